@@ -47,6 +47,35 @@ type Counter struct {
 	TotalLatency int64   `json:"total_latency"`
 	Latency      float64 `json:"latency"`
 
+	// LatencyHistogram counts the hits by latency bucket, see LatencyBuckets
+	LatencyHistogram map[string]int `json:"latency_histogram"`
+	P50Latency       float64        `json:"p50_latency"`
+	P90Latency       float64        `json:"p90_latency"`
+	P95Latency       float64        `json:"p95_latency"`
+	P99Latency       float64        `json:"p99_latency"`
+
+	// UpstreamLatencyHistogram counts the hits by upstream latency bucket, see LatencyBuckets
+	UpstreamLatencyHistogram map[string]int `json:"upstream_latency_histogram"`
+	P50UpstreamLatency       float64        `json:"p50_upstream_latency"`
+	P90UpstreamLatency       float64        `json:"p90_upstream_latency"`
+	P95UpstreamLatency       float64        `json:"p95_upstream_latency"`
+	P99UpstreamLatency       float64        `json:"p99_upstream_latency"`
+
+	// The sizes, in bytes, of the request and response bodies
+	TotalRequestSize  int64   `json:"total_request_size"`
+	MaxRequestSize    int64   `json:"max_request_size"`
+	RequestSize       float64 `json:"request_size"`
+	TotalResponseSize int64   `json:"total_response_size"`
+	MaxResponseSize   int64   `json:"max_response_size"`
+	ResponseSize      float64 `json:"response_size"`
+
+	// The apdex and SLO figures are only counted for the APIs with LatencyThresholds
+	ApdexSatisfied  int     `json:"apdex_satisfied"`
+	ApdexTolerating int     `json:"apdex_tolerating"`
+	ApdexSamples    int     `json:"apdex_samples"`
+	Apdex           float64 `json:"apdex"`
+	SLOBreaches     int     `json:"slo_breaches"`
+
 	ErrorMap  map[string]int `json:"error_map"`
 	ErrorList []ErrorData    `json:"error_list"`
 }
@@ -70,19 +99,35 @@ type AnalyticsRecordAggregate struct {
 	Geo      map[string]*Counter
 	Tags     map[string]*Counter
 
+	ErrorClasses map[string]*Counter
+
+	GraphQLOperations map[string]*Counter
+	GraphQLFields     map[string]*Counter
+
+	PortalApps map[string]*Counter
+
+	GRPCMethods  map[string]*Counter
+	GRPCStatuses map[string]*Counter
+
 	Endpoints map[string]*Counter
 
 	Lists struct {
-		APIKeys       []Counter
-		APIID         []Counter
-		OauthIDs      []Counter
-		Geo           []Counter
-		Tags          []Counter
-		Errors        []Counter
-		Endpoints     []Counter
-		KeyEndpoint   map[string][]Counter `bson:"keyendpoints"`
-		OauthEndpoint map[string][]Counter `bson:"oauthendpoints"`
-		APIEndpoint   []Counter            `bson:"apiendpoints"`
+		APIKeys           []Counter
+		APIID             []Counter
+		OauthIDs          []Counter
+		Geo               []Counter
+		Tags              []Counter
+		Errors            []Counter
+		ErrorClasses      []Counter
+		GraphQLOperations []Counter
+		GraphQLFields     []Counter
+		PortalApps        []Counter
+		GRPCMethods       []Counter
+		GRPCStatuses      []Counter
+		Endpoints         []Counter
+		KeyEndpoint       map[string][]Counter `bson:"keyendpoints"`
+		OauthEndpoint     map[string][]Counter `bson:"oauthendpoints"`
+		APIEndpoint       []Counter            `bson:"apiendpoints"`
 	}
 
 	KeyEndpoint   map[string]map[string]*Counter `bson:"keyendpoints"`
@@ -104,6 +149,12 @@ func (f AnalyticsRecordAggregate) New() AnalyticsRecordAggregate {
 	thisF.OauthIDs = make(map[string]*Counter)
 	thisF.Geo = make(map[string]*Counter)
 	thisF.Tags = make(map[string]*Counter)
+	thisF.ErrorClasses = make(map[string]*Counter)
+	thisF.GraphQLOperations = make(map[string]*Counter)
+	thisF.GraphQLFields = make(map[string]*Counter)
+	thisF.PortalApps = make(map[string]*Counter)
+	thisF.GRPCMethods = make(map[string]*Counter)
+	thisF.GRPCStatuses = make(map[string]*Counter)
 	thisF.Endpoints = make(map[string]*Counter)
 	thisF.KeyEndpoint = make(map[string]map[string]*Counter)
 	thisF.OauthEndpoint = make(map[string]map[string]*Counter)
@@ -145,6 +196,20 @@ func (f *AnalyticsRecordAggregate) generateBSONFromProperty(parent, thisUnit str
 	newUpdate["$max"].(bson.M)[constructor+"maxupstreamlatency"] = incVal.MaxUpstreamLatency
 	newUpdate["$inc"].(bson.M)[constructor+"totalupstreamlatency"] = incVal.TotalUpstreamLatency
 	newUpdate["$inc"].(bson.M)[constructor+"totallatency"] = incVal.TotalLatency
+	for k, v := range incVal.LatencyHistogram {
+		newUpdate["$inc"].(bson.M)[constructor+"latencyhistogram."+k] = v
+	}
+	for k, v := range incVal.UpstreamLatencyHistogram {
+		newUpdate["$inc"].(bson.M)[constructor+"upstreamlatencyhistogram."+k] = v
+	}
+	newUpdate["$inc"].(bson.M)[constructor+"totalrequestsize"] = incVal.TotalRequestSize
+	newUpdate["$max"].(bson.M)[constructor+"maxrequestsize"] = incVal.MaxRequestSize
+	newUpdate["$inc"].(bson.M)[constructor+"totalresponsesize"] = incVal.TotalResponseSize
+	newUpdate["$max"].(bson.M)[constructor+"maxresponsesize"] = incVal.MaxResponseSize
+	newUpdate["$inc"].(bson.M)[constructor+"apdexsatisfied"] = incVal.ApdexSatisfied
+	newUpdate["$inc"].(bson.M)[constructor+"apdextolerating"] = incVal.ApdexTolerating
+	newUpdate["$inc"].(bson.M)[constructor+"apdexsamples"] = incVal.ApdexSamples
+	newUpdate["$inc"].(bson.M)[constructor+"slobreaches"] = incVal.SLOBreaches
 
 	return newUpdate
 }
@@ -176,6 +241,46 @@ func (f *AnalyticsRecordAggregate) latencySetter(parent, thisUnit string, newUpd
 	newUpdate["$set"].(bson.M)[constructor+"latency"] = counter.Latency
 	newUpdate["$set"].(bson.M)[constructor+"upstreamlatency"] = counter.UpstreamLatency
 
+	counter.P50Latency = latencyPercentile(counter.LatencyHistogram, 0.50, counter.MaxLatency)
+	counter.P90Latency = latencyPercentile(counter.LatencyHistogram, 0.90, counter.MaxLatency)
+	counter.P95Latency = latencyPercentile(counter.LatencyHistogram, 0.95, counter.MaxLatency)
+	counter.P99Latency = latencyPercentile(counter.LatencyHistogram, 0.99, counter.MaxLatency)
+	newUpdate["$set"].(bson.M)[constructor+"p50latency"] = counter.P50Latency
+	newUpdate["$set"].(bson.M)[constructor+"p90latency"] = counter.P90Latency
+	newUpdate["$set"].(bson.M)[constructor+"p95latency"] = counter.P95Latency
+	newUpdate["$set"].(bson.M)[constructor+"p99latency"] = counter.P99Latency
+
+	counter.P50UpstreamLatency = latencyPercentile(counter.UpstreamLatencyHistogram, 0.50, counter.MaxUpstreamLatency)
+	counter.P90UpstreamLatency = latencyPercentile(counter.UpstreamLatencyHistogram, 0.90, counter.MaxUpstreamLatency)
+	counter.P95UpstreamLatency = latencyPercentile(counter.UpstreamLatencyHistogram, 0.95, counter.MaxUpstreamLatency)
+	counter.P99UpstreamLatency = latencyPercentile(counter.UpstreamLatencyHistogram, 0.99, counter.MaxUpstreamLatency)
+	newUpdate["$set"].(bson.M)[constructor+"p50upstreamlatency"] = counter.P50UpstreamLatency
+	newUpdate["$set"].(bson.M)[constructor+"p90upstreamlatency"] = counter.P90UpstreamLatency
+	newUpdate["$set"].(bson.M)[constructor+"p95upstreamlatency"] = counter.P95UpstreamLatency
+	newUpdate["$set"].(bson.M)[constructor+"p99upstreamlatency"] = counter.P99UpstreamLatency
+
+	counter.Apdex = apdexScore(counter)
+	newUpdate["$set"].(bson.M)[constructor+"apdex"] = counter.Apdex
+
+	return newUpdate
+}
+
+func (f *AnalyticsRecordAggregate) sizeSetter(parent, thisUnit string, newUpdate bson.M, counter *Counter) bson.M {
+	if counter.Hits > 0 {
+		counter.RequestSize = float64(counter.TotalRequestSize) / float64(counter.Hits)
+		counter.ResponseSize = float64(counter.TotalResponseSize) / float64(counter.Hits)
+	} else {
+		counter.RequestSize = 0.0
+		counter.ResponseSize = 0.0
+	}
+
+	constructor := parent + "." + thisUnit + "."
+	if parent == "" {
+		constructor = thisUnit + "."
+	}
+	newUpdate["$set"].(bson.M)[constructor+"requestsize"] = counter.RequestSize
+	newUpdate["$set"].(bson.M)[constructor+"responsesize"] = counter.ResponseSize
+
 	return newUpdate
 }
 
@@ -214,6 +319,30 @@ func (f *AnalyticsRecordAggregate) AsChange() bson.M {
 		newUpdate = f.generateBSONFromProperty("tags", thisUnit, incVal, newUpdate)
 	}
 
+	for thisUnit, incVal := range f.ErrorClasses {
+		newUpdate = f.generateBSONFromProperty("errorclasses", thisUnit, incVal, newUpdate)
+	}
+
+	for thisUnit, incVal := range f.GraphQLOperations {
+		newUpdate = f.generateBSONFromProperty("graphqloperations", thisUnit, incVal, newUpdate)
+	}
+
+	for thisUnit, incVal := range f.GraphQLFields {
+		newUpdate = f.generateBSONFromProperty("graphqlfields", thisUnit, incVal, newUpdate)
+	}
+
+	for thisUnit, incVal := range f.PortalApps {
+		newUpdate = f.generateBSONFromProperty("portalapps", thisUnit, incVal, newUpdate)
+	}
+
+	for thisUnit, incVal := range f.GRPCMethods {
+		newUpdate = f.generateBSONFromProperty("grpcmethods", thisUnit, incVal, newUpdate)
+	}
+
+	for thisUnit, incVal := range f.GRPCStatuses {
+		newUpdate = f.generateBSONFromProperty("grpcstatuses", thisUnit, incVal, newUpdate)
+	}
+
 	for thisUnit, incVal := range f.Endpoints {
 		newUpdate = f.generateBSONFromProperty("endpoints", thisUnit, incVal, newUpdate)
 	}
@@ -283,6 +412,7 @@ func (f *AnalyticsRecordAggregate) getRecords(fieldName string, data map[string]
 		f.SetErrorList(fieldName, thisUnit, incVal, newUpdate)
 		newUpdate = f.generateSetterForTime(fieldName, thisUnit, newTime, newUpdate)
 		newUpdate = f.latencySetter(fieldName, thisUnit, newUpdate, incVal)
+		newUpdate = f.sizeSetter(fieldName, thisUnit, newUpdate, incVal)
 		result = append(result, *incVal)
 	}
 
@@ -311,6 +441,18 @@ func (f *AnalyticsRecordAggregate) AsTimeUpdate() bson.M {
 
 	newUpdate["$set"].(bson.M)["lists.tags"] = f.getRecords("tags", f.Tags, newUpdate)
 
+	newUpdate["$set"].(bson.M)["lists.errorclasses"] = f.getRecords("errorclasses", f.ErrorClasses, newUpdate)
+
+	newUpdate["$set"].(bson.M)["lists.graphqloperations"] = f.getRecords("graphqloperations", f.GraphQLOperations, newUpdate)
+
+	newUpdate["$set"].(bson.M)["lists.graphqlfields"] = f.getRecords("graphqlfields", f.GraphQLFields, newUpdate)
+
+	newUpdate["$set"].(bson.M)["lists.portalapps"] = f.getRecords("portalapps", f.PortalApps, newUpdate)
+
+	newUpdate["$set"].(bson.M)["lists.grpcmethods"] = f.getRecords("grpcmethods", f.GRPCMethods, newUpdate)
+
+	newUpdate["$set"].(bson.M)["lists.grpcstatuses"] = f.getRecords("grpcstatuses", f.GRPCStatuses, newUpdate)
+
 	newUpdate["$set"].(bson.M)["lists.endpoints"] = f.getRecords("endpoints", f.Endpoints, newUpdate)
 
 	for thisUnit, incVal := range f.KeyEndpoint {
@@ -333,6 +475,7 @@ func (f *AnalyticsRecordAggregate) AsTimeUpdate() bson.M {
 	f.SetErrorList("", "total", &f.Total, newUpdate)
 	newUpdate = f.generateSetterForTime("", "total", newTime, newUpdate)
 	newUpdate = f.latencySetter("", "total", newUpdate, &f.Total)
+	newUpdate = f.sizeSetter("", "total", newUpdate, &f.Total)
 
 	return newUpdate
 }
@@ -355,6 +498,18 @@ func (f *AnalyticsRecordAggregate) DiscardAggregations(fields []string) {
 			f.Geo = make(map[string]*Counter)
 		case "Tags", "tags":
 			f.Tags = make(map[string]*Counter)
+		case "ErrorClasses", "errorclasses":
+			f.ErrorClasses = make(map[string]*Counter)
+		case "GraphQLOperations", "graphqloperations":
+			f.GraphQLOperations = make(map[string]*Counter)
+		case "GraphQLFields", "graphqlfields":
+			f.GraphQLFields = make(map[string]*Counter)
+		case "PortalApps", "portalapps":
+			f.PortalApps = make(map[string]*Counter)
+		case "GRPCMethods", "grpcmethods":
+			f.GRPCMethods = make(map[string]*Counter)
+		case "GRPCStatuses", "grpcstatuses":
+			f.GRPCStatuses = make(map[string]*Counter)
 		case "Endpoints", "endpoints":
 			f.Endpoints = make(map[string]*Counter)
 		case "KeyEndpoint", "keyendpint":
@@ -372,6 +527,114 @@ func (f *AnalyticsRecordAggregate) DiscardAggregations(fields []string) {
 	}
 }
 
+// LatencyBuckets are the upper bounds, in milliseconds, of the buckets the latencies are counted in to estimate their
+// percentiles. Latencies above the last bound fall in an overflow bucket.
+var LatencyBuckets = []int64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+const latencyOverflowBucket = "le_inf"
+
+// latencyBucket returns the key of the histogram bucket the latency falls in
+func latencyBucket(latency int64) string {
+	for _, bound := range LatencyBuckets {
+		if latency <= bound {
+			return "le_" + strconv.FormatInt(bound, 10)
+		}
+	}
+	return latencyOverflowBucket
+}
+
+// latencyPercentile estimates the given percentile (0 to 1) of the latencies counted in the histogram, interpolating
+// linearly inside the bucket it falls in. max is the highest latency seen, it caps the estimation and bounds the
+// overflow bucket.
+func latencyPercentile(histogram map[string]int, percentile float64, max int64) float64 {
+	total := 0
+	for _, count := range histogram {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := percentile * float64(total)
+	cumulative := 0
+	lower := int64(0)
+	for i := 0; i <= len(LatencyBuckets); i++ {
+		key, upper := latencyOverflowBucket, max
+		if i < len(LatencyBuckets) {
+			key, upper = "le_"+strconv.FormatInt(LatencyBuckets[i], 10), LatencyBuckets[i]
+		}
+
+		count := histogram[key]
+		if count > 0 && float64(cumulative+count) >= rank {
+			estimation := float64(lower) + float64(upper-lower)*(rank-float64(cumulative))/float64(count)
+			if max > 0 && estimation > float64(max) {
+				return float64(max)
+			}
+			return estimation
+		}
+		cumulative += count
+		lower = upper
+	}
+
+	return float64(max)
+}
+
+// LatencyThresholds are the latency targets of an API, used to compute its apdex score and SLO breaches
+type LatencyThresholds struct {
+	// Apdex is the apdex T threshold, in milliseconds. The requests up to T are satisfied, the ones up to 4T are
+	// tolerating and the slower or failed ones are frustrated.
+	Apdex int64 `json:"apdex" mapstructure:"apdex"`
+	// SLO is the latency objective, in milliseconds. The requests above it or failed count as SLO breaches. It
+	// defaults to the apdex threshold.
+	SLO int64 `json:"slo" mapstructure:"slo"`
+}
+
+// DefaultLatencyThresholds is the key of the thresholds used for the APIs without thresholds of their own
+const DefaultLatencyThresholds = "default"
+
+// latencyThresholdsFor returns the thresholds of the API, if any
+func latencyThresholdsFor(thresholds map[string]LatencyThresholds, apiID string) (LatencyThresholds, bool) {
+	t, ok := thresholds[apiID]
+	if !ok {
+		t, ok = thresholds[DefaultLatencyThresholds]
+	}
+	if !ok || t.Apdex <= 0 {
+		return LatencyThresholds{}, false
+	}
+	if t.SLO <= 0 {
+		t.SLO = t.Apdex
+	}
+	return t, true
+}
+
+// countApdex counts the record in the apdex and SLO figures of the counter. The requests failed with a 5xx are
+// frustrated and breach the SLO whatever their latency.
+func (t LatencyThresholds) countApdex(counter *Counter, record AnalyticsRecord) {
+	failed := record.ResponseCode >= 500
+	latency := record.Latency.Total
+
+	counter.ApdexSamples++
+	switch {
+	case failed:
+	case latency <= t.Apdex:
+		counter.ApdexSatisfied++
+	case latency <= 4*t.Apdex:
+		counter.ApdexTolerating++
+	}
+
+	if failed || latency > t.SLO {
+		counter.SLOBreaches++
+	}
+}
+
+// apdexScore returns the apdex score, from 0 to 1, of the counter. It's 0 when no request was counted.
+func apdexScore(counter *Counter) float64 {
+	if counter.ApdexSamples == 0 {
+		return 0
+	}
+	return (float64(counter.ApdexSatisfied) + float64(counter.ApdexTolerating)/2) / float64(counter.ApdexSamples)
+}
+
 func doHash(in string) string {
 	sEnc := b64.StdEncoding.EncodeToString([]byte(in))
 	search := strings.TrimRight(sEnc, "=")
@@ -404,13 +667,53 @@ func replaceUnsupportedChars(path string) string {
 	return result
 }
 
-// AggregateData calculates aggregated data, returns map orgID => aggregated analytics data
-func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList []string, storeAnalyticPerMinute bool) map[string]AnalyticsRecordAggregate {
+// AggregationDimensions are the dimensions the analytics are aggregated by by default, besides the totals
+var AggregationDimensions = []string{"apiid", "errors", "errorclasses", "versions", "apikeys", "oauthids", "geo", "tags", "endpoints", "keyendpoints", "oauthendpoints", "apiendpoints"}
+
+// OptionalAggregationDimensions are the dimensions the analytics are only aggregated by when they are configured
+var OptionalAggregationDimensions = []string{"graphqloperations", "graphqlfields", "portalapps", "grpcmethods", "grpcstatuses"}
+
+// aggregationDimensionsSet returns the set of dimensions to aggregate by, all the default ones if none is given
+func aggregationDimensionsSet(dimensions []string) map[string]bool {
+	if len(dimensions) == 0 {
+		dimensions = AggregationDimensions
+	}
+
+	validDimensions := append(append([]string{}, AggregationDimensions...), OptionalAggregationDimensions...)
+	set := make(map[string]bool)
+	for _, dimension := range dimensions {
+		dimension = strings.ToLower(dimension)
+		valid := false
+		for _, validDimension := range validDimensions {
+			if dimension == validDimension {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			log.WithFields(logrus.Fields{
+				"prefix":    MongoAggregatePrefix,
+				"dimension": dimension,
+			}).Warning("Invalid aggregation dimension. Skipping.")
+			continue
+		}
+		set[dimension] = true
+	}
+	return set
+}
+
+// AggregateData calculates aggregated data, returns map orgID => aggregated analytics data. The analytics are only
+// aggregated by the given dimensions, or by all the AggregationDimensions if none is given. The apdex and SLO figures
+// are counted for the APIs in thresholds, keyed by API ID or DefaultLatencyThresholds.
+func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList []string, storeAnalyticPerMinute bool, dimensions []string, thresholds map[string]LatencyThresholds) map[string]AnalyticsRecordAggregate {
 	analyticsPerOrg := make(map[string]AnalyticsRecordAggregate)
+	enabled := aggregationDimensionsSet(dimensions)
 
 	for _, v := range data {
 		thisV := v.(AnalyticsRecord)
 		orgID := thisV.OrgID
+		// the failed gRPC calls are answered with a 200, they're counted as the errors of their equivalent code
+		thisV.ResponseCode = thisV.GRPC.ResponseCode(thisV.ResponseCode)
 
 		if orgID == "" {
 			continue
@@ -436,6 +739,8 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 			thisAggregate.OrgID = orgID
 			thisAggregate.LastTime = thisV.TimeStamp
 			thisAggregate.Total.ErrorMap = make(map[string]int)
+			thisAggregate.Total.LatencyHistogram = make(map[string]int)
+			thisAggregate.Total.UpstreamLatencyHistogram = make(map[string]int)
 		}
 
 		// Always update the last timestamp
@@ -455,7 +760,7 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 			thisAggregate.Total.ClosedConnections += thisCounter.ClosedConnections
 			thisAggregate.Total.BytesIn += thisCounter.BytesIn
 			thisAggregate.Total.BytesOut += thisCounter.BytesOut
-			if thisV.APIID != "" {
+			if thisV.APIID != "" && enabled["apiid"] {
 				c := thisAggregate.APIID[thisV.APIID]
 				if c == nil {
 					c = &Counter{
@@ -483,6 +788,18 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 				MinLatency:           thisV.Latency.Total,
 				TotalLatency:         thisV.Latency.Total,
 				ErrorMap:             make(map[string]int),
+				LatencyHistogram:     map[string]int{latencyBucket(thisV.Latency.Total): 1},
+
+				UpstreamLatencyHistogram: map[string]int{latencyBucket(thisV.Latency.Upstream): 1},
+
+				TotalRequestSize:  thisV.ContentLength,
+				MaxRequestSize:    thisV.ContentLength,
+				TotalResponseSize: thisV.ResponseContentLength,
+				MaxResponseSize:   thisV.ResponseContentLength,
+			}
+			if t, ok := latencyThresholdsFor(thresholds, thisV.APIID); ok {
+				t.countApdex(&thisCounter, thisV)
+				t.countApdex(&thisAggregate.Total, thisV)
 			}
 			thisAggregate.Total.Hits++
 			thisAggregate.Total.TotalRequestTime += float64(thisV.RequestTime)
@@ -503,6 +820,18 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 
 			thisAggregate.Total.TotalLatency += thisV.Latency.Total
 			thisAggregate.Total.TotalUpstreamLatency += thisV.Latency.Upstream
+			thisAggregate.Total.LatencyHistogram[latencyBucket(thisV.Latency.Total)]++
+			thisAggregate.Total.UpstreamLatencyHistogram[latencyBucket(thisV.Latency.Upstream)]++
+			thisAggregate.Total.TotalRequestSize += thisV.ContentLength
+			thisAggregate.Total.TotalResponseSize += thisV.ResponseContentLength
+
+			if thisAggregate.Total.MaxRequestSize < thisV.ContentLength {
+				thisAggregate.Total.MaxRequestSize = thisV.ContentLength
+			}
+
+			if thisAggregate.Total.MaxResponseSize < thisV.ResponseContentLength {
+				thisAggregate.Total.MaxResponseSize = thisV.ResponseContentLength
+			}
 
 			if thisAggregate.Total.MaxLatency < thisV.Latency.Total {
 				thisAggregate.Total.MaxLatency = thisV.Latency.Total
@@ -544,6 +873,14 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 						for k, v := range thisCounter.ErrorMap {
 							newCounter.ErrorMap[k] = v
 						}
+						newCounter.LatencyHistogram = make(map[string]int)
+						for k, v := range thisCounter.LatencyHistogram {
+							newCounter.LatencyHistogram[k] = v
+						}
+						newCounter.UpstreamLatencyHistogram = make(map[string]int)
+						for k, v := range thisCounter.UpstreamLatencyHistogram {
+							newCounter.UpstreamLatencyHistogram[k] = v
+						}
 						c = &newCounter
 					} else {
 						c.Hits += thisCounter.Hits
@@ -576,6 +913,34 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 						c.TotalLatency += thisCounter.TotalLatency
 						c.TotalUpstreamLatency += thisCounter.TotalUpstreamLatency
 
+						if c.LatencyHistogram == nil {
+							c.LatencyHistogram = make(map[string]int)
+						}
+						for k, v := range thisCounter.LatencyHistogram {
+							c.LatencyHistogram[k] += v
+						}
+
+						if c.UpstreamLatencyHistogram == nil {
+							c.UpstreamLatencyHistogram = make(map[string]int)
+						}
+						for k, v := range thisCounter.UpstreamLatencyHistogram {
+							c.UpstreamLatencyHistogram[k] += v
+						}
+
+						c.TotalRequestSize += thisCounter.TotalRequestSize
+						c.TotalResponseSize += thisCounter.TotalResponseSize
+						if c.MaxRequestSize < thisCounter.MaxRequestSize {
+							c.MaxRequestSize = thisCounter.MaxRequestSize
+						}
+						if c.MaxResponseSize < thisCounter.MaxResponseSize {
+							c.MaxResponseSize = thisCounter.MaxResponseSize
+						}
+
+						c.ApdexSatisfied += thisCounter.ApdexSatisfied
+						c.ApdexTolerating += thisCounter.ApdexTolerating
+						c.ApdexSamples += thisCounter.ApdexSamples
+						c.SLOBreaches += thisCounter.SLOBreaches
+
 					}
 
 					return c
@@ -583,6 +948,9 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 
 				switch key {
 				case "APIID":
+					if !enabled["apiid"] {
+						break
+					}
 					c := IncrementOrSetUnit(thisAggregate.APIID[value.(string)])
 					if value.(string) != "" {
 						thisAggregate.APIID[value.(string)] = c
@@ -592,7 +960,7 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 					break
 				case "ResponseCode":
 					errAsStr := strconv.Itoa(value.(int))
-					if errAsStr != "" {
+					if errAsStr != "" && enabled["errors"] {
 						c := IncrementOrSetUnit(thisAggregate.Errors[errAsStr])
 						if c.ErrorTotal > 0 {
 							thisAggregate.Errors[errAsStr] = c
@@ -601,6 +969,9 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 					}
 					break
 				case "APIVersion":
+					if !enabled["versions"] {
+						break
+					}
 					versionStr := doHash(thisV.APIID + ":" + value.(string))
 					c := IncrementOrSetUnit(thisAggregate.Versions[versionStr])
 					if value.(string) != "" {
@@ -611,12 +982,14 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 					break
 				case "APIKey":
 					if value.(string) != "" {
-						c := IncrementOrSetUnit(thisAggregate.APIKeys[value.(string)])
-						thisAggregate.APIKeys[value.(string)] = c
-						thisAggregate.APIKeys[value.(string)].Identifier = value.(string)
-						thisAggregate.APIKeys[value.(string)].HumanIdentifier = thisV.Alias
+						if enabled["apikeys"] {
+							c := IncrementOrSetUnit(thisAggregate.APIKeys[value.(string)])
+							thisAggregate.APIKeys[value.(string)] = c
+							thisAggregate.APIKeys[value.(string)].Identifier = value.(string)
+							thisAggregate.APIKeys[value.(string)].HumanIdentifier = thisV.Alias
+						}
 
-						if thisV.TrackPath {
+						if thisV.TrackPath && enabled["keyendpoints"] {
 							keyStr := doHash(thisV.APIID + ":" + thisV.Path)
 							data := thisAggregate.KeyEndpoint[value.(string)]
 
@@ -624,7 +997,7 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 								data = make(map[string]*Counter)
 							}
 
-							c = IncrementOrSetUnit(data[keyStr])
+							c := IncrementOrSetUnit(data[keyStr])
 							c.Identifier = keyStr
 							c.HumanIdentifier = keyStr
 							data[keyStr] = c
@@ -635,11 +1008,13 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 					break
 				case "OauthID":
 					if value.(string) != "" {
-						c := IncrementOrSetUnit(thisAggregate.OauthIDs[value.(string)])
-						thisAggregate.OauthIDs[value.(string)] = c
-						thisAggregate.OauthIDs[value.(string)].Identifier = value.(string)
+						if enabled["oauthids"] {
+							c := IncrementOrSetUnit(thisAggregate.OauthIDs[value.(string)])
+							thisAggregate.OauthIDs[value.(string)] = c
+							thisAggregate.OauthIDs[value.(string)].Identifier = value.(string)
+						}
 
-						if thisV.TrackPath {
+						if thisV.TrackPath && enabled["oauthendpoints"] {
 							keyStr := doHash(thisV.APIID + ":" + thisV.Path)
 							data := thisAggregate.OauthEndpoint[value.(string)]
 
@@ -647,7 +1022,7 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 								data = make(map[string]*Counter)
 							}
 
-							c = IncrementOrSetUnit(data[keyStr])
+							c := IncrementOrSetUnit(data[keyStr])
 							c.Identifier = keyStr
 							c.HumanIdentifier = keyStr
 							data[keyStr] = c
@@ -656,6 +1031,9 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 					}
 					break
 				case "Geo":
+					if !enabled["geo"] {
+						break
+					}
 					c := IncrementOrSetUnit(thisAggregate.Geo[thisV.Geo.Country.ISOCode])
 					if thisV.Geo.Country.ISOCode != "" {
 						thisAggregate.Geo[thisV.Geo.Country.ISOCode] = c
@@ -664,7 +1042,76 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 					}
 					break
 
+				case "ErrorClass":
+					if !enabled["errorclasses"] || value.(string) == "" {
+						break
+					}
+					c := IncrementOrSetUnit(thisAggregate.ErrorClasses[value.(string)])
+					thisAggregate.ErrorClasses[value.(string)] = c
+					thisAggregate.ErrorClasses[value.(string)].Identifier = value.(string)
+					thisAggregate.ErrorClasses[value.(string)].HumanIdentifier = value.(string)
+					break
+
+				case "GraphQL":
+					if thisV.GraphQL.OperationType == "" {
+						break
+					}
+					if enabled["graphqloperations"] {
+						operation := thisV.GraphQL.OperationType
+						if thisV.GraphQL.OperationName != "" {
+							operation += ":" + thisV.GraphQL.OperationName
+						}
+						c := IncrementOrSetUnit(thisAggregate.GraphQLOperations[operation])
+						thisAggregate.GraphQLOperations[operation] = c
+						thisAggregate.GraphQLOperations[operation].Identifier = operation
+						thisAggregate.GraphQLOperations[operation].HumanIdentifier = thisV.GraphQL.OperationName
+					}
+					if enabled["graphqlfields"] {
+						for _, field := range thisV.GraphQL.RootFields {
+							fieldKey := thisV.GraphQL.OperationType + ":" + field
+							c := IncrementOrSetUnit(thisAggregate.GraphQLFields[fieldKey])
+							thisAggregate.GraphQLFields[fieldKey] = c
+							thisAggregate.GraphQLFields[fieldKey].Identifier = fieldKey
+							thisAggregate.GraphQLFields[fieldKey].HumanIdentifier = field
+						}
+					}
+					break
+
+				case "Portal":
+					if !enabled["portalapps"] || thisV.Portal.DeveloperID == "" {
+						break
+					}
+					app := replaceUnsupportedChars(thisV.Portal.AppKey())
+					c := IncrementOrSetUnit(thisAggregate.PortalApps[app])
+					thisAggregate.PortalApps[app] = c
+					thisAggregate.PortalApps[app].Identifier = thisV.Portal.AppKey()
+					thisAggregate.PortalApps[app].HumanIdentifier = thisV.Portal.Name()
+					break
+
+				case "GRPC":
+					if thisV.GRPC.Method == "" {
+						break
+					}
+					if enabled["grpcmethods"] {
+						method := thisV.GRPC.Service + "/" + thisV.GRPC.Method
+						key := replaceUnsupportedChars(method)
+						c := IncrementOrSetUnit(thisAggregate.GRPCMethods[key])
+						thisAggregate.GRPCMethods[key] = c
+						thisAggregate.GRPCMethods[key].Identifier = method
+						thisAggregate.GRPCMethods[key].HumanIdentifier = thisV.GRPC.Method
+					}
+					if enabled["grpcstatuses"] && thisV.GRPC.Status != "" {
+						c := IncrementOrSetUnit(thisAggregate.GRPCStatuses[thisV.GRPC.Status])
+						thisAggregate.GRPCStatuses[thisV.GRPC.Status] = c
+						thisAggregate.GRPCStatuses[thisV.GRPC.Status].Identifier = thisV.GRPC.Status
+						thisAggregate.GRPCStatuses[thisV.GRPC.Status].HumanIdentifier = thisV.GRPC.Status
+					}
+					break
+
 				case "Tags":
+					if !enabled["tags"] {
+						break
+					}
 					for _, thisTag := range thisV.Tags {
 						if !ignoreTag(thisTag, ignoreTagPrefixList) {
 							c := IncrementOrSetUnit(thisAggregate.Tags[thisTag])
@@ -677,15 +1124,16 @@ func AggregateData(data []interface{}, trackAllPaths bool, ignoreTagPrefixList [
 
 				case "TrackPath":
 					log.Debug("TrackPath=", value.(bool))
-					if value.(bool) {
+					if value.(bool) && enabled["endpoints"] {
 						fixedPath := replaceUnsupportedChars(thisV.Path)
 						c := IncrementOrSetUnit(thisAggregate.Endpoints[fixedPath])
 						thisAggregate.Endpoints[fixedPath] = c
 						thisAggregate.Endpoints[fixedPath].Identifier = thisV.Path
 						thisAggregate.Endpoints[fixedPath].HumanIdentifier = thisV.Path
-
+					}
+					if value.(bool) && enabled["apiendpoints"] {
 						keyStr := hex.EncodeToString([]byte(thisV.APIID + ":" + thisV.APIVersion + ":" + thisV.Path))
-						c = IncrementOrSetUnit(thisAggregate.ApiEndpoint[keyStr])
+						c := IncrementOrSetUnit(thisAggregate.ApiEndpoint[keyStr])
 						thisAggregate.ApiEndpoint[keyStr] = c
 						thisAggregate.ApiEndpoint[keyStr].Identifier = keyStr
 						thisAggregate.ApiEndpoint[keyStr].HumanIdentifier = thisV.Path
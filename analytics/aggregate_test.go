@@ -0,0 +1,150 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyPercentile(t *testing.T) {
+	histogram := map[string]int{}
+	for i := int64(1); i <= 100; i++ {
+		histogram[latencyBucket(i)]++
+	}
+
+	if p50 := latencyPercentile(histogram, 0.50, 100); p50 < 25 || p50 > 50 {
+		t.Fatal("p50 should be between 25 and 50, got", p50)
+	}
+	if p99 := latencyPercentile(histogram, 0.99, 100); p99 < 50 || p99 > 100 {
+		t.Fatal("p99 should be between 50 and 100, got", p99)
+	}
+
+	overflow := map[string]int{latencyBucket(90000): 1}
+	if p50 := latencyPercentile(overflow, 0.50, 90000); p50 > 90000 || p50 < 60000 {
+		t.Fatal("the overflow bucket percentiles should be bound by the max latency, got", p50)
+	}
+
+	if p := latencyPercentile(map[string]int{}, 0.99, 0); p != 0 {
+		t.Fatal("an empty histogram should have a 0 percentile, got", p)
+	}
+}
+
+func TestAggregateDataLatencyHistogram(t *testing.T) {
+	data := []interface{}{}
+	for i := int64(1); i <= 10; i++ {
+		data = append(data, AnalyticsRecord{
+			OrgID:        "org1",
+			APIID:        "api1",
+			ResponseCode: 200,
+			TimeStamp:    time.Now(),
+			Latency:      Latency{Total: i * 10, Upstream: i * 5},
+
+			ContentLength:         i,
+			ResponseContentLength: i * 100,
+		})
+	}
+
+	aggregate := AggregateData(data, false, nil, false, nil, nil)["org1"]
+
+	hits := 0
+	for _, count := range aggregate.APIID["api1"].LatencyHistogram {
+		hits += count
+	}
+	if hits != 10 {
+		t.Fatal("the api histogram should count all the hits, got", hits)
+	}
+	// the buckets aren't cumulative, the one of 100ms counts the hits from 60 to 100ms
+	if aggregate.Total.LatencyHistogram[latencyBucket(100)] != 5 {
+		t.Fatal("the total histogram should count the hits from 60 to 100ms in the bucket of 100ms, got", aggregate.Total.LatencyHistogram)
+	}
+
+	aggregate.AsTimeUpdate()
+	if aggregate.Total.P99Latency <= aggregate.Total.P50Latency || aggregate.Total.P99Latency > 100 {
+		t.Fatal("unexpected percentiles:", aggregate.Total.P50Latency, aggregate.Total.P99Latency)
+	}
+	if aggregate.Total.P99UpstreamLatency <= aggregate.Total.P50UpstreamLatency || aggregate.Total.P99UpstreamLatency > 50 {
+		t.Fatal("unexpected upstream percentiles:", aggregate.Total.P50UpstreamLatency, aggregate.Total.P99UpstreamLatency)
+	}
+	if api1 := aggregate.APIID["api1"]; api1.TotalRequestSize != 55 || api1.MaxResponseSize != 1000 || api1.ResponseSize != 550 {
+		t.Fatal("unexpected sizes:", api1.TotalRequestSize, api1.MaxResponseSize, api1.ResponseSize)
+	}
+	if api1 := aggregate.APIID["api1"]; api1.P99UpstreamLatency > api1.P99Latency {
+		t.Fatal("the upstream latency percentiles should be tracked separately from the total ones")
+	}
+}
+
+func TestAggregateDataDimensions(t *testing.T) {
+	data := []interface{}{
+		AnalyticsRecord{
+			OrgID:        "org1",
+			APIID:        "api1",
+			APIKey:       "key1",
+			Path:         "/get",
+			TrackPath:    true,
+			ResponseCode: 500,
+			TimeStamp:    time.Now(),
+		},
+	}
+
+	aggregate := AggregateData(data, false, nil, false, nil, nil)["org1"]
+	if len(aggregate.APIID) != 1 || len(aggregate.APIKeys) != 1 || len(aggregate.KeyEndpoint) != 1 || len(aggregate.Errors) != 1 {
+		t.Fatal("expected all the dimensions to be aggregated by default")
+	}
+
+	aggregate = AggregateData(data, false, nil, false, []string{"apiid", "keyendpoints"}, nil)["org1"]
+	if len(aggregate.APIID) != 1 || len(aggregate.KeyEndpoint) != 1 {
+		t.Fatal("expected the apiid and keyendpoints dimensions to be aggregated")
+	}
+	if len(aggregate.APIKeys) != 0 || len(aggregate.Errors) != 0 || len(aggregate.Endpoints) != 0 {
+		t.Fatal("expected the rest of the dimensions not to be aggregated")
+	}
+	if aggregate.Total.Hits != 1 || aggregate.Total.ErrorTotal != 1 {
+		t.Fatal("expected the totals to be aggregated regardless of the dimensions")
+	}
+}
+
+func TestAggregateDataApdex(t *testing.T) {
+	data := []interface{}{}
+	for _, latency := range []int64{50, 100, 300, 1000} {
+		data = append(data, AnalyticsRecord{
+			OrgID:        "org1",
+			APIID:        "api1",
+			ResponseCode: 200,
+			TimeStamp:    time.Now(),
+			Latency:      Latency{Total: latency},
+		})
+	}
+	data = append(data, AnalyticsRecord{
+		OrgID:        "org1",
+		APIID:        "api1",
+		ResponseCode: 503,
+		TimeStamp:    time.Now(),
+		Latency:      Latency{Total: 10},
+	}, AnalyticsRecord{
+		OrgID:        "org1",
+		APIID:        "api2",
+		ResponseCode: 200,
+		TimeStamp:    time.Now(),
+		Latency:      Latency{Total: 10},
+	})
+
+	thresholds := map[string]LatencyThresholds{"api1": {Apdex: 100, SLO: 250}}
+	aggregate := AggregateData(data, false, nil, false, nil, thresholds)["org1"]
+	aggregate.AsTimeUpdate()
+
+	api1 := aggregate.APIID["api1"]
+	if api1.ApdexSatisfied != 2 || api1.ApdexTolerating != 1 || api1.ApdexSamples != 5 {
+		t.Fatal("unexpected apdex counts:", api1.ApdexSatisfied, api1.ApdexTolerating, api1.ApdexSamples)
+	}
+	if api1.Apdex != 0.5 {
+		t.Fatal("expected an apdex of 0.5, got", api1.Apdex)
+	}
+	if api1.SLOBreaches != 3 {
+		t.Fatal("expected 3 SLO breaches, got", api1.SLOBreaches)
+	}
+	if api2 := aggregate.APIID["api2"]; api2.ApdexSamples != 0 {
+		t.Fatal("expected no apdex samples for an API without thresholds, got", api2.ApdexSamples)
+	}
+	if aggregate.Total.ApdexSamples != 5 || aggregate.Total.Apdex != 0.5 {
+		t.Fatal("unexpected total apdex:", aggregate.Total.ApdexSamples, aggregate.Total.Apdex)
+	}
+}
@@ -26,35 +26,45 @@ type Latency struct {
 
 // AnalyticsRecord encodes the details of a request
 type AnalyticsRecord struct {
-	Method        string       `json:"method"`
-	Host          string       `json:"host"`
-	Path          string       `json:"path"`
-	RawPath       string       `json:"raw_path"`
-	ContentLength int64        `json:"content_length"`
-	UserAgent     string       `json:"user_agent"`
-	Day           int          `json:"day"`
-	Month         time.Month   `json:"month"`
-	Year          int          `json:"year"`
-	Hour          int          `json:"hour"`
-	ResponseCode  int          `json:"response_code"`
-	APIKey        string       `json:"api_key"`
-	TimeStamp     time.Time    `json:"timestamp"`
-	APIVersion    string       `json:"api_version"`
-	APIName       string       `json:"api_name"`
-	APIID         string       `json:"api_id"`
-	OrgID         string       `json:"org_id"`
-	OauthID       string       `json:"oauth_id"`
-	RequestTime   int64        `json:"request_time"`
-	RawRequest    string       `json:"raw_request"`
-	RawResponse   string       `json:"raw_response"`
-	IPAddress     string       `json:"ip_address"`
-	Geo           GeoData      `json:"geo"`
-	Network       NetworkStats `json:"network_stats"`
-	Latency       Latency      `json:"latency"`
-	Tags          []string     `json:"tags"`
-	Alias         string       `json:"alias"`
-	TrackPath     bool         `json:"track_path"`
-	ExpireAt      time.Time    `bson:"expireAt" json:"expireAt"`
+	Method                string                 `json:"method"`
+	Host                  string                 `json:"host"`
+	Path                  string                 `json:"path"`
+	RawPath               string                 `json:"raw_path"`
+	ContentLength         int64                  `json:"content_length"`
+	ResponseContentLength int64                  `json:"response_content_length"`
+	UserAgent             string                 `json:"user_agent"`
+	Day                   int                    `json:"day"`
+	Month                 time.Month             `json:"month"`
+	Year                  int                    `json:"year"`
+	Hour                  int                    `json:"hour"`
+	ResponseCode          int                    `json:"response_code"`
+	APIKey                string                 `json:"api_key"`
+	TimeStamp             time.Time              `json:"timestamp"`
+	APIVersion            string                 `json:"api_version"`
+	APIName               string                 `json:"api_name"`
+	APIID                 string                 `json:"api_id"`
+	OrgID                 string                 `json:"org_id"`
+	OauthID               string                 `json:"oauth_id"`
+	RequestTime           int64                  `json:"request_time"`
+	RawRequest            string                 `json:"raw_request"`
+	RawResponse           string                 `json:"raw_response"`
+	IPAddress             string                 `json:"ip_address"`
+	Geo                   GeoData                `json:"geo"`
+	Network               NetworkStats           `json:"network_stats"`
+	Latency               Latency                `json:"latency"`
+	Tags                  []string               `json:"tags"`
+	Alias                 string                 `json:"alias"`
+	TrackPath             bool                   `json:"track_path"`
+	ExpireAt              time.Time              `bson:"expireAt" json:"expireAt"`
+	ErrorClass            string                 `json:"error_class"`
+	GraphQL               GraphQLStats           `json:"graphql"`
+	Portal                PortalApp              `json:"portal"`
+	TraceID               string                 `json:"trace_id"`
+	SpanID                string                 `json:"span_id"`
+	CorrelationID         string                 `json:"correlation_id"`
+	ResponseHeaders       map[string]string      `json:"response_headers"`
+	BodyFields            map[string]interface{} `json:"body_fields"`
+	GRPC                  GRPCStats              `json:"grpc"`
 }
 
 type GeoData struct {
@@ -129,7 +139,13 @@ func (a *AnalyticsRecord) GetFieldNames() []string {
 	fields = append(fields, a.Geo.GetFieldNames()...)
 	fields = append(fields, a.Network.GetFieldNames()...)
 	fields = append(fields, a.Latency.GetFieldNames()...)
-	return append(fields, "Tags", "Alias", "TrackPath", "ExpireAt")
+	fields = append(fields, "Tags", "Alias", "TrackPath", "ExpireAt", "ErrorClass")
+	fields = append(fields, "GraphQL.OperationName", "GraphQL.OperationType", "GraphQL.RootFields")
+	fields = append(fields, "Portal.DeveloperID", "Portal.DeveloperEmail", "Portal.App")
+	fields = append(fields, "TraceID", "SpanID", "CorrelationID", "ResponseHeaders", "BodyFields")
+	fields = append(fields, "GRPC.Service", "GRPC.Method", "GRPC.Status")
+	// the columns are appended as they're added, so the existing CSV files keep their order
+	return append(fields, "ResponseContentLength")
 }
 
 func (n *NetworkStats) GetLineValues() []string {
@@ -194,5 +210,12 @@ func (a *AnalyticsRecord) GetLineValues() []string {
 	fields = append(fields, a.Alias)
 	fields = append(fields, strconv.FormatBool(a.TrackPath))
 	fields = append(fields, a.ExpireAt.String())
+	fields = append(fields, a.ErrorClass)
+	fields = append(fields, a.GraphQL.OperationName, a.GraphQL.OperationType, strings.Join(a.GraphQL.RootFields, ";"))
+	fields = append(fields, a.Portal.DeveloperID, a.Portal.DeveloperEmail, a.Portal.App)
+	fields = append(fields, a.TraceID, a.SpanID, a.CorrelationID, formatHeaders(a.ResponseHeaders))
+	fields = append(fields, formatBodyFields(a.BodyFields))
+	fields = append(fields, a.GRPC.Service, a.GRPC.Method, a.GRPC.Status)
+	fields = append(fields, strconv.FormatUint(uint64(a.ResponseContentLength), 10))
 	return fields
 }
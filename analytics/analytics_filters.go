@@ -1,5 +1,7 @@
 package analytics
 
+import "time"
+
 type AnalyticsFilters struct {
 	OrgsIDs              []string `json:"org_ids"`
 	APIIDs               []string `json:"api_ids"`
@@ -7,6 +9,9 @@ type AnalyticsFilters struct {
 	SkippedOrgsIDs       []string `json:"skip_org_ids"`
 	SkippedAPIIDs        []string `json:"skip_api_ids"`
 	SkippedResponseCodes []int    `json:"skip_response_codes"`
+	// MaxRecordAge is the age in seconds over which the records are stale and dropped, so a backlog processed after an
+	// outage doesn't flood the backend with old records. 0 keeps the records of any age.
+	MaxRecordAge int `json:"max_record_age"`
 }
 
 func (filters AnalyticsFilters) ShouldFilter(record AnalyticsRecord) bool {
@@ -34,6 +39,11 @@ func (filters AnalyticsFilters) HasFilter() bool {
 	return true
 }
 
+// IsStale returns whether the record is older than MaxRecordAge at now, when it's set
+func (filters AnalyticsFilters) IsStale(record AnalyticsRecord, now time.Time) bool {
+	return filters.MaxRecordAge > 0 && now.Sub(record.TimeStamp) > time.Duration(filters.MaxRecordAge)*time.Second
+}
+
 func stringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
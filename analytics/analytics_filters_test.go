@@ -1,6 +1,9 @@
 package analytics
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestShouldFilter(t *testing.T) {
 	record := AnalyticsRecord{
@@ -116,3 +119,18 @@ func TestHasFilter(t *testing.T) {
 	}
 
 }
+
+func TestIsStale(t *testing.T) {
+	now := time.Now()
+	record := AnalyticsRecord{TimeStamp: now.Add(-2 * time.Hour)}
+
+	if (AnalyticsFilters{}).IsStale(record, now) {
+		t.Fatal("records of any age should be kept without max_record_age")
+	}
+	if !(AnalyticsFilters{MaxRecordAge: 3600}).IsStale(record, now) {
+		t.Fatal("the record older than max_record_age should be stale")
+	}
+	if (AnalyticsFilters{MaxRecordAge: 3 * 3600}).IsStale(record, now) {
+		t.Fatal("the record newer than max_record_age shouldn't be stale")
+	}
+}
@@ -0,0 +1,17 @@
+package analytics
+
+import "testing"
+
+func TestGetLineValues(t *testing.T) {
+	record := AnalyticsRecord{ContentLength: 10, ResponseContentLength: 20}
+	names, values := record.GetFieldNames(), record.GetLineValues()
+	if len(names) != len(values) {
+		t.Fatalf("expected as many values as field names, got %d and %d", len(values), len(names))
+	}
+	if names[4] != "ContentLength" || names[5] != "UserAgent" {
+		t.Error("expected the existing columns to keep their order, got", names[:6])
+	}
+	if last := len(names) - 1; names[last] != "ResponseContentLength" || values[last] != "20" {
+		t.Errorf("expected the response size to be the last column, got %s=%s", names[last], values[last])
+	}
+}
@@ -0,0 +1,232 @@
+package analytics
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAnomalyWindow     = 60
+	defaultAnomalyAlpha      = 0.1
+	defaultAnomalyThreshold  = 3
+	defaultAnomalyMinRecords = 20
+	defaultAnomalyWarmUp     = 10
+
+	// AnomalyTag is the tag of the records of an API when its error rate or its latency is anomalous, along with
+	// the tag of the metric
+	AnomalyTag          = "anomaly"
+	AnomalyErrorRateTag = "anomaly-error-rate"
+	AnomalyLatencyTag   = "anomaly-latency"
+
+	// the metrics checked for anomalies
+	AnomalyErrorRate = "error_rate"
+	AnomalyLatency   = "latency"
+
+	// minLatencyStdDev is the lowest standard deviation of the latency, in ms, so a steady API isn't anomalous as soon
+	// as its latency moves a little
+	minLatencyStdDev = 1
+)
+
+// AnomalyConfig configures the detection of the anomalies of the error rate and the latency of the APIs. The records
+// of every API are counted in windows of time, and the error rate and the mean latency of the window are compared to
+// their exponentially weighted moving average and standard deviation over the previous windows.
+type AnomalyConfig struct {
+	Enabled bool `json:"enabled"`
+	// Window is the length in seconds of the windows the records are counted in, 60 by default
+	Window int `json:"window"`
+	// Alpha is the smoothing factor of the moving averages, between 0 and 1, 0.1 by default. The higher it is, the
+	// quicker the averages follow the changes.
+	Alpha float64 `json:"alpha"`
+	// Threshold is the z-score above which the error rate or the latency of a window is anomalous, 3 by default
+	Threshold float64 `json:"threshold"`
+	// MinRecords is how many records a window must have before it's checked, 20 by default
+	MinRecords int `json:"min_records"`
+	// WarmUp is how many windows of an API are averaged before its anomalies are detected, 10 by default
+	WarmUp int `json:"warm_up"`
+	// AlertURL is the webhook the anomalies are posted to, as JSON, once per window and metric
+	AlertURL     string            `json:"alert_url"`
+	AlertHeaders map[string]string `json:"alert_headers"`
+}
+
+// Validate checks the smoothing factor and the threshold
+func (c AnomalyConfig) Validate() error {
+	if c.Alpha < 0 || c.Alpha > 1 {
+		return errors.New("alpha must be between 0 and 1")
+	}
+	if c.Threshold < 0 {
+		return errors.New("threshold can't be negative")
+	}
+	return nil
+}
+
+// Anomaly is an anomalous error rate or latency of an API in a window
+type Anomaly struct {
+	OrgID  string `json:"org_id"`
+	APIID  string `json:"api_id"`
+	Metric string `json:"metric"`
+	// Value is the error rate or the mean latency in ms of the window so far, and Mean and StdDev the ones of the
+	// previous windows
+	Value       float64   `json:"value"`
+	Mean        float64   `json:"mean"`
+	StdDev      float64   `json:"std_dev"`
+	ZScore      float64   `json:"z_score"`
+	Records     int       `json:"records"`
+	WindowStart time.Time `json:"window_start"`
+}
+
+// ewma is an exponentially weighted moving average, with its variance
+type ewma struct {
+	mean     float64
+	variance float64
+}
+
+func (e *ewma) add(value, alpha float64, first bool) {
+	if first {
+		e.mean = value
+		return
+	}
+	diff := value - e.mean
+	e.mean += alpha * diff
+	e.variance = (1 - alpha) * (e.variance + alpha*diff*diff)
+}
+
+// zScore returns how many standard deviations the value is above the mean, with the standard deviation at least
+// minStdDev, the one expected from the number of records of the window
+func (e *ewma) zScore(value, minStdDev float64) (float64, float64) {
+	stdDev := math.Max(math.Sqrt(e.variance), minStdDev)
+	return (value - e.mean) / stdDev, stdDev
+}
+
+// apiAnomalies are the window and the moving averages of an API
+type apiAnomalies struct {
+	windowStart time.Time
+	records     int
+	errors      int
+	latency     int64
+	// alerted are the metrics already found anomalous in the window
+	alerted map[string]bool
+
+	windows   int
+	errorRate ewma
+	latencyMs ewma
+}
+
+// AnomalyDetector detects the anomalies of the APIs in the stream of records
+type AnomalyDetector struct {
+	conf   AnomalyConfig
+	window time.Duration
+
+	mu   sync.Mutex
+	apis map[string]*apiAnomalies
+}
+
+// NewAnomalyDetector returns a detector with the defaults of the configuration set
+func NewAnomalyDetector(conf AnomalyConfig) *AnomalyDetector {
+	if conf.Window <= 0 {
+		conf.Window = defaultAnomalyWindow
+	}
+	if conf.Alpha == 0 {
+		conf.Alpha = defaultAnomalyAlpha
+	}
+	if conf.Threshold == 0 {
+		conf.Threshold = defaultAnomalyThreshold
+	}
+	if conf.MinRecords <= 0 {
+		conf.MinRecords = defaultAnomalyMinRecords
+	}
+	if conf.WarmUp <= 0 {
+		conf.WarmUp = defaultAnomalyWarmUp
+	}
+	return &AnomalyDetector{
+		conf:   conf,
+		window: time.Duration(conf.Window) * time.Second,
+		apis:   map[string]*apiAnomalies{},
+	}
+}
+
+// Detect counts the record in the window of its API, and tags it when the window is anomalous so far. The anomalies
+// found in the window for the first time are returned. The records older than the window of their API are counted in
+// it.
+func (d *AnomalyDetector) Detect(record *AnalyticsRecord) []Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	api, ok := d.apis[record.APIID]
+	if !ok {
+		api = &apiAnomalies{}
+		d.apis[record.APIID] = api
+	}
+	windowStart := record.TimeStamp.Truncate(d.window)
+	if windowStart.After(api.windowStart) {
+		d.closeWindow(api)
+		api.windowStart = windowStart
+	}
+
+	api.records++
+	if record.ResponseCode >= http.StatusInternalServerError {
+		api.errors++
+	}
+	api.latency += recordLatency(record)
+	if api.records < d.conf.MinRecords || api.windows < d.conf.WarmUp {
+		return nil
+	}
+
+	var anomalies []Anomaly
+	check := func(metric, tag string, value float64, average *ewma, minStdDev float64) {
+		z, stdDev := average.zScore(value, minStdDev)
+		if z <= d.conf.Threshold {
+			return
+		}
+		record.Tags = appendTag(appendTag(record.Tags, AnomalyTag), tag)
+		if api.alerted[metric] {
+			return
+		}
+		api.alerted[metric] = true
+		anomalies = append(anomalies, Anomaly{
+			OrgID:       record.OrgID,
+			APIID:       record.APIID,
+			Metric:      metric,
+			Value:       value,
+			Mean:        average.mean,
+			StdDev:      stdDev,
+			ZScore:      z,
+			Records:     api.records,
+			WindowStart: api.windowStart,
+		})
+	}
+	check(AnomalyErrorRate, AnomalyErrorRateTag, float64(api.errors)/float64(api.records), &api.errorRate,
+		errorRateStdDev(api.errorRate.mean, api.records))
+	check(AnomalyLatency, AnomalyLatencyTag, float64(api.latency)/float64(api.records), &api.latencyMs, minLatencyStdDev)
+	return anomalies
+}
+
+// errorRateStdDev returns the standard deviation of the error rate of the records of a window, when the error rate
+// of the API is rate, or 1/records for the APIs without errors, so a few errors in a window aren't anomalous
+func errorRateStdDev(rate float64, records int) float64 {
+	rate = math.Max(rate, 1/float64(records))
+	return math.Sqrt(rate * (1 - rate) / float64(records))
+}
+
+// closeWindow adds the error rate and the mean latency of the window to the moving averages, when it has enough
+// records, and starts a new window
+func (d *AnomalyDetector) closeWindow(api *apiAnomalies) {
+	if api.records >= d.conf.MinRecords {
+		first := api.windows == 0
+		api.errorRate.add(float64(api.errors)/float64(api.records), d.conf.Alpha, first)
+		api.latencyMs.add(float64(api.latency)/float64(api.records), d.conf.Alpha, first)
+		api.windows++
+	}
+	api.records, api.errors, api.latency = 0, 0, 0
+	api.alerted = map[string]bool{}
+}
+
+// recordLatency returns the total latency of the record in ms, or its request time when the latency isn't recorded
+func recordLatency(record *AnalyticsRecord) int64 {
+	if record.Latency.Total > 0 {
+		return record.Latency.Total
+	}
+	return record.RequestTime
+}
@@ -0,0 +1,82 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnomalyDetector(t *testing.T) {
+	detector := NewAnomalyDetector(AnomalyConfig{Enabled: true, Window: 60, MinRecords: 10, WarmUp: 3})
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// a steady API: 10% of errors and 100ms of latency
+	window := func(i, records, errorsEvery int, latency int64) ([]AnalyticsRecord, []Anomaly) {
+		var all []Anomaly
+		var recs []AnalyticsRecord
+		for j := 0; j < records; j++ {
+			record := AnalyticsRecord{OrgID: "org", APIID: "api", ResponseCode: 200, TimeStamp: start.Add(time.Duration(i) * time.Minute)}
+			record.Latency.Total = latency + int64(j%3)
+			if errorsEvery > 0 && j%errorsEvery == 0 {
+				record.ResponseCode = 500
+			}
+			all = append(all, detector.Detect(&record)...)
+			recs = append(recs, record)
+		}
+		return recs, all
+	}
+
+	for i := 0; i < 5; i++ {
+		if records, anomalies := window(i, 20, 10, 100); len(anomalies) != 0 || len(records[19].Tags) != 0 {
+			t.Fatalf("expected no anomaly in the steady window %d, got %+v", i, anomalies)
+		}
+	}
+
+	records, anomalies := window(5, 20, 2, 100)
+	if len(anomalies) != 1 || anomalies[0].Metric != AnomalyErrorRate || anomalies[0].APIID != "api" {
+		t.Fatalf("expected one error rate anomaly, got %+v", anomalies)
+	}
+	if anomalies[0].Value != 0.5 || anomalies[0].Records != 10 || !anomalies[0].WindowStart.Equal(start.Add(5*time.Minute)) {
+		t.Errorf("unexpected anomaly %+v", anomalies[0])
+	}
+	if len(records[8].Tags) != 0 {
+		t.Error("expected the records before the window has enough records not to be tagged")
+	}
+	last := records[19].Tags
+	if len(last) != 2 || last[0] != AnomalyTag || last[1] != AnomalyErrorRateTag {
+		t.Errorf("expected the record of the anomalous window to be tagged, got %v", last)
+	}
+
+	_, anomalies = window(6, 20, 10, 1000)
+	if len(anomalies) != 1 || anomalies[0].Metric != AnomalyLatency || anomalies[0].Value < 1000 {
+		t.Fatalf("expected one latency anomaly, got %+v", anomalies)
+	}
+
+	// the windows of other APIs are independent, and warm up on their own
+	other := AnalyticsRecord{APIID: "other", ResponseCode: 500, TimeStamp: start.Add(7 * time.Minute)}
+	for i := 0; i < 20; i++ {
+		if anomalies := detector.Detect(&other); len(anomalies) != 0 {
+			t.Fatal("expected no anomaly before the warm up", anomalies)
+		}
+	}
+}
+
+func TestAnomalyConfigValidate(t *testing.T) {
+	if err := (AnomalyConfig{Alpha: 0.5, Threshold: 2}).Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (AnomalyConfig{Alpha: 2}).Validate(); err == nil {
+		t.Error("expected an alpha above 1 to be invalid")
+	}
+}
+
+func TestErrorRateStdDev(t *testing.T) {
+	// without errors, 3 errors in 20 records are anomalous, not 2
+	z, _ := (&ewma{}).zScore(2.0/20, errorRateStdDev(0, 20))
+	if z > 3 {
+		t.Error("expected 2 errors not to be anomalous, got a z-score of", z)
+	}
+	z, _ = (&ewma{}).zScore(3.0/20, errorRateStdDev(0, 20))
+	if z <= 3 {
+		t.Error("expected 3 errors to be anomalous, got a z-score of", z)
+	}
+}
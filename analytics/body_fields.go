@@ -0,0 +1,199 @@
+package analytics
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// BodyFieldsConfig configures the extraction of fields of the JSON request bodies into the records, so business
+// metrics can be derived from them without storing the bodies
+type BodyFieldsConfig struct {
+	Fields []BodyField `json:"fields"`
+}
+
+// BodyField is a field extracted from the request bodies
+type BodyField struct {
+	// Name is the name of the field in the body fields of the records, like order.amount
+	Name string `json:"name"`
+	// Path is the JSONPath of the value in the body, like $.order.amount, $.items[0].sku or $['tenant-id']
+	Path string `json:"path"`
+	// APIIDs are the APIs whose requests have the field. When empty, the requests of any API are looked up.
+	APIIDs []string `json:"api_ids"`
+}
+
+// jsonPathStep is a step of a JSONPath: the key of an object, or the index of an array when key is empty
+type jsonPathStep struct {
+	key   string
+	index int
+}
+
+type bodyField struct {
+	name   string
+	path   []jsonPathStep
+	apiIDs []string
+}
+
+// BodyFieldExtractor extracts the fields configured by a BodyFieldsConfig
+type BodyFieldExtractor struct {
+	fields []bodyField
+}
+
+// NewBodyFieldExtractor returns the extractor of the fields, with their paths parsed
+func NewBodyFieldExtractor(conf BodyFieldsConfig) (*BodyFieldExtractor, error) {
+	e := &BodyFieldExtractor{}
+	names := map[string]bool{}
+	for _, field := range conf.Fields {
+		if field.Name == "" {
+			return nil, errors.New("a body field has no name")
+		}
+		if names[field.Name] {
+			return nil, fmt.Errorf("duplicate body field %q", field.Name)
+		}
+		names[field.Name] = true
+
+		path, err := parseJSONPath(field.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path of the body field %q: %v", field.Name, err)
+		}
+		e.fields = append(e.fields, bodyField{name: field.Name, path: path, apiIDs: field.APIIDs})
+	}
+	return e, nil
+}
+
+// Extract sets the body fields of the record from its JSON raw request, so they're only known when the detailed
+// recording is enabled. Objects and arrays are set as JSON, and the fields missing from the body aren't set.
+func (e *BodyFieldExtractor) Extract(record *AnalyticsRecord, raw *RawRecord) {
+	if record.RawRequest == "" || len(record.BodyFields) > 0 {
+		return
+	}
+
+	var fields []bodyField
+	for _, field := range e.fields {
+		if len(field.apiIDs) == 0 || stringInSlice(record.APIID, field.apiIDs) {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		return
+	}
+
+	req, body, err := raw.Request()
+	if err != nil || len(body) == 0 {
+		return
+	}
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+			return
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return
+	}
+
+	values := map[string]interface{}{}
+	for _, field := range fields {
+		if value, ok := jsonPathValue(document, field.path); ok {
+			values[field.name] = value
+		}
+	}
+	if len(values) > 0 {
+		record.BodyFields = values
+	}
+}
+
+// formatBodyFields formats the body fields as name:value pairs sorted by name and separated by semicolons
+func formatBodyFields(fields map[string]interface{}) string {
+	values := make(map[string]string, len(fields))
+	for name, value := range fields {
+		values[name] = fmt.Sprint(value)
+	}
+	return formatHeaders(values)
+}
+
+// parseJSONPath parses the JSONPath of a single value, made of the root $ followed by .key, ['key'] or [index] steps
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, errors.New("the path must start with $")
+	}
+	rest := path[1:]
+	steps := []jsonPathStep{}
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" || key == "*" {
+				return nil, fmt.Errorf("invalid key at %q", rest)
+			}
+			steps = append(steps, jsonPathStep{key: key})
+			rest = rest[end+1:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed bracket at %q", rest)
+			}
+			selector := rest[1:end]
+			if len(selector) > 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0] {
+				steps = append(steps, jsonPathStep{key: selector[1 : len(selector)-1]})
+			} else if index, err := strconv.Atoi(selector); err == nil && index >= 0 {
+				steps = append(steps, jsonPathStep{index: index})
+			} else {
+				return nil, fmt.Errorf("invalid selector %q", selector)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest)
+		}
+	}
+	return steps, nil
+}
+
+// jsonPathValue returns the value of the path in the decoded JSON document. The numbers are int64 when they're
+// integers, float64 otherwise, and the objects and arrays are encoded as JSON.
+func jsonPathValue(document interface{}, path []jsonPathStep) (interface{}, bool) {
+	value := document
+	for _, step := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if step.key == "" {
+				return nil, false
+			}
+			var ok bool
+			if value, ok = v[step.key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			if step.key != "" || step.index >= len(v) {
+				return nil, false
+			}
+			value = v[step.index]
+		default:
+			return nil, false
+		}
+	}
+
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, true
+		}
+		f, err := v.Float64()
+		return f, err == nil
+	case map[string]interface{}, []interface{}:
+		encoded, err := json.Marshal(v)
+		return string(encoded), err == nil
+	}
+	return value, value != nil
+}
@@ -0,0 +1,70 @@
+package analytics
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestBodyFieldExtractor(t *testing.T) {
+	e, err := NewBodyFieldExtractor(BodyFieldsConfig{Fields: []BodyField{
+		{Name: "order.amount", Path: "$.order.amount"},
+		{Name: "order.currency", Path: "$['order'][\"currency\"]"},
+		{Name: "sku", Path: "$.order.items[1].sku"},
+		{Name: "items", Path: "$.order.items"},
+		{Name: "tenant.id", Path: "$.tenant-id"},
+		{Name: "missing", Path: "$.order.discount"},
+		{Name: "other", Path: "$.amount", APIIDs: []string{"api2"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"order": {"amount": 12.5, "currency": "EUR", "items": [{"sku": "a"}, {"sku": "b"}]}, "tenant-id": 42, "amount": 1}`
+	encode := func(contentType string) string {
+		rawRequest := fmt.Sprintf("POST /orders HTTP/1.1\r\nHost: example.com\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s",
+			contentType, len(body), body)
+		return base64.StdEncoding.EncodeToString([]byte(rawRequest))
+	}
+	record := AnalyticsRecord{APIID: "api1", RawRequest: encode("application/json; charset=utf-8")}
+	e.Extract(&record, NewRawRecord(&record))
+
+	expected := map[string]interface{}{
+		"order.amount":   12.5,
+		"order.currency": "EUR",
+		"sku":            "b",
+		"items":          `[{"sku":"a"},{"sku":"b"}]`,
+		"tenant.id":      int64(42),
+	}
+	if !reflect.DeepEqual(record.BodyFields, expected) {
+		t.Errorf("expected the body fields %v, got %v", expected, record.BodyFields)
+	}
+
+	text := AnalyticsRecord{RawRequest: encode("text/plain")}
+	e.Extract(&text, NewRawRecord(&text))
+	if text.BodyFields != nil {
+		t.Errorf("expected the fields of a text body not to be extracted, got %v", text.BodyFields)
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	path, err := parseJSONPath("$.a['b.c'][2]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []jsonPathStep{{key: "a"}, {key: "b.c"}, {index: 2}}
+	if !reflect.DeepEqual(path, expected) {
+		t.Errorf("expected %v, got %v", expected, path)
+	}
+
+	for _, invalid := range []string{"a.b", "$.", "$.a[", "$.a[-1]", "$.*", "$['']", "$a"} {
+		if _, err := parseJSONPath(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+
+	if _, err := NewBodyFieldExtractor(BodyFieldsConfig{Fields: []BodyField{{Name: "a", Path: "$.a"}, {Name: "a", Path: "$.b"}}}); err == nil {
+		t.Error("expected the duplicate names to be invalid")
+	}
+}
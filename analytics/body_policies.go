@@ -0,0 +1,150 @@
+package analytics
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// The actions of the body policies
+const (
+	BodyStore    = "store"
+	BodyTruncate = "truncate"
+	BodyDrop     = "drop"
+	BodyHash     = "hash"
+)
+
+// BodyPoliciesConfig configures what is kept of the bodies of the raw requests and responses by their content type,
+// so the records don't carry uploads or images but keep the bodies useful for debugging
+type BodyPoliciesConfig struct {
+	// Rules are the policies of the content types, the first one matching a body applies
+	Rules []BodyPolicy `json:"rules"`
+	// Default is the policy of the bodies matching no rule, store by default
+	Default BodyPolicy `json:"default"`
+}
+
+// BodyPolicy is the action applied to the bodies with some content types
+type BodyPolicy struct {
+	// ContentTypes are media types, like application/json, or types followed by /*, like image/*
+	ContentTypes []string `json:"content_types"`
+	// Action is store, truncate, drop or hash. The hashed bodies are replaced by sha256: and their hex SHA-256.
+	Action string `json:"action"`
+	// MaxBytes is the size the bodies are truncated to
+	MaxBytes int `json:"max_bytes"`
+}
+
+// Enabled returns whether any body is changed
+func (c BodyPoliciesConfig) Enabled() bool {
+	return len(c.Rules) > 0 || (c.Default.Action != "" && c.Default.Action != BodyStore)
+}
+
+// Validate checks the actions and the content types of the rules
+func (c BodyPoliciesConfig) Validate() error {
+	for i, rule := range c.Rules {
+		if len(rule.ContentTypes) == 0 {
+			return fmt.Errorf("the rule %d has no content types", i)
+		}
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("the rule %d is invalid: %v", i, err)
+		}
+	}
+	if err := c.Default.validate(); err != nil {
+		return fmt.Errorf("the default policy is invalid: %v", err)
+	}
+	return nil
+}
+
+func (p BodyPolicy) validate() error {
+	switch p.Action {
+	case "", BodyStore, BodyDrop, BodyHash:
+	case BodyTruncate:
+		if p.MaxBytes <= 0 {
+			return errors.New("max_bytes must be positive to truncate")
+		}
+	default:
+		return fmt.Errorf("unknown action %q, must be store, truncate, drop or hash", p.Action)
+	}
+	return nil
+}
+
+// Apply applies the policies to the bodies of the raw request and response of the record. The changed bodies are
+// decoded from their transfer encoding, and their Content-Length is updated so they can still be parsed, while the
+// sizes of the record keep the original ones.
+func (c BodyPoliciesConfig) Apply(record *AnalyticsRecord, raw *RawRecord) {
+	if !c.Enabled() {
+		return
+	}
+	if record.RawRequest != "" {
+		// the body may be cut by the Gateway, so it's used even when it can't be read in full
+		if req, body, _ := raw.Request(); req != nil {
+			record.RawRequest = c.applyRaw(record.RawRequest, req.Header.Get("Content-Type"), body)
+		}
+	}
+	if record.RawResponse != "" {
+		if resp, body, _ := raw.Response(); resp != nil {
+			record.RawResponse = c.applyRaw(record.RawResponse, resp.Header.Get("Content-Type"), body)
+		}
+	}
+}
+
+// policy returns the policy of the content type
+func (c BodyPoliciesConfig) policy(contentType string) BodyPolicy {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, rule := range c.Rules {
+		for _, pattern := range rule.ContentTypes {
+			pattern = strings.ToLower(pattern)
+			if pattern == mediaType || (strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))) {
+				return rule
+			}
+		}
+	}
+	return c.Default
+}
+
+// applyRaw returns the base64 raw request or response with its body changed by the policy of its content type
+func (c BodyPoliciesConfig) applyRaw(raw, contentType string, body []byte) string {
+	if len(body) == 0 {
+		return raw
+	}
+	policy := c.policy(contentType)
+	switch policy.Action {
+	case BodyTruncate:
+		if len(body) <= policy.MaxBytes {
+			return raw
+		}
+		body = body[:policy.MaxBytes]
+	case BodyDrop:
+		body = nil
+	case BodyHash:
+		sum := sha256.Sum256(body)
+		body = []byte("sha256:" + hex.EncodeToString(sum[:]))
+	default:
+		return raw
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return raw
+	}
+	end := bytes.Index(decoded, []byte("\r\n\r\n"))
+	if end < 0 {
+		return raw
+	}
+
+	var out bytes.Buffer
+	for _, line := range strings.Split(string(decoded[:end]), "\r\n") {
+		name := strings.ToLower(strings.TrimSpace(strings.SplitN(line, ":", 2)[0]))
+		if name != "content-length" && name != "transfer-encoding" {
+			out.WriteString(line + "\r\n")
+		}
+	}
+	out.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n")
+	out.Write(body)
+	return base64.StdEncoding.EncodeToString(out.Bytes())
+}
@@ -0,0 +1,73 @@
+package analytics
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestBodyPoliciesApply(t *testing.T) {
+	conf := BodyPoliciesConfig{
+		Rules: []BodyPolicy{
+			{ContentTypes: []string{"multipart/form-data", "image/*"}, Action: BodyDrop},
+			{ContentTypes: []string{"application/json"}, Action: BodyTruncate, MaxBytes: 8},
+		},
+		Default: BodyPolicy{Action: BodyHash},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	encode := func(raw string) string {
+		return base64.StdEncoding.EncodeToString([]byte(raw))
+	}
+	decode := func(raw string) string {
+		decoded, _ := base64.StdEncoding.DecodeString(raw)
+		return string(decoded)
+	}
+
+	record := AnalyticsRecord{
+		RawRequest:  encode("POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: image/png\r\nContent-Length: 6\r\n\r\n\x89PNG\r\n"),
+		RawResponse: encode("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n10\r\n{\"id\": \"123456\"}\r\n0\r\n\r\n"),
+	}
+	conf.Apply(&record, NewRawRecord(&record))
+	if request := decode(record.RawRequest); request != "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: image/png\r\nContent-Length: 0\r\n\r\n" {
+		t.Errorf("expected the image to be dropped, got %q", request)
+	}
+	if response := decode(record.RawResponse); response != "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 8\r\n\r\n{\"id\": \"" {
+		t.Errorf("expected the JSON to be truncated, got %q", response)
+	}
+	if _, body, err := ParseRawResponse(record.RawResponse); err != nil || len(body) != 8 {
+		t.Errorf("expected the truncated response to be parsed, got %q %v", body, err)
+	}
+
+	text := AnalyticsRecord{RawRequest: encode("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello")}
+	conf.Apply(&text, NewRawRecord(&text))
+	if _, body, _ := ParseRawRequest(text.RawRequest); string(body) != "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("expected the text to be hashed, got %q", body)
+	}
+
+	small := AnalyticsRecord{RawRequest: encode("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/json\r\nContent-Length: 2\r\n\r\n{}")}
+	unchanged := small.RawRequest
+	conf.Apply(&small, NewRawRecord(&small))
+	if small.RawRequest != unchanged {
+		t.Error("expected the body under the limit to be kept as is")
+	}
+}
+
+func TestBodyPoliciesValidate(t *testing.T) {
+	invalid := []BodyPoliciesConfig{
+		{Rules: []BodyPolicy{{Action: BodyDrop}}},
+		{Rules: []BodyPolicy{{ContentTypes: []string{"image/*"}, Action: "encrypt"}}},
+		{Default: BodyPolicy{Action: BodyTruncate}},
+	}
+	for _, conf := range invalid {
+		if err := conf.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", conf)
+		} else if !strings.Contains(err.Error(), "rule") && !strings.Contains(err.Error(), "default") {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if (BodyPoliciesConfig{Default: BodyPolicy{Action: BodyStore}}).Enabled() {
+		t.Error("expected the policies storing every body to be disabled")
+	}
+}
@@ -0,0 +1,47 @@
+package analytics
+
+import "net/http"
+
+// CorrelationIDConfig configures the extraction of the correlation IDs of the records from their headers
+type CorrelationIDConfig struct {
+	// Headers are the headers the correlation ID is taken from, like X-Request-ID or X-Correlation-ID, in order of
+	// preference. The request headers are looked up first, then the response ones.
+	Headers []string `json:"headers"`
+}
+
+// Enabled returns whether any header is configured
+func (c CorrelationIDConfig) Enabled() bool {
+	return len(c.Headers) > 0
+}
+
+// Extract sets the correlation ID of the record from the first configured header of its raw request, or of its raw
+// response when the request has none, so it's only known when the detailed recording is enabled
+func (c CorrelationIDConfig) Extract(record *AnalyticsRecord, raw *RawRecord) {
+	if !c.Enabled() || record.CorrelationID != "" {
+		return
+	}
+
+	if record.RawRequest != "" {
+		if req, _, err := raw.Request(); err == nil {
+			if id := c.headerValue(req.Header); id != "" {
+				record.CorrelationID = id
+				return
+			}
+		}
+	}
+	if record.RawResponse != "" {
+		if resp, _, err := raw.Response(); err == nil {
+			record.CorrelationID = c.headerValue(resp.Header)
+		}
+	}
+}
+
+// headerValue returns the value of the first configured header set
+func (c CorrelationIDConfig) headerValue(header http.Header) string {
+	for _, name := range c.Headers {
+		if value := header.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
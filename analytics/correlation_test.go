@@ -0,0 +1,35 @@
+package analytics
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestCorrelationIDExtract(t *testing.T) {
+	conf := CorrelationIDConfig{Headers: []string{"X-Correlation-ID", "X-Request-ID"}}
+	encode := func(raw string) string {
+		return base64.StdEncoding.EncodeToString([]byte(raw))
+	}
+	response := encode("HTTP/1.1 200 OK\r\nX-Request-Id: response-id\r\nContent-Length: 0\r\n\r\n")
+
+	record := AnalyticsRecord{
+		RawRequest:  encode("GET / HTTP/1.1\r\nHost: example.com\r\nX-Request-ID: request-id\r\nX-Correlation-ID: correlation-id\r\n\r\n"),
+		RawResponse: response,
+	}
+	conf.Extract(&record, NewRawRecord(&record))
+	if record.CorrelationID != "correlation-id" {
+		t.Errorf("expected the first configured header of the request, got %q", record.CorrelationID)
+	}
+
+	record = AnalyticsRecord{RawRequest: encode("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), RawResponse: response}
+	conf.Extract(&record, NewRawRecord(&record))
+	if record.CorrelationID != "response-id" {
+		t.Errorf("expected the header of the response, got %q", record.CorrelationID)
+	}
+
+	record = AnalyticsRecord{RawResponse: response}
+	CorrelationIDConfig{}.Extract(&record, NewRawRecord(&record))
+	if record.CorrelationID != "" {
+		t.Error("expected no correlation ID without headers")
+	}
+}
@@ -0,0 +1,556 @@
+package analytics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The APIs serving the metadata of the APIs
+const (
+	DashboardSource = "dashboard"
+	GatewaySource   = "gateway"
+)
+
+const (
+	defaultDashboardCacheTTL = 300
+	defaultPortalAppField    = "app_name"
+	// portalDeveloperField is the field of the meta data of the keys issued by the developer portal with their developer
+	portalDeveloperField = "tyk_developer_id"
+	defaultDashboardRate = 10
+	dashboardTimeout     = 10 * time.Second
+	// maxPendingKeys is how many keys, at most, wait to be looked up, the next ones are looked up when they come again
+	maxPendingKeys = 10000
+	// maxCachedKeys is how many keys, at most, are cached
+	maxCachedKeys = 100000
+	// dashboardRetryInterval is how often, at most, the APIs are loaded again when they couldn't be loaded or a record
+	// has an unknown API, unless the cache TTL is shorter
+	dashboardRetryInterval = time.Minute
+)
+
+// DashboardConfig configures the enrichment of the records with the metadata of the Tyk Dashboard or Gateway API
+type DashboardConfig struct {
+	// URL is the base URL of the Dashboard or Gateway API, like http://dashboard:3000
+	URL string `json:"url"`
+	// Source is dashboard, the default, or gateway
+	Source string `json:"source"`
+	// Secret is the API key of a Dashboard user, or the secret of the Gateway
+	Secret string `json:"secret"`
+	// EnrichAPIs sets the name of the API of the records which have none, and tags them with the categories and the
+	// owners of the API
+	EnrichAPIs bool `json:"enrich_apis"`
+	// EnrichKeys sets the alias of the key of the records which have none, and tags them with the policies of the key
+	// and the values of its KeyMetaData
+	EnrichKeys bool `json:"enrich_keys"`
+	// KeyMetaData are the fields of the meta data of the keys the records are tagged with
+	KeyMetaData []string `json:"key_meta_data"`
+	// CacheTTL is for how many seconds the metadata is cached before it's loaded again, 300 by default
+	CacheTTL int `json:"cache_ttl"`
+	// EnrichPortal sets the developer portal application of the records, from the developer who owns their key and the
+	// PortalAppField of the meta data of the key
+	EnrichPortal bool `json:"enrich_portal"`
+	// PortalAppField is the field of the meta data of the keys with the name of their application, app_name by default
+	PortalAppField string `json:"portal_app_field"`
+	// RequestsPerSecond is how many keys, at most, are looked up per second, 10 by default
+	RequestsPerSecond int `json:"requests_per_second"`
+}
+
+// Enabled returns whether the records are enriched with the metadata of the Dashboard
+func (c DashboardConfig) Enabled() bool {
+	return c.URL != "" && (c.EnrichAPIs || c.EnrichKeys || c.EnrichPortal)
+}
+
+// Validate checks the source of the metadata and the rate of the key lookups
+func (c DashboardConfig) Validate() error {
+	if c.Source != "" && c.Source != DashboardSource && c.Source != GatewaySource {
+		return fmt.Errorf("invalid source %q, must be %s or %s", c.Source, DashboardSource, GatewaySource)
+	}
+	if c.EnrichPortal && c.Source == GatewaySource {
+		return errors.New("the portal developers are only known by the dashboard")
+	}
+	if c.RequestsPerSecond < 0 {
+		return errors.New("requests_per_second can't be negative")
+	}
+	return nil
+}
+
+// APIMetadata is the metadata of an API
+type APIMetadata struct {
+	Name string
+	// Categories are the Dashboard categories of the API, the #hashtags of its name
+	Categories []string
+	// Owners are the IDs of the Dashboard users and user groups owning the API
+	Owners      []string
+	OwnerGroups []string
+}
+
+// KeyMetadata is the metadata of a key
+type KeyMetadata struct {
+	Alias    string
+	Policies []string
+	// MetaData are the values of the configured fields of the meta data of the key
+	MetaData map[string]string
+	// DeveloperID is the portal developer owning the key, and App the name of their application using it
+	DeveloperID string
+	App         string
+}
+
+// PortalApp is the developer portal application which made a request, with the developer owning it
+type PortalApp struct {
+	DeveloperID    string `json:"developer_id"`
+	DeveloperEmail string `json:"developer_email"`
+	App            string `json:"app"`
+}
+
+// AppKey identifies the application among the applications of all the developers
+func (p PortalApp) AppKey() string {
+	if p.App == "" {
+		return p.DeveloperID
+	}
+	return p.DeveloperID + ":" + p.App
+}
+
+// Name is the name of the application, or the email of its developer when the application has no name
+func (p PortalApp) Name() string {
+	if p.App == "" {
+		return p.DeveloperEmail
+	}
+	return p.App
+}
+
+// portalDeveloper is the part of the portal developers of the Dashboard API with the metadata
+type portalDeveloper struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+}
+
+// sessionState is the part of the keys of the Dashboard and Gateway APIs with the metadata
+type sessionState struct {
+	Alias         string                 `json:"alias"`
+	ApplyPolicies []string               `json:"apply_policies"`
+	MetaData      map[string]interface{} `json:"meta_data"`
+}
+
+// cachedKey is a looked up key, which isn't found when it doesn't exist
+type cachedKey struct {
+	key      KeyMetadata
+	found    bool
+	expireAt time.Time
+}
+
+// keyLookup is a key waiting to be looked up, with the API of the record it came in
+type keyLookup struct {
+	keyHash string
+	apiID   string
+}
+
+// errDashboardNotFound is returned when the Dashboard or Gateway API responds that the object doesn't exist
+var errDashboardNotFound = errors.New("not found")
+
+// apiDefinition is the part of the API definitions of the Gateway API with the metadata
+type apiDefinition struct {
+	APIID string `json:"api_id"`
+	Name  string `json:"name"`
+}
+
+// dashboardAPI is an API of the Dashboard API, with its definition and its owners
+type dashboardAPI struct {
+	APIDefinition   apiDefinition `json:"api_definition"`
+	UserOwners      []string      `json:"user_owners"`
+	UserGroupOwners []string      `json:"user_group_owners"`
+}
+
+// DashboardClient caches the metadata of the APIs, loaded from the Dashboard or Gateway API
+type DashboardClient struct {
+	conf   DashboardConfig
+	client *http.Client
+	ttl    time.Duration
+
+	mu         sync.Mutex
+	apis       map[string]APIMetadata
+	developers map[string]string
+	loadedAt   time.Time
+	attemptAt  time.Time
+	refreshing bool
+
+	keys    map[string]cachedKey
+	pending map[string]bool
+	lookups chan keyLookup
+	start   sync.Once
+}
+
+// NewDashboardClient returns a client of the Dashboard or Gateway API of the configuration, with an empty cache
+func NewDashboardClient(conf DashboardConfig) *DashboardClient {
+	ttl := conf.CacheTTL
+	if ttl <= 0 {
+		ttl = defaultDashboardCacheTTL
+	}
+	return &DashboardClient{
+		conf:       conf,
+		client:     &http.Client{Timeout: dashboardTimeout},
+		ttl:        time.Duration(ttl) * time.Second,
+		apis:       map[string]APIMetadata{},
+		developers: map[string]string{},
+		keys:       map[string]cachedKey{},
+		pending:    map[string]bool{},
+		lookups:    make(chan keyLookup, maxPendingKeys),
+	}
+}
+
+// Enrich enriches the record with the metadata of its API, of its key and of its portal application, when enabled.
+// The metadata is taken from the cache, which is loaded in the background, so the records aren't enriched until the
+// metadata is loaded.
+func (d *DashboardClient) Enrich(record *AnalyticsRecord) {
+	if d.conf.EnrichAPIs {
+		d.enrichAPI(record)
+	}
+	if !d.conf.EnrichKeys && !d.conf.EnrichPortal {
+		return
+	}
+	// the obfuscated keys can't be looked up
+	if record.APIKey == "" || strings.HasPrefix(record.APIKey, "****") {
+		return
+	}
+	key, ok := d.KeyMetadata(record.APIKey, record.APIID, time.Now())
+	if !ok {
+		return
+	}
+	if d.conf.EnrichKeys {
+		d.enrichKey(record, key)
+	}
+	if d.conf.EnrichPortal {
+		d.enrichPortal(record, key)
+	}
+}
+
+// enrichAPI sets the name of the API of the record when it has none, and tags it with the categories and the owners
+// of the API, as category-<name>, owner-<user ID> and owner-group-<user group ID>. The APIs are loaded again when
+// they expire or when the API isn't cached.
+func (d *DashboardClient) enrichAPI(record *AnalyticsRecord) {
+	if record.APIID == "" {
+		return
+	}
+	api, ok := d.APIMetadata(record.APIID, time.Now())
+	if !ok {
+		return
+	}
+
+	if record.APIName == "" {
+		record.APIName = api.Name
+	}
+	for _, category := range api.Categories {
+		record.Tags = appendTag(record.Tags, "category-"+category)
+	}
+	for _, owner := range api.Owners {
+		record.Tags = appendTag(record.Tags, "owner-"+owner)
+	}
+	for _, group := range api.OwnerGroups {
+		record.Tags = appendTag(record.Tags, "owner-group-"+group)
+	}
+}
+
+// enrichKey sets the alias of the key of the record when it has none, and tags it with the policies of the key, as
+// policy-<policy ID>, and with the configured fields of its meta data, as <field>-<value>
+func (d *DashboardClient) enrichKey(record *AnalyticsRecord, key KeyMetadata) {
+	if record.Alias == "" {
+		record.Alias = key.Alias
+	}
+	for _, policy := range key.Policies {
+		record.Tags = appendTag(record.Tags, "policy-"+policy)
+	}
+	for _, field := range d.conf.KeyMetaData {
+		if value, ok := key.MetaData[field]; ok {
+			record.Tags = appendTag(record.Tags, field+"-"+value)
+		}
+	}
+}
+
+// enrichPortal sets the portal application of the record when its key was issued by the developer portal. The
+// developers are loaded again when they expire or when the developer isn't cached.
+func (d *DashboardClient) enrichPortal(record *AnalyticsRecord, key KeyMetadata) {
+	if key.DeveloperID == "" {
+		return
+	}
+	email, _ := d.DeveloperEmail(key.DeveloperID, time.Now())
+	record.Portal = PortalApp{DeveloperID: key.DeveloperID, DeveloperEmail: email, App: key.App}
+}
+
+// KeyMetadata returns the cached metadata of the hashed key, and queues the key to be looked up when it isn't cached
+// or it expired. The keys which don't exist are cached too, so they aren't looked up again until they expire.
+func (d *DashboardClient) KeyMetadata(keyHash, apiID string, now time.Time) (KeyMetadata, bool) {
+	d.start.Do(func() {
+		go d.lookupKeys()
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cached, ok := d.keys[keyHash]
+	if (!ok || !now.Before(cached.expireAt)) && !d.pending[keyHash] {
+		select {
+		case d.lookups <- keyLookup{keyHash: keyHash, apiID: apiID}:
+			d.pending[keyHash] = true
+		default:
+			// too many keys are waiting, this one is looked up when it comes again
+		}
+	}
+	return cached.key, ok && cached.found
+}
+
+// lookupKeys looks up the queued keys, at most RequestsPerSecond per second
+func (d *DashboardClient) lookupKeys() {
+	rate := d.conf.RequestsPerSecond
+	if rate <= 0 {
+		rate = defaultDashboardRate
+	}
+	limiter := time.NewTicker(time.Second / time.Duration(rate))
+	defer limiter.Stop()
+
+	for lookup := range d.lookups {
+		<-limiter.C
+		key, err := d.loadKey(lookup.keyHash, lookup.apiID)
+
+		d.mu.Lock()
+		delete(d.pending, lookup.keyHash)
+		switch {
+		case err == nil, err == errDashboardNotFound:
+			d.cacheKey(lookup.keyHash, cachedKey{key: key, found: err == nil, expireAt: time.Now().Add(d.ttl)})
+		default:
+			log.WithField("prefix", "dashboard").Error("Couldn't look up a key: ", err)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// cacheKey caches the key, making room for it when the cache is full by removing the expired keys, or any key when
+// none expired. The lock must be held.
+func (d *DashboardClient) cacheKey(keyHash string, key cachedKey) {
+	if _, ok := d.keys[keyHash]; !ok && len(d.keys) >= maxCachedKeys {
+		now := time.Now()
+		for cachedHash, cached := range d.keys {
+			if !now.Before(cached.expireAt) {
+				delete(d.keys, cachedHash)
+			}
+		}
+		for cachedHash := range d.keys {
+			if len(d.keys) < maxCachedKeys {
+				break
+			}
+			delete(d.keys, cachedHash)
+		}
+	}
+	d.keys[keyHash] = key
+}
+
+// loadKey fetches the session of the hashed key from the Dashboard, as a key of its API when the record has one, or
+// from the Gateway
+func (d *DashboardClient) loadKey(keyHash, apiID string) (KeyMetadata, error) {
+	var session sessionState
+	var err error
+	switch {
+	case d.conf.Source == GatewaySource:
+		err = d.get("/tyk/keys/"+url.PathEscape(keyHash)+"?hashed=true", &session)
+	case apiID != "":
+		var resp struct {
+			Data sessionState `json:"data"`
+		}
+		err = d.get("/api/apis/"+url.PathEscape(apiID)+"/keys/"+url.PathEscape(keyHash)+"?hashed=true", &resp)
+		session = resp.Data
+	default:
+		var resp struct {
+			Data sessionState `json:"data"`
+		}
+		err = d.get("/api/keys/"+url.PathEscape(keyHash)+"?hashed=true", &resp)
+		session = resp.Data
+	}
+	if err != nil {
+		return KeyMetadata{}, err
+	}
+
+	key := KeyMetadata{Alias: session.Alias, Policies: session.ApplyPolicies, MetaData: map[string]string{}}
+	for _, field := range d.conf.KeyMetaData {
+		if value, ok := session.MetaData[field]; ok && value != nil {
+			key.MetaData[field] = fmt.Sprint(value)
+		}
+	}
+	if d.conf.EnrichPortal {
+		appField := d.conf.PortalAppField
+		if appField == "" {
+			appField = defaultPortalAppField
+		}
+		if value, ok := session.MetaData[portalDeveloperField]; ok && value != nil {
+			key.DeveloperID = fmt.Sprint(value)
+		}
+		if value, ok := session.MetaData[appField]; ok && value != nil {
+			key.App = fmt.Sprint(value)
+		}
+	}
+	return key, nil
+}
+
+// APIMetadata returns the cached metadata of the API, and starts loading the APIs again when they are stale
+func (d *DashboardClient) APIMetadata(apiID string, now time.Time) (APIMetadata, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	api, ok := d.apis[apiID]
+	d.refreshIfStale(ok, now)
+	return api, ok
+}
+
+// DeveloperEmail returns the cached email of the portal developer, and starts loading the developers again when they
+// are stale
+func (d *DashboardClient) DeveloperEmail(developerID string, now time.Time) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	email, ok := d.developers[developerID]
+	d.refreshIfStale(ok, now)
+	return email, ok
+}
+
+// refreshIfStale starts loading the APIs and the developers again in the background when the cache expired or the
+// object looked up isn't cached, unless they were loaded, or tried to, in the last minute. The lock must be held.
+func (d *DashboardClient) refreshIfStale(cached bool, now time.Time) {
+	retry := d.ttl
+	if retry > dashboardRetryInterval {
+		retry = dashboardRetryInterval
+	}
+	stale := !cached || now.Sub(d.loadedAt) >= d.ttl
+	if stale && now.Sub(d.attemptAt) >= retry && !d.refreshing {
+		d.refreshing = true
+		d.attemptAt = now
+		go func() {
+			if err := d.Refresh(); err != nil {
+				log.WithField("prefix", "dashboard").Error("Couldn't load the APIs and the developers: ", err)
+			}
+		}()
+	}
+}
+
+// Refresh loads the metadata of all the APIs and of all the portal developers, when they enrich the records,
+// replacing the cached one. The cache is kept when they can't be loaded.
+func (d *DashboardClient) Refresh() error {
+	var apis map[string]APIMetadata
+	var developers map[string]string
+	var err error
+	if d.conf.EnrichAPIs {
+		apis, err = d.loadAPIs()
+	}
+	if err == nil && d.conf.EnrichPortal {
+		developers, err = d.loadDevelopers()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refreshing = false
+	now := time.Now()
+	d.attemptAt = now
+	if err != nil {
+		return err
+	}
+	if apis != nil {
+		d.apis = apis
+	}
+	if developers != nil {
+		d.developers = developers
+	}
+	d.loadedAt = now
+	return nil
+}
+
+// loadDevelopers fetches the emails of the portal developers of the Dashboard
+func (d *DashboardClient) loadDevelopers() (map[string]string, error) {
+	var list struct {
+		Data []portalDeveloper `json:"data"`
+	}
+	if err := d.get("/api/portal/developers?p=-1", &list); err != nil {
+		return nil, err
+	}
+	developers := make(map[string]string, len(list.Data))
+	for _, developer := range list.Data {
+		developers[developer.ID] = developer.Email
+	}
+	return developers, nil
+}
+
+// loadAPIs fetches the APIs of the Dashboard, with their owners, or the API definitions of the Gateway
+func (d *DashboardClient) loadAPIs() (map[string]APIMetadata, error) {
+	apis := map[string]APIMetadata{}
+	if d.conf.Source == GatewaySource {
+		var definitions []apiDefinition
+		if err := d.get("/tyk/apis", &definitions); err != nil {
+			return nil, err
+		}
+		for _, def := range definitions {
+			apis[def.APIID] = apiMetadata(def.Name, nil, nil)
+		}
+		return apis, nil
+	}
+
+	var list struct {
+		APIs []dashboardAPI `json:"apis"`
+	}
+	if err := d.get("/api/apis?p=-1", &list); err != nil {
+		return nil, err
+	}
+	for _, api := range list.APIs {
+		apis[api.APIDefinition.APIID] = apiMetadata(api.APIDefinition.Name, api.UserOwners, api.UserGroupOwners)
+	}
+	return apis, nil
+}
+
+// get decodes the JSON response of the Dashboard or Gateway API to the path
+func (d *DashboardClient) get(path string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(d.conf.URL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if d.conf.Source == GatewaySource {
+		req.Header.Set("X-Tyk-Authorization", d.conf.Secret)
+	} else {
+		req.Header.Set("Authorization", d.conf.Secret)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, resp.Body)
+		return errDashboardNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("%s responded with status %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// apiMetadata returns the metadata of an API, splitting the #hashtags of the Dashboard categories from its name
+func apiMetadata(name string, owners, ownerGroups []string) APIMetadata {
+	api := APIMetadata{Owners: owners, OwnerGroups: ownerGroups}
+	var words []string
+	for _, word := range strings.Fields(name) {
+		if len(word) > 1 && strings.HasPrefix(word, "#") {
+			api.Categories = append(api.Categories, word[1:])
+			continue
+		}
+		words = append(words, word)
+	}
+	api.Name = strings.Join(words, " ")
+	return api
+}
+
+// appendTag appends the tag to the tags unless they have it already
+func appendTag(tags []string, tag string) []string {
+	if stringInSlice(tag, tags) {
+		return tags
+	}
+	return append(tags, tag)
+}
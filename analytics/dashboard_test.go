@@ -0,0 +1,240 @@
+package analytics
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDashboardEnrich(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/api/apis" || r.Header.Get("Authorization") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"apis": [{"api_definition": {"api_id": "api1", "name": "Payments #finance #internal"},
+			"user_owners": ["user1"], "user_group_owners": ["group1"]}]}`))
+	}))
+	defer server.Close()
+
+	client := NewDashboardClient(DashboardConfig{URL: server.URL + "/", Secret: "secret", EnrichAPIs: true})
+	if err := client.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	record := AnalyticsRecord{APIID: "api1", Tags: []string{"key-1", "owner-user1"}}
+	client.Enrich(&record)
+	if record.APIName != "Payments" {
+		t.Errorf("expected the API name to be set, got %q", record.APIName)
+	}
+	expected := []string{"key-1", "owner-user1", "category-finance", "category-internal", "owner-group-group1"}
+	if !reflect.DeepEqual(record.Tags, expected) {
+		t.Errorf("expected the tags %v, got %v", expected, record.Tags)
+	}
+
+	named := AnalyticsRecord{APIID: "api1", APIName: "Payments v2"}
+	client.Enrich(&named)
+	if named.APIName != "Payments v2" {
+		t.Errorf("expected the API name of the record to be kept, got %q", named.APIName)
+	}
+
+	unknown := AnalyticsRecord{APIID: "api2"}
+	client.Enrich(&unknown)
+	if unknown.APIName != "" || len(unknown.Tags) != 0 {
+		t.Errorf("expected the record of an unknown API not to be enriched, got %+v", unknown)
+	}
+	// the APIs were just loaded, so the unknown API doesn't load them again
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected the APIs to be loaded once, got %d requests", n)
+	}
+}
+
+func TestDashboardAPIMetadataRefresh(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/tyk/apis" || r.Header.Get("X-Tyk-Authorization") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`[{"api_id": "api1", "name": "Users"}]`))
+	}))
+	defer server.Close()
+
+	client := NewDashboardClient(DashboardConfig{URL: server.URL, Source: GatewaySource, Secret: "secret", EnrichAPIs: true})
+	now := time.Now()
+	if _, ok := client.APIMetadata("api1", now); ok {
+		t.Error("expected the API not to be cached before the APIs are loaded")
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := client.APIMetadata("api1", time.Now()); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	api, ok := client.APIMetadata("api1", time.Now())
+	if !ok || api.Name != "Users" {
+		t.Fatalf("expected the APIs to be loaded in the background, got %+v", api)
+	}
+
+	// the cache expires after the default TTL
+	client.APIMetadata("api1", time.Now().Add(defaultDashboardCacheTTL*time.Second))
+	for i := 0; i < 100 && atomic.LoadInt32(&requests) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected the expired APIs to be loaded again, got %d requests", n)
+	}
+}
+
+func TestDashboardConfigValidate(t *testing.T) {
+	if err := (DashboardConfig{Source: GatewaySource}).Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (DashboardConfig{Source: "mdcb"}).Validate(); err == nil {
+		t.Error("expected an unknown source to be invalid")
+	}
+	if err := (DashboardConfig{RequestsPerSecond: -1}).Validate(); err == nil {
+		t.Error("expected a negative rate to be invalid")
+	}
+}
+
+func TestDashboardEnrichKeys(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Authorization") != "secret" || r.URL.Query().Get("hashed") != "true" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/apis/api1/keys/hash1":
+			w.Write([]byte(`{"key_id": "hash1", "data": {"alias": "acme", "apply_policies": ["gold"],
+				"meta_data": {"customer_id": 42, "plan": "enterprise"}}}`))
+		case "/api/keys/hash2":
+			w.Write([]byte(`{"key_id": "hash2", "data": {"alias": "globex"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewDashboardClient(DashboardConfig{URL: server.URL, Secret: "secret", EnrichKeys: true,
+		KeyMetaData: []string{"customer_id", "region"}, RequestsPerSecond: 100})
+	enrich := func(record AnalyticsRecord) AnalyticsRecord {
+		for i := 0; i < 100; i++ {
+			enriched := record
+			enriched.Tags = append([]string{}, record.Tags...)
+			client.Enrich(&enriched)
+			if enriched.Alias != record.Alias || len(enriched.Tags) != len(record.Tags) {
+				return enriched
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return record
+	}
+
+	record := enrich(AnalyticsRecord{APIID: "api1", APIKey: "hash1"})
+	if record.Alias != "acme" {
+		t.Errorf("expected the alias of the key to be set, got %q", record.Alias)
+	}
+	expected := []string{"policy-gold", "customer_id-42"}
+	if !reflect.DeepEqual(record.Tags, expected) {
+		t.Errorf("expected the tags %v, got %v", expected, record.Tags)
+	}
+
+	aliased := enrich(AnalyticsRecord{APIKey: "hash2", Alias: "key alias", Tags: []string{"key-1"}})
+	if aliased.Alias != "key alias" {
+		t.Errorf("expected the alias of the record to be kept, got %q", aliased.Alias)
+	}
+	if _, ok := client.KeyMetadata("hash2", "", time.Now()); !ok {
+		t.Error("expected the key without an API to be looked up in the keys of the organisation")
+	}
+
+	before := atomic.LoadInt32(&requests)
+	unknown := enrich(AnalyticsRecord{APIID: "api1", APIKey: "hash3"})
+	if unknown.Alias != "" || len(unknown.Tags) != 0 {
+		t.Errorf("expected the record of an unknown key not to be enriched, got %+v", unknown)
+	}
+	client.Enrich(&AnalyticsRecord{APIID: "api1", APIKey: "hash3"})
+	client.Enrich(&AnalyticsRecord{APIKey: "****abcd"})
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests) - before; n != 1 {
+		t.Errorf("expected the unknown key to be looked up once, got %d requests", n)
+	}
+}
+
+func TestDashboardCacheKey(t *testing.T) {
+	client := NewDashboardClient(DashboardConfig{})
+	expired := cachedKey{expireAt: time.Now().Add(-time.Second)}
+	for i := 0; i < maxCachedKeys; i++ {
+		client.keys[fmt.Sprint(i)] = expired
+	}
+	client.cacheKey("new", cachedKey{found: true, expireAt: time.Now().Add(time.Minute)})
+	if len(client.keys) != 1 || !client.keys["new"].found {
+		t.Errorf("expected the expired keys to be removed from the full cache, got %d keys", len(client.keys))
+	}
+}
+
+func TestDashboardEnrichPortal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/portal/developers":
+			w.Write([]byte(`{"Data": [{"id": "dev1", "email": "jane@example.com"}], "Pages": 1}`))
+		case "/api/keys/hash1":
+			w.Write([]byte(`{"data": {"alias": "jane", "meta_data": {"tyk_developer_id": "dev1", "application": "Mobile"}}}`))
+		case "/api/keys/hash2":
+			w.Write([]byte(`{"data": {"meta_data": {"tyk_developer_id": "dev1"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewDashboardClient(DashboardConfig{URL: server.URL, EnrichPortal: true, PortalAppField: "application",
+		RequestsPerSecond: 100})
+	if err := client.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	enrich := func(record AnalyticsRecord) AnalyticsRecord {
+		for i := 0; i < 100 && record.Portal.DeveloperID == ""; i++ {
+			client.Enrich(&record)
+			time.Sleep(10 * time.Millisecond)
+		}
+		return record
+	}
+
+	record := enrich(AnalyticsRecord{APIKey: "hash1", OrgID: "org1", TimeStamp: time.Now()})
+	expected := PortalApp{DeveloperID: "dev1", DeveloperEmail: "jane@example.com", App: "Mobile"}
+	if record.Portal != expected {
+		t.Errorf("expected the portal application %+v, got %+v", expected, record.Portal)
+	}
+	if record.Alias != "" {
+		t.Error("expected the alias not to be set when the keys aren't enriched")
+	}
+	noApp := enrich(AnalyticsRecord{APIKey: "hash2", OrgID: "org1", TimeStamp: time.Now()})
+	if noApp.Portal.AppKey() != "dev1" || noApp.Portal.Name() != "jane@example.com" {
+		t.Errorf("expected the key without an application to be attributed to its developer, got %+v", noApp.Portal)
+	}
+
+	data := []interface{}{record, record, noApp, AnalyticsRecord{OrgID: "org1", TimeStamp: time.Now()}}
+	aggregate := AggregateData(data, false, nil, false, nil, nil)["org1"]
+	if len(aggregate.PortalApps) != 0 {
+		t.Error("expected the portal applications not to be aggregated by default")
+	}
+	aggregate = AggregateData(data, false, nil, false, []string{"portalapps"}, nil)["org1"]
+	if c := aggregate.PortalApps["dev1:Mobile"]; len(aggregate.PortalApps) != 2 || c == nil || c.Hits != 2 || c.HumanIdentifier != "Mobile" {
+		t.Fatal("unexpected portal applications:", aggregate.PortalApps)
+	}
+
+	if err := (DashboardConfig{Source: GatewaySource, EnrichPortal: true}).Validate(); err == nil {
+		t.Error("expected the portal enrichment to be invalid with the gateway")
+	}
+}
@@ -0,0 +1,128 @@
+package analytics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDedupTTL     = 3600
+	defaultDedupMaxSize = 100000
+)
+
+// DedupConfig configures the deduplication of the records, so the records replayed or purged twice aren't written
+// again by the pumps
+type DedupConfig struct {
+	Enabled bool `json:"enabled"`
+	// TTL is for how many seconds the hash of a record is remembered, 3600 by default
+	TTL int64 `json:"ttl"`
+	// MaxSize is the maximum number of hashes remembered, the oldest ones are forgotten first. 100000 by default.
+	MaxSize int `json:"max_size"`
+}
+
+// Hash returns the SHA-256 of the fields identifying the request of the record, in hex. It doesn't depend on the
+// fields set by the pump, so a record purged twice has the same hash.
+func (a *AnalyticsRecord) Hash() string {
+	hasher := sha256.New()
+	fmt.Fprintf(hasher, "%d\x00%s\x00%s\x00%s\x00%d\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%d\x00%d\x00%d\x00%d\x00%s\x00%s",
+		a.TimeStamp.UnixNano(), a.Method, a.Host, a.RawPath, a.ResponseCode, a.APIKey, a.APIID, a.APIVersion, a.OrgID,
+		a.OauthID, a.IPAddress, a.RequestTime, a.Latency.Total, a.ContentLength, a.ResponseContentLength, a.UserAgent,
+		a.RawRequest)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// HashFields returns the SHA-256 of the record fields with the given json names, in hex, so the records with the same
+// values in those fields have the same hash
+func (a *AnalyticsRecord) HashFields(fields []string) string {
+	hasher := sha256.New()
+	for _, field := range fields {
+		value, _ := a.Field(field)
+		if t, ok := value.(time.Time); ok {
+			value = t.UnixNano()
+		}
+		fmt.Fprintf(hasher, "%s=%v\x00", field, value)
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+type dedupEntry struct {
+	hash     string
+	expireAt time.Time
+}
+
+// Deduplicator remembers the hashes of the records seen for a while, in a cache bounded in time and size
+type Deduplicator struct {
+	ttl     time.Duration
+	maxSize int
+
+	mu sync.Mutex
+	// entries are ordered by expiry, as all of them have the same TTL
+	entries []dedupEntry
+	seen    map[string]time.Time
+}
+
+// NewDeduplicator returns the deduplicator of the configuration, with the defaults of the TTL and the size set
+func NewDeduplicator(conf DedupConfig) *Deduplicator {
+	d := &Deduplicator{
+		ttl:     time.Duration(conf.TTL) * time.Second,
+		maxSize: conf.MaxSize,
+		seen:    map[string]time.Time{},
+	}
+	if d.ttl <= 0 {
+		d.ttl = defaultDedupTTL * time.Second
+	}
+	if d.maxSize <= 0 {
+		d.maxSize = defaultDedupMaxSize
+	}
+	return d
+}
+
+// IsDuplicate returns whether the record was already seen since the TTL, remembering it otherwise
+func (d *Deduplicator) IsDuplicate(record *AnalyticsRecord, now time.Time) bool {
+	hash := record.Hash()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.evict(now)
+	if expireAt, ok := d.seen[hash]; ok && now.Before(expireAt) {
+		return true
+	}
+
+	if len(d.entries) >= d.maxSize {
+		d.forget(d.entries[0])
+		d.entries = d.entries[1:]
+	}
+	entry := dedupEntry{hash: hash, expireAt: now.Add(d.ttl)}
+	d.entries = append(d.entries, entry)
+	d.seen[hash] = entry.expireAt
+	return false
+}
+
+// Len returns the number of hashes remembered
+func (d *Deduplicator) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.seen)
+}
+
+// evict forgets the expired hashes
+func (d *Deduplicator) evict(now time.Time) {
+	expired := 0
+	for expired < len(d.entries) && !now.Before(d.entries[expired].expireAt) {
+		d.forget(d.entries[expired])
+		expired++
+	}
+	// the forgotten entries are dropped from the backing array when it's grown by the next appends
+	d.entries = d.entries[expired:]
+}
+
+// forget removes the hash of the entry, unless it was seen again later
+func (d *Deduplicator) forget(entry dedupEntry) {
+	if d.seen[entry.hash].Equal(entry.expireAt) {
+		delete(d.seen, entry.hash)
+	}
+}
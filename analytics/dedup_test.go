@@ -0,0 +1,70 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordHash(t *testing.T) {
+	ts := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	record := AnalyticsRecord{Method: "GET", Path: "/get", RawPath: "/get", APIID: "api", OrgID: "org", TimeStamp: ts}
+
+	replayed := record
+	replayed.ExpireAt = ts.Add(time.Hour)
+	replayed.ErrorClass = ClientErrorClass
+	if record.Hash() != replayed.Hash() {
+		t.Error("expected the fields set by the pump not to change the hash")
+	}
+
+	other := record
+	other.TimeStamp = ts.Add(time.Nanosecond)
+	if record.Hash() == other.Hash() {
+		t.Error("expected requests at different times to have different hashes")
+	}
+}
+
+func TestRecordHashFields(t *testing.T) {
+	ts := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	record := AnalyticsRecord{APIID: "api", Tags: []string{"a", "b"}, TimeStamp: ts}
+	fields := []string{"api_id", "tags", "timestamp"}
+
+	retried := record
+	retried.ResponseCode = 500
+	if record.HashFields(fields) != retried.HashFields(fields) {
+		t.Error("expected the fields not hashed not to change the hash")
+	}
+
+	other := record
+	other.TimeStamp = ts.Add(time.Millisecond)
+	if record.HashFields(fields) == other.HashFields(fields) {
+		t.Error("expected the timestamps to be hashed with their nanoseconds")
+	}
+	if record.HashFields(fields) == record.HashFields(fields[:2]) {
+		t.Error("expected different fields to have different hashes")
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	d := NewDeduplicator(DedupConfig{Enabled: true, TTL: 60, MaxSize: 2})
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []AnalyticsRecord{{APIID: "a"}, {APIID: "b"}, {APIID: "c"}}
+
+	if d.IsDuplicate(&records[0], now) {
+		t.Error("expected the first record not to be a duplicate")
+	}
+	if !d.IsDuplicate(&records[0], now.Add(30*time.Second)) {
+		t.Error("expected the record to be a duplicate before the TTL")
+	}
+	if d.IsDuplicate(&records[0], now.Add(time.Minute)) {
+		t.Error("expected the record to be forgotten after the TTL")
+	}
+
+	d.IsDuplicate(&records[1], now.Add(time.Minute))
+	d.IsDuplicate(&records[2], now.Add(time.Minute))
+	if d.Len() != 2 {
+		t.Errorf("expected the cache to be bounded to 2 hashes, got %d", d.Len())
+	}
+	if d.IsDuplicate(&records[0], now.Add(time.Minute)) {
+		t.Error("expected the oldest hash to be forgotten when the cache is full")
+	}
+}
@@ -1,6 +1,8 @@
 package demo
 
 import (
+	"fmt"
+	"math"
 	"math/rand"
 	"strings"
 	"time"
@@ -11,13 +13,84 @@ import (
 	uuid "github.com/satori/go.uuid"
 )
 
-var apiKeys []string
-var apiID string
+// The shapes of the demo traffic through the day
+const (
+	FlatTraffic    = "flat"
+	DiurnalTraffic = "diurnal"
+	SpikyTraffic   = "spiky"
+)
+
+const (
+	// latencySigma is the spread of the log-normal request times, which gives them a long tail
+	latencySigma = 0.6
+	// spikeChance is the chance of an hour of spiky traffic to have a spike
+	spikeChance = 1.0 / 24
+	// spikeFactor multiplies the volume, the request times and the error rate of the spikes
+	spikeFactor = 4
+)
+
+// Profile shapes the demo traffic
+type Profile struct {
+	// Orgs is the number of orgs the traffic is split between, the demo org and orgs derived from its ID
+	Orgs int
+	// APIs is the number of APIs of every org, ignored when the API ID is set
+	APIs int
+	// RecordsPerDay is the average number of records per day
+	RecordsPerDay int
+	// Traffic is the shape of the traffic through the day: flat, diurnal, peaking in the afternoon, or spiky, diurnal
+	// with random spikes of traffic, latency and errors
+	Traffic string
+	// LatencyMedian is the median request time in milliseconds, the request times follow a log-normal distribution
+	LatencyMedian float64
+	// ErrorRate is the fraction of the requests failing with a 4xx or 5xx response code
+	ErrorRate float64
+	// DetailedRecording generates realistic raw requests and responses, with JSON bodies and personal data, instead
+	// of placeholders
+	DetailedRecording bool
+	// GraphQLRate is the fraction of the requests which are GraphQL operations
+	GraphQLRate float64
+}
+
+// DefaultProfile returns the profile of the traffic generated when none is configured
+func DefaultProfile() Profile {
+	return Profile{
+		Orgs:          1,
+		APIs:          3,
+		RecordsPerDay: 300,
+		Traffic:       FlatTraffic,
+		LatencyMedian: 5,
+		ErrorRate:     0.2,
+	}
+}
+
+type demoAPI struct {
+	name string
+	id   string
+}
+
+var orgIDs []string
+var apiKeys map[string][]string
+var apis []demoAPI
 var apiVersion string
+var profile = DefaultProfile()
 
-func DemoInit(orgId, apiId, version string) {
-	apiID = apiId
-	apiKeys = generateAPIKeys(orgId)
+func DemoInit(orgId, apiId, version string, demoProfile Profile) {
+	rand.Seed(time.Now().UnixNano())
+	profile = demoProfile
+	if profile.Orgs < 1 {
+		profile.Orgs = 1
+	}
+
+	orgIDs = []string{orgId}
+	for i := 2; i <= profile.Orgs; i++ {
+		orgIDs = append(orgIDs, fmt.Sprintf("%s%d", orgId, i))
+	}
+	apiKeys = map[string][]string{}
+	for _, org := range orgIDs {
+		apiKeys[org] = generateAPIKeys(org)
+	}
+
+	apis = generateAPIs(apiId, profile.APIs)
 	apiVersion = version
 	if version == "" {
 		apiVersion = "Default"
@@ -25,14 +98,12 @@ func DemoInit(orgId, apiId, version string) {
 }
 
 func randomInRange(min, max int) int {
-	rand.Seed(time.Now().UnixNano())
 	return rand.Intn(max-min) + min
 }
 
 func randomMethod() string {
 	var methods = []string{"GET", "PUT", "POST", "DELETE", "OPTIONS", "HEAD"}
 
-	rand.Seed(time.Now().Unix())
 	return methods[rand.Intn(len(methods))]
 }
 
@@ -70,18 +141,31 @@ func randomPath() string {
 	return path
 }
 
-func randomAPI() (string, string) {
-	if apiID != "" {
-		return "Foo Bar", apiID
+func generateAPIs(apiId string, count int) []demoAPI {
+	if apiId != "" {
+		return []demoAPI{{"Foo Bar", apiId}}
 	}
-	names := [][]string{
+
+	set := []demoAPI{
 		{"Foo Bar Baz API", "de6e4d9ddde34d1657a6d93fab835abd"},
 		{"Wibble Wobble API", "de6e4d9ddde34d1657a6d92fab935aba"},
 		{"Wonky Ponky API", "de6e4d9ddde34d1657a6d91fab836abb"},
 	}
+	if count < 1 {
+		count = 1
+	}
+	if count <= len(set) {
+		return set[:count]
+	}
+	for i := len(set) + 1; i <= count; i++ {
+		set = append(set, demoAPI{fmt.Sprintf("Demo API %d", i), strings.Replace(uuid.NewV4().String(), "-", "", -1)})
+	}
+	return set
+}
 
-	api := names[rand.Intn(len(names))]
-	return api[0], api[1]
+func randomAPI() (string, string) {
+	api := apis[rand.Intn(len(apis))]
+	return api.name, api.id
 }
 
 func getUA() string {
@@ -99,23 +183,42 @@ func getUA() string {
 	return userAgents[rand.Intn(len(userAgents))]
 }
 
-func responseCode() int {
+// responseCode returns an error code with the chance of errorRate, 4xx codes more often than 5xx ones
+func responseCode(errorRate float64) int {
+	if rand.Float64() >= errorRate {
+		return 200
+	}
+
 	codes := []int{
-		200,
-		200,
-		200,
+		400,
+		401,
 		403,
-		200,
+		403,
+		404,
+		404,
+		429,
 		500,
-		200,
-		200,
-		200,
-		200,
+		502,
+		503,
 	}
 
 	return codes[rand.Intn(len(codes))]
 }
 
+// requestTime returns a request time in milliseconds of the log-normal distribution with the given median
+func requestTime(median float64) int64 {
+	return int64(math.Round(median * math.Exp(latencySigma*rand.NormFloat64())))
+}
+
+// hourWeight returns how busy the hour is relative to the average hour of the day, for the traffic shape
+func hourWeight(traffic string, hour int) float64 {
+	if traffic == FlatTraffic || traffic == "" {
+		return 1
+	}
+	// busiest at 14:00 and quietest at 02:00
+	return 1 + 0.8*math.Sin(2*math.Pi*float64(hour-8)/24)
+}
+
 func generateAPIKeys(orgId string) []string {
 	set := make([]string, 50)
 	for i := 0; i < len(set); i++ {
@@ -131,53 +234,86 @@ func generateAPIKey(orgId string) string {
 	return orgId + id
 }
 
-func getRandomKey() string {
-	return apiKeys[rand.Intn(len(apiKeys))]
+func getRandomKey(orgId string) string {
+	keys := apiKeys[orgId]
+	return keys[rand.Intn(len(keys))]
 }
 
-func GenerateDemoData(start time.Time, days int, orgId string, writer func([]interface{}, *health.Job, time.Time, int)) {
-	count := 0
-	finish := start.AddDate(0, 0, days)
-	for d := start; d.Before(finish); d = d.AddDate(0, 0, 1) {
+// GenerateDemoData writes the demo traffic of days days from the day of start, one batch per day. The days after today
+// get future dated records.
+func GenerateDemoData(start time.Time, days int, writer func([]interface{}, *health.Job, time.Time, int)) {
+	first := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location())
+	for day := 0; day < days; day++ {
+		d := first.AddDate(0, 0, day)
 		set := []interface{}{}
 
-		// Generate daily entries
-		volume := randomInRange(100, 500)
-		for i := 0; i < volume; i++ {
-			p := randomPath()
-			api, apiID := randomAPI()
-			r := analytics.AnalyticsRecord{
-				Method:        randomMethod(),
-				Path:          p,
-				RawPath:       p,
-				ContentLength: int64(randomInRange(0, 999)),
-				UserAgent:     getUA(),
-				Day:           d.Day(),
-				Month:         d.Month(),
-				Year:          d.Year(),
-				Hour:          d.Hour(),
-				ResponseCode:  responseCode(),
-				APIKey:        getRandomKey(),
-				TimeStamp:     d,
-				APIVersion:    apiVersion,
-				APIName:       api,
-				APIID:         apiID,
-				OrgID:         orgId,
-				OauthID:       "",
-				RequestTime:   int64(randomInRange(0, 10)),
-				RawRequest:    "Qk9EWSBEQVRB",
-				RawResponse:   "UkVTUE9OU0UgREFUQQ==",
-				IPAddress:     "118.93.55.103",
-				Tags:          []string{"orgid-" + orgId, "apiid-" + apiID},
-				Alias:         "",
-				TrackPath:     true,
-				ExpireAt:      time.Now().Add(time.Hour * 8760),
+		for hour := 0; hour < 24; hour++ {
+			volume := float64(profile.RecordsPerDay) / 24 * hourWeight(profile.Traffic, hour) * (0.75 + rand.Float64()/2)
+			latencyMedian, errorRate := profile.LatencyMedian, profile.ErrorRate
+			if profile.Traffic == SpikyTraffic && rand.Float64() < spikeChance {
+				volume *= spikeFactor
+				latencyMedian *= spikeFactor
+				errorRate = math.Min(errorRate*spikeFactor, 1)
 			}
 
-			set = append(set, r)
+			for i := 0; i < int(math.Round(volume)); i++ {
+				ts := d.Add(time.Duration(hour)*time.Hour + time.Duration(rand.Int63n(int64(time.Hour))))
+				set = append(set, demoRecord(ts, latencyMedian, errorRate))
+			}
 		}
-		count++
+
 		writer(set, nil, time.Now(), 1)
+	}
+}
+
+// GenerateRecords returns count demo records of the profile set by DemoInit, recorded at ts
+func GenerateRecords(count int, ts time.Time) []interface{} {
+	set := make([]interface{}, count)
+	for i := range set {
+		set[i] = demoRecord(ts, profile.LatencyMedian, profile.ErrorRate)
+	}
+	return set
+}
+
+func demoRecord(ts time.Time, latencyMedian, errorRate float64) analytics.AnalyticsRecord {
+	p := randomPath()
+	api, apiID := randomAPI()
+	orgId := orgIDs[rand.Intn(len(orgIDs))]
+	latency := requestTime(latencyMedian)
+	record := analytics.AnalyticsRecord{
+		Method:                randomMethod(),
+		Path:                  p,
+		RawPath:               p,
+		ContentLength:         int64(randomInRange(0, 999)),
+		ResponseContentLength: int64(randomInRange(0, 9999)),
+		UserAgent:             getUA(),
+		Day:                   ts.Day(),
+		Month:                 ts.Month(),
+		Year:                  ts.Year(),
+		Hour:                  ts.Hour(),
+		ResponseCode:          responseCode(errorRate),
+		APIKey:                getRandomKey(orgId),
+		TimeStamp:             ts,
+		APIVersion:            apiVersion,
+		APIName:               api,
+		APIID:                 apiID,
+		OrgID:                 orgId,
+		OauthID:               "",
+		RequestTime:           latency,
+		RawRequest:            "Qk9EWSBEQVRB",
+		RawResponse:           "UkVTUE9OU0UgREFUQQ==",
+		IPAddress:             "118.93.55.103",
+		Latency:               analytics.Latency{Total: latency, Upstream: latency * 4 / 5},
+		Tags:                  []string{"orgid-" + orgId, "apiid-" + apiID},
+		Alias:                 "",
+		TrackPath:             true,
+		ExpireAt:              time.Now().Add(time.Hour * 8760),
+	}
 
+	if rand.Float64() < profile.GraphQLRate {
+		setGraphQL(&record, profile.DetailedRecording)
+	} else if profile.DetailedRecording {
+		setDetails(&record)
 	}
+	return record
 }
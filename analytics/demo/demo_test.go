@@ -0,0 +1,87 @@
+package demo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+
+	"github.com/gocraft/health"
+)
+
+func TestHourWeight(t *testing.T) {
+	if hourWeight(FlatTraffic, 2) != hourWeight(FlatTraffic, 14) {
+		t.Error("expected flat traffic to be as busy at any hour")
+	}
+	if hourWeight(DiurnalTraffic, 14) <= hourWeight(DiurnalTraffic, 2) {
+		t.Error("expected diurnal traffic to be busier in the afternoon than at night")
+	}
+
+	total := 0.0
+	for hour := 0; hour < 24; hour++ {
+		total += hourWeight(DiurnalTraffic, hour)
+	}
+	if total < 23.99 || total > 24.01 {
+		t.Errorf("expected the diurnal traffic to average the flat one, got %f hours", total)
+	}
+}
+
+func TestGenerateDemoData(t *testing.T) {
+	DemoInit("org", "", "", Profile{Orgs: 2, APIs: 5, RecordsPerDay: 2400, Traffic: SpikyTraffic, LatencyMedian: 10, ErrorRate: 0.1})
+
+	start := time.Now().AddDate(0, 0, 1)
+	records := []analytics.AnalyticsRecord{}
+	batches := 0
+	GenerateDemoData(start, 2, func(set []interface{}, job *health.Job, startTime time.Time, purgeDelay int) {
+		batches++
+		for _, v := range set {
+			records = append(records, v.(analytics.AnalyticsRecord))
+		}
+	})
+
+	if batches != 2 {
+		t.Fatalf("expected a batch per day, got %d", batches)
+	}
+	if len(records) < 2400 {
+		t.Fatalf("expected around 2400 records per day, got %d in 2 days", len(records))
+	}
+
+	orgs, apis, errors := map[string]bool{}, map[string]bool{}, 0
+	for _, record := range records {
+		orgs[record.OrgID] = true
+		apis[record.APIID] = true
+		if record.ResponseCode >= 400 {
+			errors++
+		}
+		if !record.TimeStamp.After(time.Now()) {
+			t.Fatal("expected the records to be future dated, got", record.TimeStamp)
+		}
+		if record.Hour != record.TimeStamp.Hour() || record.Day != record.TimeStamp.Day() {
+			t.Fatal("expected the date fields to match the timestamp", record)
+		}
+	}
+	if len(orgs) != 2 || !orgs["org"] || !orgs["org2"] {
+		t.Errorf("expected the records of 2 orgs, got %v", orgs)
+	}
+	if len(apis) != 5 {
+		t.Errorf("expected the records of 5 APIs, got %d", len(apis))
+	}
+	if rate := float64(errors) / float64(len(records)); rate < 0.05 || rate > 0.3 {
+		t.Errorf("expected an error rate of around 0.1, got %f", rate)
+	}
+}
+
+func TestGenerateRecords(t *testing.T) {
+	DemoInit("org", "api", "", DefaultProfile())
+	ts := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	set := GenerateRecords(10, ts)
+	if len(set) != 10 {
+		t.Fatalf("expected 10 records, got %d", len(set))
+	}
+	for _, v := range set {
+		if record := v.(analytics.AnalyticsRecord); !record.TimeStamp.Equal(ts) || record.APIID != "api" {
+			t.Fatalf("expected a record of api recorded at %s, got %+v", ts, record)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package demo
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const demoHost = "api.example.com"
+
+// graphQLOperation is a sample GraphQL operation and the data it responds with
+type graphQLOperation struct {
+	name  string
+	query string
+	data  string
+}
+
+var graphQLOperations = []graphQLOperation{
+	{
+		name:  "GetUser",
+		query: `query GetUser($id: ID!) { user(id: $id) { id name email } }`,
+		data:  `{"user":{"id":"%[1]d","name":"%[2]s","email":"%[3]s"}}`,
+	},
+	{
+		name:  "ListOrders",
+		query: `query ListOrders { orders(first: 10) { id total } viewer { name } }`,
+		data:  `{"orders":[{"id":"%[1]d","total":42.5}],"viewer":{"name":"%[2]s"}}`,
+	},
+	{
+		name:  "CreateOrder",
+		query: `mutation CreateOrder($email: String!) { createOrder(email: $email) { id status } }`,
+		data:  `{"createOrder":{"id":"%[1]d","status":"CREATED"}}`,
+	},
+	{
+		name:  "OnOrderShipped",
+		query: `subscription OnOrderShipped { orderShipped { id shippedAt } }`,
+		data:  `{"orderShipped":{"id":"%[1]d","shippedAt":"2021-01-01T00:00:00Z"}}`,
+	},
+}
+
+var firstNames = []string{"Ada", "Alan", "Grace", "Linus", "Margaret", "Dennis", "Barbara", "Ken"}
+var lastNames = []string{"Lovelace", "Turing", "Hopper", "Torvalds", "Hamilton", "Ritchie", "Liskov", "Thompson"}
+
+// demoUser is the personal data in the sample bodies, so the pumps and pipelines masking it can be exercised
+type demoUser struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+}
+
+func randomUser() demoUser {
+	first, last := firstNames[rand.Intn(len(firstNames))], lastNames[rand.Intn(len(lastNames))]
+	return demoUser{
+		ID:    randomInRange(1, 100000),
+		Name:  first + " " + last,
+		Email: strings.ToLower(first+"."+last) + "@example.com",
+		Phone: fmt.Sprintf("+1-555-%04d", rand.Intn(10000)),
+	}
+}
+
+// rawRequest returns the base64 encoded HTTP request, as recorded by the Gateway
+func rawRequest(method, path, userAgent, apiKey, contentType string, body []byte) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\nAuthorization: %s\r\n", method, path, demoHost, userAgent, apiKey)
+	if len(body) > 0 {
+		fmt.Fprintf(&b, "Content-Type: %s\r\nContent-Length: %d\r\n", contentType, len(body))
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+	return base64.StdEncoding.EncodeToString([]byte(b.String()))
+}
+
+// rawResponse returns the base64 encoded HTTP response, as recorded by the Gateway
+func rawResponse(code int, body []byte) string {
+	response := fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", code, http.StatusText(code), len(body), body)
+	return base64.StdEncoding.EncodeToString([]byte(response))
+}
+
+// setDetails sets the raw request and response of the record, with JSON bodies of the methods with a body and of the
+// responses, and the content lengths of the bodies
+func setDetails(record *analytics.AnalyticsRecord) {
+	user := randomUser()
+
+	var reqBody []byte
+	if record.Method == http.MethodPost || record.Method == http.MethodPut {
+		reqBody, _ = json.Marshal(user)
+	}
+
+	var respBody []byte
+	switch {
+	case record.ResponseCode >= http.StatusBadRequest:
+		respBody, _ = json.Marshal(map[string]string{"error": http.StatusText(record.ResponseCode)})
+	case record.Method != http.MethodHead && record.Method != http.MethodOptions:
+		respBody, _ = json.Marshal(user)
+	}
+
+	record.RawRequest = rawRequest(record.Method, record.Path, record.UserAgent, record.APIKey, "application/json", reqBody)
+	record.RawResponse = rawResponse(record.ResponseCode, respBody)
+	record.ContentLength = int64(len(reqBody))
+	record.ResponseContentLength = int64(len(respBody))
+}
+
+// setGraphQL turns the record into the request of a sample GraphQL operation, POSTed to /graphql, with its GraphQL
+// stats and, when detailed is set, its raw request and response
+func setGraphQL(record *analytics.AnalyticsRecord, detailed bool) {
+	operation := graphQLOperations[rand.Intn(len(graphQLOperations))]
+	record.Method = http.MethodPost
+	record.Path = "/graphql"
+	record.RawPath = "/graphql"
+	if stats, err := analytics.ParseGraphQLOperation(operation.query, operation.name); err == nil {
+		record.GraphQL = stats
+	}
+
+	if !detailed {
+		return
+	}
+
+	user := randomUser()
+	reqBody, _ := json.Marshal(map[string]interface{}{
+		"query":         operation.query,
+		"operationName": operation.name,
+		"variables":     map[string]interface{}{"id": user.ID, "email": user.Email},
+	})
+
+	respBody := []byte(`{"data":` + fmt.Sprintf(operation.data, user.ID, user.Name, user.Email) + `}`)
+	if record.ResponseCode >= http.StatusBadRequest {
+		respBody, _ = json.Marshal(map[string]interface{}{
+			"errors": []map[string]string{{"message": http.StatusText(record.ResponseCode)}},
+		})
+	}
+
+	record.RawRequest = rawRequest(record.Method, record.Path, record.UserAgent, record.APIKey, "application/json", reqBody)
+	record.RawResponse = rawResponse(record.ResponseCode, respBody)
+	record.ContentLength = int64(len(reqBody))
+	record.ResponseContentLength = int64(len(respBody))
+}
@@ -0,0 +1,63 @@
+package demo
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestSetDetails(t *testing.T) {
+	record := analytics.AnalyticsRecord{Method: "POST", Path: "/widget", ResponseCode: 200, APIKey: "key"}
+	setDetails(&record)
+
+	req, reqBody, err := analytics.ParseRawRequest(record.RawRequest)
+	if err != nil {
+		t.Fatal("expected the raw request to be an HTTP request: ", err)
+	}
+	if req.Method != "POST" || req.URL.Path != "/widget" || int64(len(reqBody)) != record.ContentLength {
+		t.Errorf("unexpected raw request %s %s with %d bytes", req.Method, req.URL.Path, len(reqBody))
+	}
+	user := demoUser{}
+	if err := json.Unmarshal(reqBody, &user); err != nil || user.Email == "" {
+		t.Errorf("expected a JSON body with personal data, got %s", reqBody)
+	}
+
+	resp, respBody, err := analytics.ParseRawResponse(record.RawResponse)
+	if err != nil {
+		t.Fatal("expected the raw response to be an HTTP response: ", err)
+	}
+	if resp.StatusCode != 200 || int64(len(respBody)) != record.ResponseContentLength {
+		t.Errorf("unexpected raw response %d with %d bytes", resp.StatusCode, len(respBody))
+	}
+
+	record = analytics.AnalyticsRecord{Method: "GET", Path: "/widget", ResponseCode: 500}
+	setDetails(&record)
+	if record.ContentLength != 0 {
+		t.Error("expected no request body for a GET")
+	}
+	if _, respBody, _ := analytics.ParseRawResponse(record.RawResponse); string(respBody) != `{"error":"Internal Server Error"}` {
+		t.Errorf("expected an error body, got %s", respBody)
+	}
+}
+
+func TestSetGraphQL(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		record := analytics.AnalyticsRecord{Method: "GET", Path: "/widget", ResponseCode: 200, APIID: "api"}
+		setGraphQL(&record, true)
+		if record.GraphQL.OperationType == "" || len(record.GraphQL.RootFields) == 0 {
+			t.Fatalf("expected the GraphQL stats of the operation, got %+v", record.GraphQL)
+		}
+
+		if _, respBody, err := analytics.ParseRawResponse(record.RawResponse); err != nil || !json.Valid(respBody) {
+			t.Fatalf("expected a JSON response, got %s", respBody)
+		}
+
+		enriched := record
+		enriched.GraphQL = analytics.GraphQLStats{}
+		analytics.GraphQLConfig{Enabled: true}.Enrich(&enriched, analytics.NewRawRecord(&enriched))
+		if enriched.GraphQL.OperationName != record.GraphQL.OperationName {
+			t.Fatalf("expected the raw request to be enriched with the same operation, got %+v", enriched.GraphQL)
+		}
+	}
+}
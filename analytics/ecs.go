@@ -0,0 +1,121 @@
+package analytics
+
+import "time"
+
+// ECSVersion is the version of the Elastic Common Schema the records are mapped to
+const ECSVersion = "8.11.0"
+
+// ECSDocument maps the record to the field names of the Elastic Common Schema, so it can be used by the dashboards and
+// the detection rules built on it. The fields without an ECS equivalent, like the API or the key, are under tyk.
+func (a *AnalyticsRecord) ECSDocument() map[string]interface{} {
+	outcome := "success"
+	if a.ResponseCode >= 400 {
+		outcome = "failure"
+	}
+
+	doc := map[string]interface{}{
+		"@timestamp": a.TimeStamp,
+		"ecs":        map[string]interface{}{"version": ECSVersion},
+		"event": map[string]interface{}{
+			"kind":     "event",
+			"category": []string{"web"},
+			"type":     []string{"access"},
+			"outcome":  outcome,
+			"duration": a.RequestTime * int64(time.Millisecond),
+		},
+		"http": map[string]interface{}{
+			"request": map[string]interface{}{
+				"method": a.Method,
+				"bytes":  a.ContentLength,
+			},
+			"response": map[string]interface{}{
+				"status_code": a.ResponseCode,
+				"bytes":       a.ResponseContentLength,
+			},
+		},
+		"url": map[string]interface{}{
+			"domain":   a.Host,
+			"path":     a.Path,
+			"original": a.RawPath,
+		},
+		"source":     map[string]interface{}{"ip": a.IPAddress},
+		"user_agent": map[string]interface{}{"original": a.UserAgent},
+		"tyk": map[string]interface{}{
+			"api_id":      a.APIID,
+			"api_name":    a.APIName,
+			"api_version": a.APIVersion,
+			"api_key":     a.APIKey,
+			"oauth_id":    a.OauthID,
+			"latency": map[string]interface{}{
+				"total":    a.Latency.Total,
+				"upstream": a.Latency.Upstream,
+			},
+		},
+	}
+
+	if a.IPAddress == "" {
+		delete(doc, "source")
+	} else if geo := a.Geo.ecs(); len(geo) > 0 {
+		doc["source"].(map[string]interface{})["geo"] = geo
+	}
+	if a.UserAgent == "" {
+		delete(doc, "user_agent")
+	}
+	if a.Alias != "" {
+		doc["user"] = map[string]interface{}{"name": a.Alias}
+	}
+	if a.OrgID != "" {
+		doc["organization"] = map[string]interface{}{"id": a.OrgID}
+	}
+	if len(a.Tags) > 0 {
+		doc["tags"] = a.Tags
+	}
+	if a.ErrorClass != "" {
+		doc["error"] = map[string]interface{}{"type": a.ErrorClass}
+	}
+	if a.CorrelationID != "" {
+		doc["http"].(map[string]interface{})["request"].(map[string]interface{})["id"] = a.CorrelationID
+	}
+	if a.TraceID != "" {
+		doc["trace"] = map[string]interface{}{"id": a.TraceID}
+	}
+	if a.SpanID != "" {
+		doc["span"] = map[string]interface{}{"id": a.SpanID}
+	}
+
+	tyk := doc["tyk"].(map[string]interface{})
+	if a.GraphQL.OperationType != "" {
+		tyk["graphql"] = a.GraphQL
+	}
+	if a.Portal.DeveloperID != "" {
+		tyk["portal"] = a.Portal
+	}
+	if a.GRPC.Method != "" {
+		tyk["grpc"] = a.GRPC
+	}
+	if len(a.ResponseHeaders) > 0 {
+		tyk["response_headers"] = a.ResponseHeaders
+	}
+	if len(a.BodyFields) > 0 {
+		tyk["body_fields"] = a.BodyFields
+	}
+	return doc
+}
+
+// ecs returns the ECS geo fields of the IP address, or none when it wasn't geolocated
+func (g *GeoData) ecs() map[string]interface{} {
+	geo := map[string]interface{}{}
+	if g.Country.ISOCode != "" {
+		geo["country_iso_code"] = g.Country.ISOCode
+	}
+	if name := g.City.Names["en"]; name != "" {
+		geo["city_name"] = name
+	}
+	if g.Location.Latitude != 0 || g.Location.Longitude != 0 {
+		geo["location"] = map[string]float64{"lat": g.Location.Latitude, "lon": g.Location.Longitude}
+	}
+	if g.Location.TimeZone != "" {
+		geo["timezone"] = g.Location.TimeZone
+	}
+	return geo
+}
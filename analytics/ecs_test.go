@@ -0,0 +1,57 @@
+package analytics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestECSDocument(t *testing.T) {
+	record := AnalyticsRecord{
+		Method:        "POST",
+		Host:          "api.example.com",
+		Path:          "/users",
+		RawPath:       "/users?page=2",
+		ContentLength: 42,
+		ResponseCode:  503,
+		RequestTime:   15,
+		IPAddress:     "1.2.3.4",
+		Alias:         "acme",
+		OrgID:         "org1",
+		APIID:         "api1",
+		ErrorClass:    "upstream_timeout",
+		TimeStamp:     time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	record.Geo.Country.ISOCode = "BG"
+
+	doc := record.ECSDocument()
+	expected := map[string]interface{}{
+		"kind":     "event",
+		"category": []string{"web"},
+		"type":     []string{"access"},
+		"outcome":  "failure",
+		"duration": int64(15000000),
+	}
+	if !reflect.DeepEqual(doc["event"], expected) {
+		t.Errorf("expected the event %v, got %v", expected, doc["event"])
+	}
+	if method := doc["http"].(map[string]interface{})["request"].(map[string]interface{})["method"]; method != "POST" {
+		t.Errorf("unexpected method %v", method)
+	}
+	if original := doc["url"].(map[string]interface{})["original"]; original != "/users?page=2" {
+		t.Errorf("unexpected url %v", original)
+	}
+	source := doc["source"].(map[string]interface{})
+	if source["ip"] != "1.2.3.4" || source["geo"].(map[string]interface{})["country_iso_code"] != "BG" {
+		t.Errorf("unexpected source %v", source)
+	}
+	if doc["user"].(map[string]interface{})["name"] != "acme" || doc["error"].(map[string]interface{})["type"] != "upstream_timeout" {
+		t.Errorf("unexpected user or error %v %v", doc["user"], doc["error"])
+	}
+	if doc["tyk"].(map[string]interface{})["api_id"] != "api1" {
+		t.Errorf("unexpected tyk fields %v", doc["tyk"])
+	}
+	if _, ok := doc["user_agent"]; ok {
+		t.Error("expected the empty user agent to be omitted")
+	}
+}
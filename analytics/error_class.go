@@ -0,0 +1,61 @@
+package analytics
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// The error classes of the records, from their response code and the errors answered by the Gateway itself
+const (
+	ClientErrorClass      = "client_error"
+	ServerErrorClass      = "server_error"
+	TimeoutErrorClass     = "timeout"
+	CircuitOpenErrorClass = "circuit_open"
+	AuthFailureErrorClass = "auth_failure"
+)
+
+// ErrorClasses are all the error classes
+var ErrorClasses = []string{ClientErrorClass, ServerErrorClass, TimeoutErrorClass, CircuitOpenErrorClass, AuthFailureErrorClass}
+
+// circuitOpenMessage is the error the Gateway answers with when the circuit breaker of an endpoint is open
+var circuitOpenMessage = []byte("Service temporarily unavailable.")
+
+// ClassifyError returns the error class of the record, or an empty string when the request succeeded. A tag named
+// after an error class takes precedence, then the authentication failures and the timeouts are told from the rest of
+// client and server errors by their response code, and the open circuit breakers by the error in the raw response.
+// The failed gRPC calls answered with a 200 are classified by the response code equivalent to their status.
+func (a *AnalyticsRecord) ClassifyError(raw *RawRecord) string {
+	for _, tag := range a.Tags {
+		for _, class := range ErrorClasses {
+			if tag == class {
+				return class
+			}
+		}
+	}
+
+	responseCode := a.GRPC.ResponseCode(a.ResponseCode)
+	switch {
+	case responseCode < http.StatusBadRequest:
+		return ""
+	case responseCode == http.StatusUnauthorized, responseCode == http.StatusForbidden:
+		return AuthFailureErrorClass
+	case responseCode == http.StatusRequestTimeout, responseCode == http.StatusGatewayTimeout:
+		return TimeoutErrorClass
+	case responseCode == http.StatusServiceUnavailable && a.isCircuitOpen(raw):
+		return CircuitOpenErrorClass
+	case responseCode >= http.StatusInternalServerError:
+		return ServerErrorClass
+	default:
+		return ClientErrorClass
+	}
+}
+
+// isCircuitOpen returns whether the raw response is the error of an open circuit breaker, which is only known when the
+// detailed recording is enabled
+func (a *AnalyticsRecord) isCircuitOpen(raw *RawRecord) bool {
+	if a.RawResponse == "" {
+		return false
+	}
+	_, body, err := raw.Response()
+	return err == nil && bytes.Contains(body, circuitOpenMessage)
+}
@@ -0,0 +1,50 @@
+package analytics
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	circuitOpen := base64.StdEncoding.EncodeToString([]byte("HTTP/1.1 503 Service Unavailable\r\nContent-Length: 46\r\n\r\n{\"error\": \"Service temporarily unavailable.\"}\n"))
+
+	tests := []struct {
+		record   AnalyticsRecord
+		expected string
+	}{
+		{AnalyticsRecord{ResponseCode: 200}, ""},
+		{AnalyticsRecord{ResponseCode: -1}, ""},
+		{AnalyticsRecord{ResponseCode: 404}, ClientErrorClass},
+		{AnalyticsRecord{ResponseCode: 401}, AuthFailureErrorClass},
+		{AnalyticsRecord{ResponseCode: 403}, AuthFailureErrorClass},
+		{AnalyticsRecord{ResponseCode: 504}, TimeoutErrorClass},
+		{AnalyticsRecord{ResponseCode: 503}, ServerErrorClass},
+		{AnalyticsRecord{ResponseCode: 503, RawResponse: circuitOpen}, CircuitOpenErrorClass},
+		{AnalyticsRecord{ResponseCode: 500}, ServerErrorClass},
+		{AnalyticsRecord{ResponseCode: 500, Tags: []string{"key-1", "timeout"}}, TimeoutErrorClass},
+	}
+	for _, test := range tests {
+		if class := test.record.ClassifyError(NewRawRecord(&test.record)); class != test.expected {
+			t.Errorf("expected %d %v to be classified as %q, got %q", test.record.ResponseCode, test.record.Tags, test.expected, class)
+		}
+	}
+}
+
+func TestAggregateDataErrorClasses(t *testing.T) {
+	data := []interface{}{
+		AnalyticsRecord{OrgID: "org1", ResponseCode: 504, ErrorClass: TimeoutErrorClass, TimeStamp: time.Now()},
+		AnalyticsRecord{OrgID: "org1", ResponseCode: 504, ErrorClass: TimeoutErrorClass, TimeStamp: time.Now()},
+		AnalyticsRecord{OrgID: "org1", ResponseCode: 200, TimeStamp: time.Now()},
+	}
+
+	aggregate := AggregateData(data, false, nil, false, nil, nil)["org1"]
+	if len(aggregate.ErrorClasses) != 1 || aggregate.ErrorClasses[TimeoutErrorClass].Hits != 2 {
+		t.Fatal("unexpected error classes:", aggregate.ErrorClasses)
+	}
+
+	aggregate = AggregateData(data, false, nil, false, []string{"apiid"}, nil)["org1"]
+	if len(aggregate.ErrorClasses) != 0 {
+		t.Fatal("expected the error classes not to be aggregated")
+	}
+}
@@ -0,0 +1,378 @@
+package analytics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// GraphQLConfig configures the enrichment of the records of GraphQL APIs with the operation of their request
+type GraphQLConfig struct {
+	Enabled bool `json:"enabled"`
+	// APIIDs are the GraphQL APIs. When empty, the records of any API with a GraphQL request are enriched.
+	APIIDs []string `json:"api_ids"`
+}
+
+// GraphQLStats is the GraphQL operation of a request
+type GraphQLStats struct {
+	OperationName string `json:"operation_name"`
+	// OperationType is query, mutation or subscription
+	OperationType string `json:"operation_type"`
+	// RootFields are the fields requested at the root of the operation
+	RootFields []string `json:"root_fields"`
+}
+
+// graphQLRequest is a GraphQL request sent over HTTP as JSON
+type graphQLRequest struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName"`
+}
+
+// Enrich sets the GraphQL operation of the records of the GraphQL APIs, parsed from their raw request, so it's only
+// known when the detailed recording is enabled
+func (c GraphQLConfig) Enrich(record *AnalyticsRecord, raw *RawRecord) {
+	if !c.Enabled || record.RawRequest == "" || record.GraphQL.OperationType != "" {
+		return
+	}
+	if len(c.APIIDs) > 0 && !stringInSlice(record.APIID, c.APIIDs) {
+		return
+	}
+
+	query, operationName, ok := graphQLQuery(raw)
+	if !ok {
+		return
+	}
+	if stats, err := ParseGraphQLOperation(query, operationName); err == nil {
+		record.GraphQL = stats
+	}
+}
+
+// graphQLQuery returns the query and the operation name of the raw request, when it's a GraphQL request: a GET with
+// a query parameter, or a POST with a JSON or an application/graphql body
+func graphQLQuery(raw *RawRecord) (string, string, bool) {
+	req, body, err := raw.Request()
+	if err != nil {
+		return "", "", false
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		query := req.URL.Query()
+		return query.Get("query"), query.Get("operationName"), query.Get("query") != ""
+	case http.MethodPost:
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediaType == "application/graphql" {
+			return string(body), req.URL.Query().Get("operationName"), len(body) > 0
+		}
+
+		// batched requests are arrays of requests, the first one is taken
+		gqlReq := graphQLRequest{}
+		if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+			batch := []graphQLRequest{}
+			if err := json.Unmarshal(body, &batch); err != nil || len(batch) == 0 {
+				return "", "", false
+			}
+			gqlReq = batch[0]
+		} else if err := json.Unmarshal(body, &gqlReq); err != nil {
+			return "", "", false
+		}
+		return gqlReq.Query, gqlReq.OperationName, gqlReq.Query != ""
+	}
+	return "", "", false
+}
+
+// graphQLToken is a name, like query or user, or a punctuator, like { or ..., of a GraphQL document. The values are
+// skipped by the lexer.
+type graphQLToken struct {
+	value  string
+	isName bool
+}
+
+// graphQLOperation is an operation or a fragment definition, with the root fields of its selection set and the
+// fragments spread at its root
+type graphQLOperation struct {
+	name          string
+	operationType string
+	fields        []string
+	spreads       []string
+}
+
+// ParseGraphQLOperation parses the GraphQL document and returns the operation with the given name, or the first one
+// when the name is empty. The fields of the fragments spread at the root of the operation are root fields too.
+func ParseGraphQLOperation(query, operationName string) (GraphQLStats, error) {
+	tokens, err := lexGraphQL(query)
+	if err != nil {
+		return GraphQLStats{}, err
+	}
+
+	p := &graphQLParser{tokens: tokens}
+	operations := []*graphQLOperation{}
+	fragments := map[string]*graphQLOperation{}
+	for !p.done() {
+		definition, isFragment, err := p.definition()
+		if err != nil {
+			return GraphQLStats{}, err
+		}
+		if isFragment {
+			fragments[definition.name] = definition
+		} else {
+			operations = append(operations, definition)
+		}
+	}
+
+	for _, operation := range operations {
+		if operationName != "" && operation.name != operationName {
+			continue
+		}
+		fields := []string{}
+		collectGraphQLFields(operation, fragments, map[string]bool{}, &fields)
+		return GraphQLStats{OperationName: operation.name, OperationType: operation.operationType, RootFields: fields}, nil
+	}
+	if operationName != "" {
+		return GraphQLStats{}, fmt.Errorf("operation %s not found", operationName)
+	}
+	return GraphQLStats{}, errors.New("no operation found")
+}
+
+// collectGraphQLFields appends the root fields of the definition and of the fragments it spreads, once
+func collectGraphQLFields(definition *graphQLOperation, fragments map[string]*graphQLOperation, visited map[string]bool, fields *[]string) {
+	for _, field := range definition.fields {
+		if !stringInSlice(field, *fields) {
+			*fields = append(*fields, field)
+		}
+	}
+	for _, spread := range definition.spreads {
+		fragment, ok := fragments[spread]
+		if !ok || visited[spread] {
+			continue
+		}
+		visited[spread] = true
+		collectGraphQLFields(fragment, fragments, visited, fields)
+	}
+}
+
+func lexGraphQL(query string) ([]graphQLToken, error) {
+	tokens := []graphQLToken{}
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			end, err := skipGraphQLString(query, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+		case c == '.':
+			if !strings.HasPrefix(query[i:], "...") {
+				return nil, fmt.Errorf("unexpected . at %d", i)
+			}
+			tokens = append(tokens, graphQLToken{value: "..."})
+			i += 3
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(query) && (query[i] == '_' || query[i] >= 'a' && query[i] <= 'z' || query[i] >= 'A' && query[i] <= 'Z' || query[i] >= '0' && query[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, graphQLToken{value: query[start:i], isName: true})
+		case c == '-' || c >= '0' && c <= '9':
+			// numbers are only found in values, which aren't needed
+			i++
+			for i < len(query) && (query[i] >= '0' && query[i] <= '9' || query[i] == '.' || query[i] == 'e' || query[i] == 'E' || query[i] == '+' || query[i] == '-') {
+				i++
+			}
+		case strings.IndexByte("{}()[]:!$@=|&", c) >= 0:
+			tokens = append(tokens, graphQLToken{value: string(c)})
+			i++
+		default:
+			// the BOM and the rest of unicode characters can only be found in strings and comments
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// skipGraphQLString returns the position after the string or block string starting at start
+func skipGraphQLString(query string, start int) (int, error) {
+	if strings.HasPrefix(query[start:], `"""`) {
+		for i := start + 3; i < len(query); i++ {
+			if strings.HasPrefix(query[i:], `\"""`) {
+				i += 3
+				continue
+			}
+			if strings.HasPrefix(query[i:], `"""`) {
+				return i + 3, nil
+			}
+		}
+		return 0, errors.New("unterminated block string")
+	}
+
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		case '\n':
+			return 0, errors.New("unterminated string")
+		}
+	}
+	return 0, errors.New("unterminated string")
+}
+
+type graphQLParser struct {
+	tokens []graphQLToken
+	pos    int
+}
+
+func (p *graphQLParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *graphQLParser) peek() graphQLToken {
+	if p.done() {
+		return graphQLToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *graphQLParser) next() graphQLToken {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+// definition parses an operation or a fragment definition
+func (p *graphQLParser) definition() (*graphQLOperation, bool, error) {
+	definition := &graphQLOperation{operationType: "query"}
+	isFragment := false
+
+	token := p.peek()
+	switch {
+	case token.value == "{":
+	case token.isName && (token.value == "query" || token.value == "mutation" || token.value == "subscription"):
+		definition.operationType = p.next().value
+		if p.peek().isName {
+			definition.name = p.next().value
+		}
+	case token.isName && token.value == "fragment":
+		p.next()
+		definition.name = p.next().value
+		if on := p.next(); on.value != "on" {
+			return nil, false, fmt.Errorf("unexpected %q in fragment %s", on.value, definition.name)
+		}
+		p.next()
+		isFragment = true
+	default:
+		return nil, false, fmt.Errorf("unexpected %q", token.value)
+	}
+
+	if p.peek().value == "(" {
+		if err := p.skipBalanced("(", ")"); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := p.skipDirectives(); err != nil {
+		return nil, false, err
+	}
+	if err := p.rootSelectionSet(definition); err != nil {
+		return nil, false, err
+	}
+	return definition, isFragment, nil
+}
+
+// rootSelectionSet parses the selection set of a definition, keeping its fields and fragment spreads. The fields of
+// the inline fragments at the root are root fields too.
+func (p *graphQLParser) rootSelectionSet(definition *graphQLOperation) error {
+	if token := p.next(); token.value != "{" {
+		return fmt.Errorf("expected a selection set, got %q", token.value)
+	}
+
+	for {
+		token := p.next()
+		switch {
+		case token.value == "}":
+			return nil
+		case token.value == "...":
+			if p.peek().isName && p.peek().value != "on" {
+				definition.spreads = append(definition.spreads, p.next().value)
+				if err := p.skipDirectives(); err != nil {
+					return err
+				}
+				continue
+			}
+			if p.peek().value == "on" {
+				p.next()
+				p.next()
+			}
+			if err := p.skipDirectives(); err != nil {
+				return err
+			}
+			if err := p.rootSelectionSet(definition); err != nil {
+				return err
+			}
+		case token.isName:
+			field := token.value
+			if p.peek().value == ":" {
+				p.next()
+				field = p.next().value
+			}
+			if field != "" && field != "__typename" {
+				definition.fields = append(definition.fields, field)
+			}
+			if p.peek().value == "(" {
+				if err := p.skipBalanced("(", ")"); err != nil {
+					return err
+				}
+			}
+			if err := p.skipDirectives(); err != nil {
+				return err
+			}
+			if p.peek().value == "{" {
+				if err := p.skipBalanced("{", "}"); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unexpected %q in selection set", token.value)
+		}
+	}
+}
+
+func (p *graphQLParser) skipDirectives() error {
+	for p.peek().value == "@" {
+		p.next()
+		p.next()
+		if p.peek().value == "(" {
+			if err := p.skipBalanced("(", ")"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// skipBalanced skips from the open token to its matching close token
+func (p *graphQLParser) skipBalanced(open, close string) error {
+	depth := 0
+	for !p.done() {
+		switch p.next().value {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("unbalanced %s", open)
+}
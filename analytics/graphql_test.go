@@ -0,0 +1,105 @@
+package analytics
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestParseGraphQLOperation(t *testing.T) {
+	query := `
+# the user with their orders
+query GetUser($id: ID!, $first: Int = 10) @cached(ttl: 60) {
+  user(id: $id) { name orders(first: $first) { id } }
+  me: viewer { id }
+  ...Stats
+  ... on Query @include(if: true) { search(text: "a } b") }
+  __typename
+}
+
+mutation CreateUser { createUser(input: {name: """block " } string"""}) { id } }
+
+fragment Stats on Query { stats { hits } user { id } }
+`
+
+	stats, err := ParseGraphQLOperation(query, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.OperationName != "GetUser" || stats.OperationType != "query" {
+		t.Fatalf("unexpected operation %+v", stats)
+	}
+	expected := []string{"user", "viewer", "search", "stats"}
+	if len(stats.RootFields) != len(expected) {
+		t.Fatalf("expected the root fields %v, got %v", expected, stats.RootFields)
+	}
+	for i := range expected {
+		if stats.RootFields[i] != expected[i] {
+			t.Fatalf("expected the root fields %v, got %v", expected, stats.RootFields)
+		}
+	}
+
+	stats, err = ParseGraphQLOperation(query, "CreateUser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.OperationType != "mutation" || len(stats.RootFields) != 1 || stats.RootFields[0] != "createUser" {
+		t.Fatalf("unexpected operation %+v", stats)
+	}
+
+	stats, err = ParseGraphQLOperation("{ hero { name } }", "")
+	if err != nil || stats.OperationType != "query" || stats.OperationName != "" || stats.RootFields[0] != "hero" {
+		t.Fatalf("unexpected shorthand query %+v: %v", stats, err)
+	}
+
+	if _, err := ParseGraphQLOperation(query, "Unknown"); err == nil {
+		t.Error("expected an error for an unknown operation")
+	}
+	if _, err := ParseGraphQLOperation("query { user(id: 1) ", ""); err == nil {
+		t.Error("expected an error for an unterminated query")
+	}
+}
+
+func TestGraphQLConfigEnrich(t *testing.T) {
+	rawRequest := "POST /graphql HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/json\r\nContent-Length: 79\r\n\r\n" +
+		`{"query": "subscription OnEvent { events { id } }", "operationName": "OnEvent"}`
+
+	record := &AnalyticsRecord{APIID: "gql", RawRequest: base64.StdEncoding.EncodeToString([]byte(rawRequest))}
+	GraphQLConfig{Enabled: true, APIIDs: []string{"rest"}}.Enrich(record, NewRawRecord(record))
+	if record.GraphQL.OperationType != "" {
+		t.Fatal("expected the records of other APIs not to be enriched")
+	}
+
+	GraphQLConfig{Enabled: true}.Enrich(record, NewRawRecord(record))
+	if record.GraphQL.OperationName != "OnEvent" || record.GraphQL.OperationType != "subscription" || record.GraphQL.RootFields[0] != "events" {
+		t.Fatalf("unexpected GraphQL stats %+v", record.GraphQL)
+	}
+
+	getRequest := "GET /graphql?query=%7Bhero%7Bname%7D%7D HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	record = &AnalyticsRecord{RawRequest: base64.StdEncoding.EncodeToString([]byte(getRequest))}
+	GraphQLConfig{Enabled: true}.Enrich(record, NewRawRecord(record))
+	if record.GraphQL.OperationType != "query" || record.GraphQL.RootFields[0] != "hero" {
+		t.Fatalf("unexpected GraphQL stats %+v", record.GraphQL)
+	}
+}
+
+func TestAggregateDataGraphQL(t *testing.T) {
+	graphQL := GraphQLStats{OperationName: "GetUser", OperationType: "query", RootFields: []string{"user", "viewer"}}
+	data := []interface{}{
+		AnalyticsRecord{OrgID: "org1", ResponseCode: 200, GraphQL: graphQL, TimeStamp: time.Now()},
+		AnalyticsRecord{OrgID: "org1", ResponseCode: 200, GraphQL: graphQL, TimeStamp: time.Now()},
+	}
+
+	aggregate := AggregateData(data, false, nil, false, nil, nil)["org1"]
+	if len(aggregate.GraphQLOperations) != 0 || len(aggregate.GraphQLFields) != 0 {
+		t.Fatal("expected the GraphQL dimensions not to be aggregated by default")
+	}
+
+	aggregate = AggregateData(data, false, nil, false, []string{"graphqloperations", "graphqlfields"}, nil)["org1"]
+	if c := aggregate.GraphQLOperations["query:GetUser"]; c == nil || c.Hits != 2 {
+		t.Fatal("unexpected GraphQL operations:", aggregate.GraphQLOperations)
+	}
+	if c := aggregate.GraphQLFields["query:viewer"]; len(aggregate.GraphQLFields) != 2 || c == nil || c.Hits != 2 {
+		t.Fatal("unexpected GraphQL fields:", aggregate.GraphQLFields)
+	}
+}
@@ -0,0 +1,125 @@
+package analytics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GRPCConfig configures the enrichment of the records of gRPC APIs with the method called and its status
+type GRPCConfig struct {
+	Enabled bool `json:"enabled"`
+	// APIIDs are the gRPC APIs. When empty, the records of any API with a gRPC request are enriched, which is only
+	// known from the raw request.
+	APIIDs []string `json:"api_ids"`
+}
+
+// GRPCStats is the gRPC method of a request and the status it was answered with
+type GRPCStats struct {
+	// Service is the full name of the service, like helloworld.Greeter
+	Service string `json:"service"`
+	Method  string `json:"method"`
+	// Status is the name of the status code, like OK or UNAVAILABLE, empty when the status isn't known
+	Status     string `json:"status"`
+	StatusCode int    `json:"status_code"`
+}
+
+// grpcStatuses are the names of the gRPC status codes
+var grpcStatuses = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND", "ALREADY_EXISTS",
+	"PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED",
+	"INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+// grpcResponseCodes are the HTTP status codes equivalent to the gRPC status codes
+var grpcResponseCodes = []int{
+	http.StatusOK, 499, http.StatusInternalServerError, http.StatusBadRequest, http.StatusGatewayTimeout,
+	http.StatusNotFound, http.StatusConflict, http.StatusForbidden, http.StatusTooManyRequests, http.StatusBadRequest,
+	http.StatusConflict, http.StatusBadRequest, http.StatusNotImplemented, http.StatusInternalServerError,
+	http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusUnauthorized,
+}
+
+// Failed returns whether the call was answered with a status other than OK
+func (s GRPCStats) Failed() bool {
+	return s.Status != "" && s.StatusCode != 0
+}
+
+// ResponseCode returns the HTTP status code equivalent to the status of a failed call, when it was answered with a
+// successful response code, as the gRPC calls are answered with a 200 whatever their status. The response code is
+// returned as is otherwise.
+func (s GRPCStats) ResponseCode(responseCode int) int {
+	if !s.Failed() || responseCode >= http.StatusBadRequest || responseCode < 0 {
+		return responseCode
+	}
+	if s.StatusCode < len(grpcResponseCodes) {
+		return grpcResponseCodes[s.StatusCode]
+	}
+	return http.StatusInternalServerError
+}
+
+// Enrich sets the gRPC method of the records of the gRPC APIs, parsed from the path of their request, and its status,
+// from the grpc-status header or trailer of their raw response. The requests are told from their content type when
+// the detailed recording is enabled, otherwise the records of the configured APIs are enriched from their path.
+func (c GRPCConfig) Enrich(record *AnalyticsRecord, raw *RawRecord) {
+	if !c.Enabled || record.GRPC.Method != "" {
+		return
+	}
+	listed := len(c.APIIDs) > 0 && stringInSlice(record.APIID, c.APIIDs)
+	if len(c.APIIDs) > 0 && !listed {
+		return
+	}
+
+	path := ""
+	if record.RawRequest != "" {
+		req, _, err := raw.Request()
+		if err != nil || !isGRPCContentType(req.Header.Get("Content-Type")) {
+			return
+		}
+		path = req.URL.Path
+	} else if listed {
+		path = record.Path
+	}
+
+	service, method, ok := parseGRPCPath(path)
+	if !ok {
+		return
+	}
+	record.GRPC = GRPCStats{Service: service, Method: method}
+
+	if record.RawResponse == "" {
+		return
+	}
+	resp, _, err := raw.Response()
+	if err != nil {
+		return
+	}
+	// the status is a trailer, or a header when the call failed before responding
+	status := resp.Header.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Trailer.Get("Grpc-Status")
+	}
+	if code, err := strconv.Atoi(strings.TrimSpace(status)); err == nil && code >= 0 {
+		record.GRPC.StatusCode = code
+		record.GRPC.Status = "UNKNOWN"
+		if code < len(grpcStatuses) {
+			record.GRPC.Status = grpcStatuses[code]
+		}
+	}
+}
+
+// isGRPCContentType returns whether the content type is the one of gRPC or gRPC-Web, like application/grpc+proto
+func isGRPCContentType(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	return strings.HasPrefix(contentType, "application/grpc")
+}
+
+// parseGRPCPath returns the service and the method of the path of a gRPC request, /package.Service/Method, which may
+// be prefixed by the listen path of the API
+func parseGRPCPath(path string) (string, string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) < 2 {
+		return "", "", false
+	}
+	service, method := segments[len(segments)-2], segments[len(segments)-1]
+	return service, method, service != "" && method != ""
+}
@@ -0,0 +1,95 @@
+package analytics
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestGRPCConfigEnrich(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.StdEncoding.EncodeToString([]byte(raw))
+	}
+	rawRequest := encode("POST /helloworld.Greeter/SayHello HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/grpc\r\nContent-Length: 0\r\n\r\n")
+	conf := GRPCConfig{Enabled: true}
+
+	record := AnalyticsRecord{
+		ResponseCode: 200,
+		RawRequest:   rawRequest,
+		RawResponse:  encode("HTTP/1.1 200 OK\r\nContent-Type: application/grpc\r\nTransfer-Encoding: chunked\r\nTrailer: Grpc-Status\r\n\r\n0\r\nGrpc-Status: 14\r\n\r\n"),
+	}
+	conf.Enrich(&record, NewRawRecord(&record))
+	expected := GRPCStats{Service: "helloworld.Greeter", Method: "SayHello", Status: "UNAVAILABLE", StatusCode: 14}
+	if record.GRPC != expected {
+		t.Fatalf("expected %+v, got %+v", expected, record.GRPC)
+	}
+	if class := record.ClassifyError(NewRawRecord(&record)); class != ServerErrorClass {
+		t.Errorf("expected the failed call to be classified as %q, got %q", ServerErrorClass, class)
+	}
+
+	record = AnalyticsRecord{
+		RawRequest:  rawRequest,
+		RawResponse: encode("HTTP/1.1 200 OK\r\nContent-Type: application/grpc\r\nGrpc-Status: 16\r\nContent-Length: 0\r\n\r\n"),
+	}
+	conf.Enrich(&record, NewRawRecord(&record))
+	if record.GRPC.Status != "UNAUTHENTICATED" {
+		t.Errorf("expected the status of the header, got %+v", record.GRPC)
+	}
+
+	record = AnalyticsRecord{RawRequest: encode("POST /helloworld.Greeter/SayHello HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/json\r\nContent-Length: 0\r\n\r\n")}
+	conf.Enrich(&record, NewRawRecord(&record))
+	if record.GRPC.Method != "" {
+		t.Errorf("expected the JSON request not to be enriched, got %+v", record.GRPC)
+	}
+
+	record = AnalyticsRecord{APIID: "api1", Path: "/grpc/helloworld.Greeter/SayHello"}
+	GRPCConfig{Enabled: true, APIIDs: []string{"api1"}}.Enrich(&record, NewRawRecord(&record))
+	if record.GRPC.Service != "helloworld.Greeter" || record.GRPC.Method != "SayHello" || record.GRPC.Status != "" {
+		t.Errorf("expected the method of the path of the listed API, got %+v", record.GRPC)
+	}
+}
+
+func TestGRPCStatsResponseCode(t *testing.T) {
+	tests := []struct {
+		stats        GRPCStats
+		responseCode int
+		expected     int
+	}{
+		{GRPCStats{Method: "SayHello"}, 200, 200},
+		{GRPCStats{Method: "SayHello", Status: "OK"}, 200, 200},
+		{GRPCStats{Method: "SayHello", Status: "DEADLINE_EXCEEDED", StatusCode: 4}, 200, 504},
+		{GRPCStats{Method: "SayHello", Status: "NOT_FOUND", StatusCode: 5}, 200, 404},
+		{GRPCStats{Method: "SayHello", Status: "UNKNOWN", StatusCode: 42}, 200, 500},
+		{GRPCStats{Method: "SayHello", Status: "INTERNAL", StatusCode: 13}, 429, 429},
+	}
+	for _, test := range tests {
+		if code := test.stats.ResponseCode(test.responseCode); code != test.expected {
+			t.Errorf("expected %+v answered with %d to be %d, got %d", test.stats, test.responseCode, test.expected, code)
+		}
+	}
+}
+
+func TestAggregateDataGRPC(t *testing.T) {
+	ok := GRPCStats{Service: "helloworld.Greeter", Method: "SayHello", Status: "OK"}
+	failed := GRPCStats{Service: "helloworld.Greeter", Method: "SayHello", Status: "UNAVAILABLE", StatusCode: 14}
+	data := []interface{}{
+		AnalyticsRecord{OrgID: "org1", ResponseCode: 200, GRPC: ok, TimeStamp: time.Now()},
+		AnalyticsRecord{OrgID: "org1", ResponseCode: 200, GRPC: failed, TimeStamp: time.Now()},
+	}
+
+	aggregate := AggregateData(data, false, nil, false, nil, nil)["org1"]
+	if len(aggregate.GRPCMethods) != 0 || len(aggregate.GRPCStatuses) != 0 {
+		t.Fatal("expected the gRPC dimensions not to be aggregated by default")
+	}
+	if aggregate.Total.Success != 1 || aggregate.Total.ErrorTotal != 1 || aggregate.Total.ErrorMap["503"] != 1 {
+		t.Fatalf("expected the failed call to be counted as a 503, got %+v", aggregate.Total)
+	}
+
+	aggregate = AggregateData(data, false, nil, false, []string{"grpcmethods", "grpcstatuses"}, nil)["org1"]
+	if c := aggregate.GRPCMethods[replaceUnsupportedChars("helloworld.Greeter/SayHello")]; c == nil || c.Hits != 2 || c.ErrorTotal != 1 {
+		t.Fatal("unexpected gRPC methods:", aggregate.GRPCMethods)
+	}
+	if c := aggregate.GRPCStatuses["UNAVAILABLE"]; len(aggregate.GRPCStatuses) != 2 || c == nil || c.Hits != 1 {
+		t.Fatal("unexpected gRPC statuses:", aggregate.GRPCStatuses)
+	}
+}
@@ -0,0 +1,173 @@
+package analytics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PathNormalizationConfig configures how the request paths are collapsed into templates, so /users/123 and
+// /users/456 are counted as /users/{id}
+type PathNormalizationConfig struct {
+	// NormalizeIDs replaces the numeric, UUID and long hexadecimal path segments by {id} and {uuid}
+	NormalizeIDs bool `json:"normalize_ids"`
+	// Rules are regular expressions replaced in the path, in order
+	Rules []PathNormalizationRule `json:"rules"`
+	// OpenAPISpecs are paths to OpenAPI documents, in JSON, whose path templates are matched against the paths
+	OpenAPISpecs []string `json:"openapi_specs"`
+}
+
+type PathNormalizationRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+type pathRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// PathNormalizer normalizes request paths as configured by a PathNormalizationConfig
+type PathNormalizer struct {
+	templates    [][]string
+	rules        []pathRule
+	normalizeIDs bool
+}
+
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment     = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+)
+
+// Enabled returns whether the configuration normalizes the paths at all
+func (c PathNormalizationConfig) Enabled() bool {
+	return c.NormalizeIDs || len(c.Rules) > 0 || len(c.OpenAPISpecs) > 0
+}
+
+// NewPathNormalizer compiles the rules and loads the OpenAPI documents of the configuration
+func NewPathNormalizer(conf PathNormalizationConfig) (*PathNormalizer, error) {
+	n := &PathNormalizer{normalizeIDs: conf.NormalizeIDs}
+
+	for _, rule := range conf.Rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path normalization rule %q: %v", rule.Pattern, err)
+		}
+		n.rules = append(n.rules, pathRule{pattern: pattern, replacement: rule.Replacement})
+	}
+
+	for _, specPath := range conf.OpenAPISpecs {
+		templates, err := loadOpenAPITemplates(specPath)
+		if err != nil {
+			return nil, err
+		}
+		n.templates = append(n.templates, templates...)
+	}
+
+	// The templates with more segments go first, so /users/{id}/orders wins over /users/{id}
+	sort.SliceStable(n.templates, func(i, j int) bool {
+		return len(n.templates[i]) > len(n.templates[j])
+	})
+
+	return n, nil
+}
+
+// loadOpenAPITemplates returns the path templates of an OpenAPI (or Swagger) JSON document, split in segments
+func loadOpenAPITemplates(specPath string) ([][]string, error) {
+	content, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read OpenAPI document %s: %v", specPath, err)
+	}
+
+	spec := struct {
+		Paths map[string]interface{} `json:"paths"`
+	}{}
+	if err := json.Unmarshal(content, &spec); err != nil {
+		return nil, fmt.Errorf("couldn't parse OpenAPI document %s: %v", specPath, err)
+	}
+
+	templates := make([][]string, 0, len(spec.Paths))
+	for template := range spec.Paths {
+		if strings.Trim(template, "/") == "" {
+			continue
+		}
+		templates = append(templates, splitPath(template))
+	}
+	return templates, nil
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// Normalize returns the normalized path. The OpenAPI templates are tried first, then the rules are applied and
+// finally the IDs are replaced.
+func (n *PathNormalizer) Normalize(path string) string {
+	if path == "" {
+		return path
+	}
+
+	if templated, ok := n.matchTemplate(path); ok {
+		return templated
+	}
+
+	for _, rule := range n.rules {
+		path = rule.pattern.ReplaceAllString(path, rule.replacement)
+	}
+
+	if n.normalizeIDs {
+		segments := strings.Split(path, "/")
+		for i, segment := range segments {
+			switch {
+			case numericSegment.MatchString(segment), hexSegment.MatchString(segment):
+				segments[i] = "{id}"
+			case uuidSegment.MatchString(segment):
+				segments[i] = "{uuid}"
+			}
+		}
+		path = strings.Join(segments, "/")
+	}
+
+	return path
+}
+
+// matchTemplate looks for an OpenAPI template matching the end of the path, as the path may start with the API
+// listen path, and replaces the matched segments by the template ones
+func (n *PathNormalizer) matchTemplate(path string) (string, bool) {
+	if len(n.templates) == 0 {
+		return "", false
+	}
+
+	segments := splitPath(path)
+	for _, template := range n.templates {
+		offset := len(segments) - len(template)
+		if offset < 0 {
+			continue
+		}
+
+		matches := true
+		for i, templateSegment := range template {
+			isParam := strings.HasPrefix(templateSegment, "{") && strings.HasSuffix(templateSegment, "}")
+			if !isParam && templateSegment != segments[offset+i] {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		normalized := append(append([]string{}, segments[:offset]...), template...)
+		result := "/" + strings.Join(normalized, "/")
+		if strings.HasSuffix(path, "/") && len(result) > 1 {
+			result += "/"
+		}
+		return result, true
+	}
+
+	return "", false
+}
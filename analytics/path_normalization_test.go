@@ -0,0 +1,46 @@
+package analytics
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPathNormalizer(t *testing.T) {
+	spec, err := ioutil.TempFile("", "openapi-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(spec.Name())
+	spec.WriteString(`{"openapi": "3.0.0", "paths": {"/": {}, "/users/{userId}": {}, "/users/{userId}/orders/{orderId}": {}}}`)
+	spec.Close()
+
+	normalizer, err := NewPathNormalizer(PathNormalizationConfig{
+		NormalizeIDs: true,
+		Rules:        []PathNormalizationRule{{Pattern: `^/files/.*`, Replacement: "/files/{path}"}},
+		OpenAPISpecs: []string{spec.Name()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"/users-api/users/john":                        "/users-api/users/{userId}",
+		"/users-api/users/john/orders/42":              "/users-api/users/{userId}/orders/{orderId}",
+		"/files/a/b/c.txt":                             "/files/{path}",
+		"/items/123/details":                           "/items/{id}/details",
+		"/items/5f0c3c4b2a2b7a0001d0ed20":              "/items/{id}",
+		"/items/8a1b2c3d-1234-4abc-9def-0123456789ab/": "/items/{uuid}/",
+		"/items/latest":                                "/items/latest",
+		"":                                             "",
+	}
+	for path, expected := range tests {
+		if normalized := normalizer.Normalize(path); normalized != expected {
+			t.Errorf("expected %q to be normalized to %q, got %q", path, expected, normalized)
+		}
+	}
+
+	if _, err := NewPathNormalizer(PathNormalizationConfig{Rules: []PathNormalizationRule{{Pattern: "("}}}); err == nil {
+		t.Fatal("expected an error for an invalid rule")
+	}
+}
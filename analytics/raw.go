@@ -0,0 +1,123 @@
+package analytics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+var (
+	errNoRawRequest  = errors.New("the record has no raw request")
+	errNoRawResponse = errors.New("the record has no raw response")
+)
+
+// ParseRawRequest decodes and parses the base64 encoded raw request of a record, returning the request and its body
+func ParseRawRequest(rawRequest string) (*http.Request, []byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(rawRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer req.Body.Close()
+
+	body, err := ioutil.ReadAll(req.Body)
+	return req, body, err
+}
+
+// ParseRawResponse decodes and parses the base64 encoded raw response of a record, returning the response and its body
+func ParseRawResponse(rawResponse string) (*http.Response, []byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(rawResponse)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+// RawRecord is the raw request and response of a record, parsed the first time they're needed and then shared by all
+// the enrichers of the record, so they're parsed once
+type RawRecord struct {
+	record *AnalyticsRecord
+
+	requestParsed bool
+	request       *http.Request
+	requestBody   []byte
+	requestErr    error
+
+	responseParsed bool
+	response       *http.Response
+	responseBody   []byte
+	responseErr    error
+}
+
+// NewRawRecord returns the raw request and response of the record, which aren't parsed yet
+func NewRawRecord(record *AnalyticsRecord) *RawRecord {
+	return &RawRecord{record: record}
+}
+
+// Request returns the parsed raw request of the record and its body. The request is also returned with the error of
+// a body which can't be read in full.
+func (r *RawRecord) Request() (*http.Request, []byte, error) {
+	if !r.requestParsed {
+		r.requestParsed = true
+		if r.record.RawRequest == "" {
+			r.requestErr = errNoRawRequest
+		} else {
+			r.request, r.requestBody, r.requestErr = ParseRawRequest(r.record.RawRequest)
+		}
+	}
+	return r.request, r.requestBody, r.requestErr
+}
+
+// Response returns the parsed raw response of the record and its body. The response is also returned with the error
+// of a body which can't be read in full.
+func (r *RawRecord) Response() (*http.Response, []byte, error) {
+	if !r.responseParsed {
+		r.responseParsed = true
+		if r.record.RawResponse == "" {
+			r.responseErr = errNoRawResponse
+		} else {
+			r.response, r.responseBody, r.responseErr = ParseRawResponse(r.record.RawResponse)
+		}
+	}
+	return r.response, r.responseBody, r.responseErr
+}
+
+// bodySize returns the size of a body, from its Content-Length when set, as the recorded body may be truncated, or
+// from the body read otherwise
+func bodySize(contentLength int64, body []byte) int64 {
+	if contentLength >= 0 {
+		return contentLength
+	}
+	return int64(len(body))
+}
+
+// SetContentLengths fills the request and response sizes of the record from its raw request and response, when they
+// weren't recorded by the Gateway and the detailed recording is enabled
+func (a *AnalyticsRecord) SetContentLengths(raw *RawRecord) {
+	if a.ContentLength == 0 && a.RawRequest != "" {
+		if req, body, err := raw.Request(); err == nil {
+			a.ContentLength = bodySize(req.ContentLength, body)
+		}
+	}
+
+	if a.ResponseContentLength == 0 && a.RawResponse != "" {
+		if resp, body, err := raw.Response(); err == nil {
+			a.ResponseContentLength = bodySize(resp.ContentLength, body)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package analytics
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestSetContentLengths(t *testing.T) {
+	record := AnalyticsRecord{
+		RawRequest:  base64.StdEncoding.EncodeToString([]byte("POST /post HTTP/1.1\r\nHost: example.com\r\nContent-Length: 11\r\n\r\nhello world")),
+		RawResponse: base64.StdEncoding.EncodeToString([]byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nsome response body")),
+	}
+	record.SetContentLengths(NewRawRecord(&record))
+
+	if record.ContentLength != 11 {
+		t.Fatal("expected a request size of 11, got", record.ContentLength)
+	}
+	if record.ResponseContentLength != 18 {
+		t.Fatal("expected a response size of 18, got", record.ResponseContentLength)
+	}
+
+	record = AnalyticsRecord{ContentLength: 5, RawRequest: "not base64"}
+	record.SetContentLengths(NewRawRecord(&record))
+	if record.ContentLength != 5 || record.ResponseContentLength != 0 {
+		t.Fatal("expected the recorded sizes to be kept, got", record.ContentLength, record.ResponseContentLength)
+	}
+}
+
+func TestRawRecord(t *testing.T) {
+	record := AnalyticsRecord{RawRequest: base64.StdEncoding.EncodeToString([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))}
+	raw := NewRawRecord(&record)
+	req, _, err := raw.Request()
+	if err != nil || req.Host != "example.com" {
+		t.Fatal("unexpected request", req, err)
+	}
+	if again, _, _ := raw.Request(); again != req {
+		t.Error("expected the request to be parsed once")
+	}
+	if resp, _, err := raw.Response(); resp != nil || err == nil {
+		t.Error("expected an error for the missing response, got", resp)
+	}
+}
@@ -0,0 +1,188 @@
+package analytics
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordFieldIndexes caches the reflect indexes of the record fields looked up by name
+var recordFieldIndexes sync.Map
+
+// recordFieldIndex returns the reflect index of the AnalyticsRecord field with the given json name. Nested fields are
+// separated by dots.
+func recordFieldIndex(name string) ([]int, bool) {
+	if index, ok := recordFieldIndexes.Load(name); ok {
+		return index.([]int), true
+	}
+
+	index := []int{}
+	t := reflect.TypeOf(AnalyticsRecord{})
+	for _, segment := range strings.Split(name, ".") {
+		if t.Kind() != reflect.Struct {
+			return nil, false
+		}
+
+		found := false
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if strings.Split(field.Tag.Get("json"), ",")[0] == segment {
+				index = append(index, i)
+				t = field.Type
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+
+	recordFieldIndexes.Store(name, index)
+	return index, true
+}
+
+// IsRecordField returns whether the record has a field with the given json name, like latency.total
+func IsRecordField(name string) bool {
+	_, ok := recordFieldIndex(name)
+	return ok
+}
+
+// Field returns the value of the record field with the given json name. Nested fields are separated by dots, as in
+// latency.total or geo.country.iso_code.
+func (a *AnalyticsRecord) Field(name string) (interface{}, bool) {
+	index, ok := recordFieldIndex(name)
+	if !ok {
+		return nil, false
+	}
+	return reflect.ValueOf(a).Elem().FieldByIndex(index).Interface(), true
+}
+
+// FieldString returns the value of the record field with the given json name formatted as a string, the lists are
+// joined by commas. It's empty if there's no such field.
+func (a *AnalyticsRecord) FieldString(name string) string {
+	value, ok := a.Field(name)
+	if !ok {
+		return ""
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	case map[string]string:
+		return formatHeaders(v)
+	case map[string]interface{}:
+		return formatBodyFields(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case time.Month:
+		return strconv.Itoa(int(v))
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// FieldFloat returns the value of the numeric record field with the given json name
+func (a *AnalyticsRecord) FieldFloat(name string) (float64, bool) {
+	value, ok := a.Field(name)
+	if !ok {
+		return 0, false
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Bool:
+		if v.Bool() {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// FieldSelection selects the record fields a pump writes: only the included ones when there are any, without the
+// excluded ones. Nested fields are separated by dots, like latency.total.
+type FieldSelection struct {
+	Include []string `json:"include_fields"`
+	Exclude []string `json:"exclude_fields"`
+}
+
+// IsSet returns whether any field is included or excluded
+func (s FieldSelection) IsSet() bool {
+	return len(s.Include) > 0 || len(s.Exclude) > 0
+}
+
+// Validate checks that the included and excluded fields are record fields
+func (s FieldSelection) Validate() error {
+	for _, name := range append(append([]string{}, s.Include...), s.Exclude...) {
+		if !IsRecordField(name) {
+			return fmt.Errorf("unknown record field %q", name)
+		}
+	}
+	return nil
+}
+
+// Selects returns whether the field, or some of its nested fields, is written: whether it's included, nested in or
+// containing an included field, when there are any, and neither it nor the field it's nested in are excluded
+func (s FieldSelection) Selects(name string) bool {
+	for _, excluded := range s.Exclude {
+		if name == excluded || strings.HasPrefix(name, excluded+".") {
+			return false
+		}
+	}
+	if len(s.Include) == 0 {
+		return true
+	}
+	for _, included := range s.Include {
+		if name == included || strings.HasPrefix(name, included+".") || strings.HasPrefix(included, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// keptRecordFields are never cleared, as the aggregates are keyed by them and the Mongo records expire at expireAt
+var keptRecordFields = []string{"timestamp", "org_id", "expireAt"}
+
+// Apply clears the fields of the record which aren't selected, to their zero value, so they're written as empty by
+// the pumps with fixed columns. The timestamp, org_id and expireAt fields are always kept.
+func (s FieldSelection) Apply(record *AnalyticsRecord) {
+	value := reflect.ValueOf(record).Elem()
+	kept := reflect.New(value.Type()).Elem()
+	for _, name := range keptRecordFields {
+		index, _ := recordFieldIndex(name)
+		kept.FieldByIndex(index).Set(value.FieldByIndex(index))
+	}
+
+	if len(s.Include) > 0 {
+		selected := reflect.New(value.Type()).Elem()
+		for _, name := range s.Include {
+			if index, ok := recordFieldIndex(name); ok {
+				selected.FieldByIndex(index).Set(value.FieldByIndex(index))
+			}
+		}
+		value.Set(selected)
+	}
+	for _, name := range s.Exclude {
+		if index, ok := recordFieldIndex(name); ok {
+			field := value.FieldByIndex(index)
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+
+	for _, name := range keptRecordFields {
+		index, _ := recordFieldIndex(name)
+		value.FieldByIndex(index).Set(kept.FieldByIndex(index))
+	}
+}
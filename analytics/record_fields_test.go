@@ -0,0 +1,82 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordFields(t *testing.T) {
+	record := AnalyticsRecord{
+		APIID:        "api1",
+		ResponseCode: 200,
+		Tags:         []string{"tag1", "tag2"},
+		Latency:      Latency{Total: 120, Upstream: 100},
+	}
+	record.Geo.Country.ISOCode = "GB"
+
+	if value := record.FieldString("api_id"); value != "api1" {
+		t.Fatal("expected api_id to be api1, got", value)
+	}
+	if value := record.FieldString("geo.country.iso_code"); value != "GB" {
+		t.Fatal("expected geo.country.iso_code to be GB, got", value)
+	}
+	if value := record.FieldString("tags"); value != "tag1,tag2" {
+		t.Fatal("expected the tags to be joined, got", value)
+	}
+	if value, ok := record.FieldFloat("latency.total"); !ok || value != 120 {
+		t.Fatal("expected latency.total to be 120, got", value)
+	}
+	if _, ok := record.FieldFloat("api_id"); ok {
+		t.Fatal("expected api_id not to be numeric")
+	}
+	if IsRecordField("latency.unknown") || IsRecordField("api_id.nested") {
+		t.Fatal("expected unknown fields not to be record fields")
+	}
+}
+
+func TestFieldSelection(t *testing.T) {
+	record := AnalyticsRecord{
+		APIID:      "api1",
+		Path:       "/users",
+		RawRequest: "GET /users",
+		Latency:    Latency{Total: 120, Upstream: 100},
+	}
+	record.Geo.Country.ISOCode = "GB"
+	record.Geo.City.Names = map[string]string{"en": "London"}
+
+	selection := FieldSelection{Include: []string{"api_id", "raw_request", "latency.total", "geo"}, Exclude: []string{"raw_request", "geo.city"}}
+	if err := selection.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	selected := record
+	selection.Apply(&selected)
+	if selected.APIID != "api1" || selected.Path != "" || selected.RawRequest != "" {
+		t.Error("expected only the included fields which aren't excluded, got", selected)
+	}
+	if selected.Latency.Total != 120 || selected.Latency.Upstream != 0 {
+		t.Error("expected only the included nested field, got", selected.Latency)
+	}
+	if selected.Geo.Country.ISOCode != "GB" || selected.Geo.City.Names != nil {
+		t.Error("expected the excluded nested field to be cleared, got", selected.Geo)
+	}
+	if record.Path != "/users" {
+		t.Error("expected the original record to be kept")
+	}
+
+	record.OrgID, record.TimeStamp, record.ExpireAt = "org1", time.Now(), time.Now().Add(time.Hour)
+	selected = record
+	FieldSelection{Include: []string{"api_id"}, Exclude: []string{"org_id", "expireAt"}}.Apply(&selected)
+	if selected.OrgID != "org1" || !selected.TimeStamp.Equal(record.TimeStamp) || !selected.ExpireAt.Equal(record.ExpireAt) {
+		t.Error("expected the timestamp, org ID and expiry to be kept, got", selected)
+	}
+
+	for name, selects := range map[string]bool{"api_id": true, "path": false, "latency": true, "geo.country.iso_code": true, "geo.city.names": false, "raw_request": false} {
+		if selection.Selects(name) != selects {
+			t.Errorf("expected %s to be selected: %v", name, selects)
+		}
+	}
+
+	if err := (FieldSelection{Exclude: []string{"unknown"}}).Validate(); err == nil {
+		t.Error("expected an unknown field to fail")
+	}
+}
@@ -0,0 +1,72 @@
+package analytics
+
+import (
+	"sort"
+	"strings"
+)
+
+// ResponseHeadersConfig configures the capture of response headers into the records, like the rate limit, cache
+// status or upstream server ones
+type ResponseHeadersConfig struct {
+	// Headers are the names of the captured headers. A name ending with * captures all the headers starting with it,
+	// like X-RateLimit-*.
+	Headers []string `json:"headers"`
+}
+
+// Enabled returns whether any header is configured
+func (c ResponseHeadersConfig) Enabled() bool {
+	return len(c.Headers) > 0
+}
+
+// Capture sets the configured headers of the raw response of the record in its response headers, by their lowercase
+// name, with the values of a repeated header joined by commas. The raw response is only there when the detailed
+// recording is enabled, but it can be omitted once the headers are captured.
+func (c ResponseHeadersConfig) Capture(record *AnalyticsRecord, raw *RawRecord) {
+	if !c.Enabled() || record.RawResponse == "" || len(record.ResponseHeaders) > 0 {
+		return
+	}
+	resp, _, err := raw.Response()
+	if err != nil {
+		return
+	}
+
+	headers := map[string]string{}
+	for name, values := range resp.Header {
+		name = strings.ToLower(name)
+		if c.captures(name) {
+			headers[name] = strings.Join(values, ", ")
+		}
+	}
+	if len(headers) > 0 {
+		record.ResponseHeaders = headers
+	}
+}
+
+// captures returns whether the lowercase header name is configured
+func (c ResponseHeadersConfig) captures(name string) bool {
+	for _, header := range c.Headers {
+		header = strings.ToLower(header)
+		if prefix := strings.TrimSuffix(header, "*"); prefix != header {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == header {
+			return true
+		}
+	}
+	return false
+}
+
+// formatHeaders formats the headers as name:value pairs sorted by name and separated by semicolons
+func formatHeaders(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + ":" + headers[name]
+	}
+	return strings.Join(pairs, ";")
+}
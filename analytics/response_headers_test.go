@@ -0,0 +1,36 @@
+package analytics
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestResponseHeadersCapture(t *testing.T) {
+	conf := ResponseHeadersConfig{Headers: []string{"X-RateLimit-*", "X-Cache", "Server"}}
+	rawResponse := "HTTP/1.1 200 OK\r\nX-Ratelimit-Limit: 100\r\nX-Ratelimit-Remaining: 42\r\nX-Cache: HIT\r\n" +
+		"Via: 1.1 varnish\r\nVia: 1.1 envoy\r\nContent-Length: 2\r\n\r\n{}"
+	record := AnalyticsRecord{RawResponse: base64.StdEncoding.EncodeToString([]byte(rawResponse))}
+
+	conf.Capture(&record, NewRawRecord(&record))
+	expected := map[string]string{"x-ratelimit-limit": "100", "x-ratelimit-remaining": "42", "x-cache": "HIT"}
+	if !reflect.DeepEqual(record.ResponseHeaders, expected) {
+		t.Errorf("expected the headers %v, got %v", expected, record.ResponseHeaders)
+	}
+	if value := record.FieldString("response_headers"); value != "x-cache:HIT;x-ratelimit-limit:100;x-ratelimit-remaining:42" {
+		t.Errorf("unexpected formatted headers %q", value)
+	}
+
+	conf = ResponseHeadersConfig{Headers: []string{"Via"}}
+	record.ResponseHeaders = nil
+	conf.Capture(&record, NewRawRecord(&record))
+	if record.ResponseHeaders["via"] != "1.1 varnish, 1.1 envoy" {
+		t.Errorf("expected the repeated header to be joined, got %v", record.ResponseHeaders)
+	}
+
+	empty := AnalyticsRecord{RawResponse: record.RawResponse}
+	ResponseHeadersConfig{}.Capture(&empty, NewRawRecord(&empty))
+	if empty.ResponseHeaders != nil {
+		t.Error("expected no headers to be captured without configuration")
+	}
+}
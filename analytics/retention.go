@@ -0,0 +1,81 @@
+package analytics
+
+import (
+	"fmt"
+	"time"
+)
+
+// RetentionConfig configures how long the analytics records are kept, overriding the expiry set by the Gateway, so
+// different orgs and APIs can have different retentions. The TTLs are in seconds.
+type RetentionConfig struct {
+	// DefaultTTL is the TTL of the records of the orgs and APIs without an override, 0 keeps the Gateway expiry
+	DefaultTTL int64 `json:"default_ttl"`
+	// Orgs are the TTLs by org ID
+	Orgs map[string]int64 `json:"orgs"`
+	// APIs are the TTLs by API ID, they take precedence over the org ones
+	APIs map[string]int64 `json:"apis"`
+}
+
+// Enabled returns whether the configuration sets the expiry of any record
+func (c RetentionConfig) Enabled() bool {
+	return c.DefaultTTL > 0 || len(c.Orgs) > 0 || len(c.APIs) > 0
+}
+
+// Validate checks that none of the TTLs is negative
+func (c RetentionConfig) Validate() error {
+	if c.DefaultTTL < 0 {
+		return fmt.Errorf("invalid default TTL %d", c.DefaultTTL)
+	}
+	for orgID, ttl := range c.Orgs {
+		if ttl <= 0 {
+			return fmt.Errorf("invalid TTL %d for org %s", ttl, orgID)
+		}
+	}
+	for apiID, ttl := range c.APIs {
+		if ttl <= 0 {
+			return fmt.Errorf("invalid TTL %d for API %s", ttl, apiID)
+		}
+	}
+	return nil
+}
+
+// TTL returns the TTL of the record: the one of its API, of its org or the default one, in that order. It's 0 when
+// the expiry set by the Gateway should be kept.
+func (c RetentionConfig) TTL(record *AnalyticsRecord) time.Duration {
+	if ttl, ok := c.APIs[record.APIID]; ok {
+		return time.Duration(ttl) * time.Second
+	}
+	if ttl, ok := c.Orgs[record.OrgID]; ok {
+		return time.Duration(ttl) * time.Second
+	}
+	return time.Duration(c.DefaultTTL) * time.Second
+}
+
+// Apply sets the expiry of the record from its TTL, counted from the time of the request
+func (c RetentionConfig) Apply(record *AnalyticsRecord) {
+	ttl := c.TTL(record)
+	if ttl == 0 {
+		return
+	}
+
+	from := record.TimeStamp
+	if from.IsZero() {
+		from = time.Now()
+	}
+	record.ExpireAt = from.Add(ttl)
+}
+
+// RetentionDays returns for how many days, rounded up, the record is kept from the time of the request, 0 when it
+// has no expiry
+func (a *AnalyticsRecord) RetentionDays() int {
+	if a.ExpireAt.IsZero() || !a.ExpireAt.After(a.TimeStamp) {
+		return 0
+	}
+
+	retention := a.ExpireAt.Sub(a.TimeStamp)
+	days := int(retention / (24 * time.Hour))
+	if retention%(24*time.Hour) != 0 {
+		days++
+	}
+	return days
+}
@@ -0,0 +1,52 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionConfigApply(t *testing.T) {
+	conf := RetentionConfig{
+		DefaultTTL: 7 * 86400,
+		Orgs:       map[string]int64{"premium": 90 * 86400},
+		APIs:       map[string]int64{"audit": 365 * 86400},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		orgID, apiID string
+		days         int
+	}{
+		{"basic", "api", 7},
+		{"premium", "api", 90},
+		{"premium", "audit", 365},
+		{"basic", "audit", 365},
+	}
+	for _, test := range tests {
+		record := &AnalyticsRecord{OrgID: test.orgID, APIID: test.apiID, TimeStamp: now, ExpireAt: now.Add(time.Hour)}
+		conf.Apply(record)
+		if expected := now.AddDate(0, 0, test.days); !record.ExpireAt.Equal(expected) {
+			t.Errorf("expected org %s and API %s to expire at %v, got %v", test.orgID, test.apiID, expected, record.ExpireAt)
+		}
+		if days := record.RetentionDays(); days != test.days {
+			t.Errorf("expected a retention of %d days, got %d", test.days, days)
+		}
+	}
+
+	gatewayExpiry := now.Add(36 * time.Hour)
+	record := &AnalyticsRecord{OrgID: "basic", TimeStamp: now, ExpireAt: gatewayExpiry}
+	RetentionConfig{Orgs: map[string]int64{"premium": 86400}}.Apply(record)
+	if !record.ExpireAt.Equal(gatewayExpiry) {
+		t.Error("expected the Gateway expiry to be kept without a default TTL, got", record.ExpireAt)
+	}
+	if days := record.RetentionDays(); days != 2 {
+		t.Error("expected the retention to be rounded up to 2 days, got", days)
+	}
+
+	if err := (RetentionConfig{Orgs: map[string]int64{"org": 0}}).Validate(); err == nil {
+		t.Error("expected a zero org TTL to be invalid")
+	}
+}
@@ -0,0 +1,83 @@
+package analytics
+
+import (
+	"net/http"
+	"strings"
+)
+
+// TraceContextConfig configures the extraction of the trace and span IDs of the records from their trace context
+// headers
+type TraceContextConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Extract fills the trace and span IDs of the record from the trace context headers of its raw request, when they
+// weren't recorded by the Gateway and the detailed recording is enabled
+func (c TraceContextConfig) Extract(record *AnalyticsRecord, raw *RawRecord) {
+	if !c.Enabled || record.TraceID != "" || record.RawRequest == "" {
+		return
+	}
+	req, _, err := raw.Request()
+	if err != nil {
+		return
+	}
+	record.TraceID, record.SpanID = TraceContext(req.Header)
+}
+
+// TraceContext returns the trace and span IDs of the W3C traceparent header, or of the B3 headers of Zipkin, single or
+// multiple, or of the X-Cloud-Trace-Context header of Google Cloud, in this order. The IDs are lowercased, and the
+// invalid headers are ignored. The tracestate header only carries vendor data along with traceparent, so it isn't
+// read.
+func TraceContext(header http.Header) (string, string) {
+	// traceparent: version-traceid-spanid-flags
+	if parts := strings.Split(header.Get("Traceparent"), "-"); len(parts) >= 4 && len(parts[0]) == 2 &&
+		isHex(parts[0]) && parts[0] != "ff" && isHexID(parts[1], 32) && isHexID(parts[2], 16) {
+		return strings.ToLower(parts[1]), strings.ToLower(parts[2])
+	}
+
+	// b3: traceid-spanid-sampled-parentspanid, or only the sampling decision
+	if parts := strings.Split(header.Get("B3"), "-"); len(parts) >= 2 && isB3TraceID(parts[0]) && isHexID(parts[1], 16) {
+		return strings.ToLower(parts[0]), strings.ToLower(parts[1])
+	}
+	if traceID := header.Get("X-B3-TraceId"); isB3TraceID(traceID) {
+		spanID := header.Get("X-B3-SpanId")
+		if !isHexID(spanID, 16) {
+			spanID = ""
+		}
+		return strings.ToLower(traceID), strings.ToLower(spanID)
+	}
+
+	// X-Cloud-Trace-Context: TRACE_ID/SPAN_ID;o=TRACE_TRUE, with a decimal span ID
+	if value := header.Get("X-Cloud-Trace-Context"); value != "" {
+		value = strings.SplitN(value, ";", 2)[0]
+		parts := strings.SplitN(value, "/", 2)
+		if !isHexID(parts[0], 32) {
+			return "", ""
+		}
+		if len(parts) == 2 {
+			return strings.ToLower(parts[0]), parts[1]
+		}
+		return strings.ToLower(parts[0]), ""
+	}
+
+	return "", ""
+}
+
+// isB3TraceID returns whether the B3 trace ID is valid, 64 or 128 bits long
+func isB3TraceID(id string) bool {
+	return isHexID(id, 16) || isHexID(id, 32)
+}
+
+// isHexID returns whether the ID has the length, is hexadecimal and isn't all zeros, which is invalid
+func isHexID(id string, length int) bool {
+	return len(id) == length && isHex(id) && strings.Trim(id, "0") != ""
+}
+
+func isHex(value string) bool {
+	for _, c := range value {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package analytics
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+func TestTraceContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		traceID string
+		spanID  string
+	}{
+		{"traceparent", http.Header{"Traceparent": {"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"}},
+			"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"},
+		{"invalid traceparent", http.Header{"Traceparent": {"00-00000000000000000000000000000000-00f067aa0ba902b7-01"}}, "", ""},
+		{"traceparent before b3", http.Header{
+			"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			"B3":          {"80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1"},
+		}, "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"},
+		{"single b3", http.Header{"B3": {"80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90"}},
+			"80f198ee56343ba864fe8b2a57d3eff7", "e457b5a2e4d86bd1"},
+		{"b3 sampling only", http.Header{"B3": {"0"}}, "", ""},
+		{"multiple b3", http.Header{"X-B3-Traceid": {"463ac35c9f6413ad"}, "X-B3-Spanid": {"a2fb4a1d1a96d312"}},
+			"463ac35c9f6413ad", "a2fb4a1d1a96d312"},
+		{"cloud trace", http.Header{"X-Cloud-Trace-Context": {"105445aa7843bc8bf206b12000100000/1;o=1"}},
+			"105445aa7843bc8bf206b12000100000", "1"},
+		{"none", http.Header{}, "", ""},
+	}
+
+	for _, test := range tests {
+		traceID, spanID := TraceContext(test.header)
+		if traceID != test.traceID || spanID != test.spanID {
+			t.Errorf("%s: expected %q %q, got %q %q", test.name, test.traceID, test.spanID, traceID, spanID)
+		}
+	}
+}
+
+func TestTraceContextConfigExtract(t *testing.T) {
+	conf := TraceContextConfig{Enabled: true}
+	rawRequest := "GET / HTTP/1.1\r\nHost: example.com\r\nTraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n\r\n"
+	record := AnalyticsRecord{RawRequest: base64.StdEncoding.EncodeToString([]byte(rawRequest))}
+	conf.Extract(&record, NewRawRecord(&record))
+	if record.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || record.SpanID != "00f067aa0ba902b7" {
+		t.Errorf("unexpected trace %q %q", record.TraceID, record.SpanID)
+	}
+
+	recorded := AnalyticsRecord{TraceID: "trace", RawRequest: record.RawRequest}
+	conf.Extract(&recorded, NewRawRecord(&recorded))
+	if recorded.TraceID != "trace" || recorded.SpanID != "" {
+		t.Error("expected the trace recorded by the Gateway to be kept")
+	}
+
+	disabled := AnalyticsRecord{RawRequest: record.RawRequest}
+	TraceContextConfig{}.Extract(&disabled, NewRawRecord(&disabled))
+	if disabled.TraceID != "" {
+		t.Error("expected the trace not to be extracted by default")
+	}
+
+	if !IsRecordField("trace_id") || !IsRecordField("span_id") {
+		t.Error("expected the trace and span IDs to be record fields")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const alertTimeout = 10 * time.Second
+
+// anomalyDetector tags the records of the APIs with an anomalous error rate or latency, it's nil when the detection
+// isn't enabled
+var anomalyDetector *analytics.AnomalyDetector
+
+var alertClient = &http.Client{Timeout: alertTimeout}
+
+// detectAnomalies counts the purged record in the anomaly detector, which tags it when its API is anomalous, and
+// logs and alerts the anomalies found
+func detectAnomalies(record *analytics.AnalyticsRecord) {
+	if anomalyDetector == nil {
+		return
+	}
+	anomalies := anomalyDetector.Detect(record)
+	if len(anomalies) == 0 {
+		return
+	}
+
+	for _, anomaly := range anomalies {
+		log.WithFields(logrus.Fields{
+			"prefix":  mainPrefix,
+			"api_id":  anomaly.APIID,
+			"metric":  anomaly.Metric,
+			"z_score": anomaly.ZScore,
+		}).Warningf("Anomalous %s of %.3f, the average is %.3f", anomaly.Metric, anomaly.Value, anomaly.Mean)
+	}
+	if SystemConfig.Anomalies.AlertURL != "" {
+		// the alerts are posted in the background so a slow webhook doesn't hold the purge
+		go func() {
+			if err := postAnomalies(SystemConfig.Anomalies, anomalies); err != nil {
+				log.WithFields(logrus.Fields{
+					"prefix": mainPrefix,
+				}).Error("Couldn't post the anomalies: ", err)
+			}
+		}()
+	}
+}
+
+// postAnomalies posts the anomalies to the alert webhook as a JSON array
+func postAnomalies(conf analytics.AnomalyConfig, anomalies []analytics.Anomaly) error {
+	body, err := json.Marshal(anomalies)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, conf.AlertURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range conf.AlertHeaders {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := alertClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("alert webhook responded with status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-pump/analytics"
+	"github.com/TykTechnologies/tyk-pump/storage"
+	"github.com/gocraft/health"
+	msgpack "gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	defaultBacklogKey           = "tyk-pump-backlog"
+	defaultBacklogAlertInterval = 300
+	// backlogKeyTTLPurges is after how many purge delays the backlog key expires, so it doesn't outlive the pump
+	backlogKeyTTLPurges = 3
+)
+
+type BacklogConfig struct {
+	// Enabled makes the pump publish after every purge the number of records left in the analytics storage
+	Enabled bool `json:"enabled"`
+	// Key is the redis key the backlog is written to, without prefix. Defaults to tyk-pump-backlog.
+	Key string `json:"key"`
+	// WarningThreshold warns when the backlog is greater, 0 disables the warning
+	WarningThreshold int64 `json:"warning_threshold"`
+	// MaxAge warns when the oldest record waiting in any analytics key is older, in seconds. 0 disables the warning.
+	MaxAge int64 `json:"max_age"`
+	// AlertWebhookURL is the URL the warnings are posted to, like a Slack incoming webhook
+	AlertWebhookURL string `json:"alert_webhook_url"`
+	// AlertInterval is the minimum number of seconds between two alerts posted to the webhook, 300 by default
+	AlertInterval int `json:"alert_interval"`
+}
+
+// backlogStats is the backlog of the analytics storage after a purge
+type backlogStats struct {
+	// Depth is the number of records waiting in all the analytics keys
+	Depth int64
+	// MaxAge is the age of the oldest record waiting
+	MaxAge time.Duration
+	// Keys are the backlogs of every analytics key with records waiting
+	Keys map[string]keyBacklog
+}
+
+type keyBacklog struct {
+	Length int64
+	// Age is the age of the first record of the key, the oldest one
+	Age time.Duration
+}
+
+// backlogAlert is the payload posted to the alert webhook, its text is the message shown by Slack
+type backlogAlert struct {
+	Text          string  `json:"text"`
+	Backlog       int64   `json:"backlog"`
+	MaxAgeSeconds float64 `json:"max_age_seconds"`
+}
+
+// backlogStore is the storage the backlog is written to, it's nil when the backlog isn't published
+var backlogStore *storage.RedisClusterStorageManager
+var lastBacklogAlert time.Time
+var backlogAlertClient = &http.Client{Timeout: 10 * time.Second}
+
+func setupBacklogStore() {
+	backlogStore = &storage.RedisClusterStorageManager{}
+	backlogStore.Config = SystemConfig.AnalyticsStorageConfig
+	backlogStore.Connect()
+}
+
+// measureBacklog returns the number of records waiting in the analytics keys of the store and their age at now, from
+// the timestamp of the first record of every key
+func measureBacklog(store storage.AnalyticsStorage, now time.Time) backlogStats {
+	stats := backlogStats{Keys: map[string]keyBacklog{}}
+	for _, analyticsKeyName := range analyticsKeyNames() {
+		length := store.GetSetLength(analyticsKeyName)
+		if length == 0 {
+			continue
+		}
+
+		key := keyBacklog{Length: length}
+		if values := store.GetSet(analyticsKeyName, 1); len(values) > 0 {
+			record := analytics.AnalyticsRecord{}
+			if err := msgpack.Unmarshal([]byte(values[0].(string)), &record); err == nil && !record.TimeStamp.IsZero() {
+				key.Age = now.Sub(record.TimeStamp)
+			}
+		}
+
+		stats.Keys[analyticsKeyName] = key
+		stats.Depth += length
+		if key.Age > stats.MaxAge {
+			stats.MaxAge = key.Age
+		}
+	}
+	return stats
+}
+
+// backlogWarnings returns the warnings of the thresholds exceeded by the backlog
+func backlogWarnings(conf BacklogConfig, stats backlogStats) []string {
+	warnings := []string{}
+	if conf.WarningThreshold > 0 && stats.Depth > conf.WarningThreshold {
+		warnings = append(warnings, fmt.Sprintf("%d records are waiting in the analytics storage, over the threshold of %d", stats.Depth, conf.WarningThreshold))
+	}
+	if conf.MaxAge > 0 && stats.MaxAge > time.Duration(conf.MaxAge)*time.Second {
+		warnings = append(warnings, fmt.Sprintf("the oldest record waiting in the analytics storage is %s old, over the maximum of %ds", stats.MaxAge.Round(time.Second), conf.MaxAge))
+	}
+	return warnings
+}
+
+// publishBacklog writes the backlog to its redis key and to the backlog gauges, so the Gateway or the operators can
+// sample or alert when the pump falls behind, before redis evicts the analytics. The exceeded thresholds are logged and
+// posted to the alert webhook.
+func publishBacklog(conf BacklogConfig, job *health.Job, purgeDelay int) {
+	now := time.Now()
+	stats := measureBacklog(AnalyticsStore, now)
+
+	key := conf.Key
+	if key == "" {
+		key = defaultBacklogKey
+	}
+	if err := backlogStore.SetKey(key, strconv.FormatInt(stats.Depth, 10), int64(backlogKeyTTLPurges*purgeDelay)); err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Error("Couldn't publish the backlog: ", err)
+	}
+
+	job.Gauge("analytics_backlog", float64(stats.Depth))
+	job.Gauge("analytics_backlog_age_seconds", stats.MaxAge.Seconds())
+	for analyticsKeyName, keyStats := range stats.Keys {
+		job.Gauge("analytics_backlog."+analyticsKeyName, float64(keyStats.Length))
+		job.Gauge("analytics_backlog_age_seconds."+analyticsKeyName, keyStats.Age.Seconds())
+	}
+
+	warnings := backlogWarnings(conf, stats)
+	for _, warning := range warnings {
+		log.WithFields(logrus.Fields{
+			"prefix":  mainPrefix,
+			"backlog": stats.Depth,
+		}).Warning("The pumps are falling behind, ", warning)
+	}
+
+	if len(warnings) > 0 && conf.AlertWebhookURL != "" && backlogAlertDue(conf, now) {
+		lastBacklogAlert = now
+		alert := backlogAlert{
+			Text:          "Tyk Pump is falling behind: " + strings.Join(warnings, " and "),
+			Backlog:       stats.Depth,
+			MaxAgeSeconds: stats.MaxAge.Seconds(),
+		}
+		go postBacklogAlert(conf.AlertWebhookURL, alert)
+	}
+}
+
+// backlogAlertDue returns whether an alert can be posted at now, AlertInterval seconds after the last one
+func backlogAlertDue(conf BacklogConfig, now time.Time) bool {
+	interval := conf.AlertInterval
+	if interval <= 0 {
+		interval = defaultBacklogAlertInterval
+	}
+	return now.Sub(lastBacklogAlert) >= time.Duration(interval)*time.Second
+}
+
+func postBacklogAlert(url string, alert backlogAlert) {
+	alertLog := log.WithFields(logrus.Fields{
+		"prefix": mainPrefix,
+	})
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		alertLog.Error("Couldn't encode the backlog alert: ", err)
+		return
+	}
+
+	resp, err := backlogAlertClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		alertLog.Error("Couldn't post the backlog alert: ", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		alertLog.Error("The backlog alert webhook responded with status ", resp.StatusCode)
+	}
+}
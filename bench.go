@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-pump/analytics/demo"
+	"github.com/TykTechnologies/tyk-pump/pumps"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var benchPrefix = "bench"
+
+var (
+	benchCmd       = kingpin.Command("bench", "write synthetic analytics records through the configured pumps and report their throughput, latency and errors")
+	benchPumpNames = benchCmd.Flag("pump", "name of a configured pump to benchmark, can be repeated, all the configured pumps by default").Strings()
+	benchRate      = benchCmd.Flag("rate", "number of records per second offered to every pump").Default("1000").Int()
+	benchDuration  = benchCmd.Flag("duration", "how long the records are offered for").Default("60s").Duration()
+	benchBatchSize = benchCmd.Flag("batch-size", "number of records written at a time").Default("1000").Int()
+	benchDetailed  = benchCmd.Flag("detailed", "generate realistic raw requests and responses for the records").Bool()
+)
+
+// benchStats are the results of benchmarking a pump
+type benchStats struct {
+	// Offered is the number of records handed to the pump
+	Offered int
+	Written int
+	Failed  int
+	// Skipped is the number of records not handed to the pump because it was still busy writing earlier batches
+	Skipped   int
+	Batches   int
+	Errors    int
+	Elapsed   time.Duration
+	Latencies []time.Duration
+}
+
+// runBench writes synthetic records at --rate through the --pump pumps for --duration and logs the results of each
+func runBench() {
+	benchLog := log.WithFields(logrus.Fields{
+		"prefix": benchPrefix,
+	})
+
+	if *benchRate <= 0 {
+		benchLog.Fatal("--rate must be greater than 0")
+	}
+	if *benchBatchSize <= 0 {
+		benchLog.Fatal("--batch-size must be greater than 0")
+	}
+
+	benched := []pumps.Pump{}
+	if len(*benchPumpNames) == 0 {
+		initialisePumps()
+		benched = Pumps
+	}
+	for _, name := range *benchPumpNames {
+		pmp, err := initialiseConfiguredPump(name)
+		if err != nil {
+			benchLog.Fatal(err)
+		}
+		benched = append(benched, pmp)
+	}
+
+	profile := demo.DefaultProfile()
+	profile.DetailedRecording = *benchDetailed
+	demo.DemoInit("bench", "", "", profile)
+
+	benchLog.Warning("Writing synthetic records through ", len(benched), " pumps at ", *benchRate, " records/s for ", *benchDuration)
+	stats := benchPumps(benched, *benchRate, *benchBatchSize, *benchDuration, func(count int) []interface{} {
+		return demo.GenerateRecords(count, time.Now())
+	})
+
+	for i, pmp := range benched {
+		logBenchStats(benchLog.WithField("pump", pumpName(pmp)), stats[i])
+	}
+}
+
+// benchPumps offers batches of batchSize records made by generate to every pump at rate records per second for the
+// duration, and returns the results of every pump. A batch is skipped by a pump still busy with the previous ones, so
+// a slow pump doesn't slow down the rest.
+func benchPumps(benched []pumps.Pump, rate, batchSize int, duration time.Duration, generate func(int) []interface{}) []*benchStats {
+	stats := make([]*benchStats, len(benched))
+	queues := make([]chan []interface{}, len(benched))
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i, pmp := range benched {
+		stats[i] = &benchStats{}
+		queues[i] = make(chan []interface{}, 1)
+		wg.Add(1)
+		go func(pmp pumps.Pump, queue chan []interface{}, pumpStats *benchStats) {
+			defer wg.Done()
+			for batch := range queue {
+				batchStart := time.Now()
+				failed, err := writeBenchBatch(pmp, batch)
+				pumpStats.Latencies = append(pumpStats.Latencies, time.Since(batchStart))
+				pumpStats.Batches++
+				pumpStats.Written += len(batch) - len(failed)
+				pumpStats.Failed += len(failed)
+				if err != nil {
+					pumpStats.Errors++
+				}
+			}
+			pumpStats.Elapsed = time.Since(start)
+		}(pmp, queues[i], stats[i])
+	}
+
+	// the skipped records are counted apart, as the stats are only written by the goroutine of their pump
+	skipped := make([]int, len(benched))
+	offered := make([]int, len(benched))
+	interval := time.Duration(float64(time.Second) * float64(batchSize) / float64(rate))
+	ticker := time.NewTicker(interval)
+	deadline := time.After(duration)
+	for done := false; !done; {
+		batch := generate(batchSize)
+		for i := range benched {
+			select {
+			case queues[i] <- batch:
+				offered[i] += len(batch)
+			default:
+				skipped[i] += len(batch)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			done = true
+		}
+	}
+	ticker.Stop()
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+
+	for i := range stats {
+		stats[i].Offered = offered[i]
+		stats[i].Skipped = skipped[i]
+	}
+	return stats
+}
+
+// writeBenchBatch writes the records through the pump, honouring its filters and timeout, and returns the ones it
+// failed to write
+func writeBenchBatch(pmp pumps.Pump, records []interface{}) ([]interface{}, error) {
+	ctx := context.Background()
+	if timeout := pmp.GetTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+
+	return pumps.WriteDataPartial(ctx, pmp, filterData(pmp, records))
+}
+
+func logBenchStats(pumpLog *logrus.Entry, stats *benchStats) {
+	throughput := 0.0
+	if stats.Elapsed > 0 {
+		throughput = float64(stats.Written) / stats.Elapsed.Seconds()
+	}
+	pumpLog.Infof("Wrote %d of %d records offered in %s, %.0f records/s", stats.Written, stats.Offered, stats.Elapsed.Round(time.Millisecond), throughput)
+
+	if stats.Skipped > 0 {
+		pumpLog.Warningf("Skipped %d records while busy writing, the pump can't keep up with the rate", stats.Skipped)
+	}
+
+	errorRate := 0.0
+	if stats.Batches > 0 {
+		errorRate = 100 * float64(stats.Errors) / float64(stats.Batches)
+	}
+	pumpLog.Infof("%d records failed, %d of %d batches with errors (%.1f%%)", stats.Failed, stats.Errors, stats.Batches, errorRate)
+
+	latencies := append([]time.Duration{}, stats.Latencies...)
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	pumpLog.Infof("Batch latency: p50 %s, p95 %s, p99 %s, max %s", percentile(latencies, 0.5), percentile(latencies, 0.95),
+		percentile(latencies, 0.99), percentile(latencies, 1))
+}
+
+// percentile returns the p percentile, from 0 to 1, of the sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
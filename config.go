@@ -3,12 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"strings"
 
 	"github.com/TykTechnologies/tyk-pump/pumps"
-	"github.com/kelseyhightower/envconfig"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
 	"github.com/TykTechnologies/tyk-pump/storage"
@@ -23,41 +21,83 @@ type PumpConfig struct {
 	Type                  string                     `json:"type"`
 	Filters               analytics.AnalyticsFilters `json:"filters"`
 	Timeout               int                        `json:"timeout"`
-	OmitDetailedRecording bool                       `json:"omit_detailed_recording"`
+	OmitDetailedRecording *bool                      `json:"omit_detailed_recording"`
+	LogLevel              string                     `json:"log_level"`
+	Enabled               *bool                      `json:"enabled"`
+	IncludeFields         []string                   `json:"include_fields"`
+	ExcludeFields         []string                   `json:"exclude_fields"`
 	Meta                  map[string]interface{}     `json:"meta"` // TODO: convert this to json.RawMessage and use regular json.Unmarshal
+	// OrgOverrides are meta keys overridden by org ID, the records of those orgs are written by a separate instance
+	// of the pump configured with them
+	OrgOverrides map[string]map[string]interface{} `json:"org_overrides"`
+}
+
+// OmitsDetailedRecording returns whether the pump drops the raw request and response of the records, which it does
+// when omitDetails, the global default, is set, unless the pump sets omit_detailed_recording itself
+func (p PumpConfig) OmitsDetailedRecording(omitDetails bool) bool {
+	if p.OmitDetailedRecording != nil {
+		return *p.OmitDetailedRecording
+	}
+	return omitDetails
+}
+
+// IsEnabled returns whether the pump is initialised, which it is unless enabled is false
+func (p PumpConfig) IsEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
 }
 
 type TykPumpConfiguration struct {
-	PurgeDelay              int                        `json:"purge_delay"`
-	PurgeChunk              int64                      `json:"purge_chunk"`
-	StorageExpirationTime   int64                      `json:"storage_expiration_time"`
-	DontPurgeUptimeData     bool                       `json:"dont_purge_uptime_data"`
-	UptimePumpConfig        pumps.MongoConf            `json:"uptime_pump_config"`
-	Pumps                   map[string]PumpConfig      `json:"pumps"`
-	AnalyticsStorageType    string                     `json:"analytics_storage_type"`
-	AnalyticsStorageConfig  storage.RedisStorageConfig `json:"analytics_storage_config"`
-	StatsdConnectionString  string                     `json:"statsd_connection_string"`
-	StatsdPrefix            string                     `json:"statsd_prefix"`
-	LogLevel                string                     `json:"log_level"`
-	LogFormat               string                     `json:"log_format"`
-	HealthCheckEndpointName string                     `json:"health_check_endpoint_name"`
-	HealthCheckEndpointPort int                        `json:"health_check_endpoint_port"`
-	OmitDetailedRecording   bool                       `json:"omit_detailed_recording"`
+	PurgeDelay              int                               `json:"purge_delay"`
+	PurgeChunk              int64                             `json:"purge_chunk"`
+	MaxBatchSizeBytes       int64                             `json:"max_batch_size_bytes"`
+	StorageExpirationTime   int64                             `json:"storage_expiration_time"`
+	DontPurgeUptimeData     bool                              `json:"dont_purge_uptime_data"`
+	UptimePumpConfig        pumps.MongoConf                   `json:"uptime_pump_config"`
+	UptimePumps             map[string]PumpConfig             `json:"uptime_pumps"`
+	Pumps                   map[string]PumpConfig             `json:"pumps"`
+	AnalyticsStorageType    string                            `json:"analytics_storage_type"`
+	AnalyticsStorageConfig  storage.RedisStorageConfig        `json:"analytics_storage_config"`
+	StatsdConnectionString  string                            `json:"statsd_connection_string"`
+	StatsdPrefix            string                            `json:"statsd_prefix"`
+	LogLevel                string                            `json:"log_level"`
+	LogFormat               string                            `json:"log_format"`
+	HealthCheckEndpointName string                            `json:"health_check_endpoint_name"`
+	HealthCheckEndpointPort int                               `json:"health_check_endpoint_port"`
+	OmitDetailedRecording   bool                              `json:"omit_detailed_recording"`
+	Heartbeat               HeartbeatConfig                   `json:"heartbeat"`
+	PathNormalization       analytics.PathNormalizationConfig `json:"path_normalization"`
+	Retention               analytics.RetentionConfig         `json:"retention"`
+	GraphQL                 analytics.GraphQLConfig           `json:"graphql"`
+	TraceContext            analytics.TraceContextConfig      `json:"trace_context"`
+	CorrelationID           analytics.CorrelationIDConfig     `json:"correlation_id"`
+	ResponseHeaders         analytics.ResponseHeadersConfig   `json:"response_headers"`
+	BodyFields              analytics.BodyFieldsConfig        `json:"body_fields"`
+	BodyPolicies            analytics.BodyPoliciesConfig      `json:"body_policies"`
+	GRPC                    analytics.GRPCConfig              `json:"grpc"`
+	Dedup                   analytics.DedupConfig             `json:"dedup"`
+	Dashboard               analytics.DashboardConfig         `json:"dashboard"`
+	Anomalies               analytics.AnomalyConfig           `json:"anomalies"`
+	Backlog                 BacklogConfig                     `json:"backlog"`
+	TLS                     pumps.TLSDefaults                 `json:"tls"`
+	ConfigPollInterval      int                               `json:"config_poll_interval"`
+	PumpStages              []PumpStage                       `json:"pump_stages"`
 }
 
 func LoadConfig(filePath *string, configStruct *TykPumpConfiguration) {
 
-	configuration, err := ioutil.ReadFile(*filePath)
+	configuration, err := readConfigFile(*filePath)
 	if err != nil {
 		log.Error("Couldn't load configuration file: ", err)
+	} else {
+		// the YAML and included files are decoded with the same JSON schema
+		loadedConfig, _ = json.Marshal(configuration)
+		marshalErr := json.Unmarshal(loadedConfig, &configStruct)
+		if marshalErr != nil {
+			log.Error("Couldn't unmarshal configuration: ", marshalErr)
+		}
 	}
 
-	marshalErr := json.Unmarshal(configuration, &configStruct)
-	if marshalErr != nil {
-		log.Error("Couldn't unmarshal configuration: ", marshalErr)
-	}
-
-	overrideErr := envconfig.Process(ENV_PREVIX, configStruct)
+	overrideErr := pumps.ProcessEnv(ENV_PREVIX, configStruct)
 	if overrideErr != nil {
 		log.Error("Failed to process environment variables after file load: ", overrideErr)
 	}
@@ -68,6 +108,19 @@ func LoadConfig(filePath *string, configStruct *TykPumpConfiguration) {
 	}
 }
 
+// decodeConfig decodes the configuration reloaded from the configuration source, overridden by the environment
+// variables like the one loaded on startup
+func decodeConfig(configJSON []byte) (TykPumpConfiguration, error) {
+	cfg := TykPumpConfiguration{}
+	if err := json.Unmarshal(configJSON, &cfg); err != nil {
+		return cfg, err
+	}
+	if err := pumps.ProcessEnv(ENV_PREVIX, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.LoadPumpsByEnv()
+}
+
 func (cfg *TykPumpConfiguration) LoadPumpsByEnv() error {
 	if len(cfg.Pumps) == 0 {
 		cfg.Pumps = make(map[string]PumpConfig)
@@ -119,7 +172,7 @@ func (cfg *TykPumpConfiguration) LoadPumpsByEnv() error {
 
 		pmpType := pmp.Type
 		//We fetch the env vars for that pump.
-		overrideErr := envconfig.Process(PUMPS_ENV_PREFIX+"_"+pmpName, &pmp)
+		overrideErr := pumps.ProcessEnv(PUMPS_ENV_PREFIX+"_"+pmpName, &pmp)
 		if overrideErr != nil {
 			log.Error("Failed to process environment variables for ", PUMPS_ENV_PREFIX+"_"+pmpName, " with err: ", overrideErr)
 		}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configIncludeKey is the key of the files a configuration file is merged over, relative to it
+const configIncludeKey = "include"
+
+// readConfigFile reads the configuration file as JSON, YAML when its extension is .yaml or .yml, or TOML when it's
+// .toml, into a map with the keys of the JSON schema. The files it includes are read first, in order, and each one is
+// merged over the previous ones, then the file itself is merged over them: the maps are merged key by key, any other
+// value replaces the one of the included files.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	return configSource.readConfig(path, map[string]bool{})
+}
+
+// readConfig reads the local or remote configuration file of path, with the files it includes but the ones of including
+func (s *remoteConfigSource) readConfig(path string, including map[string]bool) (map[string]interface{}, error) {
+	id := path
+	if !isRemoteConfig(path) {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		id = absPath
+	}
+	if including[id] {
+		return nil, fmt.Errorf("%s includes itself", path)
+	}
+	including[id] = true
+	defer delete(including, id)
+
+	var content []byte
+	var err error
+	if isRemoteConfig(path) {
+		content, err = s.fetch(path)
+	} else {
+		content, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config, err := decodeConfigFile(configExt(path), content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	includes, err := configIncludes(config[configIncludeKey])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	delete(config, configIncludeKey)
+
+	merged := map[string]interface{}{}
+	for _, include := range includes {
+		include, err = resolveConfigInclude(path, include)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		included, err := s.readConfig(include, including)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeConfig(merged, included)
+	}
+	return mergeConfig(merged, config), nil
+}
+
+// resolveConfigInclude returns the path of the file included by the file of path, relative to it unless it's absolute
+// or remote
+func resolveConfigInclude(path, include string) (string, error) {
+	if isRemoteConfig(path) {
+		base, err := url.Parse(path)
+		if err != nil {
+			return "", err
+		}
+		ref, err := url.Parse(include)
+		if err != nil {
+			return "", err
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+	if isRemoteConfig(include) || filepath.IsAbs(include) {
+		return include, nil
+	}
+	return filepath.Join(filepath.Dir(path), include), nil
+}
+
+// configExt returns the extension of the configuration file, without the query of the remote ones
+func configExt(path string) string {
+	if isRemoteConfig(path) {
+		if u, err := url.Parse(path); err == nil {
+			path = u.Path
+		}
+	}
+	return strings.ToLower(filepath.Ext(path))
+}
+
+// decodeConfigFile decodes the content of the configuration file in the format of its extension: YAML for .yaml and
+// .yml, TOML for .toml, and JSON for any other extension
+func decodeConfigFile(ext string, content []byte) (map[string]interface{}, error) {
+	config := map[string]interface{}{}
+	switch ext {
+	case ".yaml", ".yml":
+		var raw interface{}
+		if err := yaml.Unmarshal(content, &raw); err != nil {
+			return nil, err
+		}
+		if raw == nil {
+			return config, nil
+		}
+		normalized, ok := normalizeYAML(raw).(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a mapping, got %T", raw)
+		}
+		return normalized, nil
+	case ".toml":
+		if _, err := toml.Decode(string(content), &config); err != nil {
+			return nil, err
+		}
+		return config, nil
+	default:
+		// the numbers are kept as they are written so that the large integers aren't rounded
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		if err := decoder.Decode(&config); err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
+}
+
+// normalizeYAML converts the mappings with keys other than strings to maps of string keys, which can be encoded as JSON
+func normalizeYAML(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = normalizeYAML(item)
+		}
+		return value
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			normalized[fmt.Sprint(key)] = normalizeYAML(item)
+		}
+		return normalized
+	case []interface{}:
+		for i, item := range value {
+			value[i] = normalizeYAML(item)
+		}
+		return value
+	}
+	return value
+}
+
+// configIncludes returns the files of the include key, a path or a list of paths
+func configIncludes(value interface{}) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		includes := make([]string, 0, len(value))
+		for _, include := range value {
+			path, ok := include.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a list of paths", configIncludeKey)
+			}
+			includes = append(includes, path)
+		}
+		return includes, nil
+	}
+	return nil, fmt.Errorf("%s must be a path or a list of paths", configIncludeKey)
+}
+
+// mergeConfig merges overlay over base, key by key for the maps present in both
+func mergeConfig(base, overlay map[string]interface{}) map[string]interface{} {
+	for key, value := range overlay {
+		baseMap, baseIsMap := base[key].(map[string]interface{})
+		overlayMap, overlayIsMap := value.(map[string]interface{})
+		if baseIsMap && overlayIsMap {
+			base[key] = mergeConfig(baseMap, overlayMap)
+			continue
+		}
+		base[key] = value
+	}
+	return base
+}
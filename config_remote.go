@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-pump/pumps"
+)
+
+// remoteConfigTimeout is the timeout of the requests to the remote configuration sources
+const remoteConfigTimeout = 30 * time.Second
+
+// configSource reads the configuration files, keeping the remote ones to fetch them again only when their ETag changes
+var configSource = newRemoteConfigSource()
+
+// loadedConfig is the configuration read from the configuration file on startup, as JSON
+var loadedConfig []byte
+
+// configReloads gets the configurations reloaded from the configuration source, which are applied by the purge loop
+var configReloads = make(chan TykPumpConfiguration)
+
+// remoteConfigSource fetches the configuration files of http://, https://, s3:// and consul:// URLs
+type remoteConfigSource struct {
+	client *http.Client
+	// consulScheme is the scheme of the Consul HTTP API, replaced in the tests
+	consulScheme string
+
+	mu sync.Mutex
+	// files are the last fetched files by URL, to send their ETag in If-None-Match
+	files map[string]remoteConfigFile
+	// s3Clients sign the requests to S3, by region
+	s3Clients map[string]*http.Client
+}
+
+type remoteConfigFile struct {
+	etag    string
+	content []byte
+}
+
+func newRemoteConfigSource() *remoteConfigSource {
+	consulScheme := "http"
+	if strings.EqualFold(os.Getenv("CONSUL_HTTP_SSL"), "true") {
+		consulScheme = "https"
+	}
+	return &remoteConfigSource{
+		client:       &http.Client{Timeout: remoteConfigTimeout},
+		consulScheme: consulScheme,
+		files:        map[string]remoteConfigFile{},
+		s3Clients:    map[string]*http.Client{},
+	}
+}
+
+// isRemoteConfig returns whether the configuration file is fetched from a URL instead of read from the disk
+func isRemoteConfig(path string) bool {
+	lower := strings.ToLower(path)
+	for _, scheme := range []string{"http://", "https://", "s3://", "consul://"} {
+		if strings.HasPrefix(lower, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch returns the content of the remote configuration file:
+//   - http:// and https:// URLs are fetched as they are.
+//   - s3://bucket/key URLs are fetched from S3, signed with the AWS credentials of the environment or of the IAM role,
+//     in the region of the region query parameter, AWS_REGION or AWS_DEFAULT_REGION, us-east-1 by default.
+//   - consul://host:port/key URLs are fetched from the Consul KV store, with the token of CONSUL_HTTP_TOKEN and over
+//     HTTPS when CONSUL_HTTP_SSL is true. The query parameters, like dc, are passed to Consul.
+//
+// The cached content is returned when the server responds that the ETag of the file didn't change.
+func (s *remoteConfigSource) fetch(path string) ([]byte, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s.client
+	endpoint := path
+	header := http.Header{}
+	switch strings.ToLower(u.Scheme) {
+	case "s3":
+		query := u.Query()
+		region := query.Get("region")
+		for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+			if region == "" {
+				region = os.Getenv(env)
+			}
+		}
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint = "https://" + u.Host + ".s3." + region + ".amazonaws.com" + u.EscapedPath()
+		client = s.s3Client(region)
+	case "consul":
+		endpoint = s.consulScheme + "://" + u.Host + "/v1/kv" + u.EscapedPath() + "?raw"
+		if u.RawQuery != "" {
+			endpoint += "&" + u.RawQuery
+		}
+		if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+			header.Set("X-Consul-Token", token)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	s.mu.Lock()
+	cached, isCached := s.files[path]
+	s.mu.Unlock()
+	if isCached && cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && isCached:
+		return cached.content, nil
+	case resp.StatusCode == http.StatusOK:
+		content, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.files[path] = remoteConfigFile{etag: resp.Header.Get("ETag"), content: content}
+		s.mu.Unlock()
+		return content, nil
+	}
+	return nil, fmt.Errorf("%s responded with status %d", u.Redacted(), resp.StatusCode)
+}
+
+// s3Client returns the client signing the requests to S3 in the region
+func (s *remoteConfigSource) s3Client(region string) *http.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if client, ok := s.s3Clients[region]; ok {
+		return client
+	}
+	client := pumps.NewAWSClient(region, "s3", remoteConfigTimeout)
+	s.s3Clients[region] = client
+	return client
+}
+
+// watchConfig reads the configuration file every interval until ctx is done, and sends the configuration to reloads
+// when it changes. Only the pumps and their stages are reloaded, the changes to the rest of the configuration are logged as they need a
+// restart. The configuration is kept when it can't be read.
+func watchConfig(ctx context.Context, path string, interval time.Duration, reloads chan<- TykPumpConfiguration) {
+	current := loadedConfig
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		configuration, err := readConfigFile(path)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Error("Couldn't reload the configuration, the current one is kept: ", err)
+			continue
+		}
+		configJSON, _ := json.Marshal(configuration)
+		if bytes.Equal(configJSON, current) {
+			continue
+		}
+
+		cfg, err := decodeConfig(configJSON)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Error("Couldn't reload the configuration, the current one is kept: ", err)
+			continue
+		}
+		if !configEqualExceptPumps(current, configJSON) {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Warning("The configuration changed, only the pumps are reloaded, restart Tyk Pump to apply the rest of changes")
+		}
+		current = configJSON
+
+		select {
+		case reloads <- cfg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// configEqualExceptPumps returns whether the JSON configurations only differ in their pumps and pump stages
+func configEqualExceptPumps(a, b []byte) bool {
+	withoutPumps := func(configJSON []byte) []byte {
+		configuration := map[string]interface{}{}
+		json.Unmarshal(configJSON, &configuration)
+		delete(configuration, "pumps")
+		delete(configuration, "pump_stages")
+		result, _ := json.Marshal(configuration)
+		return result
+	}
+	return bytes.Equal(withoutPumps(a), withoutPumps(b))
+}
+
+// reloadConfig replaces the pumps whose configuration changed with the ones of the reloaded configuration, and
+// updates the pump stages. The replaced and removed pumps are flushed and closed before the new ones are initialised,
+// so the new ones can take their listeners, while the pumps whose configuration didn't change keep running as they
+// are. The current pumps are kept when the new stages are invalid.
+func reloadConfig(cfg TykPumpConfiguration) {
+	if err := validatePumpStages(cfg.PumpStages, cfg.Pumps); err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Error("Invalid pump stages in the reloaded configuration, the current pumps are kept: ", err)
+		return
+	}
+
+	running := map[string]bool{}
+	for _, pmp := range Pumps {
+		running[pumpKeys[pmp]] = true
+	}
+	// the pumps which failed to initialise are retried even when their configuration didn't change
+	changed := map[string]PumpConfig{}
+	for key, pmp := range cfg.Pumps {
+		if current, ok := SystemConfig.Pumps[key]; !ok || !running[key] || !reflect.DeepEqual(current, pmp) {
+			changed[key] = pmp
+		}
+	}
+
+	kept := []pumps.Pump{}
+	for _, pmp := range Pumps {
+		key := pumpKeys[pmp]
+		if _, ok := cfg.Pumps[key]; ok {
+			if _, isChanged := changed[key]; !isChanged {
+				kept = append(kept, pmp)
+				continue
+			}
+		}
+		closePump(pmp)
+		delete(pumpKeys, pmp)
+	}
+
+	Pumps = append(kept, loadPumps(changed)...)
+	SystemConfig.Pumps = cfg.Pumps
+	SystemConfig.PumpStages = cfg.PumpStages
+	if len(Pumps) == 0 {
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Error("None of the pumps of the reloaded configuration could be initialised")
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"prefix": mainPrefix,
+	}).Infof("Reloaded the configuration, %d pumps running, %d of them kept", len(Pumps), len(kept))
+}
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/TykTechnologies/tyk-pump/analytics"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -49,6 +59,9 @@ func TestConfigEnv(t *testing.T) {
 
 	assert.Equal(t, "csv", cfg.Pumps[pumpNameTest].Type)
 	assert.Equal(t, 10, cfg.Pumps[pumpNameTest].Timeout)
+	assert.True(t, cfg.Pumps[pumpNameTest].OmitsDetailedRecording(false))
+	assert.True(t, cfg.Pumps[pumpNameCSV].OmitsDetailedRecording(true))
+	assert.False(t, cfg.Pumps[pumpNameCSV].OmitsDetailedRecording(false))
 
 	assert.Contains(t, cfg.Pumps[pumpNameTest].Meta, "meta_env_prefix")
 	assert.Contains(t, cfg.Pumps[pumpNameCSV].Meta, "meta_env_prefix")
@@ -58,3 +71,212 @@ func TestConfigEnv(t *testing.T) {
 
 	assert.Len(t, cfg.Pumps[pumpNameCSV].Filters.APIIDs, 3)
 }
+
+func TestConfigEnvJSON(t *testing.T) {
+	testEnvVars := map[string]string{
+		PUMPS_ENV_PREFIX + "_JSON_TYPE":              "csv",
+		PUMPS_ENV_PREFIX + "_JSON_FILTERS":           `{"skip_api_ids":["a","b"],"response_codes":[200]}`,
+		PUMPS_ENV_PREFIX + "_JSON_FILTERS_ORGSIDS":   `["org"]`,
+		PUMPS_ENV_PREFIX + "_JSON_META":              `{"csv_dir":"/csv"}`,
+		PUMPS_ENV_PREFIX + "_JSON_ORGOVERRIDES":      `{"org":{"csv_dir":"/org"}}`,
+		ENV_PREVIX + "_PATHNORMALIZATION_RULES":      `[{"pattern":"^/users/[0-9]+","replacement":"/users/{id}"}]`,
+		ENV_PREVIX + "_ANALYTICSSTORAGECONFIG_ADDRS": "redis-1:6379,redis-2:6379",
+	}
+	for env, val := range testEnvVars {
+		os.Setenv(env, val)
+	}
+	defer func() {
+		for env := range testEnvVars {
+			os.Unsetenv(env)
+		}
+	}()
+
+	cfg := &TykPumpConfiguration{}
+	defaultPath := ""
+	LoadConfig(&defaultPath, cfg)
+
+	pump := cfg.Pumps["JSON"]
+	assert.Equal(t, []string{"a", "b"}, pump.Filters.SkippedAPIIDs)
+	assert.Equal(t, []int{200}, pump.Filters.ResponseCodes)
+	assert.Equal(t, []string{"org"}, pump.Filters.OrgsIDs)
+	assert.Equal(t, "/csv", pump.Meta["csv_dir"])
+	assert.Equal(t, "/org", pump.OrgOverrides["org"]["csv_dir"])
+	assert.Equal(t, []analytics.PathNormalizationRule{{Pattern: "^/users/[0-9]+", Replacement: "/users/{id}"}}, cfg.PathNormalization.Rules)
+	assert.Equal(t, []string{"redis-1:6379", "redis-2:6379"}, cfg.AnalyticsStorageConfig.Addrs)
+
+	// the environment is left as it was
+	assert.Equal(t, `["org"]`, os.Getenv(PUMPS_ENV_PREFIX+"_JSON_FILTERS_ORGSIDS"))
+}
+
+func TestConfigFileInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pump-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"base.json": `{
+			"purge_delay": 10,
+			"purge_chunk": 9007199254740993,
+			"analytics_storage_config": {"host": "localhost", "port": 6379},
+			"pumps": {"csv": {"type": "csv", "meta": {"csv_dir": "/csv"}}}
+		}`,
+		"pump.yaml": `
+include: base.json
+analytics_storage_config:
+  host: redis
+pumps:
+  csv:
+    meta:
+      csv_dir: /prod/csv
+    filters:
+      skip_api_ids: [a, b]
+  stdout:
+    type: stdout
+`,
+		"loop.yml": "include: [loop.yml]\n",
+		"pump.toml": `
+include = "base.json"
+purge_chunk = 100
+
+[analytics_storage_config]
+host = "redis"
+
+[pumps.csv.meta]
+csv_dir = "/prod/csv"
+
+[pumps.csv.filters]
+skip_api_ids = ["a", "b"]
+
+[pumps.stdout]
+type = "stdout"
+`,
+		"pump.cfg": `{"purge_delay": 5}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &TykPumpConfiguration{}
+	path := filepath.Join(dir, "pump.yaml")
+	LoadConfig(&path, cfg)
+
+	assert.Equal(t, 10, cfg.PurgeDelay)
+	assert.Equal(t, int64(9007199254740993), cfg.PurgeChunk)
+	assert.Equal(t, "redis", cfg.AnalyticsStorageConfig.Host)
+	assert.Equal(t, 6379, cfg.AnalyticsStorageConfig.Port)
+	assert.Equal(t, "csv", cfg.Pumps["csv"].Type)
+	assert.Equal(t, "/prod/csv", cfg.Pumps["csv"].Meta["csv_dir"])
+	assert.Equal(t, []string{"a", "b"}, cfg.Pumps["csv"].Filters.SkippedAPIIDs)
+	assert.Equal(t, "stdout", cfg.Pumps["stdout"].Type)
+
+	_, err = readConfigFile(filepath.Join(dir, "loop.yml"))
+	assert.Error(t, err)
+
+	// TOML files have the same schema, and include the other formats
+	cfg = &TykPumpConfiguration{}
+	path = filepath.Join(dir, "pump.toml")
+	LoadConfig(&path, cfg)
+	assert.Equal(t, 10, cfg.PurgeDelay)
+	assert.Equal(t, int64(100), cfg.PurgeChunk)
+	assert.Equal(t, "redis", cfg.AnalyticsStorageConfig.Host)
+	assert.Equal(t, 6379, cfg.AnalyticsStorageConfig.Port)
+	assert.Equal(t, "csv", cfg.Pumps["csv"].Type)
+	assert.Equal(t, "/prod/csv", cfg.Pumps["csv"].Meta["csv_dir"])
+	assert.Equal(t, []string{"a", "b"}, cfg.Pumps["csv"].Filters.SkippedAPIIDs)
+	assert.Equal(t, "stdout", cfg.Pumps["stdout"].Type)
+
+	// any other extension is read as JSON
+	configuration, err := readConfigFile(filepath.Join(dir, "pump.cfg"))
+	assert.NoError(t, err)
+	assert.Equal(t, json.Number("5"), configuration["purge_delay"])
+}
+
+func TestRemoteConfig(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/pump.yaml":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("include: base.json\npurge_delay: 5\n"))
+		case "/base.json":
+			w.Write([]byte(`{"purge_delay": 10, "pumps": {"csv": {"type": "csv"}}}`))
+		case "/v1/kv/tyk/pump.json":
+			if r.URL.RawQuery != "raw&dc=eu" || r.Header.Get("X-Consul-Token") != "consul-token" {
+				t.Errorf("unexpected Consul request %s %v", r.URL, r.Header)
+			}
+			w.Write([]byte(`{"purge_delay": 20}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		configuration, err := readConfigFile(server.URL + "/pump.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 5, configuration["purge_delay"])
+		assert.Contains(t, configuration, "pumps")
+	}
+	assert.Equal(t, 4, requests)
+
+	os.Setenv("CONSUL_HTTP_TOKEN", "consul-token")
+	defer os.Unsetenv("CONSUL_HTTP_TOKEN")
+	configuration, err := readConfigFile("consul://" + strings.TrimPrefix(server.URL, "http://") + "/tyk/pump.json?dc=eu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, json.Number("20"), configuration["purge_delay"])
+
+	_, err = readConfigFile(server.URL + "/missing.json")
+	assert.Error(t, err)
+}
+
+func TestWatchConfig(t *testing.T) {
+	var mu sync.Mutex
+	content := `{"purge_delay": 10, "pumps": {"csv": {"type": "csv"}}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	defer func(config []byte) { loadedConfig = config }(loadedConfig)
+	cfg := &TykPumpConfiguration{}
+	path := server.URL + "/pump.json"
+	LoadConfig(&path, cfg)
+	assert.Contains(t, cfg.Pumps, "csv")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloads := make(chan TykPumpConfiguration)
+	go watchConfig(ctx, path, 10*time.Millisecond, reloads)
+
+	mu.Lock()
+	content = `{"purge_delay": 10, "pumps": {"stdout": {"type": "stdout"}}}`
+	mu.Unlock()
+	select {
+	case reloaded := <-reloads:
+		assert.Contains(t, reloaded.Pumps, "stdout")
+		assert.NotContains(t, reloaded.Pumps, "csv")
+	case <-time.After(time.Second):
+		t.Fatal("expected the changed configuration to be reloaded")
+	}
+
+	select {
+	case <-reloads:
+		t.Error("expected the configuration to be reloaded only when it changes")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
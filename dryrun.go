@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-pump/analytics"
+	"github.com/TykTechnologies/tyk-pump/pumps"
+)
+
+var dryRunPrefix = "dry-run"
+
+// dryRunPurge reads the pending analytics records without removing them from the store and prints, for every
+// configured pump, a summary of the records it would receive once its filters are applied.
+func dryRunPurge(chunkSize int64, omitDetails bool, samples int) {
+	keys := []interface{}{}
+	for _, analyticsKeyName := range analyticsKeyNames() {
+		values := AnalyticsStore.GetSet(analyticsKeyName, chunkSize)
+		if len(values) > 0 {
+			keys = append(keys, decodeRecords(analyticsKeyName, values, omitDetails, nil)...)
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"prefix": dryRunPrefix,
+	}).Info("Found ", len(keys), " pending records")
+
+	for _, pmp := range Pumps {
+		printDryRunSummary(pmp, keys, samples)
+	}
+}
+
+// printDryRunSummary prints what pmp would write for the given records
+func printDryRunSummary(pmp pumps.Pump, keys []interface{}, samples int) {
+	filteredKeys := filterData(pmp, dropStaleRecords(pmp, keys, time.Now()))
+
+	perAPI := map[string]int{}
+	for _, key := range filteredKeys {
+		record := key.(analytics.AnalyticsRecord)
+		perAPI[record.APIID]++
+	}
+
+	apiIDs := make([]string, 0, len(perAPI))
+	for apiID := range perAPI {
+		apiIDs = append(apiIDs, apiID)
+	}
+	sort.Strings(apiIDs)
+
+	pumpLog := log.WithFields(logrus.Fields{
+		"prefix": dryRunPrefix,
+		"pump":   pumpName(pmp),
+	})
+	pumpLog.Info("Would write ", len(filteredKeys), " records (", len(keys)-len(filteredKeys), " filtered out)")
+	for _, apiID := range apiIDs {
+		pumpLog.Info("  api_id ", apiID, ": ", perAPI[apiID], " records")
+	}
+
+	for i := 0; i < samples && i < len(filteredKeys); i++ {
+		sample, err := dryRunSample(pmp, filteredKeys[i].(analytics.AnalyticsRecord))
+		if err != nil {
+			pumpLog.Error("Couldn't build the sample record: ", err)
+			continue
+		}
+		pumpLog.Info("Sample record: ", string(sample))
+	}
+}
+
+// dryRunSample returns what pmp would write for the record: the payload of the pumps implementing pumps.Previewer,
+// like the Splunk event or the CSV line, and the JSON of the record for the rest
+func dryRunSample(pmp pumps.Pump, record analytics.AnalyticsRecord) ([]byte, error) {
+	if previewer, ok := pmp.(pumps.Previewer); ok {
+		return previewer.Preview(record)
+	}
+	return json.Marshal(record)
+}
@@ -3,6 +3,7 @@ module github.com/TykTechnologies/tyk-pump
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/DataDog/datadog-go v4.7.0+incompatible
 	github.com/Microsoft/go-winio v0.5.0 // indirect
 	github.com/StackExchange/wmi v0.0.0-20190523213315-cbe66965904d // indirect
@@ -17,6 +18,7 @@ require (
 	github.com/go-redis/redis/v8 v8.3.1
 	github.com/gocraft/health v0.0.0-20170925182251-8675af27fef0
 	github.com/gocraft/web v0.0.0-20190207150652-9707327fb69b
+	github.com/golang/snappy v0.0.1
 	github.com/influxdata/influxdb v1.8.3
 	github.com/jehiah/go-strftime v0.0.0-20151206194810-2efbe75097a5 // indirect
 	github.com/kelseyhightower/envconfig v1.4.0
@@ -28,8 +30,8 @@ require (
 	github.com/olivere/elastic v6.2.31+incompatible // indirect
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.0.0
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
 	github.com/quipo/statsd v0.0.0-20160923160612-75b7afedf0d2
-	github.com/robertkowalski/graylog-golang v0.0.0-20151121031040-e5295cfa2827
 	github.com/satori/go.uuid v1.2.0
 	github.com/segmentio/analytics-go v0.0.0-20160711225931-bdb0aeca8a99
 	github.com/segmentio/backo-go v0.0.0-20160424052352-204274ad699c // indirect
@@ -45,4 +47,5 @@ require (
 	gopkg.in/olivere/elastic.v5 v5.0.85
 	gopkg.in/olivere/elastic.v6 v6.2.31
 	gopkg.in/vmihailenco/msgpack.v2 v2.9.1
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-pump/analytics"
+	"github.com/gocraft/health"
+)
+
+const (
+	defaultHeartbeatInterval = 60
+	defaultHeartbeatAPIID    = "tyk-pump-heartbeat"
+	heartbeatPath            = "/tyk-pump/heartbeat"
+)
+
+type HeartbeatConfig struct {
+	// Enabled makes the pump send a heartbeat record through the pumps every Interval seconds
+	Enabled bool `json:"enabled"`
+	// Interval in seconds between heartbeats, defaults to 60
+	Interval int `json:"interval"`
+	// OrgID the heartbeat records are attributed to
+	OrgID string `json:"org_id"`
+	// APIID the heartbeat records are attributed to, defaults to tyk-pump-heartbeat
+	APIID string `json:"api_id"`
+}
+
+// purgeStats holds the figures of a purge loop iteration
+type purgeStats struct {
+	Time     time.Time
+	Records  int
+	Duration time.Duration
+}
+
+var pumpStartTime = time.Now()
+var lastPurge purgeStats
+var lastHeartbeat time.Time
+
+// heartbeatDue returns whether a heartbeat has to be sent at now
+func heartbeatDue(conf HeartbeatConfig, now time.Time) bool {
+	if !conf.Enabled {
+		return false
+	}
+
+	interval := conf.Interval
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
+	return now.Sub(lastHeartbeat) >= time.Duration(interval)*time.Second
+}
+
+// sendHeartbeat writes a heartbeat record to all the pumps
+func sendHeartbeat(conf HeartbeatConfig, job *health.Job, purgeDelay int) {
+	now := time.Now()
+	lastHeartbeat = now
+
+	log.WithFields(logrus.Fields{
+		"prefix": mainPrefix,
+	}).Debug("Sending heartbeat record")
+
+	writeToPumps([]interface{}{heartbeatRecord(conf, now, lastPurge)}, job, now, purgeDelay)
+}
+
+// heartbeatRecord builds the synthetic record which lets the analytics backends tell a silent pump from an idle one.
+// The pump version, uptime and the figures of the last purge are sent as tags.
+func heartbeatRecord(conf HeartbeatConfig, now time.Time, purge purgeStats) analytics.AnalyticsRecord {
+	apiID := conf.APIID
+	if apiID == "" {
+		apiID = defaultHeartbeatAPIID
+	}
+
+	hostname, _ := os.Hostname()
+
+	tags := []string{
+		defaultHeartbeatAPIID,
+		"version:" + VERSION,
+		fmt.Sprintf("uptime_seconds:%d", int64(now.Sub(pumpStartTime).Seconds())),
+		fmt.Sprintf("last_purge_records:%d", purge.Records),
+		fmt.Sprintf("last_purge_duration_ms:%d", purge.Duration.Nanoseconds()/int64(time.Millisecond)),
+	}
+	if !purge.Time.IsZero() {
+		tags = append(tags, "last_purge_at:"+purge.Time.UTC().Format(time.RFC3339))
+	}
+
+	return analytics.AnalyticsRecord{
+		Method:       "GET",
+		Host:         hostname,
+		Path:         heartbeatPath,
+		RawPath:      heartbeatPath,
+		UserAgent:    "Tyk-Pump/" + VERSION,
+		Day:          now.Day(),
+		Month:        now.Month(),
+		Year:         now.Year(),
+		Hour:         now.Hour(),
+		ResponseCode: 200,
+		TimeStamp:    now,
+		APIName:      apiID,
+		APIID:        apiID,
+		OrgID:        conf.OrgID,
+		Tags:         tags,
+		TrackPath:    true,
+	}
+}
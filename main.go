@@ -3,8 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"os"
@@ -18,6 +21,7 @@ import (
 	"github.com/TykTechnologies/tyk-pump/server"
 	"github.com/TykTechnologies/tyk-pump/storage"
 	"github.com/gocraft/health"
+	uuid "github.com/satori/go.uuid"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 	msgpack "gopkg.in/vmihailenco/msgpack.v2"
 )
@@ -26,26 +30,57 @@ var SystemConfig TykPumpConfiguration
 var AnalyticsStore storage.AnalyticsStorage
 var UptimeStorage storage.AnalyticsStorage
 var Pumps []pumps.Pump
-var UptimePump pumps.MongoPump
+var UptimePumps []pumps.UptimeWriter
+
+// pathNormalizer normalizes the path of the records, it's nil when path normalization isn't configured
+var pathNormalizer *analytics.PathNormalizer
+
+// bodyFieldExtractor extracts the configured fields of the request bodies, it's nil when there are none
+var bodyFieldExtractor *analytics.BodyFieldExtractor
+
+// deduplicator skips the records already written, it's nil when deduplication isn't enabled
+var deduplicator *analytics.Deduplicator
+
+// dashboardClient enriches the records with the metadata of their API, it's nil when the enrichment isn't enabled
+var dashboardClient *analytics.DashboardClient
+
+// ignoreRecordAge keeps the stale records, for the commands writing old records on purpose
+var ignoreRecordAge bool
 
 var log = logger.GetLogger()
 
 var mainPrefix = "main"
 
+// command is the command selected in the command line
+var command string
+
 var (
 	help               = kingpin.CommandLine.HelpFlag.Short('h')
 	conf               = kingpin.Flag("conf", "path to the config file").Short('c').Default("pump.conf").String()
 	demoMode           = kingpin.Flag("demo", "pass orgID string to generate demo data").Default("").String()
 	demoApiMode        = kingpin.Flag("demo-api", "pass apiID string to generate demo data").Default("").String()
 	demoApiVersionMode = kingpin.Flag("demo-api-version", "pass apiID string to generate demo data").Default("").String()
+	demoOrgs           = kingpin.Flag("demo-orgs", "number of orgs the demo traffic is split between, derived from the demo orgID").Default("1").Int()
+	demoApis           = kingpin.Flag("demo-apis", "number of demo APIs, ignored with --demo-api").Default("3").Int()
+	demoDays           = kingpin.Flag("demo-days", "number of days of demo data before today").Default("30").Int()
+	demoFutureDays     = kingpin.Flag("demo-future-days", "number of days of demo data from today on, future dated but for the hours already gone").Default("0").Int()
+	demoRecordsPerDay  = kingpin.Flag("demo-records-per-day", "average number of demo records per day").Default("300").Int()
+	demoTraffic        = kingpin.Flag("demo-traffic", "shape of the demo traffic through the day: flat, diurnal or spiky").Default(demo.FlatTraffic).Enum(demo.FlatTraffic, demo.DiurnalTraffic, demo.SpikyTraffic)
+	demoLatency        = kingpin.Flag("demo-latency", "median request time of the demo traffic in milliseconds").Default("5").Float64()
+	demoErrorRate      = kingpin.Flag("demo-error-rate", "fraction of the demo requests failing with a 4xx or 5xx response code").Default("0.2").Float64()
+	demoDetailed       = kingpin.Flag("demo-detailed", "generate realistic raw requests and responses for the demo records").Bool()
+	demoGraphQLRate    = kingpin.Flag("demo-graphql-rate", "fraction of the demo requests which are GraphQL operations").Default("0").Float64()
 	debugMode          = kingpin.Flag("debug", "enable debug mode").Bool()
+	startCmd           = kingpin.Command("start", "start purging the analytics records to the pumps (default)").Default()
+	dryRun             = kingpin.Flag("dry-run", "decode and filter the pending analytics records and print what each pump would write, without writing or removing them").Bool()
+	dryRunSamples      = kingpin.Flag("dry-run-samples", "number of sample records to print per pump in dry-run mode").Default("0").Int()
 	version            = kingpin.Version(VERSION)
 )
 
 func Init() {
 	SystemConfig = TykPumpConfiguration{}
 
-	kingpin.Parse()
+	command = kingpin.Parse()
 	log.Formatter = new(prefixed.TextFormatter)
 	LoadConfig(conf, &SystemConfig)
 
@@ -87,6 +122,86 @@ func Init() {
 		log.Level = logrus.DebugLevel
 	}
 
+	if pumps.FIPSMode {
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Info("FIPS mode enabled, TLS is restricted to the FIPS-approved versions and cipher suites")
+	}
+	if err := pumps.SetTLSDefaults(SystemConfig.TLS); err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Fatal("Invalid TLS configuration: ", err)
+	}
+	storage.ApplyTLSDefaults = pumps.ApplyTLSDefaults
+
+	if SystemConfig.PathNormalization.Enabled() {
+		var err error
+		pathNormalizer, err = analytics.NewPathNormalizer(SystemConfig.PathNormalization)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Fatal("Couldn't set up path normalization: ", err)
+		}
+	}
+
+	if len(SystemConfig.BodyFields.Fields) > 0 {
+		var err error
+		bodyFieldExtractor, err = analytics.NewBodyFieldExtractor(SystemConfig.BodyFields)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Fatal("Couldn't set up the body fields: ", err)
+		}
+	}
+
+	if err := SystemConfig.BodyPolicies.Validate(); err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Fatal("Invalid body policies: ", err)
+	}
+
+	if err := SystemConfig.Retention.Validate(); err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Fatal("Invalid retention configuration: ", err)
+	}
+
+	if SystemConfig.Dedup.Enabled {
+		deduplicator = analytics.NewDeduplicator(SystemConfig.Dedup)
+	}
+
+	if err := SystemConfig.Anomalies.Validate(); err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Fatal("Invalid anomalies configuration: ", err)
+	}
+	if SystemConfig.Anomalies.Enabled {
+		anomalyDetector = analytics.NewAnomalyDetector(SystemConfig.Anomalies)
+	}
+
+	if err := SystemConfig.Dashboard.Validate(); err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Fatal("Invalid dashboard configuration: ", err)
+	}
+	if SystemConfig.Dashboard.Enabled() {
+		dashboardClient = analytics.NewDashboardClient(SystemConfig.Dashboard)
+	}
+	if dashboardClient != nil && (SystemConfig.Dashboard.EnrichAPIs || SystemConfig.Dashboard.EnrichPortal) {
+		// the APIs and the developers are loaded on startup so the first records are enriched, they are loaded again in
+		// the background
+		if err := dashboardClient.Refresh(); err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Error("Couldn't load the APIs and the developers of the dashboard, the records are enriched once they are loaded: ", err)
+		}
+	}
+
+	if err := validatePumpStages(SystemConfig.PumpStages, SystemConfig.Pumps); err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Fatal("Invalid pump stages: ", err)
+	}
 }
 
 func setupAnalyticsStore() {
@@ -118,117 +233,456 @@ func storeVersion() {
 	versionStore.SetKey("pump", VERSION, 0)
 }
 
-func initialisePumps() {
-	Pumps = []pumps.Pump{}
+// initialisePump creates and initialises the pump configured under key
+func initialisePump(key string, pmp PumpConfig) (pumps.Pump, error) {
+	pumpTypeName := pmp.Type
+	if pumpTypeName == "" {
+		pumpTypeName = key
+	}
 
-	for key, pmp := range SystemConfig.Pumps {
-		pumpTypeName := pmp.Type
-		if pumpTypeName == "" {
-			pumpTypeName = key
-		}
+	pmpType, err := pumps.GetPumpByName(pumpTypeName)
+	if err != nil {
+		return nil, fmt.Errorf("Pump load error (skipping): %v", err)
+	}
 
-		pmpType, err := pumps.GetPumpByName(pumpTypeName)
+	thisPmp := pmpType.New()
+	// the pumps configured under a key other than their type are named after it, to tell apart the pumps of a type
+	if !strings.EqualFold(key, pumpTypeName) {
+		thisPmp.SetInstanceName(key)
+	}
+	fields := analytics.FieldSelection{Include: pmp.IncludeFields, Exclude: pmp.ExcludeFields}
+	if err := fields.Validate(); err != nil {
+		return nil, fmt.Errorf("Pump %s fields error (skipping): %v", key, err)
+	}
+	thisPmp.SetFieldSelection(fields)
+	thisPmp.SetFilters(pmp.Filters)
+	thisPmp.SetTimeout(pmp.Timeout)
+	thisPmp.SetOmitDetailedRecording(pmp.OmitsDetailedRecording(SystemConfig.OmitDetailedRecording))
+	thisPmp.SetDryRun(*dryRun)
+	if pmp.LogLevel != "" {
+		level, err := logrus.ParseLevel(pmp.LogLevel)
 		if err != nil {
 			log.WithFields(logrus.Fields{
 				"prefix": mainPrefix,
-			}).Error("Pump load error (skipping): ", err)
+			}).Warningf("Invalid log level %q specified for pump %s, using the global log level", pmp.LogLevel, key)
 		} else {
-			thisPmp := pmpType.New()
-			thisPmp.SetFilters(pmp.Filters)
-			thisPmp.SetTimeout(pmp.Timeout)
-			thisPmp.SetOmitDetailedRecording(pmp.OmitDetailedRecording)
-			initErr := thisPmp.Init(pmp.Meta)
-			if initErr != nil {
-				log.WithField("pump", thisPmp.GetName()).Error("Pump init error (skipping): ", initErr)
-			} else {
-				log.WithFields(logrus.Fields{
-					"prefix": mainPrefix,
-				}).Info("Init Pump: ", key)
-				Pumps = append(Pumps, thisPmp)
-			}
+			thisPmp.SetLogLevel(level)
 		}
 	}
 
+	if initErr := thisPmp.Init(pmp.Meta); initErr != nil {
+		return nil, fmt.Errorf("Pump %s init error (skipping): %v", thisPmp.GetName(), initErr)
+	}
+	return thisPmp, nil
+}
+
+// pumpName returns the name of the pump instance in the logs and metrics, or the name of its type when it isn't named
+func pumpName(pmp pumps.Pump) string {
+	if name := pmp.GetInstanceName(); name != "" {
+		return name
+	}
+	return pmp.GetName()
+}
+
+// withOrgOverrides splits the configuration of a pump with org overrides into one configuration per overridden org,
+// keyed by the pump key and the org ID, which only gets the records of the org, and the pump configuration itself,
+// which gets the records of the rest of orgs
+func withOrgOverrides(key string, pmp PumpConfig) map[string]PumpConfig {
+	if len(pmp.OrgOverrides) == 0 {
+		return map[string]PumpConfig{key: pmp}
+	}
+
+	if pmp.Type == "" {
+		pmp.Type = key
+	}
+
+	configs := map[string]PumpConfig{}
+	base := pmp
+	base.OrgOverrides = nil
+	base.Filters.SkippedOrgsIDs = append([]string{}, pmp.Filters.SkippedOrgsIDs...)
+
+	for orgID, overrides := range pmp.OrgOverrides {
+		orgPmp := pmp
+		orgPmp.OrgOverrides = nil
+		orgPmp.Filters.OrgsIDs = []string{orgID}
+		orgPmp.Meta = make(map[string]interface{}, len(pmp.Meta)+len(overrides))
+		for metaKey, value := range pmp.Meta {
+			orgPmp.Meta[metaKey] = value
+		}
+		for metaKey, value := range overrides {
+			orgPmp.Meta[metaKey] = value
+		}
+		configs[key+":"+orgID] = orgPmp
+
+		base.Filters.SkippedOrgsIDs = append(base.Filters.SkippedOrgsIDs, orgID)
+	}
+
+	configs[key] = base
+	return configs
+}
+
+// checkOrgOverride returns an error when the pump of an org override can't run along with the pump it overrides,
+// which is the case of the prometheus pumps in pull mode listening on the same address
+func checkOrgOverride(pumpKey string, pmp, orgPmp PumpConfig) error {
+	if !strings.EqualFold(orgPmp.Type, "prometheus") {
+		return nil
+	}
+	pullMode := func(meta map[string]interface{}) bool {
+		mode, _ := meta["mode"].(string)
+		return mode == "" || mode == "pull"
+	}
+	if pullMode(pmp.Meta) && pullMode(orgPmp.Meta) && fmt.Sprint(pmp.Meta["listen_address"]) == fmt.Sprint(orgPmp.Meta["listen_address"]) {
+		return fmt.Errorf("Pump %s org override error (skipping): a prometheus pump in pull mode needs its own listen_address", pumpKey)
+	}
+	return nil
+}
+
+func initialisePumps() {
+	Pumps = loadPumps(SystemConfig.Pumps)
+
 	if len(Pumps) == 0 {
 		log.WithFields(logrus.Fields{
 			"prefix": mainPrefix,
 		}).Fatal("No pumps configured")
 	}
+}
 
-	if !SystemConfig.DontPurgeUptimeData {
-		log.WithFields(logrus.Fields{
-			"prefix": mainPrefix,
-		}).Info("'dont_purge_uptime_data' set to false, attempting to start Uptime pump! ", UptimePump.GetName())
-		UptimePump = pumps.MongoPump{IsUptime: true}
-		UptimePump.Init(SystemConfig.UptimePumpConfig)
+// loadPumps initialises the pumps of the configurations, skipping the ones which fail to initialise
+func loadPumps(configs map[string]PumpConfig) []pumps.Pump {
+	loaded := []pumps.Pump{}
+
+	for key, pmp := range configs {
+		if !pmp.IsEnabled() {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Info("Pump ", key, " is disabled (skipping)")
+			continue
+		}
+		for pumpKey, pumpConf := range withOrgOverrides(key, pmp) {
+			if pumpKey != key {
+				if err := checkOrgOverride(pumpKey, pmp, pumpConf); err != nil {
+					log.WithFields(logrus.Fields{
+						"prefix": mainPrefix,
+					}).Error(err)
+					continue
+				}
+			}
+			thisPmp, err := initialisePump(pumpKey, pumpConf)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"prefix": mainPrefix,
+				}).Error(err)
+				continue
+			}
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Info("Init Pump: ", pumpKey)
+			pumpKeys[thisPmp] = key
+			loaded = append(loaded, thisPmp)
+		}
+	}
+	return loaded
+}
+
+// initialiseUptimePump initialises the pumps the uptime data is written to, unless purging it is disabled: the Mongo
+// uptime pump and the ones of uptime_pumps, which can be of any type implementing pumps.UptimeWriter
+func initialiseUptimePump() {
+	if SystemConfig.DontPurgeUptimeData {
+		return
+	}
+
+	mongoPump := &pumps.MongoPump{IsUptime: true}
+	log.WithFields(logrus.Fields{
+		"prefix": mainPrefix,
+	}).Info("'dont_purge_uptime_data' set to false, attempting to start Uptime pump! ", mongoPump.GetName())
+	mongoPump.Init(SystemConfig.UptimePumpConfig)
+	UptimePumps = []pumps.UptimeWriter{mongoPump}
+	log.WithFields(logrus.Fields{
+		"prefix": mainPrefix,
+	}).Info("Init Uptime Pump: ", mongoPump.GetName())
+
+	for key, pmp := range SystemConfig.UptimePumps {
+		if !pmp.IsEnabled() {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Info("Uptime pump ", key, " is disabled (skipping)")
+			continue
+		}
+		thisPmp, err := initialisePump(key, pmp)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Error(err)
+			continue
+		}
+
+		uptimePmp, ok := thisPmp.(pumps.UptimeWriter)
+		if !ok {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Errorf("Uptime pump %s can't write uptime data (skipping), use one of the types: %s",
+				key, strings.Join(pumps.GetUptimePumpNames(), ", "))
+			continue
+		}
+		UptimePumps = append(UptimePumps, uptimePmp)
 		log.WithFields(logrus.Fields{
 			"prefix": mainPrefix,
-		}).Info("Init Uptime Pump: ", UptimePump.GetName())
+		}).Info("Init Uptime Pump: ", key)
 	}
-
 }
 
-func StartPurgeLoop(secInterval int, chunkSize int64, expire time.Duration, omitDetails bool) {
-	for range time.Tick(time.Duration(secInterval) * time.Second) {
+// StartPurgeLoop purges the analytics store every secInterval seconds until ctx is done
+func StartPurgeLoop(ctx context.Context, secInterval int, chunkSize int64, expire time.Duration, omitDetails bool) {
+	ticker := time.NewTicker(time.Duration(secInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cfg := <-configReloads:
+			reloadConfig(cfg)
+			continue
+		case <-ticker.C:
+		}
+
 		job := instrument.NewJob("PumpRecordsPurge")
 		startTime := time.Now()
+		purgedRecords := 0
 
-		for i := -1; i < 10; i++ {
-			var analyticsKeyName string
-			if i == -1 {
-				//if it's the first iteration, we look for tyk-system-analytics to maintain backwards compatibility or if analytics_config.enable_multiple_analytics_keys is disabled in the gateway
-				analyticsKeyName = storage.ANALYTICS_KEYNAME
-			} else {
-				analyticsKeyName = fmt.Sprintf("%v_%v", storage.ANALYTICS_KEYNAME, i)
-			}
+		for _, analyticsKeyName := range analyticsKeyNames() {
 			AnalyticsValues := AnalyticsStore.GetAndDeleteSet(analyticsKeyName, chunkSize, expire)
 			if len(AnalyticsValues) > 0 {
 				// Convert to something clean
-				keys := make([]interface{}, len(AnalyticsValues))
+				keys := decodeRecords(analyticsKeyName, AnalyticsValues, pumpsOmitDetails(omitDetails), job)
+				purgedRecords += len(keys)
 
-				for i, v := range AnalyticsValues {
-					decoded := analytics.AnalyticsRecord{}
-					err := msgpack.Unmarshal([]byte(v.(string)), &decoded)
-					log.WithFields(logrus.Fields{
-						"prefix": mainPrefix,
-					}).Debug("Decoded Record: ", decoded)
-					if err != nil {
-						log.WithFields(logrus.Fields{
-							"prefix":       mainPrefix,
-							"analytic_key": analyticsKeyName,
-						}).Error("Couldn't unmarshal analytics data:", err)
-					} else {
-						if omitDetails {
-							decoded.RawRequest = ""
-							decoded.RawResponse = ""
-						}
-						keys[i] = interface{}(decoded)
-						job.Event("record")
-					}
-				}
 				// Send to pumps
-				writeToPumps(keys, job, startTime, int(secInterval))
+				for _, batch := range splitBatch(keys, SystemConfig.MaxBatchSizeBytes) {
+					writeToPumps(batch, job, startTime, int(secInterval))
+				}
 			}
 		}
 
 		job.Timing("purge_time_all", time.Since(startTime).Nanoseconds())
+		lastPurge = purgeStats{Time: startTime, Records: purgedRecords, Duration: time.Since(startTime)}
+
+		if backlogStore != nil {
+			publishBacklog(SystemConfig.Backlog, job, secInterval)
+		}
+
+		if heartbeatDue(SystemConfig.Heartbeat, time.Now()) {
+			sendHeartbeat(SystemConfig.Heartbeat, job, int(secInterval))
+		}
 
 		if !SystemConfig.DontPurgeUptimeData {
 			UptimeValues := UptimeStorage.GetAndDeleteSet(storage.UptimeAnalytics_KEYNAME, chunkSize, expire)
-			UptimePump.WriteUptimeData(UptimeValues)
+			for _, uptimePump := range UptimePumps {
+				uptimePump.WriteUptimeData(UptimeValues)
+			}
+		}
+	}
+}
+
+// closePump writes the records buffered by the pump, then closes it
+func closePump(pmp pumps.Pump) {
+	pumpLog := pmp.GetLogger().WithField("pump", pumpName(pmp))
+	if err := pmp.Flush(); err != nil {
+		pumpLog.Error("Couldn't flush the buffered records: ", err)
+	}
+	if err := pmp.Close(); err != nil {
+		pumpLog.Error("Couldn't close the pump: ", err)
+	}
+}
+
+// flushPumps writes the records buffered by the pumps and the uptime pumps, and closes them, before Tyk Pump stops
+func flushPumps() {
+	flushed := map[interface{}]bool{}
+	flush := func(pmp pumps.Pump) {
+		if flushed[pmp] {
+			return
+		}
+		flushed[pmp] = true
+		closePump(pmp)
+	}
+
+	for _, pmp := range Pumps {
+		flush(pmp)
+	}
+	for _, uptimePump := range UptimePumps {
+		if pmp, ok := uptimePump.(pumps.Pump); ok {
+			flush(pmp)
 		}
 	}
 }
 
+// analyticsKeyNames returns the redis keys the gateway writes analytics records to
+func analyticsKeyNames() []string {
+	//we look for tyk-system-analytics first to maintain backwards compatibility or if analytics_config.enable_multiple_analytics_keys is disabled in the gateway
+	keyNames := []string{storage.ANALYTICS_KEYNAME}
+	for i := 0; i < 10; i++ {
+		keyNames = append(keyNames, fmt.Sprintf("%v_%v", storage.ANALYTICS_KEYNAME, i))
+	}
+	return keyNames
+}
+
+// decodeRecords unmarshals the raw analytics values read from analyticsKeyName, skipping the ones that can't be decoded
+func decodeRecords(analyticsKeyName string, values []interface{}, omitDetails bool, job *health.Job) []interface{} {
+	keys := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		decoded := analytics.AnalyticsRecord{}
+		err := msgpack.Unmarshal([]byte(v.(string)), &decoded)
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Debug("Decoded Record: ", decoded)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix":       mainPrefix,
+				"analytic_key": analyticsKeyName,
+			}).Error("Couldn't unmarshal analytics data:", err)
+			continue
+		}
+
+		prepareRecord(&decoded, omitDetails)
+		if isDuplicate(&decoded) {
+			log.WithFields(logrus.Fields{
+				"prefix": mainPrefix,
+			}).Debug("Skipped duplicated record: ", decoded.Hash())
+			continue
+		}
+		detectAnomalies(&decoded)
+		keys = append(keys, interface{}(decoded))
+		if job != nil {
+			job.Event("record")
+		}
+	}
+	return keys
+}
+
+// pumpsOmitDetails returns whether the raw request and response of the records can be dropped as soon as they're
+// decoded, which they can when omitDetails, the global omit_detailed_recording, is set and every pump omits them.
+// Otherwise, the pumps omitting them drop them when they write the records.
+func pumpsOmitDetails(omitDetails bool) bool {
+	if !omitDetails {
+		return false
+	}
+	for _, pmp := range Pumps {
+		if !pmp.GetOmitDetailedRecording() {
+			return false
+		}
+	}
+	return true
+}
+
+// prepareRecord applies to a decoded record the changes configured for all the pumps
+func prepareRecord(record *analytics.AnalyticsRecord, omitDetails bool) {
+	// the sizes, the gRPC method and status, the error class, the trace, the correlation ID, the response headers, the
+	// body fields and the GraphQL operation are taken from the raw request and response before they are omitted,
+	// which are parsed once for all of them
+	raw := analytics.NewRawRecord(record)
+	record.SetContentLengths(raw)
+	SystemConfig.GRPC.Enrich(record, raw)
+	record.ErrorClass = record.ClassifyError(raw)
+	SystemConfig.TraceContext.Extract(record, raw)
+	SystemConfig.CorrelationID.Extract(record, raw)
+	SystemConfig.ResponseHeaders.Capture(record, raw)
+	if bodyFieldExtractor != nil {
+		bodyFieldExtractor.Extract(record, raw)
+	}
+	SystemConfig.GraphQL.Enrich(record, raw)
+	if dashboardClient != nil {
+		dashboardClient.Enrich(record)
+	}
+	// the bodies are cut once everything is taken from them
+	SystemConfig.BodyPolicies.Apply(record, raw)
+
+	if omitDetails {
+		record.RawRequest = ""
+		record.RawResponse = ""
+	}
+
+	if pathNormalizer != nil {
+		record.Path = pathNormalizer.Normalize(record.Path)
+	}
+
+	if SystemConfig.Retention.Enabled() {
+		SystemConfig.Retention.Apply(record)
+	}
+}
+
+// recordSizeOverhead is the estimated size of the fields of a record other than its raw request and response
+const recordSizeOverhead = 1024
+
+// recordSize estimates the size of the record in memory, which is dominated by its raw request and response
+func recordSize(record *analytics.AnalyticsRecord) int64 {
+	return int64(len(record.RawRequest)+len(record.RawResponse)) + recordSizeOverhead
+}
+
+// splitBatch splits the records in batches of up to maxBytes, estimated by recordSize, so the pumps don't get huge
+// batches when the records have big bodies. A record bigger than maxBytes gets a batch of its own. A maxBytes of 0
+// keeps all the records in one batch.
+func splitBatch(keys []interface{}, maxBytes int64) [][]interface{} {
+	if maxBytes <= 0 {
+		return [][]interface{}{keys}
+	}
+
+	batches := [][]interface{}{}
+	batch := []interface{}{}
+	var batchBytes int64
+	for _, key := range keys {
+		size := int64(recordSizeOverhead)
+		if record, ok := key.(analytics.AnalyticsRecord); ok {
+			size = recordSize(&record)
+		}
+
+		if len(batch) > 0 && batchBytes+size > maxBytes {
+			batches = append(batches, batch)
+			batch = []interface{}{}
+			batchBytes = 0
+		}
+		batch = append(batch, key)
+		batchBytes += size
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// isDuplicate returns whether the record was already seen, when deduplication is enabled
+func isDuplicate(record *analytics.AnalyticsRecord) bool {
+	return deduplicator != nil && deduplicator.IsDuplicate(record, time.Now())
+}
+
 func writeToPumps(keys []interface{}, job *health.Job, startTime time.Time, purgeDelay int) {
 	// Send to pumps
 	if Pumps != nil {
-		var wg sync.WaitGroup
-		wg.Add(len(Pumps))
-		for _, pmp := range Pumps {
-			go execPumpWriting(&wg, pmp, &keys, purgeDelay, startTime, job)
+		// the batch id allows to correlate the logs of every pump writing the same records
+		batchID := uuid.NewV4().String()
+		log.WithFields(logrus.Fields{
+			"prefix":   mainPrefix,
+			"batch_id": batchID,
+			"records":  len(keys),
+		}).Debug("Sending records to pumps")
+
+		groups := pumpGroups(SystemConfig.PumpStages, Pumps)
+		for i, group := range groups {
+			if writeToPumpGroup(group.pumps, keys, job, startTime, purgeDelay, batchID) || !group.abort {
+				continue
+			}
+
+			// the pumps of the next stages don't write the batch the source of truth failed to write
+			log.WithFields(logrus.Fields{
+				"prefix":   mainPrefix,
+				"batch_id": batchID,
+				"records":  len(keys),
+			}).Errorf("A pump of stage %d failed to write the records, the next stages are aborted", i+1)
+			for _, next := range groups[i+1:] {
+				for _, pmp := range next.pumps {
+					pmp.DropRecords(pumps.DroppedAborted, len(keys))
+				}
+			}
+			break
 		}
-		wg.Wait()
 	} else {
 		log.WithFields(logrus.Fields{
 			"prefix": mainPrefix,
@@ -236,15 +690,54 @@ func writeToPumps(keys []interface{}, job *health.Job, startTime time.Time, purg
 	}
 }
 
+// writeToPumpGroup writes the records with the pumps in parallel, returning whether all of them wrote them
+func writeToPumpGroup(group []pumps.Pump, keys []interface{}, job *health.Job, startTime time.Time, purgeDelay int, batchID string) bool {
+	var wg sync.WaitGroup
+	var failed int32
+	wg.Add(len(group))
+	for _, pmp := range group {
+		go func(pmp pumps.Pump) {
+			defer wg.Done()
+			if !execPumpWriting(pmp, &keys, purgeDelay, startTime, job, batchID) {
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(pmp)
+	}
+	wg.Wait()
+	return failed == 0
+}
+
+// dropStaleRecords returns the records which aren't older than the max_record_age of the pump filters at now, counting
+// the rest as dropped by the pump
+func dropStaleRecords(pmp pumps.Pump, keys []interface{}, now time.Time) []interface{} {
+	filters := pmp.GetFilters()
+	if filters.MaxRecordAge <= 0 || ignoreRecordAge {
+		return keys
+	}
+
+	fresh := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		if record, ok := key.(analytics.AnalyticsRecord); ok && filters.IsStale(record, now) {
+			continue
+		}
+		fresh = append(fresh, key)
+	}
+	pmp.DropRecords(pumps.DroppedStale, len(keys)-len(fresh))
+	return fresh
+}
+
+// filterData returns the records the pump writes, a copy of keys when any of them is filtered or modified, as the same
+// records are written by the rest of pumps
 func filterData(pump pumps.Pump, keys []interface{}) []interface{} {
 	filters := pump.GetFilters()
-	if !filters.HasFilter() && !pump.GetOmitDetailedRecording() {
+	fields := pump.GetFieldSelection()
+	if !filters.HasFilter() && !pump.GetOmitDetailedRecording() && !fields.IsSet() {
 		return keys
 	}
-	filteredKeys := keys[:]
+	filteredKeys := make([]interface{}, len(keys))
 	newLenght := 0
 
-	for _, key := range filteredKeys {
+	for _, key := range keys {
 		decoded := key.(analytics.AnalyticsRecord)
 		if pump.GetOmitDetailedRecording() {
 			decoded.RawRequest = ""
@@ -253,6 +746,9 @@ func filterData(pump pumps.Pump, keys []interface{}) []interface{} {
 		if filters.ShouldFilter(decoded) {
 			continue
 		}
+		if fields.IsSet() {
+			fields.Apply(&decoded)
+		}
 		filteredKeys[newLenght] = decoded
 		newLenght++
 	}
@@ -260,26 +756,33 @@ func filterData(pump pumps.Pump, keys []interface{}) []interface{} {
 	return filteredKeys
 }
 
-func execPumpWriting(wg *sync.WaitGroup, pmp pumps.Pump, keys *[]interface{}, purgeDelay int, startTime time.Time, job *health.Job) {
+// writeResult is the result of writing a batch with a pump, with the records it failed to write
+type writeResult struct {
+	records int
+	failed  []interface{}
+	err     error
+}
+
+// execPumpWriting writes the records with the pump, returning whether it wrote all of them before its timeout
+func execPumpWriting(pmp pumps.Pump, keys *[]interface{}, purgeDelay int, startTime time.Time, job *health.Job, batchID string) bool {
+	// the pump logger follows the log_level of the pump
+	pumpLog := pmp.GetLogger().WithFields(logrus.Fields{
+		"pump":     pumpName(pmp),
+		"batch_id": batchID,
+	})
+
 	timer := time.AfterFunc(time.Duration(purgeDelay)*time.Second, func() {
 		if pmp.GetTimeout() == 0 {
-			log.WithFields(logrus.Fields{
-				"prefix": mainPrefix,
-			}).Warning("Pump  ", pmp.GetName(), " is taking more time than the value configured of purge_delay. You should try to set a timeout for this pump.")
+			pumpLog.Warning("Pump  ", pmp.GetName(), " is taking more time than the value configured of purge_delay. You should try to set a timeout for this pump.")
 		} else if pmp.GetTimeout() > purgeDelay {
-			log.WithFields(logrus.Fields{
-				"prefix": mainPrefix,
-			}).Warning("Pump  ", pmp.GetName(), " is taking more time than the value configured of purge_delay. You should try lowering the timeout configured for this pump.")
+			pumpLog.Warning("Pump  ", pmp.GetName(), " is taking more time than the value configured of purge_delay. You should try lowering the timeout configured for this pump.")
 		}
 	})
 	defer timer.Stop()
-	defer wg.Done()
 
-	log.WithFields(logrus.Fields{
-		"prefix": mainPrefix,
-	}).Debug("Writing to: ", pmp.GetName())
+	pumpLog.Debug("Writing to: ", pmp.GetName())
 
-	ch := make(chan error, 1)
+	ch := make(chan writeResult, 1)
 	//Load pump timeout
 	timeout := pmp.GetTimeout()
 	var ctx context.Context
@@ -293,44 +796,86 @@ func execPumpWriting(wg *sync.WaitGroup, pmp pumps.Pump, keys *[]interface{}, pu
 
 	defer cancel()
 
-	go func(ch chan error, ctx context.Context, pmp pumps.Pump, keys *[]interface{}) {
-		filteredKeys := filterData(pmp, *keys)
-
-		ch <- pmp.WriteData(ctx, filteredKeys)
+	go func(ch chan writeResult, ctx context.Context, pmp pumps.Pump, keys *[]interface{}) {
+		freshKeys := dropStaleRecords(pmp, *keys, time.Now())
+		filteredKeys := filterData(pmp, freshKeys)
+		pumpLog.WithFields(logrus.Fields{
+			"records":       len(filteredKeys),
+			"stale_records": len(*keys) - len(freshKeys),
+		}).Debug("Records left after filtering")
+		pmp.DropRecords(pumps.DroppedFiltered, len(freshKeys)-len(filteredKeys))
+
+		failed, err := pumps.WriteDataPartial(ctx, pmp, filteredKeys)
+		if reasons, ok := err.(pumps.DropReasons); ok {
+			for reason, n := range reasons.DropReasons() {
+				pmp.DropRecords(reason, n)
+			}
+		} else {
+			pmp.DropRecords(dropReason(err), len(failed))
+		}
+		ch <- writeResult{records: len(filteredKeys), failed: failed, err: err}
 	}(ch, ctx, pmp, keys)
 
+	written := false
 	select {
-	case err := <-ch:
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"prefix": mainPrefix,
-			}).Warning("Error Writing to: ", pmp.GetName(), " - Error:", err)
+	case result := <-ch:
+		written = result.err == nil
+		if result.err != nil {
+			pumpLog.WithFields(logrus.Fields{
+				"records":        result.records,
+				"failed_records": len(result.failed),
+			}).Warning("Error Writing to: ", pmp.GetName(), " - Error:", result.err)
 		}
 	case <-ctx.Done():
 		switch ctx.Err() {
 		case context.Canceled:
-			log.WithFields(logrus.Fields{
-				"prefix": mainPrefix,
-			}).Warning("The writing to ", pmp.GetName(), " have got canceled.")
+			pumpLog.Warning("The writing to ", pmp.GetName(), " have got canceled.")
 		case context.DeadlineExceeded:
-			log.WithFields(logrus.Fields{
-				"prefix": mainPrefix,
-			}).Warning("Timeout Writing to: ", pmp.GetName())
+			pumpLog.Warning("Timeout Writing to: ", pmp.GetName())
 		}
 	}
 	if job != nil {
-		job.Timing("purge_time_"+pmp.GetName(), time.Since(startTime).Nanoseconds())
+		job.Timing("purge_time_"+pumpName(pmp), time.Since(startTime).Nanoseconds())
+		for reason, count := range pmp.GetDroppedRecords() {
+			job.Gauge("dropped_records_"+pumpName(pmp)+"."+reason, float64(count))
+		}
 	}
+	return written
+}
+
+// dropReason returns the reason the records a pump failed to write with err are dropped for
+func dropReason(err error) string {
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return pumps.DroppedTimeout
+	}
+	return pumps.DroppedRejected
 }
 
 func main() {
 	Init()
+
+	switch command {
+	case migrateCmd.FullCommand():
+		runMigration()
+		return
+	case replayCmd.FullCommand():
+		ignoreRecordAge = true
+		initialisePumps()
+		runReplay()
+		return
+	case benchCmd.FullCommand():
+		runBench()
+		return
+	}
+
 	SetupInstrumentation()
 	go server.ServeHealthCheck(SystemConfig.HealthCheckEndpointName, SystemConfig.HealthCheckEndpointPort)
 
 	// Store version which will be read by dashboard and sent to
 	// vclu(version check and licecnse utilisation) service
-	storeVersion()
+	if !*dryRun {
+		storeVersion()
+	}
 
 	// Create the store
 	setupAnalyticsStore()
@@ -338,11 +883,30 @@ func main() {
 	// prime the pumps
 	initialisePumps()
 
+	if *dryRun {
+		log.Warning("DRY RUN: RECORDS WILL NOT BE WRITTEN NOR REMOVED FROM THE ANALYTICS STORE...")
+		// the records aren't written, so they don't feed the anomaly detection nor alert
+		anomalyDetector = nil
+		dryRunPurge(SystemConfig.PurgeChunk, pumpsOmitDetails(SystemConfig.OmitDetailedRecording), *dryRunSamples)
+		return
+	}
+
 	if *demoMode != "" {
 		log.Warning("BUILDING DEMO DATA AND EXITING...")
-		log.Warning("Starting from date: ", time.Now().AddDate(0, 0, -30))
-		demo.DemoInit(*demoMode, *demoApiMode, *demoApiVersionMode)
-		demo.GenerateDemoData(time.Now().AddDate(0, 0, -30), 30, *demoMode, writeToPumps)
+		ignoreRecordAge = true
+		start := time.Now().AddDate(0, 0, -*demoDays)
+		log.Warning("Starting from date: ", start)
+		demo.DemoInit(*demoMode, *demoApiMode, *demoApiVersionMode, demo.Profile{
+			Orgs:              *demoOrgs,
+			APIs:              *demoApis,
+			RecordsPerDay:     *demoRecordsPerDay,
+			Traffic:           *demoTraffic,
+			LatencyMedian:     *demoLatency,
+			ErrorRate:         *demoErrorRate,
+			DetailedRecording: *demoDetailed,
+			GraphQLRate:       *demoGraphQLRate,
+		})
+		demo.GenerateDemoData(start, *demoDays+*demoFutureDays, writeToPumps)
 
 		return
 	}
@@ -355,10 +919,36 @@ func main() {
 		}
 	}
 
+	initialiseUptimePump()
+
+	if SystemConfig.Backlog.Enabled {
+		setupBacklogStore()
+	}
+
 	// start the worker loop
 	log.WithFields(logrus.Fields{
 		"prefix": mainPrefix,
 	}).Infof("Starting purge loop @%d, chunk size %d", SystemConfig.PurgeDelay, SystemConfig.PurgeChunk)
 
-	StartPurgeLoop(SystemConfig.PurgeDelay, SystemConfig.PurgeChunk, time.Duration(SystemConfig.StorageExpirationTime)*time.Second, SystemConfig.OmitDetailedRecording)
+	ctx, stop := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.WithFields(logrus.Fields{
+			"prefix": mainPrefix,
+		}).Info("Received ", sig, ", stopping after the current purge")
+		stop()
+	}()
+
+	if SystemConfig.ConfigPollInterval > 0 {
+		go watchConfig(ctx, *conf, time.Duration(SystemConfig.ConfigPollInterval)*time.Second, configReloads)
+	}
+
+	StartPurgeLoop(ctx, SystemConfig.PurgeDelay, SystemConfig.PurgeChunk, time.Duration(SystemConfig.StorageExpirationTime)*time.Second, SystemConfig.OmitDetailedRecording)
+
+	flushPumps()
+	log.WithFields(logrus.Fields{
+		"prefix": mainPrefix,
+	}).Info("Stopped")
 }
@@ -2,12 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
 	"github.com/TykTechnologies/tyk-pump/pumps"
+	msgpack "gopkg.in/vmihailenco/msgpack.v2"
 )
 
 type MockedPump struct {
@@ -50,6 +56,9 @@ func TestFilterData(t *testing.T) {
 	if len(keys) == len(filteredKeys) {
 		t.Fatal("keys and filtered keys have the  same lenght")
 	}
+	if keys[0].(analytics.AnalyticsRecord).APIID != "api111" {
+		t.Fatal("the keys written by the rest of pumps shouldn't be modified")
+	}
 
 }
 
@@ -116,4 +125,579 @@ func TestWriteDataWithFilters(t *testing.T) {
 		fmt.Println(mockedPump.CounterRequest)
 		t.Fatal("MockedPump with filter should have 3 requests")
 	}
+	if dropped := mockedPump.GetDroppedRecords()[pumps.DroppedFiltered]; dropped != 2 {
+		t.Fatalf("expected 2 records dropped by the filter, got %d", dropped)
+	}
+}
+
+func TestPumpsOmitDetails(t *testing.T) {
+	defer func(pmps []pumps.Pump) { Pumps = pmps }(Pumps)
+
+	keep := false
+	omitting, keeping := &MockedPump{}, &MockedPump{}
+	omitting.SetOmitDetailedRecording(PumpConfig{}.OmitsDetailedRecording(true))
+	keeping.SetOmitDetailedRecording(PumpConfig{OmitDetailedRecording: &keep}.OmitsDetailedRecording(true))
+
+	Pumps = []pumps.Pump{omitting}
+	if !pumpsOmitDetails(true) || pumpsOmitDetails(false) {
+		t.Error("expected the details to be dropped on decoding when every pump omits them")
+	}
+	Pumps = []pumps.Pump{omitting, keeping}
+	if pumpsOmitDetails(true) {
+		t.Error("expected the details to be kept on decoding for the pump keeping them")
+	}
+}
+
+func TestDropStaleRecords(t *testing.T) {
+	mockedPump := &MockedPump{}
+	mockedPump.SetFilters(analytics.AnalyticsFilters{MaxRecordAge: 3600})
+
+	now := time.Now()
+	keys := []interface{}{
+		analytics.AnalyticsRecord{APIID: "api111", TimeStamp: now.AddDate(0, 0, -7)},
+		analytics.AnalyticsRecord{APIID: "api123", TimeStamp: now.Add(-time.Minute)},
+	}
+	fresh := dropStaleRecords(mockedPump, keys, now)
+	if len(fresh) != 1 || fresh[0].(analytics.AnalyticsRecord).APIID != "api123" {
+		t.Fatal("expected only the record newer than max_record_age to be kept, got", fresh)
+	}
+	if dropped := mockedPump.GetDroppedRecords()[pumps.DroppedStale]; dropped != 1 {
+		t.Fatalf("expected 1 stale record dropped, got %d", dropped)
+	}
+
+	ignoreRecordAge = true
+	defer func() { ignoreRecordAge = false }()
+	if len(dropStaleRecords(mockedPump, keys, now)) != 2 {
+		t.Fatal("expected the stale records to be kept when the record age is ignored")
+	}
+}
+
+func TestDropReason(t *testing.T) {
+	if reason := dropReason(context.DeadlineExceeded); reason != pumps.DroppedTimeout {
+		t.Errorf("expected the records of a timed out write to be dropped for %s, got %s", pumps.DroppedTimeout, reason)
+	}
+	if reason := dropReason(errors.New("rejected")); reason != pumps.DroppedRejected {
+		t.Errorf("expected the records of a failed write to be dropped for %s, got %s", pumps.DroppedRejected, reason)
+	}
+}
+
+// flushingPump counts the flushes of its buffer, and writes uptime data
+type flushingPump struct {
+	MockedPump
+	flushes int
+	closes  int
+}
+
+func (p *flushingPump) Flush() error {
+	p.flushes++
+	return nil
+}
+
+func (p *flushingPump) Close() error {
+	p.closes++
+	return nil
+}
+
+func (p *flushingPump) WriteUptimeData(data []interface{}) {}
+
+func TestFlushPumps(t *testing.T) {
+	defer func(pmps []pumps.Pump, uptimePmps []pumps.UptimeWriter) { Pumps, UptimePumps = pmps, uptimePmps }(Pumps, UptimePumps)
+
+	buffered, uptime := &flushingPump{}, &flushingPump{}
+	Pumps = []pumps.Pump{&MockedPump{}, buffered}
+	UptimePumps = []pumps.UptimeWriter{buffered, uptime}
+
+	flushPumps()
+	if buffered.flushes != 1 || uptime.flushes != 1 {
+		t.Errorf("expected every pump to be flushed once, got %d and %d flushes", buffered.flushes, uptime.flushes)
+	}
+	if buffered.closes != 1 || uptime.closes != 1 {
+		t.Errorf("expected every pump to be closed once, got %d and %d closes", buffered.closes, uptime.closes)
+	}
+}
+
+type failingPump struct {
+	MockedPump
+}
+
+func (p *failingPump) WriteData(ctx context.Context, keys []interface{}) error {
+	return errors.New("backend down")
+}
+
+func TestPumpStages(t *testing.T) {
+	defer func(pmps []pumps.Pump, stages []PumpStage) { Pumps, SystemConfig.PumpStages = pmps, stages }(Pumps, SystemConfig.PumpStages)
+
+	keys := []interface{}{analytics.AnalyticsRecord{APIID: "api111"}, analytics.AnalyticsRecord{APIID: "api123"}}
+	for _, onFailure := range []string{stageAbort, stageContinue} {
+		source, saas, unstaged := &failingPump{}, &MockedPump{}, &MockedPump{}
+		pumpKeys[source], pumpKeys[saas] = "kafka", "splunk"
+		Pumps = []pumps.Pump{unstaged, saas, source}
+		SystemConfig.PumpStages = []PumpStage{{Pumps: []string{"kafka"}, OnFailure: onFailure}, {Pumps: []string{"splunk"}}}
+
+		writeToPumps(keys, nil, time.Now(), 2)
+
+		written := 2
+		if onFailure == stageAbort {
+			written = 0
+		}
+		if saas.CounterRequest != written || unstaged.CounterRequest != written {
+			t.Errorf("expected the next stages to write %d records with %s, got %d and %d", written, onFailure, saas.CounterRequest, unstaged.CounterRequest)
+		}
+		if dropped := saas.GetDroppedRecords()[pumps.DroppedAborted]; dropped != int64(2-written) {
+			t.Errorf("expected %d records to be dropped by the aborted stage with %s, got %d", 2-written, onFailure, dropped)
+		}
+		delete(pumpKeys, source)
+		delete(pumpKeys, saas)
+	}
+
+	if err := validatePumpStages([]PumpStage{{Pumps: []string{"kafka"}, OnFailure: "retry"}}, map[string]PumpConfig{"kafka": {}}); err == nil {
+		t.Error("expected an invalid on_failure to fail")
+	}
+	if err := validatePumpStages([]PumpStage{{Pumps: []string{"kafka"}}, {Pumps: []string{"kafka"}}}, map[string]PumpConfig{"kafka": {}}); err == nil {
+		t.Error("expected a pump in several stages to fail")
+	}
+}
+
+func TestDecodeRecords(t *testing.T) {
+	encoded, err := msgpack.Marshal(analytics.AnalyticsRecord{APIID: "api111", RawRequest: "test", RawResponse: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := []interface{}{string(encoded), "not a record"}
+	keys := decodeRecords("test-key", values, true, nil)
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 decoded record, got %d", len(keys))
+	}
+
+	record := keys[0].(analytics.AnalyticsRecord)
+	if record.APIID != "api111" {
+		t.Fatal("expected api_id api111, got", record.APIID)
+	}
+	if record.RawRequest != "" || record.RawResponse != "" {
+		t.Fatal("raw_request and raw_response should be empty")
+	}
+}
+
+func TestDecodeRecordsDedup(t *testing.T) {
+	deduplicator = analytics.NewDeduplicator(analytics.DedupConfig{Enabled: true})
+	defer func() { deduplicator = nil }()
+
+	encoded, err := msgpack.Marshal(analytics.AnalyticsRecord{APIID: "api111", TimeStamp: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := []interface{}{string(encoded), string(encoded)}
+	if keys := decodeRecords("test-key", values, true, nil); len(keys) != 1 {
+		t.Fatalf("expected the duplicated record to be skipped, got %d records", len(keys))
+	}
+	if keys := decodeRecords("test-key", values[:1], true, nil); len(keys) != 0 {
+		t.Fatalf("expected the record purged again to be skipped, got %d records", len(keys))
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	conf := HeartbeatConfig{Enabled: true, Interval: 30, OrgID: "org1"}
+	now := time.Now()
+
+	lastHeartbeat = now.Add(-10 * time.Second)
+	if heartbeatDue(conf, now) {
+		t.Fatal("heartbeat shouldn't be due before the interval")
+	}
+	lastHeartbeat = now.Add(-30 * time.Second)
+	if !heartbeatDue(conf, now) {
+		t.Fatal("heartbeat should be due after the interval")
+	}
+	if heartbeatDue(HeartbeatConfig{}, now) {
+		t.Fatal("heartbeat shouldn't be due when disabled")
+	}
+
+	record := heartbeatRecord(conf, now, purgeStats{Time: now, Records: 42, Duration: time.Second})
+	if record.APIID != defaultHeartbeatAPIID || record.OrgID != "org1" {
+		t.Fatal("unexpected heartbeat api or org:", record.APIID, record.OrgID)
+	}
+	if !record.TimeStamp.Equal(now) {
+		t.Fatal("heartbeat timestamp should be the time it was sent")
+	}
+
+	found := false
+	for _, tag := range record.Tags {
+		if tag == "last_purge_records:42" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("heartbeat tags should contain the last purge records, got", record.Tags)
+	}
+}
+
+func TestParseMigrationDate(t *testing.T) {
+	date, err := parseMigrationDate("2021-03-01")
+	if err != nil || !date.Equal(time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatal("unexpected date:", date, err)
+	}
+
+	date, err = parseMigrationDate("2021-03-01T10:30:00Z")
+	if err != nil || !date.Equal(time.Date(2021, 3, 1, 10, 30, 0, 0, time.UTC)) {
+		t.Fatal("unexpected date:", date, err)
+	}
+
+	date, err = parseMigrationDate("")
+	if err != nil || !date.IsZero() {
+		t.Fatal("expected the zero time for an empty date, got", date, err)
+	}
+
+	if _, err := parseMigrationDate("01/03/2021"); err == nil {
+		t.Fatal("expected an error for an invalid date")
+	}
+}
+
+func TestReplayRecords(t *testing.T) {
+	dump := `{"api_id":"api111","timestamp":"2021-03-01T10:00:00Z","raw_request":"test"}
+{"api_id":"api123","timestamp":"2021-03-01T10:00:01Z"}
+{"api_id":"api321","timestamp":"2021-03-01T10:00:02Z"}
+`
+	batches := [][]interface{}{}
+	replayed, err := replayRecords(newRecordDecoder(strings.NewReader(dump), "json"), 2, 0, true, func(batch []interface{}) {
+		batches = append(batches, batch)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 3 || len(batches) != 2 {
+		t.Fatalf("expected 3 records in 2 batches, got %d records in %d batches", replayed, len(batches))
+	}
+
+	record := batches[0][0].(analytics.AnalyticsRecord)
+	if !record.TimeStamp.Equal(time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Fatal("the original timestamp should be kept, got", record.TimeStamp)
+	}
+	if record.RawRequest != "" {
+		t.Fatal("raw_request should be empty")
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	body := strings.Repeat("a", 2048)
+	keys := []interface{}{
+		analytics.AnalyticsRecord{APIID: "api111"},
+		analytics.AnalyticsRecord{APIID: "api123", RawRequest: body},
+		analytics.AnalyticsRecord{APIID: "api321"},
+		analytics.AnalyticsRecord{APIID: "api456"},
+	}
+
+	if batches := splitBatch(keys, 0); len(batches) != 1 || len(batches[0]) != 4 {
+		t.Fatalf("expected a single batch without a limit, got %v", batches)
+	}
+
+	batches := splitBatch(keys, 2048)
+	if len(batches) != 3 || len(batches[0]) != 1 || len(batches[1]) != 1 || len(batches[2]) != 2 {
+		t.Fatalf("expected the big record to get a batch of its own, got %v", batches)
+	}
+
+	dump := `{"api_id":"api111"}
+{"api_id":"api123"}
+{"api_id":"api321"}
+`
+	sizes := []int{}
+	replayed, err := replayRecords(newRecordDecoder(strings.NewReader(dump), "json"), 10, 2048, true, func(batch []interface{}) {
+		sizes = append(sizes, len(batch))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 3 || len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 1 {
+		t.Fatalf("expected the replayed batches to be limited to 2KB, got %v", sizes)
+	}
+}
+
+func TestWithOrgOverrides(t *testing.T) {
+	pmp := PumpConfig{
+		Filters: analytics.AnalyticsFilters{SkippedAPIIDs: []string{"internal"}},
+		Meta:    map[string]interface{}{"collector_url": "https://splunk:8088", "collector_token": "default"},
+		OrgOverrides: map[string]map[string]interface{}{
+			"org1": {"collector_token": "token1"},
+			"org2": {"collector_token": "token2"},
+		},
+	}
+
+	configs := withOrgOverrides("splunk", pmp)
+	if len(configs) != 3 {
+		t.Fatal("expected a pump per overridden org and the default one, got", len(configs))
+	}
+
+	base := configs["splunk"]
+	if base.Type != "splunk" || base.Meta["collector_token"] != "default" {
+		t.Error("unexpected default pump configuration", base)
+	}
+	for _, orgID := range []string{"org1", "org2"} {
+		if !base.Filters.ShouldFilter(analytics.AnalyticsRecord{OrgID: orgID}) {
+			t.Error("expected the default pump to skip the records of", orgID)
+		}
+	}
+
+	org1 := configs["splunk:org1"]
+	if org1.Type != "splunk" || org1.Meta["collector_token"] != "token1" || org1.Meta["collector_url"] != "https://splunk:8088" {
+		t.Error("unexpected org1 pump meta", org1.Meta)
+	}
+	if org1.Filters.ShouldFilter(analytics.AnalyticsRecord{OrgID: "org1"}) {
+		t.Error("expected the org1 pump to write the records of org1")
+	}
+	if !org1.Filters.ShouldFilter(analytics.AnalyticsRecord{OrgID: "org2"}) {
+		t.Error("expected the org1 pump to skip the records of org2")
+	}
+	if !org1.Filters.ShouldFilter(analytics.AnalyticsRecord{OrgID: "org1", APIID: "internal"}) {
+		t.Error("expected the org1 pump to keep the filters of the pump")
+	}
+	if pmp.Meta["collector_token"] != "default" {
+		t.Error("expected the pump configuration not to be modified")
+	}
+
+	if configs := withOrgOverrides("csv", PumpConfig{}); len(configs) != 1 || configs["csv"].Type != "" {
+		t.Error("expected a pump without org overrides to be kept as is, got", configs)
+	}
+}
+
+func TestLoadPumps(t *testing.T) {
+	disabled := false
+	loaded := loadPumps(map[string]PumpConfig{
+		"dummy":       {},
+		"dummy-eu":    {Type: "dummy"},
+		"dummy-us":    {Type: "dummy", Enabled: &disabled},
+		"unavailable": {Type: "unavailable"},
+	})
+	if len(loaded) != 2 {
+		t.Fatal("expected the enabled pumps to be loaded, got", len(loaded))
+	}
+
+	names := map[string]bool{}
+	for _, pmp := range loaded {
+		names[pumpName(pmp)] = true
+	}
+	if !names["Dummy Pump"] || !names["dummy-eu"] {
+		t.Error("expected the pump named after its key to be told apart from the one of its type, got", names)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer func(pmps []pumps.Pump, cfg TykPumpConfiguration) { Pumps, SystemConfig = pmps, cfg }(Pumps, SystemConfig)
+
+	SystemConfig.Pumps = map[string]PumpConfig{
+		"dummy":    {},
+		"dummy-eu": {Type: "dummy"},
+		"dummy-us": {Type: "dummy"},
+	}
+	Pumps = loadPumps(SystemConfig.Pumps)
+	current := map[string]pumps.Pump{}
+	for _, pmp := range Pumps {
+		current[pumpKeys[pmp]] = pmp
+	}
+
+	reloadConfig(TykPumpConfiguration{Pumps: map[string]PumpConfig{
+		"dummy":    {},
+		"dummy-eu": {Type: "dummy", Timeout: 5},
+		"dummy-ap": {Type: "dummy"},
+	}})
+	reloaded := map[string]pumps.Pump{}
+	for _, pmp := range Pumps {
+		reloaded[pumpKeys[pmp]] = pmp
+	}
+	if len(Pumps) != 3 || len(reloaded) != 3 {
+		t.Fatal("expected the pumps of the reloaded configuration to run, got", reloaded)
+	}
+	if reloaded["dummy"] != current["dummy"] {
+		t.Error("expected the unchanged pump to keep running")
+	}
+	if reloaded["dummy-eu"] == nil || reloaded["dummy-eu"] == current["dummy-eu"] {
+		t.Error("expected the changed pump to be replaced")
+	}
+	if _, ok := pumpKeys[current["dummy-us"]]; ok || reloaded["dummy-ap"] == nil {
+		t.Error("expected the removed pump to be dropped and the added one to run")
+	}
+}
+
+type mockedStorage struct {
+	lengths map[string]int64
+	values  map[string][]interface{}
+}
+
+func (s *mockedStorage) Init(config interface{}) error { return nil }
+func (s *mockedStorage) GetName() string               { return "Mocked Storage" }
+func (s *mockedStorage) Connect() bool                 { return true }
+func (s *mockedStorage) GetAndDeleteSet(setName string, chunkSize int64, expire time.Duration) []interface{} {
+	return nil
+}
+func (s *mockedStorage) GetSet(setName string, chunkSize int64) []interface{} {
+	return s.values[setName]
+}
+func (s *mockedStorage) GetSetLength(setName string) int64 { return s.lengths[setName] }
+
+func TestMeasureBacklog(t *testing.T) {
+	now := time.Now()
+	oldest, err := msgpack.Marshal(analytics.AnalyticsRecord{TimeStamp: now.Add(-10 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &mockedStorage{
+		lengths: map[string]int64{
+			"tyk-system-analytics":   10,
+			"tyk-system-analytics_3": 5,
+			"other":                  100,
+		},
+		values: map[string][]interface{}{
+			"tyk-system-analytics_3": {string(oldest)},
+		},
+	}
+
+	stats := measureBacklog(store, now)
+	if stats.Depth != 15 || len(stats.Keys) != 2 {
+		t.Errorf("expected a backlog of the 15 records of the analytics keys, got %+v", stats)
+	}
+	if stats.MaxAge != 10*time.Minute || stats.Keys["tyk-system-analytics_3"].Age != 10*time.Minute {
+		t.Errorf("expected the age of the oldest record, got %+v", stats)
+	}
+
+	conf := BacklogConfig{WarningThreshold: 20, MaxAge: 300}
+	if warnings := backlogWarnings(conf, stats); len(warnings) != 1 || !strings.Contains(warnings[0], "10m0s old") {
+		t.Errorf("expected the age warning only, got %v", warnings)
+	}
+}
+
+func TestBacklogAlert(t *testing.T) {
+	received := make(chan backlogAlert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alert := backlogAlert{}
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Error(err)
+		}
+		received <- alert
+	}))
+	defer server.Close()
+
+	postBacklogAlert(server.URL, backlogAlert{Text: "falling behind", Backlog: 42})
+	if alert := <-received; alert.Text != "falling behind" || alert.Backlog != 42 {
+		t.Errorf("unexpected alert %+v", alert)
+	}
+
+	now := time.Now()
+	lastBacklogAlert = now.Add(-time.Minute)
+	defer func() { lastBacklogAlert = time.Time{} }()
+	if backlogAlertDue(BacklogConfig{}, now) {
+		t.Error("expected the alerts to be posted every 5 minutes by default")
+	}
+	if !backlogAlertDue(BacklogConfig{AlertInterval: 60}, now) {
+		t.Error("expected the alert to be due after its interval")
+	}
+}
+
+func TestBenchPumps(t *testing.T) {
+	mockedPump := &MockedPump{}
+	generated := 0
+	stats := benchPumps([]pumps.Pump{mockedPump}, 1000, 50, 200*time.Millisecond, func(count int) []interface{} {
+		generated += count
+		return make([]interface{}, count)
+	})
+
+	if generated < 200 || generated > 300 {
+		t.Errorf("expected around 200 records generated at 1000 records/s for 200ms, got %d", generated)
+	}
+	if stats[0].Offered+stats[0].Skipped != generated || stats[0].Batches*50 != stats[0].Offered {
+		t.Errorf("expected every batch generated to be offered or skipped, got %+v", stats[0])
+	}
+	if len(stats[0].Latencies) != stats[0].Batches || stats[0].Errors != 0 {
+		t.Errorf("expected a latency per batch and no errors, got %+v", stats[0])
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	latencies := []time.Duration{}
+	for i := 1; i <= 100; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	if p := percentile(latencies, 0.5); p != 50*time.Millisecond {
+		t.Errorf("expected a p50 of 50ms, got %s", p)
+	}
+	if p := percentile(latencies, 0.99); p != 99*time.Millisecond {
+		t.Errorf("expected a p99 of 99ms, got %s", p)
+	}
+	if p := percentile(latencies, 1); p != 100*time.Millisecond {
+		t.Errorf("expected the max to be 100ms, got %s", p)
+	}
+	if p := percentile(nil, 0.5); p != 0 {
+		t.Errorf("expected 0 without latencies, got %s", p)
+	}
+}
+
+func TestPostAnomalies(t *testing.T) {
+	var received []analytics.Anomaly
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	conf := analytics.AnomalyConfig{AlertURL: server.URL, AlertHeaders: map[string]string{"Authorization": "Bearer secret"}}
+	anomalies := []analytics.Anomaly{{APIID: "api1", Metric: analytics.AnomalyLatency, Value: 1000, Mean: 100}}
+	if err := postAnomalies(conf, anomalies); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0].APIID != "api1" || received[0].Metric != analytics.AnomalyLatency {
+		t.Errorf("unexpected alert %+v", received)
+	}
+
+	conf.AlertHeaders = nil
+	if err := postAnomalies(conf, anomalies); err == nil {
+		t.Error("expected the rejected alert to fail")
+	}
+}
+
+func TestLoadPumpsPrometheusOrgOverrides(t *testing.T) {
+	loaded := loadPumps(map[string]PumpConfig{
+		"prometheus": {
+			Meta:         map[string]interface{}{"mode": "push", "push_gateway_url": "http://localhost:9091"},
+			OrgOverrides: map[string]map[string]interface{}{"org1": {"push_job": "org1"}},
+		},
+	})
+	if len(loaded) != 2 {
+		t.Fatal("expected the org override to get its own prometheus pump, got", len(loaded))
+	}
+
+	base := PumpConfig{Meta: map[string]interface{}{"listen_address": "127.0.0.1:0"}}
+	org1 := PumpConfig{Type: "prometheus", Meta: map[string]interface{}{"listen_address": "127.0.0.1:0"}}
+	if err := checkOrgOverride("prometheus:org1", base, org1); err == nil {
+		t.Error("expected the org override listening on the same address to be rejected")
+	}
+	org1.Meta["listen_address"] = "127.0.0.1:9091"
+	if err := checkOrgOverride("prometheus:org1", base, org1); err != nil {
+		t.Error("expected the org override with its own address to be accepted, got", err)
+	}
+}
+
+func TestDryRunSample(t *testing.T) {
+	defer func(enabled bool) { *dryRun = enabled }(*dryRun)
+	*dryRun = true
+
+	csvPump, err := initialisePump("csv", PumpConfig{Meta: map[string]interface{}{"output_file": "stdout", "fields": []interface{}{"api_id"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !csvPump.GetDryRun() {
+		t.Error("expected the pump to be initialised for a dry run")
+	}
+
+	record := analytics.AnalyticsRecord{APIID: "api1"}
+	if sample, err := dryRunSample(csvPump, record); err != nil || string(sample) != "api1" {
+		t.Errorf("expected the CSV line of the record, got %q: %v", sample, err)
+	}
+
+	// the pumps without a preview print the record in JSON
+	expected, _ := json.Marshal(record)
+	if sample, err := dryRunSample(&MockedPump{}, record); err != nil || string(sample) != string(expected) {
+		t.Errorf("expected the JSON of the record, got %s: %v", sample, err)
+	}
 }
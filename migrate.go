@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-pump/pumps"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var migratePrefix = "migrate"
+
+var (
+	migrateCmd       = kingpin.Command("migrate", "read the analytics records stored by a pump and write them through another pump")
+	migrateFrom      = migrateCmd.Flag("from", "name of the configured pump to read the analytics records from").Required().String()
+	migrateTo        = migrateCmd.Flag("to", "name of the configured pump to write the analytics records to").Required().String()
+	migrateSince     = migrateCmd.Flag("since", "only migrate the records from this date, as YYYY-MM-DD or RFC3339").Default("").String()
+	migrateUntil     = migrateCmd.Flag("until", "only migrate the records before this date, as YYYY-MM-DD or RFC3339").Default("").String()
+	migrateBatchSize = migrateCmd.Flag("batch-size", "number of records written at a time").Default("1000").Int()
+)
+
+// runMigration copies the analytics records from the --from pump to the --to pump
+func runMigration() {
+	migrateLog := log.WithFields(logrus.Fields{
+		"prefix": migratePrefix,
+	})
+
+	since, err := parseMigrationDate(*migrateSince)
+	if err != nil {
+		migrateLog.Fatal("Invalid --since date: ", err)
+	}
+	until, err := parseMigrationDate(*migrateUntil)
+	if err != nil {
+		migrateLog.Fatal("Invalid --until date: ", err)
+	}
+	if *migrateBatchSize <= 0 {
+		migrateLog.Fatal("--batch-size must be greater than 0")
+	}
+
+	from, err := initialiseConfiguredPump(*migrateFrom)
+	if err != nil {
+		migrateLog.Fatal(err)
+	}
+	reader, ok := from.(pumps.AnalyticsReader)
+	if !ok {
+		migrateLog.Fatalf("%s can't be used as the source of a migration, it doesn't support reading analytics records", from.GetName())
+	}
+
+	to, err := initialiseConfiguredPump(*migrateTo)
+	if err != nil {
+		migrateLog.Fatal(err)
+	}
+
+	migrateLog.Infof("Migrating analytics records from %s to %s", from.GetName(), to.GetName())
+
+	migrated := 0
+	err = reader.ReadData(context.Background(), since, until, *migrateBatchSize, func(records []interface{}) error {
+		if err := writeMigrationBatch(to, records); err != nil {
+			return err
+		}
+		migrated += len(records)
+		migrateLog.Info("Migrated ", migrated, " records...")
+		return nil
+	})
+	if flushErr := to.Flush(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		migrateLog.Fatal("Migration failed after ", migrated, " records: ", err)
+	}
+
+	migrateLog.Info("Migration finished, ", migrated, " records migrated")
+}
+
+// initialiseConfiguredPump initialises the pump configured under the given name
+func initialiseConfiguredPump(name string) (pumps.Pump, error) {
+	pmp, ok := SystemConfig.Pumps[name]
+	if !ok {
+		return nil, fmt.Errorf("there's no pump named %s in the configuration", name)
+	}
+	return initialisePump(name, pmp)
+}
+
+// writeMigrationBatch writes the records through the pump, honouring its filters and timeout
+func writeMigrationBatch(pmp pumps.Pump, records []interface{}) error {
+	ctx := context.Background()
+	if timeout := pmp.GetTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+
+	return pmp.WriteData(ctx, filterData(pmp, records))
+}
+
+// parseMigrationDate parses a date given as YYYY-MM-DD or RFC3339, an empty date is the zero time
+func parseMigrationDate(date string) (time.Time, error) {
+	if date == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse("2006-01-02", date); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, date)
+}
@@ -0,0 +1,240 @@
+package pumps
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	awsIMDSURL               = "http://169.254.169.254"
+	awsContainerCredsURL     = "http://169.254.170.2"
+	awsCredentialsRefreshGap = 5 * time.Minute
+)
+
+// awsCredentialsProvider returns the credentials the AWS requests of a pump are signed with: the ones of its config or
+// of the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables when set, otherwise the temporary credentials
+// of its IAM role. The role is taken, in order, from the web identity token of the pod (IAM roles for service accounts),
+// from the container credentials endpoint (ECS tasks and EKS pod identity) or from the EC2 instance metadata, and its
+// credentials are refreshed before they expire.
+type awsCredentialsProvider struct {
+	static awsCredentials
+	client *http.Client
+	// imdsURL and stsURL replace the endpoints in the tests
+	imdsURL string
+	stsURL  string
+
+	mu         sync.Mutex
+	creds      awsCredentials
+	expiration time.Time
+}
+
+// awsRoleCredentials are the credentials of the container and instance metadata endpoints
+type awsRoleCredentials struct {
+	Code            string
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// awsWebIdentityResponse is the response of the STS AssumeRoleWithWebIdentity action
+type awsWebIdentityResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// newAWSCredentialsProvider returns the provider of the static credentials, exchanging the web identity token at the
+// STS endpoint of the region
+func newAWSCredentialsProvider(static awsCredentials, region string) *awsCredentialsProvider {
+	stsURL := "https://sts.amazonaws.com"
+	if region != "" {
+		stsURL = "https://sts." + region + ".amazonaws.com"
+	}
+	return &awsCredentialsProvider{
+		static:  static.withEnvDefaults(),
+		client:  &http.Client{Timeout: 5 * time.Second},
+		imdsURL: awsIMDSURL,
+		stsURL:  stsURL,
+	}
+}
+
+// get returns the credentials, fetching the ones of the IAM role when they aren't cached or are about to expire
+func (p *awsCredentialsProvider) get(ctx context.Context) (awsCredentials, error) {
+	if p.static.AccessKeyID != "" && p.static.SecretAccessKey != "" {
+		return p.static, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.creds.AccessKeyID != "" && time.Now().Before(p.expiration.Add(-awsCredentialsRefreshGap)) {
+		return p.creds, nil
+	}
+	creds, err := p.fetch(ctx)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("couldn't get the AWS credentials: %v", err)
+	}
+	p.creds = awsCredentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+	}
+	p.expiration = creds.Expiration
+	return p.creds, nil
+}
+
+// fetch returns the temporary credentials of the IAM role
+func (p *awsCredentialsProvider) fetch(ctx context.Context) (awsRoleCredentials, error) {
+	switch {
+	case os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "":
+		return p.webIdentity(ctx)
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "":
+		return p.container(ctx, os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"))
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "":
+		return p.container(ctx, awsContainerCredsURL+os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"))
+	case strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true"):
+		return awsRoleCredentials{}, errors.New("no credentials or IAM role found, and the instance metadata is disabled")
+	}
+	return p.instance(ctx)
+}
+
+// webIdentity exchanges the web identity token for the credentials of the role with the STS AssumeRoleWithWebIdentity
+// action, which isn't signed
+func (p *awsCredentialsProvider) webIdentity(ctx context.Context) (awsRoleCredentials, error) {
+	token, err := ioutil.ReadFile(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if err != nil {
+		return awsRoleCredentials{}, err
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "tyk-pump"
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {os.Getenv("AWS_ROLE_ARN")},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.stsURL+"/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsRoleCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := p.do(req)
+	if err != nil {
+		return awsRoleCredentials{}, err
+	}
+
+	resp := awsWebIdentityResponse{}
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return awsRoleCredentials{}, err
+	}
+	return awsRoleCredentials{
+		AccessKeyID:     resp.Credentials.AccessKeyID,
+		SecretAccessKey: resp.Credentials.SecretAccessKey,
+		Token:           resp.Credentials.SessionToken,
+		Expiration:      resp.Credentials.Expiration,
+	}, nil
+}
+
+// container returns the credentials of the container credentials endpoint, authenticated with the token of the
+// AWS_CONTAINER_AUTHORIZATION_TOKEN or AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE environment variables when set
+func (p *awsCredentialsProvider) container(ctx context.Context, endpoint string) (awsRoleCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return awsRoleCredentials{}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		content, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return awsRoleCredentials{}, err
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	body, err := p.do(req)
+	if err != nil {
+		return awsRoleCredentials{}, err
+	}
+	creds := awsRoleCredentials{}
+	return creds, json.Unmarshal(body, &creds)
+}
+
+// instance returns the credentials of the role of the EC2 instance profile, from the instance metadata with IMDSv2
+func (p *awsCredentialsProvider) instance(ctx context.Context) (awsRoleCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, p.imdsURL+"/latest/api/token", nil)
+	if err != nil {
+		return awsRoleCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := p.do(req)
+	if err != nil {
+		return awsRoleCredentials{}, fmt.Errorf("instance metadata: %v", err)
+	}
+
+	credentialsURL := p.imdsURL + "/latest/meta-data/iam/security-credentials/"
+	get := func(endpoint string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return p.do(req)
+	}
+	roles, err := get(credentialsURL)
+	if err != nil {
+		return awsRoleCredentials{}, fmt.Errorf("instance metadata: %v", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return awsRoleCredentials{}, errors.New("the instance has no IAM role")
+	}
+
+	body, err := get(credentialsURL + role)
+	if err != nil {
+		return awsRoleCredentials{}, fmt.Errorf("instance metadata: %v", err)
+	}
+	creds := awsRoleCredentials{}
+	if err := json.Unmarshal(body, &creds); err != nil {
+		return creds, err
+	}
+	if creds.Code != "" && creds.Code != "Success" {
+		return creds, fmt.Errorf("instance metadata returned %s for the role %s", creds.Code, role)
+	}
+	return creds, nil
+}
+
+// do sends the request to the credentials endpoint, returning the body of the response
+func (p *awsCredentialsProvider) do(req *http.Request) ([]byte, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with status %d: %s", req.URL.Host, resp.StatusCode, body)
+	}
+	return body, nil
+}
@@ -0,0 +1,120 @@
+package pumps
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAWSCredentialsInstance(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			w.Write([]byte("imds-token"))
+		case r.Header.Get("X-aws-ec2-metadata-token") != "imds-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			w.Write([]byte("pump-role"))
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/pump-role":
+			w.Write([]byte(`{"Code":"Success","AccessKeyId":"ASIA","SecretAccessKey":"secret","Token":"session",` +
+				`"Expiration":"` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	provider := newAWSCredentialsProvider(awsCredentials{}, "eu-west-1")
+	provider.imdsURL = server.URL
+	for i := 0; i < 2; i++ {
+		creds, err := provider.get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds != (awsCredentials{AccessKeyID: "ASIA", SecretAccessKey: "secret", SessionToken: "session"}) {
+			t.Errorf("unexpected credentials %+v", creds)
+		}
+	}
+	if requests != 3 {
+		t.Errorf("expected the credentials to be cached until they expire, got %d requests", requests)
+	}
+
+	static := newAWSCredentialsProvider(awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, "eu-west-1")
+	static.imdsURL = server.URL
+	if creds, err := static.get(context.Background()); err != nil || creds.AccessKeyID != "AKID" || requests != 3 {
+		t.Errorf("expected the static credentials, got %+v %v", creds, err)
+	}
+}
+
+func TestAWSCredentialsWebIdentity(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "jwt" ||
+			r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/pump" {
+			t.Errorf("unexpected STS request %v", r.Form)
+		}
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+			<AccessKeyId>ASIA</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>session</SessionToken>
+			<Expiration>2030-01-01T00:00:00Z</Expiration></Credentials></AssumeRoleWithWebIdentityResult>
+			</AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer server.Close()
+
+	tokenFile, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("jwt\n")
+	tokenFile.Close()
+
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile.Name())
+	os.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/pump")
+	defer os.Unsetenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	defer os.Unsetenv("AWS_ROLE_ARN")
+
+	provider := newAWSCredentialsProvider(awsCredentials{}, "eu-west-1")
+	provider.stsURL = server.URL
+	creds, err := provider.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds != (awsCredentials{AccessKeyID: "ASIA", SecretAccessKey: "secret", SessionToken: "session"}) {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+}
+
+func TestAWSSigV4Transport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != `{"query":{}}` {
+			t.Errorf("expected the body to be sent, got %s", body)
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/aoss/aws4_request") {
+			t.Errorf("unexpected authorization %s", auth)
+		}
+		if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+			t.Errorf("expected the payload hash, got %s", r.Header.Get("X-Amz-Content-Sha256"))
+		}
+	}))
+	defer server.Close()
+
+	transport := &awsSigV4Transport{
+		creds:   newAWSCredentialsProvider(awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, "eu-west-1"),
+		region:  "eu-west-1",
+		service: "aoss",
+	}
+	resp, err := (&http.Client{Transport: transport}).Post(server.URL+"/index/_search", "application/json", strings.NewReader(`{"query":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
@@ -1,6 +1,8 @@
 package pumps
 
 import (
+	"sync"
+
 	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-pump/analytics"
 )
@@ -10,6 +12,29 @@ type CommonPumpConfig struct {
 	timeout               int
 	OmitDetailedRecording bool
 	log                   *logrus.Entry
+	logLevel              *logrus.Level
+	instanceName          string
+	fieldSelection        analytics.FieldSelection
+	dropped               droppedRecords
+	dryRun                bool
+}
+
+// The reasons a pump drops records for
+const (
+	DroppedFiltered      = "filtered"
+	DroppedTooLarge      = "too_large"
+	DroppedSerialization = "serialization_error"
+	DroppedRejected      = "backend_rejection"
+	DroppedUnavailable   = "backend_unavailable"
+	DroppedTimeout       = "timeout"
+	DroppedAborted       = "stage_aborted"
+	DroppedStale         = "stale"
+)
+
+// droppedRecords counts the records dropped by a pump by reason
+type droppedRecords struct {
+	mu     sync.Mutex
+	counts map[string]int64
 }
 
 func (p *CommonPumpConfig) SetFilters(filters analytics.AnalyticsFilters) {
@@ -33,6 +58,104 @@ func (p *CommonPumpConfig) GetOmitDetailedRecording() bool {
 	return p.OmitDetailedRecording
 }
 
+// SetDryRun makes Init skip what changes the backend, like creating tables or indexes, or binds a port, as the records
+// are only previewed. It must be called before Init.
+func (p *CommonPumpConfig) SetDryRun(dryRun bool) {
+	p.dryRun = dryRun
+}
+func (p *CommonPumpConfig) GetDryRun() bool {
+	return p.dryRun
+}
+
 func (p *CommonPumpConfig) GetEnvPrefix() string {
 	return ""
 }
+
+// SetLogLevel sets the level of the pump logs, overriding the global log level. It must be called before Init.
+func (p *CommonPumpConfig) SetLogLevel(level logrus.Level) {
+	p.logLevel = &level
+}
+
+// GetLogger returns the entry the pump logs with, or a new one of its log level when the pump has none yet
+func (p *CommonPumpConfig) GetLogger() *logrus.Entry {
+	if p.log == nil {
+		return p.newLogger("pump")
+	}
+	return p.log
+}
+
+// SetFieldSelection sets the record fields the pump writes, the rest are cleared before the pump gets the records
+func (p *CommonPumpConfig) SetFieldSelection(fields analytics.FieldSelection) {
+	p.fieldSelection = fields
+}
+
+// GetFieldSelection returns the record fields the pump writes
+func (p *CommonPumpConfig) GetFieldSelection() analytics.FieldSelection {
+	return p.fieldSelection
+}
+
+// SetInstanceName sets the name of the pump instance, to tell it apart from the other pumps of its type. It must be
+// called before Init.
+func (p *CommonPumpConfig) SetInstanceName(name string) {
+	p.instanceName = name
+}
+
+// GetInstanceName returns the name of the pump instance, empty unless it was named
+func (p *CommonPumpConfig) GetInstanceName() string {
+	return p.instanceName
+}
+
+// newLogger returns the entry the pump logs with, using the pump log level if it has one, and with the name of the
+// pump instance in the instance field when it's named
+func (p *CommonPumpConfig) newLogger(prefix string) *logrus.Entry {
+	pumpLogger := log
+	if p.logLevel != nil {
+		pumpLogger = &logrus.Logger{
+			Out:       log.Out,
+			Formatter: log.Formatter,
+			Hooks:     log.Hooks,
+			Level:     *p.logLevel,
+		}
+	}
+
+	entry := pumpLogger.WithField("prefix", prefix)
+	if p.instanceName != "" {
+		entry = entry.WithField("instance", p.instanceName)
+	}
+	return entry
+}
+
+// Flush does nothing, for the pumps which don't buffer records
+func (p *CommonPumpConfig) Flush() error {
+	return nil
+}
+
+// Close does nothing, for the pumps which don't hold connections or goroutines
+func (p *CommonPumpConfig) Close() error {
+	return nil
+}
+
+// DropRecords counts n records as dropped by the pump for reason
+func (p *CommonPumpConfig) DropRecords(reason string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	p.dropped.mu.Lock()
+	defer p.dropped.mu.Unlock()
+	if p.dropped.counts == nil {
+		p.dropped.counts = map[string]int64{}
+	}
+	p.dropped.counts[reason] += int64(n)
+}
+
+// GetDroppedRecords returns the number of records dropped by the pump since it started, by reason
+func (p *CommonPumpConfig) GetDroppedRecords() map[string]int64 {
+	p.dropped.mu.Lock()
+	defer p.dropped.mu.Unlock()
+	counts := make(map[string]int64, len(p.dropped.counts))
+	for reason, count := range p.dropped.counts {
+		counts[reason] = count
+	}
+	return counts
+}
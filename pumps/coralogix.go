@@ -0,0 +1,230 @@
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	coralogixPrefix     = "coralogix-pump"
+	coralogixDefaultENV = PUMPS_ENV_PREFIX + "_CORALOGIX" + PUMPS_ENV_META_PREFIX
+
+	coralogixSinglesPath                = "/logs/v1/singles"
+	defaultCoralogixApplicationTemplate = "{{.OrgID}}"
+	defaultCoralogixSubsystemTemplate   = "{{.APIName}}"
+	defaultCoralogixBatchSize           = 1000
+	// defaultCoralogixMaxBatchBytes keeps the requests under the 2MB limit of the ingestion API
+	defaultCoralogixMaxBatchBytes = 2 * 1000 * 1000
+)
+
+// Coralogix severities
+const (
+	coralogixInfo    = 3
+	coralogixWarning = 4
+	coralogixError   = 5
+)
+
+// CoralogixPump sends the analytics records to the Coralogix REST ingestion API, as JSON logs with the record fields
+type CoralogixPump struct {
+	conf        *CoralogixConf
+	client      *http.Client
+	application *template.Template
+	subsystem   *template.Template
+	CommonPumpConfig
+}
+
+// CoralogixConf configures the Coralogix pump
+type CoralogixConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	// PrivateKey is the Send-Your-Data API key authenticating the requests
+	PrivateKey string `mapstructure:"private_key"`
+	// Domain is the Coralogix domain of the account, like eu2.coralogix.com
+	Domain string `mapstructure:"domain"`
+	// URL is the URL of the ingestion API, set instead of Domain to send the logs through a proxy
+	URL string `mapstructure:"url"`
+	// ApplicationName is the application name of the logs, as a text/template template executed on the record,
+	// {{.OrgID}} by default
+	ApplicationName string `mapstructure:"application_name"`
+	// SubsystemName is the subsystem name of the logs, as a text/template template executed on the record,
+	// {{.APIName}} by default
+	SubsystemName string `mapstructure:"subsystem_name"`
+	// ComputerName is the computer name of the logs, the hostname of the machine by default
+	ComputerName string `mapstructure:"computer_name"`
+	// BatchSize is the maximum number of logs of a request, 1000 by default
+	BatchSize int `mapstructure:"batch_size"`
+	// MaxBatchBytes is the maximum size of a request, 2MB by default
+	MaxBatchBytes int `mapstructure:"max_batch_bytes"`
+}
+
+// coralogixLog is a log of the ingestion API
+type coralogixLog struct {
+	ApplicationName string                     `json:"applicationName"`
+	SubsystemName   string                     `json:"subsystemName"`
+	ComputerName    string                     `json:"computerName,omitempty"`
+	Severity        int                        `json:"severity"`
+	Timestamp       int64                      `json:"timestamp"`
+	Text            *analytics.AnalyticsRecord `json:"text"`
+}
+
+func (c *CoralogixPump) New() Pump {
+	newPump := CoralogixPump{}
+	return &newPump
+}
+
+func (c *CoralogixPump) GetName() string {
+	return "Coralogix Pump"
+}
+
+func (c *CoralogixPump) GetEnvPrefix() string {
+	return c.conf.EnvPrefix
+}
+
+func (c *CoralogixPump) Init(config interface{}) error {
+	c.conf = &CoralogixConf{}
+	c.log = c.newLogger(coralogixPrefix)
+
+	if err := decodePumpConfig(c, c.log, config, &c.conf); err != nil {
+		c.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(c, c.log, c.conf, coralogixDefaultENV)
+
+	if c.conf.PrivateKey == "" {
+		return errors.New("private_key must be set")
+	}
+	if c.conf.URL == "" {
+		if c.conf.Domain == "" {
+			return errors.New("domain or url must be set")
+		}
+		c.conf.URL = "https://ingress." + c.conf.Domain + coralogixSinglesPath
+	}
+	if c.conf.ApplicationName == "" {
+		c.conf.ApplicationName = defaultCoralogixApplicationTemplate
+	}
+	if c.conf.SubsystemName == "" {
+		c.conf.SubsystemName = defaultCoralogixSubsystemTemplate
+	}
+
+	var err error
+	if c.application, err = template.New("application_name").Parse(c.conf.ApplicationName); err != nil {
+		return fmt.Errorf("invalid application_name template: %v", err)
+	}
+	if c.subsystem, err = template.New("subsystem_name").Parse(c.conf.SubsystemName); err != nil {
+		return fmt.Errorf("invalid subsystem_name template: %v", err)
+	}
+
+	if c.conf.ComputerName == "" {
+		c.conf.ComputerName, _ = os.Hostname()
+	}
+	if c.conf.BatchSize <= 0 {
+		c.conf.BatchSize = defaultCoralogixBatchSize
+	}
+	if c.conf.MaxBatchBytes <= 0 {
+		c.conf.MaxBatchBytes = defaultCoralogixMaxBatchBytes
+	}
+	c.client = &http.Client{Timeout: 60 * time.Second}
+
+	c.log.Info(c.GetName() + " Initialized")
+	return nil
+}
+
+func (c *CoralogixPump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := c.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial sends the records in batches, returning the records of the batches that failed and of the ones
+// left at the deadline
+func (c *CoralogixPump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
+	c.log.Debug("Attempting to write ", len(data), " records...")
+
+	batches, unencoded := ndjsonBatches(data, c.conf.BatchSize, c.conf.MaxBatchBytes, c.encode)
+	if len(unencoded) > 0 {
+		c.log.Error("Couldn't encode ", len(unencoded), " records, they will be dropped")
+		c.DropRecords(DroppedSerialization, len(unencoded))
+	}
+
+	failed := []interface{}{}
+	var lastErr error
+	for i, batch := range batches {
+		if err := ctx.Err(); err != nil {
+			return append(failed, ndjsonRecords(batches[i:])...), err
+		}
+
+		if err := c.send(ctx, ndjsonArray(batch.body)); err != nil {
+			c.log.WithField("records", len(batch.records)).Error("Failed to send the records: ", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return append(failed, ndjsonRecords(batches[i:])...), ctxErr
+			}
+			failed = append(failed, batch.records...)
+			lastErr = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("failed to write %d of %d records: %v", len(failed), len(data), lastErr)
+	}
+	c.log.Info("Purged ", len(data), " records...")
+	return nil, nil
+}
+
+// encode encodes the record as a log of the ingestion API, named after the application and subsystem templates
+func (c *CoralogixPump) encode(record *analytics.AnalyticsRecord) ([]byte, error) {
+	var application, subsystem strings.Builder
+	if err := c.application.Execute(&application, record); err != nil {
+		return nil, err
+	}
+	if err := c.subsystem.Execute(&subsystem, record); err != nil {
+		return nil, err
+	}
+
+	severity := coralogixInfo
+	switch {
+	case record.ResponseCode >= 500:
+		severity = coralogixError
+	case record.ResponseCode >= 400:
+		severity = coralogixWarning
+	}
+
+	return json.Marshal(coralogixLog{
+		ApplicationName: application.String(),
+		SubsystemName:   subsystem.String(),
+		ComputerName:    c.conf.ComputerName,
+		Severity:        severity,
+		Timestamp:       record.TimeStamp.UnixNano() / int64(time.Millisecond),
+		Text:            record,
+	})
+}
+
+func (c *CoralogixPump) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, c.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.conf.PrivateKey)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("coralogix responded with status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
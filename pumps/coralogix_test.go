@@ -0,0 +1,78 @@
+package pumps
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestCoralogixWriteData(t *testing.T) {
+	requests := [][]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer key" {
+			t.Errorf("expected the private key as a bearer token, got %q", r.Header.Get("Authorization"))
+		}
+		logs := []map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&logs); err != nil {
+			t.Errorf("expected a list of logs: %v", err)
+		}
+		requests = append(requests, logs)
+	}))
+	defer server.Close()
+
+	pump := &CoralogixPump{}
+	err := pump.Init(map[string]interface{}{
+		"private_key":      "key",
+		"url":              server.URL,
+		"application_name": "tyk-{{.OrgID}}",
+		"computer_name":    "gateway",
+		"batch_size":       2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{OrgID: "org", APIName: "api", ResponseCode: 200, TimeStamp: time.Unix(1600000000, 0)},
+		analytics.AnalyticsRecord{OrgID: "org", APIName: "api", ResponseCode: 503},
+		analytics.AnalyticsRecord{OrgID: "org", APIName: "other", ResponseCode: 404},
+	}
+	if err := pump.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 2 || len(requests[0]) != 2 {
+		t.Fatalf("expected 2 batches, got %v", requests)
+	}
+	first := requests[0][0]
+	if first["applicationName"] != "tyk-org" || first["subsystemName"] != "api" || first["computerName"] != "gateway" {
+		t.Errorf("unexpected names %v", first)
+	}
+	if first["timestamp"] != float64(1600000000000) || first["severity"] != float64(coralogixInfo) {
+		t.Errorf("unexpected timestamp and severity %v", first)
+	}
+	if text, ok := first["text"].(map[string]interface{}); !ok || text["org_id"] != "org" {
+		t.Errorf("expected the record as the text, got %v", first["text"])
+	}
+	if requests[0][1]["severity"] != float64(coralogixError) || requests[1][0]["severity"] != float64(coralogixWarning) {
+		t.Errorf("expected the severities of the response codes, got %v", requests)
+	}
+}
+
+func TestCoralogixInit(t *testing.T) {
+	pump := &CoralogixPump{}
+	if err := pump.Init(map[string]interface{}{"private_key": "key", "domain": "eu2.coralogix.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if pump.conf.URL != "https://ingress.eu2.coralogix.com/logs/v1/singles" {
+		t.Errorf("unexpected URL %s", pump.conf.URL)
+	}
+	if err := pump.Init(map[string]interface{}{"private_key": "key", "domain": "x", "subsystem_name": "{{.APIName"}); err == nil {
+		t.Error("expected an invalid template to fail")
+	}
+}
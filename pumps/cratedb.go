@@ -0,0 +1,272 @@
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	cratedbPrefix     = "cratedb-pump"
+	cratedbDefaultENV = PUMPS_ENV_PREFIX + "_CRATEDB" + PUMPS_ENV_META_PREFIX
+
+	defaultCrateDBURL       = "http://localhost:4200"
+	defaultCrateDBTable     = "tyk_analytics"
+	defaultCrateDBBatchSize = 1000
+	cratedbSQLPath          = "/_sql"
+	// cratedbRowFailed is the row count of the bulk operations that failed
+	cratedbRowFailed = -2
+)
+
+var cratedbIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// cratedbTypes are the SQL types of the columns
+var cratedbTypes = map[columnType]string{
+	columnTimestamp: "TIMESTAMP WITH TIME ZONE",
+	columnString:    "TEXT",
+	columnInteger:   "BIGINT",
+}
+
+// CrateDBPump inserts the analytics records into a CrateDB table with bulk operations of the HTTP endpoint, in
+// batches of up to batch_size rows
+type CrateDBPump struct {
+	conf   *CrateDBConf
+	client *http.Client
+	CommonPumpConfig
+}
+
+// CrateDBConf configures the CrateDB pump
+type CrateDBConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	// URL is the URL of the HTTP endpoint of the cluster, http://localhost:4200 by default
+	URL      string `mapstructure:"url"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// Schema is the schema of the table, doc by default
+	Schema string `mapstructure:"schema"`
+	// Table is the table the records are inserted into, tyk_analytics by default
+	Table string `mapstructure:"table"`
+	// BatchSize is the maximum number of rows inserted by a bulk operation, 1000 by default
+	BatchSize int `mapstructure:"batch_size"`
+	// CreateTable creates the table on start when it doesn't exist, partitioned by day
+	CreateTable bool `mapstructure:"create_table"`
+	// Shards is the number of shards of every partition of the created table, the CrateDB default when 0
+	Shards int `mapstructure:"shards"`
+}
+
+type cratedbRequest struct {
+	Stmt     string          `json:"stmt"`
+	BulkArgs [][]interface{} `json:"bulk_args,omitempty"`
+}
+
+type cratedbResponse struct {
+	Results []struct {
+		RowCount int `json:"rowcount"`
+	} `json:"results"`
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (c *CrateDBPump) New() Pump {
+	newPump := CrateDBPump{}
+	return &newPump
+}
+
+func (c *CrateDBPump) GetName() string {
+	return "CrateDB Pump"
+}
+
+func (c *CrateDBPump) GetEnvPrefix() string {
+	return c.conf.EnvPrefix
+}
+
+func (c *CrateDBPump) Init(config interface{}) error {
+	c.conf = &CrateDBConf{}
+	c.log = c.newLogger(cratedbPrefix)
+
+	if err := decodePumpConfig(c, c.log, config, &c.conf); err != nil {
+		c.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(c, c.log, c.conf, cratedbDefaultENV)
+
+	if c.conf.URL == "" {
+		c.conf.URL = defaultCrateDBURL
+	}
+	if c.conf.Table == "" {
+		c.conf.Table = defaultCrateDBTable
+	}
+	for _, identifier := range []string{c.conf.Schema, c.conf.Table} {
+		if identifier != "" && !cratedbIdentifier.MatchString(identifier) {
+			return fmt.Errorf("invalid schema or table name %q", identifier)
+		}
+	}
+	if c.conf.BatchSize <= 0 {
+		c.conf.BatchSize = defaultCrateDBBatchSize
+	}
+	c.client = &http.Client{Timeout: 60 * time.Second}
+
+	if c.conf.CreateTable && !c.dryRun {
+		if _, err := c.execute(context.Background(), c.createTable(), nil); err != nil {
+			return fmt.Errorf("couldn't create the table: %v", err)
+		}
+		for _, statement := range sqlAddColumns(c.tableName(), cratedbTypes, cratedbQuote, true) {
+			if _, err := c.execute(context.Background(), statement, nil); err != nil {
+				return fmt.Errorf("couldn't add the new columns to the table: %v", err)
+			}
+		}
+	}
+
+	c.log.Info(c.GetName() + " Initialized")
+	return nil
+}
+
+// tableName returns the quoted name of the table, qualified by its schema when set
+func (c *CrateDBPump) tableName() string {
+	if c.conf.Schema == "" {
+		return cratedbQuote(c.conf.Table)
+	}
+	return cratedbQuote(c.conf.Schema) + "." + cratedbQuote(c.conf.Table)
+}
+
+func cratedbQuote(name string) string {
+	return `"` + name + `"`
+}
+
+// createTable returns the statement creating the table, partitioned by the day of the records
+func (c *CrateDBPump) createTable() string {
+	statement := sqlCreateTable(c.tableName(), cratedbTypes, cratedbQuote)
+	statement = strings.TrimSuffix(statement, ")") +
+		`, "day" TIMESTAMP WITH TIME ZONE GENERATED ALWAYS AS date_trunc('day', "timestamp"))`
+	if c.conf.Shards > 0 {
+		statement += fmt.Sprintf(" CLUSTERED INTO %d SHARDS", c.conf.Shards)
+	}
+	return statement + ` PARTITIONED BY ("day")`
+}
+
+func (c *CrateDBPump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := c.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial inserts the records with bulk operations of up to batch_size rows, returning the records of the
+// rows and batches that failed and of the batches left at the deadline
+func (c *CrateDBPump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
+	c.log.Debug("Attempting to write ", len(data), " records...")
+
+	failed := []interface{}{}
+	var lastErr error
+	statement := sqlInsert(c.tableName(), cratedbQuote, func(int) string { return "?" })
+	for start := 0; start < len(data); start += c.conf.BatchSize {
+		end := start + c.conf.BatchSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return append(failed, data[start:]...), err
+		}
+
+		batch := data[start:end]
+		rowCounts, err := c.execute(ctx, statement, cratedbBulkArgs(batch))
+		if err != nil {
+			c.log.WithField("rows", len(batch)).Error("Failed to insert the records: ", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return append(failed, data[start:]...), ctxErr
+			}
+			failed = append(failed, batch...)
+			lastErr = err
+			continue
+		}
+
+		rowsFailed := 0
+		for i, rowCount := range rowCounts {
+			if rowCount == cratedbRowFailed && i < len(batch) {
+				failed = append(failed, batch[i])
+				rowsFailed++
+			}
+		}
+		if rowsFailed > 0 {
+			c.log.WithField("rows", rowsFailed).Error("Failed to insert some of the records")
+			lastErr = errors.New("cratedb couldn't insert some of the rows")
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("failed to write %d of %d records: %v", len(failed), len(data), lastErr)
+	}
+	c.log.Info("Purged ", len(data), " records...")
+	return nil, nil
+}
+
+// cratedbBulkArgs returns the arguments of the bulk operation inserting a row per record. The timestamps are given as
+// epoch milliseconds.
+func cratedbBulkArgs(records []interface{}) [][]interface{} {
+	bulkArgs := make([][]interface{}, 0, len(records))
+	for _, v := range records {
+		record := v.(analytics.AnalyticsRecord)
+		args := make([]interface{}, len(analyticsColumns))
+		for i, column := range analyticsColumns {
+			value := column.value(&record)
+			if t, ok := value.(time.Time); ok {
+				value = t.UnixNano() / int64(time.Millisecond)
+			}
+			args[i] = value
+		}
+		bulkArgs = append(bulkArgs, args)
+	}
+	return bulkArgs
+}
+
+// execute runs the statement, as a bulk operation when bulkArgs are given, returning the row counts of the bulk
+// operation
+func (c *CrateDBPump) execute(ctx context.Context, statement string, bulkArgs [][]interface{}) ([]int, error) {
+	body, err := json.Marshal(cratedbRequest{Stmt: statement, BulkArgs: bulkArgs})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.conf.URL, "/")+cratedbSQLPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if c.conf.Username != "" {
+		req.SetBasicAuth(c.conf.Username, c.conf.Password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	result := cratedbResponse{}
+	if err := json.Unmarshal(respBody, &result); err != nil && resp.StatusCode < http.StatusMultipleChoices {
+		return nil, fmt.Errorf("couldn't decode the response: %v", err)
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		if result.Error.Message != "" {
+			return nil, fmt.Errorf("cratedb responded with status %d: %s", resp.StatusCode, result.Error.Message)
+		}
+		return nil, fmt.Errorf("cratedb responded with status %d: %s", resp.StatusCode, respBody)
+	}
+
+	rowCounts := make([]int, len(result.Results))
+	for i, r := range result.Results {
+		rowCounts[i] = r.RowCount
+	}
+	return rowCounts, nil
+}
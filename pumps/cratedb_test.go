@@ -0,0 +1,89 @@
+package pumps
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestCrateDBWriteData(t *testing.T) {
+	requests := []cratedbRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != cratedbSQLPath {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		request := cratedbRequest{}
+		json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+
+		switch len(request.BulkArgs) {
+		case 0:
+			w.Write([]byte(`{"cols":[],"rowcount":1}`))
+		case 2:
+			// the second row of the first batch is rejected
+			w.Write([]byte(`{"results":[{"rowcount":1},{"rowcount":-2}]}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"SQLParseException[line 1]","code":4000}}`))
+		}
+	}))
+	defer server.Close()
+
+	pump := &CrateDBPump{}
+	err := pump.Init(map[string]interface{}{
+		"url":          server.URL,
+		"schema":       "tyk",
+		"batch_size":   2,
+		"create_table": true,
+		"shards":       4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{APIID: "1", ResponseCode: 200, TimeStamp: time.Unix(1600000000, 0)},
+		analytics.AnalyticsRecord{APIID: "2"},
+		analytics.AnalyticsRecord{APIID: "3"},
+	}
+	failed, err := pump.WriteDataPartial(context.Background(), data)
+	if err == nil || !strings.Contains(err.Error(), "SQLParseException") {
+		t.Errorf("expected the error of the rejected batch, got %v", err)
+	}
+	if len(failed) != 2 || failed[0].(analytics.AnalyticsRecord).APIID != "2" || failed[1].(analytics.AnalyticsRecord).APIID != "3" {
+		t.Errorf("expected the rejected row and batch to fail, got %v", failed)
+	}
+
+	if len(requests) != 6 {
+		t.Fatalf("expected the CREATE TABLE, the ALTER TABLEs and a bulk operation per batch, got %d requests", len(requests))
+	}
+	create := requests[0].Stmt
+	if !strings.HasPrefix(create, `CREATE TABLE IF NOT EXISTS "tyk"."tyk_analytics" ("timestamp" TIMESTAMP WITH TIME ZONE`) ||
+		!strings.HasSuffix(create, `CLUSTERED INTO 4 SHARDS PARTITIONED BY ("day")`) {
+		t.Errorf("unexpected CREATE TABLE %s", create)
+	}
+	if alter := requests[1].Stmt; alter != `ALTER TABLE "tyk"."tyk_analytics" ADD COLUMN IF NOT EXISTS "trace_id" TEXT` {
+		t.Errorf("unexpected ALTER TABLE %s", alter)
+	}
+	insert := requests[4]
+	if !strings.HasPrefix(insert.Stmt, `INSERT INTO "tyk"."tyk_analytics" ("timestamp", "org_id"`) {
+		t.Errorf("unexpected INSERT %s", insert.Stmt)
+	}
+	row := insert.BulkArgs[0]
+	if len(row) != len(analyticsColumns) || row[0] != float64(1600000000000) || row[2] != "1" || row[12] != float64(200) {
+		t.Errorf("unexpected row %v", row)
+	}
+}
+
+func TestCrateDBInitInvalidTable(t *testing.T) {
+	pump := &CrateDBPump{}
+	if err := pump.Init(map[string]interface{}{"table": `analytics" (x)`}); err == nil {
+		t.Error("expected an invalid table name to fail")
+	}
+}
@@ -1,14 +1,17 @@
 package pumps
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
-	"encoding/csv"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"strings"
 	"time"
-
-	"github.com/mitchellh/mapstructure"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
 )
@@ -16,12 +19,32 @@ import (
 type CSVPump struct {
 	csvConf      *CSVConf
 	wroteHeaders bool
+	encoder      csvEncoder
+	currentFile  string
 	CommonPumpConfig
 }
 
 type CSVConf struct {
 	EnvPrefix string `mapstructure:"meta_env_prefix"`
 	CSVDir    string `mapstructure:"csv_dir"`
+	// FilePeriod is the period of time covered by every file: hour, the default, or day
+	FilePeriod string `mapstructure:"file_period"`
+	// MaxSizeMB rotates the file once it reaches this size, in megabytes. 0 disables the size rotation.
+	MaxSizeMB int `mapstructure:"max_size_mb"`
+	// CompressRotated gzips the files once they are rotated
+	CompressRotated bool `mapstructure:"compress_rotated"`
+	// Delimiter is the field delimiter, a comma by default
+	Delimiter string `mapstructure:"delimiter"`
+	// QuoteAll quotes all the fields rather than only the ones that need it
+	QuoteAll bool `mapstructure:"quote_all"`
+	UseCRLF  bool `mapstructure:"use_crlf"`
+	// OmitHeader doesn't write the header line with the field names
+	OmitHeader bool `mapstructure:"omit_header"`
+	// Fields are the record fields written, by json name, like api_id or latency.total. All of them by default.
+	Fields []string `mapstructure:"fields"`
+	// OutputFile writes the records to this file, like a fifo, rather than to csv_dir, or to the standard output when
+	// it's "stdout". The files aren't rotated.
+	OutputFile string `mapstructure:"output_file"`
 }
 
 var csvPrefix = "csv-pump"
@@ -42,18 +65,39 @@ func (c *CSVPump) GetEnvPrefix() string {
 
 func (c *CSVPump) Init(conf interface{}) error {
 	c.csvConf = &CSVConf{}
-	c.log = log.WithField("prefix", csvPrefix)
+	c.log = c.newLogger(csvPrefix)
 
-	err := mapstructure.Decode(conf, &c.csvConf)
+	err := decodePumpConfig(c, c.log, conf, &c.csvConf)
 	if err != nil {
 		c.log.Fatal("Failed to decode configuration: ", err)
 	}
 
 	processPumpEnvVars(c, c.log, c.csvConf, csvDefaultENV)
 
-	ferr := os.MkdirAll(c.csvConf.CSVDir, 0777)
-	if ferr != nil {
-		c.log.Error(ferr.Error() + " dir: " + c.csvConf.CSVDir)
+	if c.csvConf.FilePeriod != "" && c.csvConf.FilePeriod != "hour" && c.csvConf.FilePeriod != "day" {
+		return fmt.Errorf("invalid file_period %q, must be hour or day", c.csvConf.FilePeriod)
+	}
+
+	c.encoder = csvEncoder{comma: ',', quoteAll: c.csvConf.QuoteAll, useCRLF: c.csvConf.UseCRLF}
+	if c.csvConf.Delimiter != "" {
+		comma, size := utf8.DecodeRuneInString(c.csvConf.Delimiter)
+		if size != len(c.csvConf.Delimiter) || !validCSVDelimiter(comma) {
+			return fmt.Errorf("invalid delimiter %q", c.csvConf.Delimiter)
+		}
+		c.encoder.comma = comma
+	}
+
+	for _, field := range c.csvConf.Fields {
+		if !analytics.IsRecordField(field) {
+			return fmt.Errorf("unknown field %q", field)
+		}
+	}
+
+	if c.csvConf.OutputFile == "" && !c.dryRun {
+		ferr := os.MkdirAll(c.csvConf.CSVDir, 0777)
+		if ferr != nil {
+			c.log.Error(ferr.Error() + " dir: " + c.csvConf.CSVDir)
+		}
 	}
 
 	c.log.Info(c.GetName() + " Initialized")
@@ -63,67 +107,240 @@ func (c *CSVPump) Init(conf interface{}) error {
 func (c *CSVPump) WriteData(ctx context.Context, data []interface{}) error {
 	c.log.Debug("Attempting to write ", len(data), " records...")
 
-	curtime := time.Now()
-	fname := fmt.Sprintf("%d-%s-%d-%d.csv", curtime.Year(), curtime.Month().String(), curtime.Day(), curtime.Hour())
-	fname = path.Join(c.csvConf.CSVDir, fname)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	var outfile *os.File
-	var appendHeader bool
+	var err error
+	if c.csvConf.OutputFile != "" {
+		err = c.writeOutputFile(data)
+	} else {
+		err = c.writeDirFile(data)
+	}
+	if err != nil {
+		return err
+	}
 
-	if _, err := os.Stat(fname); os.IsNotExist(err) {
-		var createErr error
-		outfile, createErr = os.Create(fname)
-		if createErr != nil {
-			c.log.Error("Failed to create new CSV file: ", createErr)
+	c.log.Info("Purged ", len(data), " records...")
+	return nil
+}
+
+// Preview returns the line the record would be written as, without its line ending
+func (c *CSVPump) Preview(record analytics.AnalyticsRecord) ([]byte, error) {
+	return bytes.TrimRight(c.encode([]interface{}{record}, false), "\r\n"), nil
+}
+
+// writeOutputFile writes the records to the configured output file or to the standard output, with the header once
+func (c *CSVPump) writeOutputFile(data []interface{}) error {
+	var out io.Writer = os.Stdout
+	if c.csvConf.OutputFile != "stdout" {
+		outfile, err := os.OpenFile(c.csvConf.OutputFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			c.log.Error("Failed to open CSV output file: ", err)
+			return err
 		}
-		appendHeader = true
-	} else {
-		var appendErr error
-		outfile, appendErr = os.OpenFile(fname, os.O_APPEND|os.O_WRONLY, 0600)
-		if appendErr != nil {
-			c.log.Error("Failed to open CSV file: ", appendErr)
+		defer outfile.Close()
+		out = outfile
+	}
+
+	_, err := out.Write(c.encode(data, !c.wroteHeaders))
+	if err != nil {
+		c.log.Error("File write failed:", err)
+		return err
+	}
+	c.wroteHeaders = true
+	return nil
+}
+
+// writeDirFile appends the records to the file of the current period in csv_dir, rotating it first when needed
+func (c *CSVPump) writeDirFile(data []interface{}) error {
+	fname := path.Join(c.csvConf.CSVDir, c.fileName(time.Now()))
+
+	if c.currentFile != "" && c.currentFile != fname && c.csvConf.CompressRotated {
+		c.compress(c.currentFile)
+	}
+	c.currentFile = fname
+
+	info, statErr := os.Stat(fname)
+	appendHeader := os.IsNotExist(statErr)
+	if statErr == nil && c.csvConf.MaxSizeMB > 0 && info.Size() >= int64(c.csvConf.MaxSizeMB)<<20 {
+		if err := c.rotate(fname); err != nil {
+			c.log.Error("Failed to rotate CSV file: ", err)
+		} else {
+			appendHeader = true
 		}
 	}
 
+	outfile, err := os.OpenFile(fname, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		c.log.Error("Failed to open CSV file: ", err)
+		return err
+	}
 	defer outfile.Close()
-	writer := csv.NewWriter(outfile)
 
-	if appendHeader {
-		startRecord := analytics.AnalyticsRecord{}
-		var headers = startRecord.GetFieldNames()
+	if _, err := outfile.Write(c.encode(data, appendHeader)); err != nil {
+		c.log.Error("File write failed:", err)
+		return err
+	}
+	return nil
+}
 
-		err := writer.Write(headers)
-		if err != nil {
-			c.log.Error("Failed to write file headers: ", err)
+func (c *CSVPump) fileName(t time.Time) string {
+	if c.csvConf.FilePeriod == "day" {
+		return fmt.Sprintf("%d-%s-%d.csv", t.Year(), t.Month().String(), t.Day())
+	}
+	return fmt.Sprintf("%d-%s-%d-%d.csv", t.Year(), t.Month().String(), t.Day(), t.Hour())
+}
+
+// rotate renames the file with the first free index, like 2021-March-4-1.csv, and compresses it when configured
+func (c *CSVPump) rotate(fname string) error {
+	base := strings.TrimSuffix(fname, ".csv")
+	for i := 1; ; i++ {
+		rotated := fmt.Sprintf("%s-%d.csv", base, i)
+		if fileExists(rotated) || fileExists(rotated+".gz") {
+			continue
+		}
+
+		if err := os.Rename(fname, rotated); err != nil {
 			return err
+		}
+		if c.csvConf.CompressRotated {
+			c.compress(rotated)
+		}
+		return nil
+	}
+}
+
+func (c *CSVPump) compress(fname string) {
+	if err := gzipFile(fname); err != nil && !os.IsNotExist(err) {
+		c.log.Error("Failed to compress CSV file: ", err)
+	}
+}
 
+// encode returns the CSV lines of the records, after the header when asked
+func (c *CSVPump) encode(data []interface{}, header bool) []byte {
+	var buf bytes.Buffer
+	if header && !c.csvConf.OmitHeader {
+		if len(c.csvConf.Fields) > 0 {
+			c.encoder.write(&buf, c.csvConf.Fields)
+		} else {
+			startRecord := analytics.AnalyticsRecord{}
+			c.encoder.write(&buf, startRecord.GetFieldNames())
 		}
 	}
 
 	for _, v := range data {
 		decoded := v.(analytics.AnalyticsRecord)
 
-		toWrite := decoded.GetLineValues()
-		// toWrite := []string{
-		// 	decoded.Method,
-		// 	decoded.Path,
-		// 	strconv.FormatInt(decoded.ContentLength, 10),
-		// 	decoded.UserAgent,
-		// 	strconv.Itoa(decoded.Day),
-		// 	decoded.Month.String(),
-		// 	strconv.Itoa(decoded.Year),
-		// 	strconv.Itoa(decoded.Hour),
-		// 	strconv.Itoa(decoded.ResponseCode),
-		// 	decoded.APIName,
-		// 	decoded.APIVersion}
-		err := writer.Write(toWrite)
-		if err != nil {
-			c.log.Error("File write failed:", err)
-			return err
+		if len(c.csvConf.Fields) == 0 {
+			c.encoder.write(&buf, decoded.GetLineValues())
+			continue
 		}
 
+		values := make([]string, len(c.csvConf.Fields))
+		for i, field := range c.csvConf.Fields {
+			values[i] = decoded.FieldString(field)
+		}
+		c.encoder.write(&buf, values)
 	}
-	writer.Flush()
-	c.log.Info("Purged ", len(data), " records...")
-	return nil
+	return buf.Bytes()
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// gzipFile compresses the file into a .gz one and removes it
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := gzip.NewWriter(out)
+	if _, err := io.Copy(writer, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	in.Close()
+	return os.Remove(name)
+}
+
+// csvEncoder writes CSV lines like encoding/csv does, but can quote all the fields
+type csvEncoder struct {
+	comma    rune
+	quoteAll bool
+	useCRLF  bool
+}
+
+func validCSVDelimiter(r rune) bool {
+	return r != 0 && r != '"' && r != '\r' && r != '\n' && utf8.ValidRune(r) && r != utf8.RuneError
+}
+
+func (e csvEncoder) write(buf *bytes.Buffer, fields []string) {
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteRune(e.comma)
+		}
+
+		if !e.quoteAll && !e.needsQuotes(field) {
+			buf.WriteString(field)
+			continue
+		}
+
+		buf.WriteByte('"')
+		for _, r := range field {
+			switch r {
+			case '"':
+				buf.WriteString(`""`)
+			case '\n':
+				if e.useCRLF {
+					buf.WriteString("\r\n")
+				} else {
+					buf.WriteByte('\n')
+				}
+			case '\r':
+				if !e.useCRLF {
+					buf.WriteByte('\r')
+				}
+			default:
+				buf.WriteRune(r)
+			}
+		}
+		buf.WriteByte('"')
+	}
+
+	if e.useCRLF {
+		buf.WriteString("\r\n")
+	} else {
+		buf.WriteByte('\n')
+	}
+}
+
+// needsQuotes follows the rules of encoding/csv
+func (e csvEncoder) needsQuotes(field string) bool {
+	if field == "" {
+		return false
+	}
+	if field == `\.` || strings.ContainsRune(field, e.comma) || strings.ContainsAny(field, "\"\r\n") {
+		return true
+	}
+
+	r, _ := utf8.DecodeRuneInString(field)
+	return unicode.IsSpace(r)
 }
@@ -0,0 +1,117 @@
+package pumps
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestCSVEncoder(t *testing.T) {
+	fields := []string{"plain", "with,comma", `with "quotes"`, " leading space", "multi\nline", ""}
+
+	var expected bytes.Buffer
+	writer := csv.NewWriter(&expected)
+	writer.Comma = ';'
+	writer.Write(fields)
+	writer.Flush()
+
+	var buf bytes.Buffer
+	csvEncoder{comma: ';'}.write(&buf, fields)
+	if buf.String() != expected.String() {
+		t.Errorf("expected %q, got %q", expected.String(), buf.String())
+	}
+
+	buf.Reset()
+	csvEncoder{comma: ',', quoteAll: true, useCRLF: true}.write(&buf, []string{"a", `b"c`})
+	if buf.String() != "\"a\",\"b\"\"c\"\r\n" {
+		t.Errorf("unexpected quoted line %q", buf.String())
+	}
+}
+
+func TestCSVPumpFields(t *testing.T) {
+	c := &CSVPump{
+		csvConf: &CSVConf{Fields: []string{"api_id", "response_code"}},
+		encoder: csvEncoder{comma: '\t'},
+	}
+
+	data := []interface{}{analytics.AnalyticsRecord{APIID: "api1", ResponseCode: 200}}
+	if out := string(c.encode(data, true)); out != "api_id\tresponse_code\napi1\t200\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	c.csvConf.OmitHeader = true
+	if out := string(c.encode(data, true)); out != "api1\t200\n" {
+		t.Errorf("unexpected output without header %q", out)
+	}
+}
+
+func TestCSVPumpRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csv-pump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &CSVPump{
+		csvConf: &CSVConf{
+			CSVDir:          dir,
+			FilePeriod:      "day",
+			MaxSizeMB:       1,
+			CompressRotated: true,
+			Fields:          []string{"api_id"},
+		},
+		encoder: csvEncoder{comma: ','},
+	}
+
+	fname := filepath.Join(dir, c.fileName(time.Now()))
+	if err := ioutil.WriteFile(fname, bytes.Repeat([]byte("a"), 1<<20), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.writeDirFile([]interface{}{analytics.AnalyticsRecord{APIID: "api1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "api_id\napi1\n" {
+		t.Errorf("the file wasn't rotated, got %q", content)
+	}
+
+	rotated := fname[:len(fname)-len(".csv")] + "-1.csv"
+	if fileExists(rotated) || !fileExists(rotated+".gz") {
+		t.Error("the rotated file wasn't compressed")
+	}
+}
+
+func TestCSVPumpPreview(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csv-pump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a dry run doesn't create the directory of the files
+	c := &CSVPump{}
+	c.SetDryRun(true)
+	csvDir := filepath.Join(dir, "analytics")
+	if err := c.Init(map[string]interface{}{"csv_dir": csvDir, "fields": []interface{}{"api_id", "response_code"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(csvDir); !os.IsNotExist(err) {
+		t.Error("expected the csv_dir not to be created in a dry run")
+	}
+
+	line, err := c.Preview(analytics.AnalyticsRecord{APIID: "api1", ResponseCode: 200})
+	if err != nil || string(line) != "api1,200" {
+		t.Errorf("unexpected line %q: %v", line, err)
+	}
+}
@@ -0,0 +1,325 @@
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	databricksPrefix     = "databricks-pump"
+	databricksDefaultENV = PUMPS_ENV_PREFIX + "_DATABRICKS" + PUMPS_ENV_META_PREFIX
+
+	defaultDatabricksTable     = "tyk_analytics"
+	defaultDatabricksBatchSize = 1000
+	databricksStatementsPath   = "/api/2.0/sql/statements"
+	databricksTokenPath        = "/oidc/v1/token"
+	// databricksTokenRenewal is how long before expiring an OAuth access token is renewed
+	databricksTokenRenewal = time.Minute
+)
+
+var databricksIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// databricksTypes are the SQL types of the columns
+var databricksTypes = map[columnType]string{
+	columnTimestamp: "TIMESTAMP",
+	columnString:    "STRING",
+	columnInteger:   "BIGINT",
+}
+
+// DatabricksPump inserts the analytics records into a table of a Databricks SQL warehouse with the Statement
+// Execution API, in batches of up to batch_size rows
+type DatabricksPump struct {
+	conf   *DatabricksConf
+	client *http.Client
+
+	tokenMu     sync.Mutex
+	token       string
+	tokenExpiry time.Time
+
+	CommonPumpConfig
+}
+
+// DatabricksConf configures the Databricks pump
+type DatabricksConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	// Host is the URL of the workspace, like https://adb-1234567890123456.7.azuredatabricks.net
+	Host string `mapstructure:"host"`
+	// WarehouseID is the ID of the SQL warehouse running the statements
+	WarehouseID string `mapstructure:"warehouse_id"`
+	// Token is a personal access token
+	Token string `mapstructure:"token"`
+	// ClientID and ClientSecret are the OAuth credentials of a service principal, instead of Token
+	ClientID     string `mapstructure:"client_id"`
+	ClientSecret string `mapstructure:"client_secret"`
+	Catalog      string `mapstructure:"catalog"`
+	Schema       string `mapstructure:"schema"`
+	// Table is the table the records are inserted into, tyk_analytics by default
+	Table string `mapstructure:"table"`
+	// BatchSize is the maximum number of rows inserted by a statement, 1000 by default
+	BatchSize int `mapstructure:"batch_size"`
+	// CreateTable creates the table on start when it doesn't exist
+	CreateTable bool `mapstructure:"create_table"`
+}
+
+type databricksStatement struct {
+	WarehouseID   string `json:"warehouse_id"`
+	Statement     string `json:"statement"`
+	Catalog       string `json:"catalog,omitempty"`
+	Schema        string `json:"schema,omitempty"`
+	WaitTimeout   string `json:"wait_timeout"`
+	OnWaitTimeout string `json:"on_wait_timeout"`
+}
+
+type databricksStatementResponse struct {
+	Status struct {
+		State string `json:"state"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"status"`
+	Message string `json:"message"`
+}
+
+func (d *DatabricksPump) New() Pump {
+	newPump := DatabricksPump{}
+	return &newPump
+}
+
+func (d *DatabricksPump) GetName() string {
+	return "Databricks Pump"
+}
+
+func (d *DatabricksPump) GetEnvPrefix() string {
+	return d.conf.EnvPrefix
+}
+
+func (d *DatabricksPump) Init(config interface{}) error {
+	d.conf = &DatabricksConf{}
+	d.log = d.newLogger(databricksPrefix)
+
+	if err := decodePumpConfig(d, d.log, config, &d.conf); err != nil {
+		d.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(d, d.log, d.conf, databricksDefaultENV)
+
+	if d.conf.Host == "" || d.conf.WarehouseID == "" {
+		return errors.New("host and warehouse_id must be set")
+	}
+	if d.conf.Token == "" && (d.conf.ClientID == "" || d.conf.ClientSecret == "") {
+		return errors.New("token, or client_id and client_secret, must be set")
+	}
+	if !strings.Contains(d.conf.Host, "://") {
+		d.conf.Host = "https://" + d.conf.Host
+	}
+	if d.conf.Table == "" {
+		d.conf.Table = defaultDatabricksTable
+	}
+	for _, identifier := range []string{d.conf.Catalog, d.conf.Schema, d.conf.Table} {
+		if identifier != "" && !databricksIdentifier.MatchString(identifier) {
+			return fmt.Errorf("invalid catalog, schema or table name %q", identifier)
+		}
+	}
+	if d.conf.BatchSize <= 0 {
+		d.conf.BatchSize = defaultDatabricksBatchSize
+	}
+	d.client = &http.Client{Timeout: 60 * time.Second}
+
+	if d.conf.CreateTable && !d.dryRun {
+		if err := d.execute(context.Background(), sqlCreateTable(databricksQuote(d.conf.Table), databricksTypes, databricksQuote)); err != nil {
+			return fmt.Errorf("couldn't create the table: %v", err)
+		}
+		for _, statement := range sqlAddColumns(databricksQuote(d.conf.Table), databricksTypes, databricksQuote, false) {
+			if err := d.execute(context.Background(), statement); err != nil && !isColumnExistsError(err) {
+				return fmt.Errorf("couldn't add the new columns to the table: %v", err)
+			}
+		}
+	}
+
+	d.log.Info(d.GetName() + " Initialized")
+	return nil
+}
+
+func databricksQuote(name string) string {
+	return "`" + name + "`"
+}
+
+// databricksInsert returns the INSERT statement of the records, with their values as literals
+func databricksInsert(table string, records []interface{}) string {
+	rows := make([]string, 0, len(records))
+	for _, v := range records {
+		record := v.(analytics.AnalyticsRecord)
+		values := make([]string, len(analyticsColumns))
+		for i, column := range analyticsColumns {
+			values[i] = databricksLiteral(column.value(&record))
+		}
+		rows = append(rows, "("+strings.Join(values, ", ")+")")
+	}
+	return "INSERT INTO " + databricksQuote(table) + " " + sqlColumnList(databricksQuote) + " VALUES " + strings.Join(rows, ", ")
+}
+
+// databricksStringEscaper escapes the string literals, where backslashes are escape characters in Databricks SQL
+var databricksStringEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// databricksLiteral returns the SQL literal of the column value
+func databricksLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case time.Time:
+		return "TIMESTAMP '" + formatTimestamp(v) + "'"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		return "'" + databricksStringEscaper.Replace(fmt.Sprint(v)) + "'"
+	}
+}
+
+func (d *DatabricksPump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := d.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial inserts the records in batches of up to batch_size rows, returning the records of the batches that
+// failed and of the ones left at the deadline
+func (d *DatabricksPump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
+	d.log.Debug("Attempting to write ", len(data), " records...")
+
+	failed := []interface{}{}
+	var lastErr error
+	for start := 0; start < len(data); start += d.conf.BatchSize {
+		end := start + d.conf.BatchSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return append(failed, data[start:]...), err
+		}
+
+		batch := data[start:end]
+		if err := d.execute(ctx, databricksInsert(d.conf.Table, batch)); err != nil {
+			d.log.WithField("rows", len(batch)).Error("Failed to insert the records: ", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return append(failed, data[start:]...), ctxErr
+			}
+			failed = append(failed, batch...)
+			lastErr = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("failed to write %d of %d records: %v", len(failed), len(data), lastErr)
+	}
+	d.log.Info("Purged ", len(data), " records...")
+	return nil, nil
+}
+
+// execute runs the statement on the warehouse. It waits up to 30 seconds for the statement to finish, the ones still
+// running keep running on their own.
+func (d *DatabricksPump) execute(ctx context.Context, statement string) error {
+	token, err := d.getToken(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(databricksStatement{
+		WarehouseID:   d.conf.WarehouseID,
+		Statement:     statement,
+		Catalog:       d.conf.Catalog,
+		Schema:        d.conf.Schema,
+		WaitTimeout:   "30s",
+		OnWaitTimeout: "CONTINUE",
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(d.conf.Host, "/")+databricksStatementsPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	result := databricksStatementResponse{}
+	json.Unmarshal(respBody, &result)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		if result.Message != "" {
+			return fmt.Errorf("databricks responded with status %d: %s", resp.StatusCode, result.Message)
+		}
+		return fmt.Errorf("databricks responded with status %d: %s", resp.StatusCode, respBody)
+	}
+
+	switch result.Status.State {
+	case "FAILED", "CANCELED", "CLOSED":
+		return fmt.Errorf("statement %s: %s", strings.ToLower(result.Status.State), result.Status.Error.Message)
+	}
+	return nil
+}
+
+// getToken returns the personal access token, or the OAuth access token of the service principal, renewing it when
+// it's about to expire at now
+func (d *DatabricksPump) getToken(ctx context.Context, now time.Time) (string, error) {
+	if d.conf.Token != "" {
+		return d.conf.Token, nil
+	}
+
+	d.tokenMu.Lock()
+	defer d.tokenMu.Unlock()
+
+	if d.token != "" && now.Add(databricksTokenRenewal).Before(d.tokenExpiry) {
+		return d.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("scope", "all-apis")
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(d.conf.Host, "/")+databricksTokenPath, bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(d.conf.ClientID, d.conf.ClientSecret)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("couldn't authenticate, databricks responded with status %d: %s", resp.StatusCode, body)
+	}
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("couldn't authenticate, unexpected response %s", body)
+	}
+
+	d.token, d.tokenExpiry = token.AccessToken, now.Add(time.Duration(token.ExpiresIn)*time.Second)
+	return d.token, nil
+}
@@ -0,0 +1,95 @@
+package pumps
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestDatabricksWriteData(t *testing.T) {
+	tokens := 0
+	statements := []databricksStatement{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case databricksTokenPath:
+			if id, secret, _ := r.BasicAuth(); id != "id" || secret != "secret" {
+				t.Errorf("unexpected credentials %s:%s", id, secret)
+			}
+			tokens++
+			w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+		case databricksStatementsPath:
+			if r.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("expected the access token, got %q", r.Header.Get("Authorization"))
+			}
+			statement := databricksStatement{}
+			json.NewDecoder(r.Body).Decode(&statement)
+			statements = append(statements, statement)
+			switch len(statements) {
+			case 2:
+				// the table created by a previous version already has the first added column
+				w.Write([]byte(`{"status":{"state":"FAILED","error":{"message":"[FIELDS_ALREADY_EXISTS] Cannot add column, because trace_id already exists"}}}`))
+				return
+			case 6:
+				w.Write([]byte(`{"status":{"state":"FAILED","error":{"message":"[TABLE_OR_VIEW_NOT_FOUND]"}}}`))
+				return
+			}
+			w.Write([]byte(`{"status":{"state":"SUCCEEDED"}}`))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	pump := &DatabricksPump{}
+	err := pump.Init(map[string]interface{}{
+		"host":          server.URL,
+		"warehouse_id":  "abc",
+		"client_id":     "id",
+		"client_secret": "secret",
+		"catalog":       "main",
+		"schema":        "tyk",
+		"batch_size":    2,
+		"create_table":  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{APIID: "1", APIName: `it's \`, ResponseCode: 200},
+		analytics.AnalyticsRecord{APIID: "2"},
+		analytics.AnalyticsRecord{APIID: "3"},
+	}
+	failed, err := pump.WriteDataPartial(context.Background(), data)
+	if err == nil || !strings.Contains(err.Error(), "TABLE_OR_VIEW_NOT_FOUND") {
+		t.Errorf("expected the error of the failed statement, got %v", err)
+	}
+	if len(failed) != 1 || failed[0].(analytics.AnalyticsRecord).APIID != "3" {
+		t.Errorf("expected the record of the failed statement to fail, got %v", failed)
+	}
+
+	if tokens != 1 {
+		t.Errorf("expected the access token to be reused, got %d tokens", tokens)
+	}
+	if len(statements) != 6 {
+		t.Fatalf("expected the CREATE TABLE, the ALTER TABLEs and a statement per batch, got %d", len(statements))
+	}
+	if !strings.HasPrefix(statements[0].Statement, "CREATE TABLE IF NOT EXISTS `tyk_analytics` (`timestamp` TIMESTAMP") {
+		t.Errorf("unexpected CREATE TABLE %s", statements[0].Statement)
+	}
+	if statements[2].Statement != "ALTER TABLE `tyk_analytics` ADD COLUMN `span_id` STRING" {
+		t.Errorf("unexpected ALTER TABLE %s", statements[2].Statement)
+	}
+	insert := statements[4]
+	if insert.WarehouseID != "abc" || insert.Catalog != "main" || insert.Schema != "tyk" {
+		t.Errorf("unexpected context %+v", insert)
+	}
+	if !strings.Contains(insert.Statement, `'1', 'it\'s \\'`) || strings.Count(insert.Statement, "(TIMESTAMP '") != 2 {
+		t.Errorf("unexpected INSERT %s", insert.Statement)
+	}
+}
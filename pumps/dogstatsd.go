@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
-	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
@@ -39,8 +38,18 @@ type DogStatsdConf struct {
 	Buffered             bool     `mapstructure:"buffered"`
 	BufferedMaxMessages  int      `mapstructure:"buffered_max_messages"`
 	Tags                 []string `mapstructure:"tags"`
+	// MetricType is the type of the request_time metric, histogram or distribution
+	MetricType string `mapstructure:"metric_type"`
 }
 
+const (
+	dogstatsdHistogramType    = "histogram"
+	dogstatsdDistributionType = "distribution"
+)
+
+// dogstatsdTags are the tags with their own formatting, the rest of the tags are taken from the record fields
+var dogstatsdTags = []string{"method", "response_code", "api_version", "api_name", "api_id", "org_id", "tracked", "path", "oauth_id"}
+
 func (s *DogStatsdPump) New() Pump {
 	newPump := DogStatsdPump{}
 	return &newPump
@@ -50,15 +59,23 @@ func (s *DogStatsdPump) GetName() string {
 	return "DogStatsd Pump"
 }
 
+// Close sends the buffered metrics and closes the client
+func (s *DogStatsdPump) Close() error {
+	if s.client == nil {
+		return nil
+	}
+	return s.client.Close()
+}
+
 func (s *DogStatsdPump) GetEnvPrefix() string {
 	return s.conf.EnvPrefix
 }
 
 func (s *DogStatsdPump) Init(conf interface{}) error {
 
-	s.log = log.WithField("prefix", dogstatPrefix)
+	s.log = s.newLogger(dogstatPrefix)
 
-	if err := mapstructure.Decode(conf, &s.conf); err != nil {
+	if err := decodePumpConfig(s, s.log, conf, &s.conf); err != nil {
 		return errors.Wrap(err, "unable to decode dogstatsd configuration")
 	}
 
@@ -85,6 +102,21 @@ func (s *DogStatsdPump) Init(conf interface{}) error {
 	}
 	s.log.Infof("async_uds: %t, write_timeout: %ds", s.conf.AsyncUDS, s.conf.AsyncUDSWriteTimeout)
 
+	switch s.conf.MetricType {
+	case "":
+		s.conf.MetricType = dogstatsdHistogramType
+	case dogstatsdHistogramType, dogstatsdDistributionType:
+	default:
+		return fmt.Errorf("invalid metric_type '%s', must be histogram or distribution", s.conf.MetricType)
+	}
+	s.log.Infof("metric_type: %s", s.conf.MetricType)
+
+	for _, tag := range s.conf.Tags {
+		if !isDogstatsdTag(tag) && !analytics.IsRecordField(tag) {
+			return fmt.Errorf("undefined tag '%s'", tag)
+		}
+	}
+
 	var opts []statsd.Option
 	if s.conf.Buffered {
 		opts = append(opts, statsd.WithMaxMessagesPerPayload(s.conf.BufferedMaxMessages))
@@ -127,6 +159,10 @@ func (s *DogStatsdPump) WriteData(ctx context.Context, data []interface{}) error
 
 	s.log.Debug("Attempting to write ", len(data), " records...")
 	for _, v := range data {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Convert to AnalyticsRecord
 		decoded := v.(analytics.AnalyticsRecord)
 
@@ -180,17 +216,39 @@ func (s *DogStatsdPump) WriteData(ctx context.Context, data []interface{}) error
 					}
 					value = "oauth_id:" + decoded.OauthID
 				default:
-					return fmt.Errorf("undefined tag '%s'", tag)
+					// any other record field, like alias or geo.country.iso_code
+					fieldValue := decoded.FieldString(tag)
+					if fieldValue == "" {
+						continue
+					}
+					value = tag + ":" + fieldValue
 				}
 				tags = append(tags, value)
 			}
 		}
 
+		if s.conf.MetricType == dogstatsdDistributionType {
+			if err := s.client.Distribution("request_time", float64(decoded.RequestTime), tags, s.conf.SampleRate); err != nil {
+				s.log.WithError(err).Error("unable to record Distribution, dropping analytics record")
+				s.DropRecords(DroppedRejected, 1)
+			}
+			continue
+		}
 		if err := s.client.Histogram("request_time", float64(decoded.RequestTime), tags, s.conf.SampleRate); err != nil {
 			s.log.WithError(err).Error("unable to record Histogram, dropping analytics record")
+			s.DropRecords(DroppedRejected, 1)
 		}
 	}
 	s.log.Info("Purged ", len(data), " records...")
 
 	return nil
 }
+
+func isDogstatsdTag(tag string) bool {
+	for _, dogstatsdTag := range dogstatsdTags {
+		if tag == dogstatsdTag {
+			return true
+		}
+	}
+	return false
+}
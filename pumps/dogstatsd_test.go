@@ -0,0 +1,25 @@
+package pumps
+
+import "testing"
+
+func TestDogStatsdInitValidation(t *testing.T) {
+	invalid := []map[string]interface{}{
+		{"address": "localhost:8125", "metric_type": "gauge"},
+		{"address": "localhost:8125", "tags": []string{"api_id", "unknown_field"}},
+	}
+	for _, conf := range invalid {
+		pmp := DogStatsdPump{}
+		if err := pmp.Init(conf); err == nil {
+			t.Errorf("expected an error for %v", conf)
+		}
+	}
+
+	pmp := DogStatsdPump{}
+	if err := pmp.Init(map[string]interface{}{
+		"address":     "localhost:8125",
+		"metric_type": "distribution",
+		"tags":        []string{"api_id", "alias", "geo.country.iso_code"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -21,7 +21,7 @@ func (p *DummyPump) GetName() string {
 }
 
 func (p *DummyPump) Init(conf interface{}) error {
-	p.log = log.WithField("prefix", dummyPrefix)
+	p.log = p.newLogger(dummyPrefix)
 
 	p.log.Info("Dummy Initialized")
 	return nil
@@ -0,0 +1,217 @@
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	dynatracePrefix     = "dynatrace-pump"
+	dynatraceDefaultENV = PUMPS_ENV_PREFIX + "_DYNATRACE" + PUMPS_ENV_META_PREFIX
+
+	dynatraceIngestPath       = "/api/v2/logs/ingest"
+	defaultDynatraceBatchSize = 1000
+	// defaultDynatraceMaxBatchBytes keeps the requests under the 1MB payload limit of the Logs API
+	defaultDynatraceMaxBatchBytes = 1000 * 1000
+)
+
+// defaultDynatraceAttributes are the record fields sent as attributes of the logs, by attribute name
+var defaultDynatraceAttributes = map[string]string{
+	"http.method":      "method",
+	"http.host":        "host",
+	"http.target":      "path",
+	"http.status_code": "response_code",
+	"http.user_agent":  "user_agent",
+	"http.client_ip":   "ip_address",
+	"duration":         "request_time",
+	"tyk.api_id":       "api_id",
+	"tyk.api_name":     "api_name",
+	"tyk.api_version":  "api_version",
+	"tyk.org_id":       "org_id",
+	"tyk.alias":        "alias",
+}
+
+// DynatracePump sends the analytics records to the Dynatrace Logs API v2, as logs with the record fields as
+// attributes and the trace context of the requests, so they are linked to the traces of the APIs
+type DynatracePump struct {
+	conf   *DynatraceConf
+	client *http.Client
+	CommonPumpConfig
+}
+
+// DynatraceConf configures the Dynatrace pump
+type DynatraceConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	// URL is the URL of the Dynatrace environment, like https://{environment-id}.live.dynatrace.com, or of an
+	// ActiveGate, like https://{activegate}:9999/e/{environment-id}
+	URL string `mapstructure:"url"`
+	// APIToken is an access token with the logs.ingest scope
+	APIToken string `mapstructure:"api_token"`
+	// Attributes are the record fields sent as attributes of the logs, by attribute name, added to the default ones
+	Attributes map[string]string `mapstructure:"attributes"`
+	// LogSource is the log.source attribute of the logs, tyk-pump by default
+	LogSource string `mapstructure:"log_source"`
+	// BatchSize is the maximum number of logs of a request, 1000 by default
+	BatchSize int `mapstructure:"batch_size"`
+	// MaxBatchBytes is the maximum size of a request, 1MB by default
+	MaxBatchBytes int `mapstructure:"max_batch_bytes"`
+}
+
+func (d *DynatracePump) New() Pump {
+	newPump := DynatracePump{}
+	return &newPump
+}
+
+func (d *DynatracePump) GetName() string {
+	return "Dynatrace Pump"
+}
+
+func (d *DynatracePump) GetEnvPrefix() string {
+	return d.conf.EnvPrefix
+}
+
+func (d *DynatracePump) Init(config interface{}) error {
+	d.conf = &DynatraceConf{}
+	d.log = d.newLogger(dynatracePrefix)
+
+	if err := decodePumpConfig(d, d.log, config, &d.conf); err != nil {
+		d.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(d, d.log, d.conf, dynatraceDefaultENV)
+
+	if d.conf.URL == "" || d.conf.APIToken == "" {
+		return errors.New("url and api_token must be set")
+	}
+
+	attributes := map[string]string{}
+	for name, field := range defaultDynatraceAttributes {
+		attributes[name] = field
+	}
+	for name, field := range d.conf.Attributes {
+		if !analytics.IsRecordField(field) {
+			return fmt.Errorf("unknown record field %q for attribute %s", field, name)
+		}
+		attributes[name] = field
+	}
+	d.conf.Attributes = attributes
+
+	if d.conf.LogSource == "" {
+		d.conf.LogSource = "tyk-pump"
+	}
+	if d.conf.BatchSize <= 0 {
+		d.conf.BatchSize = defaultDynatraceBatchSize
+	}
+	if d.conf.MaxBatchBytes <= 0 {
+		d.conf.MaxBatchBytes = defaultDynatraceMaxBatchBytes
+	}
+	d.client = &http.Client{Timeout: 60 * time.Second}
+
+	d.log.Info(d.GetName() + " Initialized")
+	return nil
+}
+
+func (d *DynatracePump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := d.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial sends the records in batches, returning the records of the batches that failed and of the ones
+// left at the deadline
+func (d *DynatracePump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
+	d.log.Debug("Attempting to write ", len(data), " records...")
+
+	// the batch bodies are turned into JSON arrays, taking 1 byte more than the new line delimited JSON
+	batches, unencoded := ndjsonBatches(data, d.conf.BatchSize, d.conf.MaxBatchBytes-1, d.encode)
+	if len(unencoded) > 0 {
+		d.log.Error("Couldn't encode ", len(unencoded), " records, they will be dropped")
+		d.DropRecords(DroppedSerialization, len(unencoded))
+	}
+
+	failed := []interface{}{}
+	var lastErr error
+	for i, batch := range batches {
+		if err := ctx.Err(); err != nil {
+			return append(failed, ndjsonRecords(batches[i:])...), err
+		}
+
+		if err := d.ingest(ctx, ndjsonArray(batch.body)); err != nil {
+			d.log.WithField("records", len(batch.records)).Error("Failed to send the records: ", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return append(failed, ndjsonRecords(batches[i:])...), ctxErr
+			}
+			failed = append(failed, batch.records...)
+			lastErr = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("failed to write %d of %d records: %v", len(failed), len(data), lastErr)
+	}
+	d.log.Info("Purged ", len(data), " records...")
+	return nil, nil
+}
+
+// encode encodes the record as a log of the Logs API, with the configured attributes and the trace_id and span_id
+// of the request
+func (d *DynatracePump) encode(record *analytics.AnalyticsRecord) ([]byte, error) {
+	severity := "INFO"
+	switch {
+	case record.ResponseCode >= 500:
+		severity = "ERROR"
+	case record.ResponseCode >= 400:
+		severity = "WARN"
+	}
+
+	entry := map[string]interface{}{
+		"content":    recordMessage(record),
+		"timestamp":  record.TimeStamp.UTC().Format(time.RFC3339Nano),
+		"severity":   severity,
+		"log.source": d.conf.LogSource,
+	}
+	for name, field := range d.conf.Attributes {
+		if value, ok := record.FieldFloat(field); ok {
+			entry[name] = value
+		} else if value := record.FieldString(field); value != "" {
+			entry[name] = value
+		}
+	}
+	if traceID, spanID := recordTrace(record); traceID != "" {
+		entry["trace_id"] = traceID
+		if spanID != "" {
+			entry["span_id"] = spanID
+		}
+	}
+	return json.Marshal(entry)
+}
+
+func (d *DynatracePump) ingest(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(d.conf.URL, "/")+dynatraceIngestPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Api-Token "+d.conf.APIToken)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("dynatrace responded with status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
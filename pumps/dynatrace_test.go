@@ -0,0 +1,95 @@
+package pumps
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestDynatraceWriteData(t *testing.T) {
+	requests := [][]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/e/env"+dynatraceIngestPath || r.Header.Get("Authorization") != "Api-Token token" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		logs := []map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&logs); err != nil {
+			t.Errorf("expected a list of logs: %v", err)
+		}
+		requests = append(requests, logs)
+		if len(requests) == 2 {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	}))
+	defer server.Close()
+
+	pump := &DynatracePump{}
+	err := pump.Init(map[string]interface{}{
+		"url":        server.URL + "/e/env/",
+		"api_token":  "token",
+		"attributes": map[string]string{"tyk.api_key": "api_key"},
+		"batch_size": 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawRequest := "GET / HTTP/1.1\r\nHost: example.com\r\nTraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n\r\n"
+	data := []interface{}{
+		analytics.AnalyticsRecord{
+			APIID:        "api",
+			APIKey:       "key",
+			Method:       "GET",
+			Path:         "/",
+			ResponseCode: 200,
+			RequestTime:  12,
+			TimeStamp:    time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+			RawRequest:   base64.StdEncoding.EncodeToString([]byte(rawRequest)),
+		},
+		analytics.AnalyticsRecord{APIID: "api", ResponseCode: 502},
+		analytics.AnalyticsRecord{APIID: "other"},
+	}
+	failed, err := pump.WriteDataPartial(context.Background(), data)
+	if err == nil || len(failed) != 1 || failed[0].(analytics.AnalyticsRecord).APIID != "other" {
+		t.Errorf("expected the record of the rejected batch to fail, got %v: %v", failed, err)
+	}
+
+	if len(requests) != 2 || len(requests[0]) != 2 {
+		t.Fatalf("expected 2 batches, got %v", requests)
+	}
+	first := requests[0][0]
+	expected := map[string]interface{}{
+		"content":          "GET / 200",
+		"timestamp":        "2021-01-02T03:04:05Z",
+		"severity":         "INFO",
+		"log.source":       "tyk-pump",
+		"http.status_code": float64(200),
+		"duration":         float64(12),
+		"tyk.api_id":       "api",
+		"tyk.api_key":      "key",
+		"trace_id":         "4bf92f3577b34da6a3ce929d0e0e4736",
+		"span_id":          "00f067aa0ba902b7",
+	}
+	for name, value := range expected {
+		if first[name] != value {
+			t.Errorf("expected %s to be %v, got %v", name, value, first[name])
+		}
+	}
+	if requests[0][1]["severity"] != "ERROR" {
+		t.Errorf("expected the 5xx responses at ERROR severity, got %v", requests[0][1]["severity"])
+	}
+}
+
+func TestDynatraceInitUnknownAttributeField(t *testing.T) {
+	pump := &DynatracePump{}
+	err := pump.Init(map[string]interface{}{"url": "http://localhost", "api_token": "token", "attributes": map[string]string{"a": "nope"}})
+	if err == nil {
+		t.Error("expected an unknown record field to fail")
+	}
+}
@@ -3,6 +3,7 @@ package pumps
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -10,7 +11,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/mitchellh/mapstructure"
 	elasticv3 "gopkg.in/olivere/elastic.v3"
 	elasticv5 "gopkg.in/olivere/elastic.v5"
 	elasticv6 "gopkg.in/olivere/elastic.v6"
@@ -23,6 +23,10 @@ import (
 type ElasticsearchPump struct {
 	operator ElasticsearchOperator
 	esConf   *ElasticsearchConf
+	// transport is the transport of the requests to Elasticsearch, http.DefaultTransport without a tls block
+	transport http.RoundTripper
+	// signer signs the requests with the AWS Signature Version 4 when aws_sigv4 is set
+	signer *awsSigV4Transport
 	CommonPumpConfig
 }
 
@@ -30,22 +34,43 @@ var elasticsearchPrefix = "elasticsearch-pump"
 var elasticsearchDefaultENV = PUMPS_ENV_PREFIX + "_ELASTICSEARCH" + PUMPS_ENV_META_PREFIX
 
 type ElasticsearchConf struct {
-	EnvPrefix          string                  `mapstructure:"meta_env_prefix"`
-	IndexName          string                  `mapstructure:"index_name"`
-	ElasticsearchURL   string                  `mapstructure:"elasticsearch_url"`
-	EnableSniffing     bool                    `mapstructure:"use_sniffing"`
-	DocumentType       string                  `mapstructure:"document_type"`
-	RollingIndex       bool                    `mapstructure:"rolling_index"`
-	ExtendedStatistics bool                    `mapstructure:"extended_stats"`
-	GenerateID         bool                    `mapstructure:"generate_id"`
-	DecodeBase64       bool                    `mapstructure:"decode_base64"`
-	Version            string                  `mapstructure:"version"`
-	DisableBulk        bool                    `mapstructure:"disable_bulk"`
-	BulkConfig         ElasticsearchBulkConfig `mapstructure:"bulk_config"`
-	AuthAPIKeyID       string                  `mapstructure:"auth_api_key_id"`
-	AuthAPIKey         string                  `mapstructure:"auth_api_key"`
-	Username           string                  `mapstructure:"auth_basic_username"`
-	Password           string                  `mapstructure:"auth_basic_password"`
+	EnvPrefix            string                  `mapstructure:"meta_env_prefix"`
+	IndexName            string                  `mapstructure:"index_name"`
+	ElasticsearchURL     string                  `mapstructure:"elasticsearch_url"`
+	EnableSniffing       bool                    `mapstructure:"use_sniffing"`
+	DocumentType         string                  `mapstructure:"document_type"`
+	RollingIndex         bool                    `mapstructure:"rolling_index"`
+	ExtendedStatistics   bool                    `mapstructure:"extended_stats"`
+	GenerateID           bool                    `mapstructure:"generate_id"`
+	DecodeBase64         bool                    `mapstructure:"decode_base64"`
+	Version              string                  `mapstructure:"version"`
+	DisableBulk          bool                    `mapstructure:"disable_bulk"`
+	BulkConfig           ElasticsearchBulkConfig `mapstructure:"bulk_config"`
+	AuthAPIKeyID         string                  `mapstructure:"auth_api_key_id"`
+	AuthAPIKey           string                  `mapstructure:"auth_api_key"`
+	Username             string                  `mapstructure:"auth_basic_username"`
+	Password             string                  `mapstructure:"auth_basic_password"`
+	UptimeIndexName      string                  `mapstructure:"uptime_index_name"`
+	RetentionIndexSuffix bool                    `mapstructure:"retention_index_suffix"`
+	IDFields             []string                `mapstructure:"id_fields"`
+	// ECS indexes the records with the field names of the Elastic Common Schema
+	ECS bool `mapstructure:"ecs"`
+	// TLS configures the connections to Elasticsearch
+	TLS TLSConf `mapstructure:"tls"`
+	// AWSSigV4 signs the requests for Amazon OpenSearch Service, instead of the basic or API key auth
+	AWSSigV4 ElasticsearchAWSConf `mapstructure:"aws_sigv4"`
+}
+
+// ElasticsearchAWSConf configures the AWS Signature Version 4 of the requests, enabled by the region
+type ElasticsearchAWSConf struct {
+	Region string `mapstructure:"region"`
+	// Service is es, the default, for OpenSearch Service domains or aoss for OpenSearch Serverless
+	Service string `mapstructure:"service"`
+	// AccessKeyID, SecretAccessKey and SessionToken are the AWS credentials, taken from the AWS_ACCESS_KEY_ID,
+	// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables when not set, or from the IAM role otherwise
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SessionToken    string `mapstructure:"session_token"`
 }
 
 type ElasticsearchBulkConfig struct {
@@ -57,6 +82,9 @@ type ElasticsearchBulkConfig struct {
 
 type ElasticsearchOperator interface {
 	processData(ctx context.Context, data []interface{}, esConf *ElasticsearchConf) error
+	processUptimeData(ctx context.Context, data []analytics.UptimeReportData, esConf *ElasticsearchConf) error
+	flush() error
+	close() error
 }
 
 type Elasticsearch3Operator struct {
@@ -80,6 +108,8 @@ type Elasticsearch6Operator struct {
 type ApiKeyTransport struct {
 	APIKey   string
 	APIKeyID string
+	// Transport sends the requests, http.DefaultTransport when it's nil
+	Transport http.RoundTripper
 }
 
 //RoundTrip for ApiKeyTransport auth
@@ -89,6 +119,9 @@ func (t *ApiKeyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 
 	r.Header.Set("Authorization", "ApiKey "+key)
 
+	if t.Transport != nil {
+		return t.Transport.RoundTrip(r)
+	}
 	return http.DefaultTransport.RoundTrip(r)
 }
 
@@ -99,10 +132,17 @@ func (e *ElasticsearchPump) getOperator() (ElasticsearchOperator, error) {
 	urls := strings.Split(conf.ElasticsearchURL, ",")
 
 	httpClient := http.DefaultClient
-	if conf.AuthAPIKey != "" && conf.AuthAPIKeyID != "" {
+	if e.transport != nil {
+		httpClient = &http.Client{Transport: e.transport}
+	}
+	if e.signer != nil {
 		conf.Username = ""
 		conf.Password = ""
-		httpClient = &http.Client{Transport: &ApiKeyTransport{APIKey: conf.AuthAPIKey, APIKeyID: conf.AuthAPIKeyID}}
+		httpClient = &http.Client{Transport: e.signer}
+	} else if conf.AuthAPIKey != "" && conf.AuthAPIKeyID != "" {
+		conf.Username = ""
+		conf.Password = ""
+		httpClient = &http.Client{Transport: &ApiKeyTransport{APIKey: conf.AuthAPIKey, APIKeyID: conf.AuthAPIKeyID, Transport: e.transport}}
 	}
 
 	switch conf.Version {
@@ -216,9 +256,9 @@ func (e *ElasticsearchPump) GetEnvPrefix() string {
 
 func (e *ElasticsearchPump) Init(config interface{}) error {
 	e.esConf = &ElasticsearchConf{}
-	e.log = log.WithField("prefix", elasticsearchPrefix)
+	e.log = e.newLogger(elasticsearchPrefix)
 
-	loadConfigErr := mapstructure.Decode(config, &e.esConf)
+	loadConfigErr := decodePumpConfig(e, e.log, config, &e.esConf)
 	if loadConfigErr != nil {
 		e.log.Fatal("Failed to decode configuration: ", loadConfigErr)
 	}
@@ -233,6 +273,10 @@ func (e *ElasticsearchPump) Init(config interface{}) error {
 		e.esConf.ElasticsearchURL = "http://localhost:9200"
 	}
 
+	if "" == e.esConf.UptimeIndexName {
+		e.esConf.UptimeIndexName = defaultElasticsearchUptimeIndexName
+	}
+
 	if "" == e.esConf.DocumentType {
 		e.esConf.DocumentType = "tyk_analytics"
 	}
@@ -247,6 +291,41 @@ func (e *ElasticsearchPump) Init(config interface{}) error {
 		e.log.Fatal("Invalid version: ", err)
 	}
 
+	for _, field := range e.esConf.IDFields {
+		if !analytics.IsRecordField(field) {
+			return fmt.Errorf("unknown id field %s", field)
+		}
+	}
+
+	if e.esConf.TLS.IsSet() {
+		tlsConfig, err := e.esConf.TLS.ClientConfig("")
+		if err != nil {
+			return fmt.Errorf("invalid tls configuration: %v", err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		e.transport = transport
+	}
+
+	if e.esConf.AWSSigV4.Region != "" {
+		awsConf := e.esConf.AWSSigV4
+		if awsConf.Service == "" {
+			awsConf.Service = "es"
+		}
+		if awsConf.Service != "es" && awsConf.Service != "aoss" {
+			return fmt.Errorf("invalid aws_sigv4 service %q, must be es or aoss", awsConf.Service)
+		}
+		creds := newAWSCredentialsProvider(awsCredentials{
+			AccessKeyID:     awsConf.AccessKeyID,
+			SecretAccessKey: awsConf.SecretAccessKey,
+			SessionToken:    awsConf.SessionToken,
+		}, awsConf.Region)
+		if _, err := creds.get(context.Background()); err != nil {
+			return err
+		}
+		e.signer = &awsSigV4Transport{creds: creds, region: awsConf.Region, service: awsConf.Service, transport: e.transport}
+	}
+
 	var re = regexp.MustCompile(`(.*)\/\/(.*):(.*)\@(.*)`)
 	printableURL := re.ReplaceAllString(e.esConf.ElasticsearchURL, `$1//***:***@$4`)
 
@@ -273,24 +352,62 @@ func (e *ElasticsearchPump) connect() {
 	}
 }
 
+// Flush sends the documents queued in the bulk processor
+func (e *ElasticsearchPump) Flush() error {
+	if e.operator == nil {
+		return nil
+	}
+	return e.operator.flush()
+}
+
+// Close sends the queued documents and stops the workers of the bulk processor
+func (e *ElasticsearchPump) Close() error {
+	if e.operator == nil {
+		return nil
+	}
+	return e.operator.close()
+}
+
 func (e *ElasticsearchPump) WriteData(ctx context.Context, data []interface{}) error {
 	e.log.Debug("Attempting to write ", len(data), " records...")
 
 	if e.operator == nil {
 		e.log.Debug("Connecting to analytics store")
 		e.connect()
-		e.WriteData(ctx, data)
+		return e.WriteData(ctx, data)
 	} else {
 		if len(data) > 0 {
-			e.operator.processData(ctx, data, e.esConf)
+			return e.operator.processData(ctx, data, e.esConf)
 		}
 	}
 	return nil
 }
 
+// Preview returns the document the record would be indexed as
+func (e *ElasticsearchPump) Preview(record analytics.AnalyticsRecord) ([]byte, error) {
+	mapping, _ := getMapping(record, e.esConf.ExtendedStatistics, e.esConf.GenerateID, e.esConf.IDFields, e.esConf.DecodeBase64, e.esConf.ECS)
+	return json.Marshal(mapping)
+}
+
 func getIndexName(esConf *ElasticsearchConf) string {
-	indexName := esConf.IndexName
+	return rollIndexName(esConf, esConf.IndexName)
+}
+
+// getRecordIndexName returns the index of the record, suffixed with its retention in days when retention_index_suffix
+// is enabled, so an ILM policy can be attached to the indices of every retention
+func getRecordIndexName(esConf *ElasticsearchConf, record *analytics.AnalyticsRecord) string {
+	if !esConf.RetentionIndexSuffix {
+		return getIndexName(esConf)
+	}
+
+	days := record.RetentionDays()
+	if days == 0 {
+		return getIndexName(esConf)
+	}
+	return rollIndexName(esConf, fmt.Sprintf("%s-%dd", esConf.IndexName, days))
+}
 
+func rollIndexName(esConf *ElasticsearchConf, indexName string) string {
 	if esConf.RollingIndex {
 		currentTime := time.Now()
 		//This formats the date to be YYYY.MM.DD but Golang makes you use a specific date for its date formatting
@@ -299,34 +416,74 @@ func getIndexName(esConf *ElasticsearchConf) string {
 	return indexName
 }
 
-func getMapping(datum analytics.AnalyticsRecord, extendedStatistics bool, generateID bool, decodeBase64 bool) (map[string]interface{}, string) {
+// getMapping returns the document of the record and its ID when generateID is set: the hash of its idFields, or of its
+// timestamp, method, path, IP address, API, OAuth client, request time and alias when there are none. With ecs, the
+// document has the field names of the Elastic Common Schema, and the raw request and response are under tyk.
+func getMapping(datum analytics.AnalyticsRecord, extendedStatistics bool, generateID bool, idFields []string, decodeBase64 bool, ecs bool) (map[string]interface{}, string) {
 	record := datum
 
+	if ecs {
+		mapping := record.ECSDocument()
+		if extendedStatistics {
+			rawRequest, rawResponse := record.RawRequest, record.RawResponse
+			if decodeBase64 {
+				rawRequest, rawResponse = decodeRaw(rawRequest), decodeRaw(rawResponse)
+			}
+			tyk := mapping["tyk"].(map[string]interface{})
+			tyk["raw_request"] = rawRequest
+			tyk["raw_response"] = rawResponse
+		}
+		return mapping, recordID(record, generateID, idFields)
+	}
+
 	mapping := map[string]interface{}{
-		"@timestamp":       record.TimeStamp,
-		"http_method":      record.Method,
-		"request_uri":      record.Path,
-		"request_uri_full": record.RawPath,
-		"response_code":    record.ResponseCode,
-		"ip_address":       record.IPAddress,
-		"api_key":          record.APIKey,
-		"api_version":      record.APIVersion,
-		"api_name":         record.APIName,
-		"api_id":           record.APIID,
-		"org_id":           record.OrgID,
-		"oauth_id":         record.OauthID,
-		"request_time_ms":  record.RequestTime,
-		"alias":            record.Alias,
-		"content_length":   record.ContentLength,
-		"tags":             record.Tags,
+		"@timestamp":              record.TimeStamp,
+		"http_method":             record.Method,
+		"request_uri":             record.Path,
+		"request_uri_full":        record.RawPath,
+		"response_code":           record.ResponseCode,
+		"ip_address":              record.IPAddress,
+		"api_key":                 record.APIKey,
+		"api_version":             record.APIVersion,
+		"api_name":                record.APIName,
+		"api_id":                  record.APIID,
+		"org_id":                  record.OrgID,
+		"oauth_id":                record.OauthID,
+		"request_time_ms":         record.RequestTime,
+		"alias":                   record.Alias,
+		"content_length":          record.ContentLength,
+		"response_content_length": record.ResponseContentLength,
+		"tags":                    record.Tags,
+		"error_class":             record.ErrorClass,
+		"trace_id":                record.TraceID,
+		"span_id":                 record.SpanID,
+		"correlation_id":          record.CorrelationID,
+	}
+
+	if record.GraphQL.OperationType != "" {
+		mapping["graphql"] = record.GraphQL
+	}
+
+	if record.Portal.DeveloperID != "" {
+		mapping["portal"] = record.Portal
+	}
+
+	if record.GRPC.Method != "" {
+		mapping["grpc"] = record.GRPC
+	}
+
+	if len(record.ResponseHeaders) > 0 {
+		mapping["response_headers"] = record.ResponseHeaders
+	}
+
+	if len(record.BodyFields) > 0 {
+		mapping["body_fields"] = record.BodyFields
 	}
 
 	if extendedStatistics {
 		if decodeBase64 {
-			rawRequest, _ := base64.StdEncoding.DecodeString(record.RawRequest)
-			mapping["raw_request"] = string(rawRequest)
-			rawResponse, _ := base64.StdEncoding.DecodeString(record.RawResponse)
-			mapping["raw_response"] = string(rawResponse)
+			mapping["raw_request"] = decodeRaw(record.RawRequest)
+			mapping["raw_response"] = decodeRaw(record.RawResponse)
 		} else {
 			mapping["raw_request"] = record.RawRequest
 			mapping["raw_response"] = record.RawResponse
@@ -334,22 +491,36 @@ func getMapping(datum analytics.AnalyticsRecord, extendedStatistics bool, genera
 		mapping["user_agent"] = record.UserAgent
 	}
 
-	if generateID {
-		hasher := murmur3.New64()
-		hasher.Write([]byte(fmt.Sprintf("%d%s%s%s%s%s%d%s", record.TimeStamp.UnixNano(), record.Method, record.Path, record.IPAddress, record.APIID, record.OauthID, record.RequestTime, record.Alias)))
+	return mapping, recordID(record, generateID, idFields)
+}
 
-		return mapping, string(hasher.Sum(nil))
+// recordID returns the ID of the document of the record when generateID is set
+func recordID(record analytics.AnalyticsRecord, generateID bool, idFields []string) string {
+	if !generateID {
+		return ""
 	}
+	if len(idFields) > 0 {
+		return record.HashFields(idFields)
+	}
+
+	hasher := murmur3.New64()
+	hasher.Write([]byte(fmt.Sprintf("%d%s%s%s%s%s%d%s", record.TimeStamp.UnixNano(), record.Method, record.Path, record.IPAddress, record.APIID, record.OauthID, record.RequestTime, record.Alias)))
 
-	return mapping, ""
+	return string(hasher.Sum(nil))
+}
+
+// decodeRaw decodes the base64 raw request or response
+func decodeRaw(raw string) string {
+	decoded, _ := base64.StdEncoding.DecodeString(raw)
+	return string(decoded)
 }
 
 func (e Elasticsearch3Operator) processData(ctx context.Context, data []interface{}, esConf *ElasticsearchConf) error {
-	index := e.esClient.Index().Index(getIndexName(esConf))
+	index := e.esClient.Index()
 
 	for dataIndex := range data {
 		if ctxErr := ctx.Err(); ctxErr != nil {
-			continue
+			return ctxErr
 		}
 
 		d, ok := data[dataIndex].(analytics.AnalyticsRecord)
@@ -358,13 +529,14 @@ func (e Elasticsearch3Operator) processData(ctx context.Context, data []interfac
 			continue
 		}
 
-		mapping, id := getMapping(d, esConf.ExtendedStatistics, esConf.GenerateID, esConf.DecodeBase64)
+		mapping, id := getMapping(d, esConf.ExtendedStatistics, esConf.GenerateID, esConf.IDFields, esConf.DecodeBase64, esConf.ECS)
+		indexName := getRecordIndexName(esConf, &d)
 
 		if !esConf.DisableBulk {
-			r := elasticv3.NewBulkIndexRequest().Index(getIndexName(esConf)).Type(esConf.DocumentType).Id(id).Doc(mapping)
+			r := elasticv3.NewBulkIndexRequest().Index(indexName).Type(esConf.DocumentType).Id(id).Doc(mapping)
 			e.bulkProcessor.Add(r)
 		} else {
-			_, err := index.BodyJson(mapping).Type(esConf.DocumentType).Id(id).DoC(ctx)
+			_, err := index.Index(indexName).BodyJson(mapping).Type(esConf.DocumentType).Id(id).DoC(ctx)
 			if err != nil {
 				e.log.Error("Error while writing ", data[dataIndex], err)
 			}
@@ -375,12 +547,22 @@ func (e Elasticsearch3Operator) processData(ctx context.Context, data []interfac
 	return nil
 }
 
+// flush sends the documents queued in the bulk processor
+func (e Elasticsearch3Operator) flush() error {
+	return e.bulkProcessor.Flush()
+}
+
+// close sends the documents queued in the bulk processor and stops its workers
+func (e Elasticsearch3Operator) close() error {
+	return e.bulkProcessor.Close()
+}
+
 func (e Elasticsearch5Operator) processData(ctx context.Context, data []interface{}, esConf *ElasticsearchConf) error {
-	index := e.esClient.Index().Index(getIndexName(esConf))
+	index := e.esClient.Index()
 
 	for dataIndex := range data {
 		if ctxErr := ctx.Err(); ctxErr != nil {
-			continue
+			return ctxErr
 		}
 
 		d, ok := data[dataIndex].(analytics.AnalyticsRecord)
@@ -389,13 +571,14 @@ func (e Elasticsearch5Operator) processData(ctx context.Context, data []interfac
 			continue
 		}
 
-		mapping, id := getMapping(d, esConf.ExtendedStatistics, esConf.GenerateID, esConf.DecodeBase64)
+		mapping, id := getMapping(d, esConf.ExtendedStatistics, esConf.GenerateID, esConf.IDFields, esConf.DecodeBase64, esConf.ECS)
+		indexName := getRecordIndexName(esConf, &d)
 
 		if !esConf.DisableBulk {
-			r := elasticv5.NewBulkIndexRequest().Index(getIndexName(esConf)).Type(esConf.DocumentType).Id(id).Doc(mapping)
+			r := elasticv5.NewBulkIndexRequest().Index(indexName).Type(esConf.DocumentType).Id(id).Doc(mapping)
 			e.bulkProcessor.Add(r)
 		} else {
-			_, err := index.BodyJson(mapping).Type(esConf.DocumentType).Id(id).Do(ctx)
+			_, err := index.Index(indexName).BodyJson(mapping).Type(esConf.DocumentType).Id(id).Do(ctx)
 			if err != nil {
 				e.log.Error("Error while writing ", data[dataIndex], err)
 			}
@@ -406,12 +589,22 @@ func (e Elasticsearch5Operator) processData(ctx context.Context, data []interfac
 	return nil
 }
 
+// flush sends the documents queued in the bulk processor
+func (e Elasticsearch5Operator) flush() error {
+	return e.bulkProcessor.Flush()
+}
+
+// close sends the documents queued in the bulk processor and stops its workers
+func (e Elasticsearch5Operator) close() error {
+	return e.bulkProcessor.Close()
+}
+
 func (e Elasticsearch6Operator) processData(ctx context.Context, data []interface{}, esConf *ElasticsearchConf) error {
-	index := e.esClient.Index().Index(getIndexName(esConf))
+	index := e.esClient.Index()
 
 	for dataIndex := range data {
 		if ctxErr := ctx.Err(); ctxErr != nil {
-			continue
+			return ctxErr
 		}
 
 		d, ok := data[dataIndex].(analytics.AnalyticsRecord)
@@ -420,13 +613,14 @@ func (e Elasticsearch6Operator) processData(ctx context.Context, data []interfac
 			continue
 		}
 
-		mapping, id := getMapping(d, esConf.ExtendedStatistics, esConf.GenerateID, esConf.DecodeBase64)
+		mapping, id := getMapping(d, esConf.ExtendedStatistics, esConf.GenerateID, esConf.IDFields, esConf.DecodeBase64, esConf.ECS)
+		indexName := getRecordIndexName(esConf, &d)
 
 		if !esConf.DisableBulk {
-			r := elasticv6.NewBulkIndexRequest().Index(getIndexName(esConf)).Type(esConf.DocumentType).Id(id).Doc(mapping)
+			r := elasticv6.NewBulkIndexRequest().Index(indexName).Type(esConf.DocumentType).Id(id).Doc(mapping)
 			e.bulkProcessor.Add(r)
 		} else {
-			_, err := index.BodyJson(mapping).Type(esConf.DocumentType).Id(id).Do(ctx)
+			_, err := index.Index(indexName).BodyJson(mapping).Type(esConf.DocumentType).Id(id).Do(ctx)
 			if err != nil {
 				e.log.Error("Error while writing ", data[dataIndex], err)
 			}
@@ -436,3 +630,13 @@ func (e Elasticsearch6Operator) processData(ctx context.Context, data []interfac
 
 	return nil
 }
+
+// flush sends the documents queued in the bulk processor
+func (e Elasticsearch6Operator) flush() error {
+	return e.bulkProcessor.Flush()
+}
+
+// close sends the documents queued in the bulk processor and stops its workers
+func (e Elasticsearch6Operator) close() error {
+	return e.bulkProcessor.Close()
+}
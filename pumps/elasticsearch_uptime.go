@@ -0,0 +1,90 @@
+package pumps
+
+import (
+	"context"
+	"time"
+
+	elasticv3 "gopkg.in/olivere/elastic.v3"
+	elasticv5 "gopkg.in/olivere/elastic.v5"
+	elasticv6 "gopkg.in/olivere/elastic.v6"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const defaultElasticsearchUptimeIndexName = "tyk_uptime_analytics"
+
+// WriteUptimeData writes the uptime reports of the Gateway host checker to the uptime index
+func (e *ElasticsearchPump) WriteUptimeData(data []interface{}) {
+	if len(data) == 0 {
+		return
+	}
+
+	if e.operator == nil {
+		e.log.Debug("Connecting to analytics store")
+		e.connect()
+	}
+
+	reports := decodeUptimeData(e.log, data)
+	if err := e.operator.processUptimeData(context.Background(), reports, e.esConf); err != nil {
+		e.log.Error("Error while writing uptime data: ", err)
+	}
+}
+
+func getUptimeIndexName(esConf *ElasticsearchConf) string {
+	indexName := esConf.UptimeIndexName
+	if esConf.RollingIndex {
+		indexName += "-" + time.Now().Format("2006.01.02")
+	}
+	return indexName
+}
+
+func getUptimeMapping(report analytics.UptimeReportData) map[string]interface{} {
+	mapping := uptimeMapping(report)
+	mapping["@timestamp"] = report.TimeStamp
+	return mapping
+}
+
+func (e Elasticsearch3Operator) processUptimeData(ctx context.Context, data []analytics.UptimeReportData, esConf *ElasticsearchConf) error {
+	index := getUptimeIndexName(esConf)
+	for _, report := range data {
+		if esConf.DisableBulk {
+			if _, err := e.esClient.Index().Index(index).Type(esConf.DocumentType).BodyJson(getUptimeMapping(report)).DoC(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		e.bulkProcessor.Add(elasticv3.NewBulkIndexRequest().Index(index).Type(esConf.DocumentType).Doc(getUptimeMapping(report)))
+	}
+	e.log.Info("Purged ", len(data), " uptime records...")
+	return nil
+}
+
+func (e Elasticsearch5Operator) processUptimeData(ctx context.Context, data []analytics.UptimeReportData, esConf *ElasticsearchConf) error {
+	index := getUptimeIndexName(esConf)
+	for _, report := range data {
+		if esConf.DisableBulk {
+			if _, err := e.esClient.Index().Index(index).Type(esConf.DocumentType).BodyJson(getUptimeMapping(report)).Do(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		e.bulkProcessor.Add(elasticv5.NewBulkIndexRequest().Index(index).Type(esConf.DocumentType).Doc(getUptimeMapping(report)))
+	}
+	e.log.Info("Purged ", len(data), " uptime records...")
+	return nil
+}
+
+func (e Elasticsearch6Operator) processUptimeData(ctx context.Context, data []analytics.UptimeReportData, esConf *ElasticsearchConf) error {
+	index := getUptimeIndexName(esConf)
+	for _, report := range data {
+		if esConf.DisableBulk {
+			if _, err := e.esClient.Index().Index(index).Type(esConf.DocumentType).BodyJson(getUptimeMapping(report)).Do(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		e.bulkProcessor.Add(elasticv6.NewBulkIndexRequest().Index(index).Type(esConf.DocumentType).Doc(getUptimeMapping(report)))
+	}
+	e.log.Info("Purged ", len(data), " uptime records...")
+	return nil
+}
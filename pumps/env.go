@@ -0,0 +1,158 @@
+package pumps
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/mitchellh/mapstructure"
+)
+
+// envField is a configuration option which can be set with an environment variable
+type envField struct {
+	key   string
+	value reflect.Value
+	// json is whether the option is a list, a map or a nested struct, which can be set with JSON
+	json bool
+}
+
+// envFields returns the options of cfg, a pointer to a struct, which can be set with environment variables of the
+// prefix. They have the keys envconfig gives them: the prefix and the field name, or its envconfig tag, in upper case.
+// The options of a nested struct are under the key of the struct, which is returned too as it can be set with JSON as
+// a whole.
+func envFields(prefix string, cfg interface{}) []envField {
+	value := reflect.ValueOf(cfg)
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	fields := []envField{}
+	for i := 0; i < value.NumField(); i++ {
+		field, structField := value.Field(i), value.Type().Field(i)
+		if !field.CanSet() || structField.Tag.Get("ignored") == "true" {
+			continue
+		}
+
+		name := structField.Name
+		if tag := structField.Tag.Get("envconfig"); tag != "" {
+			name = tag
+		}
+		key := strings.ToUpper(prefix + "_" + name)
+
+		// envconfig allocates the nil pointers to structs, so their options can be set
+		for field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				if field.Type().Elem().Kind() != reflect.Struct {
+					break
+				}
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+
+		switch field.Kind() {
+		case reflect.Struct:
+			if decodesEnv(field) {
+				fields = append(fields, envField{key: key, value: field})
+				continue
+			}
+			innerPrefix := key
+			if structField.Anonymous {
+				innerPrefix = strings.ToUpper(prefix)
+			} else {
+				fields = append(fields, envField{key: key, value: field, json: true})
+			}
+			fields = append(fields, envFields(innerPrefix, field.Addr().Interface())...)
+		case reflect.Slice, reflect.Map, reflect.Interface:
+			fields = append(fields, envField{key: key, value: field, json: !decodesEnv(field)})
+		default:
+			fields = append(fields, envField{key: key, value: field})
+		}
+	}
+	return fields
+}
+
+// decodesEnv returns whether the field decodes its environment variable itself
+func decodesEnv(field reflect.Value) bool {
+	if !field.CanAddr() {
+		return false
+	}
+	switch field.Addr().Interface().(type) {
+	case envconfig.Decoder, envconfig.Setter, encoding.TextUnmarshaler, encoding.BinaryUnmarshaler:
+		return true
+	}
+	return false
+}
+
+// processEnv overrides cfg with the environment variables of the prefix like envconfig.Process, except for the lists,
+// maps and nested structs set with JSON, like ["a","b"] or {"a":1}, which are decoded with the keys of tagName, json or
+// mapstructure. envconfig only supports the lists and maps of single values, as comma separated values.
+func processEnv(prefix string, cfg interface{}, tagName string) error {
+	for _, field := range envFields(prefix, cfg) {
+		value, ok := os.LookupEnv(field.key)
+		trimmed := strings.TrimSpace(value)
+		if !ok || !field.json || !(strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{")) {
+			continue
+		}
+
+		field.value.Set(reflect.Zero(field.value.Type()))
+		if err := decodeJSONEnv(trimmed, field.value.Addr().Interface(), tagName); err != nil {
+			return fmt.Errorf("invalid JSON in %s: %v", field.key, err)
+		}
+
+		// envconfig would parse the JSON again as comma separated values
+		os.Unsetenv(field.key)
+		defer os.Setenv(field.key, value)
+	}
+	return envconfig.Process(prefix, cfg)
+}
+
+// decodeJSONEnv decodes the JSON value into target with the keys of tagName
+func decodeJSONEnv(value string, target interface{}, tagName string) error {
+	if tagName == "json" {
+		return json.Unmarshal([]byte(value), target)
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return err
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{TagName: tagName, Result: target})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(raw)
+}
+
+// unknownEnvVars returns the environment variables of the prefix which don't map to any option of cfg
+func unknownEnvVars(prefix string, cfg interface{}) []string {
+	keys := map[string]bool{}
+	for _, field := range envFields(prefix, cfg) {
+		keys[field.key] = true
+	}
+
+	unknown := []string{}
+	for _, env := range os.Environ() {
+		key := strings.SplitN(env, "=", 2)[0]
+		if strings.HasPrefix(key, strings.ToUpper(prefix)+"_") && !keys[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	return unknown
+}
+
+// ProcessEnv overrides cfg, the configuration of Tyk Pump, with the environment variables of the prefix. The lists,
+// maps and nested structs can be set with JSON.
+func ProcessEnv(prefix string, cfg interface{}) error {
+	return processEnv(prefix, cfg, "json")
+}
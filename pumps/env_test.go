@@ -0,0 +1,62 @@
+package pumps
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestProcessEnv(t *testing.T) {
+	type conf struct {
+		Fields  []string          `mapstructure:"fields"`
+		Headers map[string]string `mapstructure:"headers"`
+		TLS     TLSConf           `mapstructure:"tls"`
+		Retries int               `mapstructure:"retries"`
+	}
+	env := map[string]string{
+		"TEST_ENV_FIELDS":      `["api_id","path"]`,
+		"TEST_ENV_HEADERS":     "a:1,b:2",
+		"TEST_ENV_TLS":         `{"ca_file":"ca.pem","cipher_suites":["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"]}`,
+		"TEST_ENV_TLS_KEYFILE": "key.pem",
+		"TEST_ENV_RETRIES":     "3",
+		"TEST_ENV_RETRYS":      "3",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+	}
+	defer func() {
+		for key := range env {
+			os.Unsetenv(key)
+		}
+	}()
+
+	cfg := conf{Fields: []string{"method"}}
+	if err := processEnv("TEST_ENV", &cfg, "mapstructure"); err != nil {
+		t.Fatal(err)
+	}
+	expected := conf{
+		Fields:  []string{"api_id", "path"},
+		Headers: map[string]string{"a": "1", "b": "2"},
+		TLS: TLSConf{
+			CAFile:       "ca.pem",
+			KeyFile:      "key.pem",
+			CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		},
+		Retries: 3,
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("expected %+v, got %+v", expected, cfg)
+	}
+	if os.Getenv("TEST_ENV_FIELDS") != `["api_id","path"]` {
+		t.Error("expected the environment to be restored")
+	}
+
+	if unknown := unknownEnvVars("TEST_ENV", &cfg); !reflect.DeepEqual(unknown, []string{"TEST_ENV_RETRYS"}) {
+		t.Errorf("expected only the typo to be unknown, got %v", unknown)
+	}
+
+	os.Setenv("TEST_ENV_FIELDS", `["api_id"`)
+	if err := processEnv("TEST_ENV", &cfg, "mapstructure"); err == nil {
+		t.Error("expected invalid JSON to fail")
+	}
+}
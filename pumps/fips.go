@@ -0,0 +1,10 @@
+//go:build boringcrypto
+// +build boringcrypto
+
+package pumps
+
+// fipsonly restricts the TLS connections to the FIPS-approved versions and algorithms
+import _ "crypto/tls/fipsonly"
+
+// FIPSMode is whether Tyk Pump is built with the FIPS-validated BoringCrypto module, with GOEXPERIMENT=boringcrypto
+const FIPSMode = true
@@ -0,0 +1,328 @@
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	fireboltPrefix     = "firebolt-pump"
+	fireboltDefaultENV = PUMPS_ENV_PREFIX + "_FIREBOLT" + PUMPS_ENV_META_PREFIX
+
+	defaultFireboltIDURL     = "https://id.app.firebolt.io"
+	defaultFireboltAPIURL    = "https://api.app.firebolt.io"
+	defaultFireboltTable     = "tyk_analytics"
+	defaultFireboltBatchSize = 1000
+	// fireboltTokenRenewal is how long before expiring an access token is renewed
+	fireboltTokenRenewal = time.Minute
+)
+
+var fireboltIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// fireboltTypes are the SQL types of the columns
+var fireboltTypes = map[columnType]string{
+	columnTimestamp: "TIMESTAMP",
+	columnString:    "TEXT",
+	columnInteger:   "BIGINT",
+}
+
+// FireboltPump inserts the analytics records into a Firebolt table through the REST API of an engine, authenticating
+// with a service account, in batches of up to batch_size rows
+type FireboltPump struct {
+	conf      *FireboltConf
+	client    *http.Client
+	engineURL string
+
+	tokenMu     sync.Mutex
+	token       string
+	tokenExpiry time.Time
+
+	CommonPumpConfig
+}
+
+// FireboltConf configures the Firebolt pump
+type FireboltConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	// ClientID and ClientSecret are the credentials of the service account
+	ClientID     string `mapstructure:"client_id"`
+	ClientSecret string `mapstructure:"client_secret"`
+	// Account is the name of the Firebolt account
+	Account  string `mapstructure:"account"`
+	Engine   string `mapstructure:"engine"`
+	Database string `mapstructure:"database"`
+	// Table is the table the records are inserted into, tyk_analytics by default
+	Table string `mapstructure:"table"`
+	// EngineURL is the URL of the engine. By default it's looked up by account.
+	EngineURL string `mapstructure:"engine_url"`
+	// IDURL and APIURL are the URLs of the Firebolt authentication and API services
+	IDURL  string `mapstructure:"id_url"`
+	APIURL string `mapstructure:"api_url"`
+	// BatchSize is the maximum number of rows inserted by a query, 1000 by default
+	BatchSize int `mapstructure:"batch_size"`
+	// CreateTable creates the table on start when it doesn't exist
+	CreateTable bool `mapstructure:"create_table"`
+}
+
+func (f *FireboltPump) New() Pump {
+	newPump := FireboltPump{}
+	return &newPump
+}
+
+func (f *FireboltPump) GetName() string {
+	return "Firebolt Pump"
+}
+
+func (f *FireboltPump) GetEnvPrefix() string {
+	return f.conf.EnvPrefix
+}
+
+func (f *FireboltPump) Init(config interface{}) error {
+	f.conf = &FireboltConf{}
+	f.log = f.newLogger(fireboltPrefix)
+
+	if err := decodePumpConfig(f, f.log, config, &f.conf); err != nil {
+		f.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(f, f.log, f.conf, fireboltDefaultENV)
+
+	if f.conf.ClientID == "" || f.conf.ClientSecret == "" || f.conf.Engine == "" || f.conf.Database == "" {
+		return errors.New("client_id, client_secret, engine and database must be set")
+	}
+	if f.conf.EngineURL == "" && f.conf.Account == "" {
+		return errors.New("account or engine_url must be set")
+	}
+	if f.conf.Table == "" {
+		f.conf.Table = defaultFireboltTable
+	}
+	if !fireboltIdentifier.MatchString(f.conf.Table) {
+		return fmt.Errorf("invalid table name %q", f.conf.Table)
+	}
+	if f.conf.IDURL == "" {
+		f.conf.IDURL = defaultFireboltIDURL
+	}
+	if f.conf.APIURL == "" {
+		f.conf.APIURL = defaultFireboltAPIURL
+	}
+	if f.conf.BatchSize <= 0 {
+		f.conf.BatchSize = defaultFireboltBatchSize
+	}
+	f.client = &http.Client{Timeout: 60 * time.Second}
+
+	f.engineURL = f.conf.EngineURL
+	if f.engineURL == "" {
+		engineURL, err := f.lookupEngineURL(context.Background())
+		if err != nil {
+			return fmt.Errorf("couldn't look up the engine URL: %v", err)
+		}
+		f.engineURL = engineURL
+	}
+	if !strings.Contains(f.engineURL, "://") {
+		f.engineURL = "https://" + f.engineURL
+	}
+
+	if f.conf.CreateTable && !f.dryRun {
+		statement := sqlCreateTable(f.conf.Table, fireboltTypes, fireboltQuote) + ` PRIMARY INDEX "timestamp"`
+		if err := f.query(context.Background(), statement); err != nil {
+			return fmt.Errorf("couldn't create the table: %v", err)
+		}
+		for _, statement := range sqlAddColumns(f.conf.Table, fireboltTypes, fireboltQuote, true) {
+			if err := f.query(context.Background(), statement); err != nil {
+				return fmt.Errorf("couldn't add the new columns to the table: %v", err)
+			}
+		}
+	}
+
+	f.log.Info(f.GetName() + " Initialized")
+	return nil
+}
+
+func fireboltQuote(name string) string {
+	return `"` + name + `"`
+}
+
+// fireboltInsert returns the INSERT query of the records, with their values as literals as the REST API doesn't take
+// parameters
+func fireboltInsert(table string, records []interface{}) string {
+	rows := make([]string, 0, len(records))
+	for _, v := range records {
+		record := v.(analytics.AnalyticsRecord)
+		values := make([]string, len(analyticsColumns))
+		for i, column := range analyticsColumns {
+			values[i] = fireboltLiteral(column.value(&record))
+		}
+		rows = append(rows, "("+strings.Join(values, ", ")+")")
+	}
+
+	return "INSERT INTO " + table + " " + sqlColumnList(fireboltQuote) + " VALUES " + strings.Join(rows, ", ")
+}
+
+// fireboltLiteral returns the SQL literal of the column value
+func fireboltLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case time.Time:
+		return "'" + formatTimestamp(v) + "'"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		return "'" + strings.Replace(fmt.Sprint(v), "'", "''", -1) + "'"
+	}
+}
+
+func (f *FireboltPump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := f.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial inserts the records in batches of up to batch_size rows, returning the records of the batches that
+// failed and of the ones left at the deadline
+func (f *FireboltPump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
+	f.log.Debug("Attempting to write ", len(data), " records...")
+
+	failed := []interface{}{}
+	var lastErr error
+	for start := 0; start < len(data); start += f.conf.BatchSize {
+		end := start + f.conf.BatchSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return append(failed, data[start:]...), err
+		}
+
+		batch := data[start:end]
+		if err := f.query(ctx, fireboltInsert(f.conf.Table, batch)); err != nil {
+			f.log.WithField("rows", len(batch)).Error("Failed to insert the records: ", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return append(failed, data[start:]...), ctxErr
+			}
+			failed = append(failed, batch...)
+			lastErr = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("failed to write %d of %d records: %v", len(failed), len(data), lastErr)
+	}
+	f.log.Info("Purged ", len(data), " records...")
+	return nil, nil
+}
+
+// query runs the SQL query on the engine
+func (f *FireboltPump) query(ctx context.Context, statement string) error {
+	params := url.Values{}
+	params.Set("database", f.conf.Database)
+	params.Set("engine", f.conf.Engine)
+
+	engineURL := strings.TrimSuffix(f.engineURL, "/")
+	separator := "?"
+	if strings.Contains(engineURL, "?") {
+		separator = "&"
+	}
+	req, err := http.NewRequest(http.MethodPost, engineURL+separator+params.Encode(), strings.NewReader(statement))
+	if err != nil {
+		return err
+	}
+	_, err = f.do(ctx, req)
+	return err
+}
+
+// lookupEngineURL returns the URL of the system engine of the account, which runs the queries of the named engine
+func (f *FireboltPump) lookupEngineURL(ctx context.Context) (string, error) {
+	lookupURL := strings.TrimSuffix(f.conf.APIURL, "/") + "/web/v3/account/" + url.PathEscape(f.conf.Account) + "/engineUrl"
+	req, err := http.NewRequest(http.MethodGet, lookupURL, nil)
+	if err != nil {
+		return "", err
+	}
+	body, err := f.do(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	engine := struct {
+		EngineURL string `json:"engineUrl"`
+	}{}
+	if err := json.Unmarshal(body, &engine); err != nil || engine.EngineURL == "" {
+		return "", fmt.Errorf("unexpected response %s", body)
+	}
+	return engine.EngineURL, nil
+}
+
+// do sends the request authenticated with the access token, returning the body of the response
+func (f *FireboltPump) do(ctx context.Context, req *http.Request) ([]byte, error) {
+	token, err := f.getToken(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("firebolt responded with status %d: %s", resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+// getToken returns the access token of the service account, renewing it when it's about to expire at now
+func (f *FireboltPump) getToken(ctx context.Context, now time.Time) (string, error) {
+	f.tokenMu.Lock()
+	defer f.tokenMu.Unlock()
+
+	if f.token != "" && now.Add(fireboltTokenRenewal).Before(f.tokenExpiry) {
+		return f.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", f.conf.ClientID)
+	form.Set("client_secret", f.conf.ClientSecret)
+	form.Set("audience", "https://api.firebolt.io")
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(f.conf.IDURL, "/")+"/oauth/token", bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("couldn't authenticate, firebolt responded with status %d: %s", resp.StatusCode, body)
+	}
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("couldn't authenticate, unexpected response %s", body)
+	}
+
+	f.token, f.tokenExpiry = token.AccessToken, now.Add(time.Duration(token.ExpiresIn)*time.Second)
+	return f.token, nil
+}
@@ -0,0 +1,84 @@
+package pumps
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestFireboltWriteData(t *testing.T) {
+	tokens := 0
+	queries := []string{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/token":
+			r.ParseForm()
+			if r.PostForm.Get("client_id") != "id" || r.PostForm.Get("client_secret") != "secret" {
+				t.Errorf("unexpected credentials %v", r.PostForm)
+			}
+			tokens++
+			w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+		case "/web/v3/account/tyk/engineUrl":
+			w.Write([]byte(`{"engineUrl":"` + server.URL + `/engine?account_id=1"}`))
+		case "/engine":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("expected the access token, got %q", r.Header.Get("Authorization"))
+			}
+			if r.URL.Query().Get("database") != "analytics" || r.URL.Query().Get("engine") != "ingest" || r.URL.Query().Get("account_id") != "1" {
+				t.Errorf("unexpected query parameters %s", r.URL.RawQuery)
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			queries = append(queries, string(body))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	pump := &FireboltPump{}
+	err := pump.Init(map[string]interface{}{
+		"client_id":     "id",
+		"client_secret": "secret",
+		"account":       "tyk",
+		"engine":        "ingest",
+		"database":      "analytics",
+		"id_url":        server.URL,
+		"api_url":       server.URL,
+		"create_table":  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{APIID: "1", APIName: "it's", ResponseCode: 200, TimeStamp: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)},
+		analytics.AnalyticsRecord{APIID: "2"},
+	}
+	if err := pump.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	if tokens != 1 {
+		t.Errorf("expected the access token to be reused, got %d tokens", tokens)
+	}
+	if len(queries) != 5 || !strings.HasSuffix(queries[0], `PRIMARY INDEX "timestamp"`) {
+		t.Fatalf("expected the CREATE TABLE, the ALTER TABLEs and an INSERT, got %v", queries)
+	}
+	if queries[3] != `ALTER TABLE tyk_analytics ADD COLUMN IF NOT EXISTS "correlation_id" TEXT` {
+		t.Errorf("unexpected ALTER TABLE %s", queries[3])
+	}
+	insert := queries[4]
+	if !strings.HasPrefix(insert, `INSERT INTO tyk_analytics ("timestamp", "org_id"`) || strings.Count(insert, "('") != 2 {
+		t.Errorf("expected an INSERT of 2 rows, got %s", insert)
+	}
+	if !strings.Contains(insert, "('2021-01-02 03:04:05.000000000', '', '1', 'it''s'") || !strings.Contains(insert, ", 200, ") {
+		t.Errorf("unexpected values in %s", insert)
+	}
+}
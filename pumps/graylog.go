@@ -5,14 +5,11 @@ import (
 	"encoding/base64"
 	"encoding/json"
 
-	"github.com/mitchellh/mapstructure"
-	gelf "github.com/robertkowalski/graylog-golang"
-
 	"github.com/TykTechnologies/tyk-pump/analytics"
 )
 
 type GraylogPump struct {
-	client *gelf.Gelf
+	client gelfWriter
 	conf   *GraylogConf
 	CommonPumpConfig
 }
@@ -22,6 +19,31 @@ type GraylogConf struct {
 	GraylogHost string   `mapstructure:"host"`
 	GraylogPort int      `mapstructure:"port"`
 	Tags        []string `mapstructure:"tags"`
+	// Transport is udp, the default, tcp or tls
+	Transport string `mapstructure:"transport"`
+	// Compression is the compression of the UDP messages: zlib, the default, gzip or none. GELF doesn't support
+	// compression over TCP.
+	Compression string `mapstructure:"compression"`
+	// ChunkSize is the maximum size of the UDP datagrams, the bigger messages are chunked
+	ChunkSize             int    `mapstructure:"chunk_size"`
+	SSLCAFile             string `mapstructure:"ssl_ca_file"`
+	SSLCertFile           string `mapstructure:"ssl_cert_file"`
+	SSLKeyFile            string `mapstructure:"ssl_key_file"`
+	SSLInsecureSkipVerify bool   `mapstructure:"ssl_insecure_skip_verify"`
+	// TLS configures the tls transport, the ssl_ options are used for the settings it leaves unset
+	TLS TLSConf `mapstructure:"tls"`
+	// Proxy is the proxy of the tcp and tls transports
+	Proxy ProxyConf `mapstructure:"proxy"`
+}
+
+// tlsConf returns the tls block completed with the ssl_ options
+func (c GraylogConf) tlsConf() TLSConf {
+	return c.TLS.withLegacy(TLSConf{
+		CAFile:             c.SSLCAFile,
+		CertFile:           c.SSLCertFile,
+		KeyFile:            c.SSLKeyFile,
+		InsecureSkipVerify: c.SSLInsecureSkipVerify,
+	})
 }
 
 var graylogPrefix = "graylog-pump"
@@ -36,6 +58,14 @@ func (p *GraylogPump) GetName() string {
 	return "Graylog Pump"
 }
 
+// Close closes the connection to Graylog
+func (p *GraylogPump) Close() error {
+	if p.client == nil {
+		return nil
+	}
+	return p.client.Close()
+}
+
 func (p *GraylogPump) GetEnvPrefix() string {
 	return p.conf.EnvPrefix
 }
@@ -43,9 +73,9 @@ func (p *GraylogPump) GetEnvPrefix() string {
 func (p *GraylogPump) Init(conf interface{}) error {
 	p.conf = &GraylogConf{}
 
-	p.log = log.WithField("prefix", graylogPrefix)
+	p.log = p.newLogger(graylogPrefix)
 
-	err := mapstructure.Decode(conf, &p.conf)
+	err := decodePumpConfig(p, p.log, conf, &p.conf)
 	if err != nil {
 		p.log.Fatal("Failed to decode configuration: ", err)
 	}
@@ -61,30 +91,45 @@ func (p *GraylogPump) Init(conf interface{}) error {
 	}
 	p.log.Info("GraylogHost:", p.conf.GraylogHost)
 	p.log.Info("GraylogPort:", p.conf.GraylogPort)
+	p.log.Info("Transport:", p.conf.Transport)
 
-	p.connect()
+	if _, err := compressGelf(nil, p.conf.Compression); err != nil {
+		return err
+	}
+
+	if err := p.connect(); err != nil {
+		return err
+	}
 
 	p.log.Info(p.GetName() + " Initialized")
 
 	return nil
 }
 
-func (p *GraylogPump) connect() {
-	p.client = gelf.New(gelf.Config{
-		GraylogPort:     p.conf.GraylogPort,
-		GraylogHostname: p.conf.GraylogHost,
-	})
+func (p *GraylogPump) connect() error {
+	client, err := newGelfWriter(p.conf)
+	if err != nil {
+		p.log.Error("Failed to connect to Graylog: ", err)
+		return err
+	}
+	p.client = client
+	return nil
 }
 
 func (p *GraylogPump) WriteData(ctx context.Context, data []interface{}) error {
 	p.log.Debug("Attempting to write ", len(data), " records...")
 
 	if p.client == nil {
-		p.connect()
-		p.WriteData(ctx, data)
+		if err := p.connect(); err != nil {
+			return err
+		}
 	}
 
 	for _, item := range data {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		record := item.(analytics.AnalyticsRecord)
 
 		rReq, err := base64.StdEncoding.DecodeString(record.RawRequest)
@@ -99,19 +144,25 @@ func (p *GraylogPump) WriteData(ctx context.Context, data []interface{}) error {
 		}
 
 		mapping := map[string]interface{}{
-			"method":        record.Method,
-			"path":          record.Path,
-			"response_code": record.ResponseCode,
-			"api_key":       record.APIKey,
-			"api_version":   record.APIVersion,
-			"api_name":      record.APIName,
-			"api_id":        record.APIID,
-			"org_id":        record.OrgID,
-			"oauth_id":      record.OauthID,
-			"raw_request":   string(rReq),
-			"request_time":  record.RequestTime,
-			"ip_address":    record.IPAddress,
-			"raw_response":  string(rResp),
+			"method":           record.Method,
+			"path":             record.Path,
+			"response_code":    record.ResponseCode,
+			"api_key":          record.APIKey,
+			"api_version":      record.APIVersion,
+			"api_name":         record.APIName,
+			"api_id":           record.APIID,
+			"org_id":           record.OrgID,
+			"oauth_id":         record.OauthID,
+			"raw_request":      string(rReq),
+			"request_time":     record.RequestTime,
+			"ip_address":       record.IPAddress,
+			"raw_response":     string(rResp),
+			"error_class":      record.ErrorClass,
+			"trace_id":         record.TraceID,
+			"span_id":          record.SpanID,
+			"correlation_id":   record.CorrelationID,
+			"response_headers": record.ResponseHeaders,
+			"body_fields":      record.BodyFields,
 		}
 
 		messageMap := map[string]interface{}{}
@@ -142,7 +193,10 @@ func (p *GraylogPump) WriteData(ctx context.Context, data []interface{}) error {
 
 		p.log.Debug("Writing ", string(message))
 
-		p.client.Log(string(gelfString))
+		if err := p.client.Write(gelfString); err != nil {
+			p.log.Error("Failed to write to Graylog: ", err)
+			return err
+		}
 	}
 	p.log.Info("Purged ", len(data), " records...")
 
@@ -0,0 +1,89 @@
+package pumps
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChunkGelf(t *testing.T) {
+	payload := bytes.Repeat([]byte("a"), 250)
+
+	chunks, err := chunkGelf(payload, 112)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 {
+		t.Fatal("expected 3 chunks, got", len(chunks))
+	}
+
+	reassembled := []byte{}
+	for i, chunk := range chunks {
+		if !bytes.Equal(chunk[:2], gelfChunkMagic) || !bytes.Equal(chunk[2:10], chunks[0][2:10]) {
+			t.Fatal("expected every chunk to start with the magic bytes and the message id")
+		}
+		if int(chunk[10]) != i || int(chunk[11]) != len(chunks) {
+			t.Fatal("unexpected chunk sequence:", chunk[10], chunk[11])
+		}
+		reassembled = append(reassembled, chunk[gelfChunkHeaderSize:]...)
+	}
+	if !bytes.Equal(reassembled, payload) {
+		t.Fatal("expected the chunks to contain the whole payload")
+	}
+
+	if _, err := chunkGelf(bytes.Repeat([]byte("a"), 129*100), 112); err == nil {
+		t.Fatal("expected an error for a message needing more than 128 chunks")
+	}
+}
+
+func TestStreamGelfWriter(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				message, err := bufio.NewReader(conn).ReadString(0)
+				if err == nil {
+					received <- message
+				}
+			}()
+		}
+	}()
+
+	writer, err := newGelfWriter(&GraylogConf{
+		GraylogHost: "127.0.0.1",
+		GraylogPort: listener.Addr().(*net.TCPAddr).Port,
+		Transport:   "tcp",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second message is written once the writer was closed, so it has to reconnect
+	for i := 0; i < 2; i++ {
+		if err := writer.Write([]byte(`{"message":"test"}`)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case message := <-received:
+			if message != "{\"message\":\"test\"}\x00" {
+				t.Fatalf("unexpected message %q", message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the message wasn't received")
+		}
+		writer.Close()
+	}
+}
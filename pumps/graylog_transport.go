@@ -0,0 +1,183 @@
+package pumps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	gelfUDPTransport = "udp"
+	gelfTCPTransport = "tcp"
+	gelfTLSTransport = "tls"
+
+	gelfGzipCompression = "gzip"
+	gelfZlibCompression = "zlib"
+	gelfNoCompression   = "none"
+
+	// defaultGelfChunkSize fits the chunks in the usual 1500 bytes MTU
+	defaultGelfChunkSize = 1420
+	gelfChunkHeaderSize  = 12
+	gelfMaxChunks        = 128
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// gelfWriter sends GELF messages to Graylog
+type gelfWriter interface {
+	Write(message []byte) error
+	Close() error
+}
+
+// newGelfWriter returns the writer of the configured transport
+func newGelfWriter(conf *GraylogConf) (gelfWriter, error) {
+	address := net.JoinHostPort(conf.GraylogHost, fmt.Sprint(conf.GraylogPort))
+	dial, err := conf.Proxy.dialer(10 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	switch conf.Transport {
+	case "", gelfUDPTransport:
+		if conf.Proxy.URL != "" {
+			return nil, errors.New("the proxy is only supported by the tcp and tls transports")
+		}
+		conn, err := net.Dial("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		return &udpGelfWriter{conn: conn, compression: conf.Compression, chunkSize: conf.ChunkSize}, nil
+	case gelfTCPTransport:
+		return newStreamGelfWriter(func() (net.Conn, error) {
+			return dial(address)
+		})
+	case gelfTLSTransport:
+		tlsConfig, err := conf.tlsConf().ClientConfig(conf.GraylogHost)
+		if err != nil {
+			return nil, err
+		}
+		return newStreamGelfWriter(func() (net.Conn, error) {
+			return dialTLS(dial, address, tlsConfig, 10*time.Second)
+		})
+	}
+	return nil, fmt.Errorf("invalid transport %q, must be udp, tcp or tls", conf.Transport)
+}
+
+// udpGelfWriter sends every message in a datagram, compressed, or in chunks when it doesn't fit in one
+type udpGelfWriter struct {
+	conn        net.Conn
+	compression string
+	chunkSize   int
+}
+
+func (w *udpGelfWriter) Write(message []byte) error {
+	payload, err := compressGelf(message, w.compression)
+	if err != nil {
+		return err
+	}
+
+	chunkSize := w.chunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultGelfChunkSize
+	}
+
+	if len(payload) <= chunkSize {
+		_, err := w.conn.Write(payload)
+		return err
+	}
+
+	chunks, err := chunkGelf(payload, chunkSize)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if _, err := w.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *udpGelfWriter) Close() error {
+	return w.conn.Close()
+}
+
+func compressGelf(message []byte, compression string) ([]byte, error) {
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	switch compression {
+	case gelfGzipCompression:
+		writer = gzip.NewWriter(&buf)
+	case "", gelfZlibCompression:
+		writer = zlib.NewWriter(&buf)
+	case gelfNoCompression:
+		return message, nil
+	default:
+		return nil, fmt.Errorf("invalid compression %q, must be gzip, zlib or none", compression)
+	}
+
+	if _, err := writer.Write(message); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// chunkGelf splits the payload in GELF chunks of up to chunkSize bytes, headers included
+func chunkGelf(payload []byte, chunkSize int) ([][]byte, error) {
+	dataSize := chunkSize - gelfChunkHeaderSize
+	if dataSize <= 0 {
+		return nil, fmt.Errorf("chunk size %d is too small", chunkSize)
+	}
+
+	count := (len(payload) + dataSize - 1) / dataSize
+	if count > gelfMaxChunks {
+		return nil, fmt.Errorf("message of %d bytes needs %d chunks, more than the %d allowed", len(payload), count, gelfMaxChunks)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * dataSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		chunk := make([]byte, 0, gelfChunkHeaderSize+end-i*dataSize)
+		chunk = append(chunk, gelfChunkMagic...)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, payload[i*dataSize:end]...)
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+// streamGelfWriter sends the messages over TCP or TLS, delimited by null bytes as GELF requires
+type streamGelfWriter struct {
+	*streamConn
+}
+
+func newStreamGelfWriter(dial func() (net.Conn, error)) (*streamGelfWriter, error) {
+	conn, err := newStreamConn(dial)
+	if err != nil {
+		return nil, err
+	}
+	return &streamGelfWriter{conn}, nil
+}
+
+func (w *streamGelfWriter) Write(message []byte) error {
+	return w.streamConn.Write(append(append(make([]byte, 0, len(message)+1), message...), 0))
+}
@@ -0,0 +1,243 @@
+package pumps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	httpBulkPrefix     = "http-bulk-pump"
+	httpBulkDefaultENV = PUMPS_ENV_PREFIX + "_HTTPBULK" + PUMPS_ENV_META_PREFIX
+
+	defaultHTTPBulkBatchSize     = 10000
+	defaultHTTPBulkMaxBatchBytes = 10 * 1024 * 1024
+)
+
+// httpBulkTable matches the table names that can be put in the INSERT query, optionally qualified by the database
+var httpBulkTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// HTTPBulkPump inserts the analytics records as new line delimited JSON (the JSONEachRow format of ClickHouse) over
+// HTTP, for the ClickHouse HTTP interface, ClickHouse Cloud, Tinybird and the like
+type HTTPBulkPump struct {
+	conf   *HTTPBulkConf
+	client *http.Client
+	CommonPumpConfig
+}
+
+// HTTPBulkConf configures the HTTP bulk pump
+type HTTPBulkConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	// URL is the URL the records are posted to, like https://clickhouse:8443/
+	URL string `mapstructure:"url"`
+	// Table is the table the records are inserted into. When set, the INSERT INTO <table> FORMAT JSONEachRow query of
+	// the ClickHouse HTTP interface is sent in the query parameter.
+	Table string `mapstructure:"table"`
+	// QueryParams are added to the URL, like the ClickHouse settings
+	QueryParams map[string]string `mapstructure:"query_params"`
+	// Username and Password are sent with basic auth
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// Token is sent as a bearer token
+	Token string `mapstructure:"token"`
+	// Headers are sent with every request
+	Headers map[string]string `mapstructure:"headers"`
+	// Fields are the record fields of the rows, by their json names. All of them by default.
+	Fields []string `mapstructure:"fields"`
+	// BatchSize is the maximum number of rows of a request, 10000 by default
+	BatchSize int `mapstructure:"batch_size"`
+	// MaxBatchBytes is the maximum size of a request before compression, 10MiB by default
+	MaxBatchBytes int `mapstructure:"max_batch_bytes"`
+	// Compress gzips the requests
+	Compress bool `mapstructure:"compress"`
+	// TLS configures the connections to the URL
+	TLS TLSConf `mapstructure:"tls"`
+}
+
+func (h *HTTPBulkPump) New() Pump {
+	newPump := HTTPBulkPump{}
+	return &newPump
+}
+
+func (h *HTTPBulkPump) GetName() string {
+	return "HTTP Bulk Pump"
+}
+
+func (h *HTTPBulkPump) GetEnvPrefix() string {
+	return h.conf.EnvPrefix
+}
+
+func (h *HTTPBulkPump) Init(config interface{}) error {
+	h.conf = &HTTPBulkConf{}
+	h.log = h.newLogger(httpBulkPrefix)
+
+	if err := decodePumpConfig(h, h.log, config, &h.conf); err != nil {
+		h.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(h, h.log, h.conf, httpBulkDefaultENV)
+
+	if err := h.conf.init(); err != nil {
+		return err
+	}
+	client, err := h.conf.TLS.httpClient(60 * time.Second)
+	if err != nil {
+		return err
+	}
+	h.client = client
+
+	h.log.Info(h.GetName() + " Initialized")
+	return nil
+}
+
+// init validates the configuration and sets its defaults
+func (c *HTTPBulkConf) init() error {
+	if c.URL == "" {
+		return errors.New("url must be set")
+	}
+	if _, err := url.Parse(c.URL); err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	if c.Table != "" && !httpBulkTable.MatchString(c.Table) {
+		return fmt.Errorf("invalid table name %q", c.Table)
+	}
+	for _, field := range c.Fields {
+		if !analytics.IsRecordField(field) {
+			return fmt.Errorf("unknown record field %q", field)
+		}
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultHTTPBulkBatchSize
+	}
+	if c.MaxBatchBytes <= 0 {
+		c.MaxBatchBytes = defaultHTTPBulkMaxBatchBytes
+	}
+	return nil
+}
+
+func (h *HTTPBulkPump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := h.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial inserts the records in batches, returning the records of the batches that failed and of the ones
+// left at the deadline
+func (h *HTTPBulkPump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
+	h.log.Debug("Attempting to write ", len(data), " records...")
+
+	failed, err := httpBulkWrite(ctx, h.client, h.conf, &h.CommonPumpConfig, data)
+	if err != nil {
+		return failed, err
+	}
+	h.log.Info("Purged ", len(data), " records...")
+	return nil, nil
+}
+
+// httpBulkWrite posts the records in batches of rows, returning the records of the batches that failed and of the
+// ones left at the deadline. It's shared by the pumps of the services taking JSONEachRow inserts.
+func httpBulkWrite(ctx context.Context, client *http.Client, conf *HTTPBulkConf, pump *CommonPumpConfig, data []interface{}) ([]interface{}, error) {
+	batches, unencoded := ndjsonBatches(data, conf.BatchSize, conf.MaxBatchBytes, conf.row)
+	if len(unencoded) > 0 {
+		pump.log.Error("Couldn't encode ", len(unencoded), " records, they will be dropped")
+		pump.DropRecords(DroppedSerialization, len(unencoded))
+	}
+
+	failed := []interface{}{}
+	var lastErr error
+	for i, batch := range batches {
+		if err := ctx.Err(); err != nil {
+			return append(failed, ndjsonRecords(batches[i:])...), err
+		}
+
+		if err := conf.post(ctx, client, batch.body); err != nil {
+			pump.log.WithField("records", len(batch.records)).Error("Failed to insert the records: ", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return append(failed, ndjsonRecords(batches[i:])...), ctxErr
+			}
+			failed = append(failed, batch.records...)
+			lastErr = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("failed to write %d of %d records: %v", len(failed), len(data), lastErr)
+	}
+	return nil, nil
+}
+
+// row encodes the record as a row with the configured fields, or all of them
+func (c *HTTPBulkConf) row(record *analytics.AnalyticsRecord) ([]byte, error) {
+	if len(c.Fields) == 0 {
+		return ndjsonRecord(record)
+	}
+
+	row := make(map[string]interface{}, len(c.Fields))
+	for _, field := range c.Fields {
+		row[field], _ = record.Field(field)
+	}
+	return json.Marshal(row)
+}
+
+func (c *HTTPBulkConf) post(ctx context.Context, client *http.Client, rows []byte) error {
+	body := rows
+	if c.Compress {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(rows)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = compressed.Bytes()
+	}
+
+	postURL, _ := url.Parse(c.URL)
+	query := postURL.Query()
+	if c.Table != "" {
+		query.Set("query", "INSERT INTO "+c.Table+" FORMAT JSONEachRow")
+	}
+	for name, value := range c.QueryParams {
+		query.Set(name, value)
+	}
+	postURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, postURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if c.Compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("responded with status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package pumps
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestHTTPBulkWriteData(t *testing.T) {
+	queries := []string{}
+	rows := []map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "default" || password != "secret" {
+			t.Errorf("expected basic auth, got %s:%s", user, password)
+		}
+		queries = append(queries, r.URL.Query().Get("query"))
+		if r.URL.Query().Get("date_time_input_format") != "best_effort" {
+			t.Errorf("expected the query params, got %s", r.URL.RawQuery)
+		}
+
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(zr)
+		for scanner.Scan() {
+			row := map[string]interface{}{}
+			if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+				t.Errorf("expected a JSON row per line: %v", err)
+			}
+			rows = append(rows, row)
+		}
+	}))
+	defer server.Close()
+
+	pump := &HTTPBulkPump{}
+	err := pump.Init(map[string]interface{}{
+		"url":          server.URL,
+		"table":        "tyk.analytics",
+		"query_params": map[string]string{"date_time_input_format": "best_effort"},
+		"username":     "default",
+		"password":     "secret",
+		"fields":       []string{"api_id", "response_code", "latency.total"},
+		"batch_size":   2,
+		"compress":     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{APIID: "1", ResponseCode: 200, Latency: analytics.Latency{Total: 10}},
+		analytics.AnalyticsRecord{APIID: "2", ResponseCode: 500},
+		analytics.AnalyticsRecord{APIID: "3", ResponseCode: 404},
+	}
+	if err := pump.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(queries) != 2 || queries[0] != "INSERT INTO tyk.analytics FORMAT JSONEachRow" {
+		t.Errorf("expected an INSERT query per batch, got %v", queries)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+	if len(rows[0]) != 3 || rows[0]["api_id"] != "1" || rows[0]["latency.total"] != float64(10) {
+		t.Errorf("expected the configured fields, got %v", rows[0])
+	}
+}
+
+func TestHTTPBulkWriteDataRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Code: 117. DB::Exception: Unknown field found while parsing JSONEachRow format"))
+	}))
+	defer server.Close()
+
+	pump := &HTTPBulkPump{}
+	if err := pump.Init(map[string]interface{}{"url": server.URL, "token": "token"}); err != nil {
+		t.Fatal(err)
+	}
+	failed, err := pump.WriteDataPartial(context.Background(), []interface{}{analytics.AnalyticsRecord{APIID: "1"}})
+	if err == nil || !strings.Contains(err.Error(), "Unknown field") || len(failed) != 1 {
+		t.Errorf("expected the record to fail with the error of the server, got %v: %v", failed, err)
+	}
+}
+
+func TestHTTPBulkInitInvalidTable(t *testing.T) {
+	pump := &HTTPBulkPump{}
+	if err := pump.Init(map[string]interface{}{"url": "http://localhost", "table": "analytics; DROP TABLE x"}); err == nil {
+		t.Error("expected an invalid table name to fail")
+	}
+}
@@ -5,15 +5,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/mitchellh/mapstructure"
 
 	"github.com/TykTechnologies/tyk/rpc"
 )
 
 const hybridPrefix = "hybrid-pump"
 
+const (
+	defaultHybridReconnectBackoff    = time.Second
+	defaultHybridMaxReconnectBackoff = time.Minute
+)
+
 var hybridDefaultENV = PUMPS_ENV_PREFIX + "_HYBRID" + PUMPS_ENV_META_PREFIX
 
 type GroupLoginRequest struct {
@@ -47,8 +56,53 @@ type HybridPump struct {
 	trackAllPaths          bool
 	storeAnalyticPerMinute bool
 	ignoreTagPrefixList    []string
+	aggregationDimensions  []string
+	latencyThresholds      map[string]analytics.LatencyThresholds
 	CommonPumpConfig
 	rpcConfig rpc.Config
+
+	// connMu serializes the reconnections, which are delayed by the backoff after a failed one
+	connMu  sync.Mutex
+	backoff hybridBackoff
+
+	// queue holds the batches waiting to be sent by sendLoop when max_queue_size is set
+	queue   chan []interface{}
+	dropped uint64
+	// queued counts the batches of the queue and the one sendLoop is sending
+	queued int64
+	// sendBatch sends the batches of the queue, it's replaced in the tests to not need an RPC server
+	sendBatch func(data []interface{}) error
+	// done stops sendLoop when the pump is closed
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// hybridBackoff delays the reconnections to the RPC server, doubling the delay after every failed one up to max
+type hybridBackoff struct {
+	initial, max time.Duration
+	current      time.Duration
+	next         time.Time
+}
+
+func (b *hybridBackoff) ready(now time.Time) bool {
+	return !now.Before(b.next)
+}
+
+func (b *hybridBackoff) failed(now time.Time) {
+	if b.current == 0 {
+		b.current = b.initial
+	} else {
+		b.current *= 2
+	}
+	if b.current > b.max {
+		b.current = b.max
+	}
+	b.next = now.Add(b.current)
+}
+
+func (b *hybridBackoff) reset() {
+	b.current = 0
+	b.next = time.Time{}
 }
 
 func (p *HybridPump) GetName() string {
@@ -59,9 +113,48 @@ func (p *HybridPump) New() Pump {
 	return &HybridPump{}
 }
 
+// hybridFlushTimeout is how long Flush waits for the queued batches to be sent, when the pump has no timeout
+var hybridFlushTimeout = 10 * time.Second
+
+// hybridFlushInterval is how often Flush checks whether the queue is empty
+const hybridFlushInterval = 10 * time.Millisecond
+
+// Flush waits for sendLoop to send the queued batches, for up to the pump timeout, or hybridFlushTimeout when it has
+// none, so they aren't dropped when the pump is closed
+func (p *HybridPump) Flush() error {
+	if p.queue == nil {
+		return nil
+	}
+
+	timeout := hybridFlushTimeout
+	if p.timeout > 0 {
+		timeout = time.Duration(p.timeout) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&p.queued) > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d batches still queued after %v", atomic.LoadInt64(&p.queued), timeout)
+		}
+		time.Sleep(hybridFlushInterval)
+	}
+	return nil
+}
+
+// Close stops sendLoop, the batches still queued are dropped, so the pump is flushed first. The RPC connection is
+// shared by all the hybrid pumps, so it's kept for the ones replacing the pump.
+func (p *HybridPump) Close() error {
+	if p.done == nil {
+		return nil
+	}
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
+
 func (p *HybridPump) Init(config interface{}) error {
 
-	p.log = log.WithField("prefix", hybridPrefix)
+	p.log = p.newLogger(hybridPrefix)
 
 	meta := config.(map[string]interface{})
 	// read configuration
@@ -115,6 +208,15 @@ func (p *HybridPump) Init(config interface{}) error {
 	}
 
 	p.rpcConfig = rpcConfig
+
+	p.backoff = hybridBackoff{initial: defaultHybridReconnectBackoff, max: defaultHybridMaxReconnectBackoff}
+	if backoff, ok := meta["reconnect_backoff"]; ok {
+		p.backoff.initial = time.Duration(backoff.(float64) * float64(time.Second))
+	}
+	if maxBackoff, ok := meta["max_reconnect_backoff"]; ok {
+		p.backoff.max = time.Duration(maxBackoff.(float64) * float64(time.Second))
+	}
+
 	errConnect := p.connectRpc()
 	if errConnect != nil {
 		p.log.Fatal("Failed to connect to RPC server")
@@ -140,6 +242,28 @@ func (p *HybridPump) Init(config interface{}) error {
 			}
 		}
 
+		if list, ok := meta["aggregation_dimensions"]; ok {
+			aggregationDimensions := list.([]interface{})
+			p.aggregationDimensions = make([]string, len(aggregationDimensions))
+			for k, v := range aggregationDimensions {
+				p.aggregationDimensions[k] = fmt.Sprint(v)
+			}
+		}
+
+		if thresholds, ok := meta["latency_thresholds"]; ok {
+			if err := mapstructure.Decode(thresholds, &p.latencyThresholds); err != nil {
+				p.log.Error("Failed to decode latency_thresholds: ", err)
+				return err
+			}
+		}
+
+	}
+
+	if queueSize, ok := meta["max_queue_size"]; ok && queueSize.(float64) > 0 {
+		p.queue = make(chan []interface{}, int(queueSize.(float64)))
+		p.done = make(chan struct{})
+		p.sendBatch = p.send
+		go p.sendLoop()
 	}
 
 	return nil
@@ -170,14 +294,154 @@ func (p *HybridPump) WriteData(ctx context.Context, data []interface{}) error {
 	if len(data) == 0 {
 		return nil
 	}
+
+	if p.queue != nil {
+		p.enqueue(data)
+		return nil
+	}
+
 	p.log.Debug("Attempting to write ", len(data), " records...")
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := p.send(data); err != nil {
+		p.dropBatch(data)
+		return err
+	}
+	return nil
+}
+
+// enqueue queues the batch for sendLoop, dropping the oldest queued batch when the queue is full
+func (p *HybridPump) enqueue(data []interface{}) {
+	atomic.AddInt64(&p.queued, 1)
+	for {
+		select {
+		case p.queue <- data:
+			p.log.Debug("Queued ", len(data), " records...")
+			return
+		default:
+		}
+
+		select {
+		case oldest := <-p.queue:
+			p.dropBatch(oldest)
+			atomic.AddInt64(&p.queued, -1)
+		default:
+		}
+	}
+}
+
+// sendLoop sends the queued batches until the pump is closed. A batch failing to be sent is retried once the
+// reconnection backoff is over, unless the queue filled up in the meantime, in which case it's dropped as the oldest
+// batch.
+func (p *HybridPump) sendLoop() {
+	for {
+		// a closed pump stops even when batches are queued
+		select {
+		case <-p.done:
+			p.dropQueued()
+			return
+		default:
+		}
+
+		var batch []interface{}
+		select {
+		case <-p.done:
+			p.dropQueued()
+			return
+		case batch = <-p.queue:
+		}
+
+		if !p.sendQueued(batch) {
+			p.dropQueued()
+			return
+		}
+	}
+}
+
+// sendQueued sends a batch of the queue, retrying it once the reconnection backoff is over, unless the queue filled up
+// in the meantime. It returns false when the pump is closed while the batch is retried, the batch being dropped.
+func (p *HybridPump) sendQueued(batch []interface{}) bool {
+	defer atomic.AddInt64(&p.queued, -1)
+	for {
+		p.log.Debug("Attempting to write ", len(batch), " records...")
+		if err := p.sendBatch(batch); err == nil {
+			return true
+		}
 
-	if !rpc.Login() {
-		p.log.Error("Failed to login to RPC server, trying to reconnect...")
-		if errConnect := p.connectRpc(); errConnect != nil {
-			p.log.Error("Failed to connect to RPC server")
-			return errConnect
+		if len(p.queue) == cap(p.queue) {
+			p.dropBatch(batch)
+			return true
 		}
+
+		p.connMu.Lock()
+		wait := time.Until(p.backoff.next)
+		p.connMu.Unlock()
+		if wait < p.backoff.initial {
+			wait = p.backoff.initial
+		}
+		select {
+		case <-p.done:
+			p.dropBatch(batch)
+			return false
+		case <-time.After(wait):
+		}
+	}
+}
+
+// dropQueued drops the batches left in the queue
+func (p *HybridPump) dropQueued() {
+	for {
+		select {
+		case batch := <-p.queue:
+			p.dropBatch(batch)
+			atomic.AddInt64(&p.queued, -1)
+		default:
+			return
+		}
+	}
+}
+
+// dropBatch counts and reports a batch which couldn't be sent
+func (p *HybridPump) dropBatch(data []interface{}) {
+	dropped := atomic.AddUint64(&p.dropped, 1)
+	p.log.Warning("Dropped a batch of ", len(data), " records, ", dropped, " batches dropped so far")
+
+	if rpc.Instrument != nil {
+		job := rpc.Instrument.NewJob("HybridPump")
+		job.Event("dropped_batch")
+		job.Gauge("dropped_records", float64(len(data)))
+	}
+}
+
+// ensureConnected logs in to the RPC server, reconnecting when needed. A failed reconnection delays the next one
+// with an exponential backoff.
+func (p *HybridPump) ensureConnected() error {
+	if rpc.Login() {
+		return nil
+	}
+
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	now := time.Now()
+	if !p.backoff.ready(now) {
+		return fmt.Errorf("reconnection to RPC server delayed for %v", p.backoff.next.Sub(now).Round(time.Millisecond))
+	}
+
+	p.log.Error("Failed to login to RPC server, trying to reconnect...")
+	if errConnect := p.connectRpc(); errConnect != nil {
+		p.backoff.failed(now)
+		p.log.Error("Failed to connect to RPC server, next attempt in ", p.backoff.current)
+		return errConnect
+	}
+	p.backoff.reset()
+	return nil
+}
+
+func (p *HybridPump) send(data []interface{}) error {
+	if err := p.ensureConnected(); err != nil {
+		return err
 	}
 	_, err := rpc.FuncClientSingleton("Ping", nil)
 	if err != nil {
@@ -199,7 +463,7 @@ func (p *HybridPump) WriteData(ctx context.Context, data []interface{}) error {
 		}
 	} else { // send aggregated data
 		// calculate aggregates
-		aggregates := analytics.AggregateData(data, p.trackAllPaths, p.ignoreTagPrefixList, p.storeAnalyticPerMinute)
+		aggregates := analytics.AggregateData(data, p.trackAllPaths, p.ignoreTagPrefixList, p.storeAnalyticPerMinute, p.aggregationDimensions, p.latencyThresholds)
 
 		// turn map with analytics aggregates into JSON payload
 		jsonData, err := json.Marshal(aggregates)
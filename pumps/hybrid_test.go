@@ -0,0 +1,109 @@
+package pumps
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestHybridBackoff(t *testing.T) {
+	b := hybridBackoff{initial: time.Second, max: 5 * time.Second}
+	now := time.Now()
+	if !b.ready(now) {
+		t.Fatal("the first reconnection shouldn't be delayed")
+	}
+
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		b.failed(now)
+		if b.current != expected {
+			t.Errorf("expected a delay of %v, got %v", expected, b.current)
+		}
+		if b.ready(now) || !b.ready(now.Add(expected)) {
+			t.Errorf("the reconnection should be delayed by %v", expected)
+		}
+	}
+
+	b.reset()
+	if !b.ready(now) || b.current != 0 {
+		t.Error("the backoff wasn't reset")
+	}
+}
+
+func TestHybridClose(t *testing.T) {
+	p := &HybridPump{queue: make(chan []interface{}, 2), done: make(chan struct{})}
+	p.log = p.newLogger(hybridPrefix)
+	p.queue <- []interface{}{analytics.AnalyticsRecord{}}
+	p.queue <- []interface{}{analytics.AnalyticsRecord{}}
+	p.queued = 2
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		p.sendLoop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected the send loop to stop once the pump is closed")
+	}
+	if p.dropped != 2 || len(p.queue) != 0 || p.queued != 0 {
+		t.Fatal("expected the queued batches to be dropped, got", p.dropped)
+	}
+}
+
+func TestHybridFlush(t *testing.T) {
+	defer func(timeout time.Duration) { hybridFlushTimeout = timeout }(hybridFlushTimeout)
+	hybridFlushTimeout = 200 * time.Millisecond
+
+	sent := make(chan int, 3)
+	attempts := 0
+	p := &HybridPump{queue: make(chan []interface{}, 2), done: make(chan struct{})}
+	p.log = p.newLogger(hybridPrefix)
+	p.backoff = hybridBackoff{initial: time.Millisecond, max: time.Millisecond}
+	p.sendBatch = func(data []interface{}) error {
+		// the first attempt fails, as when the RPC server is reconnecting
+		if attempts++; attempts == 1 {
+			return errors.New("connection refused")
+		}
+		sent <- len(data)
+		return nil
+	}
+	p.enqueue([]interface{}{analytics.AnalyticsRecord{}})
+	p.enqueue([]interface{}{analytics.AnalyticsRecord{}, analytics.AnalyticsRecord{}})
+	go p.sendLoop()
+
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	if len(sent) != 2 || <-sent != 1 || <-sent != 2 || p.dropped != 0 {
+		t.Fatal("expected the queued batches to be sent before the pump is closed, dropped", p.dropped)
+	}
+
+	// the batches which can't be sent before the deadline are dropped when the pump is closed
+	p = &HybridPump{queue: make(chan []interface{}, 2), done: make(chan struct{})}
+	p.log = p.newLogger(hybridPrefix)
+	p.backoff = hybridBackoff{initial: time.Millisecond, max: time.Millisecond}
+	p.sendBatch = func(data []interface{}) error { return errors.New("connection refused") }
+	p.enqueue([]interface{}{analytics.AnalyticsRecord{}})
+	stopped := make(chan struct{})
+	go func() {
+		p.sendLoop()
+		close(stopped)
+	}()
+	if err := p.Flush(); err == nil {
+		t.Error("expected the batch still queued at the deadline to be reported")
+	}
+	p.Close()
+	<-stopped
+	if p.dropped != 1 {
+		t.Error("expected the batch to be dropped once the pump is closed, got", p.dropped)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/influxdata/influxdb/client/v2"
-	"github.com/mitchellh/mapstructure"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
 )
@@ -48,9 +47,9 @@ func (i *InfluxPump) GetEnvPrefix() string {
 
 func (i *InfluxPump) Init(config interface{}) error {
 	i.dbConf = &InfluxConf{}
-	i.log = log.WithField("prefix", influxPrefix)
+	i.log = i.newLogger(influxPrefix)
 
-	err := mapstructure.Decode(config, &i.dbConf)
+	err := decodePumpConfig(i, i.log, config, &i.dbConf)
 	if err != nil {
 		i.log.Fatal("Failed to decode configuration: ", err)
 	}
@@ -96,6 +95,10 @@ func (i *InfluxPump) WriteData(ctx context.Context, data []interface{}) error {
 
 	//	 Create a point and add to batch
 	for _, v := range data {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Convert to AnalyticsRecord
 		decoded := v.(analytics.AnalyticsRecord)
 		mapping := map[string]interface{}{
@@ -113,6 +116,7 @@ func (i *InfluxPump) WriteData(ctx context.Context, data []interface{}) error {
 			"request_time":  decoded.RequestTime,
 			"raw_response":  decoded.RawResponse,
 			"ip_address":    decoded.IPAddress,
+			"error_class":   decoded.ErrorClass,
 		}
 
 		tags := make(map[string]string)
@@ -141,6 +145,7 @@ func (i *InfluxPump) WriteData(ctx context.Context, data []interface{}) error {
 		// New record
 		if pt, err = client.NewPoint(table, tags, fields, time.Now()); err != nil {
 			i.log.Error(err)
+			i.DropRecords(DroppedSerialization, 1)
 			continue
 		}
 
@@ -28,4 +28,19 @@ func init() {
 	AvailablePumps["kafka"] = &KafkaPump{}
 	AvailablePumps["syslog"] = &SyslogPump{}
 	AvailablePumps["stdout"] = &StdOutPump{}
+	AvailablePumps["usage"] = &UsagePump{}
+	AvailablePumps["security"] = &SecurityPump{}
+	AvailablePumps["snowflake"] = &SnowflakePump{}
+	AvailablePumps["quickwit"] = &QuickwitPump{}
+	AvailablePumps["mezmo"] = &MezmoPump{}
+	AvailablePumps["coralogix"] = &CoralogixPump{}
+	AvailablePumps["dynatrace"] = &DynatracePump{}
+	AvailablePumps["http-bulk"] = &HTTPBulkPump{}
+	AvailablePumps["tinybird"] = &TinybirdPump{}
+	AvailablePumps["cratedb"] = &CrateDBPump{}
+	AvailablePumps["singlestore"] = &SingleStorePump{}
+	AvailablePumps["firebolt"] = &FireboltPump{}
+	AvailablePumps["databricks"] = &DatabricksPump{}
+	AvailablePumps["redshift"] = &RedshiftPump{}
+	AvailablePumps["kusto"] = &KustoPump{}
 }
@@ -4,11 +4,10 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"time"
 
-	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-pump/analytics"
-	"github.com/mitchellh/mapstructure"
 	"github.com/segmentio/kafka-go"
 	"github.com/segmentio/kafka-go/sasl"
 	"github.com/segmentio/kafka-go/sasl/plain"
@@ -20,7 +19,6 @@ import (
 type KafkaPump struct {
 	kafkaConf    *KafkaConf
 	writerConfig kafka.WriterConfig
-	log          *logrus.Entry
 	CommonPumpConfig
 }
 
@@ -45,6 +43,8 @@ type KafkaConf struct {
 	Username              string            `mapstructure:"sasl_username"`
 	Password              string            `mapstructure:"sasl_password"`
 	Algorithm             string            `mapstructure:"sasl_algorithm"`
+	// TLS enables TLS with the brokers like UseSSL, the ssl_ options are used for the settings it leaves unset
+	TLS TLSConf `mapstructure:"tls"`
 }
 
 func (k *KafkaPump) New() Pump {
@@ -61,11 +61,11 @@ func (k *KafkaPump) GetEnvPrefix() string {
 }
 
 func (k *KafkaPump) Init(config interface{}) error {
-	k.log = log.WithField("prefix", kafkaPrefix)
+	k.log = k.newLogger(kafkaPrefix)
 
 	//Read configuration file
 	k.kafkaConf = &KafkaConf{}
-	err := mapstructure.Decode(config, &k.kafkaConf)
+	err := decodePumpConfig(k, k.log, config, &k.kafkaConf)
 	if err != nil {
 		k.log.Fatal("Failed to decode configuration: ", err)
 	}
@@ -73,7 +73,16 @@ func (k *KafkaPump) Init(config interface{}) error {
 	processPumpEnvVars(k, k.log, k.kafkaConf, kafkaDefaultENV)
 
 	var tlsConfig *tls.Config
-	if k.kafkaConf.UseSSL {
+	if k.kafkaConf.TLS.IsSet() {
+		tlsConf := k.kafkaConf.TLS.withLegacy(TLSConf{
+			CertFile:           k.kafkaConf.SSLCertFile,
+			KeyFile:            k.kafkaConf.SSLKeyFile,
+			InsecureSkipVerify: k.kafkaConf.SSLInsecureSkipVerify,
+		})
+		if tlsConfig, err = tlsConf.ClientConfig(""); err != nil {
+			return fmt.Errorf("invalid tls configuration: %v", err)
+		}
+	} else if k.kafkaConf.UseSSL {
 		if k.kafkaConf.SSLCertFile != "" && k.kafkaConf.SSLKeyFile != "" {
 			var cert tls.Certificate
 			k.log.Debug("Loading certificates for mTLS.")
@@ -96,6 +105,9 @@ func (k *KafkaPump) Init(config interface{}) error {
 	} else if k.kafkaConf.SASLMechanism != "" {
 		k.log.WithField("SASL-Mechanism", k.kafkaConf.SASLMechanism).Warn("SASL-Mechanism is setted but use_ssl is false.")
 	}
+	if tlsConfig != nil {
+		ApplyTLSDefaults(tlsConfig)
+	}
 
 	var mechanism sasl.Mechanism
 
@@ -151,25 +163,32 @@ func (k *KafkaPump) WriteData(ctx context.Context, data []interface{}) error {
 		//Build message format
 		decoded := v.(analytics.AnalyticsRecord)
 		message := Json{
-			"timestamp":       decoded.TimeStamp,
-			"method":          decoded.Method,
-			"path":            decoded.Path,
-			"raw_path":        decoded.RawPath,
-			"response_code":   decoded.ResponseCode,
-			"alias":           decoded.Alias,
-			"api_key":         decoded.APIKey,
-			"api_version":     decoded.APIVersion,
-			"api_name":        decoded.APIName,
-			"api_id":          decoded.APIID,
-			"org_id":          decoded.OrgID,
-			"oauth_id":        decoded.OauthID,
-			"raw_request":     decoded.RawRequest,
-			"request_time_ms": decoded.RequestTime,
-			"raw_response":    decoded.RawResponse,
-			"ip_address":      decoded.IPAddress,
-			"host":            decoded.Host,
-			"content_length":  decoded.ContentLength,
-			"user_agent":      decoded.UserAgent,
+			"timestamp":               decoded.TimeStamp,
+			"method":                  decoded.Method,
+			"path":                    decoded.Path,
+			"raw_path":                decoded.RawPath,
+			"response_code":           decoded.ResponseCode,
+			"alias":                   decoded.Alias,
+			"api_key":                 decoded.APIKey,
+			"api_version":             decoded.APIVersion,
+			"api_name":                decoded.APIName,
+			"api_id":                  decoded.APIID,
+			"org_id":                  decoded.OrgID,
+			"oauth_id":                decoded.OauthID,
+			"raw_request":             decoded.RawRequest,
+			"request_time_ms":         decoded.RequestTime,
+			"raw_response":            decoded.RawResponse,
+			"ip_address":              decoded.IPAddress,
+			"host":                    decoded.Host,
+			"content_length":          decoded.ContentLength,
+			"response_content_length": decoded.ResponseContentLength,
+			"user_agent":              decoded.UserAgent,
+			"error_class":             decoded.ErrorClass,
+			"trace_id":                decoded.TraceID,
+			"span_id":                 decoded.SpanID,
+			"correlation_id":          decoded.CorrelationID,
+			"response_headers":        decoded.ResponseHeaders,
+			"body_fields":             decoded.BodyFields,
 		}
 		//Add static metadata to json
 		for key, value := range k.kafkaConf.MetaData {
@@ -180,6 +199,7 @@ func (k *KafkaPump) WriteData(ctx context.Context, data []interface{}) error {
 		json, jsonError := json.Marshal(message)
 		if jsonError != nil {
 			k.log.WithError(jsonError).Error("unable to marshal message")
+			k.DropRecords(DroppedSerialization, 1)
 		}
 
 		//Kafka message structure
@@ -0,0 +1,500 @@
+package pumps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	kustoPrefix     = "kusto-pump"
+	kustoDefaultENV = PUMPS_ENV_PREFIX + "_KUSTO" + PUMPS_ENV_META_PREFIX
+
+	defaultKustoAuthorityURL = "https://login.microsoftonline.com"
+	azureIMDSURL             = "http://169.254.169.254"
+	defaultKustoBatchSize    = 10000
+	defaultKustoMaxBlobBytes = 64 * 1024 * 1024
+	kustoMgmtPath            = "/v1/rest/mgmt"
+	// kustoResourcesLifetime is how long the ingestion resources and the identity token are used before refreshing
+	// them
+	kustoResourcesLifetime = time.Hour
+	// kustoTokenRenewal is how long before expiring an AAD token is renewed
+	kustoTokenRenewal = time.Minute
+
+	kustoClientSecretAuth     = "client_secret"
+	kustoManagedIdentityAuth  = "managed_identity"
+	kustoWorkloadIdentityAuth = "workload_identity"
+)
+
+// KustoPump ingests the analytics records into an Azure Data Explorer (Kusto) table with queued ingestion. The
+// records are uploaded as gzipped multi-JSON blobs to the temporary storage of the cluster, and queued for ingestion.
+// The cluster ingests them in batches as per the ingestion batching policy of the table.
+type KustoPump struct {
+	conf   *KustoConf
+	client *http.Client
+	// imdsURL is the instance metadata endpoint of the managed identity, replaced in the tests
+	imdsURL string
+
+	tokenMu     sync.Mutex
+	token       string
+	tokenExpiry time.Time
+
+	resourcesMu sync.Mutex
+	resources   *kustoResources
+
+	CommonPumpConfig
+}
+
+// KustoConf configures the Azure Data Explorer pump
+type KustoConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	// ClusterURL is the URL of the cluster, like https://mycluster.westeurope.kusto.windows.net
+	ClusterURL string `mapstructure:"cluster_url"`
+	// IngestURL is the URL of the data management endpoint of the cluster, by default the cluster URL prefixed by
+	// ingest-
+	IngestURL string `mapstructure:"ingest_url"`
+	// Auth is how the pump authenticates: client_secret, as an AAD application with its secret, managed_identity or
+	// workload_identity. By default client_secret when the secret is set, workload_identity when the
+	// AZURE_FEDERATED_TOKEN_FILE environment variable is set and managed_identity otherwise.
+	Auth string `mapstructure:"auth"`
+	// TenantID, ClientID and ClientSecret are the credentials of the AAD application. With workload_identity the
+	// tenant and the client are taken from the AZURE_TENANT_ID and AZURE_CLIENT_ID environment variables when not set,
+	// with managed_identity the client selects a user-assigned identity.
+	TenantID     string `mapstructure:"tenant_id"`
+	ClientID     string `mapstructure:"client_id"`
+	ClientSecret string `mapstructure:"client_secret"`
+	// FederatedTokenFile is the file of the token exchanged with workload_identity, taken from the
+	// AZURE_FEDERATED_TOKEN_FILE environment variable when not set
+	FederatedTokenFile string `mapstructure:"federated_token_file"`
+	// AuthorityURL is the URL of AAD, https://login.microsoftonline.com by default
+	AuthorityURL string `mapstructure:"authority_url"`
+	Database     string `mapstructure:"database"`
+	Table        string `mapstructure:"table"`
+	// Mapping is the name of the JSON ingestion mapping of the table. Without one the record fields are ingested into
+	// the columns of the same name.
+	Mapping string `mapstructure:"mapping"`
+	// BatchSize is the maximum number of records of a blob, 10000 by default
+	BatchSize int `mapstructure:"batch_size"`
+	// MaxBlobBytes is the maximum size of a blob before compression, 64MiB by default
+	MaxBlobBytes int `mapstructure:"max_blob_bytes"`
+	// FlushImmediately ingests every blob on its own, skipping the batching of the cluster. It lowers the latency at
+	// the cost of the performance of the cluster.
+	FlushImmediately bool `mapstructure:"flush_immediately"`
+}
+
+// kustoResources are the ingestion resources of the cluster
+type kustoResources struct {
+	queues               []string
+	containers           []string
+	authorizationContext string
+	expiry               time.Time
+	next                 int
+}
+
+// kustoIngestionMessage is the message queued to ingest a blob
+type kustoIngestionMessage struct {
+	ID                   string            `json:"Id"`
+	BlobPath             string            `json:"BlobPath"`
+	RawDataSize          int               `json:"RawDataSize"`
+	DatabaseName         string            `json:"DatabaseName"`
+	TableName            string            `json:"TableName"`
+	RetainBlobOnSuccess  bool              `json:"RetainBlobOnSuccess"`
+	FlushImmediately     bool              `json:"FlushImmediately"`
+	ReportLevel          int               `json:"ReportLevel"`
+	ReportMethod         int               `json:"ReportMethod"`
+	AdditionalProperties map[string]string `json:"AdditionalProperties"`
+}
+
+func (k *KustoPump) New() Pump {
+	newPump := KustoPump{}
+	return &newPump
+}
+
+func (k *KustoPump) GetName() string {
+	return "Azure Data Explorer Pump"
+}
+
+func (k *KustoPump) GetEnvPrefix() string {
+	return k.conf.EnvPrefix
+}
+
+func (k *KustoPump) Init(config interface{}) error {
+	k.conf = &KustoConf{}
+	k.log = k.newLogger(kustoPrefix)
+
+	if err := decodePumpConfig(k, k.log, config, &k.conf); err != nil {
+		k.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(k, k.log, k.conf, kustoDefaultENV)
+
+	if k.conf.ClusterURL == "" || k.conf.Database == "" || k.conf.Table == "" {
+		return errors.New("cluster_url, database and table must be set")
+	}
+	if err := k.conf.initAuth(); err != nil {
+		return err
+	}
+	k.conf.ClusterURL = strings.TrimSuffix(k.conf.ClusterURL, "/")
+	if k.conf.IngestURL == "" {
+		clusterURL, err := url.Parse(k.conf.ClusterURL)
+		if err != nil || clusterURL.Host == "" {
+			return fmt.Errorf("invalid cluster_url %q", k.conf.ClusterURL)
+		}
+		clusterURL.Host = "ingest-" + clusterURL.Host
+		k.conf.IngestURL = clusterURL.String()
+	}
+	if k.conf.AuthorityURL == "" {
+		k.conf.AuthorityURL = defaultKustoAuthorityURL
+	}
+	if k.conf.BatchSize <= 0 {
+		k.conf.BatchSize = defaultKustoBatchSize
+	}
+	if k.conf.MaxBlobBytes <= 0 {
+		k.conf.MaxBlobBytes = defaultKustoMaxBlobBytes
+	}
+	k.client = &http.Client{Timeout: 60 * time.Second}
+	k.imdsURL = azureIMDSURL
+
+	k.log.Info(k.GetName() + " Initialized")
+	return nil
+}
+
+// initAuth sets the default auth and the credentials taken from the environment, and checks the ones it needs are set
+func (c *KustoConf) initAuth() error {
+	if c.Auth == "" {
+		switch {
+		case c.ClientSecret != "":
+			c.Auth = kustoClientSecretAuth
+		case os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "":
+			c.Auth = kustoWorkloadIdentityAuth
+		default:
+			c.Auth = kustoManagedIdentityAuth
+		}
+	}
+
+	switch c.Auth {
+	case kustoClientSecretAuth:
+		if c.TenantID == "" || c.ClientID == "" || c.ClientSecret == "" {
+			return errors.New("tenant_id, client_id and client_secret must be set")
+		}
+	case kustoWorkloadIdentityAuth:
+		if c.TenantID == "" {
+			c.TenantID = os.Getenv("AZURE_TENANT_ID")
+		}
+		if c.ClientID == "" {
+			c.ClientID = os.Getenv("AZURE_CLIENT_ID")
+		}
+		if c.FederatedTokenFile == "" {
+			c.FederatedTokenFile = os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+		}
+		if c.AuthorityURL == "" {
+			c.AuthorityURL = os.Getenv("AZURE_AUTHORITY_HOST")
+		}
+		if c.TenantID == "" || c.ClientID == "" || c.FederatedTokenFile == "" {
+			return errors.New("tenant_id, client_id and federated_token_file, or the AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_FEDERATED_TOKEN_FILE environment variables, must be set")
+		}
+	case kustoManagedIdentityAuth:
+	default:
+		return fmt.Errorf("invalid auth %q, must be client_secret, managed_identity or workload_identity", c.Auth)
+	}
+	return nil
+}
+
+func (k *KustoPump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := k.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial queues the records for ingestion in blobs of up to batch_size records, returning the records of the
+// blobs that couldn't be queued and of the ones left at the deadline. The records that fail to be ingested by the
+// cluster once queued aren't reported, they can be found with the .show ingestion failures command.
+func (k *KustoPump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
+	k.log.Debug("Attempting to write ", len(data), " records...")
+
+	blobs, unencoded := ndjsonBatches(data, k.conf.BatchSize, k.conf.MaxBlobBytes, ndjsonRecord)
+	if len(unencoded) > 0 {
+		k.log.Error("Couldn't encode ", len(unencoded), " records, they will be dropped")
+		k.DropRecords(DroppedSerialization, len(unencoded))
+	}
+
+	failed := []interface{}{}
+	var lastErr error
+	for i, blob := range blobs {
+		if err := ctx.Err(); err != nil {
+			return append(failed, ndjsonRecords(blobs[i:])...), err
+		}
+
+		if err := k.ingest(ctx, blob.body); err != nil {
+			k.log.WithField("records", len(blob.records)).Error("Failed to queue the records for ingestion: ", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return append(failed, ndjsonRecords(blobs[i:])...), ctxErr
+			}
+			failed = append(failed, blob.records...)
+			lastErr = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("failed to write %d of %d records: %v", len(failed), len(data), lastErr)
+	}
+	k.log.Info("Purged ", len(data), " records...")
+	return nil, nil
+}
+
+// ingest uploads the records to a blob and queues it for ingestion, using the containers and queues of the cluster in
+// turn
+func (k *KustoPump) ingest(ctx context.Context, records []byte) error {
+	resources, err := k.getResources(ctx, time.Now())
+	if err != nil {
+		return fmt.Errorf("couldn't get the ingestion resources: %v", err)
+	}
+	k.resourcesMu.Lock()
+	container := resources.containers[resources.next%len(resources.containers)]
+	queue := resources.queues[resources.next%len(resources.queues)]
+	resources.next++
+	k.resourcesMu.Unlock()
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write(records)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	id := uuid.NewV4().String()
+	blobURL, err := url.Parse(container)
+	if err != nil {
+		return err
+	}
+	blobURL.Path += "/" + k.conf.Database + "__" + k.conf.Table + "__" + id + ".multijson.gz"
+
+	req, err := http.NewRequest(http.MethodPut, blobURL.String(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	if _, err := k.do(ctx, req); err != nil {
+		return fmt.Errorf("couldn't upload the blob: %v", err)
+	}
+
+	properties := map[string]string{
+		"authorizationContext": resources.authorizationContext,
+		"format":               "multijson",
+	}
+	if k.conf.Mapping != "" {
+		properties["ingestionMappingReference"] = k.conf.Mapping
+		properties["ingestionMappingType"] = "Json"
+	}
+	message, _ := json.Marshal(kustoIngestionMessage{
+		ID:                   id,
+		BlobPath:             blobURL.String(),
+		RawDataSize:          len(records),
+		DatabaseName:         k.conf.Database,
+		TableName:            k.conf.Table,
+		FlushImmediately:     k.conf.FlushImmediately,
+		AdditionalProperties: properties,
+	})
+
+	queueURL, err := url.Parse(queue)
+	if err != nil {
+		return err
+	}
+	queueURL.Path += "/messages"
+	queueMessage := "<QueueMessage><MessageText>" + base64.StdEncoding.EncodeToString(message) + "</MessageText></QueueMessage>"
+	req, err = http.NewRequest(http.MethodPost, queueURL.String(), strings.NewReader(queueMessage))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	if _, err := k.do(ctx, req); err != nil {
+		return fmt.Errorf("couldn't queue the blob: %v", err)
+	}
+	return nil
+}
+
+// getResources returns the ingestion resources and the identity token of the cluster, refreshing them every hour
+func (k *KustoPump) getResources(ctx context.Context, now time.Time) (*kustoResources, error) {
+	k.resourcesMu.Lock()
+	defer k.resourcesMu.Unlock()
+
+	if k.resources != nil && now.Before(k.resources.expiry) {
+		return k.resources, nil
+	}
+
+	rows, err := k.mgmt(ctx, ".get ingestion resources")
+	if err != nil {
+		return nil, err
+	}
+	resources := &kustoResources{expiry: now.Add(kustoResourcesLifetime)}
+	for _, row := range rows {
+		if len(row) < 2 {
+			continue
+		}
+		switch row[0] {
+		case "SecuredReadyForAggregationQueue":
+			resources.queues = append(resources.queues, row[1])
+		case "TempStorage":
+			resources.containers = append(resources.containers, row[1])
+		}
+	}
+	if len(resources.queues) == 0 || len(resources.containers) == 0 {
+		return nil, errors.New("the cluster has no ingestion queue or temporary storage")
+	}
+
+	rows, err = k.mgmt(ctx, ".get kusto identity token")
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 || len(rows[0]) == 0 {
+		return nil, errors.New("the cluster returned no identity token")
+	}
+	resources.authorizationContext = rows[0][0]
+
+	k.resources = resources
+	return resources, nil
+}
+
+// mgmt runs the management command on the data management endpoint, returning the rows of its result
+func (k *KustoPump) mgmt(ctx context.Context, command string) ([][]string, error) {
+	body, _ := json.Marshal(map[string]string{"db": "NetDefaultDB", "csl": command})
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(k.conf.IngestURL, "/")+kustoMgmtPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	token, err := k.getToken(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	respBody, err := k.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	result := struct {
+		Tables []struct {
+			Rows [][]string `json:"Rows"`
+		} `json:"Tables"`
+	}{}
+	if err := json.Unmarshal(respBody, &result); err != nil || len(result.Tables) == 0 {
+		return nil, fmt.Errorf("unexpected response to %s: %s", command, respBody)
+	}
+	return result.Tables[0].Rows, nil
+}
+
+// getToken returns the AAD access token of the pump for the cluster, renewing it when it's about to expire at now
+func (k *KustoPump) getToken(ctx context.Context, now time.Time) (string, error) {
+	k.tokenMu.Lock()
+	defer k.tokenMu.Unlock()
+
+	if k.token != "" && now.Add(kustoTokenRenewal).Before(k.tokenExpiry) {
+		return k.token, nil
+	}
+
+	req, err := k.tokenRequest()
+	if err != nil {
+		return "", err
+	}
+	body, err := k.do(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("couldn't authenticate: %v", err)
+	}
+	// the managed identity endpoints send the numbers as strings
+	token := struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+		ExpiresOn   json.Number `json:"expires_on"`
+	}{}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("couldn't authenticate, unexpected response %s", body)
+	}
+
+	k.token, k.tokenExpiry = token.AccessToken, now.Add(time.Hour)
+	if expiresIn, err := token.ExpiresIn.Int64(); err == nil {
+		k.tokenExpiry = now.Add(time.Duration(expiresIn) * time.Second)
+	} else if expiresOn, err := token.ExpiresOn.Int64(); err == nil {
+		k.tokenExpiry = time.Unix(expiresOn, 0)
+	}
+	return k.token, nil
+}
+
+// tokenRequest returns the request of the AAD access token for the cluster, as per the auth of the pump
+func (k *KustoPump) tokenRequest() (*http.Request, error) {
+	if k.conf.Auth == kustoManagedIdentityAuth {
+		query := url.Values{}
+		query.Set("resource", k.conf.ClusterURL)
+		if k.conf.ClientID != "" {
+			query.Set("client_id", k.conf.ClientID)
+		}
+
+		// App Service, Functions and Container Apps have their own endpoint, the VMs and AKS the instance metadata
+		if endpoint, header := os.Getenv("IDENTITY_ENDPOINT"), os.Getenv("IDENTITY_HEADER"); endpoint != "" && header != "" {
+			query.Set("api-version", "2019-08-01")
+			req, err := http.NewRequest(http.MethodGet, endpoint+"?"+query.Encode(), nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("X-IDENTITY-HEADER", header)
+			return req, nil
+		}
+		query.Set("api-version", "2018-02-01")
+		req, err := http.NewRequest(http.MethodGet, k.imdsURL+"/metadata/identity/oauth2/token?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata", "true")
+		return req, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", k.conf.ClientID)
+	form.Set("scope", k.conf.ClusterURL+"/.default")
+	if k.conf.Auth == kustoWorkloadIdentityAuth {
+		// the token file is rotated by the platform, so it's read again for every AAD token
+		assertion, err := ioutil.ReadFile(k.conf.FederatedTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read the federated token: %v", err)
+		}
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	} else {
+		form.Set("client_secret", k.conf.ClientSecret)
+	}
+	tokenURL := strings.TrimSuffix(k.conf.AuthorityURL, "/") + "/" + url.PathEscape(k.conf.TenantID) + "/oauth2/v2.0/token"
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// do sends the request, returning the body of the response
+func (k *KustoPump) do(ctx context.Context, req *http.Request) ([]byte, error) {
+	resp, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("responded with status %d: %s", resp.StatusCode, body)
+	}
+	return body, nil
+}
@@ -0,0 +1,208 @@
+package pumps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestKustoWriteData(t *testing.T) {
+	tokens, commands := 0, 0
+	blobs := map[string][]byte{}
+	messages := []kustoIngestionMessage{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case r.URL.Path == "/tenant/oauth2/v2.0/token":
+			if !strings.Contains(string(body), "scope=https%3A%2F%2Ftyk.westeurope.kusto.windows.net%2F.default") {
+				t.Errorf("unexpected token request %s", body)
+			}
+			tokens++
+			w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+		case r.URL.Path == kustoMgmtPath:
+			if r.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("expected the AAD token, got %q", r.Header.Get("Authorization"))
+			}
+			commands++
+			if strings.Contains(string(body), ".get ingestion resources") {
+				w.Write([]byte(`{"Tables":[{"TableName":"Table_0","Rows":[
+					["SecuredReadyForAggregationQueue","` + server.URL + `/queue/ready?sig=q"],
+					["FailedIngestionsQueue","` + server.URL + `/queue/failed?sig=f"],
+					["TempStorage","` + server.URL + `/blob/temp?sig=b"]]}]}`))
+				return
+			}
+			w.Write([]byte(`{"Tables":[{"TableName":"Table_0","Rows":[["identity"]]}]}`))
+		case strings.HasPrefix(r.URL.Path, "/blob/temp/") && r.Method == http.MethodPut:
+			if r.URL.Query().Get("sig") != "b" || r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+				t.Errorf("unexpected blob upload %s", r.URL)
+			}
+			blobs[r.URL.Path] = body
+			w.WriteHeader(http.StatusCreated)
+		case r.URL.Path == "/queue/ready/messages":
+			text := strings.TrimSuffix(strings.TrimPrefix(string(body), "<QueueMessage><MessageText>"), "</MessageText></QueueMessage>")
+			decoded, _ := base64.StdEncoding.DecodeString(text)
+			message := kustoIngestionMessage{}
+			if err := json.Unmarshal(decoded, &message); err != nil {
+				t.Errorf("unexpected queue message %s", body)
+			}
+			messages = append(messages, message)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+
+	pump := &KustoPump{}
+	err := pump.Init(map[string]interface{}{
+		"cluster_url":   "https://tyk.westeurope.kusto.windows.net",
+		"ingest_url":    server.URL,
+		"authority_url": server.URL,
+		"tenant_id":     "tenant",
+		"client_id":     "id",
+		"client_secret": "secret",
+		"database":      "analytics",
+		"table":         "requests",
+		"mapping":       "requests_mapping",
+		"batch_size":    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{APIID: "1"},
+		analytics.AnalyticsRecord{APIID: "2"},
+		analytics.AnalyticsRecord{APIID: "3"},
+	}
+	if err := pump.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	if tokens != 1 || commands != 2 {
+		t.Errorf("expected the token and the resources to be reused, got %d tokens and %d commands", tokens, commands)
+	}
+	if len(messages) != 2 || len(blobs) != 2 {
+		t.Fatalf("expected a blob and a message per batch, got %d blobs and %d messages", len(blobs), len(messages))
+	}
+
+	message := messages[0]
+	if message.DatabaseName != "analytics" || message.TableName != "requests" {
+		t.Errorf("unexpected message %+v", message)
+	}
+	properties := message.AdditionalProperties
+	if properties["authorizationContext"] != "identity" || properties["format"] != "multijson" || properties["ingestionMappingReference"] != "requests_mapping" {
+		t.Errorf("unexpected message properties %v", properties)
+	}
+
+	blobURL := message.BlobPath
+	if !strings.HasPrefix(blobURL, server.URL+"/blob/temp/analytics__requests__") || !strings.HasSuffix(blobURL, ".multijson.gz?sig=b") {
+		t.Fatalf("unexpected blob path %s", blobURL)
+	}
+	blob := blobs[strings.TrimSuffix(strings.TrimPrefix(blobURL, server.URL), "?sig=b")]
+	zr, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, _ := ioutil.ReadAll(zr)
+	if strings.Count(string(records), "\n") != 2 || message.RawDataSize != len(records) {
+		t.Errorf("expected the 2 records of the batch, got %s", records)
+	}
+}
+
+func TestKustoManagedIdentity(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/metadata/identity/oauth2/token" || r.Header.Get("Metadata") != "true" ||
+			query.Get("resource") != "https://tyk.westeurope.kusto.windows.net" || query.Get("client_id") != "identity" {
+			t.Errorf("unexpected token request %s", r.URL)
+		}
+		w.Write([]byte(`{"access_token":"token","expires_in":"3600"}`))
+	}))
+	defer server.Close()
+
+	pump := &KustoPump{}
+	err := pump.Init(map[string]interface{}{
+		"cluster_url": "https://tyk.westeurope.kusto.windows.net",
+		"client_id":   "identity",
+		"database":    "analytics",
+		"table":       "requests",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pump.conf.Auth != kustoManagedIdentityAuth {
+		t.Errorf("expected the managed identity without a secret, got %s", pump.conf.Auth)
+	}
+	pump.imdsURL = server.URL
+
+	token, err := pump.getToken(context.Background(), time.Now())
+	if err != nil || token != "token" {
+		t.Fatalf("expected the managed identity token, got %q %v", token, err)
+	}
+	if time.Until(pump.tokenExpiry) < 50*time.Minute {
+		t.Errorf("expected the token to expire in an hour, got %s", pump.tokenExpiry)
+	}
+}
+
+func TestKustoWorkloadIdentity(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/tenant/oauth2/v2.0/token" || r.Form.Get("client_id") != "app" ||
+			r.Form.Get("client_assertion") != "federated" || r.Form.Get("client_secret") != "" {
+			t.Errorf("unexpected token request %s %v", r.URL, r.Form)
+		}
+		w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	tokenFile, err := ioutil.TempFile("", "federated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("federated\n")
+	tokenFile.Close()
+
+	os.Setenv("AZURE_FEDERATED_TOKEN_FILE", tokenFile.Name())
+	os.Setenv("AZURE_TENANT_ID", "tenant")
+	os.Setenv("AZURE_CLIENT_ID", "app")
+	os.Setenv("AZURE_AUTHORITY_HOST", server.URL)
+	defer func() {
+		for _, name := range []string{"AZURE_FEDERATED_TOKEN_FILE", "AZURE_TENANT_ID", "AZURE_CLIENT_ID", "AZURE_AUTHORITY_HOST"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	pump := &KustoPump{}
+	err = pump.Init(map[string]interface{}{
+		"cluster_url": "https://tyk.westeurope.kusto.windows.net",
+		"database":    "analytics",
+		"table":       "requests",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pump.conf.Auth != kustoWorkloadIdentityAuth {
+		t.Errorf("expected the workload identity with a federated token, got %s", pump.conf.Auth)
+	}
+	if token, err := pump.getToken(context.Background(), time.Now()); err != nil || token != "token" {
+		t.Errorf("expected the workload identity token, got %q %v", token, err)
+	}
+
+	if err := (&KustoConf{Auth: "key"}).initAuth(); err == nil {
+		t.Error("expected an unknown auth to fail")
+	}
+}
@@ -9,7 +9,6 @@ import (
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
 	lg "github.com/logzio/logzio-go"
-	"github.com/mitchellh/mapstructure"
 )
 
 const (
@@ -21,6 +20,7 @@ const (
 	defaultLogzioDiskThreshold  = 98 // represent % of the disk
 	defaultLogzioDrainDuration  = "3s"
 	defaultLogzioURL            = "https://listener.logz.io:8071"
+	defaultLogzioMaxRetries     = 3
 
 	minDiskThreshold = 0
 	maxDiskThreshold = 100
@@ -34,6 +34,15 @@ type LogzioPumpConfig struct {
 	QueueDir       string `mapstructure:"queue_dir"`
 	Token          string `mapstructure:"token"`
 	URL            string `mapstructure:"url"`
+	// Region selects the listener of the account region, like eu, unless the url is set
+	Region string `mapstructure:"region"`
+	// Type is the log type of the events
+	Type string `mapstructure:"type"`
+	// BulkSend sends the events of every purge straight to the bulk API, gzipped when Compress is set, retrying the
+	// failed requests up to MaxRetries times
+	BulkSend   bool `mapstructure:"bulk_send"`
+	Compress   bool `mapstructure:"compress"`
+	MaxRetries int  `mapstructure:"max_retries"`
 }
 
 func NewLogzioPumpConfig() *LogzioPumpConfig {
@@ -43,12 +52,14 @@ func NewLogzioPumpConfig() *LogzioPumpConfig {
 		DrainDuration:  defaultLogzioDrainDuration,
 		QueueDir: fmt.Sprintf("%s%s%s%s%d", os.TempDir(), string(os.PathSeparator),
 			"logzio-buffer", string(os.PathSeparator), time.Now().UnixNano()),
-		URL: defaultLogzioURL,
+		URL:        defaultLogzioURL,
+		MaxRetries: defaultLogzioMaxRetries,
 	}
 }
 
 type LogzioPump struct {
 	sender *lg.LogzioSender
+	bulk   *logzioBulkSender
 	config *LogzioPumpConfig
 	CommonPumpConfig
 }
@@ -99,18 +110,33 @@ func (p *LogzioPump) GetEnvPrefix() string {
 
 func (p *LogzioPump) Init(config interface{}) error {
 	p.config = NewLogzioPumpConfig()
-	p.log = log.WithField("prefix", LogzioPumpPrefix)
+	p.log = p.newLogger(LogzioPumpPrefix)
 
-	err := mapstructure.Decode(config, p.config)
+	err := decodePumpConfig(p, p.log, config, p.config)
 	if err != nil {
 		p.log.Fatalf("Failed to decode configuration: %s", err)
 	}
 
 	processPumpEnvVars(p, p.log, p.config, logzioDefaultENV)
 
+	if p.config.Region != "" && p.config.URL == defaultLogzioURL {
+		regionURL, ok := logzioRegions[p.config.Region]
+		if !ok {
+			return fmt.Errorf("unknown region %q", p.config.Region)
+		}
+		p.config.URL = regionURL
+	}
+
 	p.log.Debugf("Initializing %s with the following configuration: %+v", LogzioPumpName, p.config)
 
-	p.sender, err = NewLogzioClient(p.config)
+	if p.config.BulkSend {
+		if p.config.Token == "" {
+			return fmt.Errorf("token is required")
+		}
+		p.bulk, err = newLogzioBulkSender(p.config)
+	} else {
+		p.sender, err = NewLogzioClient(p.config)
+	}
 	if err != nil {
 		return err
 	}
@@ -122,23 +148,33 @@ func (p *LogzioPump) Init(config interface{}) error {
 func (p *LogzioPump) WriteData(ctx context.Context, data []interface{}) error {
 	p.log.Debug("Attempting to write ", len(data), " records...")
 
+	events := make([][]byte, 0, len(data))
 	for _, v := range data {
 		decoded := v.(analytics.AnalyticsRecord)
 		mapping := map[string]interface{}{
-			"@timestamp":      decoded.TimeStamp,
-			"http_method":     decoded.Method,
-			"request_uri":     decoded.Path,
-			"response_code":   decoded.ResponseCode,
-			"api_key":         decoded.APIKey,
-			"api_version":     decoded.APIVersion,
-			"api_name":        decoded.APIName,
-			"api_id":          decoded.APIID,
-			"org_id":          decoded.OrgID,
-			"oauth_id":        decoded.OauthID,
-			"raw_request":     decoded.RawRequest,
-			"request_time_ms": decoded.RequestTime,
-			"raw_response":    decoded.RawResponse,
-			"ip_address":      decoded.IPAddress,
+			"@timestamp":       decoded.TimeStamp,
+			"http_method":      decoded.Method,
+			"request_uri":      decoded.Path,
+			"response_code":    decoded.ResponseCode,
+			"api_key":          decoded.APIKey,
+			"api_version":      decoded.APIVersion,
+			"api_name":         decoded.APIName,
+			"api_id":           decoded.APIID,
+			"org_id":           decoded.OrgID,
+			"oauth_id":         decoded.OauthID,
+			"raw_request":      decoded.RawRequest,
+			"request_time_ms":  decoded.RequestTime,
+			"raw_response":     decoded.RawResponse,
+			"ip_address":       decoded.IPAddress,
+			"error_class":      decoded.ErrorClass,
+			"trace_id":         decoded.TraceID,
+			"span_id":          decoded.SpanID,
+			"correlation_id":   decoded.CorrelationID,
+			"response_headers": decoded.ResponseHeaders,
+			"body_fields":      decoded.BodyFields,
+		}
+		if p.config.Type != "" {
+			mapping["type"] = p.config.Type
 		}
 
 		event, err := json.Marshal(mapping)
@@ -146,9 +182,36 @@ func (p *LogzioPump) WriteData(ctx context.Context, data []interface{}) error {
 			return fmt.Errorf("failed to marshal decoded data: %s", err)
 		}
 
-		p.sender.Send(event)
+		if p.bulk == nil {
+			p.sender.Send(event)
+			continue
+		}
+		events = append(events, event)
+	}
+
+	if p.bulk != nil {
+		if err := p.bulk.send(ctx, events); err != nil {
+			p.log.Error("Failed to send records to the bulk API: ", err)
+			return err
+		}
 	}
 	p.log.Info("Purged ", len(data), " records...")
 
 	return nil
 }
+
+// Flush sends the events queued by the sender, when the bulk API isn't used
+func (p *LogzioPump) Flush() error {
+	if p.sender != nil {
+		p.sender.Drain()
+	}
+	return nil
+}
+
+// Close stops the goroutine of the sender sending the queued events
+func (p *LogzioPump) Close() error {
+	if p.sender != nil {
+		p.sender.Stop()
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package pumps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var logzioRegions = map[string]string{
+	"us": "https://listener.logz.io:8071",
+	"eu": "https://listener-eu.logz.io:8071",
+	"uk": "https://listener-uk.logz.io:8071",
+	"ca": "https://listener-ca.logz.io:8071",
+	"au": "https://listener-au.logz.io:8071",
+	"nl": "https://listener-nl.logz.io:8071",
+	"wa": "https://listener-wa.logz.io:8071",
+}
+
+// logzioBulkResponse is the response of the bulk API when some of the lines were rejected
+type logzioBulkResponse struct {
+	MalformedLines  int `json:"malformedLines"`
+	SuccessfulLines int `json:"successfulLines"`
+	OversizedLines  int `json:"oversizedLines"`
+	EmptyLogLines   int `json:"emptyLogLines"`
+}
+
+// logzioBulkSender sends the events of a purge straight to the Logz.io bulk API, rather than through the disk queue
+// of the Logz.io sender, so the failures are known and retried
+type logzioBulkSender struct {
+	url        string
+	client     *http.Client
+	compress   bool
+	maxRetries int
+	backoff    time.Duration
+}
+
+func newLogzioBulkSender(conf *LogzioPumpConfig) (*logzioBulkSender, error) {
+	bulkURL, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %s", err)
+	}
+	query := bulkURL.Query()
+	query.Set("token", conf.Token)
+	if conf.Type != "" {
+		query.Set("type", conf.Type)
+	}
+	bulkURL.RawQuery = query.Encode()
+
+	return &logzioBulkSender{
+		url:        bulkURL.String(),
+		client:     &http.Client{Timeout: 30 * time.Second},
+		compress:   conf.Compress,
+		maxRetries: conf.MaxRetries,
+		backoff:    time.Second,
+	}, nil
+}
+
+// send posts the events as new line delimited JSON. The network errors and 5xx responses are retried, the batches
+// too large for the API are split in halves and the lines rejected by a partial failure are reported, but not
+// retried as the rest of the batch was accepted.
+func (s *logzioBulkSender) send(ctx context.Context, events [][]byte) error {
+	if len(events) == 0 {
+		return nil
+	}
+	body := append(bytes.Join(events, []byte("\n")), '\n')
+
+	var lastErr error
+	for attempt := 0; attempt <= s.maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return lastErr
+			case <-time.After(s.backoff << uint(attempt-1)):
+			}
+		}
+
+		status, respBody, err := s.post(ctx, body)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch {
+		case status == http.StatusOK:
+			return nil
+		case status == http.StatusRequestEntityTooLarge && len(events) > 1:
+			half := len(events) / 2
+			if err := s.send(ctx, events[:half]); err != nil {
+				return err
+			}
+			return s.send(ctx, events[half:])
+		case status == http.StatusBadRequest:
+			resp := logzioBulkResponse{}
+			if err := json.Unmarshal(respBody, &resp); err == nil && resp.SuccessfulLines > 0 {
+				return fmt.Errorf("%d of %d lines rejected: %d malformed, %d oversized, %d empty",
+					resp.MalformedLines+resp.OversizedLines+resp.EmptyLogLines, len(events),
+					resp.MalformedLines, resp.OversizedLines, resp.EmptyLogLines)
+			}
+			return fmt.Errorf("bulk request rejected with status %d: %s", status, respBody)
+		case status >= http.StatusInternalServerError || status == http.StatusTooManyRequests:
+			lastErr = fmt.Errorf("bulk request failed with status %d: %s", status, respBody)
+		default:
+			return fmt.Errorf("bulk request rejected with status %d: %s", status, respBody)
+		}
+	}
+	return lastErr
+}
+
+func (s *logzioBulkSender) post(ctx context.Context, body []byte) (int, []byte, error) {
+	payload := body
+	if s.compress {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(body); err != nil {
+			return 0, nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return 0, nil, err
+		}
+		payload = buf.Bytes()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain")
+	if s.compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, nil
+}
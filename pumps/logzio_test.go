@@ -1,8 +1,16 @@
 package pumps
 
 import (
-	"github.com/mitchellh/mapstructure"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/mitchellh/mapstructure"
 )
 
 func TestLogzioInit(t *testing.T) {
@@ -78,3 +86,86 @@ func TestLogzioDecodeOverrideDefaults(t *testing.T) {
 		t.Fatalf("Failed to override one of the default configurations: %+v", pconfig)
 	}
 }
+
+func TestLogzioBulkSender(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	batches := []int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+
+		if r.URL.Query().Get("token") != testToken || r.URL.Query().Get("type") != "tyk" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Error("the payload isn't gzipped")
+		}
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		lines := 0
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			lines++
+		}
+
+		switch {
+		case requests == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case lines > 2:
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		default:
+			batches = append(batches, lines)
+		}
+	}))
+	defer server.Close()
+
+	conf := NewLogzioPumpConfig()
+	conf.URL = server.URL
+	conf.Token = testToken
+	conf.Type = "tyk"
+	conf.Compress = true
+	sender, err := newLogzioBulkSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.backoff = 0
+
+	events := [][]byte{[]byte(`{"a":1}`), []byte(`{"a":2}`), []byte(`{"a":3}`), []byte(`{"a":4}`)}
+	if err := sender.send(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 2 || batches[0] != 2 || batches[1] != 2 {
+		t.Errorf("expected the batch to be split in two, got %v", batches)
+	}
+}
+
+func TestLogzioBulkSenderPartialFailure(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"malformedLines":1,"successfulLines":2,"oversizedLines":0,"emptyLogLines":0}`))
+	}))
+	defer server.Close()
+
+	conf := NewLogzioPumpConfig()
+	conf.URL = server.URL
+	conf.Token = testToken
+	sender, err := newLogzioBulkSender(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sender.send(context.Background(), [][]byte{[]byte("{}"), []byte("{}"), []byte("bad")})
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 lines rejected") {
+		t.Errorf("expected the rejected lines to be reported, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("the partial failure shouldn't be retried, got %d requests", requests)
+	}
+}
@@ -0,0 +1,289 @@
+package pumps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	mezmoPrefix     = "mezmo-pump"
+	mezmoDefaultENV = PUMPS_ENV_PREFIX + "_MEZMO" + PUMPS_ENV_META_PREFIX
+
+	defaultMezmoURL           = "https://logs.mezmo.com/logs/ingest"
+	defaultMezmoHostnameField = "host"
+	defaultMezmoAppField      = "api_name"
+	defaultMezmoBatchSize     = 1000
+	// defaultMezmoMaxBatchBytes keeps the requests under the 10MB limit of the ingestion API
+	defaultMezmoMaxBatchBytes = 10 * 1000 * 1000
+)
+
+// MezmoPump sends the analytics records to the Mezmo (formerly LogDNA) ingestion API, as log lines with the record
+// as their metadata
+type MezmoPump struct {
+	conf   *MezmoConf
+	client *http.Client
+	CommonPumpConfig
+}
+
+// MezmoConf configures the Mezmo pump
+type MezmoConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	// IngestionKey authenticates the requests to the ingestion API
+	IngestionKey string `mapstructure:"ingestion_key"`
+	// URL is the URL of the ingestion API, https://logs.mezmo.com/logs/ingest by default
+	URL string `mapstructure:"url"`
+	// HostnameField is the record field the hostname of the lines is taken from, host by default
+	HostnameField string `mapstructure:"hostname_field"`
+	// Hostname is the hostname of the lines whose HostnameField is empty, the one of the machine by default
+	Hostname string `mapstructure:"hostname"`
+	// AppField is the record field the app of the lines is taken from, api_name by default
+	AppField string `mapstructure:"app_field"`
+	// LevelField is the record field the level of the lines is taken from. By default the level is ERROR for the 5xx
+	// responses, WARN for the 4xx ones and INFO otherwise.
+	LevelField string `mapstructure:"level_field"`
+	// Tags are added to the lines, to group them in Mezmo
+	Tags []string `mapstructure:"tags"`
+	// BatchSize is the maximum number of lines of a request, 1000 by default
+	BatchSize int `mapstructure:"batch_size"`
+	// MaxBatchBytes is the maximum size of a request before compression, 10MB by default
+	MaxBatchBytes int `mapstructure:"max_batch_bytes"`
+	// Compress gzips the requests
+	Compress bool `mapstructure:"compress"`
+}
+
+// mezmoLine is a line of the ingestion API
+type mezmoLine struct {
+	Line      string                     `json:"line"`
+	App       string                     `json:"app,omitempty"`
+	Level     string                     `json:"level"`
+	Timestamp int64                      `json:"timestamp"`
+	Meta      *analytics.AnalyticsRecord `json:"meta"`
+}
+
+func (m *MezmoPump) New() Pump {
+	newPump := MezmoPump{}
+	return &newPump
+}
+
+func (m *MezmoPump) GetName() string {
+	return "Mezmo Pump"
+}
+
+func (m *MezmoPump) GetEnvPrefix() string {
+	return m.conf.EnvPrefix
+}
+
+func (m *MezmoPump) Init(config interface{}) error {
+	m.conf = &MezmoConf{}
+	m.log = m.newLogger(mezmoPrefix)
+
+	if err := decodePumpConfig(m, m.log, config, &m.conf); err != nil {
+		m.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(m, m.log, m.conf, mezmoDefaultENV)
+
+	if m.conf.IngestionKey == "" {
+		return errors.New("ingestion_key must be set")
+	}
+	if m.conf.URL == "" {
+		m.conf.URL = defaultMezmoURL
+	}
+	if m.conf.HostnameField == "" {
+		m.conf.HostnameField = defaultMezmoHostnameField
+	}
+	if m.conf.AppField == "" {
+		m.conf.AppField = defaultMezmoAppField
+	}
+	for _, field := range []string{m.conf.HostnameField, m.conf.AppField, m.conf.LevelField} {
+		if field != "" && !analytics.IsRecordField(field) {
+			return fmt.Errorf("unknown record field %q", field)
+		}
+	}
+	if m.conf.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("hostname must be set, couldn't get the one of the machine: %v", err)
+		}
+		m.conf.Hostname = hostname
+	}
+	if m.conf.BatchSize <= 0 {
+		m.conf.BatchSize = defaultMezmoBatchSize
+	}
+	if m.conf.MaxBatchBytes <= 0 {
+		m.conf.MaxBatchBytes = defaultMezmoMaxBatchBytes
+	}
+	m.client = &http.Client{Timeout: 60 * time.Second}
+
+	m.log.Info(m.GetName() + " Initialized")
+	return nil
+}
+
+func (m *MezmoPump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := m.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial sends the records in batches of the same hostname, returning the records of the batches that
+// failed and of the ones left at the deadline
+func (m *MezmoPump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
+	m.log.Debug("Attempting to write ", len(data), " records...")
+
+	hostnames, byHostname := m.groupByHostname(data)
+	hostnameBatches := map[string][]ndjsonBatch{}
+	for _, hostname := range hostnames {
+		batches, unencoded := ndjsonBatches(byHostname[hostname], m.conf.BatchSize, m.conf.MaxBatchBytes, m.line)
+		if len(unencoded) > 0 {
+			m.log.Error("Couldn't encode ", len(unencoded), " records, they will be dropped")
+			m.DropRecords(DroppedSerialization, len(unencoded))
+		}
+		hostnameBatches[hostname] = batches
+	}
+
+	failed := []interface{}{}
+	var lastErr error
+	for h, hostname := range hostnames {
+		batches := hostnameBatches[hostname]
+		for i, batch := range batches {
+			if err := ctx.Err(); err != nil {
+				return append(failed, m.remaining(hostnames[h+1:], hostnameBatches, batches[i:])...), err
+			}
+
+			if err := m.ingest(ctx, hostname, batch.body); err != nil {
+				m.log.WithField("records", len(batch.records)).Error("Failed to send the records: ", err)
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return append(failed, m.remaining(hostnames[h+1:], hostnameBatches, batches[i:])...), ctxErr
+				}
+				failed = append(failed, batch.records...)
+				lastErr = err
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("failed to write %d of %d records: %v", len(failed), len(data), lastErr)
+	}
+	m.log.Info("Purged ", len(data), " records...")
+	return nil, nil
+}
+
+// groupByHostname groups the records by the hostname of their lines, keeping the hostnames in the order they are
+// first seen. The values that aren't records are grouped with the default hostname, for ndjsonBatches to set them
+// apart.
+func (m *MezmoPump) groupByHostname(data []interface{}) ([]string, map[string][]interface{}) {
+	hostnames := []string{}
+	byHostname := map[string][]interface{}{}
+	for _, v := range data {
+		hostname := m.conf.Hostname
+		if record, ok := v.(analytics.AnalyticsRecord); ok {
+			if value := record.FieldString(m.conf.HostnameField); value != "" {
+				hostname = value
+			}
+		}
+		if _, ok := byHostname[hostname]; !ok {
+			hostnames = append(hostnames, hostname)
+		}
+		byHostname[hostname] = append(byHostname[hostname], v)
+	}
+	return hostnames, byHostname
+}
+
+// remaining returns the records of the current batches and of the hostnames left
+func (m *MezmoPump) remaining(hostnames []string, hostnameBatches map[string][]ndjsonBatch, current []ndjsonBatch) []interface{} {
+	records := ndjsonRecords(current)
+	for _, hostname := range hostnames {
+		records = append(records, ndjsonRecords(hostnameBatches[hostname])...)
+	}
+	return records
+}
+
+// line encodes the record as a line of the ingestion API
+func (m *MezmoPump) line(record *analytics.AnalyticsRecord) ([]byte, error) {
+	return json.Marshal(mezmoLine{
+		Line:      recordMessage(record),
+		App:       record.FieldString(m.conf.AppField),
+		Level:     m.level(record),
+		Timestamp: record.TimeStamp.UnixNano() / int64(time.Millisecond),
+		Meta:      record,
+	})
+}
+
+func (m *MezmoPump) level(record *analytics.AnalyticsRecord) string {
+	if m.conf.LevelField != "" {
+		if level := record.FieldString(m.conf.LevelField); level != "" {
+			return strings.ToUpper(level)
+		}
+	}
+
+	switch {
+	case record.ResponseCode >= 500:
+		return "ERROR"
+	case record.ResponseCode >= 400:
+		return "WARN"
+	default:
+		return "INFO"
+	}
+}
+
+// ingest sends a batch of lines, given one per line, wrapping them in the lines list of the request
+func (m *MezmoPump) ingest(ctx context.Context, hostname string, lines []byte) error {
+	var body bytes.Buffer
+	var w io.Writer = &body
+	var zw *gzip.Writer
+	if m.conf.Compress {
+		zw = gzip.NewWriter(&body)
+		w = zw
+	}
+	w.Write([]byte(`{"lines":`))
+	w.Write(ndjsonArray(lines))
+	w.Write([]byte(`}`))
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	query := url.Values{}
+	query.Set("hostname", hostname)
+	query.Set("now", strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
+	if len(m.conf.Tags) > 0 {
+		query.Set("tags", strings.Join(m.conf.Tags, ","))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, m.conf.URL+"?"+query.Encode(), &body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(m.conf.IngestionKey, "")
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if m.conf.Compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("mezmo responded with status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package pumps
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestMezmoWriteData(t *testing.T) {
+	type request struct {
+		hostname string
+		tags     string
+		lines    []map[string]interface{}
+	}
+	requests := []request{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, _, _ := r.BasicAuth(); user != "key" {
+			t.Errorf("expected the ingestion key as the user, got %q", user)
+		}
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Error("expected the request to be gzipped")
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := struct {
+			Lines []map[string]interface{} `json:"lines"`
+		}{}
+		if err := json.NewDecoder(zr).Decode(&body); err != nil {
+			t.Errorf("expected the lines as JSON: %v", err)
+		}
+		requests = append(requests, request{r.URL.Query().Get("hostname"), r.URL.Query().Get("tags"), body.Lines})
+		if r.URL.Query().Get("hostname") == "b.com" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	pump := &MezmoPump{}
+	err := pump.Init(map[string]interface{}{
+		"ingestion_key": "key",
+		"url":           server.URL,
+		"hostname":      "tyk",
+		"tags":          []string{"tyk", "gateway"},
+		"batch_size":    2,
+		"compress":      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{Host: "a.com", APIName: "api", Method: "GET", Path: "/a", ResponseCode: 200},
+		analytics.AnalyticsRecord{Host: "b.com", APIName: "api", ResponseCode: 404},
+		analytics.AnalyticsRecord{Host: "a.com", APIName: "api", ResponseCode: 500},
+		analytics.AnalyticsRecord{APIName: "other"},
+	}
+	failed, err := pump.WriteDataPartial(context.Background(), data)
+	if err == nil || len(failed) != 1 || failed[0].(analytics.AnalyticsRecord).Host != "b.com" {
+		t.Errorf("expected the record of the rejected request to fail, got %v: %v", failed, err)
+	}
+
+	if len(requests) != 3 {
+		t.Fatalf("expected a request per hostname, got %d", len(requests))
+	}
+	first := requests[0]
+	if first.hostname != "a.com" || first.tags != "tyk,gateway" || len(first.lines) != 2 {
+		t.Fatalf("unexpected first request %+v", first)
+	}
+	line := first.lines[0]
+	if line["line"] != "GET /a 200" || line["app"] != "api" || line["level"] != "INFO" {
+		t.Errorf("unexpected line %v", line)
+	}
+	if meta, ok := line["meta"].(map[string]interface{}); !ok || meta["host"] != "a.com" {
+		t.Errorf("expected the record as the metadata, got %v", line["meta"])
+	}
+	if first.lines[1]["level"] != "ERROR" {
+		t.Errorf("expected the 5xx responses at ERROR level, got %v", first.lines[1]["level"])
+	}
+	if requests[2].hostname != "tyk" || !strings.Contains(requests[2].lines[0]["app"].(string), "other") {
+		t.Errorf("expected the default hostname for the records without host, got %+v", requests[2])
+	}
+}
+
+func TestMezmoLevel(t *testing.T) {
+	pump := &MezmoPump{conf: &MezmoConf{LevelField: "tags"}}
+	if level := pump.level(&analytics.AnalyticsRecord{Tags: []string{"debug"}, ResponseCode: 500}); level != "DEBUG" {
+		t.Errorf("expected the level of the level field, got %s", level)
+	}
+	if level := pump.level(&analytics.AnalyticsRecord{ResponseCode: 429}); level != "WARN" {
+		t.Errorf("expected the 4xx responses at WARN level, got %s", level)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-pump/analytics"
-	"github.com/mitchellh/mapstructure"
 	"github.com/moesif/moesifapi-go"
 	"github.com/moesif/moesifapi-go/models"
 	"io/ioutil"
@@ -57,6 +56,10 @@ type MoesifConf struct {
 	BulkConfig                 map[string]interface{} `mapstructure:"bulk_config"`
 	AuthorizationHeaderName    string                 `mapstructure:"authorization_header_name"`
 	AuthorizationUserIdField   string                 `mapstructure:"authorization_user_id_field"`
+	// UserIDRules and CompanyIDRules derive the user and company IDs, the first rule finding one wins. They replace
+	// user_id_header and company_id_header.
+	UserIDRules    []MoesifIDRule `mapstructure:"user_id_rules"`
+	CompanyIDRules []MoesifIDRule `mapstructure:"company_id_rules"`
 }
 
 func (p *MoesifPump) New() Pump {
@@ -230,15 +233,22 @@ func parseAuthorizationHeader(token string, field string) string {
 
 func (p *MoesifPump) Init(config interface{}) error {
 	p.moesifConf = &MoesifConf{}
-	p.log = log.WithField("prefix", moesifPrefix)
+	p.log = p.newLogger(moesifPrefix)
 
-	loadConfigErr := mapstructure.Decode(config, &p.moesifConf)
+	loadConfigErr := decodePumpConfig(p, p.log, config, &p.moesifConf)
 	if loadConfigErr != nil {
 		p.log.Fatal("Failed to decode configuration: ", loadConfigErr)
 	}
 
 	processPumpEnvVars(p, p.log, p.moesifConf, moesifDefaultENV)
 
+	for _, rule := range append(append([]MoesifIDRule{}, p.moesifConf.UserIDRules...), p.moesifConf.CompanyIDRules...) {
+		if err := rule.validate(); err != nil {
+			p.log.Error("Invalid ID rule: ", err)
+			return err
+		}
+	}
+
 	var apiEndpoint string
 	var batchSize int
 	var eventQueueSize int
@@ -295,6 +305,7 @@ func (p *MoesifPump) WriteData(ctx context.Context, data []interface{}) error {
 	}
 
 	transferEncoding := "base64"
+	events := make([]*models.EventModel, 0, len(data))
 	for dataIndex := range data {
 		var record, _ = data[dataIndex].(analytics.AnalyticsRecord)
 
@@ -365,11 +376,13 @@ func (p *MoesifPump) WriteData(ctx context.Context, data []interface{}) error {
 
 		// User Id
 		var userID string
-		if p.moesifConf.UserIDHeader != "" {
+		if len(p.moesifConf.UserIDRules) > 0 {
+			userID = p.idFromRules(p.moesifConf.UserIDRules, &record, decodedReqBody.headers, decodedRspBody.headers)
+		} else if p.moesifConf.UserIDHeader != "" {
 			userID = fetchIDFromHeader(decodedReqBody.headers, decodedRspBody.headers, p.moesifConf.UserIDHeader)
 		}
 
-		if userID == "" {
+		if userID == "" && len(p.moesifConf.UserIDRules) == 0 {
 			if record.Alias != "" {
 				userID = record.Alias
 			} else if record.OauthID != "" {
@@ -418,7 +431,9 @@ func (p *MoesifPump) WriteData(ctx context.Context, data []interface{}) error {
 
 		// Company Id
 		var companyID string
-		if p.moesifConf.CompanyIDHeader != "" {
+		if len(p.moesifConf.CompanyIDRules) > 0 {
+			companyID = p.idFromRules(p.moesifConf.CompanyIDRules, &record, decodedReqBody.headers, decodedRspBody.headers)
+		} else if p.moesifConf.CompanyIDHeader != "" {
 			companyID = fetchIDFromHeader(decodedReqBody.headers, decodedRspBody.headers, p.moesifConf.CompanyIDHeader)
 		}
 
@@ -431,6 +446,7 @@ func (p *MoesifPump) WriteData(ctx context.Context, data []interface{}) error {
 
 		if p.samplingPercentage < randomPercentage {
 			p.log.Debug("Skipped Event due to sampling percentage: " + strconv.Itoa(p.samplingPercentage) + " and random percentage: " + strconv.Itoa(randomPercentage))
+			p.DropRecords(DroppedFiltered, 1)
 			continue
 		}
 		// Add Weight to the Event Model
@@ -453,24 +469,33 @@ func (p *MoesifPump) WriteData(ctx context.Context, data []interface{}) error {
 			Weight:       &eventWeight,
 		}
 
-		err = p.moesifAPI.QueueEvent(&event)
-		if err != nil {
-			p.log.Error("Error while writing ", data[dataIndex], err)
+		events = append(events, &event)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The events are sent in batches by the Moesif client rather than one by one
+	if len(events) > 0 {
+		if err := p.moesifAPI.QueueEvents(events); err != nil {
+			p.log.Error("Error while writing ", len(events), " events: ", err)
+			return err
 		}
+	}
 
-		if p.moesifAPI.GetETag() != "" &&
-			p.eTag != "" &&
-			p.eTag != p.moesifAPI.GetETag() &&
-			time.Now().UTC().After(p.lastUpdatedTime.Add(time.Minute*1)) {
+	if p.moesifAPI.GetETag() != "" &&
+		p.eTag != "" &&
+		p.eTag != p.moesifAPI.GetETag() &&
+		time.Now().UTC().After(p.lastUpdatedTime.Add(time.Minute*1)) {
 
-			// Call Endpoint to fetch config
-			response, err := p.moesifAPI.GetAppConfig()
-			if err != nil {
-				log.WithFields(logrus.Fields{
-					"prefix": moesifPrefix,
-				}).Debug("Error fetching application configuration with err -  " + err.Error())
-				continue
-			}
+		// Call Endpoint to fetch config
+		response, err := p.moesifAPI.GetAppConfig()
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"prefix": moesifPrefix,
+			}).Debug("Error fetching application configuration with err -  " + err.Error())
+		} else {
 			p.samplingPercentage, p.eTag, p.lastUpdatedTime = p.parseConfiguration(response)
 		}
 	}
@@ -534,3 +559,19 @@ func (p *MoesifPump) SetTimeout(timeout int) {
 func (p *MoesifPump) GetTimeout() int {
 	return p.timeout
 }
+
+// Flush sends the events queued by the Moesif client
+func (p *MoesifPump) Flush() error {
+	if p.moesifAPI != nil {
+		p.moesifAPI.Flush()
+	}
+	return nil
+}
+
+// Close sends the queued events and stops the goroutine of the Moesif client sending them
+func (p *MoesifPump) Close() error {
+	if p.moesifAPI != nil {
+		p.moesifAPI.Close()
+	}
+	return nil
+}
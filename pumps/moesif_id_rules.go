@@ -0,0 +1,122 @@
+package pumps
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	moesifRequestHeaderSource  = "request_header"
+	moesifResponseHeaderSource = "response_header"
+	moesifJWTClaimSource       = "jwt_claim"
+	moesifBasicAuthSource      = "basic_auth"
+	moesifFieldSource          = "field"
+)
+
+// MoesifIDRule derives the user or company ID of an event from a request or response header, a claim of the JWT of
+// the authorization header, the user of its basic auth, or a record field
+type MoesifIDRule struct {
+	Source string `mapstructure:"source"`
+	Name   string `mapstructure:"name"`
+}
+
+func (r MoesifIDRule) validate() error {
+	switch r.Source {
+	case moesifRequestHeaderSource, moesifResponseHeaderSource, moesifJWTClaimSource:
+		if r.Name == "" {
+			return fmt.Errorf("the %s rule needs a name", r.Source)
+		}
+	case moesifBasicAuthSource:
+	case moesifFieldSource:
+		if !analytics.IsRecordField(r.Name) {
+			return fmt.Errorf("unknown record field %q", r.Name)
+		}
+	default:
+		return fmt.Errorf("invalid source %q, must be request_header, response_header, jwt_claim, basic_auth or field", r.Source)
+	}
+	return nil
+}
+
+// idFromRules returns the ID found by the first matching rule
+func (p *MoesifPump) idFromRules(rules []MoesifIDRule, record *analytics.AnalyticsRecord, reqHeaders, rspHeaders map[string]interface{}) string {
+	for _, rule := range rules {
+		var id string
+		switch rule.Source {
+		case moesifRequestHeaderSource:
+			id, _ = reqHeaders[strings.ToLower(rule.Name)].(string)
+		case moesifResponseHeaderSource:
+			id, _ = rspHeaders[strings.ToLower(rule.Name)].(string)
+		case moesifJWTClaimSource:
+			id = jwtClaim(p.authorizationHeader(reqHeaders), rule.Name)
+		case moesifBasicAuthSource:
+			id = basicAuthUser(p.authorizationHeader(reqHeaders))
+		case moesifFieldSource:
+			id = record.FieldString(rule.Name)
+		}
+
+		if id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+func (p *MoesifPump) authorizationHeader(reqHeaders map[string]interface{}) string {
+	name := "authorization"
+	if p.moesifConf.AuthorizationHeaderName != "" {
+		name = strings.ToLower(p.moesifConf.AuthorizationHeaderName)
+	}
+	header, _ := reqHeaders[name].(string)
+	return header
+}
+
+// jwtClaim returns the claim of the JWT, optionally prefixed by Bearer, formatted as a string. The token isn't
+// verified, the Gateway already did.
+func jwtClaim(token, claim string) string {
+	token = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(token), "Bearer"))
+	parts := strings.Split(token, ".")
+	if len(parts) < 2 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+
+	switch value := claims[claim].(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	}
+}
+
+func basicAuthUser(header string) string {
+	header = strings.TrimSpace(header)
+	if !strings.HasPrefix(header, "Basic ") {
+		return ""
+	}
+
+	credentials, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(header, "Basic ")))
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(string(credentials), ":", 2)[0]
+}
@@ -0,0 +1,83 @@
+package pumps
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+	"github.com/moesif/moesifapi-go"
+)
+
+func TestMoesifIDFromRules(t *testing.T) {
+	p := &MoesifPump{moesifConf: &MoesifConf{}}
+	// {"sub":"user1","org":{"id":7},"tenant":42}
+	token := "Bearer eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user1","org":{"id":7},"tenant":42}`)) + ".sig"
+	reqHeaders := map[string]interface{}{"authorization": token, "x-user": ""}
+	rspHeaders := map[string]interface{}{"x-company": "company1"}
+	record := &analytics.AnalyticsRecord{Alias: "alias1", OrgID: "org1"}
+
+	tests := []struct {
+		rules    []MoesifIDRule
+		expected string
+	}{
+		{[]MoesifIDRule{{Source: "request_header", Name: "X-User"}, {Source: "jwt_claim", Name: "sub"}}, "user1"},
+		{[]MoesifIDRule{{Source: "jwt_claim", Name: "tenant"}}, "42"},
+		{[]MoesifIDRule{{Source: "jwt_claim", Name: "org"}}, `{"id":7}`},
+		{[]MoesifIDRule{{Source: "response_header", Name: "X-Company"}}, "company1"},
+		{[]MoesifIDRule{{Source: "jwt_claim", Name: "missing"}, {Source: "field", Name: "org_id"}}, "org1"},
+		{[]MoesifIDRule{{Source: "basic_auth"}}, ""},
+	}
+	for _, test := range tests {
+		if id := p.idFromRules(test.rules, record, reqHeaders, rspHeaders); id != test.expected {
+			t.Errorf("expected %q for %+v, got %q", test.expected, test.rules, id)
+		}
+	}
+
+	reqHeaders["authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte("user2:secret"))
+	if id := p.idFromRules([]MoesifIDRule{{Source: "basic_auth"}}, record, reqHeaders, rspHeaders); id != "user2" {
+		t.Errorf("expected the basic auth user, got %q", id)
+	}
+}
+
+func TestMoesifIDRuleValidate(t *testing.T) {
+	invalid := []MoesifIDRule{
+		{Source: "cookie", Name: "id"},
+		{Source: "request_header"},
+		{Source: "field", Name: "unknown"},
+	}
+	for _, rule := range invalid {
+		if err := rule.validate(); err == nil {
+			t.Errorf("expected an error for %+v", rule)
+		}
+	}
+
+	if err := (MoesifIDRule{Source: "field", Name: "api_key"}).validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+// queuingMoesifAPI counts the flushes and closes of the queue of the Moesif client
+type queuingMoesifAPI struct {
+	moesifapi.API
+	flushes int
+	closes  int
+}
+
+func (a *queuingMoesifAPI) Flush() { a.flushes++ }
+func (a *queuingMoesifAPI) Close() { a.closes++ }
+
+func TestMoesifFlush(t *testing.T) {
+	p := &MoesifPump{}
+	if err := p.Flush(); err != nil {
+		t.Fatal("expected a pump not initialised to flush nothing, got", err)
+	}
+
+	api := &queuingMoesifAPI{}
+	p.moesifAPI = api
+	if err := p.Flush(); err != nil || api.flushes != 1 {
+		t.Errorf("expected the queued events to be sent, got %d flushes %v", api.flushes, err)
+	}
+	if err := p.Close(); err != nil || api.closes != 1 {
+		t.Errorf("expected the client to be closed, got %d closes %v", api.closes, err)
+	}
+}
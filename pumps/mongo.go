@@ -9,6 +9,7 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -20,8 +21,9 @@ import (
 	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-pump/analytics"
 	"github.com/kelseyhightower/envconfig"
-	"github.com/mitchellh/mapstructure"
+	"github.com/lonelycode/mgohacks"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
@@ -60,6 +62,10 @@ type BaseMongoConf struct {
 	MongoSSLCAFile                string    `json:"mongo_ssl_ca_file" mapstructure:"mongo_ssl_ca_file"`
 	MongoSSLPEMKeyfile            string    `json:"mongo_ssl_pem_keyfile" mapstructure:"mongo_ssl_pem_keyfile"`
 	MongoDBType                   MongoType `json:"mongo_db_type" mapstructure:"mongo_db_type"`
+	// TLS enables TLS like MongoUseSSL, the mongo_ssl_ options are used for the settings it leaves unset
+	TLS TLSConf `json:"tls" mapstructure:"tls"`
+	// Proxy is the proxy of the connections to the mongo servers
+	Proxy ProxyConf `json:"proxy" mapstructure:"proxy"`
 }
 
 func (b *BaseMongoConf) GetBlurredURL() string {
@@ -73,13 +79,22 @@ func (b *BaseMongoConf) GetBlurredURL() string {
 }
 
 type MongoConf struct {
-	BaseMongoConf
+	BaseMongoConf `mapstructure:",squash"`
 
 	CollectionName            string `json:"collection_name" mapstructure:"collection_name"`
 	MaxInsertBatchSizeBytes   int    `json:"max_insert_batch_size_bytes" mapstructure:"max_insert_batch_size_bytes"`
 	MaxDocumentSizeBytes      int    `json:"max_document_size_bytes" mapstructure:"max_document_size_bytes"`
 	CollectionCapMaxSizeBytes int    `json:"collection_cap_max_size_bytes" mapstructure:"collection_cap_max_size_bytes"`
 	CollectionCapEnable       bool   `json:"collection_cap_enable" mapstructure:"collection_cap_enable"`
+	// TTLIndex creates a TTL index on the expiry of the records, so they are removed when they expire. It can't be
+	// used with a capped collection.
+	TTLIndex bool `json:"ttl_index" mapstructure:"ttl_index"`
+	// IdempotentWrites writes the records with their hash as ID, so the records written twice, like the replayed
+	// ones, replace the ones already written instead of being duplicated
+	IdempotentWrites bool `json:"idempotent_writes" mapstructure:"idempotent_writes"`
+	// IDFields are the record fields the IDs of idempotent_writes are hashed from, the fields identifying the request
+	// by default
+	IDFields []string `json:"id_fields" mapstructure:"id_fields"`
 }
 
 func loadCertficateAndKeyFromFile(path string) (*tls.Certificate, error) {
@@ -151,22 +166,28 @@ func mongoDialInfo(conf BaseMongoConf) (dialInfo *mgo.DialInfo, err error) {
 		return dialInfo, err
 	}
 
-	if conf.MongoUseSSL {
+	dial, err := conf.Proxy.dialer(10 * time.Second)
+	if err != nil {
+		return dialInfo, err
+	}
+	if conf.Proxy.URL != "" {
 		dialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
-			tlsConfig := &tls.Config{}
-			if conf.MongoSSLInsecureSkipVerify {
-				tlsConfig.InsecureSkipVerify = true
-			}
+			return dial(addr.String())
+		}
+	}
 
-			if conf.MongoSSLCAFile != "" {
-				caCert, err := ioutil.ReadFile(conf.MongoSSLCAFile)
-				if err != nil {
-					log.Fatal("Can't load mongo CA certificates: ", err)
-				}
-				caCertPool := x509.NewCertPool()
-				caCertPool.AppendCertsFromPEM(caCert)
-				tlsConfig.RootCAs = caCertPool
-			}
+	if conf.MongoUseSSL || conf.TLS.IsSet() {
+		// the client certificate of mongo_ssl_pem_keyfile is loaded separately, its file has the key too
+		tlsConfig, err := conf.TLS.withLegacy(TLSConf{
+			CAFile:             conf.MongoSSLCAFile,
+			InsecureSkipVerify: conf.MongoSSLInsecureSkipVerify,
+		}).ClientConfig("")
+		if err != nil {
+			log.Fatal("Can't load the mongo TLS configuration: ", err)
+		}
+
+		dialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			tlsConfig := tlsConfig.Clone()
 
 			if conf.MongoSSLAllowInvalidHostnames {
 				tlsConfig.InsecureSkipVerify = true
@@ -205,7 +226,7 @@ func mongoDialInfo(conf BaseMongoConf) (dialInfo *mgo.DialInfo, err error) {
 				}
 			}
 
-			if conf.MongoSSLPEMKeyfile != "" {
+			if conf.MongoSSLPEMKeyfile != "" && len(tlsConfig.Certificates) == 0 {
 				cert, err := loadCertficateAndKeyFromFile(conf.MongoSSLPEMKeyfile)
 				if err != nil {
 					log.Fatal("Can't load mongo client certificate: ", err)
@@ -214,7 +235,7 @@ func mongoDialInfo(conf BaseMongoConf) (dialInfo *mgo.DialInfo, err error) {
 				tlsConfig.Certificates = []tls.Certificate{*cert}
 			}
 
-			return tls.Dial("tcp", addr.String(), tlsConfig)
+			return dialTLS(dial, addr.String(), tlsConfig, 10*time.Second)
 		}
 	}
 
@@ -230,24 +251,28 @@ func (m *MongoPump) GetName() string {
 	return "MongoDB Pump"
 }
 
+// Close closes the session to MongoDB
+func (m *MongoPump) Close() error {
+	if m.dbSession != nil {
+		m.dbSession.Close()
+	}
+	return nil
+}
+
 func (m *MongoPump) GetEnvPrefix() string {
 	return m.dbConf.EnvPrefix
 }
 
 func (m *MongoPump) Init(config interface{}) error {
 	m.dbConf = &MongoConf{}
-	m.log = log.WithField("prefix", mongoPrefix)
+	m.log = m.newLogger(mongoPrefix)
 
-	err := mapstructure.Decode(config, &m.dbConf)
+	err := decodePumpConfig(m, m.log, config, &m.dbConf)
 	if err == nil {
-		err = mapstructure.Decode(config, &m.dbConf.BaseMongoConf)
 		m.log.WithFields(logrus.Fields{
 			"url":             m.dbConf.GetBlurredURL(),
 			"collection_name": m.dbConf.CollectionName,
 		}).Info("Init")
-		if err != nil {
-			panic(m.dbConf.BaseMongoConf)
-		}
 	}
 	if err != nil {
 		m.log.Fatal("Failed to decode configuration: ", err)
@@ -281,13 +306,25 @@ func (m *MongoPump) Init(config interface{}) error {
 		m.dbConf.MaxDocumentSizeBytes = 10 * MiB
 	}
 
+	if m.dbConf.TTLIndex && m.dbConf.CollectionCapEnable {
+		return errors.New("ttl_index can't be enabled with collection_cap_enable, capped collections don't support TTL indexes")
+	}
+
+	for _, field := range m.dbConf.IDFields {
+		if !analytics.IsRecordField(field) {
+			return fmt.Errorf("unknown id field %s", field)
+		}
+	}
+
 	m.connect()
 
-	m.capCollection()
+	if !m.dryRun {
+		m.capCollection()
 
-	indexCreateErr := m.ensureIndexes()
-	if indexCreateErr != nil {
-		m.log.Error(indexCreateErr)
+		indexCreateErr := m.ensureIndexes()
+		if indexCreateErr != nil {
+			m.log.Error(indexCreateErr)
+		}
 	}
 
 	m.log.Debug("MongoDB DB CS: ", m.dbConf.GetBlurredURL())
@@ -398,6 +435,19 @@ func (m *MongoPump) ensureIndexes() error {
 		return err
 	}
 
+	if m.dbConf.TTLIndex {
+		ttlIndex := mgo.Index{
+			Key:         []string{"expireAt"},
+			ExpireAfter: 0,
+			Background:  m.dbConf.MongoDBType == StandardMongo,
+		}
+
+		err = mgohacks.EnsureTTLIndex(c, ttlIndex)
+		if err != nil {
+			return err
+		}
+	}
+
 	logBrowserIndex := mgo.Index{
 		Name:       "logBrowserIndex",
 		Key:        []string{"-timestamp", "orgid", "apiid", "apikey", "responsecode"},
@@ -438,6 +488,19 @@ func (m *MongoPump) connect() {
 }
 
 func (m *MongoPump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := m.WriteDataPartial(ctx, data)
+	return err
+}
+
+// mongoSetResult is the result of writing one of the sets of records accumulated by AccumulateSet
+type mongoSetResult struct {
+	set int
+	err error
+}
+
+// WriteDataPartial writes the records in sets of up to the max document size, returning the records of the sets that
+// failed and of the ones still being written at the deadline
+func (m *MongoPump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
 
 	collectionName := m.dbConf.CollectionName
 	if collectionName == "" {
@@ -452,9 +515,14 @@ func (m *MongoPump) WriteData(ctx context.Context, data []interface{}) error {
 	}
 	accumulateSet := m.AccumulateSet(data)
 
-	errCh := make(chan error, len(accumulateSet))
-	for _, dataSet := range accumulateSet {
-		go func(dataSet []interface{}, errCh chan error) {
+	resultCh := make(chan mongoSetResult, len(accumulateSet))
+	for i, dataSet := range accumulateSet {
+		go func(set int, dataSet []interface{}) {
+			if err := ctx.Err(); err != nil {
+				resultCh <- mongoSetResult{set, err}
+				return
+			}
+
 			sess := m.dbSession.Copy()
 			defer sess.Close()
 
@@ -465,34 +533,80 @@ func (m *MongoPump) WriteData(ctx context.Context, data []interface{}) error {
 				"number of records": len(dataSet),
 			}).Debug("Attempt to purge records")
 
-			err := analyticsCollection.Insert(dataSet...)
+			var err error
+			if m.dbConf.IdempotentWrites {
+				err = upsertRecords(analyticsCollection, dataSet, m.dbConf.IDFields)
+			} else {
+				err = analyticsCollection.Insert(dataSet...)
+			}
 			if err != nil {
 				m.log.WithFields(logrus.Fields{"collection": collectionName, "number of records": len(dataSet)}).Error("Problem inserting to mongo collection: ", err)
 
 				if strings.Contains(strings.ToLower(err.Error()), "closed explicitly") {
 					m.log.Warning("--> Detected connection failure!")
 				}
-				errCh <- err
+				resultCh <- mongoSetResult{set, err}
+				return
 			}
-			errCh <- nil
+			resultCh <- mongoSetResult{set, nil}
 			m.log.WithFields(logrus.Fields{
 				"collection":        collectionName,
 				"number of records": len(dataSet),
 			}).Info("Completed purging the records")
-		}(dataSet, errCh)
+		}(i, dataSet)
 	}
 
+	failed := []interface{}{}
+	var lastErr error
+	done := make([]bool, len(accumulateSet))
 	for range accumulateSet {
 		select {
-		case err := <-errCh:
-			if err != nil {
-				return err
+		case result := <-resultCh:
+			done[result.set] = true
+			if result.err != nil {
+				failed = append(failed, accumulateSet[result.set]...)
+				lastErr = result.err
+			}
+		case <-ctx.Done():
+			// mgo doesn't take a context, so the inserts still running at the deadline are left behind and their
+			// records reported as failed, even though some may get written
+			for set, dataSet := range accumulateSet {
+				if !done[set] {
+					failed = append(failed, dataSet...)
+				}
 			}
+			return failed, ctx.Err()
 		}
 	}
+
+	if len(failed) > 0 {
+		return failed, lastErr
+	}
 	m.log.Info("Purged ", len(data), " records...")
 
-	return nil
+	return nil, nil
+}
+
+// upsertRecords writes the records with their hash as ID, replacing the ones with the same ID. The hash is the one of
+// idFields when set.
+func upsertRecords(c *mgo.Collection, records []interface{}, idFields []string) error {
+	bulk := c.Bulk()
+	bulk.Unordered()
+	for _, item := range records {
+		record := item.(analytics.AnalyticsRecord)
+		bulk.Upsert(bson.M{"_id": mongoRecordID(&record, idFields)}, record)
+	}
+	_, err := bulk.Run()
+	return err
+}
+
+// mongoRecordID returns the hash of the idFields of the record, or of the fields identifying its request when there
+// are none
+func mongoRecordID(record *analytics.AnalyticsRecord, idFields []string) string {
+	if len(idFields) > 0 {
+		return record.HashFields(idFields)
+	}
+	return record.Hash()
 }
 
 func (m *MongoPump) AccumulateSet(data []interface{}) [][]interface{} {
@@ -594,3 +708,52 @@ func (m *MongoPump) WriteUptimeData(data []interface{}) {
 		}
 	}
 }
+
+// ReadData reads the analytics records stored in the collection between since and until, oldest first
+func (m *MongoPump) ReadData(ctx context.Context, since, until time.Time, batchSize int, fn func([]interface{}) error) error {
+	for m.dbSession == nil {
+		m.log.Debug("Connecting to analytics store")
+		m.connect()
+	}
+
+	sess := m.dbSession.Copy()
+	defer sess.Close()
+
+	timeRange := bson.M{"$gte": since}
+	if !until.IsZero() {
+		timeRange["$lt"] = until
+	}
+
+	iter := sess.DB("").C(m.dbConf.CollectionName).Find(bson.M{"timestamp": timeRange}).Sort("timestamp").Batch(batchSize).Iter()
+
+	batch := make([]interface{}, 0, batchSize)
+	record := analytics.AnalyticsRecord{}
+	for iter.Next(&record) {
+		batch = append(batch, record)
+		record = analytics.AnalyticsRecord{}
+
+		if len(batch) < batchSize {
+			continue
+		}
+
+		if err := fn(batch); err != nil {
+			iter.Close()
+			return err
+		}
+		batch = make([]interface{}, 0, batchSize)
+
+		if ctx.Err() != nil {
+			iter.Close()
+			return ctx.Err()
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	if len(batch) > 0 {
+		return fn(batch)
+	}
+	return nil
+}
@@ -10,7 +10,6 @@ import (
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/lonelycode/mgohacks"
-	"github.com/mitchellh/mapstructure"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
@@ -31,13 +30,15 @@ type MongoAggregatePump struct {
 }
 
 type MongoAggregateConf struct {
-	BaseMongoConf
-	UseMixedCollection      bool     `mapstructure:"use_mixed_collection"`
-	TrackAllPaths           bool     `mapstructure:"track_all_paths"`
-	IgnoreTagPrefixList     []string `mapstructure:"ignore_tag_prefix_list"`
-	ThresholdLenTagList     int      `mapstructure:"threshold_len_tag_list"`
-	StoreAnalyticsPerMinute bool     `mapstructure:"store_analytics_per_minute"`
-	IgnoreAggregationsList  []string `mapstructure:"ignore_aggregations"`
+	BaseMongoConf           `mapstructure:",squash"`
+	UseMixedCollection      bool                                   `mapstructure:"use_mixed_collection"`
+	TrackAllPaths           bool                                   `mapstructure:"track_all_paths"`
+	IgnoreTagPrefixList     []string                               `mapstructure:"ignore_tag_prefix_list"`
+	ThresholdLenTagList     int                                    `mapstructure:"threshold_len_tag_list"`
+	StoreAnalyticsPerMinute bool                                   `mapstructure:"store_analytics_per_minute"`
+	IgnoreAggregationsList  []string                               `mapstructure:"ignore_aggregations"`
+	AggregationDimensions   []string                               `mapstructure:"aggregation_dimensions"`
+	LatencyThresholds       map[string]analytics.LatencyThresholds `mapstructure:"latency_thresholds"`
 }
 
 func (m *MongoAggregatePump) New() Pump {
@@ -118,6 +119,14 @@ func (m *MongoAggregatePump) GetName() string {
 	return "MongoDB Aggregate Pump"
 }
 
+// Close closes the session to MongoDB
+func (m *MongoAggregatePump) Close() error {
+	if m.dbSession != nil {
+		m.dbSession.Close()
+	}
+	return nil
+}
+
 func (m *MongoAggregatePump) GetEnvPrefix() string {
 	return m.dbConf.EnvPrefix
 }
@@ -132,12 +141,9 @@ func (m *MongoAggregatePump) GetCollectionName(orgid string) (string, error) {
 
 func (m *MongoAggregatePump) Init(config interface{}) error {
 	m.dbConf = &MongoAggregateConf{}
-	m.log = log.WithField("prefix", analytics.MongoAggregatePrefix)
+	m.log = m.newLogger(analytics.MongoAggregatePrefix)
 
-	err := mapstructure.Decode(config, &m.dbConf)
-	if err == nil {
-		err = mapstructure.Decode(config, &m.dbConf.BaseMongoConf)
-	}
+	err := decodePumpConfig(m, m.log, config, &m.dbConf)
 
 	if err != nil {
 		m.log.Fatal("Failed to decode configuration: ", err)
@@ -226,13 +232,17 @@ func (m *MongoAggregatePump) WriteData(ctx context.Context, data []interface{})
 	if m.dbSession == nil {
 		m.log.Debug("Connecting to analytics store")
 		m.connect()
-		m.WriteData(ctx, data)
+		return m.WriteData(ctx, data)
 	} else {
 		// calculate aggregates
-		analyticsPerOrg := analytics.AggregateData(data, m.dbConf.TrackAllPaths, m.dbConf.IgnoreTagPrefixList, m.dbConf.StoreAnalyticsPerMinute)
+		analyticsPerOrg := analytics.AggregateData(data, m.dbConf.TrackAllPaths, m.dbConf.IgnoreTagPrefixList, m.dbConf.StoreAnalyticsPerMinute, m.dbConf.AggregationDimensions, m.dbConf.LatencyThresholds)
 
 		// put aggregated data into MongoDB
 		for orgID, filteredData := range analyticsPerOrg {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			collectionName, collErr := m.GetCollectionName(orgID)
 			if collErr != nil {
 				m.log.Info("No OrgID for AnalyticsRecord, skipping")
@@ -356,8 +366,3 @@ func (m *MongoAggregatePump) HandleWriteErr(err error) error {
 	}
 	return err
 }
-
-// WriteUptimeData will pull the data from the in-memory store and drop it into the specified MongoDB collection
-func (m *MongoAggregatePump) WriteUptimeData(data []interface{}) {
-	m.log.Warning("Mongo Aggregate should not be writing uptime data!")
-}
@@ -8,7 +8,6 @@ import (
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/lonelycode/mgohacks"
-	"github.com/mitchellh/mapstructure"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/vmihailenco/msgpack.v2"
 
@@ -26,7 +25,7 @@ var mongoSelectivePumpPrefix = "PMP_MONGOSEL"
 var mongoSelectiveDefaultEnv = PUMPS_ENV_PREFIX + "_MONGOSELECTIVE" + PUMPS_ENV_META_PREFIX
 
 type MongoSelectiveConf struct {
-	BaseMongoConf
+	BaseMongoConf           `mapstructure:",squash"`
 	MaxInsertBatchSizeBytes int `mapstructure:"max_insert_batch_size_bytes"`
 	MaxDocumentSizeBytes    int `mapstructure:"max_document_size_bytes"`
 }
@@ -40,6 +39,14 @@ func (m *MongoSelectivePump) GetName() string {
 	return "MongoDB Selective Pump"
 }
 
+// Close closes the session to MongoDB
+func (m *MongoSelectivePump) Close() error {
+	if m.dbSession != nil {
+		m.dbSession.Close()
+	}
+	return nil
+}
+
 func (m *MongoSelectivePump) GetEnvPrefix() string {
 	return m.dbConf.EnvPrefix
 }
@@ -53,12 +60,9 @@ func (m *MongoSelectivePump) GetCollectionName(orgid string) (string, error) {
 
 func (m *MongoSelectivePump) Init(config interface{}) error {
 	m.dbConf = &MongoSelectiveConf{}
-	m.log = log.WithField("prefix", mongoSelectivePrefix)
+	m.log = m.newLogger(mongoSelectivePrefix)
 
-	err := mapstructure.Decode(config, &m.dbConf)
-	if err == nil {
-		err = mapstructure.Decode(config, &m.dbConf.BaseMongoConf)
-	}
+	err := decodePumpConfig(m, m.log, config, &m.dbConf)
 
 	if err != nil {
 		m.log.Fatal("Failed to decode configuration: ", err)
@@ -159,7 +163,7 @@ func (m *MongoSelectivePump) WriteData(ctx context.Context, data []interface{})
 	if m.dbSession == nil {
 		m.log.Debug("Connecting to analytics store")
 		m.connect()
-		m.WriteData(ctx, data)
+		return m.WriteData(ctx, data)
 	} else {
 		analyticsPerOrg := make(map[string][]interface{})
 
@@ -185,6 +189,10 @@ func (m *MongoSelectivePump) WriteData(ctx context.Context, data []interface{})
 		for col_name, filtered_data := range analyticsPerOrg {
 
 			for _, dataSet := range m.AccumulateSet(filtered_data) {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
 				thisSession := m.dbSession.Copy()
 				defer thisSession.Close()
 				analyticsCollection := thisSession.DB("").C(col_name)
@@ -227,6 +235,7 @@ func (m *MongoSelectivePump) AccumulateSet(data []interface{}) [][]interface{} {
 		skip := false
 		if sizeBytes > m.dbConf.MaxDocumentSizeBytes {
 			m.log.Warning("Document too large, skipping!")
+			m.DropRecords(DroppedTooLarge, 1)
 			skip = true
 		}
 
@@ -0,0 +1,80 @@
+package pumps
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// ndjsonBatch is a batch of records encoded as new line delimited JSON, one record per line
+type ndjsonBatch struct {
+	records []interface{}
+	body    []byte
+}
+
+// ndjsonRecord encodes the record as a JSON line with its own field names
+func ndjsonRecord(record *analytics.AnalyticsRecord) ([]byte, error) {
+	return json.Marshal(record)
+}
+
+// ndjsonBatches encodes the records into batches of up to maxRecords records and maxBytes bytes, when they are
+// greater than 0. A record larger than maxBytes gets a batch of its own. The records encode fails for are returned
+// apart.
+func ndjsonBatches(data []interface{}, maxRecords, maxBytes int, encode func(*analytics.AnalyticsRecord) ([]byte, error)) ([]ndjsonBatch, []interface{}) {
+	batches := []ndjsonBatch{}
+	unencoded := []interface{}{}
+
+	var current ndjsonBatch
+	var body bytes.Buffer
+	flush := func() {
+		if len(current.records) == 0 {
+			return
+		}
+		current.body = append([]byte{}, body.Bytes()...)
+		batches = append(batches, current)
+		current = ndjsonBatch{}
+		body.Reset()
+	}
+
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			unencoded = append(unencoded, v)
+			continue
+		}
+		line, err := encode(&record)
+		if err != nil {
+			unencoded = append(unencoded, v)
+			continue
+		}
+
+		if maxBytes > 0 && body.Len() > 0 && body.Len()+len(line)+1 > maxBytes {
+			flush()
+		}
+		body.Write(line)
+		body.WriteByte('\n')
+		current.records = append(current.records, v)
+		if maxRecords > 0 && len(current.records) >= maxRecords {
+			flush()
+		}
+	}
+	flush()
+
+	return batches, unencoded
+}
+
+// ndjsonRecords returns the records of the batches
+func ndjsonRecords(batches []ndjsonBatch) []interface{} {
+	records := []interface{}{}
+	for _, batch := range batches {
+		records = append(records, batch.records...)
+	}
+	return records
+}
+
+// ndjsonArray turns a batch body into a JSON array of its lines, for the APIs taking a list of records
+func ndjsonArray(body []byte) []byte {
+	lines := bytes.Replace(bytes.TrimSuffix(body, []byte("\n")), []byte("\n"), []byte(","), -1)
+	return append(append([]byte("["), lines...), ']')
+}
@@ -0,0 +1,55 @@
+package pumps
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestNDJSONBatches(t *testing.T) {
+	encode := func(record *analytics.AnalyticsRecord) ([]byte, error) {
+		if record.APIID == "bad" {
+			return nil, errors.New("can't encode")
+		}
+		return []byte(`{"api_id":"` + record.APIID + `"}`), nil
+	}
+	data := []interface{}{
+		analytics.AnalyticsRecord{APIID: "1"},
+		analytics.AnalyticsRecord{APIID: "2"},
+		analytics.AnalyticsRecord{APIID: "bad"},
+		analytics.AnalyticsRecord{APIID: "3"},
+		analytics.AnalyticsRecord{APIID: "a-very-long-api-id"},
+		analytics.AnalyticsRecord{APIID: "4"},
+	}
+
+	batches, unencoded := ndjsonBatches(data, 2, 40, encode)
+	if len(unencoded) != 1 || unencoded[0].(analytics.AnalyticsRecord).APIID != "bad" {
+		t.Errorf("expected the record that can't be encoded apart, got %v", unencoded)
+	}
+
+	expected := []string{
+		"{\"api_id\":\"1\"}\n{\"api_id\":\"2\"}\n",
+		"{\"api_id\":\"3\"}\n",
+		"{\"api_id\":\"a-very-long-api-id\"}\n",
+		"{\"api_id\":\"4\"}\n",
+	}
+	if len(batches) != len(expected) {
+		t.Fatalf("expected %d batches, got %d", len(expected), len(batches))
+	}
+	for i, batch := range batches {
+		if string(batch.body) != expected[i] {
+			t.Errorf("expected batch %d to be %q, got %q", i, expected[i], batch.body)
+		}
+		if len(batch.records) != strings.Count(expected[i], "\n") {
+			t.Errorf("expected batch %d to have a record per line, got %d", i, len(batch.records))
+		}
+	}
+}
+
+func TestNDJSONArray(t *testing.T) {
+	if array := string(ndjsonArray([]byte("{\"a\":1}\n{\"b\":2}\n"))); array != `[{"a":1},{"b":2}]` {
+		t.Errorf("unexpected array %s", array)
+	}
+}
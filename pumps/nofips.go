@@ -0,0 +1,7 @@
+//go:build !boringcrypto
+// +build !boringcrypto
+
+package pumps
+
+// FIPSMode is whether Tyk Pump is built with the FIPS-validated BoringCrypto module, with GOEXPERIMENT=boringcrypto
+const FIPSMode = false
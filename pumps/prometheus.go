@@ -3,14 +3,19 @@ package pumps
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
 
-	"github.com/mitchellh/mapstructure"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 )
 
 type PrometheusPump struct {
@@ -22,13 +27,211 @@ type PrometheusPump struct {
 	OauthStatusMetrics  *prometheus.CounterVec
 	TotalLatencyMetrics *prometheus.HistogramVec
 
+	// counters are the built-in counters with the labels they keep once the drop_labels are removed
+	counters        []prometheusCounter
+	latencyLabels   []string
+	series          *prometheusSeries
+	lastSeriesPurge time.Time
+	client          *http.Client
+	// registry holds the metrics of the pump, so several instances of the pump don't register the same metrics
+	registry *prometheus.Registry
+	server   *http.Server
+	listener net.Listener
+
 	CommonPumpConfig
 }
 
+type prometheusCounter struct {
+	name string
+	vec  *prometheus.CounterVec
+	// allLabels are all the labels the counter needs, including the dropped ones
+	allLabels []string
+	labels    []string
+}
+
+// prometheusLabels are the labels of the built-in metrics which can be dropped
+var prometheusLabels = []string{"code", "api", "path", "method", "key", "client_id", "country"}
+
 type PrometheusConf struct {
-	EnvPrefix string `mapstructure:"meta_env_prefix"`
-	Addr      string `mapstructure:"listen_address"`
-	Path      string `mapstructure:"path"`
+	EnvPrefix     string             `mapstructure:"meta_env_prefix"`
+	Addr          string             `mapstructure:"listen_address"`
+	Path          string             `mapstructure:"path"`
+	CustomMetrics []PrometheusMetric `mapstructure:"custom_metrics"`
+	// LatencyBuckets are the buckets of the tyk_latency histogram, in milliseconds
+	LatencyBuckets []float64 `mapstructure:"latency_buckets"`
+	// APILabel is the record field used as the api label, api_id or api_name
+	APILabel string `mapstructure:"api_label"`
+	// KeyLabel is the record field used as the key label, api_key or alias. The key is used for the keys without alias.
+	KeyLabel string `mapstructure:"key_label"`
+	// ResponseCodeClass replaces the response code in the code label by its class, like 2xx
+	ResponseCodeClass bool `mapstructure:"response_code_class"`
+	// GeoLabel adds the country of the client, its ISO code, as the country label of tyk_http_status
+	GeoLabel bool `mapstructure:"geo_label"`
+	// DropLabels are the labels removed from the built-in metrics, which are aggregated by the rest of the labels
+	DropLabels []string `mapstructure:"drop_labels"`
+	// SeriesTTL is the number of seconds after which the series that weren't updated are removed, 0 keeps them forever
+	SeriesTTL int `mapstructure:"series_ttl"`
+	// Mode is how the metrics reach Prometheus: pull, the default, exposes them on listen_address, push sends them to
+	// a Pushgateway and remote_write to a remote write endpoint, after every purge
+	Mode           string `mapstructure:"mode"`
+	PushGatewayURL string `mapstructure:"push_gateway_url"`
+	// PushJob is the job the metrics are pushed to the Pushgateway as, tyk-pump by default
+	PushJob            string            `mapstructure:"push_job"`
+	RemoteWriteURL     string            `mapstructure:"remote_write_url"`
+	RemoteWriteHeaders map[string]string `mapstructure:"remote_write_headers"`
+}
+
+const (
+	prometheusPullMode        = "pull"
+	prometheusPushMode        = "push"
+	prometheusRemoteWriteMode = "remote_write"
+)
+
+// PrometheusMetric is a user defined metric, labelled and valued by record fields
+type PrometheusMetric struct {
+	Name string `mapstructure:"name"`
+	Help string `mapstructure:"help"`
+	// Type is counter or histogram
+	Type string `mapstructure:"type"`
+	// Labels are the json names of the record fields used as labels, like api_id or latency.total
+	Labels []string `mapstructure:"labels"`
+	// Value is the json name of the numeric record field observed by histograms or added to counters. Counters are
+	// incremented by one per record when it's empty.
+	Value   string    `mapstructure:"value"`
+	Buckets []float64 `mapstructure:"buckets"`
+
+	counterVec   *prometheus.CounterVec
+	histogramVec *prometheus.HistogramVec
+}
+
+const (
+	prometheusCounterType   = "counter"
+	prometheusHistogramType = "histogram"
+)
+
+// init validates the metric and registers its collector
+func (m *PrometheusMetric) init(registerer prometheus.Registerer) error {
+	if m.Name == "" {
+		return errors.New("custom metric without name")
+	}
+	if m.Help == "" {
+		m.Help = m.Name
+	}
+	if m.Value != "" && !analytics.IsRecordField(m.Value) {
+		return fmt.Errorf("custom metric %s: unknown value field %s", m.Name, m.Value)
+	}
+
+	labelNames := make([]string, len(m.Labels))
+	for i, label := range m.Labels {
+		if !analytics.IsRecordField(label) {
+			return fmt.Errorf("custom metric %s: unknown label field %s", m.Name, label)
+		}
+		labelNames[i] = strings.Replace(label, ".", "_", -1)
+	}
+
+	var collector prometheus.Collector
+	switch m.Type {
+	case prometheusCounterType:
+		m.counterVec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: m.Name, Help: m.Help}, labelNames)
+		collector = m.counterVec
+	case prometheusHistogramType:
+		if m.Value == "" {
+			return fmt.Errorf("custom metric %s: histograms need a value field", m.Name)
+		}
+		if len(m.Buckets) == 0 {
+			m.Buckets = buckets
+		}
+		m.histogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: m.Name, Help: m.Help, Buckets: m.Buckets}, labelNames)
+		collector = m.histogramVec
+	default:
+		return fmt.Errorf("custom metric %s: invalid type %q, must be counter or histogram", m.Name, m.Type)
+	}
+
+	return registerer.Register(collector)
+}
+
+// observe updates the metric with the record
+func (m *PrometheusMetric) observe(record *analytics.AnalyticsRecord, series *prometheusSeries) {
+	labelValues := make([]string, len(m.Labels))
+	for i, label := range m.Labels {
+		labelValues[i] = record.FieldString(label)
+	}
+
+	value := 1.0
+	if m.Value != "" {
+		var ok bool
+		if value, ok = record.FieldFloat(m.Value); !ok {
+			return
+		}
+	}
+
+	if m.counterVec != nil {
+		// counters can't go down
+		if value > 0 {
+			m.counterVec.WithLabelValues(labelValues...).Add(value)
+			series.touch(m.Name, m.counterVec, labelValues)
+		}
+		return
+	}
+	m.histogramVec.WithLabelValues(labelValues...).Observe(value)
+	series.touch(m.Name, m.histogramVec, labelValues)
+}
+
+// seriesDeleter is implemented by the metric vectors
+type seriesDeleter interface {
+	DeleteLabelValues(lvs ...string) bool
+}
+
+type trackedSeries struct {
+	vec         seriesDeleter
+	labelValues []string
+	lastUpdate  time.Time
+}
+
+// prometheusSeries tracks when every series was last updated, so the stale ones can be removed. A nil
+// prometheusSeries tracks nothing.
+type prometheusSeries struct {
+	mu     sync.Mutex
+	series map[string]*trackedSeries
+}
+
+func newPrometheusSeries() *prometheusSeries {
+	return &prometheusSeries{series: make(map[string]*trackedSeries)}
+}
+
+// touch records that the series of the metric with the given label values was just updated
+func (s *prometheusSeries) touch(metric string, vec seriesDeleter, labelValues []string) {
+	if s == nil {
+		return
+	}
+
+	key := metric + "\xff" + strings.Join(labelValues, "\xff")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tracked, ok := s.series[key]; ok {
+		tracked.lastUpdate = time.Now()
+		return
+	}
+	s.series[key] = &trackedSeries{vec: vec, labelValues: labelValues, lastUpdate: time.Now()}
+}
+
+// expire removes the series not updated since the given time, returning how many were removed
+func (s *prometheusSeries) expire(before time.Time) int {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := 0
+	for key, tracked := range s.series {
+		if tracked.lastUpdate.Before(before) {
+			tracked.vec.DeleteLabelValues(tracked.labelValues...)
+			delete(s.series, key)
+			expired++
+		}
+	}
+	return expired
 }
 
 var prometheusPrefix = "prometheus-pump"
@@ -38,70 +241,228 @@ var buckets = []float64{1, 2, 5, 7, 10, 15, 20, 25, 30, 40, 50, 60, 70, 80, 90,
 
 func (p *PrometheusPump) New() Pump {
 	newPump := PrometheusPump{}
-	newPump.TotalStatusMetrics = prometheus.NewCounterVec(
+	return &newPump
+}
+
+// initMetrics creates the registry of the pump and registers the built-in metrics, with the configured buckets, along
+// with the Go and process metrics
+func (p *PrometheusPump) initMetrics() error {
+	latencyBuckets := buckets
+	if len(p.conf.LatencyBuckets) > 0 {
+		latencyBuckets = p.conf.LatencyBuckets
+	}
+
+	p.counters = nil
+	p.TotalStatusMetrics = p.newCounter(
 		prometheus.CounterOpts{
 			Name: "tyk_http_status",
 			Help: "HTTP status codes per API",
 		},
-		[]string{"code", "api"},
+		p.apiStatusLabels()...,
 	)
-	newPump.PathStatusMetrics = prometheus.NewCounterVec(
+	p.PathStatusMetrics = p.newCounter(
 		prometheus.CounterOpts{
 			Name: "tyk_http_status_per_path",
 			Help: "HTTP status codes per API path and method",
 		},
-		[]string{"code", "api", "path", "method"},
+		"code", "api", "path", "method",
 	)
-	newPump.KeyStatusMetrics = prometheus.NewCounterVec(
+	p.KeyStatusMetrics = p.newCounter(
 		prometheus.CounterOpts{
 			Name: "tyk_http_status_per_key",
 			Help: "HTTP status codes per API key",
 		},
-		[]string{"code", "key"},
+		"code", "key",
 	)
-	newPump.OauthStatusMetrics = prometheus.NewCounterVec(
+	p.OauthStatusMetrics = p.newCounter(
 		prometheus.CounterOpts{
 			Name: "tyk_http_status_per_oauth_client",
 			Help: "HTTP status codes per oAuth client id",
 		},
-		[]string{"code", "client_id"},
+		"code", "client_id",
 	)
-	newPump.TotalLatencyMetrics = prometheus.NewHistogramVec(
+	p.latencyLabels = p.keptLabels("type", "api")
+	p.TotalLatencyMetrics = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "tyk_latency",
 			Help:    "Latency added by Tyk, Total Latency, and upstream latency per API",
-			Buckets: buckets,
+			Buckets: latencyBuckets,
 		},
-		[]string{"type", "api"},
+		p.latencyLabels,
 	)
 
-	prometheus.MustRegister(newPump.TotalStatusMetrics)
-	prometheus.MustRegister(newPump.PathStatusMetrics)
-	prometheus.MustRegister(newPump.KeyStatusMetrics)
-	prometheus.MustRegister(newPump.OauthStatusMetrics)
-	prometheus.MustRegister(newPump.TotalLatencyMetrics)
-	return &newPump
+	p.registry = prometheus.NewRegistry()
+	collectors := []prometheus.Collector{
+		p.TotalStatusMetrics, p.PathStatusMetrics, p.KeyStatusMetrics, p.OauthStatusMetrics, p.TotalLatencyMetrics,
+		prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	}
+	for _, collector := range collectors {
+		if err := p.registry.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apiStatusLabels returns the labels of tyk_http_status, which has the country label when geo_label is enabled
+func (p *PrometheusPump) apiStatusLabels() []string {
+	if p.conf.GeoLabel {
+		return []string{"code", "api", "country"}
+	}
+	return []string{"code", "api"}
+}
+
+// keptLabels returns the labels which aren't dropped by the configuration
+func (p *PrometheusPump) keptLabels(labels ...string) []string {
+	kept := []string{}
+	for _, label := range labels {
+		dropped := false
+		for _, dropLabel := range p.conf.DropLabels {
+			if label == dropLabel {
+				dropped = true
+				break
+			}
+		}
+		if !dropped {
+			kept = append(kept, label)
+		}
+	}
+	return kept
+}
+
+// newCounter creates a built-in counter with the labels which aren't dropped
+func (p *PrometheusPump) newCounter(opts prometheus.CounterOpts, labels ...string) *prometheus.CounterVec {
+	counter := prometheusCounter{name: opts.Name, allLabels: labels, labels: p.keptLabels(labels...)}
+	counter.vec = prometheus.NewCounterVec(opts, counter.labels)
+	p.counters = append(p.counters, counter)
+	return counter.vec
+}
+
+// apiLabel returns the value of the api label of the record
+func (p *PrometheusPump) apiLabel(record analytics.AnalyticsRecord) string {
+	if p.conf.APILabel == "api_name" {
+		return record.APIName
+	}
+	return record.APIID
+}
+
+// keyLabel returns the value of the key label of the record
+func (p *PrometheusPump) keyLabel(record analytics.AnalyticsRecord) string {
+	if p.conf.KeyLabel == "alias" && record.Alias != "" {
+		return record.Alias
+	}
+	return record.APIKey
+}
+
+// codeLabel returns the value of the code label of the record, the response code or its class, like 2xx
+func (p *PrometheusPump) codeLabel(record analytics.AnalyticsRecord) string {
+	if p.conf.ResponseCodeClass && record.ResponseCode >= 100 {
+		return strconv.Itoa(record.ResponseCode/100) + "xx"
+	}
+	return strconv.Itoa(record.ResponseCode)
 }
 
 func (p *PrometheusPump) GetName() string {
 	return "Prometheus Pump"
 }
 
+// Close stops the listener exposing the metrics, the metrics are in the registry of the pump so nothing is left registered
+func (p *PrometheusPump) Close() error {
+	if p.server == nil {
+		return nil
+	}
+	err := p.server.Close()
+	// the listener may not be served yet, it's closed here so its address is free once the pump is closed
+	p.listener.Close()
+	return err
+}
+
 func (p *PrometheusPump) GetEnvPrefix() string {
 	return p.conf.EnvPrefix
 }
 
 func (p *PrometheusPump) Init(conf interface{}) error {
 	p.conf = &PrometheusConf{}
-	p.log = log.WithField("prefix", prometheusPrefix)
+	p.log = p.newLogger(prometheusPrefix)
 
-	err := mapstructure.Decode(conf, &p.conf)
+	err := decodePumpConfig(p, p.log, conf, &p.conf)
 	if err != nil {
 		p.log.Fatal("Failed to decode configuration: ", err)
 	}
 
 	processPumpEnvVars(p, p.log, p.conf, prometheusDefaultENV)
 
+	switch p.conf.APILabel {
+	case "", "api_id", "api_name":
+	default:
+		return fmt.Errorf("invalid api_label %q, must be api_id or api_name", p.conf.APILabel)
+	}
+	switch p.conf.KeyLabel {
+	case "", "api_key", "alias":
+	default:
+		return fmt.Errorf("invalid key_label %q, must be api_key or alias", p.conf.KeyLabel)
+	}
+
+	for _, label := range p.conf.DropLabels {
+		valid := false
+		for _, validLabel := range prometheusLabels {
+			if label == validLabel {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid label %q in drop_labels, must be one of %s", label, strings.Join(prometheusLabels, ", "))
+		}
+	}
+
+	if p.conf.SeriesTTL > 0 {
+		p.series = newPrometheusSeries()
+	}
+
+	if err := p.initMetrics(); err != nil {
+		return err
+	}
+
+	for i := range p.conf.CustomMetrics {
+		if err := p.conf.CustomMetrics[i].init(p.registry); err != nil {
+			return err
+		}
+	}
+
+	switch p.conf.Mode {
+	case "", prometheusPullMode:
+		if p.dryRun {
+			break
+		}
+		if err := p.listen(); err != nil {
+			return err
+		}
+	case prometheusPushMode:
+		if p.conf.PushGatewayURL == "" {
+			return errors.New("Prometheus push_gateway_url not set")
+		}
+		if p.conf.PushJob == "" {
+			p.conf.PushJob = "tyk-pump"
+		}
+		p.log.Info("Pushing metrics to: ", p.conf.PushGatewayURL)
+	case prometheusRemoteWriteMode:
+		if p.conf.RemoteWriteURL == "" {
+			return errors.New("Prometheus remote_write_url not set")
+		}
+		p.client = &http.Client{}
+		p.log.Info("Writing metrics to: ", p.conf.RemoteWriteURL)
+	default:
+		return fmt.Errorf("invalid mode %q, must be pull, push or remote_write", p.conf.Mode)
+	}
+
+	p.log.Info(p.GetName() + " Initialized")
+
+	return nil
+}
+
+// listen exposes the metrics on the configured address and path, for Prometheus to scrape them
+func (p *PrometheusPump) listen() error {
 	if p.conf.Path == "" {
 		p.conf.Path = "/metrics"
 	}
@@ -112,32 +473,120 @@ func (p *PrometheusPump) Init(conf interface{}) error {
 
 	p.log.Info("Starting prometheus listener on:", p.conf.Addr)
 
-	http.Handle(p.conf.Path, promhttp.Handler())
+	// the address is listened on here, so an address already used, like by another prometheus pump, fails Init
+	listener, err := net.Listen("tcp", p.conf.Addr)
+	if err != nil {
+		return fmt.Errorf("couldn't listen on %s, every prometheus pump in pull mode needs its own listen_address: %v", p.conf.Addr, err)
+	}
 
+	mux := http.NewServeMux()
+	mux.Handle(p.conf.Path, promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{}))
+	p.listener = listener
+	p.server = &http.Server{Handler: mux}
 	go func() {
-		log.Fatal(http.ListenAndServe(p.conf.Addr, nil))
+		if err := p.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			p.log.Error("Prometheus listener stopped: ", err)
+		}
 	}()
-	p.log.Info(p.GetName() + " Initialized")
-
 	return nil
 }
 
 func (p *PrometheusPump) WriteData(ctx context.Context, data []interface{}) error {
 	p.log.Debug("Attempting to write ", len(data), " records...")
 
+	// the counters are aggregated by their label values before being updated, so every series is updated once per batch
+	counts := make([]map[string]float64, len(p.counters))
+	for i := range counts {
+		counts[i] = make(map[string]float64)
+	}
+
 	for _, item := range data {
 		record := item.(analytics.AnalyticsRecord)
-		code := strconv.Itoa(record.ResponseCode)
-
-		p.TotalStatusMetrics.WithLabelValues(code, record.APIID).Inc()
-		p.PathStatusMetrics.WithLabelValues(code, record.APIID, record.Path, record.Method).Inc()
-		p.KeyStatusMetrics.WithLabelValues(code, record.APIKey).Inc()
+		labels := map[string]string{
+			"code":   p.codeLabel(record),
+			"api":    p.apiLabel(record),
+			"path":   record.Path,
+			"method": record.Method,
+			"key":    p.keyLabel(record),
+		}
+		if p.conf.GeoLabel {
+			labels["country"] = record.Geo.Country.ISOCode
+		}
 		if record.OauthID != "" {
-			p.OauthStatusMetrics.WithLabelValues(code, record.OauthID).Inc()
+			labels["client_id"] = record.OauthID
+		}
+
+		for i, counter := range p.counters {
+			if _, ok := counterLabelValues(counter.allLabels, labels); !ok {
+				continue
+			}
+			labelValues, _ := counterLabelValues(counter.labels, labels)
+			counts[i][strings.Join(labelValues, "\xff")]++
+		}
+
+		latencies := map[string]int64{
+			"total":    record.RequestTime,
+			"upstream": record.Latency.Upstream,
+			"gateway":  record.Latency.Total - record.Latency.Upstream,
+		}
+		for latencyType, latency := range latencies {
+			labels["type"] = latencyType
+			labelValues, _ := counterLabelValues(p.latencyLabels, labels)
+			p.TotalLatencyMetrics.WithLabelValues(labelValues...).Observe(float64(latency))
+			p.series.touch("tyk_latency", p.TotalLatencyMetrics, labelValues)
+		}
+
+		for i := range p.conf.CustomMetrics {
+			p.conf.CustomMetrics[i].observe(&record, p.series)
+		}
+	}
+
+	for i, counter := range p.counters {
+		for key, count := range counts[i] {
+			labelValues := []string{}
+			if len(counter.labels) > 0 {
+				labelValues = strings.Split(key, "\xff")
+			}
+			counter.vec.WithLabelValues(labelValues...).Add(count)
+			p.series.touch(counter.name, counter.vec, labelValues)
 		}
-		p.TotalLatencyMetrics.WithLabelValues("total", record.APIID).Observe(float64(record.RequestTime))
 	}
+
+	if p.series != nil && time.Since(p.lastSeriesPurge) > time.Minute {
+		p.lastSeriesPurge = time.Now()
+		if expired := p.series.expire(time.Now().Add(-time.Duration(p.conf.SeriesTTL) * time.Second)); expired > 0 {
+			p.log.Debug("Removed ", expired, " stale series")
+		}
+	}
+
+	switch p.conf.Mode {
+	case prometheusPushMode:
+		if err := push.New(p.conf.PushGatewayURL, p.conf.PushJob).Gatherer(p.registry).Push(); err != nil {
+			p.log.Error("Failed to push the metrics: ", err)
+			return err
+		}
+	case prometheusRemoteWriteMode:
+		if err := p.remoteWrite(ctx); err != nil {
+			p.log.Error("Failed to write the metrics: ", err)
+			return err
+		}
+	}
+
 	p.log.Info("Purged ", len(data), " records...")
 
 	return nil
 }
+
+// counterLabelValues returns the values of the labels, it's false when any is missing, like the client_id of the
+// requests without OAuth client
+func counterLabelValues(labelNames []string, labels map[string]string) ([]string, bool) {
+	values := make([]string, len(labelNames))
+	for i, name := range labelNames {
+		value, ok := labels[name]
+		if !ok {
+			return nil, false
+		}
+		values[i] = value
+	}
+	return values, true
+}
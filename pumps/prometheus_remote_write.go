@@ -0,0 +1,165 @@
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// remoteWriteLabel and remoteWriteSeries mirror the prompb Label and TimeSeries messages of the remote write protocol.
+// They are encoded by hand to avoid depending on the whole Prometheus server module.
+type remoteWriteLabel struct {
+	name, value string
+}
+
+type remoteWriteSeries struct {
+	labels    []remoteWriteLabel
+	value     float64
+	timestamp int64
+}
+
+// remoteWrite sends all the metrics of the pump to the configured remote write endpoint
+func (p *PrometheusPump) remoteWrite(ctx context.Context) error {
+	families, err := p.registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	series := remoteWriteTimeSeries(families, time.Now().UnixNano()/int64(time.Millisecond))
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+
+	req, err := http.NewRequest(http.MethodPost, p.conf.RemoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for name, value := range p.conf.RemoteWriteHeaders {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("remote write failed with status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// remoteWriteTimeSeries flattens the metric families into time series, the histograms and summaries are split in
+// their _bucket or quantile, _sum and _count series like in the exposition format
+func remoteWriteTimeSeries(families []*dto.MetricFamily, timestamp int64) []remoteWriteSeries {
+	series := []remoteWriteSeries{}
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.GetMetric() {
+			labels := make([]remoteWriteLabel, 0, len(metric.GetLabel())+2)
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, remoteWriteLabel{name: label.GetName(), value: label.GetValue()})
+			}
+
+			add := func(name string, value float64, extra ...remoteWriteLabel) {
+				seriesLabels := append([]remoteWriteLabel{{name: "__name__", value: name}}, labels...)
+				seriesLabels = append(seriesLabels, extra...)
+				sort.Slice(seriesLabels, func(i, j int) bool {
+					return seriesLabels[i].name < seriesLabels[j].name
+				})
+				series = append(series, remoteWriteSeries{labels: seriesLabels, value: value, timestamp: timestamp})
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, metric.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, bucket := range histogram.GetBucket() {
+					add(name+"_bucket", float64(bucket.GetCumulativeCount()), remoteWriteLabel{name: "le", value: formatFloat(bucket.GetUpperBound())})
+				}
+				add(name+"_bucket", float64(histogram.GetSampleCount()), remoteWriteLabel{name: "le", value: "+Inf"})
+				add(name+"_sum", histogram.GetSampleSum())
+				add(name+"_count", float64(histogram.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.GetQuantile() {
+					add(name, quantile.GetValue(), remoteWriteLabel{name: "quantile", value: formatFloat(quantile.GetQuantile())})
+				}
+				add(name+"_sum", summary.GetSampleSum())
+				add(name+"_count", float64(summary.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes the series as a prompb WriteRequest
+func encodeWriteRequest(series []remoteWriteSeries) []byte {
+	request := []byte{}
+	for _, s := range series {
+		timeSeries := []byte{}
+		for _, label := range s.labels {
+			encodedLabel := appendProtoString(nil, 1, label.name)
+			encodedLabel = appendProtoString(encodedLabel, 2, label.value)
+			timeSeries = appendProtoBytes(timeSeries, 1, encodedLabel)
+		}
+
+		sample := appendProtoKey(nil, 1, 1)
+		sample = appendFixed64(sample, math.Float64bits(s.value))
+		sample = appendProtoKey(sample, 2, 0)
+		sample = appendVarint(sample, uint64(s.timestamp))
+		timeSeries = appendProtoBytes(timeSeries, 2, sample)
+
+		request = appendProtoBytes(request, 1, timeSeries)
+	}
+	return request
+}
+
+func appendProtoKey(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field<<3|wireType))
+}
+
+func appendProtoBytes(b []byte, field int, value []byte) []byte {
+	b = appendProtoKey(b, field, 2)
+	b = appendVarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendProtoString(b []byte, field int, value string) []byte {
+	return appendProtoBytes(b, field, []byte(value))
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,66 @@
+package pumps
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestEncodeWriteRequest(t *testing.T) {
+	series := []remoteWriteSeries{{
+		labels:    []remoteWriteLabel{{name: "a", value: "b"}},
+		value:     1,
+		timestamp: 2,
+	}}
+
+	expected := []byte{
+		0x0a, 0x15, // timeseries
+		0x0a, 0x06, 0x0a, 0x01, 'a', 0x12, 0x01, 'b', // label
+		0x12, 0x0b, 0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0x10, 0x02, // sample
+	}
+	if encoded := encodeWriteRequest(series); !bytes.Equal(encoded, expected) {
+		t.Fatalf("unexpected encoding: % x", encoded)
+	}
+}
+
+func TestRemoteWriteTimeSeries(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "test_latency",
+		Help:    "test latency",
+		Buckets: []float64{1, 10},
+	})
+	registry.MustRegister(histogram)
+	histogram.Observe(5)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]float64{}
+	for _, s := range remoteWriteTimeSeries(families, 1000) {
+		key := ""
+		for _, label := range s.labels {
+			key += label.name + "=" + label.value + ","
+		}
+		values[key] = s.value
+	}
+
+	expected := map[string]float64{
+		"__name__=test_latency_bucket,le=1,":    0,
+		"__name__=test_latency_bucket,le=10,":   1,
+		"__name__=test_latency_bucket,le=+Inf,": 1,
+		"__name__=test_latency_sum,":            5,
+		"__name__=test_latency_count,":          1,
+	}
+	if len(values) != len(expected) {
+		t.Fatal("unexpected series:", values)
+	}
+	for key, value := range expected {
+		if v, ok := values[key]; !ok || v != value {
+			t.Errorf("expected %s to be %v, got %v", key, value, values)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package pumps
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPrometheusMetricInit(t *testing.T) {
+	invalid := []PrometheusMetric{
+		{Type: "counter"},
+		{Name: "tyk_invalid_type", Type: "gauge"},
+		{Name: "tyk_invalid_label", Type: "counter", Labels: []string{"unknown"}},
+		{Name: "tyk_invalid_value", Type: "counter", Value: "unknown"},
+		{Name: "tyk_histogram_without_value", Type: "histogram"},
+	}
+	for _, metric := range invalid {
+		if err := metric.init(prometheus.NewRegistry()); err == nil {
+			t.Errorf("expected an error for %+v", metric)
+		}
+	}
+
+	metric := PrometheusMetric{
+		Name:   "tyk_test_bytes_out",
+		Type:   "histogram",
+		Labels: []string{"api_id", "geo.country.iso_code"},
+		Value:  "response_content_length",
+	}
+	if err := metric.init(prometheus.NewRegistry()); err != nil {
+		t.Fatal(err)
+	}
+	if len(metric.Buckets) == 0 {
+		t.Fatal("expected the default buckets to be used")
+	}
+}
+
+func TestPrometheusLabels(t *testing.T) {
+	record := analytics.AnalyticsRecord{APIID: "api1", APIName: "API 1", APIKey: "key1", Alias: "alias1", ResponseCode: 404}
+
+	p := &PrometheusPump{conf: &PrometheusConf{}}
+	if p.apiLabel(record) != "api1" || p.keyLabel(record) != "key1" || p.codeLabel(record) != "404" {
+		t.Fatal("unexpected default labels:", p.apiLabel(record), p.keyLabel(record), p.codeLabel(record))
+	}
+
+	p.conf = &PrometheusConf{APILabel: "api_name", KeyLabel: "alias", ResponseCodeClass: true}
+	if p.apiLabel(record) != "API 1" || p.keyLabel(record) != "alias1" || p.codeLabel(record) != "4xx" {
+		t.Fatal("unexpected configured labels:", p.apiLabel(record), p.keyLabel(record), p.codeLabel(record))
+	}
+
+	record.Alias = ""
+	if p.keyLabel(record) != "key1" {
+		t.Fatal("expected the key to be used for the keys without alias, got", p.keyLabel(record))
+	}
+}
+
+type fakeSeriesDeleter struct {
+	deleted [][]string
+}
+
+func (d *fakeSeriesDeleter) DeleteLabelValues(lvs ...string) bool {
+	d.deleted = append(d.deleted, lvs)
+	return true
+}
+
+func TestPrometheusSeriesExpire(t *testing.T) {
+	vec := &fakeSeriesDeleter{}
+	series := newPrometheusSeries()
+	series.touch("metric", vec, []string{"200", "api1"})
+	series.touch("metric", vec, []string{"200", "api2"})
+
+	if expired := series.expire(time.Now().Add(-time.Minute)); expired != 0 {
+		t.Fatal("expected no series to expire yet, got", expired)
+	}
+
+	series.series["metric\xff200\xffapi1"].lastUpdate = time.Now().Add(-time.Hour)
+	if expired := series.expire(time.Now().Add(-time.Minute)); expired != 1 {
+		t.Fatal("expected one series to expire, got", expired)
+	}
+	if len(vec.deleted) != 1 || vec.deleted[0][1] != "api1" {
+		t.Fatal("expected the stale series to be deleted, got", vec.deleted)
+	}
+
+	var disabled *prometheusSeries
+	disabled.touch("metric", vec, []string{"200"})
+	if disabled.expire(time.Now()) != 0 {
+		t.Fatal("expected a nil tracker to track nothing")
+	}
+}
+
+func TestPrometheusDropLabels(t *testing.T) {
+	p := &PrometheusPump{conf: &PrometheusConf{DropLabels: []string{"path", "key"}}}
+	kept := p.keptLabels("code", "api", "path", "method")
+	if len(kept) != 3 || kept[2] != "method" {
+		t.Fatal("unexpected kept labels:", kept)
+	}
+
+	labels := map[string]string{"code": "200", "api": "api1"}
+	if values, ok := counterLabelValues([]string{"api", "code"}, labels); !ok || values[0] != "api1" {
+		t.Fatal("unexpected label values:", values)
+	}
+	if _, ok := counterLabelValues([]string{"code", "client_id"}, labels); ok {
+		t.Fatal("expected the values to be missing without client_id")
+	}
+}
+
+func TestPrometheusGeoLabel(t *testing.T) {
+	p := &PrometheusPump{conf: &PrometheusConf{}}
+	if labels := p.apiStatusLabels(); len(labels) != 2 {
+		t.Fatal("expected no country label by default, got", labels)
+	}
+
+	p.conf.GeoLabel = true
+	p.conf.DropLabels = []string{"api"}
+	kept := p.keptLabels(p.apiStatusLabels()...)
+	if len(kept) != 2 || kept[0] != "code" || kept[1] != "country" {
+		t.Fatal("unexpected kept labels:", kept)
+	}
+}
+
+func TestPrometheusInstances(t *testing.T) {
+	conf := map[string]interface{}{"listen_address": "127.0.0.1:0"}
+	for i := 0; i < 2; i++ {
+		p := &PrometheusPump{}
+		if err := p.Init(conf); err != nil {
+			t.Fatal("expected every instance to register its own metrics, got", err)
+		}
+		defer p.Close()
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if err := (&PrometheusPump{}).Init(map[string]interface{}{"listen_address": listener.Addr().String()}); err == nil {
+		t.Fatal("expected an error when the address is already used")
+	}
+}
+
+func TestPrometheusClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := map[string]interface{}{"listen_address": listener.Addr().String()}
+	listener.Close()
+
+	// a reloaded pump listens on the address of the pump it replaces once it's closed
+	for i := 0; i < 2; i++ {
+		p := &PrometheusPump{}
+		if err := p.Init(conf); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPrometheusDryRun(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the address is in use, but a dry run doesn't listen on it
+	p := &PrometheusPump{}
+	p.SetDryRun(true)
+	if err := p.Init(map[string]interface{}{"listen_address": listener.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	if p.listener != nil {
+		t.Error("expected the pump not to listen in a dry run")
+	}
+}
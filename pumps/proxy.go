@@ -0,0 +1,256 @@
+package pumps
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// socks5Errors are the messages of the SOCKS5 reply codes
+var socks5Errors = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// ProxyConf is the proxy block of the pumps connecting to their backend over TCP, through a SOCKS5 or an HTTP CONNECT
+// proxy
+type ProxyConf struct {
+	// URL is the URL of the proxy, socks5://host:port or http://host:port, with the credentials in its user info
+	URL string `json:"url" mapstructure:"url"`
+}
+
+// dialFunc opens a TCP connection to the address
+type dialFunc func(address string) (net.Conn, error)
+
+// dialer returns the function opening TCP connections through the proxy, or directly when it isn't set, timing out
+// after timeout
+func (c ProxyConf) dialer(timeout time.Duration) (dialFunc, error) {
+	netDialer := &net.Dialer{Timeout: timeout}
+	if c.URL == "" {
+		return func(address string) (net.Conn, error) {
+			return netDialer.Dial("tcp", address)
+		}, nil
+	}
+
+	proxyURL, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %v", err)
+	}
+	if proxyURL.Port() == "" {
+		return nil, fmt.Errorf("invalid proxy url %s, it must have a port", proxyURL.Redacted())
+	}
+
+	var handshake func(conn net.Conn, address string) (net.Conn, error)
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		handshake = func(conn net.Conn, address string) (net.Conn, error) {
+			return conn, socks5Connect(conn, address, proxyURL.User)
+		}
+	case "http":
+		handshake = func(conn net.Conn, address string) (net.Conn, error) {
+			return httpConnect(conn, address, proxyURL.User)
+		}
+	default:
+		return nil, fmt.Errorf("invalid proxy scheme %q, must be socks5 or http", proxyURL.Scheme)
+	}
+
+	return func(address string) (net.Conn, error) {
+		conn, err := netDialer.Dial("tcp", proxyURL.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		conn.SetDeadline(time.Now().Add(timeout))
+		tunnel, err := handshake(conn, address)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: %v", proxyURL.Host, err)
+		}
+		conn.SetDeadline(time.Time{})
+		return tunnel, nil
+	}, nil
+}
+
+// dialTLS opens a TLS connection to the address with dial, verifying the server for the host of the address unless
+// tlsConfig sets the server name
+func dialTLS(dial dialFunc, address string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	conn, err := dial(address)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// socks5Connect asks the SOCKS5 proxy to connect to the address (RFC 1928), authenticating with the user when given
+// (RFC 1929)
+func socks5Connect(conn net.Conn, address string, user *url.Userinfo) error {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portText)
+	}
+
+	methods := []byte{0}
+	if user != nil {
+		methods = append(methods, 2)
+	}
+	if _, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case 0:
+	case 2:
+		if user == nil {
+			return errors.New("the proxy requires authentication")
+		}
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("the proxy username and password must be up to 255 bytes")
+		}
+		auth := append([]byte{1, byte(len(user.Username()))}, user.Username()...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("the proxy rejected the username and password")
+		}
+	default:
+		return errors.New("the proxy doesn't support the authentication methods")
+	}
+
+	request := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %s too long", host)
+		}
+		request = append(append(request, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, 1), ip4...)
+	} else {
+		request = append(append(request, 4), ip...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		message, ok := socks5Errors[header[1]]
+		if !ok {
+			message = fmt.Sprintf("unknown error %d", header[1])
+		}
+		return fmt.Errorf("connecting to %s: %s", address, message)
+	}
+
+	// the reply ends with the bound address and port, which aren't needed
+	var addressLength int
+	switch header[3] {
+	case 1:
+		addressLength = net.IPv4len
+	case 4:
+		addressLength = net.IPv6len
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		addressLength = int(length[0])
+	default:
+		return fmt.Errorf("unknown address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addressLength+2))
+	return err
+}
+
+// httpConnect asks the HTTP proxy to open a tunnel to the address with the CONNECT method, authenticating with the user
+// when given
+func httpConnect(conn net.Conn, address string, user *url.Userinfo) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("connecting to %s: %s", address, resp.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads the bytes the proxy sent after its response first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
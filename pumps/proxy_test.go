@@ -0,0 +1,133 @@
+package pumps
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listen serves every connection of a new listener with serve, and returns its address
+func listen(t *testing.T, serve func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// tunnel copies the connection to the address and back
+func tunnel(conn net.Conn, address string) {
+	backend, err := net.Dial("tcp", address)
+	if err != nil {
+		return
+	}
+	defer backend.Close()
+	go io.Copy(backend, conn)
+	io.Copy(conn, backend)
+}
+
+func testProxyDial(t *testing.T, conf ProxyConf, echo string) {
+	dial, err := conf.dialer(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("expected the echo through the proxy, got %q %v", reply, err)
+	}
+}
+
+func TestProxySOCKS5(t *testing.T) {
+	echo := listen(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	proxy := listen(t, func(conn net.Conn) {
+		greeting := make([]byte, 4)
+		if _, err := io.ReadFull(conn, greeting); err != nil || greeting[1] != 2 || greeting[3] != 2 {
+			t.Errorf("expected the username and password method to be offered, got %v", greeting)
+			return
+		}
+		conn.Write([]byte{5, 2})
+
+		auth := make([]byte, 11)
+		if _, err := io.ReadFull(conn, auth); err != nil || string(auth) != "\x01\x04user\x04pass" {
+			t.Errorf("unexpected authentication %q", auth)
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+
+		request := make([]byte, 8)
+		io.ReadFull(conn, request)
+		if request[3] != 1 {
+			t.Errorf("expected an IPv4 address, got %v", request)
+			return
+		}
+		host := net.IP(request[4:8]).String()
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+		conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		tunnel(conn, net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))))
+	})
+
+	testProxyDial(t, ProxyConf{URL: "socks5://user:pass@" + proxy}, echo)
+}
+
+func TestProxyHTTPConnect(t *testing.T) {
+	echo := listen(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	proxy := listen(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil || req.Method != http.MethodConnect {
+			t.Errorf("expected a CONNECT request, got %v %v", req, err)
+			return
+		}
+		if req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")) {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		tunnel(conn, req.Host)
+	})
+
+	testProxyDial(t, ProxyConf{URL: "http://user:pass@" + proxy}, echo)
+
+	dial, err := ProxyConf{URL: "http://" + proxy}.dialer(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dial(echo); err == nil {
+		t.Error("expected the proxy to reject the connection without credentials")
+	}
+}
+
+func TestProxyConfInvalid(t *testing.T) {
+	for _, proxyURL := range []string{"ftp://proxy:21", "socks5://proxy", "://proxy"} {
+		if _, err := (ProxyConf{URL: proxyURL}).dialer(time.Second); err == nil {
+			t.Errorf("expected %s to fail", proxyURL)
+		}
+	}
+}
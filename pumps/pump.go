@@ -4,10 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-pump/analytics"
-	"github.com/kelseyhightower/envconfig"
+	"github.com/mitchellh/mapstructure"
 )
 
 const PUMPS_ENV_PREFIX = "TYK_PMP_PUMPS"
@@ -24,7 +27,84 @@ type Pump interface {
 	GetTimeout() int
 	SetOmitDetailedRecording(bool)
 	GetOmitDetailedRecording() bool
+	SetLogLevel(logrus.Level)
+	// GetLogger returns the entry the pump logs with, so the logs about the pump follow its log level
+	GetLogger() *logrus.Entry
+	SetFieldSelection(analytics.FieldSelection)
+	GetFieldSelection() analytics.FieldSelection
+	SetInstanceName(string)
+	GetInstanceName() string
 	GetEnvPrefix() string
+	SetDryRun(bool)
+	GetDryRun() bool
+	DropRecords(reason string, n int)
+	GetDroppedRecords() map[string]int64
+	// Flush writes the records the pump buffered, it's called when Tyk Pump stops so they aren't lost
+	Flush() error
+	// Close releases the connections, listeners and goroutines of the pump. It's called once the pump is flushed, when
+	// Tyk Pump stops or when the pump is replaced by a configuration reload.
+	Close() error
+}
+
+// AnalyticsReader is implemented by the pumps able to read back the analytics records they stored, so they can be
+// the source of a migration between backends.
+type AnalyticsReader interface {
+	// ReadData reads the analytics records recorded between since and until, oldest first, and hands them to fn in
+	// batches of up to batchSize records. A zero until means there's no upper bound.
+	ReadData(ctx context.Context, since, until time.Time, batchSize int, fn func([]interface{}) error) error
+}
+
+// PartialWriter is implemented by the pumps able to tell which records they failed to write, so only those have to
+// be retried instead of the whole batch.
+type PartialWriter interface {
+	// WriteDataPartial writes the records like WriteData, returning the ones it failed to write along with the error.
+	// The records which aren't returned were written.
+	WriteDataPartial(ctx context.Context, data []interface{}) (failed []interface{}, err error)
+}
+
+// Previewer is implemented by the pumps whose payload isn't the JSON of the records, so a dry run prints the payload
+// they would write instead.
+type Previewer interface {
+	// Preview returns the payload the pump would write for the record
+	Preview(record analytics.AnalyticsRecord) ([]byte, error)
+}
+
+// DropReasons is implemented by the errors of the writes whose records failed for different reasons, so they're
+// counted as dropped for each of them instead of all for the same one.
+type DropReasons interface {
+	// DropReasons returns how many records failed by drop reason
+	DropReasons() map[string]int
+}
+
+// WriteDataPartial writes the records with the pump, returning the ones it failed to write. All the records fail
+// together when the pump doesn't implement PartialWriter.
+func WriteDataPartial(ctx context.Context, pump Pump, data []interface{}) ([]interface{}, error) {
+	if writer, ok := pump.(PartialWriter); ok {
+		return writer.WriteDataPartial(ctx, data)
+	}
+
+	if err := pump.WriteData(ctx, data); err != nil {
+		return data, err
+	}
+	return nil, nil
+}
+
+// UptimeWriter is implemented by the pumps able to write the uptime data of the Gateway host checker, so they can be
+// configured in uptime_pumps.
+type UptimeWriter interface {
+	WriteUptimeData(data []interface{})
+}
+
+// GetUptimePumpNames returns the sorted names of the available pumps which implement UptimeWriter
+func GetUptimePumpNames() []string {
+	names := []string{}
+	for name, pump := range AvailablePumps {
+		if _, ok := pump.(UptimeWriter); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
 }
 
 func GetPumpByName(name string) (Pump, error) {
@@ -39,15 +119,67 @@ func GetPumpByName(name string) (Pump, error) {
 func processPumpEnvVars(pump Pump, log *logrus.Entry, cfg interface{}, defaultEnv string) {
 	if envVar := pump.GetEnvPrefix(); envVar != "" {
 		log.Debug(fmt.Sprintf("Checking %s env variables with prefix %s", pump.GetName(), envVar))
-		overrideErr := envconfig.Process(envVar, cfg)
+		logEnvVars(log, envVar, cfg)
+		overrideErr := processEnv(envVar, cfg, "mapstructure")
 		if overrideErr != nil {
 			log.Error(fmt.Sprintf("Failed to process environment variables for %s pump %s with err:%v ", envVar, pump.GetName(), overrideErr))
 		}
+		warnUnknownEnvVars(pump, log, envVar, cfg)
 	} else {
 		log.Debug(fmt.Sprintf("Checking default %s env variables with prefix %s", pump.GetName(), defaultEnv))
-		overrideErr := envconfig.Process(defaultEnv, cfg)
+		logEnvVars(log, defaultEnv, cfg)
+		overrideErr := processEnv(defaultEnv, cfg, "mapstructure")
 		if overrideErr != nil {
 			log.Error(fmt.Sprintf("Failed to process environment variables for %s pump %s with err:%v ", defaultEnv, pump.GetName(), overrideErr))
 		}
+		warnUnknownEnvVars(pump, log, defaultEnv, cfg)
+	}
+}
+
+// warnUnknownEnvVars warns about an environment variable with the pump prefix which doesn't map to any of the pump
+// configuration options, as it's most likely a typo that would otherwise be silently ignored.
+func warnUnknownEnvVars(pump Pump, log *logrus.Entry, prefix string, cfg interface{}) {
+	for _, key := range unknownEnvVars(prefix, cfg) {
+		log.Warning(fmt.Sprintf("Configuration of %s pump: unknown environment variable %s, it will be ignored", pump.GetName(), key))
+	}
+}
+
+// logEnvVars logs the environment variables the pump configuration can be set with, in debug, so they can be found
+// without reading the code
+func logEnvVars(log *logrus.Entry, prefix string, cfg interface{}) {
+	if log.Logger.Level < logrus.DebugLevel {
+		return
+	}
+	keys := []string{}
+	for _, field := range envFields(prefix, cfg) {
+		if field.json {
+			keys = append(keys, field.key+" (JSON)")
+		} else {
+			keys = append(keys, field.key)
+		}
+	}
+	log.Debug("Environment variables: ", strings.Join(keys, ", "))
+}
+
+// decodePumpConfig decodes the pump meta configuration into cfg, like mapstructure.Decode, but warning about every
+// key which doesn't map to any of the pump configuration options, as it's most likely a typo that would otherwise be
+// silently ignored.
+func decodePumpConfig(pump Pump, log *logrus.Entry, input interface{}, cfg interface{}) error {
+	var metadata mapstructure.Metadata
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Metadata: &metadata,
+		Result:   cfg,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := decoder.Decode(input); err != nil {
+		return err
+	}
+
+	for _, key := range metadata.Unused {
+		log.Warning(fmt.Sprintf("Configuration of %s pump: unknown meta key %q, it will be ignored", pump.GetName(), key))
 	}
+	return nil
 }
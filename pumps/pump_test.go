@@ -1,7 +1,12 @@
 package pumps
 
 import (
+	"context"
+	"errors"
 	"testing"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-pump/analytics"
 )
 
 func TestGetPumpByName(t *testing.T) {
@@ -20,3 +25,123 @@ func TestGetPumpByName(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestGetUptimePumpNames(t *testing.T) {
+	names := GetUptimePumpNames()
+	expected := []string{"elasticsearch", "mongo", "mongo-pump-selective", "splunk"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, names)
+		}
+	}
+}
+
+func TestDecodePumpConfig(t *testing.T) {
+	pmp := &CSVPump{}
+	pmp.log = log.WithField("prefix", csvPrefix)
+
+	meta := map[string]interface{}{
+		"csv_dir": "./bar",
+		"csv_dri": "./typo",
+	}
+
+	conf := &CSVConf{}
+	if err := decodePumpConfig(pmp, pmp.log, meta, conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.CSVDir != "./bar" {
+		t.Fatal("expected csv_dir to be decoded, got", conf.CSVDir)
+	}
+
+	mongoConf := &MongoConf{}
+	mongoMeta := map[string]interface{}{
+		"mongo_url":       "mongodb://localhost:27017/tyk",
+		"collection_name": "tyk_analytics",
+	}
+	if err := decodePumpConfig(pmp, pmp.log, mongoMeta, mongoConf); err != nil {
+		t.Fatal(err)
+	}
+	if mongoConf.MongoURL != "mongodb://localhost:27017/tyk" || mongoConf.CollectionName != "tyk_analytics" {
+		t.Fatal("expected the embedded mongo configuration to be decoded, got", mongoConf)
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	pmp := &CSVPump{}
+	if pmp.newLogger(csvPrefix).Logger != log {
+		t.Fatal("expected the pump to use the global logger when no log level is set")
+	}
+
+	pmp.SetLogLevel(logrus.DebugLevel)
+	pumpLog := pmp.newLogger(csvPrefix)
+	if pumpLog.Logger == log || pumpLog.Logger.Level != logrus.DebugLevel {
+		t.Fatal("expected the pump to log with its own debug level")
+	}
+	if pumpLog.Data["prefix"] != csvPrefix {
+		t.Fatal("expected the pump log entries to keep the prefix, got", pumpLog.Data["prefix"])
+	}
+
+	if pmp.GetLogger().Logger.Level != logrus.DebugLevel {
+		t.Fatal("expected the logger of a pump not initialised yet to have its log level")
+	}
+	pmp.log = pumpLog
+	if pmp.GetLogger() != pumpLog {
+		t.Fatal("expected the logger of the pump")
+	}
+}
+
+func TestSetInstanceName(t *testing.T) {
+	pmp := &CSVPump{}
+	if _, ok := pmp.newLogger(csvPrefix).Data["instance"]; ok {
+		t.Fatal("expected the pump not to log an instance when it isn't named")
+	}
+
+	pmp.SetInstanceName("csv-archive")
+	if pmp.GetInstanceName() != "csv-archive" || pmp.newLogger(csvPrefix).Data["instance"] != "csv-archive" {
+		t.Fatal("expected the pump to log its instance name")
+	}
+}
+
+type failingPump struct {
+	DummyPump
+}
+
+func (p *failingPump) WriteData(ctx context.Context, data []interface{}) error {
+	return errors.New("backend down")
+}
+
+func TestWriteDataPartial(t *testing.T) {
+	data := []interface{}{analytics.AnalyticsRecord{APIID: "1"}, analytics.AnalyticsRecord{APIID: "2"}}
+
+	failed, err := WriteDataPartial(context.Background(), &failingPump{}, data)
+	if err == nil || len(failed) != len(data) {
+		t.Errorf("expected all the records to fail with the pump, got %d failed and error %v", len(failed), err)
+	}
+
+	dummy := &DummyPump{}
+	dummy.log = dummy.newLogger("dummy")
+	failed, err = WriteDataPartial(context.Background(), dummy, data)
+	if err != nil || len(failed) != 0 {
+		t.Errorf("expected no record to fail, got %d failed and error %v", len(failed), err)
+	}
+}
+
+func TestDropRecords(t *testing.T) {
+	pmp := &DummyPump{}
+	pmp.DropRecords(DroppedTooLarge, 2)
+	pmp.DropRecords(DroppedTooLarge, 1)
+	pmp.DropRecords(DroppedRejected, 0)
+
+	dropped := pmp.GetDroppedRecords()
+	if len(dropped) != 1 || dropped[DroppedTooLarge] != 3 {
+		t.Fatalf("expected 3 records dropped for being too large, got %v", dropped)
+	}
+
+	dropped[DroppedTooLarge] = 0
+	if pmp.GetDroppedRecords()[DroppedTooLarge] != 3 {
+		t.Fatal("expected the returned counts to be a copy")
+	}
+}
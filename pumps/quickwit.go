@@ -0,0 +1,157 @@
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	quickwitPrefix     = "quickwit-pump"
+	quickwitDefaultENV = PUMPS_ENV_PREFIX + "_QUICKWIT" + PUMPS_ENV_META_PREFIX
+
+	defaultQuickwitBatchSize = 1000
+	// defaultQuickwitMaxBatchBytes keeps the requests under the 10MiB limit of the ingest API
+	defaultQuickwitMaxBatchBytes = 10 * 1024 * 1024
+)
+
+var quickwitCommitModes = []string{"auto", "wait_for", "force"}
+
+// QuickwitPump indexes the analytics records with the Quickwit ingest API, as JSON documents with the record fields
+type QuickwitPump struct {
+	conf   *QuickwitConf
+	client *http.Client
+	CommonPumpConfig
+}
+
+// QuickwitConf configures the Quickwit pump
+type QuickwitConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	// URL is the URL of the Quickwit cluster, like http://localhost:7280
+	URL string `mapstructure:"url"`
+	// IndexID is the index the records are ingested into. Its timestamp field should be timestamp.
+	IndexID string `mapstructure:"index_id"`
+	// Commit is when the ingested records become searchable: auto, the default, wait_for or force
+	Commit string `mapstructure:"commit"`
+	// BatchSize is the maximum number of records of a request, 1000 by default
+	BatchSize int `mapstructure:"batch_size"`
+	// MaxBatchBytes is the maximum size of a request, 10MiB by default
+	MaxBatchBytes int `mapstructure:"max_batch_bytes"`
+	// Headers are sent with every request, like the Authorization one of a proxy
+	Headers map[string]string `mapstructure:"headers"`
+}
+
+func (q *QuickwitPump) New() Pump {
+	newPump := QuickwitPump{}
+	return &newPump
+}
+
+func (q *QuickwitPump) GetName() string {
+	return "Quickwit Pump"
+}
+
+func (q *QuickwitPump) GetEnvPrefix() string {
+	return q.conf.EnvPrefix
+}
+
+func (q *QuickwitPump) Init(config interface{}) error {
+	q.conf = &QuickwitConf{}
+	q.log = q.newLogger(quickwitPrefix)
+
+	if err := decodePumpConfig(q, q.log, config, &q.conf); err != nil {
+		q.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(q, q.log, q.conf, quickwitDefaultENV)
+
+	if q.conf.URL == "" || q.conf.IndexID == "" {
+		return errors.New("url and index_id must be set")
+	}
+	if q.conf.Commit == "" {
+		q.conf.Commit = quickwitCommitModes[0]
+	}
+	if !contains(quickwitCommitModes, q.conf.Commit) {
+		return fmt.Errorf("invalid commit %q, must be one of %s", q.conf.Commit, strings.Join(quickwitCommitModes, ", "))
+	}
+	if q.conf.BatchSize <= 0 {
+		q.conf.BatchSize = defaultQuickwitBatchSize
+	}
+	if q.conf.MaxBatchBytes <= 0 {
+		q.conf.MaxBatchBytes = defaultQuickwitMaxBatchBytes
+	}
+	q.client = &http.Client{Timeout: 60 * time.Second}
+
+	q.log.Info(q.GetName() + " Initialized")
+	return nil
+}
+
+func (q *QuickwitPump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := q.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial ingests the records in batches, returning the records of the batches that failed and of the ones
+// left at the deadline
+func (q *QuickwitPump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
+	q.log.Debug("Attempting to write ", len(data), " records...")
+
+	batches, unencoded := ndjsonBatches(data, q.conf.BatchSize, q.conf.MaxBatchBytes, ndjsonRecord)
+	if len(unencoded) > 0 {
+		q.log.Error("Couldn't encode ", len(unencoded), " records, they will be dropped")
+		q.DropRecords(DroppedSerialization, len(unencoded))
+	}
+
+	failed := []interface{}{}
+	var lastErr error
+	for i, batch := range batches {
+		if err := ctx.Err(); err != nil {
+			return append(failed, ndjsonRecords(batches[i:])...), err
+		}
+
+		if err := q.ingest(ctx, batch.body); err != nil {
+			q.log.WithField("records", len(batch.records)).Error("Failed to ingest the records: ", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return append(failed, ndjsonRecords(batches[i:])...), ctxErr
+			}
+			failed = append(failed, batch.records...)
+			lastErr = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("failed to write %d of %d records: %v", len(failed), len(data), lastErr)
+	}
+	q.log.Info("Purged ", len(data), " records...")
+	return nil, nil
+}
+
+func (q *QuickwitPump) ingest(ctx context.Context, body []byte) error {
+	ingestURL := strings.TrimSuffix(q.conf.URL, "/") + "/api/v1/" + url.PathEscape(q.conf.IndexID) + "/ingest?commit=" + q.conf.Commit
+	req, err := http.NewRequest(http.MethodPost, ingestURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for name, value := range q.conf.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("quickwit responded with status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
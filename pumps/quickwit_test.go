@@ -0,0 +1,65 @@
+package pumps
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestQuickwitInit(t *testing.T) {
+	pump := &QuickwitPump{}
+	if err := pump.Init(map[string]interface{}{"url": "http://localhost:7280"}); err == nil {
+		t.Error("expected the index_id to be required")
+	}
+
+	pump = &QuickwitPump{}
+	if err := pump.Init(map[string]interface{}{"url": "http://localhost:7280", "index_id": "tyk", "commit": "now"}); err == nil {
+		t.Error("expected an invalid commit mode to fail")
+	}
+}
+
+func TestQuickwitWriteData(t *testing.T) {
+	bodies := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/tyk-analytics/ingest" || r.URL.Query().Get("commit") != "wait_for" {
+			t.Errorf("unexpected request to %s", r.URL)
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Error("expected the configured headers")
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if strings.Contains(string(body), `"api_id":"3"`) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	pump := &QuickwitPump{}
+	err := pump.Init(map[string]interface{}{
+		"url":        server.URL,
+		"index_id":   "tyk-analytics",
+		"commit":     "wait_for",
+		"batch_size": 2,
+		"headers":    map[string]interface{}{"Authorization": "Bearer secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{analytics.AnalyticsRecord{APIID: "1"}, analytics.AnalyticsRecord{APIID: "2"}, analytics.AnalyticsRecord{APIID: "3"}}
+	failed, err := pump.WriteDataPartial(context.Background(), data)
+	if err == nil || len(failed) != 1 || failed[0].(analytics.AnalyticsRecord).APIID != "3" {
+		t.Errorf("expected the rejected batch to fail, got %v and %v", failed, err)
+	}
+
+	if len(bodies) != 2 || strings.Count(bodies[0], "\n") != 2 || !strings.Contains(bodies[0], `"timestamp":`) {
+		t.Errorf("expected batches of 2 JSON records, got %q", bodies)
+	}
+}
@@ -0,0 +1,430 @@
+package pumps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	redshiftPrefix     = "redshift-pump"
+	redshiftDefaultENV = PUMPS_ENV_PREFIX + "_REDSHIFT" + PUMPS_ENV_META_PREFIX
+
+	defaultRedshiftTable          = "tyk_analytics"
+	defaultRedshiftS3Prefix       = "tyk-pump/"
+	defaultRedshiftSmallBatchSize = 50
+	defaultRedshiftMaxFileBytes   = 64 * 1024 * 1024
+	defaultRedshiftMaxRetries     = 3
+	// redshiftTimestampFormat is the format of the timestamps of the staged rows, Redshift keeps microseconds
+	redshiftTimestampFormat = "2006-01-02 15:04:05.000000"
+)
+
+var (
+	redshiftIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+	redshiftIAMRole    = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:role/[A-Za-z0-9+=,.@_/-]+$`)
+	redshiftS3Bucket   = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+	redshiftS3Prefix   = regexp.MustCompile(`^[A-Za-z0-9!_.*()/-]*$`)
+
+	// redshiftPollInterval is how often the status of the statements is checked
+	redshiftPollInterval = 500 * time.Millisecond
+	// redshiftRetryBackoff is how long to wait before the first retry, doubled at every retry
+	redshiftRetryBackoff = time.Second
+)
+
+// redshiftTypes are the SQL types of the columns
+var redshiftTypes = map[columnType]string{
+	columnTimestamp: "TIMESTAMP",
+	columnString:    "VARCHAR(65535)",
+	columnInteger:   "BIGINT",
+}
+
+// RedshiftPump loads the analytics records into a Redshift table. The records of every purge are staged in S3 as
+// gzipped JSON files, listed in a manifest, and loaded with a COPY run by the Redshift Data API. The purges of up to
+// small_batch_size records are inserted with the Data API instead.
+type RedshiftPump struct {
+	conf   *RedshiftConf
+	creds  *awsCredentialsProvider
+	client *http.Client
+	CommonPumpConfig
+}
+
+// RedshiftConf configures the Redshift pump
+type RedshiftConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	Region    string `mapstructure:"region"`
+	// AccessKeyID, SecretAccessKey and SessionToken are the AWS credentials, taken from the AWS_ACCESS_KEY_ID,
+	// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables when not set, or from the IAM role otherwise
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SessionToken    string `mapstructure:"session_token"`
+	// ClusterIdentifier is the provisioned cluster, WorkgroupName the serverless workgroup
+	ClusterIdentifier string `mapstructure:"cluster_identifier"`
+	WorkgroupName     string `mapstructure:"workgroup_name"`
+	Database          string `mapstructure:"database"`
+	// DbUser is the database user of a provisioned cluster, SecretArn the Secrets Manager secret of the credentials
+	DbUser    string `mapstructure:"db_user"`
+	SecretArn string `mapstructure:"secret_arn"`
+	// Table is the table the records are loaded into, optionally qualified by the schema, tyk_analytics by default
+	Table string `mapstructure:"table"`
+	// S3Bucket and S3Prefix are where the files are staged, under tyk-pump/ by default
+	S3Bucket string `mapstructure:"s3_bucket"`
+	S3Prefix string `mapstructure:"s3_prefix"`
+	// IAMRole is the ARN of the role Redshift reads the staged files with
+	IAMRole string `mapstructure:"iam_role"`
+	// SmallBatchSize is the number of records up to which a purge is inserted rather than staged, 50 by default.
+	// -1 stages all the purges.
+	SmallBatchSize int `mapstructure:"small_batch_size"`
+	// MaxFileBytes is the maximum size of a staged file before compression, 64MiB by default
+	MaxFileBytes int `mapstructure:"max_file_bytes"`
+	// MaxRetries is how many times a failed upload or COPY is retried, 3 by default. -1 disables the retries.
+	MaxRetries int `mapstructure:"max_retries"`
+	// CreateTable creates the table on start when it doesn't exist
+	CreateTable bool `mapstructure:"create_table"`
+	// S3URL and DataAPIURL replace the AWS endpoints, for VPC endpoints
+	S3URL      string `mapstructure:"s3_url"`
+	DataAPIURL string `mapstructure:"data_api_url"`
+}
+
+type redshiftParameter struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type redshiftStatement struct {
+	ClusterIdentifier string              `json:"ClusterIdentifier,omitempty"`
+	WorkgroupName     string              `json:"WorkgroupName,omitempty"`
+	Database          string              `json:"Database"`
+	DbUser            string              `json:"DbUser,omitempty"`
+	SecretArn         string              `json:"SecretArn,omitempty"`
+	Sql               string              `json:"Sql"`
+	Parameters        []redshiftParameter `json:"Parameters,omitempty"`
+}
+
+func (r *RedshiftPump) New() Pump {
+	newPump := RedshiftPump{}
+	return &newPump
+}
+
+func (r *RedshiftPump) GetName() string {
+	return "Redshift Pump"
+}
+
+func (r *RedshiftPump) GetEnvPrefix() string {
+	return r.conf.EnvPrefix
+}
+
+func (r *RedshiftPump) Init(config interface{}) error {
+	r.conf = &RedshiftConf{}
+	r.log = r.newLogger(redshiftPrefix)
+
+	if err := decodePumpConfig(r, r.log, config, &r.conf); err != nil {
+		r.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(r, r.log, r.conf, redshiftDefaultENV)
+
+	if r.conf.Region == "" || r.conf.Database == "" {
+		return errors.New("region and database must be set")
+	}
+	if (r.conf.ClusterIdentifier == "") == (r.conf.WorkgroupName == "") {
+		return errors.New("either cluster_identifier or workgroup_name must be set")
+	}
+	if r.conf.Table == "" {
+		r.conf.Table = defaultRedshiftTable
+	}
+	if !redshiftIdentifier.MatchString(r.conf.Table) {
+		return fmt.Errorf("invalid table name %q", r.conf.Table)
+	}
+	if r.conf.SmallBatchSize == 0 {
+		r.conf.SmallBatchSize = defaultRedshiftSmallBatchSize
+	}
+	if r.conf.S3Prefix == "" {
+		r.conf.S3Prefix = defaultRedshiftS3Prefix
+	}
+	if !redshiftS3Bucket.MatchString(r.conf.S3Bucket) || !redshiftS3Prefix.MatchString(r.conf.S3Prefix) {
+		return fmt.Errorf("invalid s3_bucket or s3_prefix %s/%s", r.conf.S3Bucket, r.conf.S3Prefix)
+	}
+	if !redshiftIAMRole.MatchString(r.conf.IAMRole) {
+		return fmt.Errorf("invalid iam_role %q, must be the ARN of a role", r.conf.IAMRole)
+	}
+	if r.conf.MaxFileBytes <= 0 {
+		r.conf.MaxFileBytes = defaultRedshiftMaxFileBytes
+	}
+	if r.conf.MaxRetries == 0 {
+		r.conf.MaxRetries = defaultRedshiftMaxRetries
+	}
+	if r.conf.S3URL == "" {
+		r.conf.S3URL = "https://s3." + r.conf.Region + ".amazonaws.com"
+	}
+	if r.conf.DataAPIURL == "" {
+		r.conf.DataAPIURL = "https://redshift-data." + r.conf.Region + ".amazonaws.com"
+	}
+
+	r.creds = newAWSCredentialsProvider(awsCredentials{
+		AccessKeyID:     r.conf.AccessKeyID,
+		SecretAccessKey: r.conf.SecretAccessKey,
+		SessionToken:    r.conf.SessionToken,
+	}, r.conf.Region)
+	if _, err := r.creds.get(context.Background()); err != nil {
+		return err
+	}
+	r.client = &http.Client{Timeout: 60 * time.Second}
+
+	if r.conf.CreateTable && !r.dryRun {
+		if err := r.execute(context.Background(), sqlCreateTable(r.conf.Table, redshiftTypes, unquoted), nil); err != nil {
+			return fmt.Errorf("couldn't create the table: %v", err)
+		}
+		for _, statement := range sqlAddColumns(r.conf.Table, redshiftTypes, unquoted, false) {
+			if err := r.execute(context.Background(), statement, nil); err != nil && !isColumnExistsError(err) {
+				return fmt.Errorf("couldn't add the new columns to the table: %v", err)
+			}
+		}
+	}
+
+	r.log.Info(r.GetName() + " Initialized")
+	return nil
+}
+
+func (r *RedshiftPump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := r.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial loads the records, staged in S3 or inserted when there are few. The records are loaded at once, so
+// all of them are returned when it fails.
+func (r *RedshiftPump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
+	r.log.Debug("Attempting to write ", len(data), " records...")
+
+	files, unencoded := ndjsonBatches(data, 0, r.conf.MaxFileBytes, redshiftRow)
+	if len(unencoded) > 0 {
+		r.log.Error("Couldn't encode ", len(unencoded), " records, they will be dropped")
+		r.DropRecords(DroppedSerialization, len(unencoded))
+	}
+	records := ndjsonRecords(files)
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	if len(records) <= r.conf.SmallBatchSize {
+		err = r.insert(ctx, records)
+	} else {
+		err = r.stageAndCopy(ctx, files)
+	}
+	if err != nil {
+		r.log.WithField("records", len(records)).Error("Failed to load the records: ", err)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return records, ctxErr
+		}
+		return records, fmt.Errorf("failed to write %d of %d records: %v", len(records), len(data), err)
+	}
+
+	r.log.Info("Purged ", len(data), " records...")
+	return nil, nil
+}
+
+// redshiftRow encodes the record as a JSON object of the column values, as COPY reads them with the auto option
+func redshiftRow(record *analytics.AnalyticsRecord) ([]byte, error) {
+	row := make(map[string]interface{}, len(analyticsColumns))
+	for _, column := range analyticsColumns {
+		value := column.value(record)
+		if t, ok := value.(time.Time); ok {
+			value = t.Format(redshiftTimestampFormat)
+		}
+		row[column.name] = value
+	}
+	return json.Marshal(row)
+}
+
+// stageAndCopy uploads the files and their manifest to S3, then loads them with a COPY. The uploads and the COPY are
+// retried up to max_retries times.
+func (r *RedshiftPump) stageAndCopy(ctx context.Context, files []ndjsonBatch) error {
+	base := r.conf.S3Prefix + time.Now().UTC().Format("2006/01/02/150405.000000000")
+
+	manifest := struct {
+		Entries []map[string]interface{} `json:"entries"`
+	}{}
+	for i, file := range files {
+		var body bytes.Buffer
+		zw := gzip.NewWriter(&body)
+		zw.Write(file.body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+
+		key := base + "-" + strconv.Itoa(i) + ".json.gz"
+		if err := r.retry(ctx, func() error { return r.upload(ctx, key, body.Bytes()) }); err != nil {
+			return fmt.Errorf("couldn't stage %s: %v", key, err)
+		}
+		manifest.Entries = append(manifest.Entries, map[string]interface{}{
+			"url":       "s3://" + r.conf.S3Bucket + "/" + key,
+			"mandatory": true,
+		})
+	}
+
+	manifestBody, _ := json.Marshal(manifest)
+	manifestKey := base + ".manifest"
+	if err := r.retry(ctx, func() error { return r.upload(ctx, manifestKey, manifestBody) }); err != nil {
+		return fmt.Errorf("couldn't stage the manifest: %v", err)
+	}
+
+	statement := "COPY " + r.conf.Table + " " + sqlColumnList(unquoted) +
+		" FROM 's3://" + r.conf.S3Bucket + "/" + manifestKey + "'" +
+		" IAM_ROLE '" + r.conf.IAMRole + "'" +
+		" FORMAT AS JSON 'auto' GZIP MANIFEST TIMEFORMAT 'auto' REGION '" + r.conf.Region + "'"
+	return r.retry(ctx, func() error { return r.execute(ctx, statement, nil) })
+}
+
+// insert inserts the records with a single INSERT, the strings being parameters of the statement. The Data API
+// doesn't take empty parameters, so the empty strings are literals.
+func (r *RedshiftPump) insert(ctx context.Context, records []interface{}) error {
+	parameters := []redshiftParameter{}
+	rows := make([]string, 0, len(records))
+	for _, v := range records {
+		record := v.(analytics.AnalyticsRecord)
+		values := make([]string, len(analyticsColumns))
+		for i, column := range analyticsColumns {
+			switch value := column.value(&record).(type) {
+			case time.Time:
+				values[i] = "'" + value.Format(redshiftTimestampFormat) + "'"
+			case int64:
+				values[i] = strconv.FormatInt(value, 10)
+			case string:
+				if value == "" {
+					values[i] = "''"
+					continue
+				}
+				name := "p" + strconv.Itoa(len(parameters))
+				parameters = append(parameters, redshiftParameter{Name: name, Value: value})
+				values[i] = ":" + name
+			}
+		}
+		rows = append(rows, "("+strings.Join(values, ", ")+")")
+	}
+
+	statement := "INSERT INTO " + r.conf.Table + " " + sqlColumnList(unquoted) + " VALUES " + strings.Join(rows, ", ")
+	return r.execute(ctx, statement, parameters)
+}
+
+// retry calls f up to max_retries more times while it fails, waiting longer between every attempt
+func (r *RedshiftPump) retry(ctx context.Context, f func() error) error {
+	backoff := redshiftRetryBackoff
+	err := f()
+	for attempt := 1; err != nil && attempt <= r.conf.MaxRetries; attempt++ {
+		r.log.Warning("Retrying after error: ", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		err = f()
+	}
+	return err
+}
+
+// upload puts the object in the staging bucket
+func (r *RedshiftPump) upload(ctx context.Context, key string, body []byte) error {
+	objectURL := strings.TrimSuffix(r.conf.S3URL, "/") + "/" + r.conf.S3Bucket + "/" + key
+	req, err := http.NewRequest(http.MethodPut, objectURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	_, err = r.do(req, body, "s3")
+	return err
+}
+
+// execute runs the statement with the Data API and waits for it to finish
+func (r *RedshiftPump) execute(ctx context.Context, statement string, parameters []redshiftParameter) error {
+	result := struct {
+		ID string `json:"Id"`
+	}{}
+	err := r.dataAPI(ctx, "ExecuteStatement", redshiftStatement{
+		ClusterIdentifier: r.conf.ClusterIdentifier,
+		WorkgroupName:     r.conf.WorkgroupName,
+		Database:          r.conf.Database,
+		DbUser:            r.conf.DbUser,
+		SecretArn:         r.conf.SecretArn,
+		Sql:               statement,
+		Parameters:        parameters,
+	}, &result)
+	if err != nil {
+		return err
+	}
+
+	for {
+		status := struct {
+			Status string `json:"Status"`
+			Error  string `json:"Error"`
+		}{}
+		if err := r.dataAPI(ctx, "DescribeStatement", map[string]string{"Id": result.ID}, &status); err != nil {
+			return err
+		}
+		switch status.Status {
+		case "FINISHED":
+			return nil
+		case "FAILED", "ABORTED":
+			return fmt.Errorf("statement %s: %s", strings.ToLower(status.Status), status.Error)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(redshiftPollInterval):
+		}
+	}
+}
+
+// dataAPI calls the action of the Redshift Data API, decoding its response into result
+func (r *RedshiftPump) dataAPI(ctx context.Context, action string, input, result interface{}) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(r.conf.DataAPIURL, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "RedshiftData."+action)
+
+	respBody, err := r.do(req, body, "redshift-data")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(respBody, result)
+}
+
+// do signs and sends the request to the AWS service, returning the body of the response
+func (r *RedshiftPump) do(req *http.Request, body []byte, service string) ([]byte, error) {
+	creds, err := r.creds.get(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	signAWSRequest(req, body, creds, r.conf.Region, service, time.Now())
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("%s responded with status %d: %s", service, resp.StatusCode, respBody)
+	}
+	return respBody, nil
+}
@@ -0,0 +1,171 @@
+package pumps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestRedshiftWriteData(t *testing.T) {
+	redshiftRetryBackoff, redshiftPollInterval = time.Millisecond, time.Millisecond
+	defer func() { redshiftRetryBackoff, redshiftPollInterval = time.Second, 500*time.Millisecond }()
+
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	statements := []redshiftStatement{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			t.Errorf("expected a signed request, got %q", r.Header.Get("Authorization"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if r.Method == http.MethodPut {
+			if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+				t.Error("expected the payload hash of the S3 request")
+			}
+			objects[r.URL.Path] = body
+			return
+		}
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "RedshiftData.ExecuteStatement":
+			statement := redshiftStatement{}
+			json.Unmarshal(body, &statement)
+			statements = append(statements, statement)
+			w.Write([]byte(`{"Id":"` + string(rune('0'+len(statements))) + `"}`))
+		case "RedshiftData.DescribeStatement":
+			id := map[string]string{}
+			json.Unmarshal(body, &id)
+			// the first COPY fails
+			if strings.HasPrefix(statements[len(statements)-1].Sql, "COPY") && id["Id"] == "2" {
+				w.Write([]byte(`{"Status":"FAILED","Error":"S3ServiceException: slow down"}`))
+				return
+			}
+			w.Write([]byte(`{"Status":"FINISHED"}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	pump := &RedshiftPump{}
+	err := pump.Init(map[string]interface{}{
+		"region":            "eu-west-1",
+		"access_key_id":     "AKID",
+		"secret_access_key": "secret",
+		"workgroup_name":    "tyk",
+		"database":          "dev",
+		"s3_bucket":         "tyk-staging",
+		"iam_role":          "arn:aws:iam::123456789012:role/redshift-copy",
+		"small_batch_size":  2,
+		"max_file_bytes":    700,
+		"s3_url":            server.URL,
+		"data_api_url":      server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := []interface{}{
+		analytics.AnalyticsRecord{APIID: "1", ResponseCode: 200, TimeStamp: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)},
+		analytics.AnalyticsRecord{APIID: "2"},
+	}
+	if err := pump.WriteData(context.Background(), small); err != nil {
+		t.Fatal(err)
+	}
+	if len(statements) != 1 || len(objects) != 0 {
+		t.Fatalf("expected the small batch to be inserted, got %d statements and %d objects", len(statements), len(objects))
+	}
+	insert := statements[0]
+	if insert.WorkgroupName != "tyk" || insert.Database != "dev" || !strings.HasPrefix(insert.Sql, "INSERT INTO tyk_analytics (timestamp, org_id") {
+		t.Errorf("unexpected INSERT %+v", insert)
+	}
+	if !strings.Contains(insert.Sql, "('2021-01-02 03:04:05.000000', '', :p0, ") || len(insert.Parameters) != 2 || insert.Parameters[1].Value != "2" {
+		t.Errorf("expected the strings as parameters, got %s %v", insert.Sql, insert.Parameters)
+	}
+
+	large := []interface{}{
+		analytics.AnalyticsRecord{APIID: "3"},
+		analytics.AnalyticsRecord{APIID: "4"},
+		analytics.AnalyticsRecord{APIID: "5"},
+	}
+	if err := pump.WriteData(context.Background(), large); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(statements) != 3 || statements[1].Sql != statements[2].Sql {
+		t.Fatalf("expected the failed COPY to be retried, got %v", statements)
+	}
+	copyStatement := statements[2].Sql
+	if !strings.HasPrefix(copyStatement, "COPY tyk_analytics (timestamp, ") ||
+		!strings.Contains(copyStatement, "FROM 's3://tyk-staging/tyk-pump/") ||
+		!strings.Contains(copyStatement, "IAM_ROLE 'arn:aws:iam::123456789012:role/redshift-copy' FORMAT AS JSON 'auto' GZIP MANIFEST") {
+		t.Errorf("unexpected COPY %s", copyStatement)
+	}
+
+	manifestKey := copyStatement[strings.Index(copyStatement, "s3://tyk-staging/")+len("s3://tyk-staging/") : strings.Index(copyStatement, ".manifest")+len(".manifest")]
+	manifest := struct {
+		Entries []struct {
+			URL       string `json:"url"`
+			Mandatory bool   `json:"mandatory"`
+		} `json:"entries"`
+	}{}
+	if err := json.Unmarshal(objects["/tyk-staging/"+manifestKey], &manifest); err != nil {
+		t.Fatalf("expected the manifest to be staged: %v", err)
+	}
+	if len(manifest.Entries) < 2 {
+		t.Fatalf("expected the records to be split in files, got %v", manifest.Entries)
+	}
+
+	rows := 0
+	for _, entry := range manifest.Entries {
+		object, ok := objects["/"+strings.TrimPrefix(entry.URL, "s3://")]
+		if !ok || !entry.Mandatory {
+			t.Fatalf("expected %s to be staged and mandatory", entry.URL)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(object))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines, _ := ioutil.ReadAll(zr)
+		for _, line := range strings.Split(strings.TrimSpace(string(lines)), "\n") {
+			row := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(line), &row); err != nil || row["timestamp"] == nil {
+				t.Errorf("expected a JSON row per line, got %s", line)
+			}
+			rows++
+		}
+	}
+	if rows != len(large) {
+		t.Errorf("expected %d staged rows, got %d", len(large), rows)
+	}
+}
+
+func TestRedshiftInitInvalidIAMRole(t *testing.T) {
+	pump := &RedshiftPump{}
+	err := pump.Init(map[string]interface{}{
+		"region":             "eu-west-1",
+		"access_key_id":      "AKID",
+		"secret_access_key":  "secret",
+		"cluster_identifier": "tyk",
+		"database":           "dev",
+		"s3_bucket":          "tyk-staging",
+		"iam_role":           "arn' x",
+	})
+	if err == nil {
+		t.Error("expected an invalid IAM role to fail")
+	}
+}
@@ -0,0 +1,397 @@
+package pumps
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// SecurityPump extracts the security events of the records, the authentication failures, their spikes, the brute
+// force of keys and the unusually large payloads, and sends them to a SIEM in CEF or LEEF, over syslog or to Splunk
+type SecurityPump struct {
+	conf   *SecurityConf
+	writer *syslogWriter
+	splunk *SplunkClient
+	window time.Duration
+
+	// windowStart is the start of the window the failures by IP are counted in
+	windowStart time.Time
+	ips         map[string]*securityIP
+	CommonPumpConfig
+}
+
+var (
+	securityPrefix     = "security-pump"
+	securityDefaultENV = PUMPS_ENV_PREFIX + "_SECURITY" + PUMPS_ENV_META_PREFIX
+)
+
+const (
+	securitySyslogOutput = "syslog"
+	securitySplunkOutput = "splunk"
+
+	securityCEFFormat  = "cef"
+	securityLEEFFormat = "leef"
+
+	defaultSecurityWindow            = 60
+	defaultSecurityAuthFailures      = 20
+	defaultSecurityBruteForceKeys    = 5
+	defaultSecurityLargePayloadBytes = 10 << 20
+	defaultSecuritySourceType        = "tyk:security"
+
+	securityVendor  = "Tyk Technologies"
+	securityProduct = "Tyk Pump"
+)
+
+// The security events, with their severity from 0 to 10
+const (
+	SecurityAuthFailure      = "auth_failure"
+	SecurityAuthFailureSpike = "auth_failure_spike"
+	SecurityBruteForce       = "brute_force"
+	SecurityLargePayload     = "large_payload"
+)
+
+var securitySeverities = map[string]int{
+	SecurityAuthFailure:      3,
+	SecurityLargePayload:     5,
+	SecurityAuthFailureSpike: 7,
+	SecurityBruteForce:       8,
+}
+
+var securityNames = map[string]string{
+	SecurityAuthFailure:      "Authentication failure",
+	SecurityLargePayload:     "Unusually large payload",
+	SecurityAuthFailureSpike: "Spike of authentication failures",
+	SecurityBruteForce:       "Brute force of API keys",
+}
+
+// SecurityConf configures the security pump
+type SecurityConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	// Output is where the events are sent: syslog, the default, or splunk
+	Output string `mapstructure:"output"`
+	// Format is cef, the default, or leef
+	Format string `mapstructure:"format"`
+	// Syslog configures the syslog output, like the syslog pump
+	Syslog SyslogConf `mapstructure:"syslog"`
+	// The Splunk output sends the events to the raw endpoint of the HTTP Event Collector
+	SplunkCollectorURL          string `mapstructure:"splunk_collector_url"`
+	SplunkToken                 string `mapstructure:"splunk_token"`
+	SplunkSourceType            string `mapstructure:"splunk_sourcetype"`
+	SplunkIndex                 string `mapstructure:"splunk_index"`
+	SplunkSSLInsecureSkipVerify bool   `mapstructure:"splunk_ssl_insecure_skip_verify"`
+	// Window is the length in seconds of the windows the authentication failures of every IP are counted in, 60 by
+	// default
+	Window int `mapstructure:"window"`
+	// AuthFailureThreshold is how many authentication failures of an IP in a window are a spike, 20 by default
+	AuthFailureThreshold int `mapstructure:"auth_failure_threshold"`
+	// BruteForceKeys is how many different keys failing to authenticate from an IP in a window are a brute force, 5
+	// by default
+	BruteForceKeys int `mapstructure:"brute_force_keys"`
+	// LargePayloadBytes is the size above which the payload of a request or a response is unusually large, 10MB by
+	// default
+	LargePayloadBytes int64 `mapstructure:"large_payload_bytes"`
+}
+
+// securityIP are the authentication failures of an IP in the current window
+type securityIP struct {
+	failures int
+	keys     map[string]bool
+	// spike and bruteForce are whether the events were already sent in the window
+	spike      bool
+	bruteForce bool
+}
+
+// SecurityEvent is a security event found in the records, with the record which raised it
+type SecurityEvent struct {
+	Type   string
+	Record analytics.AnalyticsRecord
+	// Count is the number of authentication failures or of keys which raised a spike or a brute force
+	Count int
+}
+
+func (p *SecurityPump) New() Pump {
+	newPump := SecurityPump{}
+	return &newPump
+}
+
+func (p *SecurityPump) GetName() string {
+	return "Security Pump"
+}
+
+// Close closes the connection to the syslog server
+func (p *SecurityPump) Close() error {
+	if p.writer == nil {
+		return nil
+	}
+	return p.writer.Close()
+}
+
+func (p *SecurityPump) GetEnvPrefix() string {
+	return p.conf.EnvPrefix
+}
+
+func (p *SecurityPump) Init(config interface{}) error {
+	p.conf = &SecurityConf{}
+	p.log = p.newLogger(securityPrefix)
+
+	if err := decodePumpConfig(p, p.log, config, &p.conf); err != nil {
+		p.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(p, p.log, p.conf, securityDefaultENV)
+
+	switch p.conf.Format {
+	case "":
+		p.conf.Format = securityCEFFormat
+	case securityCEFFormat, securityLEEFFormat:
+	default:
+		return fmt.Errorf("invalid format %q, must be cef or leef", p.conf.Format)
+	}
+	if p.conf.Window <= 0 {
+		p.conf.Window = defaultSecurityWindow
+	}
+	if p.conf.AuthFailureThreshold <= 0 {
+		p.conf.AuthFailureThreshold = defaultSecurityAuthFailures
+	}
+	if p.conf.BruteForceKeys <= 0 {
+		p.conf.BruteForceKeys = defaultSecurityBruteForceKeys
+	}
+	if p.conf.LargePayloadBytes <= 0 {
+		p.conf.LargePayloadBytes = defaultSecurityLargePayloadBytes
+	}
+	p.window = time.Duration(p.conf.Window) * time.Second
+	p.ips = map[string]*securityIP{}
+
+	switch p.conf.Output {
+	case "", securitySyslogOutput:
+		p.conf.Output = securitySyslogOutput
+		if err := p.initSyslog(); err != nil {
+			return err
+		}
+	case securitySplunkOutput:
+		if err := p.initSplunk(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid output %q, must be syslog or splunk", p.conf.Output)
+	}
+
+	p.log.Info(p.GetName() + " Initialized")
+	return nil
+}
+
+// initSyslog connects to the syslog daemon, with the defaults of the syslog pump
+func (p *SecurityPump) initSyslog() error {
+	conf := p.conf.Syslog
+	if conf.Transport == "" {
+		conf.Transport = "udp"
+	}
+	if conf.NetworkAddr == "" {
+		conf.NetworkAddr = "localhost:5140"
+	}
+	tag := conf.Tag
+	if tag == "" {
+		tag = securityPrefix
+	}
+	writer, err := newSyslogWriter(&conf, tag)
+	if err != nil {
+		return err
+	}
+	p.writer = writer
+	return nil
+}
+
+// initSplunk sets up the client sending the events as raw lines to the HTTP Event Collector
+func (p *SecurityPump) initSplunk() error {
+	if p.conf.SplunkCollectorURL == "" || p.conf.SplunkToken == "" {
+		return errors.New("splunk_collector_url and splunk_token must be set")
+	}
+	u, err := url.Parse(p.conf.SplunkCollectorURL)
+	if err != nil {
+		return err
+	}
+	if p.conf.SplunkSourceType == "" {
+		p.conf.SplunkSourceType = defaultSecuritySourceType
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: p.conf.SplunkSSLInsecureSkipVerify}
+	ApplyTLSDefaults(tlsConfig)
+	client := newSplunkClient(p.conf.SplunkToken, u, &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	})
+	u.Path = defaultRawPath
+	client.CollectorURL = u.String()
+	client.Raw = true
+	client.RawFormat = template.Must(template.New("security").Parse("{{.message}}"))
+	p.splunk = client
+	return nil
+}
+
+func (p *SecurityPump) WriteData(ctx context.Context, data []interface{}) error {
+	p.log.Debug("Attempting to write ", len(data), " records...")
+
+	events := p.detect(data)
+	for _, event := range events {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := p.send(ctx, event); err != nil {
+			p.log.Error("Failed to send the security event: ", err)
+			return err
+		}
+	}
+
+	p.log.Info("Purged ", len(data), " records into ", len(events), " security events...")
+	return nil
+}
+
+// send sends the event, formatted in CEF or LEEF, to the output
+func (p *SecurityPump) send(ctx context.Context, event SecurityEvent) error {
+	var message string
+	if p.conf.Format == securityLEEFFormat {
+		message = leefMessage(event)
+	} else {
+		message = cefMessage(event)
+	}
+
+	if p.writer != nil {
+		return p.writer.Write(&event.Record, message)
+	}
+	resp, err := p.splunk.send(ctx, splunkEvent{
+		Time:       event.Record.TimeStamp.Unix(),
+		SourceType: p.conf.SplunkSourceType,
+		Index:      p.conf.SplunkIndex,
+		Event:      map[string]interface{}{"message": message},
+	})
+	if err != nil {
+		return err
+	}
+	return checkSplunkResponse(resp)
+}
+
+// detect returns the security events of the records: every authentication failure and unusually large payload, and
+// once per window and IP, the spike of authentication failures and the brute force of keys. The failures are
+// counted by IP in windows of the timestamp of the records, the records older than the current window are counted in
+// it.
+func (p *SecurityPump) detect(data []interface{}) []SecurityEvent {
+	var events []SecurityEvent
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok {
+			continue
+		}
+
+		if record.ContentLength > p.conf.LargePayloadBytes || record.ResponseContentLength > p.conf.LargePayloadBytes {
+			events = append(events, SecurityEvent{Type: SecurityLargePayload, Record: record})
+		}
+		if record.ResponseCode != http.StatusUnauthorized && record.ResponseCode != http.StatusForbidden {
+			continue
+		}
+		events = append(events, SecurityEvent{Type: SecurityAuthFailure, Record: record})
+
+		if windowStart := record.TimeStamp.Truncate(p.window); windowStart.After(p.windowStart) {
+			p.windowStart = windowStart
+			p.ips = map[string]*securityIP{}
+		}
+		ip, ok := p.ips[record.IPAddress]
+		if !ok {
+			ip = &securityIP{keys: map[string]bool{}}
+			p.ips[record.IPAddress] = ip
+		}
+		ip.failures++
+		if record.APIKey != "" {
+			ip.keys[record.APIKey] = true
+		}
+
+		if !ip.spike && ip.failures >= p.conf.AuthFailureThreshold {
+			ip.spike = true
+			events = append(events, SecurityEvent{Type: SecurityAuthFailureSpike, Record: record, Count: ip.failures})
+		}
+		if !ip.bruteForce && len(ip.keys) >= p.conf.BruteForceKeys {
+			ip.bruteForce = true
+			events = append(events, SecurityEvent{Type: SecurityBruteForce, Record: record, Count: len(ip.keys)})
+		}
+	}
+	return events
+}
+
+// securityFields are the fields of the event, in the CEF extension keys, with the LEEF ones when they differ
+func securityFields(event SecurityEvent) [][3]string {
+	record := event.Record
+	fields := [][3]string{
+		{"rt", "devTime", strconv.FormatInt(record.TimeStamp.UnixNano()/int64(time.Millisecond), 10)},
+		{"src", "src", record.IPAddress},
+		{"requestMethod", "method", record.Method},
+		{"request", "url", record.Path},
+		{"requestClientApplication", "userAgent", record.UserAgent},
+		{"suser", "usrName", record.Alias},
+		{"in", "srcBytes", strconv.FormatInt(record.ContentLength, 10)},
+		{"out", "dstBytes", strconv.FormatInt(record.ResponseContentLength, 10)},
+		{"outcome", "responseCode", strconv.Itoa(record.ResponseCode)},
+		{"cs1Label", "", "apiId"},
+		{"cs1", "apiId", record.APIID},
+		{"cs2Label", "", "orgId"},
+		{"cs2", "orgId", record.OrgID},
+		{"cs3Label", "", "apiKey"},
+		{"cs3", "apiKey", record.APIKey},
+		{"cs4Label", "", "traceId"},
+		{"cs4", "traceId", record.TraceID},
+		{"cs5Label", "", "correlationId"},
+		{"cs5", "correlationId", record.CorrelationID},
+	}
+	if event.Count > 0 {
+		fields = append(fields, [3]string{"cnt", "count", strconv.Itoa(event.Count)})
+	}
+	return fields
+}
+
+// cefMessage formats the event in the Common Event Format of ArcSight
+func cefMessage(event SecurityEvent) string {
+	var ext []string
+	for _, field := range securityFields(event) {
+		if field[2] != "" {
+			ext = append(ext, field[0]+"="+cefEscapeExtension(field[2]))
+		}
+	}
+	return fmt.Sprintf("CEF:0|%s|%s|1.0|%s|%s|%d|%s", cefEscapeHeader(securityVendor), cefEscapeHeader(securityProduct),
+		event.Type, cefEscapeHeader(securityNames[event.Type]), securitySeverities[event.Type], strings.Join(ext, " "))
+}
+
+// leefMessage formats the event in the Log Event Extended Format of QRadar, with tab separated attributes
+func leefMessage(event SecurityEvent) string {
+	attributes := []string{"cat=" + event.Type, "sev=" + strconv.Itoa(securitySeverities[event.Type]), "devTimeFormat=epoch"}
+	for _, field := range securityFields(event) {
+		if field[1] != "" && field[2] != "" {
+			attributes = append(attributes, field[1]+"="+leefEscape(field[2]))
+		}
+	}
+	return fmt.Sprintf("LEEF:1.0|%s|%s|1.0|%s|%s", securityVendor, securityProduct, event.Type, strings.Join(attributes, "\t"))
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r\n", `\n`, "\n", `\n`, "\r", `\r`)
+	leefEscaper         = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+)
+
+func cefEscapeHeader(value string) string {
+	return cefHeaderEscaper.Replace(value)
+}
+
+func cefEscapeExtension(value string) string {
+	return cefExtensionEscaper.Replace(value)
+}
+
+func leefEscape(value string) string {
+	return leefEscaper.Replace(value)
+}
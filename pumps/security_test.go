@@ -0,0 +1,134 @@
+package pumps
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestSecurityDetect(t *testing.T) {
+	p := &SecurityPump{
+		conf:   &SecurityConf{AuthFailureThreshold: 3, BruteForceKeys: 2, LargePayloadBytes: 100},
+		window: time.Minute,
+		ips:    map[string]*securityIP{},
+	}
+	now := time.Date(2020, 3, 4, 5, 6, 0, 0, time.UTC)
+	data := []interface{}{
+		analytics.AnalyticsRecord{IPAddress: "1.2.3.4", ResponseCode: 401, APIKey: "a", TimeStamp: now},
+		analytics.AnalyticsRecord{IPAddress: "1.2.3.4", ResponseCode: 200, ContentLength: 101, TimeStamp: now},
+		analytics.AnalyticsRecord{IPAddress: "1.2.3.4", ResponseCode: 403, APIKey: "b", TimeStamp: now},
+		analytics.AnalyticsRecord{IPAddress: "5.6.7.8", ResponseCode: 401, APIKey: "a", TimeStamp: now},
+		analytics.AnalyticsRecord{IPAddress: "1.2.3.4", ResponseCode: 401, APIKey: "b", TimeStamp: now},
+		analytics.AnalyticsRecord{IPAddress: "1.2.3.4", ResponseCode: 401, APIKey: "c", TimeStamp: now},
+		// a new window counts the failures again
+		analytics.AnalyticsRecord{IPAddress: "1.2.3.4", ResponseCode: 401, APIKey: "a", TimeStamp: now.Add(time.Minute)},
+		analytics.AnalyticsRecord{IPAddress: "1.2.3.4", ResponseCode: 200, ResponseContentLength: 101, TimeStamp: now.Add(time.Minute)},
+	}
+
+	var types []string
+	for _, event := range p.detect(data) {
+		types = append(types, fmt.Sprintf("%s:%s:%d", event.Type, event.Record.IPAddress, event.Count))
+	}
+	expected := []string{
+		"auth_failure:1.2.3.4:0", "large_payload:1.2.3.4:0", "auth_failure:1.2.3.4:0", "brute_force:1.2.3.4:2",
+		"auth_failure:5.6.7.8:0", "auth_failure:1.2.3.4:0", "auth_failure_spike:1.2.3.4:3", "auth_failure:1.2.3.4:0",
+		"auth_failure:1.2.3.4:0", "large_payload:1.2.3.4:0",
+	}
+	if strings.Join(types, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected the events %v, got %v", expected, types)
+	}
+}
+
+func TestSecurityMessages(t *testing.T) {
+	event := SecurityEvent{
+		Type:  SecurityBruteForce,
+		Count: 5,
+		Record: analytics.AnalyticsRecord{
+			TimeStamp:    time.Unix(1583298367, 0),
+			IPAddress:    "1.2.3.4",
+			Method:       "GET",
+			Path:         "/a=b\\c",
+			UserAgent:    "curl\n",
+			APIID:        "api1",
+			ResponseCode: 401,
+		},
+	}
+
+	expected := `CEF:0|Tyk Technologies|Tyk Pump|1.0|brute_force|Brute force of API keys|8|rt=1583298367000 ` +
+		`src=1.2.3.4 requestMethod=GET request=/a\=b\\c requestClientApplication=curl\n in=0 out=0 outcome=401 ` +
+		`cs1Label=apiId cs1=api1 cs2Label=orgId cs3Label=apiKey cs4Label=traceId cs5Label=correlationId cnt=5`
+	if message := cefMessage(event); message != expected {
+		t.Errorf("expected %s, got %s", expected, message)
+	}
+
+	expected = "LEEF:1.0|Tyk Technologies|Tyk Pump|1.0|brute_force|cat=brute_force\tsev=8\tdevTimeFormat=epoch\t" +
+		"devTime=1583298367000\tsrc=1.2.3.4\tmethod=GET\turl=/a=b\\c\tuserAgent=curl \tsrcBytes=0\tdstBytes=0\t" +
+		"responseCode=401\tapiId=api1\tcount=5"
+	if message := leefMessage(event); message != expected {
+		t.Errorf("expected %s, got %s", expected, message)
+	}
+
+	if header := cefEscapeHeader(`a|b\c`); header != `a\|b\\c` {
+		t.Errorf("unexpected escaped header %s", header)
+	}
+}
+
+func TestSecuritySplunk(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- string(body)
+		w.Write([]byte(`{"text": "Success", "code": 0}`))
+	}))
+	defer server.Close()
+
+	p := &SecurityPump{}
+	err := p.Init(map[string]interface{}{
+		"output":               "splunk",
+		"format":               "leef",
+		"splunk_collector_url": server.URL,
+		"splunk_token":         "token",
+		"splunk_index":         "security",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := analytics.AnalyticsRecord{IPAddress: "1.2.3.4", ResponseCode: 403, TimeStamp: time.Now()}
+	if err := p.WriteData(context.Background(), []interface{}{record}); err != nil {
+		t.Fatal(err)
+	}
+	r := <-received
+	if r.URL.Path != defaultRawPath || r.URL.Query().Get("sourcetype") != defaultSecuritySourceType ||
+		r.URL.Query().Get("index") != "security" {
+		t.Errorf("unexpected request %s", r.URL)
+	}
+	if r.Header.Get(authHeaderName) != authHeaderPrefix+"token" {
+		t.Errorf("unexpected authorization %q", r.Header.Get(authHeaderName))
+	}
+	if body := <-bodies; !strings.HasPrefix(body, "LEEF:1.0|Tyk Technologies|Tyk Pump|1.0|auth_failure|") {
+		t.Errorf("expected the LEEF event, got %s", body)
+	}
+}
+
+func TestSecurityInvalidConfig(t *testing.T) {
+	for _, config := range []map[string]interface{}{
+		{"format": "json"},
+		{"output": "kafka"},
+		{"output": "splunk"},
+	} {
+		p := &SecurityPump{}
+		if err := p.Init(config); err == nil {
+			t.Errorf("expected %v to be invalid", config)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 
-	"github.com/mitchellh/mapstructure"
 	segment "github.com/segmentio/analytics-go"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
@@ -33,15 +32,23 @@ func (s *SegmentPump) GetName() string {
 	return "Segment Pump"
 }
 
+// Close sends the queued events and stops the client
+func (s *SegmentPump) Close() error {
+	if s.segmentClient == nil {
+		return nil
+	}
+	return s.segmentClient.Close()
+}
+
 func (s *SegmentPump) GetEnvPrefix() string {
 	return s.segmentConf.EnvPrefix
 }
 
 func (s *SegmentPump) Init(config interface{}) error {
 	s.segmentConf = &SegmentConf{}
-	s.log = log.WithField("prefix", segmentPrefix)
+	s.log = s.newLogger(segmentPrefix)
 
-	loadConfigErr := mapstructure.Decode(config, &s.segmentConf)
+	loadConfigErr := decodePumpConfig(s, s.log, config, &s.segmentConf)
 	if loadConfigErr != nil {
 		s.log.Fatal("Failed to decode configuration: ", loadConfigErr)
 	}
@@ -58,6 +65,9 @@ func (s *SegmentPump) WriteData(ctx context.Context, data []interface{}) error {
 	s.log.Debug("Attempting to write ", len(data), " records...")
 
 	for _, v := range data {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		s.WriteDataRecord(v.(analytics.AnalyticsRecord))
 	}
 	s.log.Info("Purged ", len(data), " records...")
@@ -71,6 +81,7 @@ func (s *SegmentPump) WriteDataRecord(record analytics.AnalyticsRecord) error {
 
 	if err != nil {
 		s.log.Error("Couldn't marshal analytics data:", err)
+		s.DropRecords(DroppedSerialization, 1)
 	} else {
 		err = s.segmentClient.Track(&segment.Track{
 			Event:       "Hit",
@@ -79,6 +90,7 @@ func (s *SegmentPump) WriteDataRecord(record analytics.AnalyticsRecord) error {
 		})
 		if err != nil {
 			s.log.Error("Couldn't track record:", err)
+			s.DropRecords(DroppedRejected, 1)
 		}
 	}
 
@@ -0,0 +1,218 @@
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	singlestorePrefix     = "singlestore-pump"
+	singlestoreDefaultENV = PUMPS_ENV_PREFIX + "_SINGLESTORE" + PUMPS_ENV_META_PREFIX
+
+	defaultSingleStoreTable     = "tyk_analytics"
+	defaultSingleStoreBatchSize = 1000
+	singlestoreExecPath         = "/api/v2/exec"
+)
+
+var singlestoreIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// singlestoreTypes are the SQL types of the columns
+var singlestoreTypes = map[columnType]string{
+	columnTimestamp: "DATETIME(6)",
+	columnString:    "TEXT",
+	columnInteger:   "BIGINT",
+}
+
+// SingleStorePump inserts the analytics records into a SingleStore table with the Data API, a multi-row INSERT of up
+// to batch_size rows per request
+type SingleStorePump struct {
+	conf   *SingleStoreConf
+	client *http.Client
+	CommonPumpConfig
+}
+
+// SingleStoreConf configures the SingleStore pump
+type SingleStoreConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	// URL is the URL of the Data API of the workspace, like https://svc-xxx.svc.singlestore.com
+	URL      string `mapstructure:"url"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	Database string `mapstructure:"database"`
+	// Table is the table the records are inserted into, tyk_analytics by default
+	Table string `mapstructure:"table"`
+	// BatchSize is the maximum number of rows inserted by a request, 1000 by default
+	BatchSize int `mapstructure:"batch_size"`
+	// CreateTable creates the table on start when it doesn't exist, as a columnstore table sorted by timestamp
+	CreateTable bool `mapstructure:"create_table"`
+}
+
+type singlestoreRequest struct {
+	SQL      string        `json:"sql"`
+	Args     []interface{} `json:"args,omitempty"`
+	Database string        `json:"database"`
+}
+
+func (s *SingleStorePump) New() Pump {
+	newPump := SingleStorePump{}
+	return &newPump
+}
+
+func (s *SingleStorePump) GetName() string {
+	return "SingleStore Pump"
+}
+
+func (s *SingleStorePump) GetEnvPrefix() string {
+	return s.conf.EnvPrefix
+}
+
+func (s *SingleStorePump) Init(config interface{}) error {
+	s.conf = &SingleStoreConf{}
+	s.log = s.newLogger(singlestorePrefix)
+
+	if err := decodePumpConfig(s, s.log, config, &s.conf); err != nil {
+		s.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(s, s.log, s.conf, singlestoreDefaultENV)
+
+	if s.conf.URL == "" || s.conf.Username == "" || s.conf.Database == "" {
+		return errors.New("url, username and database must be set")
+	}
+	if s.conf.Table == "" {
+		s.conf.Table = defaultSingleStoreTable
+	}
+	if !singlestoreIdentifier.MatchString(s.conf.Table) {
+		return fmt.Errorf("invalid table name %q", s.conf.Table)
+	}
+	if s.conf.BatchSize <= 0 {
+		s.conf.BatchSize = defaultSingleStoreBatchSize
+	}
+	s.client = &http.Client{Timeout: 60 * time.Second}
+
+	if s.conf.CreateTable && !s.dryRun {
+		if err := s.execute(context.Background(), singlestoreCreateTable(s.conf.Table), nil); err != nil {
+			return fmt.Errorf("couldn't create the table: %v", err)
+		}
+		for _, statement := range sqlAddColumns(singlestoreQuote(s.conf.Table), singlestoreTypes, singlestoreQuote, false) {
+			if err := s.execute(context.Background(), statement, nil); err != nil && !isColumnExistsError(err) {
+				return fmt.Errorf("couldn't add the new columns to the table: %v", err)
+			}
+		}
+	}
+
+	s.log.Info(s.GetName() + " Initialized")
+	return nil
+}
+
+func singlestoreQuote(name string) string {
+	return "`" + name + "`"
+}
+
+// singlestoreCreateTable returns the statement creating the table as a columnstore, sorted by timestamp for the time
+// range queries and sharded by API
+func singlestoreCreateTable(table string) string {
+	statement := sqlCreateTable(singlestoreQuote(table), singlestoreTypes, singlestoreQuote)
+	return strings.TrimSuffix(statement, ")") + ", SORT KEY (`timestamp`), SHARD KEY (`api_id`))"
+}
+
+// singlestoreInsert returns the INSERT statement of the given number of rows
+func singlestoreInsert(table string, rows int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(analyticsColumns)), ", ") + ")"
+	return "INSERT INTO " + singlestoreQuote(table) + " " + sqlColumnList(singlestoreQuote) + " VALUES " +
+		strings.TrimSuffix(strings.Repeat(row+", ", rows), ", ")
+}
+
+// singlestoreArgs returns the arguments of the INSERT statement of the records, row after row
+func singlestoreArgs(records []interface{}) []interface{} {
+	args := make([]interface{}, 0, len(records)*len(analyticsColumns))
+	for _, v := range records {
+		record := v.(analytics.AnalyticsRecord)
+		for _, column := range analyticsColumns {
+			value := column.value(&record)
+			if t, ok := value.(time.Time); ok {
+				value = formatTimestamp(t)
+			}
+			args = append(args, value)
+		}
+	}
+	return args
+}
+
+func (s *SingleStorePump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := s.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial inserts the records in batches of up to batch_size rows, returning the records of the batches that
+// failed and of the ones left at the deadline
+func (s *SingleStorePump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
+	s.log.Debug("Attempting to write ", len(data), " records...")
+
+	failed := []interface{}{}
+	var lastErr error
+	for start := 0; start < len(data); start += s.conf.BatchSize {
+		end := start + s.conf.BatchSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return append(failed, data[start:]...), err
+		}
+
+		batch := data[start:end]
+		if err := s.execute(ctx, singlestoreInsert(s.conf.Table, len(batch)), singlestoreArgs(batch)); err != nil {
+			s.log.WithField("rows", len(batch)).Error("Failed to insert the records: ", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return append(failed, data[start:]...), ctxErr
+			}
+			failed = append(failed, batch...)
+			lastErr = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("failed to write %d of %d records: %v", len(failed), len(data), lastErr)
+	}
+	s.log.Info("Purged ", len(data), " records...")
+	return nil, nil
+}
+
+// execute runs the statement with the Data API
+func (s *SingleStorePump) execute(ctx context.Context, statement string, args []interface{}) error {
+	body, err := json.Marshal(singlestoreRequest{SQL: statement, Args: args, Database: s.conf.Database})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(s.conf.URL, "/")+singlestoreExecPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(s.conf.Username, s.conf.Password)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("singlestore responded with status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
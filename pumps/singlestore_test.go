@@ -0,0 +1,75 @@
+package pumps
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestSingleStoreWriteData(t *testing.T) {
+	requests := []singlestoreRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); r.URL.Path != singlestoreExecPath || user != "admin" || password != "secret" {
+			t.Errorf("unexpected request to %s as %s", r.URL.Path, user)
+		}
+		request := singlestoreRequest{}
+		json.NewDecoder(r.Body).Decode(&request)
+		requests = append(requests, request)
+		if strings.HasPrefix(request.SQL, "ALTER TABLE") && strings.Contains(request.SQL, "`correlation_id`") {
+			// the table created by a previous version already has the column
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Error 1060: Duplicate column name 'correlation_id'"))
+			return
+		}
+		w.Write([]byte(`{"lastInsertId":0,"rowsAffected":2}`))
+	}))
+	defer server.Close()
+
+	pump := &SingleStorePump{}
+	err := pump.Init(map[string]interface{}{
+		"url":          server.URL,
+		"username":     "admin",
+		"password":     "secret",
+		"database":     "tyk",
+		"batch_size":   2,
+		"create_table": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{APIID: "1", ResponseCode: 200, TimeStamp: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)},
+		analytics.AnalyticsRecord{APIID: "2"},
+		analytics.AnalyticsRecord{APIID: "3"},
+	}
+	if err := pump.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 6 {
+		t.Fatalf("expected the CREATE TABLE, the ALTER TABLEs and a request per batch, got %d requests", len(requests))
+	}
+	if create := requests[0].SQL; !strings.HasSuffix(create, "SORT KEY (`timestamp`), SHARD KEY (`api_id`))") || requests[0].Database != "tyk" {
+		t.Errorf("unexpected CREATE TABLE %s", create)
+	}
+	if alter := requests[1].SQL; alter != "ALTER TABLE `tyk_analytics` ADD COLUMN `trace_id` TEXT" {
+		t.Errorf("unexpected ALTER TABLE %s", alter)
+	}
+	insert := requests[4]
+	if strings.Count(insert.SQL, "(?,") != 2 || len(insert.Args) != 2*len(analyticsColumns) {
+		t.Errorf("expected an INSERT of 2 rows, got %s with %d args", insert.SQL, len(insert.Args))
+	}
+	if insert.Args[0] != "2021-01-02 03:04:05.000000000" || insert.Args[len(analyticsColumns)+2] != "2" {
+		t.Errorf("unexpected args %v", insert.Args)
+	}
+	if strings.Count(requests[5].SQL, "(?,") != 1 {
+		t.Errorf("expected an INSERT of the last row, got %s", requests[5].SQL)
+	}
+}
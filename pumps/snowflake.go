@@ -0,0 +1,399 @@
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	snowflakePrefix     = "snowflake-pump"
+	snowflakeDefaultENV = PUMPS_ENV_PREFIX + "_SNOWFLAKE" + PUMPS_ENV_META_PREFIX
+
+	defaultSnowflakeTable     = "TYK_ANALYTICS"
+	defaultSnowflakeBatchSize = 1000
+	// snowflakeTokenLifetime is how long the key pair JWTs are valid for, Snowflake accepts up to an hour
+	snowflakeTokenLifetime = 59 * time.Minute
+	// snowflakeTokenRenewal is how long before expiring a JWT is renewed
+	snowflakeTokenRenewal   = 5 * time.Minute
+	snowflakeStatementsPath = "/api/v2/statements"
+)
+
+var snowflakeIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+
+// snowflakePollInterval is how often the status of the statements still running is checked
+var snowflakePollInterval = time.Second
+
+// SnowflakePump inserts the analytics records into a Snowflake table through the SQL API, authenticating with a key
+// pair, in batches of up to batch_size rows
+type SnowflakePump struct {
+	conf   *SnowflakeConf
+	key    *rsa.PrivateKey
+	client *http.Client
+
+	tokenMu     sync.Mutex
+	token       string
+	tokenExpiry time.Time
+
+	CommonPumpConfig
+}
+
+// SnowflakeConf configures the Snowflake pump
+type SnowflakeConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	// Account is the account identifier, like myorg-myaccount
+	Account string `mapstructure:"account"`
+	// URL is the URL of the account, https://<account>.snowflakecomputing.com by default
+	URL  string `mapstructure:"url"`
+	User string `mapstructure:"user"`
+	// PrivateKeyFile is the unencrypted PEM file of the private key of the user key pair
+	PrivateKeyFile string `mapstructure:"private_key_file"`
+	// PrivateKey is the PEM private key, instead of PrivateKeyFile
+	PrivateKey string `mapstructure:"private_key"`
+	Database   string `mapstructure:"database"`
+	Schema     string `mapstructure:"schema"`
+	// Table is the table the records are inserted into, TYK_ANALYTICS by default
+	Table     string `mapstructure:"table"`
+	Warehouse string `mapstructure:"warehouse"`
+	Role      string `mapstructure:"role"`
+	// BatchSize is the maximum number of rows inserted by a statement, 1000 by default
+	BatchSize int `mapstructure:"batch_size"`
+	// CreateTable creates the table on start when it doesn't exist
+	CreateTable bool `mapstructure:"create_table"`
+}
+
+// snowflakeTypes are the SQL types of the columns
+var snowflakeTypes = map[columnType]string{
+	columnTimestamp: "TIMESTAMP_NTZ",
+	columnString:    "VARCHAR",
+	columnInteger:   "NUMBER",
+}
+
+// snowflakeBindTypes are the SQL API binding types of the columns
+var snowflakeBindTypes = map[columnType]string{
+	columnTimestamp: "TEXT",
+	columnString:    "TEXT",
+	columnInteger:   "FIXED",
+}
+
+// snowflakeBinding is the value of a statement parameter, a list of values to insert a row per value
+type snowflakeBinding struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+type snowflakeStatement struct {
+	Statement string                      `json:"statement"`
+	Timeout   int                         `json:"timeout,omitempty"`
+	Database  string                      `json:"database,omitempty"`
+	Schema    string                      `json:"schema,omitempty"`
+	Warehouse string                      `json:"warehouse,omitempty"`
+	Role      string                      `json:"role,omitempty"`
+	Bindings  map[string]snowflakeBinding `json:"bindings,omitempty"`
+}
+
+func (s *SnowflakePump) New() Pump {
+	newPump := SnowflakePump{}
+	return &newPump
+}
+
+func (s *SnowflakePump) GetName() string {
+	return "Snowflake Pump"
+}
+
+func (s *SnowflakePump) GetEnvPrefix() string {
+	return s.conf.EnvPrefix
+}
+
+func (s *SnowflakePump) Init(config interface{}) error {
+	s.conf = &SnowflakeConf{}
+	s.log = s.newLogger(snowflakePrefix)
+
+	if err := decodePumpConfig(s, s.log, config, &s.conf); err != nil {
+		s.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(s, s.log, s.conf, snowflakeDefaultENV)
+
+	if s.conf.Account == "" || s.conf.User == "" {
+		return errors.New("account and user must be set")
+	}
+	if s.conf.URL == "" {
+		s.conf.URL = "https://" + strings.ToLower(s.conf.Account) + ".snowflakecomputing.com"
+	}
+	if s.conf.Table == "" {
+		s.conf.Table = defaultSnowflakeTable
+	}
+	if !snowflakeIdentifier.MatchString(s.conf.Table) {
+		return fmt.Errorf("invalid table name %q", s.conf.Table)
+	}
+	if s.conf.BatchSize <= 0 {
+		s.conf.BatchSize = defaultSnowflakeBatchSize
+	}
+
+	keyPEM := []byte(s.conf.PrivateKey)
+	if s.conf.PrivateKeyFile != "" {
+		var err error
+		if keyPEM, err = ioutil.ReadFile(s.conf.PrivateKeyFile); err != nil {
+			return fmt.Errorf("couldn't read the private key: %v", err)
+		}
+	}
+	key, err := parseSnowflakeKey(keyPEM)
+	if err != nil {
+		return err
+	}
+	s.key = key
+	s.client = &http.Client{Timeout: 60 * time.Second}
+
+	if s.conf.CreateTable && !s.dryRun {
+		if err := s.execute(context.Background(), snowflakeCreateTable(s.conf.Table), nil); err != nil {
+			return fmt.Errorf("couldn't create the table: %v", err)
+		}
+		for _, statement := range sqlAddColumns(s.conf.Table, snowflakeTypes, unquoted, true) {
+			if err := s.execute(context.Background(), statement, nil); err != nil {
+				return fmt.Errorf("couldn't add the new columns to the table: %v", err)
+			}
+		}
+	}
+
+	s.log.Info(s.GetName() + " Initialized")
+	return nil
+}
+
+// parseSnowflakeKey parses the PEM RSA private key, in PKCS#8 or PKCS#1
+func parseSnowflakeKey(keyPEM []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("private_key or private_key_file must be a PEM private key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the private key, it must be unencrypted: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the private key must be an RSA key")
+	}
+	return key, nil
+}
+
+func snowflakeCreateTable(table string) string {
+	return sqlCreateTable(table, snowflakeTypes, unquoted)
+}
+
+func snowflakeInsert(table string) string {
+	return sqlInsert(table, unquoted, func(int) string { return "?" })
+}
+
+// snowflakeBindings returns the bindings inserting a row per record
+func snowflakeBindings(records []interface{}) map[string]snowflakeBinding {
+	bindings := make(map[string]snowflakeBinding, len(analyticsColumns))
+	for i, column := range analyticsColumns {
+		values := make([]string, 0, len(records))
+		for _, v := range records {
+			record := v.(analytics.AnalyticsRecord)
+			values = append(values, snowflakeValue(column.value(&record)))
+		}
+		bindings[strconv.Itoa(i+1)] = snowflakeBinding{Type: snowflakeBindTypes[column.columnType], Value: values}
+	}
+	return bindings
+}
+
+// snowflakeValue formats the column value as the SQL API takes the bindings, as text
+func snowflakeValue(value interface{}) string {
+	switch v := value.(type) {
+	case time.Time:
+		return formatTimestamp(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (s *SnowflakePump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := s.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial inserts the records in batches of up to batch_size rows, returning the records of the batches that
+// failed and of the ones left at the deadline
+func (s *SnowflakePump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
+	s.log.Debug("Attempting to write ", len(data), " records...")
+
+	failed := []interface{}{}
+	var lastErr error
+	statement := snowflakeInsert(s.conf.Table)
+	for start := 0; start < len(data); start += s.conf.BatchSize {
+		end := start + s.conf.BatchSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return append(failed, data[start:]...), err
+		}
+
+		batch := data[start:end]
+		if err := s.execute(ctx, statement, snowflakeBindings(batch)); err != nil {
+			s.log.WithField("rows", len(batch)).Error("Failed to insert the records: ", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return append(failed, data[start:]...), ctxErr
+			}
+			failed = append(failed, batch...)
+			lastErr = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("failed to write %d of %d records: %v", len(failed), len(data), lastErr)
+	}
+	s.log.Info("Purged ", len(data), " records...")
+	return nil, nil
+}
+
+// execute runs the statement with the SQL API. The statements still running when Snowflake responds, with a 202, are
+// polled until they complete, returning their error.
+func (s *SnowflakePump) execute(ctx context.Context, statement string, bindings map[string]snowflakeBinding) error {
+	body, err := json.Marshal(snowflakeStatement{
+		Statement: statement,
+		Timeout:   s.timeout,
+		Database:  s.conf.Database,
+		Schema:    s.conf.Schema,
+		Warehouse: s.conf.Warehouse,
+		Role:      s.conf.Role,
+		Bindings:  bindings,
+	})
+	if err != nil {
+		return err
+	}
+
+	statusCode, respBody, err := s.request(ctx, http.MethodPost, snowflakeStatementsPath, body)
+	for err == nil && statusCode == http.StatusAccepted {
+		running := struct {
+			StatementHandle string `json:"statementHandle"`
+		}{}
+		if err := json.Unmarshal(respBody, &running); err != nil || running.StatementHandle == "" {
+			return fmt.Errorf("snowflake responded without the handle of the running statement: %s", respBody)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(snowflakePollInterval):
+		}
+		statusCode, respBody, err = s.request(ctx, http.MethodGet, snowflakeStatementsPath+"/"+running.StatementHandle, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if statusCode == http.StatusOK {
+		return nil
+	}
+
+	status := struct {
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal(respBody, &status); err == nil && status.Message != "" {
+		return fmt.Errorf("snowflake responded with status %d: %s", statusCode, status.Message)
+	}
+	return fmt.Errorf("snowflake responded with status %d: %s", statusCode, respBody)
+}
+
+// request sends a request to the path of the SQL API, returning the status code and the body of the response
+func (s *SnowflakePump) request(ctx context.Context, method, path string, body []byte) (int, []byte, error) {
+	token, err := s.getToken(time.Now())
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(s.conf.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Snowflake-Authorization-Token-Type", "KEYPAIR_JWT")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, err
+}
+
+// getToken returns the key pair JWT authenticating the user, renewing it when it's about to expire at now
+func (s *SnowflakePump) getToken(now time.Time) (string, error) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	if s.token != "" && now.Add(snowflakeTokenRenewal).Before(s.tokenExpiry) {
+		return s.token, nil
+	}
+
+	token, err := snowflakeJWT(s.key, s.conf.Account, s.conf.User, now)
+	if err != nil {
+		return "", err
+	}
+	s.token, s.tokenExpiry = token, now.Add(snowflakeTokenLifetime)
+	return s.token, nil
+}
+
+// snowflakeJWT returns the JWT signed by the key authenticating the user of the account. Its issuer has the
+// fingerprint of the public key, which must be set as the RSA_PUBLIC_KEY of the user.
+func snowflakeJWT(key *rsa.PrivateKey, account, user string, now time.Time) (string, error) {
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	fingerprint := sha256.Sum256(publicKey)
+
+	// the account locator is given without its region
+	account = strings.ToUpper(strings.SplitN(account, ".", 2)[0])
+	subject := account + "." + strings.ToUpper(user)
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": subject + ".SHA256:" + base64.StdEncoding.EncodeToString(fingerprint[:]),
+		"sub": subject,
+		"iat": now.Unix(),
+		"exp": now.Add(snowflakeTokenLifetime).Unix(),
+	})
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hashed := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,168 @@
+package pumps
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestSnowflakeJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+
+	token, err := snowflakeJWT(key, "myorg-account.us-east-1", "tyk", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a JWT of 3 parts, got %s", token)
+	}
+
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hashed[:], signature); err != nil {
+		t.Fatal("expected the JWT to be signed by the key: ", err)
+	}
+
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "MYORG-ACCOUNT.TYK" || !strings.HasPrefix(claims["iss"].(string), "MYORG-ACCOUNT.TYK.SHA256:") {
+		t.Errorf("unexpected subject and issuer %v", claims)
+	}
+	if claims["exp"].(float64)-claims["iat"].(float64) > 3600 {
+		t.Errorf("expected the JWT to expire within an hour, got %v", claims)
+	}
+}
+
+func TestSnowflakeWriteData(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statements := []snowflakeStatement{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != snowflakeStatementsPath || r.Header.Get("X-Snowflake-Authorization-Token-Type") != "KEYPAIR_JWT" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+
+		statement := snowflakeStatement{}
+		json.NewDecoder(r.Body).Decode(&statement)
+		statements = append(statements, statement)
+		if len(statements) == 2 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"message":"invalid value"}`))
+		}
+	}))
+	defer server.Close()
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pump := &SnowflakePump{}
+	err = pump.Init(map[string]interface{}{
+		"account":     "account",
+		"user":        "tyk",
+		"url":         server.URL,
+		"private_key": string(keyPEM),
+		"database":    "analytics",
+		"batch_size":  2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{APIID: "1", ResponseCode: 200},
+		analytics.AnalyticsRecord{APIID: "2", ResponseCode: 500},
+		analytics.AnalyticsRecord{APIID: "3"},
+		analytics.AnalyticsRecord{APIID: "4"},
+		analytics.AnalyticsRecord{APIID: "5"},
+	}
+	failed, err := pump.WriteDataPartial(context.Background(), data)
+	if err == nil || !strings.Contains(err.Error(), "invalid value") {
+		t.Errorf("expected the error of the rejected batch, got %v", err)
+	}
+	if len(failed) != 2 || failed[0].(analytics.AnalyticsRecord).APIID != "3" {
+		t.Errorf("expected the records of the second batch to fail, got %v", failed)
+	}
+
+	if len(statements) != 3 {
+		t.Fatalf("expected a statement per batch of 2 records, got %d", len(statements))
+	}
+	first := statements[0]
+	if !strings.HasPrefix(first.Statement, "INSERT INTO TYK_ANALYTICS (timestamp, org_id") || first.Database != "analytics" {
+		t.Errorf("unexpected statement %+v", first)
+	}
+	apiIDs := first.Bindings["3"].Value.([]interface{})
+	codes := first.Bindings["13"]
+	if len(apiIDs) != 2 || apiIDs[1] != "2" || codes.Type != "FIXED" || codes.Value.([]interface{})[1] != "500" {
+		t.Errorf("expected the values of the records bound by column, got %v", first.Bindings)
+	}
+}
+
+func TestSnowflakeExecutePolling(t *testing.T) {
+	defer func(interval time.Duration) { snowflakePollInterval = interval }(snowflakePollInterval)
+	snowflakePollInterval = time.Millisecond
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"statementHandle":"handle-1","message":"Asynchronous execution in progress."}`))
+		case r.URL.Path != snowflakeStatementsPath+"/handle-1":
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		case polls < 2:
+			polls++
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"statementHandle":"handle-1"}`))
+		default:
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"message":"NULL result in a non-nullable column"}`))
+		}
+	}))
+	defer server.Close()
+
+	pump := &SnowflakePump{
+		conf:   &SnowflakeConf{Account: "account", User: "tyk", URL: server.URL},
+		key:    key,
+		client: server.Client(),
+	}
+	err = pump.execute(context.Background(), "INSERT INTO TYK_ANALYTICS VALUES (NULL)", nil)
+	if err == nil || !strings.Contains(err.Error(), "non-nullable") {
+		t.Errorf("expected the error of the completed statement, got %v", err)
+	}
+	if polls != 2 {
+		t.Errorf("expected the running statement to be polled until it completes, got %d polls", polls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	polls = 0
+	if err := pump.execute(ctx, "INSERT INTO TYK_ANALYTICS VALUES (NULL)", nil); err == nil {
+		t.Error("expected the polling to stop at the deadline")
+	}
+}
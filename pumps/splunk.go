@@ -6,33 +6,211 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
-	"github.com/mitchellh/mapstructure"
-
+	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-pump/analytics"
 )
 
 const (
 	defaultPath      = "/services/collector/event/1.0"
+	defaultRawPath   = "/services/collector/raw/1.0"
 	authHeaderName   = "authorization"
 	authHeaderPrefix = "Splunk "
 	splunkPumpPrefix = "splunk-pump"
 	splunkPumpName   = "Splunk Pump"
 	splunkDefaultENV = PUMPS_ENV_PREFIX + "_SPLUNK" + PUMPS_ENV_META_PREFIX
+
+	defaultSplunkUptimeSourceType = "tyk:uptime"
+
+	defaultSplunkMaxRetries          = 3
+	defaultSplunkTokenReloadInterval = 60
+	defaultSplunkTokenGracePeriod    = 300
+
+	// splunkTimeStampField is the name the record timestamp has in the events, kept from the first versions of the pump
+	splunkTimeStampField = "time_stamp"
+
+	// splunkEnvelopeHEC wraps the events in the envelope of the HTTP Event Collector
+	splunkEnvelopeHEC = "hec"
+	// splunkEnvelopeFlat adds the time, sourcetype and index to the fields of the events
+	splunkEnvelopeFlat = "flat"
+	// splunkEnvelopeNone sends the fields of the events alone
+	splunkEnvelopeNone = "none"
 )
 
 var (
 	errInvalidSettings = errors.New("Empty settings")
+
+	// splunkRetryBackoff is how long to wait before the first retry, doubled at every retry
+	splunkRetryBackoff = time.Second
 )
 
+// defaultSplunkFields are the record fields of the events when no fields are configured
+var defaultSplunkFields = []string{
+	"method", "path", "response_code", "api_key", splunkTimeStampField, "api_version", "api_name", "api_id", "org_id",
+	"oauth_id", "raw_request", "request_time", "raw_response", "ip_address", "error_class", "tags", "alias",
+	"latency.total", "latency.upstream", "content_length", "response_content_length", "user_agent", "trace_id", "span_id",
+	"correlation_id", "response_headers", "body_fields",
+}
+
+// splunkRecordField returns the name of the record field of an event field
+func splunkRecordField(field string) string {
+	if field == splunkTimeStampField {
+		return "timestamp"
+	}
+	return field
+}
+
+// splunkFields returns the fields of the events of the configuration, the configured or default ones with the extra
+// ones and without the excluded ones, nor the ones the pump fields selection leaves out. The unknown fields are
+// skipped with a warning.
+func splunkFields(conf *SplunkPumpConfig, selection analytics.FieldSelection, log *logrus.Entry) []string {
+	base := conf.Fields
+	if len(base) == 0 {
+		base = defaultSplunkFields
+	}
+
+	excluded := make(map[string]bool, len(conf.ExcludeFields))
+	for _, field := range conf.ExcludeFields {
+		excluded[field] = true
+	}
+	fields := []string{}
+	for _, field := range append(append([]string{}, base...), conf.ExtraFields...) {
+		if !analytics.IsRecordField(splunkRecordField(field)) {
+			log.Warningf("Skipping the unknown field %q", field)
+			continue
+		}
+		if !excluded[field] && selection.Selects(splunkRecordField(field)) && !contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// splunkTemplateFuncs are the functions of the event templates
+var splunkTemplateFuncs = template.FuncMap{
+	// json encodes the value in JSON, to write strings and lists in the events
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+// splunkError is an error response of the HTTP Event Collector
+type splunkError struct {
+	status int
+	// code and text are the status of the collector in the response, code is -1 when it has none
+	code int
+	text string
+}
+
+func (e *splunkError) Error() string {
+	if e.code < 0 {
+		return fmt.Sprintf("splunk responded with status %d: %s", e.status, e.text)
+	}
+	return fmt.Sprintf("splunk responded with status %d: %s (code %d)", e.status, e.text, e.code)
+}
+
+// checkSplunkResponse returns the error of the response of the collector, if any, closing it
+func checkSplunkResponse(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusMultipleChoices {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	status := struct {
+		Text string `json:"text"`
+		Code *int   `json:"code"`
+	}{}
+	if err := json.Unmarshal(body, &status); err != nil || status.Code == nil {
+		return &splunkError{status: resp.StatusCode, code: -1, text: strings.TrimSpace(string(body))}
+	}
+	return &splunkError{status: resp.StatusCode, code: *status.Code, text: status.Text}
+}
+
+// classifySplunkError returns whether sending an event again may succeed after err, and the reason the event is
+// dropped for otherwise
+func classifySplunkError(err error) (retryable bool, reason string) {
+	hecErr, ok := err.(*splunkError)
+	if !ok {
+		// the collector couldn't be reached
+		return true, DroppedUnavailable
+	}
+	switch {
+	case hecErr.status == http.StatusTooManyRequests || hecErr.status >= http.StatusInternalServerError ||
+		hecErr.code == 8 || hecErr.code == 9:
+		// internal server error or server busy
+		return true, DroppedUnavailable
+	case hecErr.status == http.StatusRequestEntityTooLarge:
+		return false, DroppedTooLarge
+	}
+	return false, DroppedRejected
+}
+
+// splunkErrorMessage describes the rejection of an event by the collector with err
+func splunkErrorMessage(err error) string {
+	hecErr, ok := err.(*splunkError)
+	switch {
+	case !ok:
+		return "Couldn't reach the collector"
+	case hecErr.code >= 1 && hecErr.code <= 4 || hecErr.status == http.StatusUnauthorized || hecErr.status == http.StatusForbidden:
+		return "The collector rejected the token, check collector_token"
+	case hecErr.code == 7:
+		return "The collector rejected the index, check the indexes allowed for the token"
+	case hecErr.status == http.StatusRequestEntityTooLarge:
+		return "The event is larger than the maximum of the collector"
+	case hecErr.code == 9 || hecErr.status == http.StatusServiceUnavailable || hecErr.status == http.StatusTooManyRequests:
+		return "The collector is busy"
+	case hecErr.status >= http.StatusInternalServerError:
+		return "The collector failed"
+	}
+	return "The collector rejected the event"
+}
+
+// splunkWriteError is the error of a write, with how many records failed by drop reason
+type splunkWriteError struct {
+	error
+	reasons map[string]int
+}
+
+func (e *splunkWriteError) DropReasons() map[string]int {
+	return e.reasons
+}
+
 // SplunkClient contains Splunk client methods.
 type SplunkClient struct {
 	Token         string
 	CollectorURL  string
 	TLSSkipVerify bool
+	// TokenHeader and TokenPrefix are the header the token is sent in and the prefix of its value
+	TokenHeader string
+	TokenPrefix string
+	// Envelope is the shape of the events, hec, flat or none
+	Envelope string
+	// TimeField and EventField are the keys of the time and of the event in the envelope
+	TimeField  string
+	EventField string
+	// Raw sends the events as raw lines, formatted with RawFormat or in JSON without it
+	Raw       bool
+	RawFormat *template.Template
+	// TokenFile is the file the token is reloaded from every TokenReloadInterval. After a rotation, the events
+	// rejected with the new token are sent again with the previous one for TokenGracePeriod.
+	TokenFile           string
+	TokenReloadInterval time.Duration
+	TokenGracePeriod    time.Duration
+
+	tokenMu             sync.Mutex
+	nextTokenReload     time.Time
+	previousToken       string
+	previousTokenExpiry time.Time
 
 	httpClient *http.Client
 }
@@ -58,42 +236,195 @@ func NewSplunkClient(token string, collectorURL string, skipVerify bool, certFil
 		}
 		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, ServerName: serverName}
 	}
+	ApplyTLSDefaults(tlsConfig)
 	http.DefaultClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	return newSplunkClient(token, u, http.DefaultClient), nil
+}
+
+// newSplunkClient returns the client of the collector sending the events with httpClient
+func newSplunkClient(token string, u *url.URL, httpClient *http.Client) *SplunkClient {
 	// Append the default collector API path:
 	u.Path = defaultPath
-	c = &SplunkClient{
+	return &SplunkClient{
 		Token:        token,
 		CollectorURL: u.String(),
-		httpClient:   http.DefaultClient,
+		TokenHeader:  authHeaderName,
+		TokenPrefix:  authHeaderPrefix,
+		Envelope:     splunkEnvelopeHEC,
+		TimeField:    "time",
+		EventField:   "event",
+		httpClient:   httpClient,
 	}
-	return c, nil
+}
+
+// splunkEvent is the envelope of an event sent to the HTTP Event Collector
+type splunkEvent struct {
+	Time       int64                  `json:"time"`
+	SourceType string                 `json:"sourcetype,omitempty"`
+	Index      string                 `json:"index,omitempty"`
+	Event      map[string]interface{} `json:"event"`
 }
 
 // Send sends an event to the Splunk HTTP Event Collector interface.
 func (c *SplunkClient) Send(ctx context.Context, event map[string]interface{}, ts time.Time) (*http.Response, error) {
-	eventWrap := struct {
-		Time  int64                  `json:"time"`
-		Event map[string]interface{} `json:"event"`
-	}{Event: event}
-	eventWrap.Time = ts.Unix()
-	eventJSON, err := json.Marshal(eventWrap)
+	return c.send(ctx, splunkEvent{Time: ts.Unix(), Event: event})
+}
+
+func (c *SplunkClient) send(ctx context.Context, eventWrap splunkEvent) (*http.Response, error) {
+	body, err := c.body(eventWrap)
 	if err != nil {
 		return nil, err
 	}
-	reader := bytes.NewReader(eventJSON)
-	req, err := http.NewRequest("POST", c.CollectorURL, reader)
+	if c.Raw {
+		return c.sendRaw(ctx, eventWrap, body)
+	}
+	return c.post(ctx, c.CollectorURL, body)
+}
+
+// body returns the body the event is sent with: its line when the events are raw, its envelope in JSON otherwise
+func (c *SplunkClient) body(eventWrap splunkEvent) ([]byte, error) {
+	if !c.Raw {
+		return json.Marshal(c.envelope(eventWrap))
+	}
+	if c.RawFormat == nil {
+		return json.Marshal(eventWrap.Event)
+	}
+	var buf bytes.Buffer
+	if err := c.RawFormat.Execute(&buf, eventWrap.Event); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sendRaw sends the line of the event to the raw endpoint, with its sourcetype and index as query parameters
+func (c *SplunkClient) sendRaw(ctx context.Context, eventWrap splunkEvent, line []byte) (*http.Response, error) {
+	u, err := url.Parse(c.CollectorURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	if eventWrap.SourceType != "" {
+		query.Set("sourcetype", eventWrap.SourceType)
+	}
+	if eventWrap.Index != "" {
+		query.Set("index", eventWrap.Index)
+	}
+	u.RawQuery = query.Encode()
+	return c.post(ctx, u.String(), line)
+}
+
+func (c *SplunkClient) post(ctx context.Context, collectorURL string, body []byte) (*http.Response, error) {
+	reader := bytes.NewReader(body)
+	req, err := http.NewRequest("POST", collectorURL, reader)
 	if err != nil {
 		return nil, err
 	}
 	req = req.WithContext(ctx)
-	req.Header.Add(authHeaderName, authHeaderPrefix+c.Token)
+	token, previousToken := c.tokens(time.Now())
+	req.Header.Add(c.TokenHeader, c.TokenPrefix+token)
+	resp, err := c.httpClient.Do(req)
+	if err != nil || previousToken == "" ||
+		(resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) {
+		return resp, err
+	}
+
+	// the new token may not be active yet, the previous one is still accepted during the grace period
+	resp.Body.Close()
+	req, err = http.NewRequest("POST", collectorURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add(c.TokenHeader, c.TokenPrefix+previousToken)
 	return c.httpClient.Do(req)
 }
 
+// tokens returns the token and, during the grace period of a rotation, the previous one
+func (c *SplunkClient) tokens(now time.Time) (string, string) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	if c.previousToken != "" && now.Before(c.previousTokenExpiry) {
+		return c.Token, c.previousToken
+	}
+	return c.Token, ""
+}
+
+// reloadToken reads the token from TokenFile once the reload interval has passed, keeping the previous token for the
+// grace period when it changed
+func (c *SplunkClient) reloadToken(now time.Time) error {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	if c.TokenFile == "" || now.Before(c.nextTokenReload) {
+		return nil
+	}
+	c.nextTokenReload = now.Add(c.TokenReloadInterval)
+
+	token, err := readSplunkToken(c.TokenFile)
+	if err != nil {
+		return err
+	}
+	if token != c.Token {
+		c.previousToken, c.previousTokenExpiry = c.Token, now.Add(c.TokenGracePeriod)
+		c.Token = token
+	}
+	return nil
+}
+
+// readSplunkToken reads the token from the file, ignoring the surrounding spaces
+func readSplunkToken(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+	return token, nil
+}
+
+// envelope returns the event in the envelope of the client
+func (c *SplunkClient) envelope(eventWrap splunkEvent) interface{} {
+	switch c.Envelope {
+	case splunkEnvelopeNone:
+		return eventWrap.Event
+	case splunkEnvelopeFlat:
+		flat := make(map[string]interface{}, len(eventWrap.Event)+3)
+		for field, value := range eventWrap.Event {
+			flat[field] = value
+		}
+		flat[c.TimeField] = eventWrap.Time
+		if eventWrap.SourceType != "" {
+			flat["sourcetype"] = eventWrap.SourceType
+		}
+		if eventWrap.Index != "" {
+			flat["index"] = eventWrap.Index
+		}
+		return flat
+	}
+	if c.TimeField == "time" && c.EventField == "event" {
+		return eventWrap
+	}
+	envelope := map[string]interface{}{c.TimeField: eventWrap.Time, c.EventField: eventWrap.Event}
+	if eventWrap.SourceType != "" {
+		envelope["sourcetype"] = eventWrap.SourceType
+	}
+	if eventWrap.Index != "" {
+		envelope["index"] = eventWrap.Index
+	}
+	return envelope
+}
+
 // SplunkPump is a Tyk Pump driver for Splunk.
 type SplunkPump struct {
-	client *SplunkClient
-	config *SplunkPumpConfig
+	client        *SplunkClient
+	config        *SplunkPumpConfig
+	eventTemplate *template.Template
+	// fields are the record fields of the events, the configured or default ones with the extra ones and without the
+	// excluded ones
+	fields []string
 	CommonPumpConfig
 }
 
@@ -109,6 +440,43 @@ type SplunkPumpConfig struct {
 	ObfuscateAPIKeys       bool     `mapstructure:"obfuscate_api_keys"`
 	ObfuscateAPIKeysLength int      `mapstructure:"obfuscate_api_keys_length"`
 	Fields                 []string `mapstructure:"fields"`
+	UptimeSourceType       string   `mapstructure:"uptime_sourcetype"`
+	UptimeIndex            string   `mapstructure:"uptime_index"`
+	// CollectorPath replaces the path of the collector, /services/collector/event/1.0 by default, to send the events to
+	// HEC-compatible receivers like Cribl Stream
+	CollectorPath string `mapstructure:"collector_path"`
+	// TokenHeader is the header of the token, authorization by default, and TokenPrefix the prefix of its value,
+	// "Splunk " by default with the authorization header and none with other headers
+	TokenHeader string `mapstructure:"token_header"`
+	TokenPrefix string `mapstructure:"token_prefix"`
+	// Envelope is the shape of the events: hec (the default) wraps them in the HEC envelope, flat adds the time,
+	// sourcetype and index to their fields, and none sends their fields alone
+	Envelope string `mapstructure:"envelope"`
+	// TimeField and EventField are the keys of the time and the event in the envelope, time and event by default
+	TimeField  string `mapstructure:"time_field"`
+	EventField string `mapstructure:"event_field"`
+	// Raw sends the events to the raw endpoint, /services/collector/raw/1.0 unless CollectorPath is set, as lines
+	// formatted with RawFormat, a Go template of the event fields, or in JSON without it
+	Raw       bool   `mapstructure:"raw"`
+	RawFormat string `mapstructure:"raw_format"`
+	// CollectorTokenFile is a file the collector token is read from, instead of CollectorToken, and reloaded every
+	// TokenReloadInterval seconds, 60 by default. After a rotation, the events rejected with the new token are sent
+	// again with the previous one for TokenGracePeriod seconds, 300 by default.
+	CollectorTokenFile  string `mapstructure:"collector_token_file"`
+	TokenReloadInterval int    `mapstructure:"token_reload_interval"`
+	TokenGracePeriod    int    `mapstructure:"token_grace_period"`
+	// MaxRetries is how many times an event is sent again when the collector is busy, fails or can't be reached, 3
+	// by default. -1 disables the retries.
+	MaxRetries int `mapstructure:"max_retries"`
+	// EventTemplate is a text/template template executed on the record producing the event as a JSON object,
+	// replacing Fields. The json function encodes a value in JSON, like {"api": {{json .APIName}}}.
+	EventTemplate string `mapstructure:"event_template"`
+	// TLS configures the connections to the collector, the ssl_ options are used for the settings it leaves unset
+	TLS TLSConf `mapstructure:"tls"`
+	// ExtraFields are added to the fields of the events, and ExcludeFields removed from them, to adjust the default
+	// fields without listing them all
+	ExtraFields   []string `mapstructure:"extra_fields"`
+	ExcludeFields []string `mapstructure:"exclude_fields"`
 }
 
 // New initializes a new pump.
@@ -128,103 +496,276 @@ func (p *SplunkPump) GetEnvPrefix() string {
 // Init performs the initialization of the SplunkClient.
 func (p *SplunkPump) Init(config interface{}) error {
 	p.config = &SplunkPumpConfig{}
-	p.log = log.WithField("prefix", splunkPumpPrefix)
+	p.log = p.newLogger(splunkPumpPrefix)
 
-	err := mapstructure.Decode(config, p.config)
+	err := decodePumpConfig(p, p.log, config, p.config)
 	if err != nil {
 		return err
 	}
 
 	processPumpEnvVars(p, p.log, p.config, splunkDefaultENV)
 
+	if p.config.UptimeSourceType == "" {
+		p.config.UptimeSourceType = defaultSplunkUptimeSourceType
+	}
+	if p.config.MaxRetries == 0 {
+		p.config.MaxRetries = defaultSplunkMaxRetries
+	}
+	p.fields = splunkFields(p.config, p.fieldSelection, p.log)
+	if p.config.EventTemplate != "" {
+		if p.eventTemplate, err = template.New("event_template").Funcs(splunkTemplateFuncs).Parse(p.config.EventTemplate); err != nil {
+			return fmt.Errorf("invalid event_template: %v", err)
+		}
+	}
+
+	if p.config.CollectorTokenFile != "" {
+		if p.config.CollectorToken, err = readSplunkToken(p.config.CollectorTokenFile); err != nil {
+			return fmt.Errorf("couldn't read the collector token: %v", err)
+		}
+	}
+
 	p.log.Infof("%s Endpoint: %s", splunkPumpName, p.config.CollectorURL)
 
-	p.client, err = NewSplunkClient(p.config.CollectorToken, p.config.CollectorURL, p.config.SSLInsecureSkipVerify, p.config.SSLCertFile, p.config.SSLKeyFile, p.config.SSLServerName)
+	if p.config.TLS.IsSet() {
+		p.client, err = p.newTLSClient()
+	} else {
+		p.client, err = NewSplunkClient(p.config.CollectorToken, p.config.CollectorURL, p.config.SSLInsecureSkipVerify, p.config.SSLCertFile, p.config.SSLKeyFile, p.config.SSLServerName)
+	}
 	if err != nil {
 		return err
 	}
+	if err := p.configureClient(); err != nil {
+		return err
+	}
 
 	p.log.Info(p.GetName() + " Initialized")
 
 	return nil
 }
 
+// newTLSClient returns the client of the collector with the tls block, completed with the ssl_ options. Unlike the
+// ssl_ options, it doesn't require a client certificate to verify the collector.
+func (p *SplunkPump) newTLSClient() (*SplunkClient, error) {
+	if p.config.CollectorToken == "" || p.config.CollectorURL == "" {
+		return nil, errInvalidSettings
+	}
+	u, err := url.Parse(p.config.CollectorURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := p.config.TLS.withLegacy(TLSConf{
+		CertFile:           p.config.SSLCertFile,
+		KeyFile:            p.config.SSLKeyFile,
+		ServerName:         p.config.SSLServerName,
+		InsecureSkipVerify: p.config.SSLInsecureSkipVerify,
+	}).ClientConfig("")
+	if err != nil {
+		return nil, fmt.Errorf("invalid tls configuration: %v", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return newSplunkClient(p.config.CollectorToken, u, &http.Client{Transport: transport}), nil
+}
+
+// configureClient sets the collector path, the token header and the envelope of the configuration on the client
+func (p *SplunkPump) configureClient() error {
+	collectorPath := p.config.CollectorPath
+	if collectorPath == "" && p.config.Raw {
+		collectorPath = defaultRawPath
+	}
+	if collectorPath != "" {
+		u, err := url.Parse(p.client.CollectorURL)
+		if err != nil {
+			return err
+		}
+		u.Path = collectorPath
+		p.client.CollectorURL = u.String()
+	}
+
+	if p.config.CollectorTokenFile != "" {
+		if p.config.TokenReloadInterval <= 0 {
+			p.config.TokenReloadInterval = defaultSplunkTokenReloadInterval
+		}
+		if p.config.TokenGracePeriod <= 0 {
+			p.config.TokenGracePeriod = defaultSplunkTokenGracePeriod
+		}
+		p.client.TokenFile = p.config.CollectorTokenFile
+		p.client.TokenReloadInterval = time.Duration(p.config.TokenReloadInterval) * time.Second
+		p.client.TokenGracePeriod = time.Duration(p.config.TokenGracePeriod) * time.Second
+		p.client.nextTokenReload = time.Now().Add(p.client.TokenReloadInterval)
+	}
+
+	p.client.Raw = p.config.Raw
+	if p.config.RawFormat != "" {
+		rawFormat, err := template.New("raw_format").Parse(p.config.RawFormat)
+		if err != nil {
+			return fmt.Errorf("invalid raw_format: %v", err)
+		}
+		p.client.RawFormat = rawFormat
+	}
+
+	if p.config.TokenHeader != "" {
+		p.client.TokenHeader, p.client.TokenPrefix = p.config.TokenHeader, p.config.TokenPrefix
+	} else if p.config.TokenPrefix != "" {
+		p.client.TokenPrefix = p.config.TokenPrefix
+	}
+
+	switch p.config.Envelope {
+	case "":
+	case splunkEnvelopeHEC, splunkEnvelopeFlat, splunkEnvelopeNone:
+		p.client.Envelope = p.config.Envelope
+	default:
+		return fmt.Errorf("unknown envelope %q, it must be hec, flat or none", p.config.Envelope)
+	}
+	if p.config.TimeField != "" {
+		p.client.TimeField = p.config.TimeField
+	}
+	if p.config.EventField != "" {
+		p.client.EventField = p.config.EventField
+	}
+	return nil
+}
+
 // WriteData prepares an appropriate data structure and sends it to the HTTP Event Collector.
 func (p *SplunkPump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := p.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial sends the records one by one, returning the ones Splunk didn't accept and the ones left unsent at
+// the deadline
+func (p *SplunkPump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
 	p.log.Debug("Attempting to write ", len(data), " records...")
+	if err := p.client.reloadToken(time.Now()); err != nil {
+		p.log.Error("Couldn't reload the collector token, the current one is kept: ", err)
+	}
+
+	failed := []interface{}{}
+	reasons := map[string]int{}
+	var lastErr error
+	for i, v := range data {
+		if err := ctx.Err(); err != nil {
+			return append(failed, data[i:]...), err
+		}
 
-	for _, v := range data {
 		decoded := v.(analytics.AnalyticsRecord)
-		apiKey := decoded.APIKey
-
-		// Check if the APIKey obfuscation is configured and its doable
-		if p.config.ObfuscateAPIKeys && len(apiKey) > p.config.ObfuscateAPIKeysLength {
-			// Obfuscate the APIKey, starting with 4 asterics and followed by last N chars (configured separately) of the APIKey
-			// The default value of the length is 0 so unless another number is configured, the APIKey will be fully hidden
-			apiKey = "****" + apiKey[len(apiKey)-p.config.ObfuscateAPIKeysLength:]
-		}
-
-		mapping := map[string]interface{}{
-			"method":         decoded.Method,
-			"host":           decoded.Host,
-			"path":           decoded.Path,
-			"raw_path":       decoded.RawPath,
-			"content_length": decoded.ContentLength,
-			"user_agent":     decoded.UserAgent,
-			"response_code":  decoded.ResponseCode,
-			"api_key":        apiKey,
-			"time_stamp":     decoded.TimeStamp,
-			"api_version":    decoded.APIVersion,
-			"api_name":       decoded.APIName,
-			"api_id":         decoded.APIID,
-			"org_id":         decoded.OrgID,
-			"oauth_id":       decoded.OauthID,
-			"raw_request":    decoded.RawRequest,
-			"request_time":   decoded.RequestTime,
-			"raw_response":   decoded.RawResponse,
-			"ip_address":     decoded.IPAddress,
-			"geo":            decoded.Geo,
-			"alias":          decoded.Alias,
-		}
-
-		// Define an empty event
-		event := make(map[string]interface{})
-
-		// Populate the Splunk event with the fields set in the config
-		if len(p.config.Fields) > 0 {
-			// Loop through all fields set in the pump config
-			for _, field := range p.config.Fields {
-				// Skip the next actions in case the configured field doesn't exist
-				if _, ok := mapping[field]; !ok {
-					continue
-				}
-
-				// Adding field value
-				event[field] = mapping[field]
-			}
-		} else {
-			// Set the default event fields
-			event = map[string]interface{}{
-				"method":        decoded.Method,
-				"path":          decoded.Path,
-				"response_code": decoded.ResponseCode,
-				"api_key":       apiKey,
-				"time_stamp":    decoded.TimeStamp,
-				"api_version":   decoded.APIVersion,
-				"api_name":      decoded.APIName,
-				"api_id":        decoded.APIID,
-				"org_id":        decoded.OrgID,
-				"oauth_id":      decoded.OauthID,
-				"raw_request":   decoded.RawRequest,
-				"request_time":  decoded.RequestTime,
-				"raw_response":  decoded.RawResponse,
-				"ip_address":    decoded.IPAddress,
+		event, err := p.event(decoded)
+		if err != nil {
+			p.log.Error("Couldn't build the event of ", decoded.APIID, " record: ", err)
+			failed = append(failed, v)
+			reasons[DroppedSerialization]++
+			lastErr = err
+			continue
+		}
+
+		if err := p.sendEvent(ctx, event, decoded.TimeStamp); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return append(failed, data[i:]...), ctxErr
 			}
+			_, reason := classifySplunkError(err)
+			p.log.WithField("reason", reason).Error(splunkErrorMessage(err), ", couldn't write ", decoded.APIID, " record: ", err)
+			failed = append(failed, v)
+			reasons[reason]++
+			lastErr = err
 		}
+	}
 
-		p.client.Send(ctx, event, decoded.TimeStamp)
+	if len(failed) > 0 {
+		return failed, &splunkWriteError{
+			error:   fmt.Errorf("failed to write %d of %d records: %v", len(failed), len(data), lastErr),
+			reasons: reasons,
+		}
 	}
 	p.log.Info("Purged ", len(data), " records...")
 
-	return nil
+	return nil, nil
+}
+
+// event returns the event of the record, built with the event template or made of the configured fields
+func (p *SplunkPump) event(record analytics.AnalyticsRecord) (map[string]interface{}, error) {
+	// Check if the APIKey obfuscation is configured and its doable
+	if p.config.ObfuscateAPIKeys && len(record.APIKey) > p.config.ObfuscateAPIKeysLength {
+		// Obfuscate the APIKey, starting with 4 asterics and followed by last N chars (configured separately) of the APIKey
+		// The default value of the length is 0 so unless another number is configured, the APIKey will be fully hidden
+		record.APIKey = "****" + record.APIKey[len(record.APIKey)-p.config.ObfuscateAPIKeysLength:]
+	}
+
+	event := make(map[string]interface{})
+	if p.eventTemplate != nil {
+		var buf bytes.Buffer
+		if err := p.eventTemplate.Execute(&buf, record); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("the event template didn't produce a JSON object: %v", err)
+		}
+		return event, nil
+	}
+
+	fields := p.fields
+	if fields == nil {
+		fields = defaultSplunkFields
+	}
+	for _, field := range fields {
+		event[field], _ = record.Field(splunkRecordField(field))
+	}
+	return event, nil
+}
+
+// Preview returns the body the event of the record would be sent with
+func (p *SplunkPump) Preview(record analytics.AnalyticsRecord) ([]byte, error) {
+	event, err := p.event(record)
+	if err != nil {
+		return nil, err
+	}
+	return p.client.body(splunkEvent{Time: record.TimeStamp.Unix(), Event: event})
+}
+
+// sendEvent sends the event, retrying up to max_retries times while the collector is busy, fails or can't be reached
+func (p *SplunkPump) sendEvent(ctx context.Context, event map[string]interface{}, ts time.Time) error {
+	backoff := splunkRetryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := p.client.Send(ctx, event, ts)
+		if err == nil {
+			err = checkSplunkResponse(resp)
+		}
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if retryable, _ := classifySplunkError(err); !retryable || attempt >= p.config.MaxRetries {
+			return err
+		}
+
+		p.log.Warning(splunkErrorMessage(err), ", retrying: ", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// WriteUptimeData sends the uptime reports of the Gateway host checker with the uptime sourcetype and index
+func (p *SplunkPump) WriteUptimeData(data []interface{}) {
+	if err := p.client.reloadToken(time.Now()); err != nil {
+		p.log.Error("Couldn't reload the collector token, the current one is kept: ", err)
+	}
+	reports := decodeUptimeData(p.log, data)
+	for _, report := range reports {
+		resp, err := p.client.send(context.Background(), splunkEvent{
+			Time:       report.TimeStamp.Unix(),
+			SourceType: p.config.UptimeSourceType,
+			Index:      p.config.UptimeIndex,
+			Event:      uptimeMapping(report),
+		})
+		if err == nil {
+			err = checkSplunkResponse(resp)
+		}
+		if err != nil {
+			p.log.Error(splunkErrorMessage(err), ", couldn't write uptime data: ", err)
+		}
+	}
+	p.log.Debug("Purged ", len(reports), " uptime records...")
 }
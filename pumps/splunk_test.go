@@ -3,12 +3,20 @@ package pumps
 import (
 	"context"
 	"encoding/json"
+	"encoding/pem"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"text/template"
 	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-pump/analytics"
 )
 
 const (
@@ -89,3 +97,483 @@ func TestSplunkSend(t *testing.T) {
 		t.Fatalf("Bad status")
 	}
 }
+
+func TestSplunkSendEnvelope(t *testing.T) {
+	received := make(chan map[string]interface{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		envelope := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+			t.Error(err)
+		}
+		received <- envelope
+	}))
+	defer server.Close()
+	client, _ := NewSplunkClient(testToken, server.URL, true, "", "", "")
+
+	res, err := client.Send(context.TODO(), map[string]interface{}{"api_id": "123"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if envelope := <-received; envelope["sourcetype"] != nil || envelope["index"] != nil {
+		t.Errorf("the analytics events shouldn't have a sourcetype nor an index, got %v", envelope)
+	}
+
+	res, err = client.send(context.TODO(), splunkEvent{
+		Time:       time.Now().Unix(),
+		SourceType: defaultSplunkUptimeSourceType,
+		Index:      "uptime",
+		Event:      map[string]interface{}{"url": "http://upstream"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if envelope := <-received; envelope["sourcetype"] != "tyk:uptime" || envelope["index"] != "uptime" {
+		t.Errorf("unexpected uptime envelope %v", envelope)
+	}
+}
+
+func TestSplunkWriteDataTimeout(t *testing.T) {
+	release := make(chan struct{})
+	requests := make(chan struct{}, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client, _ := NewSplunkClient(testToken, server.URL, true, "", "", "")
+	pump := &SplunkPump{client: client, config: &SplunkPumpConfig{}}
+	pump.log = pump.newLogger(splunkPumpPrefix)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	data := []interface{}{analytics.AnalyticsRecord{APIID: "1"}, analytics.AnalyticsRecord{APIID: "2"}, analytics.AnalyticsRecord{APIID: "3"}}
+	if err := pump.WriteData(ctx, data); err != context.DeadlineExceeded {
+		t.Errorf("expected the write to stop at the deadline, got %v", err)
+	}
+	if len(requests) != 1 {
+		t.Errorf("expected the records after the deadline not to be sent, got %d requests", len(requests))
+	}
+}
+
+func TestSplunkWriteDataPartial(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), `"api_id":"2"`) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	client, _ := NewSplunkClient(testToken, server.URL, true, "", "", "")
+	pump := &SplunkPump{client: client, config: &SplunkPumpConfig{}}
+	pump.log = pump.newLogger(splunkPumpPrefix)
+
+	data := []interface{}{analytics.AnalyticsRecord{APIID: "1"}, analytics.AnalyticsRecord{APIID: "2"}, analytics.AnalyticsRecord{APIID: "3"}}
+	failed, err := WriteDataPartial(context.Background(), pump, data)
+	if err == nil {
+		t.Fatal("expected the rejected record to fail the write")
+	}
+	if len(failed) != 1 || failed[0].(analytics.AnalyticsRecord).APIID != "2" {
+		t.Errorf("expected only the rejected record to be reported, got %v", failed)
+	}
+}
+
+func TestSplunkHECCompatibleReceiver(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cribl/_bulk" {
+			t.Errorf("expected the configured path, got %s", r.URL.Path)
+		}
+		if r.Header.Get("X-Token") != testToken {
+			t.Errorf("expected the token in the configured header, got %q", r.Header.Get("X-Token"))
+		}
+		event := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer server.Close()
+
+	pump := &SplunkPump{}
+	err := pump.Init(map[string]interface{}{
+		"collector_token":          testToken,
+		"collector_url":            server.URL,
+		"ssl_insecure_skip_verify": true,
+		"collector_path":           "/cribl/_bulk",
+		"token_header":             "X-Token",
+		"envelope":                 "flat",
+		"time_field":               "_time",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := pump.WriteData(context.Background(), []interface{}{analytics.AnalyticsRecord{APIID: "1", TimeStamp: ts}}); err != nil {
+		t.Fatal(err)
+	}
+	event := <-received
+	if event["api_id"] != "1" || event["_time"] != float64(ts.Unix()) || event["event"] != nil {
+		t.Errorf("expected a flat event, got %v", event)
+	}
+
+	if err := pump.Init(map[string]interface{}{
+		"collector_token":          testToken,
+		"collector_url":            server.URL,
+		"ssl_insecure_skip_verify": true,
+		"envelope":                 "raw",
+	}); err == nil {
+		t.Error("expected an unknown envelope to fail")
+	}
+}
+
+func TestSplunkRaw(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	lines := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		lines <- string(body)
+	}))
+	defer server.Close()
+
+	pump := &SplunkPump{}
+	err := pump.Init(map[string]interface{}{
+		"collector_token":          testToken,
+		"collector_url":            server.URL,
+		"ssl_insecure_skip_verify": true,
+		"raw":                      true,
+		"raw_format":               `api_id={{.api_id}} method={{.method}} status={{.response_code}}`,
+		"uptime_index":             "uptime",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := analytics.AnalyticsRecord{APIID: "1", Method: "GET", ResponseCode: 200}
+	if err := pump.WriteData(context.Background(), []interface{}{record}); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-received; r.URL.Path != defaultRawPath || r.URL.RawQuery != "" {
+		t.Errorf("expected the raw endpoint, got %s", r.URL)
+	}
+	if line := <-lines; line != "api_id=1 method=GET status=200" {
+		t.Errorf("unexpected raw line %q", line)
+	}
+
+	res, err := pump.client.send(context.Background(), splunkEvent{
+		SourceType: defaultSplunkUptimeSourceType,
+		Index:      "uptime",
+		Event:      map[string]interface{}{"api_id": "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if r := <-received; r.URL.Query().Get("sourcetype") != "tyk:uptime" || r.URL.Query().Get("index") != "uptime" {
+		t.Errorf("expected the sourcetype and index as parameters, got %s", r.URL)
+	}
+	<-lines
+}
+
+func TestSplunkTokenRotation(t *testing.T) {
+	var mu sync.Mutex
+	accepted := map[string]bool{"Splunk old": true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !accepted[r.Header.Get("authorization")] {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "splunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	ioutil.WriteFile(tokenFile, []byte("old\n"), 0600)
+
+	pump := &SplunkPump{}
+	err = pump.Init(map[string]interface{}{
+		"collector_token_file":     tokenFile,
+		"collector_url":            server.URL,
+		"ssl_insecure_skip_verify": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []interface{}{analytics.AnalyticsRecord{APIID: "1"}}
+	if err := pump.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	// the token is rotated before the new one is active
+	ioutil.WriteFile(tokenFile, []byte("new\n"), 0600)
+	pump.client.nextTokenReload = time.Now()
+	if err := pump.WriteData(context.Background(), data); err != nil {
+		t.Fatalf("expected the previous token to be used in the grace period, got %v", err)
+	}
+	if pump.client.Token != "new" {
+		t.Errorf("expected the token to be reloaded, got %s", pump.client.Token)
+	}
+
+	mu.Lock()
+	accepted = map[string]bool{"Splunk new": true}
+	mu.Unlock()
+	pump.client.previousTokenExpiry = time.Now()
+	if err := pump.WriteData(context.Background(), data); err != nil {
+		t.Fatalf("expected the new token to be used, got %v", err)
+	}
+
+	mu.Lock()
+	accepted = map[string]bool{"Splunk old": true}
+	mu.Unlock()
+	if err := pump.WriteData(context.Background(), data); err == nil {
+		t.Error("expected the previous token not to be used after the grace period")
+	}
+}
+
+func TestSplunkWriteDataRetries(t *testing.T) {
+	splunkRetryBackoff = time.Millisecond
+	defer func() { splunkRetryBackoff = time.Second }()
+
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		event := splunkEvent{}
+		json.Unmarshal(body, &event)
+		apiID := event.Event["api_id"].(string)
+		attempts[apiID]++
+
+		switch apiID {
+		case "busy":
+			// busy until the last retry
+			if attempts[apiID] <= 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"text":"Server is busy","code":9}`))
+			}
+		case "unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"text":"Server is busy","code":9}`))
+		case "large":
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		case "invalid":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"text":"Invalid data format","code":6}`))
+		}
+	}))
+	defer server.Close()
+
+	client, _ := NewSplunkClient(testToken, server.URL, true, "", "", "")
+	pump := &SplunkPump{client: client, config: &SplunkPumpConfig{MaxRetries: 3}}
+	pump.log = pump.newLogger(splunkPumpPrefix)
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{APIID: "busy"},
+		analytics.AnalyticsRecord{APIID: "unavailable"},
+		analytics.AnalyticsRecord{APIID: "large"},
+		analytics.AnalyticsRecord{APIID: "invalid"},
+		analytics.AnalyticsRecord{APIID: "ok"},
+	}
+	failed, err := pump.WriteDataPartial(context.Background(), data)
+	if len(failed) != 3 {
+		t.Errorf("expected 3 failed records, got %v", failed)
+	}
+	if attempts["busy"] != 4 || attempts["unavailable"] != 4 || attempts["large"] != 1 || attempts["invalid"] != 1 {
+		t.Errorf("expected only the busy collector to be retried, got %v", attempts)
+	}
+
+	reasons, ok := err.(DropReasons)
+	if !ok {
+		t.Fatalf("expected the drop reasons of the failed records, got %v", err)
+	}
+	expected := map[string]int{DroppedUnavailable: 1, DroppedTooLarge: 1, DroppedRejected: 1}
+	for reason, n := range expected {
+		if reasons.DropReasons()[reason] != n {
+			t.Errorf("expected %d records dropped for %s, got %v", n, reason, reasons.DropReasons())
+		}
+	}
+}
+
+func TestCheckSplunkResponse(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	recorder.WriteHeader(http.StatusForbidden)
+	recorder.Write([]byte(`{"text":"Invalid token","code":4}`))
+	err := checkSplunkResponse(recorder.Result())
+	hecErr, ok := err.(*splunkError)
+	if !ok || hecErr.code != 4 || hecErr.text != "Invalid token" {
+		t.Fatalf("expected the status of the collector, got %v", err)
+	}
+	if retryable, reason := classifySplunkError(err); retryable || reason != DroppedRejected {
+		t.Errorf("expected an invalid token to be fatal, got %v %s", retryable, reason)
+	}
+	if !strings.Contains(splunkErrorMessage(err), "token") {
+		t.Errorf("expected the token to be blamed, got %s", splunkErrorMessage(err))
+	}
+
+	recorder = httptest.NewRecorder()
+	recorder.WriteHeader(http.StatusOK)
+	if err := checkSplunkResponse(recorder.Result()); err != nil {
+		t.Errorf("expected a successful response, got %v", err)
+	}
+}
+
+func TestSplunkEvent(t *testing.T) {
+	record := analytics.AnalyticsRecord{
+		APIID:     "1",
+		APIName:   "Petstore \"v2\"",
+		APIKey:    "0123456789",
+		TimeStamp: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		Latency:   analytics.Latency{Total: 30, Upstream: 20},
+		Tags:      []string{"key-1", "org-1"},
+	}
+	record.Geo.Country.ISOCode = "BG"
+
+	pump := &SplunkPump{}
+	err := pump.Init(map[string]interface{}{
+		"collector_token":           testToken,
+		"collector_url":             testEndpointURL,
+		"ssl_insecure_skip_verify":  true,
+		"obfuscate_api_keys":        true,
+		"obfuscate_api_keys_length": 4,
+		"fields":                    []string{"api_id", "api_key", "time_stamp", "latency.total", "geo.country.iso_code", "tags"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := pump.event(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event["api_id"] != "1" || event["api_key"] != "****6789" || event["time_stamp"] != record.TimeStamp ||
+		event["latency.total"] != int64(30) || event["geo.country.iso_code"] != "BG" || len(event["tags"].([]string)) != 2 {
+		t.Errorf("expected the values of the record fields, got %v", event)
+	}
+
+	err = pump.Init(map[string]interface{}{
+		"collector_token":          testToken,
+		"collector_url":            testEndpointURL,
+		"ssl_insecure_skip_verify": true,
+		"event_template":           `{"api": {{json .APIName}}, "upstream_latency": {{.Latency.Upstream}}, "tags": {{json .Tags}}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event, err = pump.event(record); err != nil {
+		t.Fatal(err)
+	}
+	if event["api"] != record.APIName || event["upstream_latency"] != float64(20) || len(event["tags"].([]interface{})) != 2 {
+		t.Errorf("unexpected templated event %v", event)
+	}
+
+	err = pump.Init(map[string]interface{}{
+		"collector_token":          testToken,
+		"collector_url":            testEndpointURL,
+		"ssl_insecure_skip_verify": true,
+		"fields":                   []string{"api_id", "unknown"},
+	})
+	if err != nil || len(pump.fields) != 1 || pump.fields[0] != "api_id" {
+		t.Errorf("expected the unknown field to be skipped, got %v %v", pump.fields, err)
+	}
+}
+
+func TestSplunkFields(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	fields := splunkFields(&SplunkPumpConfig{
+		ExtraFields:   []string{"geo.country.iso_code", "tags"},
+		ExcludeFields: []string{"raw_request", "raw_response"},
+	}, analytics.FieldSelection{}, log)
+	if len(fields) != len(defaultSplunkFields)-1 || contains(fields, "raw_request") || fields[len(fields)-1] != "geo.country.iso_code" {
+		t.Errorf("expected the default fields adjusted, got %v", fields)
+	}
+
+	fields = splunkFields(&SplunkPumpConfig{Fields: []string{"api_id"}, ExtraFields: []string{"alias"}}, analytics.FieldSelection{}, log)
+	if len(fields) != 2 || fields[1] != "alias" {
+		t.Errorf("expected the extra fields to be added to the configured ones, got %v", fields)
+	}
+
+	fields = splunkFields(&SplunkPumpConfig{Fields: []string{"api_id"}, ExtraFields: []string{"unknown"}}, analytics.FieldSelection{}, log)
+	if len(fields) != 1 || fields[0] != "api_id" {
+		t.Errorf("expected the unknown field to be skipped, got %v", fields)
+	}
+	fields = splunkFields(&SplunkPumpConfig{ExtraFields: []string{"geo.country.iso_code"}}, analytics.FieldSelection{
+		Include: []string{"api_id", "path", "geo", "raw_request"},
+		Exclude: []string{"raw_request"},
+	}, log)
+	if len(fields) != 3 || fields[2] != "geo.country.iso_code" {
+		t.Errorf("expected only the selected fields, got %v", fields)
+	}
+}
+
+func TestSplunkTLS(t *testing.T) {
+	received := make(chan struct{}, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "splunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	pump := &SplunkPump{}
+	err = pump.Init(map[string]interface{}{
+		"collector_token": testToken,
+		"collector_url":   server.URL,
+		"tls": map[string]interface{}{
+			"ca_file":     caFile,
+			"min_version": "1.2",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pump.WriteData(context.Background(), []interface{}{analytics.AnalyticsRecord{APIID: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	if pump.client.httpClient == http.DefaultClient {
+		t.Error("expected the tls block not to use the default client")
+	}
+}
+
+func TestSplunkPreview(t *testing.T) {
+	pump := &SplunkPump{}
+	err := pump.Init(map[string]interface{}{
+		"collector_token":          testToken,
+		"collector_url":            testEndpointURL,
+		"ssl_insecure_skip_verify": true,
+		"fields":                   []interface{}{"api_id", "method"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := analytics.AnalyticsRecord{APIID: "1", Method: "GET", TimeStamp: time.Unix(1600000000, 0)}
+	payload, err := pump.Preview(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != `{"time":1600000000,"event":{"api_id":"1","method":"GET"}}` {
+		t.Errorf("unexpected envelope %s", payload)
+	}
+
+	pump.client.Raw = true
+	pump.client.RawFormat = template.Must(template.New("raw").Parse(`api_id={{.api_id}} method={{.method}}`))
+	if payload, err = pump.Preview(record); err != nil || string(payload) != "api_id=1 method=GET" {
+		t.Errorf("unexpected raw line %q: %v", payload, err)
+	}
+}
@@ -0,0 +1,123 @@
+package pumps
+
+import (
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// columnType is the type of a column of the analytics tables, mapped to a SQL type by every pump
+type columnType int
+
+const (
+	columnTimestamp columnType = iota
+	columnString
+	columnInteger
+)
+
+// analyticsColumn is a column of the analytics tables of the SQL warehouse pumps, with its value for a record: a
+// time.Time, string or int64 as per its type
+type analyticsColumn struct {
+	name       string
+	columnType columnType
+	value      func(r *analytics.AnalyticsRecord) interface{}
+}
+
+var analyticsColumns = []analyticsColumn{
+	{"timestamp", columnTimestamp, func(r *analytics.AnalyticsRecord) interface{} { return r.TimeStamp.UTC() }},
+	{"org_id", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.OrgID }},
+	{"api_id", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.APIID }},
+	{"api_name", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.APIName }},
+	{"api_version", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.APIVersion }},
+	{"api_key", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.APIKey }},
+	{"alias", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.Alias }},
+	{"oauth_id", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.OauthID }},
+	{"method", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.Method }},
+	{"host", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.Host }},
+	{"path", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.Path }},
+	{"raw_path", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.RawPath }},
+	{"response_code", columnInteger, func(r *analytics.AnalyticsRecord) interface{} { return int64(r.ResponseCode) }},
+	{"request_time", columnInteger, func(r *analytics.AnalyticsRecord) interface{} { return r.RequestTime }},
+	{"upstream_latency", columnInteger, func(r *analytics.AnalyticsRecord) interface{} { return r.Latency.Upstream }},
+	{"content_length", columnInteger, func(r *analytics.AnalyticsRecord) interface{} { return r.ContentLength }},
+	{"response_content_length", columnInteger, func(r *analytics.AnalyticsRecord) interface{} { return r.ResponseContentLength }},
+	{"user_agent", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.UserAgent }},
+	{"ip_address", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.IPAddress }},
+	{"geo_country", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.Geo.Country.ISOCode }},
+	{"error_class", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.ErrorClass }},
+	{"trace_id", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.TraceID }},
+	{"span_id", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.SpanID }},
+	{"correlation_id", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.CorrelationID }},
+	{"tags", columnString, func(r *analytics.AnalyticsRecord) interface{} { return strings.Join(r.Tags, ",") }},
+	{"raw_request", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.RawRequest }},
+	{"raw_response", columnString, func(r *analytics.AnalyticsRecord) interface{} { return r.RawResponse }},
+}
+
+// sqlCreateTable returns the CREATE TABLE IF NOT EXISTS statement of the analytics table, with the SQL types of the
+// column types and the given identifier quoting
+func sqlCreateTable(table string, types map[columnType]string, quote func(string) string) string {
+	columns := make([]string, len(analyticsColumns))
+	for i, column := range analyticsColumns {
+		columns[i] = quote(column.name) + " " + types[column.columnType]
+	}
+	return "CREATE TABLE IF NOT EXISTS " + table + " (" + strings.Join(columns, ", ") + ")"
+}
+
+// addedColumns are the columns added after the first version of the analytics table, which the tables created by a
+// previous version lack
+var addedColumns = []string{"trace_id", "span_id", "correlation_id"}
+
+// sqlAddColumns returns the ALTER TABLE statements adding the added columns to a table created by a previous version,
+// one per column as not every warehouse adds several at once. With ifNotExists, they do nothing when the table has the
+// columns, otherwise they fail with an error told by isColumnExistsError, for the warehouses without ADD COLUMN IF NOT
+// EXISTS.
+func sqlAddColumns(table string, types map[columnType]string, quote func(string) string, ifNotExists bool) []string {
+	addColumn := " ADD COLUMN "
+	if ifNotExists {
+		addColumn += "IF NOT EXISTS "
+	}
+	statements := make([]string, 0, len(addedColumns))
+	for _, name := range addedColumns {
+		for _, column := range analyticsColumns {
+			if column.name == name {
+				statements = append(statements, "ALTER TABLE "+table+addColumn+quote(name)+" "+types[column.columnType])
+			}
+		}
+	}
+	return statements
+}
+
+// isColumnExistsError returns whether the error is the one of adding a column the table already has
+func isColumnExistsError(err error) bool {
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "already exists") || strings.Contains(message, "duplicate column")
+}
+
+// sqlColumnList returns the list of the column names, in parentheses, with the given identifier quoting
+func sqlColumnList(quote func(string) string) string {
+	names := make([]string, len(analyticsColumns))
+	for i, column := range analyticsColumns {
+		names[i] = quote(column.name)
+	}
+	return "(" + strings.Join(names, ", ") + ")"
+}
+
+// sqlInsert returns the INSERT statement of a row of the analytics table, with the given parameter placeholders
+func sqlInsert(table string, quote func(string) string, param func(i int) string) string {
+	params := make([]string, len(analyticsColumns))
+	for i := range analyticsColumns {
+		params[i] = param(i)
+	}
+	return "INSERT INTO " + table + " " + sqlColumnList(quote) + " VALUES (" + strings.Join(params, ", ") + ")"
+}
+
+// unquoted leaves the identifiers as they are
+func unquoted(name string) string {
+	return name
+}
+
+// formatTimestamp formats the timestamp as the SQL warehouses parse it, without time zone
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.000000000")
+}
@@ -3,17 +3,21 @@ package pumps
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
 	"strings"
+	"text/template"
 	"time"
 
-	"github.com/mitchellh/mapstructure"
 	"github.com/quipo/statsd"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
 )
 
 type StatsdPump struct {
-	dbConf *StatsdConf
+	dbConf    *StatsdConf
+	templates map[string]*template.Template
 	CommonPumpConfig
 }
 
@@ -25,8 +29,41 @@ type StatsdConf struct {
 	Address   string   `mapstructure:"address"`
 	Fields    []string `mapstructure:"fields"`
 	Tags      []string `mapstructure:"tags"`
+	// MetricTemplates are the names of the metrics by field, as text/template templates executed on the record, like
+	// tyk.{{.APIName}}.{{.Method}}.{{.ResponseCode}}
+	MetricTemplates map[string]string `mapstructure:"metric_templates"`
+	// SampleRates are the rates, from 0 to 1, at which the records are sampled by metric type, timing or counter
+	SampleRates map[string]float64 `mapstructure:"sample_rates"`
 }
 
+const (
+	statsdTimingType  = "timing"
+	statsdCounterType = "counter"
+)
+
+type statsdField struct {
+	metricType string
+	value      func(record *analytics.AnalyticsRecord) int64
+}
+
+// statsdFields are the fields which can be sent as metrics
+var statsdFields = map[string]statsdField{
+	"request_time": {statsdTimingType, func(record *analytics.AnalyticsRecord) int64 {
+		return record.RequestTime
+	}},
+	"latency": {statsdTimingType, func(record *analytics.AnalyticsRecord) int64 {
+		return record.Latency.Total
+	}},
+	"upstream_latency": {statsdTimingType, func(record *analytics.AnalyticsRecord) int64 {
+		return record.Latency.Upstream
+	}},
+	"hits": {statsdCounterType, func(record *analytics.AnalyticsRecord) int64 {
+		return 1
+	}},
+}
+
+var statsdUnsafeChars = strings.NewReplacer(":", "_", "|", "_", "@", "_", " ", "_", "\n", "_")
+
 func (s *StatsdPump) New() Pump {
 	newPump := StatsdPump{}
 	return &newPump
@@ -42,15 +79,39 @@ func (s *StatsdPump) GetEnvPrefix() string {
 
 func (s *StatsdPump) Init(config interface{}) error {
 	s.dbConf = &StatsdConf{}
-	s.log = log.WithField("prefix", statsdPrefix)
+	s.log = s.newLogger(statsdPrefix)
 
-	err := mapstructure.Decode(config, &s.dbConf)
+	err := decodePumpConfig(s, s.log, config, &s.dbConf)
 	if err != nil {
 		s.log.Fatal("Failed to decode configuration: ", err)
 	}
 
 	processPumpEnvVars(s, s.log, s.dbConf, statsdDefaultENV)
 
+	for _, f := range s.dbConf.Fields {
+		if _, ok := statsdFields[f]; !ok {
+			s.log.Warning("Unsupported field ", f, ", it won't be sent")
+		}
+	}
+
+	s.templates = make(map[string]*template.Template)
+	for f, metricTemplate := range s.dbConf.MetricTemplates {
+		tmpl, err := template.New(f).Parse(metricTemplate)
+		if err != nil {
+			return fmt.Errorf("invalid metric template for %s: %v", f, err)
+		}
+		s.templates[f] = tmpl
+	}
+
+	for metricType, rate := range s.dbConf.SampleRates {
+		if metricType != statsdTimingType && metricType != statsdCounterType {
+			return fmt.Errorf("invalid metric type %s in sample_rates, must be timing or counter", metricType)
+		}
+		if rate <= 0 || rate > 1 {
+			return fmt.Errorf("invalid %s sample rate %v, must be greater than 0 and up to 1", metricType, rate)
+		}
+	}
+
 	s.connect()
 
 	s.log.Debug("StatsD CS: ", s.dbConf.Address)
@@ -90,6 +151,10 @@ func (s *StatsdPump) WriteData(ctx context.Context, data []interface{}) error {
 	defer client.Close()
 
 	for _, v := range data {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Convert to AnalyticsRecord
 		decoded := v.(analytics.AnalyticsRecord)
 
@@ -116,6 +181,7 @@ func (s *StatsdPump) WriteData(ctx context.Context, data []interface{}) error {
 			"request_time":  decoded.RequestTime,
 			"raw_response":  decoded.RawResponse,
 			"ip_address":    decoded.IPAddress,
+			"error_class":   decoded.ErrorClass,
 		}
 
 		// Combine tags
@@ -145,9 +211,28 @@ func (s *StatsdPump) WriteData(ctx context.Context, data []interface{}) error {
 		// For each field, create metric calculation
 		// Everybody has their own implementation here
 		for _, f := range s.dbConf.Fields {
-			if f == "request_time" {
-				metric := f + "." + metricTags
-				client.Timing(metric, mapping[f].(int64))
+			field, ok := statsdFields[f]
+			if !ok {
+				continue
+			}
+
+			rate := s.sampleRate(field.metricType)
+			if rate < 1 && rand.Float64() >= rate {
+				continue
+			}
+
+			metric, err := s.metricName(f, metricTags, &decoded)
+			if err != nil {
+				s.log.Error("Failed to build the ", f, " metric name: ", err)
+				continue
+			}
+
+			switch field.metricType {
+			case statsdTimingType:
+				client.Timing(metric, field.value(&decoded))
+			case statsdCounterType:
+				// the statsd client can't send the sample rate, so the sampled counts are scaled up instead
+				client.Incr(metric, int64(math.Round(float64(field.value(&decoded))/rate)))
 			}
 		}
 	}
@@ -155,3 +240,26 @@ func (s *StatsdPump) WriteData(ctx context.Context, data []interface{}) error {
 
 	return nil
 }
+
+// sampleRate returns the rate at which the records are sampled for the metrics of the given type
+func (s *StatsdPump) sampleRate(metricType string) float64 {
+	if rate, ok := s.dbConf.SampleRates[metricType]; ok {
+		return rate
+	}
+	return 1
+}
+
+// metricName returns the name of the metric of the field for the record, from its template if it has one or from
+// the field and the tags otherwise
+func (s *StatsdPump) metricName(field, metricTags string, record *analytics.AnalyticsRecord) (string, error) {
+	tmpl, ok := s.templates[field]
+	if !ok {
+		return field + "." + metricTags, nil
+	}
+
+	var name strings.Builder
+	if err := tmpl.Execute(&name, record); err != nil {
+		return "", err
+	}
+	return statsdUnsafeChars.Replace(name.String()), nil
+}
@@ -0,0 +1,34 @@
+package pumps
+
+import (
+	"testing"
+	"text/template"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestStatsdMetricName(t *testing.T) {
+	s := &StatsdPump{
+		dbConf: &StatsdConf{SampleRates: map[string]float64{"counter": 0.5}},
+		templates: map[string]*template.Template{
+			"upstream_latency": template.Must(template.New("upstream_latency").Parse("tyk.{{.APIName}}.{{.Method}}.{{.ResponseCode}}.upstream")),
+		},
+	}
+	record := &analytics.AnalyticsRecord{APIName: "my api", Method: "GET", ResponseCode: 200}
+
+	name, err := s.metricName("upstream_latency", "tags", record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "tyk.my_api.GET.200.upstream" {
+		t.Fatal("unexpected templated metric name:", name)
+	}
+
+	if name, _ := s.metricName("request_time", "api1.200", record); name != "request_time.api1.200" {
+		t.Fatal("unexpected default metric name:", name)
+	}
+
+	if s.sampleRate(statsdCounterType) != 0.5 || s.sampleRate(statsdTimingType) != 1 {
+		t.Fatal("unexpected sample rates")
+	}
+}
@@ -6,7 +6,6 @@ import (
 
 	"github.com/TykTechnologies/logrus"
 	"github.com/TykTechnologies/tyk-pump/analytics"
-	"github.com/mitchellh/mapstructure"
 )
 
 var (
@@ -23,6 +22,10 @@ type StdOutConf struct {
 	EnvPrefix    string `mapstructure:"meta_env_prefix"`
 	Format       string `mapstructure:"format"`
 	LogFieldName string `mapstructure:"log_field_name"`
+	// GCPProjectID prefixes the trace IDs of the gcp format, as Cloud Logging expects them
+	GCPProjectID string `mapstructure:"gcp_project_id"`
+	// Fields are the record fields written by the logfmt format
+	Fields []string `mapstructure:"fields"`
 }
 
 func (s *StdOutPump) GetName() string {
@@ -40,10 +43,10 @@ func (s *StdOutPump) New() Pump {
 
 func (s *StdOutPump) Init(config interface{}) error {
 
-	s.log = log.WithField("prefix", stdOutPrefix)
+	s.log = s.newLogger(stdOutPrefix)
 
 	s.conf = &StdOutConf{}
-	err := mapstructure.Decode(config, &s.conf)
+	err := decodePumpConfig(s, s.log, config, &s.conf)
 
 	if err != nil {
 		s.log.Fatal("Failed to decode configuration: ", err)
@@ -55,6 +58,12 @@ func (s *StdOutPump) Init(config interface{}) error {
 		s.conf.LogFieldName = "tyk-analytics-record"
 	}
 
+	for _, field := range s.conf.Fields {
+		if !analytics.IsRecordField(field) {
+			return fmt.Errorf("unknown field %q", field)
+		}
+	}
+
 	s.log.Info(s.GetName() + " Initialized")
 
 	return nil
@@ -72,17 +81,26 @@ func (s *StdOutPump) WriteData(ctx context.Context, data []interface{}) error {
 
 		select {
 		case <-ctx.Done():
-			return nil
+			return ctx.Err()
 		default:
 			decoded := v.(analytics.AnalyticsRecord)
 
-			if s.conf.Format == "json" {
+			switch s.conf.Format {
+			case stdoutJSONFormat:
 				formatter := &logrus.JSONFormatter{}
 				entry := log.WithField(s.conf.LogFieldName, decoded)
 				entry.Level = logrus.InfoLevel
 				data, _ := formatter.Format(entry)
 				fmt.Print(string(data))
-			} else {
+			case stdoutGCPFormat:
+				s.printEntry(s.gcpEntry(&decoded))
+			case stdoutAWSFormat:
+				s.printEntry(s.awsEntry(&decoded))
+			case stdoutECSFormat:
+				s.printEntry(s.ecsEntry(&decoded))
+			case stdoutLogfmtFormat:
+				fmt.Print(string(s.logfmtEntry(&decoded)))
+			default:
 				s.log.WithField(s.conf.LogFieldName, decoded).Info()
 			}
 
@@ -92,3 +110,11 @@ func (s *StdOutPump) WriteData(ctx context.Context, data []interface{}) error {
 
 	return nil
 }
+
+func (s *StdOutPump) printEntry(entry []byte, err error) {
+	if err != nil {
+		s.log.Error("Failed to format record: ", err)
+		return
+	}
+	fmt.Println(string(entry))
+}
@@ -0,0 +1,166 @@
+package pumps
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	stdoutJSONFormat   = "json"
+	stdoutGCPFormat    = "gcp"
+	stdoutAWSFormat    = "aws"
+	stdoutLogfmtFormat = "logfmt"
+	stdoutECSFormat    = "ecs"
+)
+
+// defaultLogfmtFields are the record fields written by the logfmt format when no fields are configured
+var defaultLogfmtFields = []string{
+	"timestamp", "method", "host", "path", "response_code", "api_id", "api_name", "org_id", "alias", "ip_address",
+	"request_time", "latency.upstream", "user_agent", "error_class", "trace_id",
+	"correlation_id",
+}
+
+// recordMessage summarises the record in a line, for the log agents showing a message
+func recordMessage(record *analytics.AnalyticsRecord) string {
+	return fmt.Sprintf("%s %s %d", record.Method, record.Path, record.ResponseCode)
+}
+
+// gcpEntry formats the record as a Cloud Logging structured log, with its httpRequest and trace
+func (s *StdOutPump) gcpEntry(record *analytics.AnalyticsRecord) ([]byte, error) {
+	severity := "INFO"
+	switch {
+	case record.ResponseCode >= 500:
+		severity = "ERROR"
+	case record.ResponseCode >= 400:
+		severity = "WARNING"
+	}
+
+	entry := map[string]interface{}{
+		"severity":  severity,
+		"message":   recordMessage(record),
+		"timestamp": record.TimeStamp.Format(time.RFC3339Nano),
+		"httpRequest": map[string]interface{}{
+			"requestMethod": record.Method,
+			"requestUrl":    record.RawPath,
+			"status":        record.ResponseCode,
+			"userAgent":     record.UserAgent,
+			"remoteIp":      record.IPAddress,
+			"requestSize":   strconv.FormatInt(record.ContentLength, 10),
+			"responseSize":  strconv.FormatInt(record.ResponseContentLength, 10),
+			"latency":       strconv.FormatFloat(float64(record.RequestTime)/1000, 'f', -1, 64) + "s",
+		},
+		"logging.googleapis.com/labels": map[string]string{
+			"api_id": record.APIID,
+			"org_id": record.OrgID,
+		},
+		s.conf.LogFieldName: record,
+	}
+
+	if traceID, spanID := recordTrace(record); traceID != "" {
+		if s.conf.GCPProjectID != "" {
+			traceID = "projects/" + s.conf.GCPProjectID + "/traces/" + traceID
+		}
+		entry["logging.googleapis.com/trace"] = traceID
+		if spanID != "" {
+			entry["logging.googleapis.com/spanId"] = spanID
+		}
+	}
+
+	return json.Marshal(entry)
+}
+
+// awsEntry formats the record like the JSON logs of Lambda, which CloudWatch Logs Insights discovers the fields of
+func (s *StdOutPump) awsEntry(record *analytics.AnalyticsRecord) ([]byte, error) {
+	level := "INFO"
+	switch {
+	case record.ResponseCode >= 500:
+		level = "ERROR"
+	case record.ResponseCode >= 400:
+		level = "WARN"
+	}
+
+	entry := map[string]interface{}{
+		"timestamp":         record.TimeStamp.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"level":             level,
+		"message":           recordMessage(record),
+		s.conf.LogFieldName: record,
+	}
+	if traceID, _ := recordTrace(record); traceID != "" {
+		entry["traceId"] = traceID
+	}
+
+	return json.Marshal(entry)
+}
+
+// ecsEntry formats the record as a JSON log with the field names of the Elastic Common Schema, for the Elastic Agent
+// and Filebeat, with the log level and the trace of the raw request
+func (s *StdOutPump) ecsEntry(record *analytics.AnalyticsRecord) ([]byte, error) {
+	level := "info"
+	switch {
+	case record.ResponseCode >= 500:
+		level = "error"
+	case record.ResponseCode >= 400:
+		level = "warn"
+	}
+
+	entry := record.ECSDocument()
+	entry["message"] = recordMessage(record)
+	entry["log"] = map[string]interface{}{"level": level}
+	if traceID, spanID := recordTrace(record); traceID != "" {
+		entry["trace"] = map[string]interface{}{"id": traceID}
+		if spanID != "" {
+			entry["span"] = map[string]interface{}{"id": spanID}
+		}
+	}
+
+	return json.Marshal(entry)
+}
+
+// logfmtEntry formats the configured record fields as key=value pairs
+func (s *StdOutPump) logfmtEntry(record *analytics.AnalyticsRecord) []byte {
+	level := "info"
+	switch {
+	case record.ResponseCode >= 500:
+		level = "error"
+	case record.ResponseCode >= 400:
+		level = "warning"
+	}
+
+	fields := s.conf.Fields
+	if len(fields) == 0 {
+		fields = defaultLogfmtFields
+	}
+
+	var line strings.Builder
+	line.WriteString("level=" + level)
+	for _, field := range fields {
+		line.WriteString(" " + field + "=" + logfmtValue(record.FieldString(field)))
+	}
+	line.WriteString("\n")
+	return []byte(line.String())
+}
+
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\\t\r\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// recordTrace returns the trace and span IDs of the record, or the ones of the trace context headers of its raw
+// request when they aren't set
+func recordTrace(record *analytics.AnalyticsRecord) (string, string) {
+	if record.TraceID != "" || record.RawRequest == "" {
+		return record.TraceID, record.SpanID
+	}
+	req, _, err := analytics.ParseRawRequest(record.RawRequest)
+	if err != nil {
+		return "", ""
+	}
+	return analytics.TraceContext(req.Header)
+}
@@ -0,0 +1,123 @@
+package pumps
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestStdOutGCPEntry(t *testing.T) {
+	s := &StdOutPump{conf: &StdOutConf{LogFieldName: "record", GCPProjectID: "my-project"}}
+	rawRequest := "GET /users HTTP/1.1\r\nHost: example.com\r\nX-Cloud-Trace-Context: 105445aa7843bc8bf206b12000100000/1;o=1\r\n\r\n"
+	record := &analytics.AnalyticsRecord{
+		Method:       "GET",
+		Path:         "/users",
+		ResponseCode: 503,
+		RequestTime:  1500,
+		TimeStamp:    time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		RawRequest:   base64.StdEncoding.EncodeToString([]byte(rawRequest)),
+	}
+
+	data, err := s.gcpEntry(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry["severity"] != "ERROR" {
+		t.Errorf("unexpected severity %v", entry["severity"])
+	}
+	if entry["logging.googleapis.com/trace"] != "projects/my-project/traces/105445aa7843bc8bf206b12000100000" {
+		t.Errorf("unexpected trace %v", entry["logging.googleapis.com/trace"])
+	}
+	if entry["logging.googleapis.com/spanId"] != "1" {
+		t.Errorf("unexpected span %v", entry["logging.googleapis.com/spanId"])
+	}
+	if latency := entry["httpRequest"].(map[string]interface{})["latency"]; latency != "1.5s" {
+		t.Errorf("unexpected latency %v", latency)
+	}
+	if _, ok := entry["record"]; !ok {
+		t.Error("the record is missing")
+	}
+}
+
+func TestStdOutAWSEntry(t *testing.T) {
+	s := &StdOutPump{conf: &StdOutConf{LogFieldName: "record"}}
+	rawRequest := "GET / HTTP/1.1\r\nHost: example.com\r\nTraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n\r\n"
+	record := &analytics.AnalyticsRecord{
+		ResponseCode: 404,
+		TimeStamp:    time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		RawRequest:   base64.StdEncoding.EncodeToString([]byte(rawRequest)),
+	}
+
+	data, err := s.awsEntry(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry["level"] != "WARN" || entry["timestamp"] != "2021-01-02T03:04:05.000Z" {
+		t.Errorf("unexpected entry %s", data)
+	}
+	if entry["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected trace %v", entry["traceId"])
+	}
+}
+
+func TestStdOutLogfmtEntry(t *testing.T) {
+	s := &StdOutPump{conf: &StdOutConf{Fields: []string{"api_id", "path", "user_agent", "latency.total"}}}
+	record := &analytics.AnalyticsRecord{
+		APIID:     "api1",
+		Path:      "/users",
+		UserAgent: `curl "7.0"`,
+		Latency:   analytics.Latency{Total: 12},
+	}
+
+	expected := `level=info api_id=api1 path=/users user_agent="curl \"7.0\"" latency.total=12` + "\n"
+	if line := string(s.logfmtEntry(record)); line != expected {
+		t.Errorf("expected %q, got %q", expected, line)
+	}
+}
+
+func TestStdOutECSEntry(t *testing.T) {
+	s := &StdOutPump{conf: &StdOutConf{}}
+	rawRequest := "GET / HTTP/1.1\r\nHost: example.com\r\nTraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n\r\n"
+	record := &analytics.AnalyticsRecord{
+		Method:       "GET",
+		Path:         "/",
+		ResponseCode: 401,
+		TimeStamp:    time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+		RawRequest:   base64.StdEncoding.EncodeToString([]byte(rawRequest)),
+	}
+
+	data, err := s.ecsEntry(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if level := entry["log"].(map[string]interface{})["level"]; level != "warn" {
+		t.Errorf("unexpected level %v", level)
+	}
+	if traceID := entry["trace"].(map[string]interface{})["id"]; traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected trace %v", traceID)
+	}
+	if method := entry["http"].(map[string]interface{})["request"].(map[string]interface{})["method"]; method != "GET" {
+		t.Errorf("unexpected method %v", method)
+	}
+	if entry["message"] != "GET / 401" {
+		t.Errorf("unexpected message %v", entry["message"])
+	}
+}
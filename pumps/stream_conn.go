@@ -0,0 +1,89 @@
+package pumps
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// streamConn writes frames to a connection. When a write fails, it reconnects and retries once.
+type streamConn struct {
+	dial func() (net.Conn, error)
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newStreamConn(dial func() (net.Conn, error)) (*streamConn, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{dial: dial, conn: conn}, nil
+}
+
+func (c *streamConn) Write(frame []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		if _, err := c.conn.Write(frame); err == nil {
+			return nil
+		}
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	_, err = c.conn.Write(frame)
+	return err
+}
+
+func (c *streamConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// newTLSConfig returns the client TLS config verifying the server with the CA file, when given, and authenticating
+// with the certificate and key files, when given
+func newTLSConfig(serverName, caFile, certFile, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -3,16 +3,13 @@ package pumps
 import (
 	"context"
 	"fmt"
-	"log/syslog"
-
-	"github.com/mitchellh/mapstructure"
 
 	"github.com/TykTechnologies/tyk-pump/analytics"
 )
 
 type SyslogPump struct {
 	syslogConf *SyslogConf
-	writer     *syslog.Writer
+	writer     *syslogWriter
 	filters    analytics.AnalyticsFilters
 	timeout    int
 	CommonPumpConfig
@@ -29,12 +26,50 @@ type SyslogConf struct {
 	NetworkAddr string `mapstructure:"network_addr"`
 	LogLevel    int    `mapstructure:"log_level"`
 	Tag         string `mapstructure:"tag"`
+	// Format is rfc3164, the default, or rfc5424
+	Format string `mapstructure:"format"`
+	// Framing is non_transparent, the default, or octet_counting, which is only allowed over tcp and tls
+	Framing string `mapstructure:"framing"`
+	// Facility overrides the facility of the log level, by name, like local0
+	Facility string `mapstructure:"facility"`
+	// SeverityMapping maps response codes, like 404, or classes, like 5xx, to severity names
+	SeverityMapping map[string]string `mapstructure:"severity_mapping"`
+	// StructuredData are the record fields sent in the RFC5424 structured data element
+	StructuredData   []string `mapstructure:"structured_data"`
+	StructuredDataID string   `mapstructure:"structured_data_id"`
+
+	SSLCAFile             string `mapstructure:"ssl_ca_file"`
+	SSLCertFile           string `mapstructure:"ssl_cert_file"`
+	SSLKeyFile            string `mapstructure:"ssl_key_file"`
+	SSLInsecureSkipVerify bool   `mapstructure:"ssl_insecure_skip_verify"`
+	// TLS configures the tls transport, the ssl_ options are used for the settings it leaves unset
+	TLS TLSConf `mapstructure:"tls"`
+	// Proxy is the proxy of the tcp and tls transports
+	Proxy ProxyConf `mapstructure:"proxy"`
+}
+
+// tlsConf returns the tls block completed with the ssl_ options
+func (c SyslogConf) tlsConf() TLSConf {
+	return c.TLS.withLegacy(TLSConf{
+		CAFile:             c.SSLCAFile,
+		CertFile:           c.SSLCertFile,
+		KeyFile:            c.SSLKeyFile,
+		InsecureSkipVerify: c.SSLInsecureSkipVerify,
+	})
 }
 
 func (s *SyslogPump) GetName() string {
 	return "Syslog Pump"
 }
 
+// Close closes the connection to the syslog server
+func (s *SyslogPump) Close() error {
+	if s.writer == nil {
+		return nil
+	}
+	return s.writer.Close()
+}
+
 func (s *SyslogPump) New() Pump {
 	newPump := SyslogPump{}
 	return &newPump
@@ -47,9 +82,9 @@ func (s *SyslogPump) GetEnvPrefix() string {
 func (s *SyslogPump) Init(config interface{}) error {
 	//Read configuration file
 	s.syslogConf = &SyslogConf{}
-	s.log = log.WithField("prefix", syslogPrefix)
+	s.log = s.newLogger(syslogPrefix)
 
-	err := mapstructure.Decode(config, &s.syslogConf)
+	err := decodePumpConfig(s, s.log, config, &s.syslogConf)
 	if err != nil {
 		s.log.Fatal("Failed to decode configuration: ", err)
 	}
@@ -71,12 +106,7 @@ func (s *SyslogPump) initWriter() {
 	if s.syslogConf.Tag != "" {
 		tag = s.syslogConf.Tag
 	}
-	syslogWriter, err := syslog.Dial(
-		s.syslogConf.Transport,
-		s.syslogConf.NetworkAddr,
-		syslog.Priority(s.syslogConf.LogLevel),
-		tag)
-
+	syslogWriter, err := newSyslogWriter(s.syslogConf, tag)
 	if err != nil {
 		s.log.Fatal("failed to connect to Syslog Daemon: ", err)
 	}
@@ -103,6 +133,22 @@ func (s *SyslogPump) initConfigs() {
 		s.log.Info("No host given, using 'localhost:5140'")
 	}
 
+	if s.syslogConf.Format != "" &&
+		s.syslogConf.Format != syslogRFC3164Format &&
+		s.syslogConf.Format != syslogRFC5424Format {
+		s.log.Fatal("Chosen invalid Format. Please use rfc3164 or rfc5424")
+	}
+
+	if s.syslogConf.Framing != "" &&
+		s.syslogConf.Framing != syslogNonTransparentFraming &&
+		s.syslogConf.Framing != syslogOctetCountingFraming {
+		s.log.Fatal("Chosen invalid Framing. Please use non_transparent or octet_counting")
+	}
+
+	if s.syslogConf.Framing == syslogOctetCountingFraming && s.syslogConf.Transport == "udp" {
+		s.log.Fatal("Octet counting framing is only supported over tcp and tls")
+	}
+
 	if s.syslogConf.LogLevel == 0 {
 		s.log.Warn("Using Log Level 0 (KERNEL) for Syslog pump")
 	}
@@ -118,34 +164,43 @@ func (s *SyslogPump) WriteData(ctx context.Context, data []interface{}) error {
 	for _, v := range data {
 		select {
 		case <-ctx.Done():
-			return nil
+			return ctx.Err()
 		default:
 			// Decode the raw analytics into Form
 			decoded := v.(analytics.AnalyticsRecord)
 			message := Json{
-				"timestamp":       decoded.TimeStamp,
-				"method":          decoded.Method,
-				"path":            decoded.Path,
-				"raw_path":        decoded.RawPath,
-				"response_code":   decoded.ResponseCode,
-				"alias":           decoded.Alias,
-				"api_key":         decoded.APIKey,
-				"api_version":     decoded.APIVersion,
-				"api_name":        decoded.APIName,
-				"api_id":          decoded.APIID,
-				"org_id":          decoded.OrgID,
-				"oauth_id":        decoded.OauthID,
-				"raw_request":     decoded.RawRequest,
-				"request_time_ms": decoded.RequestTime,
-				"raw_response":    decoded.RawResponse,
-				"ip_address":      decoded.IPAddress,
-				"host":            decoded.Host,
-				"content_length":  decoded.ContentLength,
-				"user_agent":      decoded.UserAgent,
+				"timestamp":               decoded.TimeStamp,
+				"method":                  decoded.Method,
+				"path":                    decoded.Path,
+				"raw_path":                decoded.RawPath,
+				"response_code":           decoded.ResponseCode,
+				"alias":                   decoded.Alias,
+				"api_key":                 decoded.APIKey,
+				"api_version":             decoded.APIVersion,
+				"api_name":                decoded.APIName,
+				"api_id":                  decoded.APIID,
+				"org_id":                  decoded.OrgID,
+				"oauth_id":                decoded.OauthID,
+				"raw_request":             decoded.RawRequest,
+				"request_time_ms":         decoded.RequestTime,
+				"raw_response":            decoded.RawResponse,
+				"ip_address":              decoded.IPAddress,
+				"host":                    decoded.Host,
+				"content_length":          decoded.ContentLength,
+				"response_content_length": decoded.ResponseContentLength,
+				"user_agent":              decoded.UserAgent,
+				"error_class":             decoded.ErrorClass,
+				"trace_id":                decoded.TraceID,
+				"span_id":                 decoded.SpanID,
+				"correlation_id":          decoded.CorrelationID,
+				"response_headers":        decoded.ResponseHeaders,
+				"body_fields":             decoded.BodyFields,
 			}
 
 			// Print to Syslog
-			_, _ = fmt.Fprintf(s.writer, "%s", message)
+			if err := s.writer.Write(&decoded, fmt.Sprintf("%s", message)); err != nil {
+				s.log.Error("Failed to write to Syslog: ", err)
+			}
 		}
 	}
 	s.log.Info("Purged ", len(data), " records...")
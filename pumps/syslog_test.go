@@ -0,0 +1,123 @@
+package pumps
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestSyslogWriterFormat(t *testing.T) {
+	record := &analytics.AnalyticsRecord{
+		TimeStamp:    time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC),
+		APIID:        "api1",
+		Path:         `/a"b]`,
+		ResponseCode: 503,
+	}
+
+	w := &syslogWriter{
+		format:          syslogRFC5424Format,
+		hostname:        "host",
+		tag:             "tyk pump",
+		pid:             42,
+		facility:        16,
+		severity:        6,
+		severityMapping: map[string]int{"5xx": 3, "503": 2},
+		sdID:            defaultSyslogSDID,
+		sdFields:        []string{"api_id", "path"},
+	}
+
+	expected := `<130>1 2020-03-04T05:06:07.000000Z host tyk_pump 42 - [tyk@32473 api_id="api1" path="/a\"b\]"] msg`
+	if message := w.formatMessage(record, "msg"); message != expected {
+		t.Errorf("expected %s, got %s", expected, message)
+	}
+
+	w.format = syslogRFC3164Format
+	record.ResponseCode = 200
+	expected = "<134>2020-03-04T05:06:07Z host tyk pump[42]: msg"
+	if message := w.formatMessage(record, "msg"); message != expected {
+		t.Errorf("expected %s, got %s", expected, message)
+	}
+}
+
+func TestSyslogWriterSeverity(t *testing.T) {
+	w := &syslogWriter{severity: 6, severityMapping: map[string]int{"5xx": 3, "404": 4}}
+
+	for code, expected := range map[int]int{200: 6, 404: 4, 403: 6, 500: 3} {
+		if severity := w.severityFor(code); severity != expected {
+			t.Errorf("expected severity %d for %d, got %d", expected, code, severity)
+		}
+	}
+}
+
+func TestSyslogWriterFraming(t *testing.T) {
+	w := &syslogWriter{framing: syslogOctetCountingFraming}
+	if frame := string(w.frame("hello")); frame != "5 hello" {
+		t.Errorf("unexpected octet counting frame %q", frame)
+	}
+
+	w.framing = syslogNonTransparentFraming
+	if frame := string(w.frame("hello")); frame != "hello\n" {
+		t.Errorf("unexpected non transparent frame %q", frame)
+	}
+}
+
+func TestSyslogWriterTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err == nil {
+			received <- line
+		}
+	}()
+
+	w, err := newSyslogWriter(&SyslogConf{
+		Transport:       "tcp",
+		NetworkAddr:     listener.Addr().String(),
+		Format:          syslogRFC5424Format,
+		SeverityMapping: map[string]string{"2xx": "notice"},
+	}, "tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.Write(&analytics.AnalyticsRecord{ResponseCode: 200}, "msg"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case line := <-received:
+		if line[:4] != "<5>1" {
+			t.Errorf("unexpected message %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message wasn't received")
+	}
+}
+
+func TestNewSyslogWriterValidation(t *testing.T) {
+	confs := []*SyslogConf{
+		{Transport: "tcp", Facility: "nope"},
+		{Transport: "tcp", SeverityMapping: map[string]string{"5xx": "bad"}},
+		{Transport: "tcp", StructuredData: []string{"unknown_field"}},
+	}
+	for _, conf := range confs {
+		if _, err := newSyslogWriter(conf, "tag"); err == nil {
+			t.Errorf("expected an error for %+v", conf)
+		}
+	}
+}
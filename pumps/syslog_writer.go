@@ -0,0 +1,212 @@
+package pumps
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+const (
+	syslogRFC3164Format = "rfc3164"
+	syslogRFC5424Format = "rfc5424"
+
+	syslogNonTransparentFraming = "non_transparent"
+	syslogOctetCountingFraming  = "octet_counting"
+
+	// defaultSyslogSDID uses the private enterprise number reserved for documentation, see RFC 5612
+	defaultSyslogSDID = "tyk@32473"
+
+	rfc5424Timestamp = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7, "uucp": 8, "cron": 9,
+	"authpriv": 10, "ftp": 11, "local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21,
+	"local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// syslogWriter formats the records as RFC3164 or RFC5424 messages and sends them to the syslog daemon
+type syslogWriter struct {
+	conn *streamConn
+
+	format   string
+	framing  string
+	hostname string
+	tag      string
+	pid      int
+
+	facility        int
+	severity        int
+	severityMapping map[string]int
+
+	sdID     string
+	sdFields []string
+}
+
+func newSyslogWriter(conf *SyslogConf, tag string) (*syslogWriter, error) {
+	w := &syslogWriter{
+		format:   conf.Format,
+		framing:  conf.Framing,
+		tag:      tag,
+		pid:      os.Getpid(),
+		facility: conf.LogLevel >> 3,
+		severity: conf.LogLevel & 7,
+		sdID:     conf.StructuredDataID,
+		sdFields: conf.StructuredData,
+	}
+	if w.sdID == "" {
+		w.sdID = defaultSyslogSDID
+	}
+	w.hostname, _ = os.Hostname()
+
+	if conf.Facility != "" {
+		facility, ok := syslogFacilities[conf.Facility]
+		if !ok {
+			return nil, fmt.Errorf("invalid facility %q", conf.Facility)
+		}
+		w.facility = facility
+	}
+
+	w.severityMapping = make(map[string]int, len(conf.SeverityMapping))
+	for code, name := range conf.SeverityMapping {
+		severity, ok := syslogSeverities[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid severity %q for response code %s", name, code)
+		}
+		w.severityMapping[strings.ToLower(code)] = severity
+	}
+
+	for _, field := range w.sdFields {
+		if !analytics.IsRecordField(field) {
+			return nil, fmt.Errorf("unknown structured data field %q", field)
+		}
+	}
+
+	proxyDial, err := conf.Proxy.dialer(10 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	var dial func() (net.Conn, error)
+	switch conf.Transport {
+	case "udp":
+		if conf.Proxy.URL != "" {
+			return nil, errors.New("the proxy is only supported by the tcp and tls transports")
+		}
+		dial = func() (net.Conn, error) {
+			return net.DialTimeout("udp", conf.NetworkAddr, 10*time.Second)
+		}
+	case "tcp":
+		dial = func() (net.Conn, error) {
+			return proxyDial(conf.NetworkAddr)
+		}
+	case "tls":
+		host, _, err := net.SplitHostPort(conf.NetworkAddr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig, err := conf.tlsConf().ClientConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		dial = func() (net.Conn, error) {
+			return dialTLS(proxyDial, conf.NetworkAddr, tlsConfig, 10*time.Second)
+		}
+	default:
+		return nil, fmt.Errorf("invalid transport %q, must be udp, tcp or tls", conf.Transport)
+	}
+
+	conn, err := newStreamConn(dial)
+	if err != nil {
+		return nil, err
+	}
+	w.conn = conn
+	return w, nil
+}
+
+// Write sends the message of the record with the severity mapped from its response code
+func (w *syslogWriter) Write(record *analytics.AnalyticsRecord, message string) error {
+	return w.conn.Write(w.frame(w.formatMessage(record, message)))
+}
+
+func (w *syslogWriter) Close() error {
+	return w.conn.Close()
+}
+
+// formatMessage formats the message in the configured format, RFC3164 being the default
+func (w *syslogWriter) formatMessage(record *analytics.AnalyticsRecord, message string) string {
+	timestamp := record.TimeStamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	priority := w.facility<<3 | w.severityFor(record.ResponseCode)
+
+	if w.format != syslogRFC5424Format {
+		return fmt.Sprintf("<%d>%s %s %s[%d]: %s", priority, timestamp.Format(time.RFC3339), w.hostname, w.tag, w.pid, message)
+	}
+
+	return fmt.Sprintf("<%d>1 %s %s %s %d - %s %s", priority, timestamp.Format(rfc5424Timestamp),
+		syslogHeaderValue(w.hostname), syslogHeaderValue(w.tag), w.pid, w.structuredData(record), message)
+}
+
+// severityFor returns the severity mapped to the exact response code, or to its class like 5xx, or the default one
+func (w *syslogWriter) severityFor(code int) int {
+	if severity, ok := w.severityMapping[strconv.Itoa(code)]; ok {
+		return severity
+	}
+	if severity, ok := w.severityMapping[strconv.Itoa(code/100)+"xx"]; ok {
+		return severity
+	}
+	return w.severity
+}
+
+// structuredData returns the SD element with the configured record fields, or the nil value when there's none
+func (w *syslogWriter) structuredData(record *analytics.AnalyticsRecord) string {
+	if len(w.sdFields) == 0 {
+		return "-"
+	}
+
+	var sd strings.Builder
+	sd.WriteString("[" + w.sdID)
+	for _, field := range w.sdFields {
+		sd.WriteString(" " + field + `="` + escapeSDParam(record.FieldString(field)) + `"`)
+	}
+	sd.WriteString("]")
+	return sd.String()
+}
+
+// frame delimits the message with a newline or prefixes it with its length, as RFC6587 describes for TCP and TLS
+func (w *syslogWriter) frame(message string) []byte {
+	if w.framing == syslogOctetCountingFraming {
+		return []byte(strconv.Itoa(len(message)) + " " + message)
+	}
+	if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+	return []byte(message)
+}
+
+var sdParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func escapeSDParam(value string) string {
+	return sdParamEscaper.Replace(value)
+}
+
+// syslogHeaderValue returns the nil value for the empty header fields, and replaces the spaces, which would break the
+// header, by underscores
+func syslogHeaderValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.Replace(value, " ", "_", -1)
+}
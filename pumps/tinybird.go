@@ -0,0 +1,122 @@
+package pumps
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	tinybirdPrefix     = "tinybird-pump"
+	tinybirdDefaultENV = PUMPS_ENV_PREFIX + "_TINYBIRD" + PUMPS_ENV_META_PREFIX
+
+	defaultTinybirdURL = "https://api.tinybird.co"
+	tinybirdEventsPath = "/v0/events"
+	// defaultTinybirdMaxBatchBytes keeps the requests under the 10MB limit of the Events API
+	defaultTinybirdMaxBatchBytes = 10 * 1000 * 1000
+)
+
+// tinybirdDataSource matches the names of the Tinybird data sources
+var tinybirdDataSource = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// TinybirdPump sends the analytics records to the Tinybird Events API, as NDJSON rows of a data source
+type TinybirdPump struct {
+	conf   *TinybirdConf
+	bulk   *HTTPBulkConf
+	client *http.Client
+	CommonPumpConfig
+}
+
+// TinybirdConf configures the Tinybird pump
+type TinybirdConf struct {
+	EnvPrefix string `mapstructure:"meta_env_prefix"`
+	// Token is a Tinybird token with the append permission on the data source
+	Token string `mapstructure:"token"`
+	// DataSource is the name of the data source the records are appended to
+	DataSource string `mapstructure:"data_source"`
+	// URL is the API URL of the Tinybird region, https://api.tinybird.co by default
+	URL string `mapstructure:"url"`
+	// Wait makes the requests wait for the rows to be written, instead of only accepted
+	Wait bool `mapstructure:"wait"`
+	// Fields are the record fields of the rows, by their json names. All of them by default.
+	Fields []string `mapstructure:"fields"`
+	// BatchSize is the maximum number of rows of a request, 10000 by default
+	BatchSize int `mapstructure:"batch_size"`
+	// Compress gzips the requests
+	Compress bool `mapstructure:"compress"`
+}
+
+func (t *TinybirdPump) New() Pump {
+	newPump := TinybirdPump{}
+	return &newPump
+}
+
+func (t *TinybirdPump) GetName() string {
+	return "Tinybird Pump"
+}
+
+func (t *TinybirdPump) GetEnvPrefix() string {
+	return t.conf.EnvPrefix
+}
+
+func (t *TinybirdPump) Init(config interface{}) error {
+	t.conf = &TinybirdConf{}
+	t.log = t.newLogger(tinybirdPrefix)
+
+	if err := decodePumpConfig(t, t.log, config, &t.conf); err != nil {
+		t.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(t, t.log, t.conf, tinybirdDefaultENV)
+
+	if t.conf.Token == "" || t.conf.DataSource == "" {
+		return errors.New("token and data_source must be set")
+	}
+	if !tinybirdDataSource.MatchString(t.conf.DataSource) {
+		return errors.New("invalid data_source " + t.conf.DataSource)
+	}
+	if t.conf.URL == "" {
+		t.conf.URL = defaultTinybirdURL
+	}
+
+	t.bulk = &HTTPBulkConf{
+		URL:           strings.TrimSuffix(t.conf.URL, "/") + tinybirdEventsPath,
+		QueryParams:   map[string]string{"name": t.conf.DataSource},
+		Token:         t.conf.Token,
+		Fields:        t.conf.Fields,
+		BatchSize:     t.conf.BatchSize,
+		MaxBatchBytes: defaultTinybirdMaxBatchBytes,
+		Compress:      t.conf.Compress,
+	}
+	if t.conf.Wait {
+		t.bulk.QueryParams["wait"] = "true"
+	}
+	if err := t.bulk.init(); err != nil {
+		return err
+	}
+	t.client = &http.Client{Timeout: 60 * time.Second}
+
+	t.log.Info(t.GetName() + " Initialized")
+	return nil
+}
+
+func (t *TinybirdPump) WriteData(ctx context.Context, data []interface{}) error {
+	_, err := t.WriteDataPartial(ctx, data)
+	return err
+}
+
+// WriteDataPartial appends the records to the data source in batches, returning the records of the batches that
+// failed and of the ones left at the deadline
+func (t *TinybirdPump) WriteDataPartial(ctx context.Context, data []interface{}) ([]interface{}, error) {
+	t.log.Debug("Attempting to write ", len(data), " records...")
+
+	failed, err := httpBulkWrite(ctx, t.client, t.bulk, &t.CommonPumpConfig, data)
+	if err != nil {
+		return failed, err
+	}
+	t.log.Info("Purged ", len(data), " records...")
+	return nil, nil
+}
@@ -0,0 +1,60 @@
+package pumps
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestTinybirdWriteData(t *testing.T) {
+	bodies := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != tinybirdEventsPath || r.URL.Query().Get("name") != "api_requests" || r.URL.Query().Get("wait") != "true" {
+			t.Errorf("unexpected request to %s", r.URL)
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("expected the token as a bearer token, got %q", r.Header.Get("Authorization"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	pump := &TinybirdPump{}
+	err := pump.Init(map[string]interface{}{
+		"token":       "token",
+		"data_source": "api_requests",
+		"url":         server.URL + "/",
+		"wait":        true,
+		"fields":      []string{"api_id", "response_code"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{
+		analytics.AnalyticsRecord{APIID: "1", ResponseCode: 200},
+		analytics.AnalyticsRecord{APIID: "2", ResponseCode: 500},
+	}
+	if err := pump.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "{\"api_id\":\"1\",\"response_code\":200}\n{\"api_id\":\"2\",\"response_code\":500}\n"
+	if len(bodies) != 1 || bodies[0] != expected {
+		t.Errorf("expected a NDJSON row per record, got %q", strings.Join(bodies, ""))
+	}
+}
+
+func TestTinybirdInitInvalidDataSource(t *testing.T) {
+	pump := &TinybirdPump{}
+	if err := pump.Init(map[string]interface{}{"token": "token", "data_source": "requests&x=1"}); err == nil {
+		t.Error("expected an invalid data source to fail")
+	}
+}
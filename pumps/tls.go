@@ -0,0 +1,180 @@
+package pumps
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// tlsVersions are the TLS versions of min_version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConf is the tls block of the pumps connecting to their backend over TLS. It's shared by all of them, while the
+// ssl_ options they had before it are still honoured for the settings the block leaves unset.
+type TLSConf struct {
+	// CAFile is a PEM file with the CA certificates the server is verified with, the system ones by default
+	CAFile string `json:"ca_file" mapstructure:"ca_file"`
+	// CertFile and KeyFile are the PEM files of the client certificate and its key, for mutual TLS
+	CertFile string `json:"cert_file" mapstructure:"cert_file"`
+	KeyFile  string `json:"key_file" mapstructure:"key_file"`
+	// ServerName is the name the server certificate is verified for, the host of the backend by default
+	ServerName string `json:"server_name" mapstructure:"server_name"`
+	// MinVersion is the minimum TLS version, 1.0, 1.1, 1.2 or 1.3
+	MinVersion string `json:"min_version" mapstructure:"min_version"`
+	// CipherSuites are the names of the cipher suites allowed up to TLS 1.2, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	CipherSuites       []string `json:"cipher_suites" mapstructure:"cipher_suites"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify" mapstructure:"insecure_skip_verify"`
+}
+
+// TLSDefaults are the minimum TLS version and the cipher suites of all the outbound TLS connections, unless the tls
+// block of the pump sets them
+type TLSDefaults struct {
+	MinVersion   string   `json:"min_version"`
+	CipherSuites []string `json:"cipher_suites"`
+}
+
+// fipsCipherSuites are the cipher suites allowed in FIPS mode
+var fipsCipherSuites = map[uint16]bool{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   true,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: true,
+}
+
+// tlsDefaults holds the minimum version and the cipher suites set by SetTLSDefaults
+var tlsDefaults = &tls.Config{}
+
+// SetTLSDefaults validates and sets the TLS defaults. They're applied to the TLS config of the pumps connections and to
+// http.DefaultTransport, used by the pumps without a transport of their own. In FIPS mode the minimum version is 1.2 by
+// default.
+func SetTLSDefaults(defaults TLSDefaults) error {
+	config := &tls.Config{}
+	if err := setTLSVersion(config, defaults.MinVersion, defaults.CipherSuites); err != nil {
+		return err
+	}
+	if FIPSMode && config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	tlsDefaults = config
+
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		ApplyTLSDefaults(transport.TLSClientConfig)
+	}
+	return nil
+}
+
+// ApplyTLSDefaults sets the minimum version and the cipher suites of the TLS defaults in tlsConfig, unless it already
+// sets them
+func ApplyTLSDefaults(tlsConfig *tls.Config) {
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tlsDefaults.MinVersion
+	}
+	if len(tlsConfig.CipherSuites) == 0 {
+		tlsConfig.CipherSuites = tlsDefaults.CipherSuites
+	}
+}
+
+// setTLSVersion sets the minimum version and the cipher suites, given by name, in tlsConfig. In FIPS mode it fails
+// for the versions and cipher suites which aren't FIPS-approved.
+func setTLSVersion(tlsConfig *tls.Config, minVersion string, cipherSuites []string) error {
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return fmt.Errorf("unknown TLS version %q, it must be 1.0, 1.1, 1.2 or 1.3", minVersion)
+		}
+		if FIPSMode && version < tls.VersionTLS12 {
+			return fmt.Errorf("TLS version %s isn't allowed in FIPS mode, it must be 1.2 or 1.3", minVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(cipherSuites) > 0 {
+		ids := map[string]uint16{}
+		for _, suite := range tls.CipherSuites() {
+			ids[suite.Name] = suite.ID
+		}
+		tlsConfig.CipherSuites = make([]uint16, 0, len(cipherSuites))
+		for _, name := range cipherSuites {
+			id, ok := ids[name]
+			if !ok {
+				return fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			if FIPSMode && !fipsCipherSuites[id] {
+				return fmt.Errorf("cipher suite %q isn't allowed in FIPS mode", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+	return nil
+}
+
+// IsSet returns whether any option of the block is set
+func (c TLSConf) IsSet() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || c.ServerName != "" || c.MinVersion != "" ||
+		len(c.CipherSuites) > 0 || c.InsecureSkipVerify
+}
+
+// withLegacy returns the block with the options it leaves unset taken from legacy, the ssl_ options of the pump
+func (c TLSConf) withLegacy(legacy TLSConf) TLSConf {
+	if c.CAFile == "" {
+		c.CAFile = legacy.CAFile
+	}
+	if c.CertFile == "" && c.KeyFile == "" {
+		c.CertFile, c.KeyFile = legacy.CertFile, legacy.KeyFile
+	}
+	if c.ServerName == "" {
+		c.ServerName = legacy.ServerName
+	}
+	if c.MinVersion == "" {
+		c.MinVersion = legacy.MinVersion
+	}
+	if len(c.CipherSuites) == 0 {
+		c.CipherSuites = legacy.CipherSuites
+	}
+	c.InsecureSkipVerify = c.InsecureSkipVerify || legacy.InsecureSkipVerify
+	return c
+}
+
+// ClientConfig returns the client TLS config of the block, verifying the server for serverName unless server_name is
+// set. The TLS defaults apply to the minimum version and the cipher suites the block leaves unset.
+func (c TLSConf) ClientConfig(serverName string) (*tls.Config, error) {
+	if c.ServerName != "" {
+		serverName = c.ServerName
+	}
+	tlsConfig, err := newTLSConfig(serverName, c.CAFile, c.CertFile, c.KeyFile, c.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setTLSVersion(tlsConfig, c.MinVersion, c.CipherSuites); err != nil {
+		return nil, err
+	}
+	ApplyTLSDefaults(tlsConfig)
+	return tlsConfig, nil
+}
+
+// httpClient returns an HTTP client with the timeout, using the client TLS config of the block when it's set
+func (c TLSConf) httpClient(timeout time.Duration) (*http.Client, error) {
+	client := &http.Client{Timeout: timeout}
+	if !c.IsSet() {
+		return client, nil
+	}
+
+	tlsConfig, err := c.ClientConfig("")
+	if err != nil {
+		return nil, fmt.Errorf("invalid tls configuration: %v", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client.Transport = transport
+	return client, nil
+}
@@ -0,0 +1,95 @@
+package pumps
+
+import (
+	"crypto/tls"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestTLSConfWithLegacy(t *testing.T) {
+	conf := TLSConf{CAFile: "ca.pem", MinVersion: "1.2"}.withLegacy(TLSConf{
+		CAFile:             "legacy-ca.pem",
+		CertFile:           "cert.pem",
+		KeyFile:            "key.pem",
+		InsecureSkipVerify: true,
+	})
+	expected := TLSConf{CAFile: "ca.pem", CertFile: "cert.pem", KeyFile: "key.pem", MinVersion: "1.2", InsecureSkipVerify: true}
+	if !reflect.DeepEqual(conf, expected) {
+		t.Errorf("expected the block completed with the legacy options, got %+v", conf)
+	}
+	if (TLSConf{}).IsSet() || !conf.IsSet() {
+		t.Error("expected only the block with options to be set")
+	}
+}
+
+func TestTLSConfClientConfig(t *testing.T) {
+	tlsConfig, err := TLSConf{MinVersion: "1.2"}.ClientConfig("backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.ServerName != "backend" {
+		t.Errorf("unexpected TLS config %+v", tlsConfig)
+	}
+
+	tlsConfig, err = TLSConf{ServerName: "other"}.ClientConfig("backend")
+	if err != nil || tlsConfig.ServerName != "other" {
+		t.Errorf("expected server_name to replace the backend host, got %v %v", tlsConfig, err)
+	}
+
+	if _, err := (TLSConf{MinVersion: "1.4"}).ClientConfig(""); err == nil {
+		t.Error("expected an unknown TLS version to fail")
+	}
+	if _, err := (TLSConf{CAFile: "missing.pem"}).ClientConfig(""); err == nil {
+		t.Error("expected a missing CA file to fail")
+	}
+}
+
+func TestTLSDefaults(t *testing.T) {
+	defer func() {
+		tlsDefaults = &tls.Config{}
+		http.DefaultTransport.(*http.Transport).TLSClientConfig = nil
+	}()
+
+	if err := SetTLSDefaults(TLSDefaults{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}); err == nil {
+		t.Error("expected an insecure cipher suite to fail")
+	}
+
+	err := SetTLSDefaults(TLSDefaults{MinVersion: "1.2", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transportConfig := http.DefaultTransport.(*http.Transport).TLSClientConfig
+	if transportConfig == nil || transportConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected the defaults in the default transport, got %+v", transportConfig)
+	}
+
+	tlsConfig, err := TLSConf{}.ClientConfig("backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 || !reflect.DeepEqual(tlsConfig.CipherSuites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}) {
+		t.Errorf("expected the defaults to apply, got %+v", tlsConfig)
+	}
+
+	tlsConfig, err = TLSConf{MinVersion: "1.3"}.ClientConfig("backend")
+	if err != nil || tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("expected the block to override the defaults, got %v %v", tlsConfig, err)
+	}
+}
+
+func TestTLSFIPSMode(t *testing.T) {
+	if !FIPSMode {
+		t.Skip("FIPS mode needs GOEXPERIMENT=boringcrypto")
+	}
+
+	if _, err := (TLSConf{MinVersion: "1.1"}).ClientConfig(""); err == nil {
+		t.Error("expected TLS 1.1 to fail in FIPS mode")
+	}
+	if _, err := (TLSConf{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"}}).ClientConfig(""); err == nil {
+		t.Error("expected a cipher suite which isn't FIPS-approved to fail in FIPS mode")
+	}
+	if _, err := (TLSConf{MinVersion: "1.2", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}).ClientConfig(""); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,34 @@
+package pumps
+
+import (
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-pump/analytics"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// decodeUptimeData decodes the uptime reports of the Gateway host checker, skipping the ones that can't be decoded
+func decodeUptimeData(log *logrus.Entry, data []interface{}) []analytics.UptimeReportData {
+	reports := make([]analytics.UptimeReportData, 0, len(data))
+	for _, v := range data {
+		decoded := analytics.UptimeReportData{}
+		if err := msgpack.Unmarshal([]byte(v.(string)), &decoded); err != nil {
+			log.Error("Couldn't unmarshal uptime data: ", err)
+			continue
+		}
+		reports = append(reports, decoded)
+	}
+	return reports
+}
+
+// uptimeMapping returns the fields of an uptime report, named like the ones of the analytics records
+func uptimeMapping(report analytics.UptimeReportData) map[string]interface{} {
+	return map[string]interface{}{
+		"url":             report.URL,
+		"request_time_ms": report.RequestTime,
+		"response_code":   report.ResponseCode,
+		"tcp_error":       report.TCPError,
+		"server_error":    report.ServerError,
+		"api_id":          report.APIID,
+		"org_id":          report.OrgID,
+	}
+}
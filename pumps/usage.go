@@ -0,0 +1,458 @@
+package pumps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+// UsagePump sums the hits of every API key per billing period, the raw material of usage based billing, and writes
+// the usage to MongoDB, posts it to a webhook or reports it to Stripe or Chargebee
+type UsagePump struct {
+	conf      *UsageConf
+	dbSession *mgo.Session
+	client    *http.Client
+	CommonPumpConfig
+}
+
+var usagePrefix = "usage-pump"
+var usageDefaultENV = PUMPS_ENV_PREFIX + "_USAGE" + PUMPS_ENV_META_PREFIX
+
+const (
+	usageHourPeriod  = "hour"
+	usageDayPeriod   = "day"
+	usageMonthPeriod = "month"
+
+	usageMongoBackend     = "mongo"
+	usageWebhookBackend   = "webhook"
+	usageStripeBackend    = "stripe"
+	usageChargebeeBackend = "chargebee"
+
+	defaultUsageCollectionName = "tyk_key_usage"
+	defaultUsagePlanTagPrefix  = "policy-"
+	defaultStripeURL           = "https://api.stripe.com"
+)
+
+// UsageConf configures the usage pump. The mongo options are only used by the mongo backend.
+type UsageConf struct {
+	BaseMongoConf `mapstructure:",squash"`
+	// Period is the billing period the hits are summed by: hour, day or month, the default
+	Period string `mapstructure:"period"`
+	// Backend is where the usage is written: mongo, the default, webhook, stripe or chargebee
+	Backend string `mapstructure:"backend"`
+	// ByAPI sums the hits of every key by API too
+	ByAPI bool `mapstructure:"by_api"`
+	// ByPlan sums the hits of every key by plan too, the value of the tag of the record starting with PlanTagPrefix
+	ByPlan bool `mapstructure:"by_plan"`
+	// PlanTagPrefix is the prefix of the tag with the plan of the records, policy- by default
+	PlanTagPrefix string `mapstructure:"plan_tag_prefix"`
+	// CustomerTagPrefix is the prefix of the tag with the billing customer of the records. Without it, or when a record
+	// has no such tag, the customer is the alias of the key.
+	CustomerTagPrefix string `mapstructure:"customer_tag_prefix"`
+	// CollectionName is the collection the usage is written to, tyk_key_usage by default
+	CollectionName string            `mapstructure:"collection_name"`
+	WebhookURL     string            `mapstructure:"webhook_url"`
+	WebhookHeaders map[string]string `mapstructure:"webhook_headers"`
+	// StripeAPIKey is the secret key the meter events are sent to Stripe with
+	StripeAPIKey string `mapstructure:"stripe_api_key"`
+	// StripeEventName is the event name of the Stripe meter the hits are reported to
+	StripeEventName string `mapstructure:"stripe_event_name"`
+	// StripeURL is the URL of the Stripe API, https://api.stripe.com by default
+	StripeURL string `mapstructure:"stripe_url"`
+	// ChargebeeURL is the URL of the Chargebee site, like https://acme.chargebee.com
+	ChargebeeURL    string `mapstructure:"chargebee_url"`
+	ChargebeeAPIKey string `mapstructure:"chargebee_api_key"`
+	// ChargebeeItemPriceID is the metered item price the hits are reported to. When empty, it's the plan of the usage.
+	ChargebeeItemPriceID string `mapstructure:"chargebee_item_price_id"`
+}
+
+// KeyUsage is the usage of an API key, or of an API key in an API, in a billing period
+type KeyUsage struct {
+	ID            string    `bson:"_id" json:"id"`
+	OrgID         string    `bson:"org_id" json:"org_id"`
+	APIKey        string    `bson:"api_key" json:"api_key"`
+	Alias         string    `bson:"alias,omitempty" json:"alias,omitempty"`
+	APIID         string    `bson:"api_id,omitempty" json:"api_id,omitempty"`
+	Plan          string    `bson:"plan,omitempty" json:"plan,omitempty"`
+	Customer      string    `bson:"customer,omitempty" json:"customer,omitempty"`
+	Period        string    `bson:"period" json:"period"`
+	PeriodStart   time.Time `bson:"period_start" json:"period_start"`
+	Hits          int64     `bson:"hits" json:"hits"`
+	Success       int64     `bson:"success" json:"success"`
+	Errors        int64     `bson:"errors" json:"errors"`
+	RequestBytes  int64     `bson:"request_bytes" json:"request_bytes"`
+	ResponseBytes int64     `bson:"response_bytes" json:"response_bytes"`
+	LastTime      time.Time `bson:"last_time" json:"last_time"`
+}
+
+func (p *UsagePump) New() Pump {
+	newPump := UsagePump{}
+	return &newPump
+}
+
+func (p *UsagePump) GetName() string {
+	return "Usage Pump"
+}
+
+// Close closes the session to MongoDB
+func (p *UsagePump) Close() error {
+	if p.dbSession != nil {
+		p.dbSession.Close()
+	}
+	return nil
+}
+
+func (p *UsagePump) GetEnvPrefix() string {
+	return p.conf.EnvPrefix
+}
+
+func (p *UsagePump) Init(config interface{}) error {
+	p.conf = &UsageConf{}
+	p.log = p.newLogger(usagePrefix)
+
+	if err := decodePumpConfig(p, p.log, config, &p.conf); err != nil {
+		p.log.Fatal("Failed to decode configuration: ", err)
+	}
+
+	processPumpEnvVars(p, p.log, p.conf, usageDefaultENV)
+
+	switch p.conf.Period {
+	case "":
+		p.conf.Period = usageMonthPeriod
+	case usageHourPeriod, usageDayPeriod, usageMonthPeriod:
+	default:
+		return fmt.Errorf("invalid period %q, must be hour, day or month", p.conf.Period)
+	}
+
+	switch p.conf.Backend {
+	case "", usageMongoBackend:
+		p.conf.Backend = usageMongoBackend
+		if p.conf.CollectionName == "" {
+			p.conf.CollectionName = defaultUsageCollectionName
+		}
+		p.connect()
+		p.log.Debug("MongoDB DB CS: ", p.conf.GetBlurredURL())
+	case usageWebhookBackend:
+		if p.conf.WebhookURL == "" {
+			return errors.New("webhook_url not set")
+		}
+		p.client = &http.Client{Timeout: 30 * time.Second}
+	case usageStripeBackend:
+		if p.conf.StripeAPIKey == "" || p.conf.StripeEventName == "" {
+			return errors.New("stripe_api_key and stripe_event_name must be set")
+		}
+		if p.conf.StripeURL == "" {
+			p.conf.StripeURL = defaultStripeURL
+		}
+		p.client = &http.Client{Timeout: 30 * time.Second}
+	case usageChargebeeBackend:
+		if p.conf.ChargebeeURL == "" || p.conf.ChargebeeAPIKey == "" {
+			return errors.New("chargebee_url and chargebee_api_key must be set")
+		}
+		if p.conf.ChargebeeItemPriceID == "" && !p.conf.ByPlan {
+			return errors.New("chargebee_item_price_id must be set unless the usage is summed by plan")
+		}
+		p.client = &http.Client{Timeout: 30 * time.Second}
+	default:
+		return fmt.Errorf("invalid backend %q, must be mongo, webhook, stripe or chargebee", p.conf.Backend)
+	}
+
+	if p.conf.PlanTagPrefix == "" {
+		p.conf.PlanTagPrefix = defaultUsagePlanTagPrefix
+	}
+
+	p.log.Info(p.GetName() + " Initialized")
+	return nil
+}
+
+func (p *UsagePump) connect() {
+	dialInfo, err := mongoDialInfo(p.conf.BaseMongoConf)
+	if err != nil {
+		p.log.Panic("Mongo URL is invalid: ", err)
+	}
+
+	if p.timeout > 0 {
+		dialInfo.Timeout = time.Second * time.Duration(p.timeout)
+	}
+
+	p.dbSession, err = mgo.DialWithInfo(dialInfo)
+	for err != nil {
+		p.log.WithError(err).WithField("dialinfo", dialInfo).Error("Mongo connection failed. Retrying.")
+		time.Sleep(5 * time.Second)
+		p.dbSession, err = mgo.DialWithInfo(dialInfo)
+	}
+}
+
+func (p *UsagePump) WriteData(ctx context.Context, data []interface{}) error {
+	p.log.Debug("Attempting to write ", len(data), " records...")
+
+	usage := summarizeUsage(data, *p.conf)
+	if len(usage) == 0 {
+		return nil
+	}
+
+	var err error
+	switch p.conf.Backend {
+	case usageWebhookBackend:
+		err = p.postUsage(ctx, usage)
+	case usageStripeBackend:
+		err = p.reportUsage(ctx, usage, p.stripeMeterEvent)
+	case usageChargebeeBackend:
+		err = p.reportUsage(ctx, usage, p.chargebeeUsage)
+	default:
+		err = p.upsertUsage(ctx, usage)
+	}
+	if err != nil {
+		p.log.Error("Failed to write the usage: ", err)
+		return err
+	}
+
+	p.log.Info("Purged ", len(data), " records into the usage of ", len(usage), " keys...")
+	return nil
+}
+
+// upsertUsage adds the usage to the one already stored for the same keys and periods
+func (p *UsagePump) upsertUsage(ctx context.Context, usage []KeyUsage) error {
+	sess := p.dbSession.Copy()
+	defer sess.Close()
+	c := sess.DB("").C(p.conf.CollectionName)
+
+	for _, u := range usage {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		update := bson.M{
+			"$inc": bson.M{
+				"hits":           u.Hits,
+				"success":        u.Success,
+				"errors":         u.Errors,
+				"request_bytes":  u.RequestBytes,
+				"response_bytes": u.ResponseBytes,
+			},
+			"$max": bson.M{"last_time": u.LastTime},
+			"$setOnInsert": bson.M{
+				"org_id":       u.OrgID,
+				"api_key":      u.APIKey,
+				"api_id":       u.APIID,
+				"plan":         u.Plan,
+				"period":       u.Period,
+				"period_start": u.PeriodStart,
+			},
+		}
+		set := bson.M{}
+		if u.Alias != "" {
+			set["alias"] = u.Alias
+		}
+		if u.Customer != "" {
+			set["customer"] = u.Customer
+		}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+
+		if _, err := c.UpsertId(u.ID, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postUsage posts the usage of the purged records, which the webhook has to add to the usage it already got
+func (p *UsagePump) postUsage(ctx context.Context, usage []KeyUsage) error {
+	body, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.conf.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range p.conf.WebhookHeaders {
+		req.Header.Set(name, value)
+	}
+
+	return p.send(req, "webhook")
+}
+
+// reportUsage sends the usage of every customer with the request of newRequest. The usage without customer can't be
+// billed, so it's skipped.
+func (p *UsagePump) reportUsage(ctx context.Context, usage []KeyUsage, newRequest func(KeyUsage) (*http.Request, error)) error {
+	skipped := 0
+	for _, u := range usage {
+		if u.Customer == "" {
+			skipped++
+			continue
+		}
+		req, err := newRequest(u)
+		if err != nil {
+			return err
+		}
+		if err := p.send(req.WithContext(ctx), p.conf.Backend); err != nil {
+			return err
+		}
+	}
+	if skipped > 0 {
+		p.log.Warning("Skipped the usage of ", skipped, " keys without customer")
+	}
+	return nil
+}
+
+// stripeMeterEvent returns the request sending the hits of the usage to the Stripe meter as a meter event. Its
+// identifier is derived from the usage, so Stripe ignores the events sent again when a purge is retried.
+func (p *UsagePump) stripeMeterEvent(u KeyUsage) (*http.Request, error) {
+	form := url.Values{}
+	form.Set("event_name", p.conf.StripeEventName)
+	form.Set("identifier", fmt.Sprintf("%s:%d", u.ID, u.LastTime.UnixNano()))
+	form.Set("timestamp", strconv.FormatInt(u.LastTime.Unix(), 10))
+	form.Set("payload[stripe_customer_id]", u.Customer)
+	form.Set("payload[value]", strconv.FormatInt(u.Hits, 10))
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(p.conf.StripeURL, "/")+"/v1/billing/meter_events", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+p.conf.StripeAPIKey)
+	return req, nil
+}
+
+// chargebeeUsage returns the request adding the hits of the usage to the usage of the Chargebee subscription of the
+// customer, for the metered item price of the configuration, or of the plan
+func (p *UsagePump) chargebeeUsage(u KeyUsage) (*http.Request, error) {
+	itemPriceID := p.conf.ChargebeeItemPriceID
+	if itemPriceID == "" {
+		itemPriceID = u.Plan
+	}
+	form := url.Values{}
+	form.Set("item_price_id", itemPriceID)
+	form.Set("quantity", strconv.FormatInt(u.Hits, 10))
+	form.Set("usage_date", strconv.FormatInt(u.LastTime.Unix(), 10))
+
+	endpoint := strings.TrimSuffix(p.conf.ChargebeeURL, "/") + "/api/v2/subscriptions/" + url.PathEscape(u.Customer) + "/usages"
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(p.conf.ChargebeeAPIKey, "")
+	return req, nil
+}
+
+// send sends the request to the backend, failing unless it responds with a 2xx status
+func (p *UsagePump) send(req *http.Request, backend string) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s responded with status %d: %s", backend, resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// summarizeUsage sums the hits of the records by org, API key, billing period, and API and plan when the configuration
+// sums by them, sorted by ID. The records without API key are skipped.
+func summarizeUsage(data []interface{}, conf UsageConf) []KeyUsage {
+	period := conf.Period
+	usageByID := map[string]*KeyUsage{}
+	for _, v := range data {
+		record, ok := v.(analytics.AnalyticsRecord)
+		if !ok || record.APIKey == "" {
+			continue
+		}
+
+		start := usagePeriodStart(record.TimeStamp, period)
+		apiID := ""
+		if conf.ByAPI {
+			apiID = record.APIID
+		}
+		id := fmt.Sprintf("%s:%s:%s:%s:%s", record.OrgID, record.APIKey, apiID, period, start.Format(time.RFC3339))
+		plan := ""
+		if conf.ByPlan {
+			plan, _ = usageTag(record.Tags, conf.PlanTagPrefix)
+			id += ":" + plan
+		}
+
+		u, found := usageByID[id]
+		if !found {
+			u = &KeyUsage{ID: id, OrgID: record.OrgID, APIKey: record.APIKey, APIID: apiID, Plan: plan, Period: period, PeriodStart: start}
+			usageByID[id] = u
+		}
+
+		u.Hits++
+		if record.ResponseCode >= http.StatusBadRequest {
+			u.Errors++
+		} else {
+			u.Success++
+		}
+		u.RequestBytes += record.ContentLength
+		u.ResponseBytes += record.ResponseContentLength
+		if record.Alias != "" {
+			u.Alias = record.Alias
+		}
+		if customer, ok := usageTag(record.Tags, conf.CustomerTagPrefix); ok {
+			u.Customer = customer
+		} else if u.Customer == "" {
+			u.Customer = record.Alias
+		}
+		if record.TimeStamp.After(u.LastTime) {
+			u.LastTime = record.TimeStamp
+		}
+	}
+
+	usage := make([]KeyUsage, 0, len(usageByID))
+	for _, u := range usageByID {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].ID < usage[j].ID
+	})
+	return usage
+}
+
+// usageTag returns the rest of the first tag starting with the prefix
+func usageTag(tags []string, prefix string) (string, bool) {
+	if prefix == "" {
+		return "", false
+	}
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix), true
+		}
+	}
+	return "", false
+}
+
+// usagePeriodStart returns the start of the billing period of t, in UTC
+func usagePeriodStart(t time.Time, period string) time.Time {
+	t = t.UTC()
+	switch period {
+	case usageHourPeriod:
+		return t.Truncate(time.Hour)
+	case usageDayPeriod:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
@@ -0,0 +1,195 @@
+package pumps
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk-pump/analytics"
+)
+
+func TestUsagePeriodStart(t *testing.T) {
+	ts := time.Date(2021, 3, 15, 13, 45, 10, 0, time.FixedZone("CET", 3600))
+	tests := map[string]time.Time{
+		usageHourPeriod:  time.Date(2021, 3, 15, 12, 0, 0, 0, time.UTC),
+		usageDayPeriod:   time.Date(2021, 3, 15, 0, 0, 0, 0, time.UTC),
+		usageMonthPeriod: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for period, expected := range tests {
+		if start := usagePeriodStart(ts, period); !start.Equal(expected) {
+			t.Errorf("expected the %s to start at %v, got %v", period, expected, start)
+		}
+	}
+}
+
+func TestSummarizeUsage(t *testing.T) {
+	ts := time.Date(2021, 3, 15, 13, 0, 0, 0, time.UTC)
+	data := []interface{}{
+		analytics.AnalyticsRecord{OrgID: "org", APIKey: "key", APIID: "api1", ResponseCode: 200, ContentLength: 10, ResponseContentLength: 100, TimeStamp: ts},
+		analytics.AnalyticsRecord{OrgID: "org", APIKey: "key", APIID: "api2", Alias: "alice", ResponseCode: 500, ResponseContentLength: 50, TimeStamp: ts.Add(time.Minute)},
+		analytics.AnalyticsRecord{OrgID: "org", APIKey: "key", APIID: "api1", ResponseCode: 200, TimeStamp: ts.AddDate(0, 1, 0)},
+		analytics.AnalyticsRecord{OrgID: "org", APIID: "keyless", ResponseCode: 200, TimeStamp: ts},
+	}
+
+	usage := summarizeUsage(data, UsageConf{Period: usageMonthPeriod})
+	if len(usage) != 2 {
+		t.Fatalf("expected the usage of 2 months, got %+v", usage)
+	}
+	march := usage[0]
+	if march.ID != "org:key::month:2021-03-01T00:00:00Z" {
+		t.Error("unexpected ID", march.ID)
+	}
+	if march.Hits != 2 || march.Success != 1 || march.Errors != 1 {
+		t.Errorf("expected 2 hits, 1 of them failed, got %+v", march)
+	}
+	if march.RequestBytes != 10 || march.ResponseBytes != 150 {
+		t.Errorf("unexpected bytes %+v", march)
+	}
+	if march.Alias != "alice" || !march.LastTime.Equal(ts.Add(time.Minute)) {
+		t.Errorf("unexpected alias or last time %+v", march)
+	}
+
+	if usage := summarizeUsage(data, UsageConf{Period: usageMonthPeriod, ByAPI: true}); len(usage) != 3 || usage[0].APIID != "api1" || usage[2].APIID != "api2" {
+		t.Errorf("expected the usage of every API, got %+v", usage)
+	}
+}
+
+func TestUsagePumpWebhook(t *testing.T) {
+	var received []KeyUsage
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Error("the webhook headers weren't sent")
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	pump := &UsagePump{}
+	err := pump.Init(map[string]interface{}{
+		"backend":         "webhook",
+		"period":          "day",
+		"webhook_url":     server.URL,
+		"webhook_headers": map[string]string{"Authorization": "Bearer secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []interface{}{analytics.AnalyticsRecord{OrgID: "org", APIKey: "key", ResponseCode: 200, TimeStamp: time.Now()}}
+	if err := pump.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0].Hits != 1 || received[0].Period != usageDayPeriod {
+		t.Errorf("unexpected usage %+v", received)
+	}
+
+	status = http.StatusBadGateway
+	if err := pump.WriteData(context.Background(), data); err == nil {
+		t.Error("expected the failed webhook to fail the purge")
+	}
+
+	if err := (&UsagePump{}).Init(map[string]interface{}{"backend": "webhook", "period": "week", "webhook_url": server.URL}); err == nil {
+		t.Error("expected an invalid period to fail")
+	}
+}
+
+func TestSummarizeUsageByPlan(t *testing.T) {
+	ts := time.Date(2021, 3, 15, 13, 0, 0, 0, time.UTC)
+	data := []interface{}{
+		analytics.AnalyticsRecord{OrgID: "org", APIKey: "key", Alias: "alice", Tags: []string{"policy-gold", "customer-cus_1"}, TimeStamp: ts},
+		analytics.AnalyticsRecord{OrgID: "org", APIKey: "key", Alias: "alice", Tags: []string{"policy-gold"}, TimeStamp: ts},
+		analytics.AnalyticsRecord{OrgID: "org", APIKey: "key", Alias: "alice", Tags: []string{"policy-silver"}, TimeStamp: ts},
+	}
+
+	usage := summarizeUsage(data, UsageConf{Period: usageMonthPeriod, ByPlan: true, PlanTagPrefix: "policy-", CustomerTagPrefix: "customer-"})
+	if len(usage) != 2 || usage[0].Plan != "gold" || usage[0].Hits != 2 || usage[1].Plan != "silver" {
+		t.Fatalf("expected the usage of every plan, got %+v", usage)
+	}
+	if usage[0].Customer != "cus_1" || usage[1].Customer != "alice" {
+		t.Errorf("expected the customer of the tag, or the alias of the key, got %+v", usage)
+	}
+}
+
+func TestUsagePumpBilling(t *testing.T) {
+	var requests []*http.Request
+	var forms []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		form := map[string]string{}
+		for name := range r.PostForm {
+			form[name] = r.PostForm.Get(name)
+		}
+		requests = append(requests, r)
+		forms = append(forms, form)
+	}))
+	defer server.Close()
+
+	ts := time.Date(2021, 3, 15, 13, 0, 0, 0, time.UTC)
+	data := []interface{}{
+		analytics.AnalyticsRecord{OrgID: "org", APIKey: "key1", Tags: []string{"policy-gold", "customer-cus_1"}, TimeStamp: ts},
+		analytics.AnalyticsRecord{OrgID: "org", APIKey: "key1", Tags: []string{"policy-gold", "customer-cus_1"}, TimeStamp: ts},
+		analytics.AnalyticsRecord{OrgID: "org", APIKey: "key2", Tags: []string{"policy-gold"}, TimeStamp: ts},
+	}
+
+	stripe := &UsagePump{}
+	err := stripe.Init(map[string]interface{}{
+		"backend":             "stripe",
+		"stripe_url":          server.URL,
+		"stripe_api_key":      "sk_test",
+		"stripe_event_name":   "api_requests",
+		"customer_tag_prefix": "customer-",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stripe.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("expected the usage without customer to be skipped, got %d requests", len(requests))
+	}
+	if requests[0].URL.Path != "/v1/billing/meter_events" || requests[0].Header.Get("Authorization") != "Bearer sk_test" {
+		t.Errorf("unexpected Stripe request %s %v", requests[0].URL, requests[0].Header)
+	}
+	if f := forms[0]; f["event_name"] != "api_requests" || f["payload[stripe_customer_id]"] != "cus_1" || f["payload[value]"] != "2" || f["identifier"] == "" {
+		t.Errorf("unexpected meter event %v", f)
+	}
+
+	requests, forms = nil, nil
+	chargebee := &UsagePump{}
+	err = chargebee.Init(map[string]interface{}{
+		"backend":             "chargebee",
+		"by_plan":             true,
+		"chargebee_url":       server.URL,
+		"chargebee_api_key":   "cb_test",
+		"customer_tag_prefix": "customer-",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chargebee.WriteData(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].URL.Path != "/api/v2/subscriptions/cus_1/usages" {
+		t.Fatalf("unexpected Chargebee requests %v", requests)
+	}
+	if user, _, _ := requests[0].BasicAuth(); user != "cb_test" {
+		t.Error("expected the API key to be sent as the user")
+	}
+	if f := forms[0]; f["item_price_id"] != "gold" || f["quantity"] != "2" || f["usage_date"] != "1615813200" {
+		t.Errorf("unexpected usage %v", f)
+	}
+
+	if err := (&UsagePump{}).Init(map[string]interface{}{"backend": "chargebee", "chargebee_url": server.URL, "chargebee_api_key": "cb_test"}); err == nil {
+		t.Error("expected the Chargebee backend without item price nor plans to fail")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/TykTechnologies/logrus"
+	"github.com/TykTechnologies/tyk-pump/analytics"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	msgpack "gopkg.in/vmihailenco/msgpack.v2"
+)
+
+var replayPrefix = "replay"
+
+var (
+	replayCmd       = kingpin.Command("replay", "write the analytics records of a dump file through the configured pumps")
+	replayFile      = replayCmd.Flag("file", "path to the dump file").Required().String()
+	replayFormat    = replayCmd.Flag("format", "format of the dump file: json, one record per line, or msgpack, the records as stored in redis one after the other").Default("json").Enum("json", "msgpack")
+	replayBatchSize = replayCmd.Flag("batch-size", "number of records sent to the pumps at a time").Default("1000").Int()
+)
+
+// recordDecoder decodes the next record of a dump, returning io.EOF once there are no more records
+type recordDecoder func(record *analytics.AnalyticsRecord) error
+
+// runReplay writes the records of the --file dump through the configured pumps, keeping their original timestamps
+func runReplay() {
+	replayLog := log.WithFields(logrus.Fields{
+		"prefix": replayPrefix,
+		"file":   *replayFile,
+	})
+
+	if *replayBatchSize <= 0 {
+		replayLog.Fatal("--batch-size must be greater than 0")
+	}
+
+	file, err := os.Open(*replayFile)
+	if err != nil {
+		replayLog.Fatal("Couldn't open the dump file: ", err)
+	}
+	defer file.Close()
+
+	replayed, err := replayRecords(newRecordDecoder(file, *replayFormat), *replayBatchSize, SystemConfig.MaxBatchSizeBytes, pumpsOmitDetails(SystemConfig.OmitDetailedRecording), func(batch []interface{}) {
+		writeToPumps(batch, nil, time.Now(), SystemConfig.PurgeDelay)
+	})
+	flushPumps()
+	if err != nil {
+		replayLog.Fatal("Replay stopped after ", replayed, " records: ", err)
+	}
+
+	replayLog.Info("Replay finished, ", replayed, " records replayed")
+}
+
+// newRecordDecoder returns the decoder of the records of r in the given format
+func newRecordDecoder(r io.Reader, format string) recordDecoder {
+	if format == "msgpack" {
+		decoder := msgpack.NewDecoder(bufio.NewReader(r))
+		return func(record *analytics.AnalyticsRecord) error {
+			return decoder.Decode(record)
+		}
+	}
+
+	decoder := json.NewDecoder(r)
+	return func(record *analytics.AnalyticsRecord) error {
+		return decoder.Decode(record)
+	}
+}
+
+// replayRecords decodes all the records and hands them to write in batches of batchSize records, and of up to maxBytes
+// when it's set, returning the number of records replayed. The duplicated records are skipped when deduplication is
+// enabled.
+func replayRecords(decode recordDecoder, batchSize int, maxBytes int64, omitDetails bool, write func([]interface{})) (int, error) {
+	replayed := 0
+	batch := make([]interface{}, 0, batchSize)
+	var batchBytes int64
+	for {
+		record := analytics.AnalyticsRecord{}
+		err := decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		prepareRecord(&record, omitDetails)
+		if isDuplicate(&record) {
+			continue
+		}
+
+		size := recordSize(&record)
+		if maxBytes > 0 && len(batch) > 0 && batchBytes+size > maxBytes {
+			write(batch)
+			replayed += len(batch)
+			batch = make([]interface{}, 0, batchSize)
+			batchBytes = 0
+		}
+		batch = append(batch, record)
+		batchBytes += size
+
+		if len(batch) == batchSize {
+			write(batch)
+			replayed += len(batch)
+			batch = make([]interface{}, 0, batchSize)
+			batchBytes = 0
+		}
+	}
+
+	if len(batch) > 0 {
+		write(batch)
+		replayed += len(batch)
+	}
+	return replayed, nil
+}
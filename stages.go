@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/TykTechnologies/tyk-pump/pumps"
+)
+
+// The failure semantics of the pump stages
+const (
+	stageContinue = "continue"
+	stageAbort    = "abort"
+)
+
+// PumpStage is a group of pumps which write the batches in parallel, once the pumps of the previous stages wrote them
+type PumpStage struct {
+	// Pumps are the keys of the pumps of the stage in the pumps configuration
+	Pumps []string `json:"pumps"`
+	// OnFailure is what happens to a batch when a pump of the stage fails to write it: with abort the batch isn't
+	// written by the pumps of the next stages, with continue, the default, it is
+	OnFailure string `json:"on_failure"`
+}
+
+// pumpKeys are the keys of the loaded pumps in the pumps configuration, which tell their stage
+var pumpKeys = map[pumps.Pump]string{}
+
+// pumpGroup are the pumps of a stage
+type pumpGroup struct {
+	pumps []pumps.Pump
+	abort bool
+}
+
+// validatePumpStages checks the failure semantics of the stages, and that their pumps are configured in one stage only
+func validatePumpStages(stages []PumpStage, configs map[string]PumpConfig) error {
+	staged := map[string]bool{}
+	for i, stage := range stages {
+		if stage.OnFailure != "" && stage.OnFailure != stageContinue && stage.OnFailure != stageAbort {
+			return fmt.Errorf("invalid on_failure %q of stage %d, must be %s or %s", stage.OnFailure, i+1, stageContinue, stageAbort)
+		}
+		for _, key := range stage.Pumps {
+			if _, ok := configs[key]; !ok {
+				return fmt.Errorf("stage %d has the pump %s, which isn't configured", i+1, key)
+			}
+			if staged[key] {
+				return fmt.Errorf("the pump %s is in several stages", key)
+			}
+			staged[key] = true
+		}
+	}
+	return nil
+}
+
+// pumpGroups groups the pumps by stage, in the order of the stages. The pumps of no stage are grouped in a last stage,
+// which is the only one without stages.
+func pumpGroups(stages []PumpStage, all []pumps.Pump) []pumpGroup {
+	if len(stages) == 0 {
+		return []pumpGroup{{pumps: all}}
+	}
+
+	stageOf := map[string]int{}
+	groups := make([]pumpGroup, len(stages)+1)
+	for i, stage := range stages {
+		for _, key := range stage.Pumps {
+			stageOf[key] = i
+		}
+		groups[i].abort = stage.OnFailure == stageAbort
+	}
+	for _, pmp := range all {
+		i, ok := stageOf[pumpKeys[pmp]]
+		if !ok {
+			i = len(stages)
+		}
+		groups[i].pumps = append(groups[i].pumps, pmp)
+	}
+	return groups
+}
@@ -21,6 +21,10 @@ var redisLogPrefix = "redis"
 var ENV_REDIS_PREFIX = "TYK_PMP_REDIS"
 var ctx = context.Background()
 
+// ApplyTLSDefaults sets the TLS defaults in the TLS config of the Redis connections, main sets it to the ones of the
+// tls option
+var ApplyTLSDefaults = func(*tls.Config) {}
+
 type EnvMapString map[string]string
 
 func (e *EnvMapString) Decode(value string) error {
@@ -100,6 +104,7 @@ func NewRedisClusterPool(forceReconnect bool, config RedisStorageConfig) redis.U
 		tlsConfig = &tls.Config{
 			InsecureSkipVerify: config.RedisSSLInsecureSkipVerify,
 		}
+		ApplyTLSDefaults(tlsConfig)
 	}
 
 	var client redis.UniversalClient
@@ -270,6 +275,39 @@ func (r *RedisClusterStorageManager) GetAndDeleteSet(keyName string, chunkSize i
 	return result
 }
 
+// GetSet returns up to chunkSize values of the set without removing them, a chunkSize of 0 returns the whole set
+func (r *RedisClusterStorageManager) GetSet(keyName string, chunkSize int64) []interface{} {
+	r.ensureConnection()
+
+	vals, err := r.db.LRange(ctx, r.fixKey(keyName), 0, chunkSize-1).Result()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": redisLogPrefix,
+		}).Error("Could not read the set: ", err)
+		return nil
+	}
+
+	result := make([]interface{}, len(vals))
+	for i, v := range vals {
+		result[i] = v
+	}
+	return result
+}
+
+// GetSetLength returns the number of values of the set, 0 when it can't be read
+func (r *RedisClusterStorageManager) GetSetLength(keyName string) int64 {
+	r.ensureConnection()
+
+	length, err := r.db.LLen(ctx, r.fixKey(keyName)).Result()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"prefix": redisLogPrefix,
+		}).Error("Could not read the length of the set: ", err)
+		return 0
+	}
+	return length
+}
+
 // SetKey will create (or update) a key value in the store
 func (r *RedisClusterStorageManager) SetKey(keyName, session string, timeout int64) error {
 	log.Debug("[STORE] SET Raw key is: ", keyName)
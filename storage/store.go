@@ -7,6 +7,8 @@ type AnalyticsStorage interface {
 	GetName() string
 	Connect() bool
 	GetAndDeleteSet(setName string, chunkSize int64, expire time.Duration) []interface{}
+	GetSet(setName string, chunkSize int64) []interface{}
+	GetSetLength(setName string) int64
 }
 
 const (